@@ -53,8 +53,19 @@ func UplinkAirtime(frame *gw.UplinkFrame) (time.Duration, error) {
 }
 
 func DownlinkAirtime(frame *gw.DownlinkFrame) (time.Duration, error) {
-	payload := len(frame.Items[0].GetPhyPayload())
-	lora := frame.Items[0].GetTxInfo().GetModulation().GetLora()
+	airtime, err := DownlinkItemAirtime(frame.Items[0])
+	if err != nil {
+		return 0, err
+	}
+
+	return airtime * 8, nil // For downlinks airtime is x 8 because all 8 channels of a gateway are claimed during transmission
+}
+
+// DownlinkItemAirtime returns the time the gateway is on air to transmit the
+// downlink item.
+func DownlinkItemAirtime(item *gw.DownlinkFrameItem) (time.Duration, error) {
+	payload := len(item.GetPhyPayload())
+	lora := item.GetTxInfo().GetModulation().GetLora()
 	if lora == nil {
 		return 0, fmt.Errorf("packet is not LoRa, cannot calculate airtime")
 	}
@@ -77,10 +88,5 @@ func DownlinkAirtime(frame *gw.DownlinkFrame) (time.Duration, error) {
 	headerEnabled := true
 	lowDataRateOptimization := (sf >= 11)
 
-	airtime, err := airtime.CalculateLoRaAirtime(payload, sf, bandwidth, preamble, codingrate, headerEnabled, lowDataRateOptimization)
-	if err != nil {
-		return 0, err
-	}
-
-	return airtime * 8, nil // For downlinks airtime is x 8 because all 8 channels of a gateway are claimed during transmission
+	return airtime.CalculateLoRaAirtime(payload, sf, bandwidth, preamble, codingrate, headerEnabled, lowDataRateOptimization)
 }
@@ -39,7 +39,7 @@ the gateway.`,
 
 func init() {
 	rootCmd.PersistentFlags().String("config", "", "configuration file")
-	rootCmd.PersistentFlags().String("net", "main", "the network to load the default parameters for (\"dev\", \"test\", \"main\" or \"\")")
+	rootCmd.PersistentFlags().String("net", "main", "the network to load the default parameters for (\"dev\", \"test\", \"main\", \"private\" or \"\")")
 	rootCmd.PersistentFlags().String("default_frequency_plan", "", "default gateway frequency plan")
 
 	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
@@ -47,4 +47,13 @@ func init() {
 	}
 
 	rootCmd.AddCommand(forwarder.GatewayCmds)
+	rootCmd.AddCommand(forwarder.TopCmd)
+	rootCmd.AddCommand(forwarder.OperatorCmd)
+	rootCmd.AddCommand(forwarder.SelfTestCmd)
+	rootCmd.AddCommand(forwarder.ConformanceCmd)
+	rootCmd.AddCommand(forwarder.AccountingCmds)
+	rootCmd.AddCommand(forwarder.VersionCmd)
+	rootCmd.AddCommand(forwarder.SelfUpdateCmd)
+	rootCmd.AddCommand(forwarder.ReleaseCmds)
+	rootCmd.AddCommand(forwarder.ComplianceHoldCmds)
 }
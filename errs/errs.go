@@ -0,0 +1,101 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package errs defines the kinds of errors that are returned by the
+// packet-handling packages. Errors of the packages wrap one of these kinds,
+// embedders branch on the kind of a failure with errors.Is:
+//
+//	if errors.Is(err, errs.ErrNotFound) {
+//		...
+//	}
+//
+// Package specific errors, such as gateway.ErrNotFound, can still be used
+// with errors.Is to test for a specific failure.
+package errs
+
+import "errors"
+
+var (
+	// ErrNotFound indicates the requested entity doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists indicates the entity that is created already exists.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInvalidArgument indicates the request or configuration is invalid.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrFailedPrecondition indicates the request can't be handled in the
+	// current state, e.g. a required feature is not enabled.
+	ErrFailedPrecondition = errors.New("failed precondition")
+	// ErrUnavailable indicates a service is temporarily unavailable, the
+	// request can be retried.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrNotSupported indicates the operation is not supported.
+	ErrNotSupported = errors.New("not supported")
+	// ErrResourceExhausted indicates a queue or rate limit is exhausted.
+	ErrResourceExhausted = errors.New("resource exhausted")
+	// ErrNoRoute indicates no router is interested in a packet.
+	ErrNoRoute = errors.New("no route")
+	// ErrUnpaidRouter indicates a router is interested in a packet but
+	// didn't pay for its airtime.
+	ErrUnpaidRouter = errors.New("router didn't pay for airtime")
+	// ErrDutyCycle indicates a transmission would exceed the duty cycle
+	// limit.
+	ErrDutyCycle = errors.New("duty cycle limit exceeded")
+)
+
+// kindError is an error of a kind with its own message.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// New returns an error with the given message that wraps kind. The message
+// of kind is not included in the message of the error.
+func New(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+// Kind returns the kind of err, or nil if err has none of the kinds in this
+// package.
+func Kind(err error) error {
+	for _, kind := range kinds {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return nil
+}
+
+// kinds holds the kinds that Kind tests for.
+var kinds = []error{
+	ErrNoRoute,
+	ErrUnpaidRouter,
+	ErrDutyCycle,
+	ErrNotFound,
+	ErrAlreadyExists,
+	ErrInvalidArgument,
+	ErrFailedPrecondition,
+	ErrUnavailable,
+	ErrNotSupported,
+	ErrResourceExhausted,
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestKind(t *testing.T) {
+	notFound := New(ErrNotFound, "gateway not found")
+	if notFound.Error() != "gateway not found" {
+		t.Errorf("unexpected message %q", notFound.Error())
+	}
+
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{notFound, ErrNotFound},
+		{fmt.Errorf("lookup: %w", notFound), ErrNotFound},
+		{New(ErrDutyCycle, "duty cycle"), ErrDutyCycle},
+		{ErrUnpaidRouter, ErrUnpaidRouter},
+		{errors.New("other"), nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := Kind(tt.err); got != tt.kind {
+			t.Errorf("kind of %v: expected %v, got %v", tt.err, tt.kind, got)
+		}
+		if tt.kind != nil && !errors.Is(tt.err, tt.kind) {
+			t.Errorf("expected %v to be %v", tt.err, tt.kind)
+		}
+	}
+	if errors.Is(notFound, ErrAlreadyExists) {
+		t.Error("not found error must not be of another kind")
+	}
+}
@@ -24,12 +24,16 @@ import (
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/stats"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/config"
+	"github.com/ThingsIXFoundation/packet-handling/logging"
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/band"
 	"github.com/brocaar/lorawan/gps"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
 
+// backendLog is the logger of the backend module
+var backendLog = logging.Module("backend")
+
 // websocket upgrade parameters
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -144,9 +148,17 @@ func NewBackend(conf config.Config) (*Backend, error) {
 
 	// using net.Listen makes it easier to test as we can bind to ":0" and
 	// then read back the Addr to find the assigned (random) port.
-	b.ln, err = net.Listen("tcp", conf.Backend.BasicStation.Bind)
-	if err != nil {
-		return nil, errors.Wrap(err, "create listener error")
+	if conf.Backend.BasicStation.Listener != nil {
+		b.ln = conf.Backend.BasicStation.Listener
+	} else {
+		b.ln, err = net.Listen("tcp", conf.Backend.BasicStation.Bind)
+		if err != nil {
+			return nil, errors.Wrap(err, "create listener error")
+		}
+	}
+
+	if b.tlsCert != "" || b.tlsKey != "" || b.caCert != "" {
+		b.scheme = "wss"
 	}
 
 	// init HTTP server
@@ -221,7 +233,7 @@ func (b *Backend) SendDownlinkFrame(df *gw.DownlinkFrame) error {
 		return errors.Wrap(err, "send to gateway error")
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
 		"downlink_id": df.GetDownlinkId(),
 	}).Info("backend/basicstation: downlink-frame message sent to gateway")
@@ -255,7 +267,7 @@ func (b *Backend) RawPacketForwarderCommand(pl *gw.RawPacketForwarderCommand) er
 		return errors.Wrap(err, "send raw packet-forwarder command to gateway error")
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 	}).Info("backend/basicstation: raw packet-forwarder command sent to gateway")
 
@@ -265,7 +277,7 @@ func (b *Backend) RawPacketForwarderCommand(pl *gw.RawPacketForwarderCommand) er
 // Start starts the backend.
 func (b *Backend) Start() error {
 	go func() {
-		log.WithFields(log.Fields{
+		backendLog.WithFields(log.Fields{
 			"bind":     b.ln.Addr(),
 			"ca_cert":  b.caCert,
 			"tls_cert": b.tlsCert,
@@ -275,13 +287,12 @@ func (b *Backend) Start() error {
 		if b.tlsCert == "" && b.tlsKey == "" && b.caCert == "" {
 			// no tls
 			if err := b.server.Serve(b.ln); err != nil && !b.isClosed {
-				log.WithError(err).Fatal("backend/basicstation: server error")
+				backendLog.WithError(err).Fatal("backend/basicstation: server error")
 			}
 		} else {
 			// tls
-			b.scheme = "wss"
 			if err := b.server.ServeTLS(b.ln, b.tlsCert, b.tlsKey); err != nil && !b.isClosed {
-				log.WithError(err).Fatal("backend/basicstation: server error")
+				backendLog.WithError(err).Fatal("backend/basicstation: server error")
 			}
 		}
 	}()
@@ -301,7 +312,7 @@ func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
 
 	if err := conn.conn.ReadJSON(&req); err != nil {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			log.WithError(err).Error("backend/basicstation: read message error")
+			backendLog.WithError(err).Error("backend/basicstation: read message error")
 		}
 		return
 	}
@@ -324,7 +335,7 @@ func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
 
 	bb, err := json.Marshal(resp)
 	if err != nil {
-		log.WithError(err).Error("backend/basicstation: marshal json error")
+		backendLog.WithError(err).Error("backend/basicstation: marshal json error")
 		return
 	}
 
@@ -333,11 +344,11 @@ func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
 
 	conn.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
 	if err := conn.conn.WriteMessage(websocket.TextMessage, bb); err != nil {
-		log.WithError(err).Error("backend/basicstation: websocket send message error")
+		backendLog.WithError(err).Error("backend/basicstation: websocket send message error")
 		return
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id":  lorawan.EUI64(req.Router),
 		"remote_addr": r.RemoteAddr,
 		"router_uri":  resp.URI,
@@ -348,20 +359,20 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 	// get the gateway id from the url
 	urlParts := strings.Split(r.URL.Path, "/")
 	if len(urlParts) < 2 {
-		log.WithField("url", r.URL.Path).Error("backend/basicstation: unable to read gateway id from url")
+		backendLog.WithField("url", r.URL.Path).Error("backend/basicstation: unable to read gateway id from url")
 		return
 	}
 
 	var gatewayID lorawan.EUI64
 	if err := gatewayID.UnmarshalText([]byte(urlParts[len(urlParts)-1])); err != nil {
-		log.WithError(err).Error("backend/basicstation: parse gateway id error")
+		backendLog.WithError(err).Error("backend/basicstation: parse gateway id error")
 		return
 	}
 
 	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 		var cn lorawan.EUI64
 		if err := cn.UnmarshalText([]byte(r.TLS.PeerCertificates[0].Subject.CommonName)); err != nil || cn != gatewayID {
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"gateway_id":  gatewayID,
 				"common_name": r.TLS.PeerCertificates[0].Subject.CommonName,
 			}).Error("backend/basicstation: CommonName verification failed")
@@ -372,15 +383,15 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 	// make sure we're not overwriting an existing connection
 	_, err := b.gateways.get(gatewayID)
 	if err == nil {
-		log.WithField("gateway_id", gatewayID).Error("backend/basicstation: connection with same gateway id already exists")
+		backendLog.WithField("gateway_id", gatewayID).Error("backend/basicstation: connection with same gateway id already exists")
 		return
 	}
 
 	// set the gateway connection
 	if err := b.gateways.set(gatewayID, conn); err != nil {
-		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: set gateway error")
+		backendLog.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: set gateway error")
 	}
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
 		"remote_addr": r.RemoteAddr,
 	}).Info("backend/basicstation: gateway connected")
@@ -391,7 +402,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 	defer func() {
 		done <- struct{}{}
 		b.gateways.remove(gatewayID)
-		log.WithFields(log.Fields{
+		backendLog.WithFields(log.Fields{
 			"gateway_id":  gatewayID,
 			"remote_addr": r.RemoteAddr,
 		}).Info("backend/basicstation: gateway disconnected")
@@ -424,7 +435,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 		mt, msg, err := conn.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.WithField("gateway_id", gatewayID).WithError(err).Error("backend/basicstation: read message error")
+				backendLog.WithField("gateway_id", gatewayID).WithError(err).Error("backend/basicstation: read message error")
 			}
 			return
 		}
@@ -433,7 +444,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 		conn.conn.SetReadDeadline(time.Now().Add(b.readTimeout))
 
 		if mt == websocket.BinaryMessage {
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"gateway_id":     gatewayID,
 				"message_base64": base64.StdEncoding.EncodeToString(msg),
 			}).Debug("backend/basicstation: binary message received")
@@ -442,7 +453,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			continue
 		}
 
-		log.WithFields(log.Fields{
+		backendLog.WithFields(log.Fields{
 			"gateway_id": gatewayID,
 			"message":    string(msg),
 		}).Debug("backend/basicstation: message received")
@@ -450,7 +461,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 		// get message-type
 		msgType, err := structs.GetMessageType(msg)
 		if err != nil {
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"gateway_id": gatewayID,
 				"payload":    string(msg),
 			}).WithError(err).Error("backend/basicstation: get message-type error")
@@ -465,7 +476,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			// handle version
 			var pl structs.Version
 			if err := json.Unmarshal(msg, &pl); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"message_type": msgType,
 					"gateway_id":   gatewayID,
 					"payload":      string(msg),
@@ -477,7 +488,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			// handle uplink
 			var pl structs.UplinkDataFrame
 			if err := json.Unmarshal(msg, &pl); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"message_type": msgType,
 					"gateway_id":   gatewayID,
 					"payload":      string(msg),
@@ -490,7 +501,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			// handle join-request
 			var pl structs.JoinRequest
 			if err := json.Unmarshal(msg, &pl); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"message_type": msgType,
 					"gateway_id":   gatewayID,
 					"payload":      string(msg),
@@ -503,7 +514,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			// handle proprietary uplink
 			var pl structs.UplinkProprietaryFrame
 			if err := json.Unmarshal(msg, &pl); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"message_type": msgType,
 					"gateway_id":   gatewayID,
 					"payload":      string(msg),
@@ -516,7 +527,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			// handle downlink transmitted
 			var pl structs.DownlinkTransmitted
 			if err := json.Unmarshal(msg, &pl); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"message_type": msgType,
 					"gateway_id":   gatewayID,
 					"payload":      string(msg),
@@ -528,7 +539,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 			// handle time sync request
 			var pl structs.TimeSyncRequest
 			if err := json.Unmarshal(msg, &pl); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"message_type": msgType,
 					"gateway_id":   gatewayID,
 					"payload":      string(msg),
@@ -543,7 +554,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 }
 
 func (b *Backend) handleVersion(gatewayID lorawan.EUI64, pl structs.Version) {
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"station":    pl.Station,
 		"firmware":   pl.Firmware,
@@ -555,17 +566,17 @@ func (b *Backend) handleVersion(gatewayID lorawan.EUI64, pl structs.Version) {
 
 	websocketSendCounter("router_config").Inc()
 	if err := b.sendToGateway(gatewayID, b.routerConfig); err != nil {
-		log.WithError(err).Error("backend/basicstation: send to gateway error")
+		backendLog.WithError(err).Error("backend/basicstation: send to gateway error")
 		return
 	}
 
-	log.WithField("gateway_id", gatewayID).Info("backend/basicstation: router-config message sent to gateway")
+	backendLog.WithField("gateway_id", gatewayID).Info("backend/basicstation: router-config message sent to gateway")
 }
 
 func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, v structs.JoinRequest) {
 	uplinkFrame, err := structs.JoinRequestToProto(b.band, gatewayID, v)
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+		backendLog.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
 		}).Error("backend/basicstation: error converting join-request to protobuf message")
 		return
@@ -578,7 +589,7 @@ func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, v structs.JoinReque
 		conn.stats.CountUplink(uplinkFrame)
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"uplink_id":  uplinkFrame.RxInfo.UplinkId,
 	}).Info("backend/basicstation: join-request received")
@@ -591,7 +602,7 @@ func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, v structs.JoinReque
 func (b *Backend) handleProprietaryDataFrame(gatewayID lorawan.EUI64, v structs.UplinkProprietaryFrame) {
 	uplinkFrame, err := structs.UplinkProprietaryFrameToProto(b.band, gatewayID, v)
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+		backendLog.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
 		}).Error("backend/basicstation: error converting proprietary uplink to protobuf message")
 		return
@@ -604,7 +615,7 @@ func (b *Backend) handleProprietaryDataFrame(gatewayID lorawan.EUI64, v structs.
 		conn.stats.CountUplink(uplinkFrame)
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"uplink_id":  uplinkFrame.RxInfo.UplinkId,
 	}).Info("backend/basicstation: proprietary uplink frame received")
@@ -620,7 +631,7 @@ func (b *Backend) handleDownlinkTransmittedMessage(gatewayID lorawan.EUI64, v st
 
 	txack, err := structs.DownlinkTransmittedToProto(gatewayID, v)
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+		backendLog.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
 		}).Error("backend/basicstation: error converting downlink transmitted to protobuf message")
 		return
@@ -635,7 +646,7 @@ func (b *Backend) handleDownlinkTransmittedMessage(gatewayID lorawan.EUI64, v st
 		}
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
 		"downlink_id": txack.GetDownlinkId(),
 	}).Info("backend/basicstation: downlink transmitted message received")
@@ -648,7 +659,7 @@ func (b *Backend) handleDownlinkTransmittedMessage(gatewayID lorawan.EUI64, v st
 func (b *Backend) handleUplinkDataFrame(gatewayID lorawan.EUI64, v structs.UplinkDataFrame) {
 	uplinkFrame, err := structs.UplinkDataFrameToProto(b.band, gatewayID, v)
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+		backendLog.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
 		}).Error("backend/basicstation: error converting uplink frame to protobuf message")
 		return
@@ -662,7 +673,7 @@ func (b *Backend) handleUplinkDataFrame(gatewayID lorawan.EUI64, v structs.Uplin
 		conn.stats.CountUplink(uplinkFrame)
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"uplink_id":  uplinkFrame.RxInfo.UplinkId,
 	}).Info("backend/basicstation: uplink frame received")
@@ -678,7 +689,7 @@ func (b *Backend) handleRawPacketForwarderEvent(gatewayID lorawan.EUI64, pl []by
 		Payload:   pl,
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 	}).Info("backend/basicstation: raw packet-forwarder event received")
 
@@ -694,11 +705,11 @@ func (b *Backend) handleTimeSync(gatewayID lorawan.EUI64, v structs.TimeSyncRequ
 		GPSTime:     int64(gps.Time(time.Now()).TimeSinceGPSEpoch() / time.Microsecond),
 	}
 	if err := b.sendToGateway(gatewayID, &resp); err != nil {
-		log.WithError(err).Error("backend/basicstation: send to gateway error")
+		backendLog.WithError(err).Error("backend/basicstation: send to gateway error")
 		return
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"txtime":     resp.TxTime,
 		"gpstime":    resp.GPSTime,
@@ -719,7 +730,7 @@ func (b *Backend) sendToGateway(gatewayID lorawan.EUI64, v interface{}) error {
 		return errors.Wrap(err, "marshal json error")
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"message":    string(bb),
 	}).Debug("sending message to gateway")
@@ -752,7 +763,7 @@ func (b *Backend) sendRawToGateway(gatewayID lorawan.EUI64, messageType int, dat
 func (b *Backend) websocketWrap(handler func(*http.Request, *connection), w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.WithError(err).Error("backend/basicstation: websocket upgrade error")
+		backendLog.WithError(err).Error("backend/basicstation: websocket upgrade error")
 		return
 	}
 	defer conn.Close()
@@ -780,7 +791,7 @@ func (b *Backend) websocketWrap(handler func(*http.Request, *connection), w http
 				websocketPingPongCounter("ping").Inc()
 				c.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
 				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					log.WithError(err).Error("backend/basicstation: send ping message error")
+					backendLog.WithError(err).Error("backend/basicstation: send ping message error")
 					c.conn.Close()
 				}
 				c.Unlock()
@@ -802,7 +813,7 @@ func (b *Backend) sendTimesyncRequest(gatewayID lorawan.EUI64, upInfo structs.Ra
 
 	lastTimesync, err := b.gateways.getLastTimesync(gatewayID)
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+		backendLog.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
 		}).Error("backend/basicstation: get last timesync timestamp error")
 		return
@@ -815,7 +826,7 @@ func (b *Backend) sendTimesyncRequest(gatewayID lorawan.EUI64, upInfo structs.Ra
 
 	// Set last timesync
 	if err := b.gateways.setLastTimesync(gatewayID, time.Now()); err != nil {
-		log.WithError(err).WithFields(log.Fields{
+		backendLog.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
 		}).Error("backend/basicstation: set last timesync timestamp error")
 		return
@@ -828,11 +839,11 @@ func (b *Backend) sendTimesyncRequest(gatewayID lorawan.EUI64, upInfo structs.Ra
 	}
 
 	if err := b.sendToGateway(gatewayID, &timesync); err != nil {
-		log.WithError(err).Error("backend/basicstation: send to gateway error")
+		backendLog.WithError(err).Error("backend/basicstation: send to gateway error")
 		return
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"xtime":      timesync.XTime,
 		"gpstime":    timesync.GPSTime,
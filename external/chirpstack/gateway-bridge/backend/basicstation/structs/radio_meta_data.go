@@ -72,7 +72,7 @@ func SetRadioMetaDataToProto(loraBand band.Band, gatewayID lorawan.EUI64, rmd Ra
 	//
 	pb.RxInfo = &gw.UplinkRxInfo{
 		GatewayId: gatewayID.String(),
-		Rssi:      int32(rmd.UpInfo.RSSI),
+		Rssi:      int32(math.Round(float64(rmd.UpInfo.RSSI))),
 		Snr:       float32(rmd.UpInfo.SNR),
 		CrcStatus: gw.CRCStatus_CRC_OK,
 	}
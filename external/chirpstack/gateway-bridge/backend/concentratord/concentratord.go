@@ -14,10 +14,14 @@ import (
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/config"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/filters"
+	"github.com/ThingsIXFoundation/packet-handling/logging"
 	"github.com/brocaar/lorawan"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
 
+// backendLog is the logger of the backend module
+var backendLog = logging.Module("backend")
+
 // Backend implements a ConcentratorD backend.
 type Backend struct {
 	eventSockCancel   func()
@@ -41,7 +45,7 @@ type Backend struct {
 
 // NewBackend creates a new Backend.
 func NewBackend(conf config.Config) (*Backend, error) {
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"event_url":   conf.Backend.Concentratord.EventURL,
 		"command_url": conf.Backend.Concentratord.CommandURL,
 	}).Info("backend/concentratord: setting up backend")
@@ -69,7 +73,7 @@ func (b *Backend) dialEventSock() error {
 		return errors.Wrap(err, "set event option error")
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"event_url": b.eventURL,
 	}).Info("backend/concentratord: connected to event socket")
 
@@ -86,7 +90,7 @@ func (b *Backend) dialCommandSock() error {
 		return errors.Wrap(err, "dial command api url error")
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"command_url": b.commandURL,
 	}).Info("backend/concentratord: connected to command socket")
 
@@ -96,7 +100,7 @@ func (b *Backend) dialCommandSock() error {
 func (b *Backend) dialCommandSockLoop() {
 	for {
 		if err := b.dialCommandSock(); err != nil {
-			log.WithError(err).Error("backend/concentratord: command socket dial error")
+			backendLog.WithError(err).Error("backend/concentratord: command socket dial error")
 			time.Sleep(time.Second)
 			continue
 		}
@@ -107,7 +111,7 @@ func (b *Backend) dialCommandSockLoop() {
 func (b *Backend) dialEventSockLoop() {
 	for {
 		if err := b.dialEventSock(); err != nil {
-			log.WithError(err).Error("backend/concentratord: event socket dial error")
+			backendLog.WithError(err).Error("backend/concentratord: event socket dial error")
 			time.Sleep(time.Second)
 			continue
 		}
@@ -189,13 +193,13 @@ func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
 
 // SendDownlinkFrame sends the given downlink frame.
 func (b *Backend) SendDownlinkFrame(pl *gw.DownlinkFrame) error {
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"downlink_id": pl.GetDownlinkId(),
 	}).Info("backend/concentratord: forwarding downlink command")
 
 	bb, err := b.commandRequest("down", pl)
 	if err != nil {
-		log.WithError(err).Fatal("backend/concentratord: send downlink command error")
+		backendLog.WithError(err).Fatal("backend/concentratord: send downlink command error")
 	}
 	if len(bb) == 0 {
 		return errors.New("no reply receieved, check concentratord logs for error")
@@ -216,13 +220,13 @@ func (b *Backend) SendDownlinkFrame(pl *gw.DownlinkFrame) error {
 }
 
 func (b *Backend) ApplyConfiguration(config *gw.GatewayConfiguration) error {
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"version": config.Version,
 	}).Info("backend/concentratord: forwarding configuration command")
 
 	_, err := b.commandRequest("config", config)
 	if err != nil {
-		log.WithError(err).Fatal("backend/concentratord: send configuration command error")
+		backendLog.WithError(err).Fatal("backend/concentratord: send configuration command error")
 	}
 
 	commandCounter("config").Inc()
@@ -270,7 +274,7 @@ func (b *Backend) eventLoop() {
 	for {
 		msg, err := b.eventSock.Recv()
 		if err != nil {
-			log.WithError(err).Error("backend/concentratord: receive event message error")
+			backendLog.WithError(err).Error("backend/concentratord: receive event message error")
 
 			// We need to recover both the event and command sockets.
 			func() {
@@ -290,7 +294,7 @@ func (b *Backend) eventLoop() {
 		}
 
 		if len(msg.Frames) != 2 {
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"frame_count": len(msg.Frames),
 			}).Error("backend/concentratord: expected 2 frames in event message")
 			continue
@@ -302,14 +306,14 @@ func (b *Backend) eventLoop() {
 		case "stats":
 			err = b.handleGatewayStats(msg.Frames[1])
 		default:
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"event": string(msg.Frames[0]),
 			}).Error("backend/concentratord: unexpected event received")
 			continue
 		}
 
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
+			backendLog.WithError(err).WithFields(log.Fields{
 				"event": string(msg.Frames[0]),
 			}).Error("backend/concentratord: handle event error")
 		}
@@ -326,7 +330,7 @@ func (b *Backend) handleUplinkFrame(bb []byte) error {
 	}
 
 	if filters.MatchFilters(pl.PhyPayload) {
-		log.WithFields(log.Fields{
+		backendLog.WithFields(log.Fields{
 			"uplink_id": pl.GetRxInfo().GetUplinkId(),
 		}).Info("backend/concentratord: uplink event received")
 
@@ -334,7 +338,7 @@ func (b *Backend) handleUplinkFrame(bb []byte) error {
 			b.uplinkFrameFunc(&pl)
 		}
 	} else {
-		log.WithFields(log.Fields{
+		backendLog.WithFields(log.Fields{
 			"data_base64": base64.StdEncoding.EncodeToString(pl.PhyPayload),
 		}).Debug("backend/concentratord: uplink event dropped because of configured filters")
 	}
@@ -349,7 +353,7 @@ func (b *Backend) handleGatewayStats(bb []byte) error {
 		return errors.Wrap(err, "protobuf unmarshal error")
 	}
 
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"gateway_id": pl.GetGatewayId(),
 	}).Info("backend/concentratord: stats event received")
 
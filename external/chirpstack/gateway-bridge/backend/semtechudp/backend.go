@@ -15,10 +15,14 @@ import (
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/semtechudp/packets"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/config"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/filters"
+	"github.com/ThingsIXFoundation/packet-handling/logging"
 	"github.com/brocaar/lorawan"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
 
+// backendLog is the logger of the backend module
+var backendLog = logging.Module("backend")
+
 // udpPacket represents a raw UDP packet.
 type udpPacket struct {
 	addr *net.UDPAddr
@@ -52,15 +56,20 @@ type Backend struct {
 
 // NewBackend creates a new backend.
 func NewBackend(conf config.Config) (*Backend, error) {
-	addr, err := net.ResolveUDPAddr("udp", conf.Backend.SemtechUDP.UDPBind)
-	if err != nil {
-		return nil, errors.Wrap(err, "resolve udp addr error")
-	}
+	conn := conf.Backend.SemtechUDP.Conn
+	if conn == nil {
+		addr, err := net.ResolveUDPAddr("udp", conf.Backend.SemtechUDP.UDPBind)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve udp addr error")
+		}
 
-	log.WithField("addr", addr).Info("backend/semtechudp: starting gateway udp listener")
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return nil, errors.Wrap(err, "listen udp error")
+		backendLog.WithField("addr", addr).Info("backend/semtechudp: starting gateway udp listener")
+		conn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "listen udp error")
+		}
+	} else {
+		backendLog.WithField("addr", conn.LocalAddr()).Info("backend/semtechudp: using provided gateway udp listener")
 	}
 
 	b := &Backend{
@@ -76,9 +85,9 @@ func NewBackend(conf config.Config) (*Backend, error) {
 
 	go func() {
 		for {
-			log.Debug("backend/semtechudp: cleanup gateway registry")
+			backendLog.Debug("backend/semtechudp: cleanup gateway registry")
 			if err := b.gateways.cleanup(); err != nil {
-				log.WithError(err).Error("backend/semtechudp: gateway registry cleanup failed")
+				backendLog.WithError(err).Error("backend/semtechudp: gateway registry cleanup failed")
 			}
 			time.Sleep(time.Minute)
 		}
@@ -94,7 +103,7 @@ func (b *Backend) Start() error {
 	go func() {
 		err := b.readPackets()
 		if !b.isClosed() {
-			log.WithError(err).Error("backend/semtechudp: read udp packets error")
+			backendLog.WithError(err).Error("backend/semtechudp: read udp packets error")
 		}
 		b.wg.Done()
 	}()
@@ -102,7 +111,7 @@ func (b *Backend) Start() error {
 	go func() {
 		err := b.sendPackets()
 		if !b.isClosed() {
-			log.WithError(err).Error("backend/semtechudp: send udp packets error")
+			backendLog.WithError(err).Error("backend/semtechudp: send udp packets error")
 		}
 		b.wg.Done()
 	}()
@@ -115,13 +124,13 @@ func (b *Backend) Stop() error {
 	b.Lock()
 	b.closed = true
 
-	log.Info("backend/semtechudp: closing gateway backend")
+	backendLog.Info("backend/semtechudp: closing gateway backend")
 
 	if err := b.conn.Close(); err != nil {
 		return errors.Wrap(err, "close udp listener error")
 	}
 
-	log.Info("backend/semtechudp: handling last packets")
+	backendLog.Info("backend/semtechudp: handling last packets")
 	close(b.udpSendChan)
 	b.Unlock()
 	b.wg.Wait()
@@ -230,7 +239,7 @@ func (b *Backend) readPackets() error {
 				return nil
 			}
 
-			log.WithError(err).Error("gateway: read from udp error")
+			backendLog.WithError(err).Error("gateway: read from udp error")
 			continue
 		}
 		data := make([]byte, i)
@@ -240,7 +249,7 @@ func (b *Backend) readPackets() error {
 		// handle packet async
 		go func(up udpPacket) {
 			if err := b.handlePacket(up); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				backendLog.WithError(err).WithFields(log.Fields{
 					"data_base64": base64.StdEncoding.EncodeToString(up.data),
 					"addr":        up.addr,
 				}).Error("backend/semtechudp: could not handle packet")
@@ -253,14 +262,14 @@ func (b *Backend) sendPackets() error {
 	for p := range b.udpSendChan {
 		pt, err := packets.GetPacketType(p.data)
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
+			backendLog.WithError(err).WithFields(log.Fields{
 				"addr":        p.addr,
 				"data_base64": base64.StdEncoding.EncodeToString(p.data),
 			}).Error("backend/semtechudp: get packet-type error")
 			continue
 		}
 
-		log.WithFields(log.Fields{
+		backendLog.WithFields(log.Fields{
 			"addr":             p.addr,
 			"type":             pt,
 			"protocol_version": p.data[0],
@@ -268,7 +277,7 @@ func (b *Backend) sendPackets() error {
 
 		_, err = b.conn.WriteToUDP(p.data, p.addr)
 		if err != nil {
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"addr":             p.addr,
 				"type":             pt,
 				"protocol_version": p.data[0],
@@ -292,7 +301,7 @@ func (b *Backend) handlePacket(up udpPacket) error {
 	if err != nil {
 		return err
 	}
-	log.WithFields(log.Fields{
+	backendLog.WithFields(log.Fields{
 		"addr":             up.addr,
 		"type":             pt,
 		"protocol_version": up.data[0],
@@ -513,7 +522,7 @@ func (b *Backend) handleUplinkFrames(uplinkFrames []*gw.UplinkFrame) error {
 				b.uplinkFrameFunc(uplinkFrames[i])
 			}
 		} else {
-			log.WithFields(log.Fields{
+			backendLog.WithFields(log.Fields{
 				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
 			}).Debug("backend/semtechudp: frame dropped because of configured filters")
 		}
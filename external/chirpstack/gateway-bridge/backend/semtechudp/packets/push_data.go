@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"time"
@@ -64,6 +65,20 @@ func (p PushDataPacket) GetGatewayStats() (*gw.GatewayStats, error) {
 		Metadata:            p.Payload.Stat.Meta,
 	}
 
+	// extended telemetry, gw.GatewayStats has no fields for it
+	if p.Payload.Stat.Temp != nil || p.Payload.Stat.Volt != nil {
+		stats.Metadata = make(map[string]string, len(p.Payload.Stat.Meta)+2)
+		for k, v := range p.Payload.Stat.Meta {
+			stats.Metadata[k] = v
+		}
+		if p.Payload.Stat.Temp != nil {
+			stats.Metadata["temperature"] = strconv.FormatFloat(*p.Payload.Stat.Temp, 'f', -1, 64)
+		}
+		if p.Payload.Stat.Volt != nil {
+			stats.Metadata["voltage"] = strconv.FormatFloat(*p.Payload.Stat.Volt, 'f', -1, 64)
+		}
+	}
+
 	// time
 	stats.Time = timestamppb.New(time.Time(p.Payload.Stat.Time))
 
@@ -131,7 +146,7 @@ func getUplinkFrame(gatewayID lorawan.EUI64, stat *Stat, rxpk RXPK, FakeRxInfoTi
 	frame := gw.UplinkFrame{
 		PhyPayload: rxpk.Data,
 		TxInfo: &gw.UplinkTxInfo{
-			Frequency: uint32(rxpk.Freq * 1000000),
+			Frequency: uint32(math.Round(rxpk.Freq * 1000000)),
 		},
 		RxInfo: &gw.UplinkRxInfo{
 			GatewayId: gatewayID.String(),
@@ -353,17 +368,19 @@ type PushDataPayload struct {
 
 // Stat contains the status of the gateway.
 type Stat struct {
-	Time ExpandedTime      `json:"time"` // UTC 'system' time of the gateway, ISO 8601 'expanded' format (e.g 2014-01-12 08:59:28 GMT)
-	Lati float64           `json:"lati"` // GPS latitude of the gateway in degree (float, N is +)
-	Long float64           `json:"long"` // GPS latitude of the gateway in degree (float, E is +)
-	Alti int32             `json:"alti"` // GPS altitude of the gateway in meter RX (integer)
-	RXNb uint32            `json:"rxnb"` // Number of radio packets received (unsigned integer)
-	RXOK uint32            `json:"rxok"` // Number of radio packets received with a valid PHY CRC
-	RXFW uint32            `json:"rxfw"` // Number of radio packets forwarded (unsigned integer)
-	ACKR float64           `json:"ackr"` // Percentage of upstream datagrams that were acknowledged
-	DWNb uint32            `json:"dwnb"` // Number of downlink datagrams received (unsigned integer)
-	TXNb uint32            `json:"txnb"` // Number of packets emitted (unsigned integer)
-	Meta map[string]string `json:"meta"` // Custom meta-data (Optional, not part of PROTOCOL.TXT)
+	Time ExpandedTime      `json:"time"`           // UTC 'system' time of the gateway, ISO 8601 'expanded' format (e.g 2014-01-12 08:59:28 GMT)
+	Lati float64           `json:"lati"`           // GPS latitude of the gateway in degree (float, N is +)
+	Long float64           `json:"long"`           // GPS latitude of the gateway in degree (float, E is +)
+	Alti int32             `json:"alti"`           // GPS altitude of the gateway in meter RX (integer)
+	RXNb uint32            `json:"rxnb"`           // Number of radio packets received (unsigned integer)
+	RXOK uint32            `json:"rxok"`           // Number of radio packets received with a valid PHY CRC
+	RXFW uint32            `json:"rxfw"`           // Number of radio packets forwarded (unsigned integer)
+	ACKR float64           `json:"ackr"`           // Percentage of upstream datagrams that were acknowledged
+	DWNb uint32            `json:"dwnb"`           // Number of downlink datagrams received (unsigned integer)
+	TXNb uint32            `json:"txnb"`           // Number of packets emitted (unsigned integer)
+	Meta map[string]string `json:"meta"`           // Custom meta-data (Optional, not part of PROTOCOL.TXT)
+	Temp *float64          `json:"temp,omitempty"` // Concentrator temperature in degree Celsius (Optional, SX1302 packet forwarder)
+	Volt *float64          `json:"volt,omitempty"` // Supply voltage in Volt (Optional, not part of PROTOCOL.TXT)
 }
 
 // RXPK contain a RF packet and associated metadata.
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"net"
 	"time"
 )
 
@@ -23,6 +24,10 @@ type Config struct {
 			UDPBind      string `mapstructure:"udp_bind"`
 			SkipCRCCheck bool   `mapstructure:"skip_crc_check"`
 			FakeRxTime   bool   `mapstructure:"fake_rx_time"`
+
+			// Conn is an optional already bound socket that is used instead
+			// of binding a new socket on UDPBind.
+			Conn *net.UDPConn `mapstructure:"-"`
 		} `mapstructure:"semtech_udp"`
 
 		BasicStation struct {
@@ -39,6 +44,10 @@ type Config struct {
 			FrequencyMin     uint32                     `mapstructure:"frequency_min"`
 			FrequencyMax     uint32                     `mapstructure:"frequency_max"`
 			Concentrators    []BasicStationConcentrator `mapstructure:"concentrators"`
+
+			// Listener is an optional already bound listener that is used
+			// instead of binding a new listener on Bind.
+			Listener net.Listener `mapstructure:"-"`
 		} `mapstructure:"basic_station"`
 
 		Concentratord struct {
@@ -0,0 +1,107 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fixtures
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/brocaar/lorawan"
+)
+
+// basicStationUpInfo is the radio metadata of a Basic Station uplink.
+type basicStationUpInfo struct {
+	RCtx    uint64  `json:"rctx"`
+	XTime   uint64  `json:"xtime"`
+	GPSTime int64   `json:"gpstime"`
+	RSSI    float32 `json:"rssi"`
+	SNR     float32 `json:"snr"`
+	RxTime  float64 `json:"rxtime"`
+}
+
+// BasicStationMessage returns the message a Basic Station gateway sends to
+// the LNS when it receives the frame, a jreq message for join-requests and
+// an updf message for data uplinks.
+func (f Frame) BasicStationMessage() []byte {
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(f.PHYPayload); err != nil {
+		panic(fmt.Sprintf("fixtures: invalid frame %s: %v", f.Name, err))
+	}
+
+	upinfo := basicStationUpInfo{
+		XTime:  uint64(f.Tmst),
+		RSSI:   float32(f.RSSI),
+		SNR:    f.SNR,
+		RxTime: float64(ReceivedAt.UnixNano()) / 1e9,
+	}
+	mic := int32(binary.LittleEndian.Uint32(phy.MIC[:]))
+
+	var msg interface{}
+	switch pl := phy.MACPayload.(type) {
+	case *lorawan.JoinRequestPayload:
+		msg = struct {
+			MsgType  string             `json:"msgtype"`
+			MHdr     uint8              `json:"MHdr"`
+			JoinEUI  string             `json:"JoinEui"`
+			DevEUI   string             `json:"DevEui"`
+			DevNonce uint16             `json:"DevNonce"`
+			MIC      int32              `json:"MIC"`
+			DR       int                `json:"DR"`
+			Freq     uint32             `json:"Freq"`
+			UpInfo   basicStationUpInfo `json:"upinfo"`
+		}{"jreq", f.PHYPayload[0], basicStationEUI(pl.JoinEUI), basicStationEUI(pl.DevEUI), uint16(pl.DevNonce), mic, f.DataRate, f.Frequency, upinfo}
+	case *lorawan.MACPayload:
+		fopts := f.PHYPayload[8 : 8+int(f.PHYPayload[5]&0x0f)]
+		fport, frm := -1, ""
+		if pl.FPort != nil {
+			fport = int(*pl.FPort)
+			frm = hex.EncodeToString(f.PHYPayload[9+len(fopts) : len(f.PHYPayload)-4])
+		}
+		msg = struct {
+			MsgType    string             `json:"msgtype"`
+			MHdr       uint8              `json:"MHdr"`
+			DevAddr    int32              `json:"DevAddr"`
+			FCtrl      uint8              `json:"FCtrl"`
+			FCnt       uint16             `json:"FCnt"`
+			FOpts      string             `json:"FOpts"`
+			FPort      int                `json:"FPort"`
+			FRMPayload string             `json:"FRMPayload"`
+			MIC        int32              `json:"MIC"`
+			DR         int                `json:"DR"`
+			Freq       uint32             `json:"Freq"`
+			UpInfo     basicStationUpInfo `json:"upinfo"`
+		}{"updf", f.PHYPayload[0], int32(binary.LittleEndian.Uint32(f.PHYPayload[1:5])), f.PHYPayload[5], uint16(pl.FHDR.FCnt),
+			hex.EncodeToString(fopts), fport, frm, mic, f.DataRate, f.Frequency, upinfo}
+	default:
+		panic(fmt.Sprintf("fixtures: unsupported frame %s", f.Name))
+	}
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		// only contains types that always encode
+		panic(err)
+	}
+	return raw
+}
+
+// basicStationEUI formats the EUI in the Basic Station format, e.g.
+// 70-b3-d5-7e-d0-00-00-01.
+func basicStationEUI(eui lorawan.EUI64) string {
+	return fmt.Sprintf("%02x-%02x-%02x-%02x-%02x-%02x-%02x-%02x", eui[0], eui[1], eui[2], eui[3], eui[4], eui[5], eui[6], eui[7])
+}
@@ -0,0 +1,298 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package fixtures provides a corpus of realistic LoRaWAN frames for tests.
+// It contains valid join-requests and data uplinks across regions and data
+// rates, together with the Semtech UDP and Basic Station messages a gateway
+// sends for them. Frames are built from the published device keys in this
+// package, their MICs are valid and their payloads can be decrypted, so the
+// corpus can be used by downstream integrators and the ThingsIX tests alike.
+//
+// The corpus is deterministic, frames and messages are identical between
+// runs and releases unless the corpus is explicitly extended.
+package fixtures
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// Device is a LoRaWAN 1.0.x device whose keys are used to build the frames.
+type Device struct {
+	Name    string
+	DevEUI  lorawan.EUI64
+	JoinEUI lorawan.EUI64
+	AppKey  lorawan.AES128Key
+	// DevAddr and session keys of the device for data uplinks
+	DevAddr lorawan.DevAddr
+	NwkSKey lorawan.AES128Key
+	AppSKey lorawan.AES128Key
+}
+
+var (
+	// OTAADevice sends the join-requests in the corpus.
+	OTAADevice = Device{
+		Name:    "otaa",
+		DevEUI:  lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0x00, 0x01},
+		JoinEUI: lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0x00, 0xff},
+		AppKey:  lorawan.AES128Key{0x2b, 0x7e, 0x15, 0x16, 0x28, 0xae, 0xd2, 0xa6, 0xab, 0xf7, 0x15, 0x88, 0x09, 0xcf, 0x4f, 0x3c},
+	}
+
+	// ABPDevice sends the data uplinks in the corpus. Its DevAddr is in the
+	// NetID 000013 (The Things Network) range.
+	ABPDevice = Device{
+		Name:    "abp",
+		DevAddr: lorawan.DevAddr{0x26, 0x0b, 0x12, 0x34},
+		NwkSKey: lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		AppSKey: lorawan.AES128Key{0x10, 0x0f, 0x0e, 0x0d, 0x0c, 0x0b, 0x0a, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+	}
+)
+
+// Frame is a LoRaWAN frame as received by a gateway.
+type Frame struct {
+	// Name uniquely identifies the frame in the corpus
+	Name string
+	// Region is the LoRaWAN region, e.g. EU868
+	Region band.Name
+	// DataRate is the uplink data rate index in the region
+	DataRate        int
+	Frequency       uint32
+	SpreadingFactor uint32
+	// Bandwidth in Hz
+	Bandwidth uint32
+	RSSI      int32
+	SNR       float32
+	// Tmst is the concentrator timestamp at which the frame was received
+	Tmst       uint32
+	PHYPayload []byte
+	// FPort and FRMPayload are the decrypted port and application payload
+	// of data uplinks
+	FPort      *uint8
+	FRMPayload []byte
+}
+
+// IsJoinRequest returns an indication if the frame is a join-request.
+func (f Frame) IsJoinRequest() bool {
+	return len(f.PHYPayload) > 0 && lorawan.MType(f.PHYPayload[0]>>5) == lorawan.JoinRequest
+}
+
+// UplinkFrame returns the frame as received by the gateway with the given id
+// in the ChirpStack gateway format.
+func (f Frame) UplinkFrame(gatewayID lorawan.EUI64) *gw.UplinkFrame {
+	return &gw.UplinkFrame{
+		PhyPayload: append([]byte(nil), f.PHYPayload...),
+		TxInfo: &gw.UplinkTxInfo{
+			Frequency: f.Frequency,
+			Modulation: &gw.Modulation{
+				Parameters: &gw.Modulation_Lora{
+					Lora: &gw.LoraModulationInfo{
+						Bandwidth:       f.Bandwidth,
+						SpreadingFactor: f.SpreadingFactor,
+						CodeRate:        gw.CodeRate_CR_4_5,
+					},
+				},
+			},
+		},
+		RxInfo: &gw.UplinkRxInfo{
+			GatewayId: gatewayID.String(),
+			Rssi:      f.RSSI,
+			Snr:       f.SNR,
+			Context:   contextBytes(f.Tmst),
+			CrcStatus: gw.CRCStatus_CRC_OK,
+		},
+	}
+}
+
+// contextBytes returns the timestamp as context, the format the Semtech UDP
+// backend uses.
+func contextBytes(tmst uint32) []byte {
+	return []byte{byte(tmst >> 24), byte(tmst >> 16), byte(tmst >> 8), byte(tmst)}
+}
+
+// corpusEntry describes a frame in the corpus, the physical payload is built
+// from it.
+type corpusEntry struct {
+	region  band.Name
+	dr      int
+	channel int
+	// join builds a join-request with the given DevNonce when set, a data
+	// uplink otherwise
+	join     bool
+	devNonce uint16
+	mtype    lorawan.MType
+	fcnt     uint32
+	fport    uint8
+	payload  string
+	rssi     int32
+	snr      float32
+}
+
+var corpus = []corpusEntry{
+	{region: band.EU868, dr: 0, channel: 0, join: true, devNonce: 1, rssi: -118, snr: -12.5},
+	{region: band.EU868, dr: 5, channel: 1, join: true, devNonce: 2, rssi: -65, snr: 9.5},
+	{region: band.US915, dr: 0, channel: 8, join: true, devNonce: 3, rssi: -110, snr: -7},
+	{region: band.AS923, dr: 2, channel: 0, join: true, devNonce: 4, rssi: -97, snr: 1.2},
+	{region: band.EU868, dr: 0, channel: 0, mtype: lorawan.UnconfirmedDataUp, fcnt: 1, fport: 1, payload: "hello", rssi: -120, snr: -15},
+	{region: band.EU868, dr: 1, channel: 1, mtype: lorawan.UnconfirmedDataUp, fcnt: 2, fport: 1, payload: "hello", rssi: -115, snr: -10},
+	{region: band.EU868, dr: 2, channel: 2, mtype: lorawan.ConfirmedDataUp, fcnt: 3, fport: 2, payload: "confirmed", rssi: -108, snr: -5.5},
+	{region: band.EU868, dr: 3, channel: 0, mtype: lorawan.UnconfirmedDataUp, fcnt: 4, fport: 10, payload: "temperature=21.5", rssi: -101, snr: -1},
+	{region: band.EU868, dr: 4, channel: 1, mtype: lorawan.UnconfirmedDataUp, fcnt: 5, fport: 10, payload: "temperature=21.7", rssi: -88, snr: 4.2},
+	{region: band.EU868, dr: 5, channel: 2, mtype: lorawan.UnconfirmedDataUp, fcnt: 6, fport: 200, payload: "a longer payload sent on the fastest data rate", rssi: -60, snr: 10.5},
+	{region: band.US915, dr: 1, channel: 9, mtype: lorawan.UnconfirmedDataUp, fcnt: 7, fport: 1, payload: "us915", rssi: -112, snr: -8},
+	{region: band.US915, dr: 3, channel: 10, mtype: lorawan.ConfirmedDataUp, fcnt: 8, fport: 2, payload: "us915 confirmed", rssi: -95, snr: 2.5},
+	{region: band.US915, dr: 4, channel: 65, mtype: lorawan.UnconfirmedDataUp, fcnt: 9, fport: 3, payload: "us915 500khz", rssi: -90, snr: 5},
+	{region: band.AU915, dr: 2, channel: 8, mtype: lorawan.UnconfirmedDataUp, fcnt: 10, fport: 1, payload: "au915", rssi: -104, snr: -3},
+	{region: band.AU915, dr: 6, channel: 64, mtype: lorawan.UnconfirmedDataUp, fcnt: 11, fport: 3, payload: "au915 500khz", rssi: -86, snr: 6.5},
+	{region: band.AS923, dr: 5, channel: 1, mtype: lorawan.UnconfirmedDataUp, fcnt: 12, fport: 1, payload: "as923", rssi: -79, snr: 7.5},
+	{region: band.IN865, dr: 0, channel: 2, mtype: lorawan.UnconfirmedDataUp, fcnt: 13, fport: 1, payload: "in865", rssi: -117, snr: -11},
+	{region: band.KR920, dr: 4, channel: 0, mtype: lorawan.UnconfirmedDataUp, fcnt: 14, fport: 1, payload: "kr920", rssi: -92, snr: 3},
+}
+
+// frames holds the corpus, built when the package is initialized
+var frames = mustBuildCorpus()
+
+func mustBuildCorpus() []Frame {
+	frames := make([]Frame, 0, len(corpus))
+	names := make(map[string]bool)
+	for i, entry := range corpus {
+		frame, err := entry.build(uint32(1000000 * (i + 1)))
+		if err != nil {
+			panic(fmt.Sprintf("fixtures: invalid corpus entry %d: %v", i, err))
+		}
+		if names[frame.Name] {
+			panic(fmt.Sprintf("fixtures: duplicate frame %s", frame.Name))
+		}
+		names[frame.Name] = true
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func (entry corpusEntry) build(tmst uint32) (Frame, error) {
+	b, err := band.GetConfig(entry.region, false, lorawan.DwellTimeNoLimit)
+	if err != nil {
+		return Frame{}, err
+	}
+	dr, err := b.GetDataRate(entry.dr)
+	if err != nil {
+		return Frame{}, err
+	}
+	channel, err := b.GetUplinkChannel(entry.channel)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	frame := Frame{
+		Region:          entry.region,
+		DataRate:        entry.dr,
+		Frequency:       channel.Frequency,
+		SpreadingFactor: uint32(dr.SpreadFactor),
+		Bandwidth:       uint32(dr.Bandwidth) * 1000,
+		RSSI:            entry.rssi,
+		SNR:             entry.snr,
+		Tmst:            tmst,
+	}
+
+	var phy lorawan.PHYPayload
+	if entry.join {
+		frame.Name = strings.ToLower(fmt.Sprintf("%s-join-dr%d", entry.region, entry.dr))
+		phy = lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.JoinRequestPayload{
+				JoinEUI:  OTAADevice.JoinEUI,
+				DevEUI:   OTAADevice.DevEUI,
+				DevNonce: lorawan.DevNonce(entry.devNonce),
+			},
+		}
+		if err := phy.SetUplinkJoinMIC(OTAADevice.AppKey); err != nil {
+			return Frame{}, err
+		}
+	} else {
+		kind := "unconfirmed"
+		if entry.mtype == lorawan.ConfirmedDataUp {
+			kind = "confirmed"
+		}
+		frame.Name = strings.ToLower(fmt.Sprintf("%s-%s-dr%d", entry.region, kind, entry.dr))
+		fport := entry.fport
+		frame.FPort = &fport
+		frame.FRMPayload = []byte(entry.payload)
+
+		phy = lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: entry.mtype, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{
+				FHDR: lorawan.FHDR{
+					DevAddr: ABPDevice.DevAddr,
+					FCtrl:   lorawan.FCtrl{ADR: true},
+					FCnt:    entry.fcnt,
+				},
+				FPort:      &fport,
+				FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte(entry.payload)}},
+			},
+		}
+		if err := phy.EncryptFRMPayload(ABPDevice.AppSKey); err != nil {
+			return Frame{}, err
+		}
+		if err := phy.SetUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, ABPDevice.NwkSKey, ABPDevice.NwkSKey); err != nil {
+			return Frame{}, err
+		}
+	}
+
+	if frame.PHYPayload, err = phy.MarshalBinary(); err != nil {
+		return Frame{}, err
+	}
+	return frame, nil
+}
+
+// All returns all frames in the corpus.
+func All() []Frame {
+	return append([]Frame(nil), frames...)
+}
+
+// JoinRequests returns the join-requests in the corpus.
+func JoinRequests() []Frame {
+	var joins []Frame
+	for _, frame := range frames {
+		if frame.IsJoinRequest() {
+			joins = append(joins, frame)
+		}
+	}
+	return joins
+}
+
+// Uplinks returns the data uplinks in the corpus.
+func Uplinks() []Frame {
+	var uplinks []Frame
+	for _, frame := range frames {
+		if !frame.IsJoinRequest() {
+			uplinks = append(uplinks, frame)
+		}
+	}
+	return uplinks
+}
+
+// ByName returns the frame with the given name.
+func ByName(name string) (Frame, bool) {
+	for _, frame := range frames {
+		if frame.Name == name {
+			return frame, true
+		}
+	}
+	return Frame{}, false
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fixtures
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/basicstation/structs"
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+)
+
+var testGatewayID = lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+func TestCorpus(t *testing.T) {
+	if len(JoinRequests()) == 0 || len(Uplinks()) == 0 {
+		t.Fatal("corpus without join-requests or uplinks")
+	}
+	if len(JoinRequests())+len(Uplinks()) != len(All()) {
+		t.Fatal("join-requests and uplinks don't add up to the corpus")
+	}
+
+	for _, frame := range All() {
+		if got, ok := ByName(frame.Name); !ok || !bytes.Equal(got.PHYPayload, frame.PHYPayload) {
+			t.Errorf("%s: not found by name", frame.Name)
+		}
+
+		var phy lorawan.PHYPayload
+		if err := phy.UnmarshalBinary(frame.PHYPayload); err != nil {
+			t.Errorf("%s: %v", frame.Name, err)
+			continue
+		}
+
+		if frame.IsJoinRequest() {
+			if ok, err := phy.ValidateUplinkJoinMIC(OTAADevice.AppKey); err != nil || !ok {
+				t.Errorf("%s: invalid join MIC", frame.Name)
+			}
+			continue
+		}
+
+		if ok, err := phy.ValidateUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, ABPDevice.NwkSKey, ABPDevice.NwkSKey); err != nil || !ok {
+			t.Errorf("%s: invalid data MIC", frame.Name)
+		}
+		if err := phy.DecryptFRMPayload(ABPDevice.AppSKey); err != nil {
+			t.Errorf("%s: %v", frame.Name, err)
+			continue
+		}
+		mac := phy.MACPayload.(*lorawan.MACPayload)
+		if mac.FHDR.DevAddr != ABPDevice.DevAddr {
+			t.Errorf("%s: DevAddr %s, expected %s", frame.Name, mac.FHDR.DevAddr, ABPDevice.DevAddr)
+		}
+		if payload := mac.FRMPayload[0].(*lorawan.DataPayload).Bytes; !bytes.Equal(payload, frame.FRMPayload) {
+			t.Errorf("%s: decrypted payload %q, expected %q", frame.Name, payload, frame.FRMPayload)
+		}
+	}
+}
+
+func TestSemtechUDP(t *testing.T) {
+	for _, frame := range All() {
+		var packet packets.PushDataPacket
+		if err := packet.UnmarshalBinary(frame.SemtechUDPPushData(testGatewayID, 1)); err != nil {
+			t.Errorf("%s: %v", frame.Name, err)
+			continue
+		}
+		uplinks, err := packet.GetUplinkFrames(false, false)
+		if err != nil || len(uplinks) != 1 {
+			t.Errorf("%s: unable to decode uplink: %v", frame.Name, err)
+			continue
+		}
+		uplink := uplinks[0]
+		if !bytes.Equal(uplink.PhyPayload, frame.PHYPayload) {
+			t.Errorf("%s: PHYPayload mismatch", frame.Name)
+		}
+		if uplink.TxInfo.Frequency != frame.Frequency {
+			t.Errorf("%s: frequency %d, expected %d", frame.Name, uplink.TxInfo.Frequency, frame.Frequency)
+		}
+		lora := uplink.TxInfo.GetModulation().GetLora()
+		if lora.SpreadingFactor != frame.SpreadingFactor || lora.Bandwidth != frame.Bandwidth {
+			t.Errorf("%s: SF%d BW%d, expected SF%d BW%d", frame.Name, lora.SpreadingFactor, lora.Bandwidth, frame.SpreadingFactor, frame.Bandwidth)
+		}
+		if !bytes.Equal(uplink.RxInfo.Context, frame.UplinkFrame(testGatewayID).RxInfo.Context) {
+			t.Errorf("%s: context mismatch", frame.Name)
+		}
+	}
+
+	var stats packets.PushDataPacket
+	if err := stats.UnmarshalBinary(SemtechUDPStats(testGatewayID, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := stats.GetGatewayStats(); err != nil || s == nil || s.RxPacketsReceived != 18 {
+		t.Errorf("unable to decode stats: %v", err)
+	}
+}
+
+func TestBasicStation(t *testing.T) {
+	for _, frame := range All() {
+		b, err := band.GetConfig(frame.Region, false, lorawan.DwellTimeNoLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw := frame.BasicStationMessage()
+		var msgType struct {
+			MsgType string `json:"msgtype"`
+		}
+		if err := json.Unmarshal(raw, &msgType); err != nil {
+			t.Fatal(err)
+		}
+
+		var phyPayload []byte
+		switch msgType.MsgType {
+		case "jreq":
+			var jreq structs.JoinRequest
+			if err := json.Unmarshal(raw, &jreq); err != nil {
+				t.Fatal(err)
+			}
+			uplink, err := structs.JoinRequestToProto(b, testGatewayID, jreq)
+			if err != nil {
+				t.Errorf("%s: %v", frame.Name, err)
+				continue
+			}
+			phyPayload = uplink.PhyPayload
+		case "updf":
+			var updf structs.UplinkDataFrame
+			if err := json.Unmarshal(raw, &updf); err != nil {
+				t.Fatal(err)
+			}
+			uplink, err := structs.UplinkDataFrameToProto(b, testGatewayID, updf)
+			if err != nil {
+				t.Errorf("%s: %v", frame.Name, err)
+				continue
+			}
+			if uplink.TxInfo.GetModulation().GetLora().GetSpreadingFactor() != frame.SpreadingFactor {
+				t.Errorf("%s: data rate mismatch", frame.Name)
+			}
+			phyPayload = uplink.PhyPayload
+		default:
+			t.Errorf("%s: unexpected message type %s", frame.Name, msgType.MsgType)
+			continue
+		}
+		if !bytes.Equal(phyPayload, frame.PHYPayload) {
+			t.Errorf("%s: PHYPayload %x, expected %x", frame.Name, phyPayload, frame.PHYPayload)
+		}
+	}
+}
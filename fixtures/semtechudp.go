@@ -0,0 +1,97 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fixtures
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+const (
+	// semtechUDPProtocolVersion is the version of the Semtech UDP protocol
+	// the messages are encoded with
+	semtechUDPProtocolVersion = 2
+	// semtechUDPPushData is the PUSH_DATA identifier
+	semtechUDPPushDataID = 0x00
+)
+
+// ReceivedAt is the time at which all frames in the corpus were received.
+var ReceivedAt = time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// semtechUDPRXPK is a received packet in a Semtech UDP PUSH_DATA message.
+type semtechUDPRXPK struct {
+	Time string  `json:"time"`
+	Tmst uint32  `json:"tmst"`
+	Chan uint8   `json:"chan"`
+	RFCh uint8   `json:"rfch"`
+	Freq float64 `json:"freq"`
+	Stat int8    `json:"stat"`
+	Modu string  `json:"modu"`
+	DatR string  `json:"datr"`
+	CodR string  `json:"codr"`
+	RSSI int32   `json:"rssi"`
+	LSNR float32 `json:"lsnr"`
+	Size int     `json:"size"`
+	Data []byte  `json:"data"`
+}
+
+// SemtechUDPPushData returns the Semtech UDP PUSH_DATA message the gateway
+// with the given id sends when it receives the frame.
+func (f Frame) SemtechUDPPushData(gatewayID lorawan.EUI64, token uint16) []byte {
+	payload, err := json.Marshal(struct {
+		RXPK []semtechUDPRXPK `json:"rxpk"`
+	}{
+		RXPK: []semtechUDPRXPK{{
+			Time: ReceivedAt.Format(time.RFC3339Nano),
+			Tmst: f.Tmst,
+			Freq: float64(f.Frequency) / 1000000,
+			Stat: 1,
+			Modu: "LORA",
+			DatR: fmt.Sprintf("SF%dBW%d", f.SpreadingFactor, f.Bandwidth/1000),
+			CodR: "4/5",
+			RSSI: f.RSSI,
+			LSNR: f.SNR,
+			Size: len(f.PHYPayload),
+			Data: f.PHYPayload,
+		}},
+	})
+	if err != nil {
+		// only contains types that always encode
+		panic(err)
+	}
+	return semtechUDPPushData(gatewayID, token, payload)
+}
+
+// SemtechUDPStats returns the Semtech UDP PUSH_DATA message with gateway
+// statistics that the gateway with the given id sends periodically.
+func SemtechUDPStats(gatewayID lorawan.EUI64, token uint16) []byte {
+	payload := []byte(`{"stat":{"time":"2023-03-01 12:00:00 UTC","lati":52.09,"long":5.12,"alti":12,"rxnb":18,"rxok":18,"rxfw":18,"ackr":100.0,"dwnb":2,"txnb":2,"temp":31.5}}`)
+	return semtechUDPPushData(gatewayID, token, payload)
+}
+
+func semtechUDPPushData(gatewayID lorawan.EUI64, token uint16, payload []byte) []byte {
+	msg := make([]byte, 12, 12+len(payload))
+	msg[0] = semtechUDPProtocolVersion
+	binary.LittleEndian.PutUint16(msg[1:3], token)
+	msg[3] = semtechUDPPushDataID
+	copy(msg[4:12], gatewayID[:])
+	return append(msg, payload...)
+}
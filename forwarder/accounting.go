@@ -21,7 +21,6 @@ import (
 
 	"github.com/ThingsIXFoundation/router-api/go/router"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/sirupsen/logrus"
 )
 
 // buildAccounter returns the Accounter module as configured in the given cfg.
@@ -50,17 +49,17 @@ type NoAccounting struct {
 // NewNoAccountingStrategy returns an Accounter that allows all data to
 // be forwarded to the router and ignore router payments.
 func NewNoAccountingStrategy() *NoAccounting {
-	logrus.Info("disable packet accounting")
+	accountingLog.Info("disable packet accounting")
 	return &NoAccounting{}
 }
 
 // Allow all data to the given user
 func (a NoAccounting) Allow(user common.Address, airtime time.Duration) bool {
-	logrus.Debug("allow all for no-accounting")
+	accountingLog.Debug("allow all for no-accounting")
 	return true
 }
 
 // AddPayment ignores the given payment
 func (a NoAccounting) AddPayment(payment *router.AirtimePaymentEvent) {
-	logrus.Debug("ignore airtime payment for no-accounting")
+	accountingLog.Debug("ignore airtime payment for no-accounting")
 }
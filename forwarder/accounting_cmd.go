@@ -0,0 +1,150 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	AccountingCmds = &cobra.Command{
+		Use:   "accounting",
+		Short: "accounting related commands",
+	}
+
+	reconcileAccountingCmd = &cobra.Command{
+		Use:   "reconcile <log-file>...",
+		Short: "Re-derive accounting totals from archived forwarder logs and compare them with receipts and settlements",
+		Long: `Re-derive the packets and airtime forwarded to each router per day (UTC)
+from archived forwarder logs and compare them with the receipts a router
+reported and with settled airtime, for example exported from on-chain
+settlement transactions. Log files can be gzip compressed (.gz) and in logrus
+text or JSON format; routers are identified by the router_id log field.
+
+Receipts are read from a CSV file with the columns date,router,packets,airtime_ms
+and settlements from a CSV file with the columns date,router,airtime_ms. Dates
+are formatted as YYYY-MM-DD.
+
+Days and routers where a source differs more than --tolerance from the totals
+in the logs are marked as discrepancies and the command exits with a
+non-zero status.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  reconcileAccounting,
+	}
+
+	reconcileReceipts    string
+	reconcileSettlements string
+	reconcileTolerance   float64
+	reconcileJSON        bool
+)
+
+func init() {
+	reconcileAccountingCmd.Flags().StringVar(&reconcileReceipts, "receipts", "", "CSV file with router receipts")
+	reconcileAccountingCmd.Flags().StringVar(&reconcileSettlements, "settlements", "", "CSV file with settled airtime")
+	reconcileAccountingCmd.Flags().Float64Var(&reconcileTolerance, "tolerance", 0.01, "allowed relative difference before a discrepancy is reported")
+	reconcileAccountingCmd.Flags().BoolVar(&reconcileJSON, "json", false, "Output in json format")
+
+	AccountingCmds.AddCommand(reconcileAccountingCmd)
+}
+
+func reconcileAccounting(cmd *cobra.Command, args []string) {
+	ledger := newAccountingLedger()
+
+	for _, path := range args {
+		f, err := openArchive(path)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to open log file")
+		}
+		err = ledger.ReadLog(f)
+		_ = f.Close()
+		if err != nil {
+			logrus.WithError(err).WithField("file", path).Fatal("unable to read log file")
+		}
+	}
+
+	for _, source := range []struct {
+		path string
+		read func(f *os.File) error
+	}{
+		{reconcileReceipts, func(f *os.File) error { return ledger.ReadReceipts(f) }},
+		{reconcileSettlements, func(f *os.File) error { return ledger.ReadSettlements(f) }},
+	} {
+		if source.path == "" {
+			continue
+		}
+		f, err := os.Open(source.path)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to open CSV file")
+		}
+		err = source.read(f)
+		_ = f.Close()
+		if err != nil {
+			logrus.WithError(err).WithField("file", source.path).Fatal("unable to read CSV file")
+		}
+	}
+
+	if ledger.skipped > 0 {
+		logrus.WithField("lines", ledger.skipped).Warn("skipped forwarded packet log lines without timestamp, router_id or airtime_ms")
+	}
+
+	rows := ledger.Reconcile(reconcileTolerance, reconcileReceipts != "", reconcileSettlements != "")
+	if reconcileJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(rows)
+	} else {
+		printReconciliationAsTable(rows)
+	}
+
+	for _, row := range rows {
+		if len(row.Discrepancies) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func printReconciliationAsTable(rows []AccountingReconciliation) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"day", "router", "packets", "airtime", "denied",
+		"receipt_packets", "receipt_airtime", "settled_airtime", "status"})
+	table.SetAutoWrapText(false)
+
+	for _, row := range rows {
+		var (
+			receiptPackets, receiptAirtime, settled = "-", "-", "-"
+			status                                  = "ok"
+		)
+		if row.ReceiptPackets != nil {
+			receiptPackets = fmt.Sprint(*row.ReceiptPackets)
+			receiptAirtime = row.ReceiptAirtime.String()
+		}
+		if row.SettledAirtime != nil {
+			settled = row.SettledAirtime.String()
+		}
+		if len(row.Discrepancies) > 0 {
+			status = "MISMATCH: " + strings.Join(row.Discrepancies, "; ")
+		}
+		table.Append([]string{row.Day, row.Router, fmt.Sprint(row.Packets), row.Airtime.String(),
+			fmt.Sprint(row.Denied), receiptPackets, receiptAirtime, settled, status})
+	}
+	table.Render()
+}
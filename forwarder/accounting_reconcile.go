@@ -0,0 +1,374 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log messages the router client writes for each uplink or join it offered
+// to a router, these are the source for re-deriving accounting totals.
+const (
+	logForwardedUplink = "forwarded uplink packet to router"
+	logForwardedJoin   = "forwarded join packet to router"
+	logDeniedUplink    = "accounting prevents forwarding uplink packet to router, drop packet"
+	logDeniedJoin      = "accounting prevents forwarding join packet to router, drop packet"
+)
+
+// accountingKey identifies a row in the reconciliation report.
+type accountingKey struct {
+	Day    string
+	Router string
+}
+
+// accountingTotals is the traffic attributed to a router on a day.
+type accountingTotals struct {
+	Packets uint64
+	Airtime time.Duration
+}
+
+// AccountingReconciliation is a row in the reconciliation report that
+// compares the totals derived from forwarder logs with the receipts routers
+// report and the settled airtime.
+type AccountingReconciliation struct {
+	Day            string         `json:"day"`
+	Router         string         `json:"router"`
+	Packets        uint64         `json:"packets"`
+	Airtime        time.Duration  `json:"airtime"`
+	Denied         uint64         `json:"denied"`
+	ReceiptPackets *uint64        `json:"receiptPackets,omitempty"`
+	ReceiptAirtime *time.Duration `json:"receiptAirtime,omitempty"`
+	SettledAirtime *time.Duration `json:"settledAirtime,omitempty"`
+	Discrepancies  []string       `json:"discrepancies,omitempty"`
+}
+
+// accountingLedger collects the totals from the different sources.
+type accountingLedger struct {
+	derived  map[accountingKey]*accountingTotals
+	denied   map[accountingKey]uint64
+	receipts map[accountingKey]*accountingTotals
+	settled  map[accountingKey]time.Duration
+	// skipped counts forwarded packet log lines that could not be attributed
+	skipped uint64
+}
+
+func newAccountingLedger() *accountingLedger {
+	return &accountingLedger{
+		derived:  make(map[accountingKey]*accountingTotals),
+		denied:   make(map[accountingKey]uint64),
+		receipts: make(map[accountingKey]*accountingTotals),
+		settled:  make(map[accountingKey]time.Duration),
+	}
+}
+
+// openArchive opens the file at path, archives ending in .gz are
+// decompressed.
+func openArchive(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to decompress %s: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// ReadLog derives accounting totals from a forwarder log in logrus text or
+// JSON format. Lines without a timestamp can't be attributed to a day and
+// are counted as skipped.
+func (l *accountingLedger) ReadLog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "packet to router") {
+			continue
+		}
+
+		var fields map[string]string
+		if strings.HasPrefix(line, "{") {
+			fields = parseJSONLogLine(line)
+		} else {
+			fields = parseTextLogLine(line)
+		}
+
+		msg := fields["msg"]
+		if msg != logForwardedUplink && msg != logForwardedJoin && msg != logDeniedUplink && msg != logDeniedJoin {
+			continue
+		}
+
+		ts, err := time.Parse(time.RFC3339, fields["time"])
+		if err != nil || fields["router_id"] == "" {
+			l.skipped++
+			continue
+		}
+		key := accountingKey{Day: ts.UTC().Format("2006-01-02"), Router: fields["router_id"]}
+
+		if msg == logDeniedUplink || msg == logDeniedJoin {
+			l.denied[key]++
+			continue
+		}
+
+		airtime, err := strconv.ParseUint(fields["airtime_ms"], 10, 32)
+		if err != nil {
+			// logs written before the airtime was logged
+			l.skipped++
+			continue
+		}
+		totals, ok := l.derived[key]
+		if !ok {
+			totals = &accountingTotals{}
+			l.derived[key] = totals
+		}
+		totals.Packets++
+		totals.Airtime += time.Duration(airtime) * time.Millisecond
+	}
+	return scanner.Err()
+}
+
+// parseTextLogLine returns the key/value pairs in a logrus text formatted
+// line, quoted values are unquoted.
+func parseTextLogLine(line string) map[string]string {
+	fields := make(map[string]string)
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			break
+		}
+		key, rest := line[:eq], line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && (rest[end] != '"' || rest[end-1] == '\\') {
+				end++
+			}
+			if end >= len(rest) {
+				end = len(rest) - 1
+			}
+			unquoted, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				unquoted = rest[1:end]
+			}
+			value, line = unquoted, rest[end+1:]
+		} else if sp := strings.IndexByte(rest, ' '); sp >= 0 {
+			value, line = rest[:sp], rest[sp:]
+		} else {
+			value, line = rest, ""
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// parseJSONLogLine returns the fields in a logrus JSON formatted line.
+func parseJSONLogLine(line string) map[string]string {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return nil
+	}
+	fields := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			fields[k] = v
+		case float64:
+			fields[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			fields[k] = fmt.Sprint(v)
+		}
+	}
+	return fields
+}
+
+// readAccountingCSV reads a CSV file with a header row. For each row fn is
+// called with the values by column name.
+func readAccountingCSV(r io.Reader, required []string, fn func(row map[string]string) error) error {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	header := records[0]
+	for _, col := range required {
+		found := false
+		for _, h := range header {
+			found = found || strings.TrimSpace(h) == col
+		}
+		if !found {
+			return fmt.Errorf("missing column %q", col)
+		}
+	}
+
+	for i, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for j, h := range header {
+			if j < len(record) {
+				row[strings.TrimSpace(h)] = strings.TrimSpace(record[j])
+			}
+		}
+		if err := fn(row); err != nil {
+			return fmt.Errorf("row %d: %w", i+2, err)
+		}
+	}
+	return nil
+}
+
+func parseAccountingDay(day string) (string, error) {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q, expected YYYY-MM-DD", day)
+	}
+	return t.Format("2006-01-02"), nil
+}
+
+// ReadReceipts reads the receipts a router reported as CSV with the columns
+// date, router, packets and airtime_ms.
+func (l *accountingLedger) ReadReceipts(r io.Reader) error {
+	return readAccountingCSV(r, []string{"date", "router", "packets", "airtime_ms"}, func(row map[string]string) error {
+		day, err := parseAccountingDay(row["date"])
+		if err != nil {
+			return err
+		}
+		packets, err := strconv.ParseUint(row["packets"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid packets %q", row["packets"])
+		}
+		airtime, err := strconv.ParseUint(row["airtime_ms"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid airtime_ms %q", row["airtime_ms"])
+		}
+
+		key := accountingKey{Day: day, Router: row["router"]}
+		totals, ok := l.receipts[key]
+		if !ok {
+			totals = &accountingTotals{}
+			l.receipts[key] = totals
+		}
+		totals.Packets += packets
+		totals.Airtime += time.Duration(airtime) * time.Millisecond
+		return nil
+	})
+}
+
+// ReadSettlements reads settled airtime as CSV with the columns date, router
+// and airtime_ms, for example exported from on-chain settlement transactions.
+func (l *accountingLedger) ReadSettlements(r io.Reader) error {
+	return readAccountingCSV(r, []string{"date", "router", "airtime_ms"}, func(row map[string]string) error {
+		day, err := parseAccountingDay(row["date"])
+		if err != nil {
+			return err
+		}
+		airtime, err := strconv.ParseUint(row["airtime_ms"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid airtime_ms %q", row["airtime_ms"])
+		}
+		l.settled[accountingKey{Day: day, Router: row["router"]}] += time.Duration(airtime) * time.Millisecond
+		return nil
+	})
+}
+
+// Reconcile compares the derived totals with receipts and settlements per
+// day and router. Differences larger than tolerance, a fraction of the
+// derived value, are reported as discrepancies. Sources that were not loaded
+// are not compared.
+func (l *accountingLedger) Reconcile(tolerance float64, haveReceipts, haveSettlements bool) []AccountingReconciliation {
+	keys := make(map[accountingKey]bool)
+	for key := range l.derived {
+		keys[key] = true
+	}
+	for key := range l.denied {
+		keys[key] = true
+	}
+	for key := range l.receipts {
+		keys[key] = true
+	}
+	for key := range l.settled {
+		keys[key] = true
+	}
+
+	differs := func(derived, other float64) bool {
+		return math.Abs(derived-other) > tolerance*math.Max(derived, 1)
+	}
+
+	rows := make([]AccountingReconciliation, 0, len(keys))
+	for key := range keys {
+		row := AccountingReconciliation{Day: key.Day, Router: key.Router, Denied: l.denied[key]}
+		if totals, ok := l.derived[key]; ok {
+			row.Packets, row.Airtime = totals.Packets, totals.Airtime
+		}
+
+		if haveReceipts {
+			var receipt accountingTotals
+			if totals, ok := l.receipts[key]; ok {
+				receipt = *totals
+			}
+			row.ReceiptPackets, row.ReceiptAirtime = &receipt.Packets, &receipt.Airtime
+			if differs(float64(row.Packets), float64(receipt.Packets)) {
+				row.Discrepancies = append(row.Discrepancies,
+					fmt.Sprintf("router receipts %d packets, logs %d", receipt.Packets, row.Packets))
+			}
+			if differs(float64(row.Airtime), float64(receipt.Airtime)) {
+				row.Discrepancies = append(row.Discrepancies,
+					fmt.Sprintf("router receipts %s airtime, logs %s", receipt.Airtime, row.Airtime))
+			}
+		}
+
+		if haveSettlements {
+			settled := l.settled[key]
+			row.SettledAirtime = &settled
+			if differs(float64(row.Airtime), float64(settled)) {
+				row.Discrepancies = append(row.Discrepancies,
+					fmt.Sprintf("settled %s airtime, logs %s", settled, row.Airtime))
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Day != rows[j].Day {
+			return rows[i].Day < rows[j].Day
+		}
+		return rows[i].Router < rows[j].Router
+	})
+	return rows
+}
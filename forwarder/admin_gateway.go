@@ -0,0 +1,269 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/cors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// maxAdminRequestSize is the maximum size of a gRPC-Web or REST request body.
+const maxAdminRequestSize = 1 << 20
+
+// adminRESTRoute maps a REST endpoint on a method of the admin service.
+type adminRESTRoute struct {
+	method string
+	path   string
+	rpc    string
+	// request builds the request message of the call from the HTTP request
+	request func(r *http.Request) (proto.Message, error)
+}
+
+// adminRESTRoutes are the REST endpoints of the admin service, they are
+// documented in admin.proto.
+var adminRESTRoutes = []adminRESTRoute{
+	{http.MethodGet, "/v1/admin/gateways", "ListGateways", emptyAdminRequest},
+	{http.MethodGet, "/v1/admin/routers", "ListRouters", emptyAdminRequest},
+	{http.MethodPost, "/v1/admin/routers/{id}/disconnect", "DisconnectRouter", idAdminRequest},
+	{http.MethodPost, "/v1/admin/routers/{id}/reconnect", "ReconnectRouter", idAdminRequest},
+	{http.MethodGet, "/v1/admin/sites", "ListSites", emptyAdminRequest},
+	{http.MethodPost, "/v1/admin/sites/{id}/enable", "EnableSite", idAdminRequest},
+	{http.MethodPost, "/v1/admin/sites/{id}/disable", "DisableSite", idAdminRequest},
+	{http.MethodGet, "/v1/admin/config", "DumpConfig", emptyAdminRequest},
+	{http.MethodPost, "/v1/admin/buffers/flush", "FlushBuffers", func(r *http.Request) (proto.Message, error) {
+		discard, err := strconv.ParseBool(r.URL.Query().Get("discard"))
+		if err != nil && r.URL.Query().Has("discard") {
+			return nil, status.Error(codes.InvalidArgument, "invalid discard")
+		}
+		return wrapperspb.Bool(discard), nil
+	}},
+}
+
+func emptyAdminRequest(*http.Request) (proto.Message, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func idAdminRequest(r *http.Request) (proto.Message, error) {
+	return wrapperspb.String(chi.URLParam(r, "id")), nil
+}
+
+// adminHandler serves the admin service over gRPC, gRPC-Web and REST on a
+// single port. Browser tools use gRPC-Web or REST without a separate proxy,
+// all calls pass through interceptor.
+func adminHandler(srv *grpc.Server, admin adminService, interceptor grpc.UnaryServerInterceptor) http.Handler {
+	rest := chi.NewRouter()
+	for _, route := range adminRESTRoutes {
+		route := route
+		rest.Method(route.method, route.path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveAdminREST(w, r, admin, interceptor, route)
+		}))
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		switch {
+		case strings.HasPrefix(contentType, "application/grpc-web"):
+			serveAdminGRPCWeb(w, r, admin, interceptor)
+		case r.ProtoMajor == 2 && strings.HasPrefix(contentType, "application/grpc"):
+			srv.ServeHTTP(w, r)
+		default:
+			rest.ServeHTTP(w, r)
+		}
+	})
+
+	return cors.Handler(cors.Options{
+		AllowedOrigins:   []string{"https://*", "http://*"},
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Grpc-Web", "X-User-Agent"},
+		ExposedHeaders:   []string{"Grpc-Status", "Grpc-Message"},
+		AllowCredentials: false,
+		MaxAge:           300,
+	})(handler)
+}
+
+// callAdmin calls the method with the given name of the admin service, dec
+// decodes the request message.
+func callAdmin(r *http.Request, admin adminService, interceptor grpc.UnaryServerInterceptor, name string, dec func(interface{}) error) (proto.Message, error) {
+	ctx := r.Context()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", auth))
+	}
+	for _, method := range adminServiceDesc.Methods {
+		if method.MethodName == name {
+			reply, err := method.Handler(admin, ctx, dec, interceptor)
+			if err != nil {
+				return nil, err
+			}
+			return reply.(proto.Message), nil
+		}
+	}
+	return nil, status.Errorf(codes.Unimplemented, "unknown method %s", name)
+}
+
+// serveAdminREST serves a REST call, the reply is the JSON encoding of the
+// returned struct.
+func serveAdminREST(w http.ResponseWriter, r *http.Request, admin adminService, interceptor grpc.UnaryServerInterceptor, route adminRESTRoute) {
+	in, err := route.request(r)
+	if err == nil {
+		var reply proto.Message
+		reply, err = callAdmin(r, admin, interceptor, route.rpc, func(v interface{}) error {
+			proto.Merge(v.(proto.Message), in)
+			return nil
+		})
+		if err == nil {
+			raw, err := protojson.Marshal(reply)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(raw)
+			return
+		}
+	}
+	st := status.Convert(err)
+	http.Error(w, st.Message(), adminHTTPStatus(st.Code()))
+}
+
+// serveAdminGRPCWeb serves a unary gRPC-Web call in binary or text (base64)
+// format.
+func serveAdminGRPCWeb(w http.ResponseWriter, r *http.Request, admin adminService, interceptor grpc.UnaryServerInterceptor) {
+	var (
+		contentType = r.Header.Get("Content-Type")
+		text        = strings.HasPrefix(contentType, "application/grpc-web-text")
+		prefix      = "/" + adminServiceName + "/"
+	)
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		reply proto.Message
+		err   error
+	)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		err = status.Errorf(codes.Unimplemented, "unknown service method %s", r.URL.Path)
+	} else {
+		var payload []byte
+		if payload, err = readGRPCWebRequest(r.Body, text); err == nil {
+			reply, err = callAdmin(r, admin, interceptor, strings.TrimPrefix(r.URL.Path, prefix), func(v interface{}) error {
+				return proto.Unmarshal(payload, v.(proto.Message))
+			})
+		}
+	}
+
+	var body bytes.Buffer
+	if err == nil {
+		raw, merr := proto.Marshal(reply)
+		if merr != nil {
+			err = status.Error(codes.Internal, merr.Error())
+		} else {
+			writeGRPCWebFrame(&body, 0x00, raw)
+		}
+	}
+	st := status.Convert(err)
+	trailer := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", st.Code(), url.PathEscape(st.Message()))
+	writeGRPCWebFrame(&body, 0x80, []byte(trailer))
+
+	out := body.Bytes()
+	if text {
+		w.Header().Set("Content-Type", "application/grpc-web-text+proto")
+		out = []byte(base64.StdEncoding.EncodeToString(out))
+	} else {
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+	}
+	_, _ = w.Write(out)
+}
+
+// readGRPCWebRequest returns the message in the gRPC-Web request body.
+func readGRPCWebRequest(body io.Reader, text bool) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(body, maxAdminRequestSize))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if text {
+		if raw, err = base64.StdEncoding.DecodeString(string(raw)); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid base64 request")
+		}
+	}
+	if len(raw) < 5 {
+		return nil, status.Error(codes.InvalidArgument, "missing request message")
+	}
+	if raw[0] != 0x00 {
+		return nil, status.Error(codes.Unimplemented, "compressed requests are not supported")
+	}
+	size := binary.BigEndian.Uint32(raw[1:5])
+	if uint32(len(raw)-5) < size {
+		return nil, status.Error(codes.InvalidArgument, "truncated request message")
+	}
+	return raw[5 : 5+size], nil
+}
+
+// writeGRPCWebFrame writes a length prefixed gRPC-Web frame.
+func writeGRPCWebFrame(w *bytes.Buffer, flags byte, payload []byte) {
+	w.WriteByte(flags)
+	_ = binary.Write(w, binary.BigEndian, uint32(len(payload)))
+	w.Write(payload)
+}
+
+// adminHTTPStatus maps a gRPC status code to the HTTP status of a REST
+// reply.
+func adminHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// adminServiceName is the full name of the service described in admin.proto.
+const adminServiceName = "thingsix.forwarder.admin.v1.ForwarderAdmin"
+
+// redactedSettings are parts of config keys of which the value is not
+// exposed by DumpConfig, settings ending with _file hold a path and are
+// exposed.
+var redactedSettings = []string{"passphrase", "secret", "token", "password", "key"}
+
+// AdminServer implements the gRPC admin service. The service uses protobuf
+// well-known types as messages so clients don't need generated code, the
+// fields of the returned structs are described in admin.proto.
+type AdminServer struct {
+	exchange *Exchange
+	// settings returns the loaded configuration
+	settings func() map[string]interface{}
+}
+
+// NewAdminServer returns the admin service for the given exchange.
+func NewAdminServer(exchange *Exchange) *AdminServer {
+	return &AdminServer{
+		exchange: exchange,
+		settings: viper.AllSettings,
+	}
+}
+
+// AdminGateway describes a gateway that is connected to the forwarder.
+type AdminGateway struct {
+	LocalID        lorawan.EUI64  `json:"localId"`
+	NetworkID      *lorawan.EUI64 `json:"networkId,omitempty"`
+	ConnectedSince time.Time      `json:"connectedSince"`
+	// LastSeen is the time the last uplink or stats message was received
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// ListGateways returns the connected gateways ordered by local id.
+func (s *AdminServer) ListGateways(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	gateways := make([]AdminGateway, 0)
+	for localID, presence := range s.exchange.health.connectedGatewayPresence() {
+		gw := AdminGateway{
+			LocalID:        localID,
+			ConnectedSince: presence.ConnectedSince,
+			LastSeen:       presence.LastSeen,
+		}
+		if known, err := s.exchange.gateways.ByLocalID(localID); err == nil {
+			gw.NetworkID = &known.NetworkID
+		}
+		gateways = append(gateways, gw)
+	}
+	sort.Slice(gateways, func(i, j int) bool {
+		return bytes.Compare(gateways[i].LocalID[:], gateways[j].LocalID[:]) < 0
+	})
+	return adminStruct(map[string]interface{}{"gateways": gateways})
+}
+
+// ListRouters returns the router clients and their connection state.
+func (s *AdminServer) ListRouters(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return adminStruct(map[string]interface{}{"routers": s.exchange.routingTable.RouterClients()})
+}
+
+// DisconnectRouter drops the connection with the router with the given id or
+// name, the forwarder stays disconnected until ReconnectRouter is called.
+func (s *AdminServer) DisconnectRouter(ctx context.Context, id *wrapperspb.StringValue) (*structpb.Struct, error) {
+	if err := s.exchange.routingTable.DisconnectRouter(id.GetValue()); err != nil {
+		return nil, adminError(err)
+	}
+	return s.router(id.GetValue())
+}
+
+// ReconnectRouter drops the connection with the router with the given id or
+// name and connects again immediately.
+func (s *AdminServer) ReconnectRouter(ctx context.Context, id *wrapperspb.StringValue) (*structpb.Struct, error) {
+	if err := s.exchange.routingTable.ReconnectRouter(id.GetValue()); err != nil {
+		return nil, adminError(err)
+	}
+	return s.router(id.GetValue())
+}
+
+func (s *AdminServer) router(id string) (*structpb.Struct, error) {
+	client, ok := s.exchange.routingTable.routerClient(id)
+	if !ok {
+		return nil, adminError(ErrRouterNotFound)
+	}
+	return adminStruct(map[string]interface{}{"router": client.Stats()})
+}
+
+// ListSites returns the sites with the aggregate stats of their gateways.
+func (s *AdminServer) ListSites(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return adminStruct(s.exchange.sites.Report(time.Now()))
+}
+
+// EnableSite enables all gateways of the site with the given id.
+func (s *AdminServer) EnableSite(ctx context.Context, id *wrapperspb.StringValue) (*structpb.Struct, error) {
+	return s.setSiteEnabled(ctx, id.GetValue(), true)
+}
+
+// DisableSite disables all gateways of the site with the given id.
+func (s *AdminServer) DisableSite(ctx context.Context, id *wrapperspb.StringValue) (*structpb.Struct, error) {
+	return s.setSiteEnabled(ctx, id.GetValue(), false)
+}
+
+func (s *AdminServer) setSiteEnabled(ctx context.Context, id string, enabled bool) (*structpb.Struct, error) {
+	reply, err := s.exchange.sites.SetEnabled(ctx, id, enabled)
+	if err != nil {
+		return nil, adminError(err)
+	}
+	return adminStruct(reply)
+}
+
+// DumpConfig returns the loaded configuration with secrets redacted.
+func (s *AdminServer) DumpConfig(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return adminStruct(redactSettings(s.settings()))
+}
+
+// FlushBuffers replays the buffered uplinks to the connected routers, or
+// drops them when discard is set.
+func (s *AdminServer) FlushBuffers(ctx context.Context, discard *wrapperspb.BoolValue) (*structpb.Struct, error) {
+	flush, err := s.exchange.FlushUplinkBuffer(ctx, discard.GetValue())
+	if err != nil {
+		return nil, adminError(err)
+	}
+	return adminStruct(map[string]interface{}{"uplinks": flush})
+}
+
+// adminStruct converts v through its JSON encoding into a struct message.
+func adminStruct(v interface{}) (*structpb.Struct, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	var msg structpb.Struct
+	if err := msg.UnmarshalJSON(raw); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &msg, nil
+}
+
+// adminError maps err to a gRPC status error.
+func adminError(err error) error {
+	switch errs.Kind(err) {
+	case errs.ErrNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case errs.ErrAlreadyExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errs.ErrInvalidArgument:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errs.ErrNotSupported:
+		return status.Error(codes.Unimplemented, err.Error())
+	case errs.ErrFailedPrecondition:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errs.ErrResourceExhausted:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errs.ErrNoRoute, errs.ErrUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// redactSettings returns a copy of settings without the values of secret
+// keys, passwords in URLs and PINs in PKCS#11 URIs.
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if _, nested := value.(map[string]interface{}); !nested && secretSetting(key) {
+			redacted[key] = "redacted"
+			continue
+		}
+		redacted[key] = redactSetting(value)
+	}
+	return redacted
+}
+
+// secretSetting returns an indication if the value of the config key is a
+// secret. PIN is matched as a whole word to not match e.g. ping_interval.
+func secretSetting(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "_file") {
+		return false
+	}
+	for _, word := range strings.FieldsFunc(key, func(r rune) bool { return r == '_' || r == '-' }) {
+		if word == "pin" {
+			return true
+		}
+	}
+	for _, part := range redactedSettings {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactSetting(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return redactSettings(value)
+	case []interface{}:
+		redacted := make([]interface{}, len(value))
+		for i := range value {
+			redacted[i] = redactSetting(value[i])
+		}
+		return redacted
+	case string:
+		if strings.HasPrefix(value, "pkcs11:") {
+			return redactPKCS11URI(value)
+		}
+		if u, err := url.Parse(value); err == nil && strings.Contains(value, "://") {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// redactPKCS11URI returns the PKCS#11 URI without the pin-value attribute.
+func redactPKCS11URI(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "redacted"
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "redacted"
+	}
+	if _, ok := query["pin-value"]; !ok {
+		return value
+	}
+	query.Del("pin-value")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// adminService is the handler type of adminServiceDesc.
+type adminService interface {
+	ListGateways(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	ListRouters(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	DisconnectRouter(context.Context, *wrapperspb.StringValue) (*structpb.Struct, error)
+	ReconnectRouter(context.Context, *wrapperspb.StringValue) (*structpb.Struct, error)
+	ListSites(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	EnableSite(context.Context, *wrapperspb.StringValue) (*structpb.Struct, error)
+	DisableSite(context.Context, *wrapperspb.StringValue) (*structpb.Struct, error)
+	DumpConfig(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	FlushBuffers(context.Context, *wrapperspb.BoolValue) (*structpb.Struct, error)
+}
+
+// adminServiceDesc describes the service in admin.proto, it is written by
+// hand since all messages are well-known types.
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: adminServiceName,
+	HandlerType: (*adminService)(nil),
+	Methods: []grpc.MethodDesc{
+		adminMethod("ListGateways", adminService.ListGateways),
+		adminMethod("ListRouters", adminService.ListRouters),
+		adminMethod("DisconnectRouter", adminService.DisconnectRouter),
+		adminMethod("ReconnectRouter", adminService.ReconnectRouter),
+		adminMethod("ListSites", adminService.ListSites),
+		adminMethod("EnableSite", adminService.EnableSite),
+		adminMethod("DisableSite", adminService.DisableSite),
+		adminMethod("DumpConfig", adminService.DumpConfig),
+		adminMethod("FlushBuffers", adminService.FlushBuffers),
+	},
+	Metadata: "forwarder/admin.proto",
+}
+
+// adminMethod returns the description of a unary method that decodes its
+// request in a new Req and passes it to call.
+func adminMethod[Req any, PReq interface {
+	*Req
+	proto.Message
+}](name string, call func(adminService, context.Context, PReq) (*structpb.Struct, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := PReq(new(Req))
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(adminService), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + adminServiceName + "/" + name,
+			}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(adminService), ctx, req.(PReq))
+			})
+		},
+	}
+}
+
+// bearerTokenInterceptor only passes calls with a bearer token in the
+// authorization metadata of which the hash is in tokens.
+func bearerTokenInterceptor(tokens [][sha256.Size]byte) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, auth := range md.Get("authorization") {
+			if strings.HasPrefix(auth, "Bearer ") && validBearerToken(tokens, strings.TrimPrefix(auth, "Bearer ")) {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing bearer token")
+	}
+}
+
+// runAdminAPI serves the admin API on ln until ctx expires. The service is
+// served over gRPC, gRPC-Web and REST on the same port.
+func runAdminAPI(ctx context.Context, cfg *Config, ln net.Listener, exchange *Exchange) {
+	acfg := cfg.Forwarder.Admin
+	tokens, err := loadBearerTokens(acfg.Tokens, acfg.TokensFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to load admin API tokens")
+	}
+
+	var (
+		interceptor = bearerTokenInterceptor(tokens)
+		admin       = NewAdminServer(exchange)
+		grpcSrv     = grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+		useTLS      = acfg.CertFile != "" && acfg.KeyFile != ""
+	)
+	grpcSrv.RegisterService(&adminServiceDesc, admin)
+
+	handler := adminHandler(grpcSrv, admin, interceptor)
+	if !useTLS {
+		// gRPC requires HTTP/2, without TLS it is negotiated in plain text
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	srv := http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 15 * time.Second,
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"addr":   acfg.Address,
+		"tokens": len(tokens),
+		"tls":    useTLS,
+	}).Info("start admin API")
+
+	stopped := make(chan error)
+	go func() {
+		<-ctx.Done()
+		// give in progress calls some time to complete
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		grpcSrv.Stop()
+		stopped <- err
+	}()
+
+	if useTLS {
+		err = srv.ServeTLS(ln, acfg.CertFile, acfg.KeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).Fatal("admin API crashed")
+	}
+
+	<-stopped
+}
@@ -0,0 +1,223 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+)
+
+// AlertSeverity indicates how urgent an alert is.
+type AlertSeverity string
+
+const (
+	AlertSeverityInfo     AlertSeverity = "info"
+	AlertSeverityWarning  AlertSeverity = "warning"
+	AlertSeverityCritical AlertSeverity = "critical"
+)
+
+// Alert describes a condition detected by the forwarder that operators
+// should act upon. Alerts are identified by their key, raising an alert with
+// the same key updates it.
+type Alert struct {
+	Key              string                 `json:"key"`
+	Kind             string                 `json:"kind"`
+	Severity         AlertSeverity          `json:"severity"`
+	GatewayNetworkID *lorawan.EUI64         `json:"gatewayNetworkId,omitempty"`
+	GatewayLocalID   *lorawan.EUI64         `json:"gatewayLocalId,omitempty"`
+	Summary          string                 `json:"summary"`
+	Details          map[string]interface{} `json:"details,omitempty"`
+	Since            time.Time              `json:"since"`
+	Updated          time.Time              `json:"updated"`
+	// Resolved is set in webhook notifications for resolved alerts
+	Resolved *time.Time `json:"resolved,omitempty"`
+}
+
+// alertNotification is the payload posted to webhooks.
+type alertNotification struct {
+	Status string `json:"status"`
+	Alert  Alert  `json:"alert"`
+}
+
+// Alerter keeps track of active alerts and notifies webhooks when alerts are
+// raised or resolved.
+type Alerter struct {
+	mu     sync.Mutex
+	active map[string]*Alert
+
+	webhooks      []string
+	client        *http.Client
+	notifications chan alertNotification
+}
+
+// NewAlerter returns an alerter that notifies the webhooks from cfg, cfg can
+// be nil in which case alerts are only available through the API.
+func NewAlerter(cfg *ForwarderAlertsConfig) *Alerter {
+	a := &Alerter{
+		active:        make(map[string]*Alert),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		notifications: make(chan alertNotification, 256),
+	}
+	if cfg != nil {
+		a.webhooks = cfg.Webhooks
+		if cfg.Timeout != nil && *cfg.Timeout > 0 {
+			a.client.Timeout = *cfg.Timeout
+		}
+	}
+	return a
+}
+
+// Raise activates the alert or updates it when an alert with the same key is
+// already active. Webhooks are only notified for new alerts and when the
+// severity changes.
+func (a *Alerter) Raise(alert Alert) {
+	now := time.Now()
+
+	a.mu.Lock()
+	existing, ok := a.active[alert.Key]
+	notify := !ok || existing.Severity != alert.Severity
+	if ok {
+		alert.Since = existing.Since
+	} else {
+		alert.Since = now
+	}
+	alert.Updated = now
+	a.active[alert.Key] = &alert
+	a.mu.Unlock()
+
+	if notify {
+		logrus.WithFields(logrus.Fields{
+			"alert":    alert.Key,
+			"severity": alert.Severity,
+		}).Warn(alert.Summary)
+		a.notify(alertNotification{Status: "firing", Alert: alert})
+	}
+}
+
+// Resolve deactivates the alert with the given key, if active.
+func (a *Alerter) Resolve(key string) {
+	a.mu.Lock()
+	alert, ok := a.active[key]
+	delete(a.active, key)
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	now := time.Now()
+	resolved := *alert
+	resolved.Updated, resolved.Resolved = now, &now
+
+	logrus.WithField("alert", key).Info("alert resolved")
+	a.notify(alertNotification{Status: "resolved", Alert: resolved})
+}
+
+// ResolveKind resolves all active alerts of the given kind for which keep
+// returns false.
+func (a *Alerter) ResolveKind(kind string, keep func(key string) bool) {
+	var keys []string
+	a.mu.Lock()
+	for key, alert := range a.active {
+		if alert.Kind == kind && !keep(key) {
+			keys = append(keys, key)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, key := range keys {
+		a.Resolve(key)
+	}
+}
+
+// Active returns the active alerts ordered by key.
+func (a *Alerter) Active() []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(a.active))
+	for _, alert := range a.active {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Key < alerts[j].Key })
+	return alerts
+}
+
+func (a *Alerter) notify(n alertNotification) {
+	if len(a.webhooks) == 0 {
+		return
+	}
+	select {
+	case a.notifications <- n:
+	default:
+		logrus.WithField("alert", n.Alert.Key).Warn("alert notification queue full, drop notification")
+	}
+}
+
+// Run delivers notifications to the webhooks until ctx expires.
+func (a *Alerter) Run(ctx context.Context) {
+	for {
+		select {
+		case n := <-a.notifications:
+			for _, webhook := range a.webhooks {
+				if err := a.post(ctx, webhook, n); err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{
+						"alert":   n.Alert.Key,
+						"webhook": webhook,
+					}).Warn("unable to deliver alert notification")
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Alerter) post(ctx context.Context, webhook string, n alertNotification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Alerts returns the active alerts.
+func (svc APIService) Alerts(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, svc.alerter.Active())
+}
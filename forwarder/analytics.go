@@ -0,0 +1,334 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
+	"github.com/ThingsIXFoundation/packet-handling/objectstore"
+	"github.com/ThingsIXFoundation/packet-handling/parquet"
+	"github.com/sirupsen/logrus"
+)
+
+var analyticsExportFeature = features.Register("analytics_export",
+	"export packet events to the analytics sinks", true)
+
+// analyticsColumn is a column in an exported analytics schema.
+type analyticsColumn struct {
+	parquet.Column
+	value func(ev *PacketEvent) interface{}
+}
+
+func (c analyticsColumn) bigQueryValue(ev *PacketEvent) interface{} {
+	if c.Type == parquet.Timestamp {
+		// BigQuery accepts timestamps as seconds since the epoch
+		return float64(ev.Time.UnixMicro()) / 1e6
+	}
+	return c.value(ev)
+}
+
+// analyticsSchemas holds the exported columns per schema version. Existing
+// versions must not change, consumers rely on them. Add a new version when
+// columns are added or changed.
+var analyticsSchemas = map[int][]analyticsColumn{
+	1: analyticsSchemaV1,
+	2: append(append([]analyticsColumn{}, analyticsSchemaV1...), analyticsSchemaV2...),
+}
+
+// latestAnalyticsSchema is the schema version used if none is configured
+const latestAnalyticsSchema = 2
+
+var analyticsSchemaV1 = []analyticsColumn{
+	{parquet.Column{Name: "time", Type: parquet.Timestamp}, func(ev *PacketEvent) interface{} { return ev.Time }},
+	{parquet.Column{Name: "type", Type: parquet.String}, func(ev *PacketEvent) interface{} { return string(ev.Type) }},
+	{parquet.Column{Name: "gw_network_id", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.GatewayNetworkID.String() }},
+	{parquet.Column{Name: "gw_local_id", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.GatewayLocalID.String() }},
+	{parquet.Column{Name: "frequency", Type: parquet.Int64}, func(ev *PacketEvent) interface{} { return int64(ev.Frequency) }},
+	{parquet.Column{Name: "spreading_factor", Type: parquet.Int32}, func(ev *PacketEvent) interface{} { return int32(ev.SpreadingFactor) }},
+	{parquet.Column{Name: "bandwidth", Type: parquet.Int32}, func(ev *PacketEvent) interface{} { return int32(ev.Bandwidth) }},
+	{parquet.Column{Name: "rssi", Type: parquet.Int32}, func(ev *PacketEvent) interface{} { return ev.RSSI }},
+	{parquet.Column{Name: "snr", Type: parquet.Double}, func(ev *PacketEvent) interface{} { return float64(ev.SNR) }},
+	{parquet.Column{Name: "payload_size", Type: parquet.Int32}, func(ev *PacketEvent) interface{} { return int32(ev.PayloadSize) }},
+	{parquet.Column{Name: "airtime_ms", Type: parquet.Int64}, func(ev *PacketEvent) interface{} { return ev.Airtime.Milliseconds() }},
+}
+
+var analyticsSchemaV2 = []analyticsColumn{
+	{parquet.Column{Name: "owner", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.Owner }},
+	{parquet.Column{Name: "region", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.Region }},
+	{parquet.Column{Name: "mtype", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.MType }},
+	{parquet.Column{Name: "dev_addr", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.DevAddr }},
+	{parquet.Column{Name: "dev_eui", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.DevEUI }},
+	{parquet.Column{Name: "fcnt", Type: parquet.Int64}, func(ev *PacketEvent) interface{} { return int64(ev.FCnt) }},
+	{parquet.Column{Name: "downlink_id", Type: parquet.Int64}, func(ev *PacketEvent) interface{} { return int64(ev.DownlinkID) }},
+	{parquet.Column{Name: "tx_ack_status", Type: parquet.String}, func(ev *PacketEvent) interface{} { return ev.TxAckStatus }},
+}
+
+// analyticsSink receives batches of packet events.
+type analyticsSink interface {
+	Name() string
+	Export(ctx context.Context, events []*PacketEvent) error
+}
+
+// asyncAnalyticsSink is implemented by sinks that export in the background,
+// Run is called for the lifetime of the exporter.
+type asyncAnalyticsSink interface {
+	analyticsSink
+	Run(ctx context.Context)
+}
+
+// AnalyticsExporter batches packet events from the exchange and exports them
+// to the configured sinks.
+type AnalyticsExporter struct {
+	schemaVersion int
+	batchSize     int
+	flushInterval time.Duration
+	sinks         []analyticsSink
+}
+
+// NewAnalyticsExporter returns an exporter configured from cfg.
+func NewAnalyticsExporter(cfg *ForwarderAnalyticsConfig) (*AnalyticsExporter, error) {
+	exporter := &AnalyticsExporter{
+		schemaVersion: cfg.SchemaVersion,
+		batchSize:     cfg.BatchSize,
+		flushInterval: time.Minute,
+	}
+	if exporter.schemaVersion == 0 {
+		exporter.schemaVersion = latestAnalyticsSchema
+	}
+	schema, ok := analyticsSchemas[exporter.schemaVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported analytics schema version %d", exporter.schemaVersion)
+	}
+	if exporter.batchSize <= 0 {
+		exporter.batchSize = 10000
+	}
+	if cfg.FlushInterval != nil && *cfg.FlushInterval > 0 {
+		exporter.flushInterval = *cfg.FlushInterval
+	}
+
+	if cfg.Parquet != nil {
+		sink, err := newParquetSink(cfg, schema, exporter.schemaVersion)
+		if err != nil {
+			return nil, err
+		}
+		exporter.sinks = append(exporter.sinks, sink)
+	}
+	if cfg.BigQuery != nil {
+		sink, err := newBigQuerySink(cfg, schema)
+		if err != nil {
+			return nil, err
+		}
+		exporter.sinks = append(exporter.sinks, sink)
+	}
+	if cfg.ClickHouse != nil {
+		sink, err := newClickHouseSink(cfg, schema)
+		if err != nil {
+			return nil, err
+		}
+		exporter.sinks = append(exporter.sinks, sink)
+	}
+	if len(exporter.sinks) == 0 {
+		return nil, fmt.Errorf("analytics exporter requires a parquet, bigquery or clickhouse sink")
+	}
+
+	return exporter, nil
+}
+
+// Run exports packet events from the exchange until the given context
+// expires, pending events are exported before it returns.
+func (a *AnalyticsExporter) Run(ctx context.Context, exchange *Exchange) {
+	var (
+		events = make(chan *PacketEvent, 8192)
+		batch  = make([]*PacketEvent, 0, a.batchSize)
+		ticker = time.NewTicker(a.flushInterval)
+	)
+	defer ticker.Stop()
+
+	exchange.SubscribePacketEvents(events)
+	defer exchange.UnsubscribePacketEvents(events)
+
+	// background sinks stop after the final batch is handed over
+	var (
+		sinksCtx, stopSinks = context.WithCancel(context.Background())
+		sinksDone           sync.WaitGroup
+	)
+	defer func() {
+		stopSinks()
+		sinksDone.Wait()
+	}()
+	for _, sink := range a.sinks {
+		if async, ok := sink.(asyncAnalyticsSink); ok {
+			sinksDone.Add(1)
+			go func() {
+				async.Run(sinksCtx)
+				sinksDone.Done()
+			}()
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"schema_version": a.schemaVersion,
+		"sinks":          len(a.sinks),
+		"pseudonymized":  exchange.analyticsIDs != nil,
+	}).Info("export packet events for analytics")
+
+	for {
+		select {
+		case ev := <-events:
+			if exchange.analyticsIDs != nil {
+				ev = pseudonymizePacketEvent(exchange.analyticsIDs, ev)
+			}
+			batch = append(batch, ev)
+			if len(batch) >= a.batchSize {
+				a.export(ctx, batch)
+				batch = make([]*PacketEvent, 0, a.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				a.export(ctx, batch)
+				batch = make([]*PacketEvent, 0, a.batchSize)
+			}
+		case <-ctx.Done():
+			if len(batch) > 0 {
+				exportCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				a.export(exportCtx, batch)
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+func (a *AnalyticsExporter) export(ctx context.Context, batch []*PacketEvent) {
+	if !analyticsExportFeature.Enabled() {
+		for _, sink := range a.sinks {
+			analyticsExportCounter.WithLabelValues(sink.Name(), "disabled").Add(float64(len(batch)))
+		}
+		logrus.WithField("events", len(batch)).Debug("analytics export feature disabled, drop packet events")
+		return
+	}
+	for _, sink := range a.sinks {
+		log := logrus.WithFields(logrus.Fields{
+			"sink":   sink.Name(),
+			"events": len(batch),
+		})
+		if err := sink.Export(ctx, batch); err != nil {
+			log.WithError(err).Error("unable to export packet events")
+			analyticsExportCounter.WithLabelValues(sink.Name(), "failed").Add(float64(len(batch)))
+			continue
+		}
+		log.Debug("exported packet events")
+		analyticsExportCounter.WithLabelValues(sink.Name(), "success").Add(float64(len(batch)))
+	}
+}
+
+// parquetSink writes each batch to a Parquet file in a local directory or in
+// object storage.
+type parquetSink struct {
+	schema        []analyticsColumn
+	schemaVersion int
+	codec         parquet.Codec
+	directory     string
+	prefix        string
+	store         *objectstore.Client
+}
+
+func newParquetSink(cfg *ForwarderAnalyticsConfig, schema []analyticsColumn, version int) (*parquetSink, error) {
+	codec, err := parquet.ParseCodec(cfg.Parquet.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &parquetSink{
+		schema:        schema,
+		schemaVersion: version,
+		codec:         codec,
+		directory:     cfg.Parquet.Directory,
+		prefix:        cfg.Parquet.Prefix,
+	}
+	if sink.prefix != "" && !strings.HasSuffix(sink.prefix, "/") {
+		sink.prefix += "/"
+	}
+
+	if cfg.Parquet.ObjectStore != nil {
+		if sink.store, err = objectstore.New(*cfg.Parquet.ObjectStore); err != nil {
+			return nil, err
+		}
+	} else if sink.directory == "" {
+		return nil, fmt.Errorf("parquet analytics export requires a directory or object store")
+	} else if err := os.MkdirAll(sink.directory, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create parquet analytics directory: %w", err)
+	}
+
+	return sink, nil
+}
+
+func (s *parquetSink) Name() string {
+	return "parquet"
+}
+
+func (s *parquetSink) Export(ctx context.Context, events []*PacketEvent) error {
+	columns := make([]parquet.Column, len(s.schema))
+	for i, col := range s.schema {
+		columns[i] = col.Column
+	}
+
+	var buf bytes.Buffer
+	w, err := parquet.NewWriter(&buf, columns, s.codec)
+	if err != nil {
+		return err
+	}
+	w.SetMetadata("schema_version", fmt.Sprint(s.schemaVersion))
+
+	row := make([]interface{}, len(s.schema))
+	for _, ev := range events {
+		for i, col := range s.schema {
+			row[i] = col.value(ev)
+		}
+		if err := w.Write(row...); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	var (
+		first = events[0].Time.UTC()
+		name  = fmt.Sprintf("packets-v%d-%d.parquet", s.schemaVersion, first.UnixMilli())
+	)
+
+	if s.store != nil {
+		key := fmt.Sprintf("%sdate=%s/%s", s.prefix, first.Format("2006-01-02"), name)
+		return s.store.Put(ctx, key, buf.Bytes(), "application/vnd.apache.parquet")
+	}
+
+	// write to a temporary file first so readers never see partial files
+	path := filepath.Join(s.directory, name)
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -19,27 +19,35 @@ package forwarder
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/broadcast"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/health"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/brocaar/lorawan"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-func runAPI(ctx context.Context, cfg *Config, store gateway.GatewayStore, unknownGateways gateway.UnknownGatewayLogger) {
-	if cfg.Forwarder.Gateways.HttpAPI.Address == "" {
+func runAPI(ctx context.Context, cfg *Config, ln net.Listener, exchange *Exchange) {
+	if ln == nil {
 		logrus.Info("forwarder HTTP API disabled")
 		return
 	}
@@ -53,14 +61,7 @@ func runAPI(ctx context.Context, cfg *Config, store gateway.GatewayStore, unknow
 		MaxAge:           300,
 	}))
 
-	service := APIService{
-		gateways:                     store,
-		chainID:                      new(big.Int).SetUint64(cfg.BlockChain.Polygon.ChainID),
-		batchOnboarderAddress:        cfg.Forwarder.Gateways.BatchOnboarder.Address,
-		earlyAdopterOnboarderAddress: cfg.Forwarder.Gateways.EarlyAdopter.Address,
-		unknown:                      unknownGateways,
-		thingsIXOnboardEndpoint:      cfg.Forwarder.Gateways.ThingsIXOnboardEndpoint,
-	}
+	service := newAPIService(cfg, exchange)
 
 	logrus.WithFields(logrus.Fields{
 		"chain_id":        service.chainID,
@@ -68,19 +69,7 @@ func runAPI(ctx context.Context, cfg *Config, store gateway.GatewayStore, unknow
 		"batch_onboarder": cfg.Forwarder.Gateways.BatchOnboarder.Address,
 	}).Info("start forwarder HTTP API")
 
-	root.Get("/info", Info)
-
-	root.Route("/v1", func(r chi.Router) {
-		r.Route("/gateways", func(r chi.Router) {
-			r.Post("/", service.AddGateway)
-			r.Post("/onboard", service.OnboardGatewayMessage)
-			r.Post("/import", service.ImportGateways)
-			r.Get("/", service.ListGateways)
-			r.Get("/unknown", service.ListUnknownGateways)
-			r.Get("/{local_id}", service.Gateway)
-			r.Get("/{local_id}/sync", service.SyncGateway)
-		})
-	})
+	root.Mount("/", newAPIRouter(service))
 
 	srv := http.Server{
 		Handler:      root,
@@ -97,13 +86,176 @@ func runAPI(ctx context.Context, cfg *Config, store gateway.GatewayStore, unknow
 		stopped <- srv.Shutdown(ctx)
 	}()
 
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logrus.WithError(err).Fatal("HTTP service crashed")
 	}
 
 	<-stopped
 }
 
+// newAPIService returns the API service for the given exchange.
+func newAPIService(cfg *Config, exchange *Exchange) APIService {
+	return APIService{
+		gateways:                     exchange.gateways,
+		chainID:                      new(big.Int).SetUint64(cfg.BlockChain.Polygon.ChainID),
+		batchOnboarderAddress:        cfg.Forwarder.Gateways.BatchOnboarder.Address,
+		earlyAdopterOnboarderAddress: cfg.Forwarder.Gateways.EarlyAdopter.Address,
+		unknown:                      exchange.recordUnknownGateway,
+		thingsIXOnboardEndpoint:      cfg.Forwarder.Gateways.ThingsIXOnboardEndpoint,
+		heatmap:                      exchange.heatmap,
+		coverageGaps:                 exchange.coverageGaps,
+		coverageProofs:               exchange.coverageProofs,
+		deviceDensity:                exchange.deviceDensity,
+		routingTable:                 exchange.routingTable,
+		recentEvents:                 exchange.recentEvents,
+		packetEvents:                 exchange.packetEvents,
+		scheduler:                    exchange.scheduler,
+		uplinkLanes:                  exchange.uplinkLanes,
+		telemetry:                    exchange.telemetry,
+		heartbeat:                    exchange.heartbeat,
+		slo:                          exchange.slo,
+		payloadStats:                 exchange.payloadStats,
+		channelStats:                 exchange.channelStats,
+		alerter:                      exchange.alerter,
+		selfTests:                    exchange.selfTests,
+		downlinkSimulator:            exchange.downlinkSimulator,
+		registryChanges:              exchange.registryChanges,
+		downlinkStats:                exchange.downlinkStats,
+		clockDrift:                   exchange.clockDrift,
+		healthChecks:                 exchange.healthChecks,
+		injectUplink:                 exchange.InjectUplink,
+		sites:                        exchange.sites,
+	}
+}
+
+// newAPIRouter returns a router with all forwarder API routes. Routes added
+// here must be documented in api.yaml.
+func newAPIRouter(service APIService) chi.Router {
+	root := chi.NewRouter()
+	root.Get("/info", Info)
+	root.Get("/build-info", BuildInfo)
+	root.Get("/openapi.json", OpenAPISpec)
+	root.Get("/healthz", health.LivenessHandler(service.healthChecks))
+	root.Get("/readyz", health.ReadinessHandler(service.healthChecks))
+
+	root.Route("/v1", func(r chi.Router) {
+		r.Route("/gateways", func(r chi.Router) {
+			r.Post("/", service.AddGateway)
+			r.Post("/onboard", service.OnboardGatewayMessage)
+			r.Post("/import", service.ImportGateways)
+			r.Get("/", service.ListGateways)
+			r.Get("/unknown", service.ListUnknownGateways)
+			r.Get("/registry-changes", service.RegistryChanges)
+			r.Post("/bulk", service.BulkGateways)
+			r.Get("/{local_id}", service.Gateway)
+			r.Put("/{local_id}", service.EnsureGateway)
+			r.Put("/{local_id}/metadata", service.SetGatewayMetadata)
+			r.Get("/{local_id}/sync", service.SyncGateway)
+			r.Post("/{local_id}/selftest", service.StartSelfTest)
+			r.Get("/{local_id}/selftest", service.SelfTestReport)
+			r.Post("/{local_id}/downlink", service.SendSimulatedDownlink)
+			r.Get("/{local_id}/downlink", service.SimulatedDownlinks)
+			r.Get("/{local_id}/coverage-proof", service.GatewayCoverageProof)
+			r.Get("/{local_id}/channels", service.GatewayChannelStats)
+		})
+		r.Route("/sites", func(r chi.Router) {
+			r.Get("/", service.ListSites)
+			r.Get("/{site_id}", service.Site)
+			r.Post("/{site_id}/enable", service.EnableSite)
+			r.Post("/{site_id}/disable", service.DisableSite)
+		})
+		r.Route("/routes", func(r chi.Router) {
+			r.Get("/", service.ListRoutes)
+			r.Get("/changes", service.RouteChanges)
+			r.Put("/{name}", service.SetRoute)
+			r.Delete("/{name}", service.DeleteRoute)
+		})
+		r.Route("/features", func(r chi.Router) {
+			r.Get("/", service.ListFeatures)
+			r.Get("/{name}", service.Feature)
+			r.Put("/{name}", service.SetFeature)
+			r.Delete("/{name}", service.ResetFeature)
+		})
+		r.Route("/stats", func(r chi.Router) {
+			r.Get("/heatmap", service.AirtimeHeatmap)
+			r.Get("/coverage-gaps", service.CoverageGaps)
+			r.Get("/coverage-proofs", service.CoverageProofs)
+			r.Get("/devices", service.DeviceDensity)
+			r.Get("/runtime", service.RuntimeStats)
+			r.Get("/slo", service.SLO)
+			r.Get("/slo/latency", service.RouteLatency)
+			r.Get("/payloads", service.PayloadStats)
+			r.Get("/channels", service.ChannelStats)
+			r.Get("/downlinks", service.DownlinkStats)
+			r.Get("/downlinks/{dev_addr}", service.DeviceDownlinkStats)
+			r.Get("/clock-drift", service.ClockDrift)
+			r.Get("/telemetry", service.GatewayTelemetry)
+			r.Get("/heartbeat", service.Heartbeat)
+		})
+		r.Route("/log/levels", func(r chi.Router) {
+			r.Get("/", service.LogLevels)
+			r.Put("/{module}", service.SetLogLevel)
+			r.Delete("/{module}", service.ResetLogLevel)
+		})
+		r.Get("/alerts", service.Alerts)
+		r.Get("/events", service.ListPacketEvents)
+		r.Get("/events/stream", service.EventStream)
+		r.Route("/graphql", func(r chi.Router) {
+			r.Get("/", service.GraphQL)
+			r.Post("/", service.GraphQL)
+			r.Get("/schema", service.GraphQLSchema)
+		})
+	})
+
+	return root
+}
+
+// ListFeatures returns all feature flags and their current state.
+func (svc APIService) ListFeatures(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, features.All())
+}
+
+// Feature returns the feature flag identified by the name in the path.
+func (svc APIService) Feature(w http.ResponseWriter, r *http.Request) {
+	status, err := features.Get(chi.URLParam(r, "name"))
+	replyFeature(w, status, err)
+}
+
+// SetFeature enables or disables the feature flag identified by the name in
+// the path. The change takes effect immediately and is not persisted.
+func (svc APIService) SetFeature(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Enabled == nil {
+		http.Error(w, "missing enabled", http.StatusBadRequest)
+		return
+	}
+
+	status, err := features.Set(chi.URLParam(r, "name"), *req.Enabled)
+	replyFeature(w, status, err)
+}
+
+// ResetFeature sets the feature flag identified by the name in the path back
+// to its default state.
+func (svc APIService) ResetFeature(w http.ResponseWriter, r *http.Request) {
+	status, err := features.Reset(chi.URLParam(r, "name"))
+	replyFeature(w, status, err)
+}
+
+func replyFeature(w http.ResponseWriter, status features.Status, err error) {
+	if errors.Is(err, features.ErrUnknownFlag) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	replyJSON(w, http.StatusOK, status)
+}
+
 func replyJSON(w http.ResponseWriter, statusCode int, message interface{}) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -117,6 +269,29 @@ type APIService struct {
 	earlyAdopterOnboarderAddress common.Address
 	unknown                      gateway.UnknownGatewayLogger
 	thingsIXOnboardEndpoint      string
+	heatmap                      *AirtimeHeatmap
+	coverageGaps                 *CoverageGapReporter
+	coverageProofs               *CoverageProofs
+	deviceDensity                *DeviceDensity
+	routingTable                 *RoutingTable
+	recentEvents                 *recentPacketEvents
+	packetEvents                 *broadcast.Broadcaster[*PacketEvent]
+	scheduler                    *DownlinkScheduler
+	uplinkLanes                  *UplinkLanes
+	telemetry                    *GatewayTelemetry
+	heartbeat                    *Heartbeat
+	slo                          *SLOTracker
+	payloadStats                 *PayloadStats
+	channelStats                 *ChannelStats
+	alerter                      *Alerter
+	selfTests                    *SelfTester
+	downlinkSimulator            *DownlinkSimulator
+	registryChanges              *RegistryWatcher
+	downlinkStats                *DownlinkStats
+	clockDrift                   *ClockDriftEstimator
+	healthChecks                 health.Checker
+	injectUplink                 func(*gateway.Gateway, InjectUplinkRequest) (InjectedUplink, error)
+	sites                        *Sites
 }
 
 func (svc APIService) AddGateway(w http.ResponseWriter, r *http.Request) {
@@ -162,6 +337,104 @@ func (svc APIService) AddGateway(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// EnsureGateway adds the gateway identified by the local id in the path with
+// the private key from the request if it is not in the store. If the gateway
+// is already in the store its key must match the key from the request. It
+// replies with 201 when the gateway was added, 200 when it was already in the
+// store with the same key and 409 when the gateway or key is in use with
+// different details.
+func (svc APIService) EnsureGateway(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			PrivateKey string `json:"privateKey"`
+			KeyRef     string `json:"keyRef"`
+		}
+	)
+
+	localID, err := gateway.ParseEUI64(chi.URLParam(r, "local_id"))
+	if err != nil {
+		http.Error(w, "invalid gateway local id", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		key       *ecdsa.PrivateKey
+		signer    gateway.KeySigner
+		networkID lorawan.EUI64
+	)
+	if req.KeyRef != "" {
+		if req.PrivateKey != "" {
+			http.Error(w, "privateKey and keyRef are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		if _, ok := svc.gateways.(gateway.KeyRefStore); !ok {
+			http.Error(w, "gateway store doesn't support key references", http.StatusBadRequest)
+			return
+		}
+		if signer, err = gateway.OpenKeyRef(req.KeyRef); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		networkID = gateway.GatewayNetworkIDFromPublicKey(signer.Public())
+	} else {
+		keyBytes, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(req.PrivateKey), "0x"))
+		if err != nil {
+			http.Error(w, "invalid private key", http.StatusBadRequest)
+			return
+		}
+		if key, err = crypto.ToECDSA(keyBytes); err != nil {
+			http.Error(w, "invalid private key", http.StatusBadRequest)
+			return
+		}
+		networkID = gateway.GatewayNetworkIDFromPrivateKey(key)
+	}
+
+	gw, err := svc.gateways.ByLocalID(localID)
+	switch {
+	case err == nil:
+		if gw.NetworkID != networkID {
+			http.Error(w, "gateway in store with a different key", http.StatusConflict)
+			return
+		}
+		replyJSON(w, http.StatusOK, gw)
+		return
+	case !errors.Is(err, gateway.ErrNotFound):
+		logrus.WithError(err).Error("unable to determine if gateway is in store")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if other, err := svc.gateways.ByNetworkID(networkID); err == nil {
+		http.Error(w, fmt.Sprintf("key in use by gateway %s", other.LocalID), http.StatusConflict)
+		return
+	}
+
+	if signer != nil {
+		gw, err = svc.gateways.(gateway.KeyRefStore).AddKeyRef(r.Context(), localID, req.KeyRef, signer)
+	} else {
+		gw, err = svc.gateways.Add(r.Context(), localID, key)
+	}
+	switch {
+	case err == nil:
+		logrus.WithFields(logrus.Fields{
+			"gw_local_id":     gw.LocalID,
+			"gw_network_id":   gw.NetworkID,
+			"gw_external_key": gw.KeyRef != "",
+		}).Info("added gateway to store")
+		replyJSON(w, http.StatusCreated, gw)
+	case errors.Is(err, gateway.ErrAlreadyExists):
+		http.Error(w, "gateway added concurrently", http.StatusConflict)
+	default:
+		logrus.WithError(err).Error("unable to add new gateway entry to store")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
 func (svc APIService) ImportGateways(w http.ResponseWriter, r *http.Request) {
 	var (
 		req struct {
@@ -409,10 +682,56 @@ type OnboardGatewayReply struct {
 	Onboarder                    common.Address     `json:"onboarder"`
 }
 
+// gatewayListSpec describes how gateways can be filtered and sorted.
+var gatewayListSpec = listSpec[*gateway.Gateway]{
+	fields: map[string]func(*gateway.Gateway) string{
+		"localId":   func(gw *gateway.Gateway) string { return gw.LocalID.String() },
+		"networkId": func(gw *gateway.Gateway) string { return gw.NetworkID.String() },
+		"gatewayId": func(gw *gateway.Gateway) string { return gw.ID().String() },
+		"onboarded": func(gw *gateway.Gateway) string { return strconv.FormatBool(gw.Onboarded()) },
+		"disabled":  func(gw *gateway.Gateway) string { return strconv.FormatBool(gw.Disabled) },
+		"owner": func(gw *gateway.Gateway) string {
+			if gw.Owner == nil {
+				return ""
+			}
+			return gw.Owner.Hex()
+		},
+		"version": func(gw *gateway.Gateway) string {
+			if gw.Version == nil {
+				return ""
+			}
+			return strconv.Itoa(int(*gw.Version))
+		},
+		"band": func(gw *gateway.Gateway) string {
+			if gw.Details == nil || gw.Details.Band == nil {
+				return ""
+			}
+			return *gw.Details.Band
+		},
+		"name": func(gw *gateway.Gateway) string {
+			if gw.Metadata == nil {
+				return ""
+			}
+			return gw.Metadata.Name
+		},
+	},
+	numeric:     map[string]bool{"version": true},
+	id:          func(gw *gateway.Gateway) string { return gw.LocalID.String() },
+	defaultSort: "localId",
+}
+
+// ListGateways returns the gateways in the store grouped in pending and
+// onboarded gateways. If the request has pagination, filter or sort
+// parameters a single page of gateways is returned instead.
 func (svc APIService) ListGateways(w http.ResponseWriter, r *http.Request) {
 	var collector gateway.Collector
 	svc.gateways.Range(&collector)
 
+	if gatewayListSpec.requested(r) {
+		replyListPage(w, r, gatewayListSpec, collector.Gateways)
+		return
+	}
+
 	var (
 		pending   = make([]*gateway.Gateway, 0)
 		onboarded = make([]*gateway.Gateway, 0)
@@ -441,6 +760,23 @@ func (svc APIService) ListGateways(w http.ResponseWriter, r *http.Request) {
 	replyJSON(w, http.StatusOK, reply)
 }
 
+// unknownGatewayListSpec describes how recorded unknown gateways can be
+// filtered and sorted.
+var unknownGatewayListSpec = listSpec[*gateway.RecordedUnknownGateway]{
+	fields: map[string]func(*gateway.RecordedUnknownGateway) string{
+		"localId": func(gw *gateway.RecordedUnknownGateway) string { return gw.LocalID.String() },
+		"firstSeen": func(gw *gateway.RecordedUnknownGateway) string {
+			if gw.FirstSeen == nil {
+				return ""
+			}
+			return strconv.FormatInt(*gw.FirstSeen, 10)
+		},
+	},
+	numeric:     map[string]bool{"firstSeen": true},
+	id:          func(gw *gateway.RecordedUnknownGateway) string { return gw.LocalID.String() },
+	defaultSort: "localId",
+}
+
 func (svc APIService) ListUnknownGateways(w http.ResponseWriter, r *http.Request) {
 	recg, err := svc.unknown.Recorded()
 	switch {
@@ -451,6 +787,10 @@ func (svc APIService) ListUnknownGateways(w http.ResponseWriter, r *http.Request
 				filtered = append(filtered, r)
 			}
 		}
+		if unknownGatewayListSpec.requested(r) {
+			replyListPage(w, r, unknownGatewayListSpec, filtered)
+			return
+		}
 		replyJSON(w, http.StatusOK, filtered)
 	case errors.Is(err, gateway.ErrRecordingUnknownGatewaysDisabled):
 		http.Error(w, "recording unknown gateways disabled", http.StatusServiceUnavailable)
@@ -459,32 +799,26 @@ func (svc APIService) ListUnknownGateways(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// Gateway returns the gateway identified by the id in the path. The id can be
+// a local id, network id or ThingsIX id in any supported format or a short
+// form of one of these.
 func (svc APIService) Gateway(w http.ResponseWriter, r *http.Request) {
-	localID, err := utils.Eui64FromString(chi.URLParam(r, "local_id"))
-	if err != nil {
-		http.Error(w, "invalid gateway local id", http.StatusBadRequest)
-		return
-	}
-
-	gw, err := svc.gateways.ByLocalID(localID)
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
 	switch {
 	case err == nil:
 		replyJSON(w, http.StatusOK, gw)
-	case errors.Is(err, gateway.ErrNotFound):
-		http.NotFound(w, r)
 	default:
-		logrus.WithError(err).Error("unable to retrieve gateway")
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		replyGatewayLookupError(w, r, err)
 	}
 }
 
 func (svc APIService) SyncGateway(w http.ResponseWriter, r *http.Request) {
-	localID, err := utils.Eui64FromString(chi.URLParam(r, "local_id"))
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
 	if err != nil {
-		http.Error(w, "invalid gateway local id", http.StatusBadRequest)
+		replyGatewayLookupError(w, r, err)
 		return
 	}
-	gw, err := svc.gateways.SyncGatewayByLocalID(r.Context(), localID, true)
+	gw, err = svc.gateways.SyncGatewayByLocalID(r.Context(), gw.LocalID, true)
 	switch {
 	case err == nil:
 		replyJSON(w, http.StatusOK, gw)
@@ -496,6 +830,20 @@ func (svc APIService) SyncGateway(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func replyGatewayLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, gateway.ErrInvalidGatewayID):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, gateway.ErrAmbiguousGatewayID):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, gateway.ErrNotFound):
+		http.NotFound(w, r)
+	default:
+		logrus.WithError(err).Error("unable to retrieve gateway")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
 func Info(w http.ResponseWriter, r *http.Request) {
 	version, commit := utils.Info()
 	replyJSON(w, http.StatusOK, map[string]interface{}{
@@ -504,3 +852,8 @@ func Info(w http.ResponseWriter, r *http.Request) {
 		"network": viper.GetString("net"),
 	})
 }
+
+// BuildInfo replies with the build information of the running binary.
+func BuildInfo(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, utils.Build())
+}
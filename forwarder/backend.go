@@ -17,13 +17,16 @@
 package forwarder
 
 import (
+	"crypto/tls"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/basicstation"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/semtechudp"
 	chirpconfig "github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/config"
+	"github.com/ThingsIXFoundation/packet-handling/upgrade"
 	"github.com/brocaar/lorawan/band"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
@@ -33,11 +36,17 @@ import (
 // in the given cfg. Or an error in case of missing configuration or invalid
 // configuration.
 func buildBackend(cfg *Config) (Backend, error) {
+	if len(cfg.Forwarder.Backend.Enabled) > 0 {
+		return buildBackends(cfg, cfg.Forwarder.Backend.Enabled)
+	}
+
 	switch {
 	case cfg.Forwarder.Backend.BasicStation != nil && cfg.Forwarder.Backend.BasicStation.Region != "":
-		return buildBasicStationBackend(cfg)
+		return buildBackends(cfg, []string{"basic_station"})
+	case cfg.Forwarder.Backend.MQTT != nil:
+		return buildBackends(cfg, []string{"mqtt"})
 	case cfg.Forwarder.Backend.SemtechUDP != nil:
-		return buildSemtechUDPBackend(cfg)
+		return buildBackends(cfg, []string{"semtech_udp"})
 	case cfg.Forwarder.Backend.Concentratord != nil:
 		return nil, fmt.Errorf("backend concentratord not supported")
 	default:
@@ -45,6 +54,51 @@ func buildBackend(cfg *Config) (Backend, error) {
 	}
 }
 
+// buildBackends returns a backend that runs the backends with the given
+// names simultaneously.
+func buildBackends(cfg *Config, names []string) (Backend, error) {
+	var backends []Backend
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("backend %s enabled more than once", name)
+		}
+
+		var (
+			backend Backend
+			err     error
+		)
+		switch name {
+		case "semtech_udp":
+			if cfg.Forwarder.Backend.SemtechUDP == nil {
+				cfg.Forwarder.Backend.SemtechUDP = &ForwarderBackendSemtechUDPConfig{}
+			}
+			backend, err = buildSemtechUDPBackend(cfg)
+		case "basic_station":
+			if cfg.Forwarder.Backend.BasicStation == nil || cfg.Forwarder.Backend.BasicStation.Region == "" {
+				return nil, fmt.Errorf("backend basic_station enabled without region")
+			}
+			backend, err = buildBasicStationBackend(cfg)
+		case "mqtt":
+			if cfg.Forwarder.Backend.MQTT == nil {
+				return nil, fmt.Errorf("backend mqtt enabled without configuration")
+			}
+			backend, err = buildMQTTBackend(cfg)
+		default:
+			return nil, fmt.Errorf("unsupported backend %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, newMeteredBackend(name, backend))
+	}
+
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	backendLog.WithField("backends", names).Info("run multiple backends")
+	return newMultiBackend(names, backends), nil
+}
+
 // buildSemtechUDPBackend return the Chirpstack UDP backend implementation
 // based on the given cfg.
 func buildSemtechUDPBackend(cfg *Config) (*semtechudp.Backend, error) {
@@ -66,9 +120,24 @@ func buildSemtechUDPBackend(cfg *Config) (*semtechudp.Backend, error) {
 	chirpCfg.Backend.SemtechUDP.UDPBind = udpBind
 	chirpCfg.Backend.SemtechUDP.FakeRxTime = fakeRxTime
 
-	logrus.WithFields(logrus.Fields{
+	// let the backend pass uplinks without valid CRC when the exchange
+	// must handle them according to its CRC policy
+	if policies, err := buildCRCPolicies(cfg); err == nil {
+		chirpCfg.Backend.SemtechUDP.SkipCRCCheck = policies.forwardsCRCErrors()
+	}
+
+	// bind through the upgrader to reuse the socket from a parent process
+	// when this process was started as part of a zero-downtime upgrade
+	conn, err := upgrade.Default().ListenUDP(udpBind)
+	if err != nil {
+		return nil, fmt.Errorf("unable to bind semtech udp socket: %w", err)
+	}
+	chirpCfg.Backend.SemtechUDP.Conn = conn
+
+	backendLog.WithFields(logrus.Fields{
 		"udp_bind":     chirpCfg.Backend.SemtechUDP.UDPBind,
 		"fake_rx_time": chirpCfg.Backend.SemtechUDP.FakeRxTime,
+		"skip_crc":     chirpCfg.Backend.SemtechUDP.SkipCRCCheck,
 	}).Info("Semtech UDP backend")
 
 	backend, err := semtechudp.NewBackend(chirpCfg)
@@ -86,24 +155,40 @@ func buildBasicStationBackend(cfg *Config) (*basicstation.Backend, error) {
 		return nil, fmt.Errorf("unsupported region %s", cfg.Forwarder.Backend.BasicStation.Region)
 	}
 
-	var chirpCfg chirpconfig.Config
+	var (
+		bsCfg    = cfg.Forwarder.Backend.BasicStation
+		chirpCfg chirpconfig.Config
+	)
 	chirpCfg.Backend.Type = "basic_station"
 	chirpCfg.Backend.BasicStation.Region = b.Name()
-	chirpCfg.Backend.BasicStation.CACert = *cfg.Forwarder.Backend.BasicStation.CACert
-	chirpCfg.Backend.BasicStation.TLSCert = *cfg.Forwarder.Backend.BasicStation.TLSCert
-	chirpCfg.Backend.BasicStation.TLSKey = *cfg.Forwarder.Backend.BasicStation.TLSKey
-	chirpCfg.Backend.BasicStation.StatsInterval = *cfg.Forwarder.Backend.BasicStation.StatsInterval
-	chirpCfg.Backend.BasicStation.PingInterval = *cfg.Forwarder.Backend.BasicStation.PingInterval
-	chirpCfg.Backend.BasicStation.TimesyncInterval = *cfg.Forwarder.Backend.BasicStation.TimesyncInterval
-	chirpCfg.Backend.BasicStation.ReadTimeout = *cfg.Forwarder.Backend.BasicStation.ReadTimeout
-	chirpCfg.Backend.BasicStation.WriteTimeout = *cfg.Forwarder.Backend.BasicStation.WriteTimeout
+	chirpCfg.Backend.BasicStation.Bind = valueOr(bsCfg.Bind, "0.0.0.0:8887")
+	chirpCfg.Backend.BasicStation.CACert = valueOr(bsCfg.CACert, "")
+	chirpCfg.Backend.BasicStation.TLSCert = valueOr(bsCfg.TLSCert, "")
+	chirpCfg.Backend.BasicStation.TLSKey = valueOr(bsCfg.TLSKey, "")
+	chirpCfg.Backend.BasicStation.StatsInterval = valueOr(bsCfg.StatsInterval, 30*time.Second)
+	chirpCfg.Backend.BasicStation.PingInterval = valueOr(bsCfg.PingInterval, time.Minute)
+	chirpCfg.Backend.BasicStation.TimesyncInterval = valueOr(bsCfg.TimesyncInterval, time.Hour)
+	chirpCfg.Backend.BasicStation.ReadTimeout = valueOr(bsCfg.ReadTimeout, 65*time.Second)
+	chirpCfg.Backend.BasicStation.WriteTimeout = valueOr(bsCfg.WriteTimeout, time.Second)
+
+	if err := validateBasicStationConfig(&chirpCfg); err != nil {
+		return nil, err
+	}
+
+	ln, err := upgrade.Default().Listen("tcp", chirpCfg.Backend.BasicStation.Bind)
+	if err != nil {
+		return nil, fmt.Errorf("unable to bind basic station listener: %w", err)
+	}
+	chirpCfg.Backend.BasicStation.Listener = ln
 
 	loadBasicStationRegionConfigUplink(b, &chirpCfg)
 	loadBasicStationRegionConfigDownlink(b, &chirpCfg)
 
-	logrus.WithFields(logrus.Fields{
-		"bind":   chirpCfg.Backend.BasicStation.Bind,
-		"region": chirpCfg.Backend.BasicStation.Region,
+	backendLog.WithFields(logrus.Fields{
+		"bind":        chirpCfg.Backend.BasicStation.Bind,
+		"region":      chirpCfg.Backend.BasicStation.Region,
+		"tls":         chirpCfg.Backend.BasicStation.TLSCert != "",
+		"client_auth": chirpCfg.Backend.BasicStation.CACert != "",
 	}).Info("Basic Station backend")
 
 	backend, err := basicstation.NewBackend(chirpCfg)
@@ -113,6 +198,38 @@ func buildBasicStationBackend(cfg *Config) (*basicstation.Backend, error) {
 	return backend, nil
 }
 
+// validateBasicStationConfig verifies the basic station configuration before
+// the backend is started. Without TLS certificate and key gateways connect
+// over plain websockets (ws://), a CA certificate enables client certificate
+// authentication and requires TLS.
+func validateBasicStationConfig(cfg *chirpconfig.Config) error {
+	bs := cfg.Backend.BasicStation
+	if bs.TLSCert != "" || bs.TLSKey != "" || bs.CACert != "" {
+		if bs.TLSCert == "" || bs.TLSKey == "" {
+			return fmt.Errorf("basic station backend requires both tls_cert and tls_key for TLS")
+		}
+		// fail on startup instead of when the listener is started
+		if _, err := tls.LoadX509KeyPair(bs.TLSCert, bs.TLSKey); err != nil {
+			return fmt.Errorf("unable to load basic station TLS certificate: %w", err)
+		}
+	}
+	if bs.StatsInterval <= 0 || bs.PingInterval <= 0 {
+		return fmt.Errorf("basic station stats_interval and ping_interval must be positive")
+	}
+	if bs.ReadTimeout <= bs.PingInterval {
+		return fmt.Errorf("basic station read_timeout must be greater than ping_interval")
+	}
+	return nil
+}
+
+// valueOr returns the value v points to, or def when v is nil.
+func valueOr[T any](v *T, def T) T {
+	if v != nil {
+		return *v
+	}
+	return def
+}
+
 func loadBasicStationRegionConfigUplink(b band.Band, cfg *chirpconfig.Config) {
 	var concentrator chirpconfig.BasicStationConcentrator
 
@@ -122,22 +239,22 @@ func loadBasicStationRegionConfigUplink(b band.Band, cfg *chirpconfig.Config) {
 	for _, channelIndex := range b.GetEnabledUplinkChannelIndices() {
 		channel, err := b.GetUplinkChannel(channelIndex)
 		if err != nil {
-			logrus.Fatal(err)
+			backendLog.Fatal(err)
 		}
 
 		minDr, err := b.GetDataRate(channel.MinDR)
 		if err != nil {
-			logrus.Fatal(err)
+			backendLog.Fatal(err)
 		}
 		maxDr, err := b.GetDataRate(channel.MaxDR)
 		if err != nil {
-			logrus.Fatal(err)
+			backendLog.Fatal(err)
 		}
 		if maxDr.Modulation == band.LRFHSSModulation {
 			for dr := channel.MaxDR; dr > 0; dr-- {
 				maxDr, err = b.GetDataRate(dr)
 				if err != nil {
-					logrus.Fatal(err)
+					backendLog.Fatal(err)
 				}
 
 				if maxDr.Modulation == band.LoRaModulation {
@@ -171,7 +288,7 @@ func loadBasicStationRegionConfigDownlink(b band.Band, cfg *chirpconfig.Config)
 	for _, channelIndex := range b.GetEnabledUplinkChannelIndices() {
 		rx1ChannelIndex, err := b.GetRX1ChannelIndexForUplinkChannelIndex(channelIndex)
 		if err != nil {
-			logrus.Fatal(err)
+			backendLog.Fatal(err)
 		}
 		if slices.Contains(reportedIndexes, rx1ChannelIndex) {
 			continue
@@ -181,18 +298,18 @@ func loadBasicStationRegionConfigDownlink(b band.Band, cfg *chirpconfig.Config)
 
 		channel, err := b.GetDownlinkChannel(rx1ChannelIndex)
 		if err != nil {
-			logrus.Fatal(err)
+			backendLog.Fatal(err)
 		}
 
 		maxDr, err := b.GetDataRate(channel.MaxDR)
 		if err != nil {
-			logrus.Fatal(err)
+			backendLog.Fatal(err)
 		}
 		if maxDr.Modulation == band.LRFHSSModulation {
 			for dr := channel.MaxDR; dr > 0; dr-- {
 				maxDr, err = b.GetDataRate(dr)
 				if err != nil {
-					logrus.Fatal(err)
+					backendLog.Fatal(err)
 				}
 
 				if maxDr.Modulation == band.LoRaModulation {
@@ -0,0 +1,88 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// meteredBackend wraps a backend and counts the events that are exchanged
+// with the gateways connected through it.
+type meteredBackend struct {
+	Backend
+	name string
+}
+
+// newMeteredBackend returns a backend that records metrics for all events
+// passed through the given named backend.
+func newMeteredBackend(name string, backend Backend) *meteredBackend {
+	return &meteredBackend{Backend: backend, name: name}
+}
+
+func (m *meteredBackend) count(event string) {
+	backendEventsCounter.WithLabelValues(m.name, event).Inc()
+}
+
+func (m *meteredBackend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {
+	m.Backend.SetDownlinkTxAckFunc(func(ack *gw.DownlinkTxAck) {
+		m.count("tx_ack")
+		if f != nil {
+			f(ack)
+		}
+	})
+}
+
+func (m *meteredBackend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {
+	m.Backend.SetGatewayStatsFunc(func(stats *gw.GatewayStats) {
+		m.count("stats")
+		if f != nil {
+			f(stats)
+		}
+	})
+}
+
+func (m *meteredBackend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	m.Backend.SetUplinkFrameFunc(func(frame *gw.UplinkFrame) {
+		m.count("uplink")
+		if f != nil {
+			f(frame)
+		}
+	})
+}
+
+func (m *meteredBackend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	m.Backend.SetSubscribeEventFunc(func(event events.Subscribe) {
+		if event.Subscribe {
+			m.count("connect")
+		} else {
+			m.count("disconnect")
+		}
+		if f != nil {
+			f(event)
+		}
+	})
+}
+
+func (m *meteredBackend) SendDownlinkFrame(frame *gw.DownlinkFrame) error {
+	if err := m.Backend.SendDownlinkFrame(frame); err != nil {
+		m.count("downlink_error")
+		return err
+	}
+	m.count("downlink")
+	return nil
+}
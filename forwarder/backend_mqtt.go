@@ -0,0 +1,318 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
+	chirpconfig "github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/config"
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/integration/mqtt/auth"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// mqttBackend receives gateway events from and sends commands to gateways
+// connected to an MQTT broker through the ChirpStack Gateway Bridge. It
+// takes the role of the ChirpStack network server on the broker, gateways
+// publish events on <prefix>/gateway/<gateway id>/event/<event> and receive
+// commands on <prefix>/gateway/<gateway id>/command/<command>.
+type mqttBackend struct {
+	client  paho.Client
+	prefix  string
+	qos     uint8
+	timeout time.Duration
+
+	marshal   func(proto.Message) ([]byte, error)
+	unmarshal func([]byte, proto.Message) error
+
+	mu                          sync.RWMutex
+	uplinkFrameFunc             func(*gw.UplinkFrame)
+	gatewayStatsFunc            func(*gw.GatewayStats)
+	downlinkTxAckFunc           func(*gw.DownlinkTxAck)
+	rawPacketForwarderEventFunc func(*gw.RawPacketForwarderEvent)
+	subscribeEventFunc          func(events.Subscribe)
+}
+
+// buildMQTTBackend returns the MQTT backend configured in the given cfg.
+func buildMQTTBackend(cfg *Config) (*mqttBackend, error) {
+	mqttCfg := cfg.Forwarder.Backend.MQTT
+	if mqttCfg.Server == "" && len(mqttCfg.Servers) == 0 {
+		return nil, fmt.Errorf("mqtt backend requires a server")
+	}
+
+	b := &mqttBackend{
+		prefix:  strings.Trim(mqttCfg.TopicPrefix, "/"),
+		qos:     mqttCfg.QOS,
+		timeout: 10 * time.Second,
+	}
+	if b.qos > 2 {
+		return nil, fmt.Errorf("invalid mqtt qos %d", b.qos)
+	}
+	if mqttCfg.Timeout != nil && *mqttCfg.Timeout > 0 {
+		b.timeout = *mqttCfg.Timeout
+	}
+
+	switch mqttCfg.Marshaler {
+	case "", "protobuf":
+		b.marshal = proto.Marshal
+		b.unmarshal = proto.Unmarshal
+	case "json":
+		b.marshal = protojson.MarshalOptions{EmitUnpopulated: true}.Marshal
+		b.unmarshal = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal
+	default:
+		return nil, fmt.Errorf("unknown mqtt marshaler %s", mqttCfg.Marshaler)
+	}
+
+	clientID := mqttCfg.ClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "thingsix-forwarder-" + hostname
+	}
+
+	// the generic authentication of the gateway bridge handles the broker
+	// addresses, credentials and TLS
+	var chirpCfg chirpconfig.Config
+	chirpCfg.Integration.MQTT.Auth.Generic.Servers = mqttCfg.Servers
+	if mqttCfg.Server != "" {
+		chirpCfg.Integration.MQTT.Auth.Generic.Servers = append([]string{mqttCfg.Server}, mqttCfg.Servers...)
+	}
+	chirpCfg.Integration.MQTT.Auth.Generic.Username = mqttCfg.Username
+	chirpCfg.Integration.MQTT.Auth.Generic.Password = mqttCfg.Password
+	chirpCfg.Integration.MQTT.Auth.Generic.CACert = mqttCfg.CACert
+	chirpCfg.Integration.MQTT.Auth.Generic.TLSCert = mqttCfg.TLSCert
+	chirpCfg.Integration.MQTT.Auth.Generic.TLSKey = mqttCfg.TLSKey
+	chirpCfg.Integration.MQTT.Auth.Generic.CleanSession = true
+	chirpCfg.Integration.MQTT.Auth.Generic.ClientID = clientID
+
+	authentication, err := auth.NewGenericAuthentication(chirpCfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure mqtt authentication: %w", err)
+	}
+
+	opts := paho.NewClientOptions()
+	if err := authentication.Init(opts); err != nil {
+		return nil, fmt.Errorf("unable to configure mqtt client: %w", err)
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetOnConnectHandler(b.onConnected)
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		backendLog.WithError(err).Warn("mqtt backend lost connection to broker")
+	})
+	b.client = paho.NewClient(opts)
+
+	backendLog.WithFields(logrus.Fields{
+		"servers":      chirpCfg.Integration.MQTT.Auth.Generic.Servers,
+		"client_id":    clientID,
+		"topic_prefix": b.prefix,
+		"marshaler":    mqttCfg.Marshaler,
+	}).Info("MQTT backend")
+
+	return b, nil
+}
+
+// topic returns the topic with the configured prefix.
+func (b *mqttBackend) topic(format string, args ...interface{}) string {
+	topic := fmt.Sprintf(format, args...)
+	if b.prefix == "" {
+		return topic
+	}
+	return b.prefix + "/" + topic
+}
+
+// Start connects to the broker, it doesn't wait for the connection to be
+// established, the client keeps retrying in the background.
+func (b *mqttBackend) Start() error {
+	b.client.Connect()
+	return nil
+}
+
+// Stop disconnects from the broker.
+func (b *mqttBackend) Stop() error {
+	b.client.Disconnect(uint(b.timeout / time.Millisecond))
+	return nil
+}
+
+// onConnected (re)subscribes to the gateway event and state topics, the
+// broker drops subscriptions of clean sessions on disconnect.
+func (b *mqttBackend) onConnected(c paho.Client) {
+	filters := map[string]byte{
+		b.topic("gateway/+/event/+"): b.qos,
+		b.topic("gateway/+/state/+"): b.qos,
+	}
+	token := c.SubscribeMultiple(filters, b.handleMessage)
+	if !token.WaitTimeout(b.timeout) || token.Error() != nil {
+		backendLog.WithError(token.Error()).Error("mqtt backend unable to subscribe to gateway topics")
+		return
+	}
+	backendLog.Info("mqtt backend connected to broker")
+}
+
+// handleMessage dispatches the messages published by gateways based on
+// their topic.
+func (b *mqttBackend) handleMessage(_ paho.Client, msg paho.Message) {
+	var (
+		topic = strings.TrimPrefix(msg.Topic(), b.prefix+"/")
+		parts = strings.Split(topic, "/")
+		log   = backendLog.WithField("topic", msg.Topic())
+	)
+	if len(parts) != 4 || parts[0] != "gateway" {
+		log.Debug("mqtt backend received message on unexpected topic")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(parts[1])); err != nil {
+		log.WithError(err).Warn("mqtt backend received message with invalid gateway id")
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	switch parts[2] + "/" + parts[3] {
+	case "event/up":
+		var frame gw.UplinkFrame
+		if err := b.unmarshal(msg.Payload(), &frame); err != nil {
+			log.WithError(err).Warn("mqtt backend unable to decode uplink")
+			return
+		}
+		// the gateway is identified by the topic, not by the payload
+		if frame.RxInfo == nil {
+			frame.RxInfo = &gw.UplinkRxInfo{}
+		}
+		frame.RxInfo.GatewayId = gatewayID.String()
+		if b.uplinkFrameFunc != nil {
+			b.uplinkFrameFunc(&frame)
+		}
+	case "event/stats":
+		var stats gw.GatewayStats
+		if err := b.unmarshal(msg.Payload(), &stats); err != nil {
+			log.WithError(err).Warn("mqtt backend unable to decode gateway stats")
+			return
+		}
+		stats.GatewayId = gatewayID.String()
+		if b.gatewayStatsFunc != nil {
+			b.gatewayStatsFunc(&stats)
+		}
+	case "event/ack":
+		var ack gw.DownlinkTxAck
+		if err := b.unmarshal(msg.Payload(), &ack); err != nil {
+			log.WithError(err).Warn("mqtt backend unable to decode downlink ack")
+			return
+		}
+		ack.GatewayId = gatewayID.String()
+		if b.downlinkTxAckFunc != nil {
+			b.downlinkTxAckFunc(&ack)
+		}
+	case "event/raw":
+		var event gw.RawPacketForwarderEvent
+		if err := b.unmarshal(msg.Payload(), &event); err != nil {
+			log.WithError(err).Warn("mqtt backend unable to decode raw packet forwarder event")
+			return
+		}
+		event.GatewayId = gatewayID.String()
+		if b.rawPacketForwarderEventFunc != nil {
+			b.rawPacketForwarderEventFunc(&event)
+		}
+	case "state/conn":
+		var state gw.ConnState
+		if err := b.unmarshal(msg.Payload(), &state); err != nil {
+			log.WithError(err).Warn("mqtt backend unable to decode connection state")
+			return
+		}
+		if b.subscribeEventFunc != nil {
+			b.subscribeEventFunc(events.Subscribe{
+				GatewayID: gatewayID,
+				Subscribe: state.GetState() == gw.ConnState_ONLINE,
+			})
+		}
+	}
+}
+
+// publish sends the command to the gateway.
+func (b *mqttBackend) publish(gatewayID, command string, msg proto.Message) error {
+	var eui lorawan.EUI64
+	if err := eui.UnmarshalText([]byte(gatewayID)); err != nil {
+		return fmt.Errorf("invalid gateway id %s: %w", gatewayID, err)
+	}
+	payload, err := b.marshal(msg)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s command: %w", command, err)
+	}
+	if !b.client.IsConnectionOpen() {
+		return fmt.Errorf("mqtt backend not connected to broker")
+	}
+
+	token := b.client.Publish(b.topic("gateway/%s/command/%s", eui, command), b.qos, false, payload)
+	if !token.WaitTimeout(b.timeout) {
+		return fmt.Errorf("unable to publish %s command: timeout", command)
+	}
+	return token.Error()
+}
+
+func (b *mqttBackend) SendDownlinkFrame(frame *gw.DownlinkFrame) error {
+	return b.publish(frame.GetGatewayId(), "down", frame)
+}
+
+func (b *mqttBackend) ApplyConfiguration(config *gw.GatewayConfiguration) error {
+	return b.publish(config.GetGatewayId(), "config", config)
+}
+
+func (b *mqttBackend) RawPacketForwarderCommand(cmd *gw.RawPacketForwarderCommand) error {
+	return b.publish(cmd.GetGatewayId(), "raw", cmd)
+}
+
+func (b *mqttBackend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {
+	b.mu.Lock()
+	b.downlinkTxAckFunc = f
+	b.mu.Unlock()
+}
+
+func (b *mqttBackend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {
+	b.mu.Lock()
+	b.gatewayStatsFunc = f
+	b.mu.Unlock()
+}
+
+func (b *mqttBackend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	b.mu.Lock()
+	b.uplinkFrameFunc = f
+	b.mu.Unlock()
+}
+
+func (b *mqttBackend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEvent)) {
+	b.mu.Lock()
+	b.rawPacketForwarderEventFunc = f
+	b.mu.Unlock()
+}
+
+func (b *mqttBackend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.mu.Lock()
+	b.subscribeEventFunc = f
+	b.mu.Unlock()
+}
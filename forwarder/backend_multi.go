@@ -0,0 +1,178 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// multiBackend combines several backends so gateways connected through
+// different backends share a single exchange. It remembers through which
+// backend each gateway is connected and sends commands for the gateway to
+// that backend.
+type multiBackend struct {
+	names    []string
+	backends []Backend
+
+	mu       sync.RWMutex
+	gateways map[lorawan.EUI64]int
+}
+
+// newMultiBackend returns a backend that combines the given named backends.
+func newMultiBackend(names []string, backends []Backend) *multiBackend {
+	return &multiBackend{
+		names:    names,
+		backends: backends,
+		gateways: make(map[lorawan.EUI64]int),
+	}
+}
+
+// seen records that the gateway with the given id is connected through the
+// backend with index i.
+func (m *multiBackend) seen(i int, gatewayID string) {
+	var id lorawan.EUI64
+	if err := id.UnmarshalText([]byte(gatewayID)); err != nil {
+		return
+	}
+	m.mu.RLock()
+	current, ok := m.gateways[id]
+	m.mu.RUnlock()
+	if ok && current == i {
+		return
+	}
+	m.mu.Lock()
+	m.gateways[id] = i
+	m.mu.Unlock()
+}
+
+// backendFor returns the backend the gateway is connected through.
+func (m *multiBackend) backendFor(gatewayID string) (Backend, error) {
+	var id lorawan.EUI64
+	if err := id.UnmarshalText([]byte(gatewayID)); err != nil {
+		return nil, fmt.Errorf("invalid gateway id %s: %w", gatewayID, err)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, ok := m.gateways[id]
+	if !ok {
+		return nil, fmt.Errorf("gateway %s is not connected", id)
+	}
+	return m.backends[i], nil
+}
+
+func (m *multiBackend) Start() error {
+	for i, b := range m.backends {
+		if err := b.Start(); err != nil {
+			return fmt.Errorf("unable to start %s backend: %w", m.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (m *multiBackend) Stop() error {
+	// stop all backends, even when one of them fails
+	var first error
+	for i, b := range m.backends {
+		if err := b.Stop(); err != nil && first == nil {
+			first = fmt.Errorf("unable to stop %s backend: %w", m.names[i], err)
+		}
+	}
+	return first
+}
+
+func (m *multiBackend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {
+	for _, b := range m.backends {
+		b.SetDownlinkTxAckFunc(f)
+	}
+}
+
+func (m *multiBackend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {
+	for i, b := range m.backends {
+		i := i
+		b.SetGatewayStatsFunc(func(stats *gw.GatewayStats) {
+			m.seen(i, stats.GetGatewayId())
+			if f != nil {
+				f(stats)
+			}
+		})
+	}
+}
+
+func (m *multiBackend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	for i, b := range m.backends {
+		i := i
+		b.SetUplinkFrameFunc(func(frame *gw.UplinkFrame) {
+			m.seen(i, frame.GetRxInfo().GetGatewayId())
+			if f != nil {
+				f(frame)
+			}
+		})
+	}
+}
+
+func (m *multiBackend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEvent)) {
+	for _, b := range m.backends {
+		b.SetRawPacketForwarderEventFunc(f)
+	}
+}
+
+func (m *multiBackend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	for i, b := range m.backends {
+		i := i
+		b.SetSubscribeEventFunc(func(event events.Subscribe) {
+			m.mu.Lock()
+			if event.Subscribe {
+				m.gateways[event.GatewayID] = i
+			} else if current, ok := m.gateways[event.GatewayID]; ok && current == i {
+				delete(m.gateways, event.GatewayID)
+			}
+			m.mu.Unlock()
+			if f != nil {
+				f(event)
+			}
+		})
+	}
+}
+
+func (m *multiBackend) SendDownlinkFrame(frame *gw.DownlinkFrame) error {
+	b, err := m.backendFor(frame.GetGatewayId())
+	if err != nil {
+		return err
+	}
+	return b.SendDownlinkFrame(frame)
+}
+
+func (m *multiBackend) ApplyConfiguration(config *gw.GatewayConfiguration) error {
+	b, err := m.backendFor(config.GetGatewayId())
+	if err != nil {
+		return err
+	}
+	return b.ApplyConfiguration(config)
+}
+
+func (m *multiBackend) RawPacketForwarderCommand(cmd *gw.RawPacketForwarderCommand) error {
+	b, err := m.backendFor(cmd.GetGatewayId())
+	if err != nil {
+		return err
+	}
+	return b.RawPacketForwarderCommand(cmd)
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// reasons for a band plan violation
+const (
+	bandPlanReasonFrequency = "frequency"
+	bandPlanReasonDataRate  = "data_rate"
+)
+
+// BandPlanChannel is a frequency range of a regional band plan.
+type BandPlanChannel struct {
+	// MinFrequency is the lower bound of the range in Hz
+	MinFrequency uint32 `json:"minFrequency"`
+	// MaxFrequency is the upper bound of the range in Hz
+	MaxFrequency uint32 `json:"maxFrequency"`
+	// MaxEIRP is the maximum downlink transmit power in dBm EIRP, it is
+	// not used for uplink ranges
+	MaxEIRP int32 `json:"maxEirp,omitempty"`
+}
+
+// BandPlan holds the frequencies gateways in a region receive and transmit
+// on. The data rates follow the LoRaWAN regional parameters of the region.
+type BandPlan struct {
+	Region   frequency_plan.BandName `json:"region"`
+	Uplink   []BandPlanChannel       `json:"uplink"`
+	Downlink []BandPlanChannel       `json:"downlink"`
+}
+
+// bandPlanChannel returns the channel in channels that contains frequency.
+func bandPlanChannel(channels []BandPlanChannel, frequency uint32) (BandPlanChannel, bool) {
+	for _, ch := range channels {
+		if frequency >= ch.MinFrequency && frequency <= ch.MaxFrequency {
+			return ch, true
+		}
+	}
+	return BandPlanChannel{}, false
+}
+
+// Frequency ranges shared by the AS923 groups, the groups differ in their
+// default channels but use the same limits.
+var as923Channels = []BandPlanChannel{
+	{MinFrequency: 915_000_000, MaxFrequency: 928_000_000, MaxEIRP: 16},
+}
+
+// bandPlans are the built-in band plans. The ranges follow the LoRaWAN
+// regional parameters (RP002-1.0.3), the maximum EIRP is the default of the
+// region. Local regulation can be stricter, see the tx power limiter.
+var bandPlans = map[frequency_plan.BandName]*BandPlan{
+	frequency_plan.EU868: {
+		Region: frequency_plan.EU868,
+		Uplink: []BandPlanChannel{
+			{MinFrequency: 863_000_000, MaxFrequency: 870_000_000},
+		},
+		Downlink: []BandPlanChannel{
+			{MinFrequency: 863_000_000, MaxFrequency: 869_400_000, MaxEIRP: 16},
+			{MinFrequency: 869_400_000, MaxFrequency: 869_650_000, MaxEIRP: 27},
+			{MinFrequency: 869_650_000, MaxFrequency: 870_000_000, MaxEIRP: 16},
+		},
+	},
+	frequency_plan.EU433: {
+		Region:   frequency_plan.EU433,
+		Uplink:   []BandPlanChannel{{MinFrequency: 433_050_000, MaxFrequency: 434_790_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 433_050_000, MaxFrequency: 434_790_000, MaxEIRP: 12}},
+	},
+	frequency_plan.CN779: {
+		Region:   frequency_plan.CN779,
+		Uplink:   []BandPlanChannel{{MinFrequency: 779_000_000, MaxFrequency: 787_000_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 779_000_000, MaxFrequency: 787_000_000, MaxEIRP: 12}},
+	},
+	frequency_plan.US915: {
+		Region:   frequency_plan.US915,
+		Uplink:   []BandPlanChannel{{MinFrequency: 902_300_000, MaxFrequency: 914_900_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 923_300_000, MaxFrequency: 927_500_000, MaxEIRP: 30}},
+	},
+	frequency_plan.AU915: {
+		Region:   frequency_plan.AU915,
+		Uplink:   []BandPlanChannel{{MinFrequency: 915_200_000, MaxFrequency: 927_800_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 923_300_000, MaxFrequency: 927_500_000, MaxEIRP: 30}},
+	},
+	frequency_plan.CN470: {
+		Region:   frequency_plan.CN470,
+		Uplink:   []BandPlanChannel{{MinFrequency: 470_300_000, MaxFrequency: 509_700_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 470_300_000, MaxFrequency: 509_700_000, MaxEIRP: 19}},
+	},
+	frequency_plan.AS923:   {Region: frequency_plan.AS923, Uplink: as923Channels, Downlink: as923Channels},
+	frequency_plan.AS923_2: {Region: frequency_plan.AS923_2, Uplink: as923Channels, Downlink: as923Channels},
+	frequency_plan.AS923_3: {Region: frequency_plan.AS923_3, Uplink: as923Channels, Downlink: as923Channels},
+	frequency_plan.AS923_4: {
+		Region:   frequency_plan.AS923_4,
+		Uplink:   []BandPlanChannel{{MinFrequency: 917_000_000, MaxFrequency: 920_000_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 917_000_000, MaxFrequency: 920_000_000, MaxEIRP: 16}},
+	},
+	frequency_plan.KR920: {
+		Region:   frequency_plan.KR920,
+		Uplink:   []BandPlanChannel{{MinFrequency: 920_900_000, MaxFrequency: 923_300_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 920_900_000, MaxFrequency: 923_300_000, MaxEIRP: 14}},
+	},
+	frequency_plan.IN865: {
+		Region:   frequency_plan.IN865,
+		Uplink:   []BandPlanChannel{{MinFrequency: 865_000_000, MaxFrequency: 867_000_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 865_000_000, MaxFrequency: 867_000_000, MaxEIRP: 30}},
+	},
+	frequency_plan.RU864: {
+		Region:   frequency_plan.RU864,
+		Uplink:   []BandPlanChannel{{MinFrequency: 864_000_000, MaxFrequency: 870_000_000}},
+		Downlink: []BandPlanChannel{{MinFrequency: 864_000_000, MaxFrequency: 870_000_000, MaxEIRP: 16}},
+	},
+}
+
+// BandPlans validates uplinks and downlinks against the band plan of the
+// region the gateway operates in. Gateways and routers are otherwise trusted
+// to use frequencies and data rates that are valid in the region.
+type BandPlans struct {
+	plans     map[frequency_plan.BandName]*BandPlan
+	uplinks   bool
+	downlinks bool
+}
+
+// NewBandPlans returns band plans with the built-in plans extended and
+// overridden by the plans in cfg.
+func NewBandPlans(cfg *ForwarderBandPlanConfig) (*BandPlans, error) {
+	p := &BandPlans{
+		plans:     make(map[frequency_plan.BandName]*BandPlan, len(bandPlans)),
+		uplinks:   cfg.ValidateUplinks,
+		downlinks: cfg.ValidateDownlinks,
+	}
+	for region, plan := range bandPlans {
+		p.plans[region] = plan
+	}
+
+	for name, plan := range cfg.Plans {
+		var region frequency_plan.BandName
+		if err := region.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("invalid band plan %s: %w", name, err)
+		}
+		bp := &BandPlan{Region: region}
+		for _, ch := range plan.Uplink {
+			if ch.MinFrequency > ch.MaxFrequency {
+				return nil, fmt.Errorf("invalid uplink range %d-%d Hz in band plan %s", ch.MinFrequency, ch.MaxFrequency, region)
+			}
+			bp.Uplink = append(bp.Uplink, BandPlanChannel{MinFrequency: ch.MinFrequency, MaxFrequency: ch.MaxFrequency})
+		}
+		for _, ch := range plan.Downlink {
+			if ch.MinFrequency > ch.MaxFrequency {
+				return nil, fmt.Errorf("invalid downlink range %d-%d Hz in band plan %s", ch.MinFrequency, ch.MaxFrequency, region)
+			}
+			bp.Downlink = append(bp.Downlink, BandPlanChannel{
+				MinFrequency: ch.MinFrequency,
+				MaxFrequency: ch.MaxFrequency,
+				MaxEIRP:      ch.MaxEIRP,
+			})
+		}
+		// keep the built-in ranges for a direction the plan doesn't override
+		if builtin, ok := bandPlans[region]; ok {
+			if len(bp.Uplink) == 0 {
+				bp.Uplink = builtin.Uplink
+			}
+			if len(bp.Downlink) == 0 {
+				bp.Downlink = builtin.Downlink
+			}
+		}
+		p.plans[region] = bp
+	}
+
+	return p, nil
+}
+
+// Plan returns the band plan for region, or nil if there is none.
+func (p *BandPlans) Plan(region frequency_plan.BandName) *BandPlan {
+	return p.plans[frequency_plan.BandName(strings.ToUpper(string(region)))]
+}
+
+// ValidateUplink returns a *BandPlanViolationError when frame is received on
+// a frequency or data rate that is not part of the band plan of region.
+// Uplinks from gateways without a known region are not validated.
+func (p *BandPlans) ValidateUplink(region frequency_plan.BandName, frame *gw.UplinkFrame) error {
+	plan := p.Plan(region)
+	if !p.uplinks || plan == nil {
+		return nil
+	}
+
+	txInfo := frame.GetTxInfo()
+	if _, ok := bandPlanChannel(plan.Uplink, txInfo.GetFrequency()); !ok {
+		return &BandPlanViolationError{
+			Region:    plan.Region,
+			Direction: "uplink",
+			Reason:    bandPlanReasonFrequency,
+			Details:   fmt.Sprintf("frequency %d Hz", txInfo.GetFrequency()),
+		}
+	}
+	return validateBandPlanDataRate(plan.Region, true, txInfo.GetModulation())
+}
+
+// LimitDownlinkItem validates item against the band plan of region. An
+// item on a frequency or data rate that is not part of the plan returns a
+// *BandPlanViolationError. If the requested transmit power exceeds the
+// maximum EIRP of the channel the power is lowered and the requested power
+// is returned together with capped set to true.
+func (p *BandPlans) LimitDownlinkItem(region frequency_plan.BandName, item *gw.DownlinkFrameItem) (requested int32, capped bool, err error) {
+	plan := p.Plan(region)
+	if !p.downlinks || plan == nil || item.GetTxInfo() == nil {
+		return 0, false, nil
+	}
+
+	txInfo := item.GetTxInfo()
+	ch, ok := bandPlanChannel(plan.Downlink, txInfo.GetFrequency())
+	if !ok {
+		return 0, false, &BandPlanViolationError{
+			Region:    plan.Region,
+			Direction: "downlink",
+			Reason:    bandPlanReasonFrequency,
+			Details:   fmt.Sprintf("frequency %d Hz", txInfo.GetFrequency()),
+		}
+	}
+	if err := validateBandPlanDataRate(plan.Region, false, txInfo.GetModulation()); err != nil {
+		return 0, false, err
+	}
+
+	requested = txInfo.GetPower()
+	if ch.MaxEIRP != 0 && requested > ch.MaxEIRP {
+		txInfo.Power = ch.MaxEIRP
+		return requested, true, nil
+	}
+	return requested, false, nil
+}
+
+// validateBandPlanDataRate returns a *BandPlanViolationError if modulation
+// is not a data rate of region in the given direction. Modulations the
+// regional parameters don't describe, e.g. LR-FHSS, are not validated.
+func validateBandPlanDataRate(region frequency_plan.BandName, uplink bool, modulation *gw.Modulation) error {
+	b, err := regionBand(region)
+	if err != nil {
+		return nil
+	}
+
+	var (
+		dr      band.DataRate
+		details string
+	)
+	switch {
+	case modulation.GetLora() != nil:
+		lora := modulation.GetLora()
+		dr = band.DataRate{
+			Modulation:   band.LoRaModulation,
+			SpreadFactor: int(lora.GetSpreadingFactor()),
+			Bandwidth:    int(lora.GetBandwidth() / 1000),
+		}
+		details = fmt.Sprintf("data rate SF%d/%dkHz", lora.GetSpreadingFactor(), lora.GetBandwidth()/1000)
+	case modulation.GetFsk() != nil:
+		dr = band.DataRate{
+			Modulation: band.FSKModulation,
+			BitRate:    int(modulation.GetFsk().GetDatarate()),
+		}
+		details = fmt.Sprintf("data rate FSK %d bps", modulation.GetFsk().GetDatarate())
+	default:
+		return nil
+	}
+
+	direction := "downlink"
+	if uplink {
+		direction = "uplink"
+	}
+	if _, err := b.GetDataRateIndex(uplink, dr); err != nil {
+		return &BandPlanViolationError{
+			Region:    region,
+			Direction: direction,
+			Reason:    bandPlanReasonDataRate,
+			Details:   details,
+		}
+	}
+	return nil
+}
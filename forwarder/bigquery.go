@@ -0,0 +1,274 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+// bigQuerySink streams packet events into a BigQuery table with the
+// tabledata.insertAll API.
+type bigQuerySink struct {
+	schema []analyticsColumn
+	url    string
+	auth   *serviceAccountTokenSource
+	client *http.Client
+}
+
+func newBigQuerySink(cfg *ForwarderAnalyticsConfig, schema []analyticsColumn) (*bigQuerySink, error) {
+	bq := cfg.BigQuery
+	if bq.Project == "" || bq.Dataset == "" || bq.Table == "" {
+		return nil, fmt.Errorf("bigquery analytics export requires project, dataset and table")
+	}
+	auth, err := newServiceAccountTokenSource(bq.CredentialsFile, bigQueryScope)
+	if err != nil {
+		return nil, err
+	}
+	return &bigQuerySink{
+		schema: schema,
+		url: fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+			url.PathEscape(bq.Project), url.PathEscape(bq.Dataset), url.PathEscape(bq.Table)),
+		auth:   auth,
+		client: &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (s *bigQuerySink) Name() string {
+	return "bigquery"
+}
+
+type bigQueryInsertRequest struct {
+	Rows []bigQueryRow `json:"rows"`
+}
+
+type bigQueryRow struct {
+	InsertID string                 `json:"insertId"`
+	JSON     map[string]interface{} `json:"json"`
+}
+
+type bigQueryInsertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+func (s *bigQuerySink) Export(ctx context.Context, events []*PacketEvent) error {
+	req := bigQueryInsertRequest{Rows: make([]bigQueryRow, 0, len(events))}
+	for _, ev := range events {
+		row := make(map[string]interface{}, len(s.schema))
+		for _, col := range s.schema {
+			row[col.Name] = col.bigQueryValue(ev)
+		}
+		req.Rows = append(req.Rows, bigQueryRow{
+			// insert id lets BigQuery deduplicate rows when a batch is retried
+			InsertID: fmt.Sprintf("%s-%s-%d-%d", ev.GatewayNetworkID, ev.Type, ev.Time.UnixNano(), ev.DownlinkID),
+			JSON:     row,
+		})
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.auth.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain bigquery access token: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bigquery returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result bigQueryInsertResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unable to decode bigquery response: %w", err)
+	}
+	if len(result.InsertErrors) > 0 {
+		reason := ""
+		if errs := result.InsertErrors[0].Errors; len(errs) > 0 {
+			reason = errs[0].Message
+		}
+		return fmt.Errorf("bigquery rejected %d rows: %s", len(result.InsertErrors), reason)
+	}
+	return nil
+}
+
+// serviceAccountTokenSource obtains OAuth2 access tokens for a Google service
+// account with the JWT bearer grant.
+type serviceAccountTokenSource struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	scope    string
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newServiceAccountTokenSource(credentialsFile, scope string) (*serviceAccountTokenSource, error) {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		return nil, fmt.Errorf("missing service account credentials file")
+	}
+
+	raw, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account credentials: %w", err)
+	}
+	var creds struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, fmt.Errorf("invalid service account credentials: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service account private key is not an RSA key")
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &serviceAccountTokenSource{
+		email:    creds.ClientEmail,
+		key:      key,
+		tokenURI: creds.TokenURI,
+		scope:    scope,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Token returns a cached access token or requests a new one when the cached
+// token is about to expire.
+func (ts *serviceAccountTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Until(ts.expires) > time.Minute {
+		return ts.token, nil
+	}
+
+	assertion, err := ts.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	ts.token = token.AccessToken
+	ts.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// assertion returns a signed JWT that is exchanged for an access token.
+func (ts *serviceAccountTokenSource) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": ts.scope,
+		"aud":   ts.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
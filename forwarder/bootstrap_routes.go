@@ -0,0 +1,100 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/ed25519"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// The embedded bootstrap router set is a ThingsIX API router snapshot that is
+// signed at release time with 'forwarder release bootstrap-routers'. It lets
+// a freshly installed forwarder deliver packets before the ThingsIX routers
+// are fetched, which can take minutes when they are loaded from the chain.
+var (
+	//go:embed bootstrap/routers.json
+	bootstrapRoutersJSON []byte
+	//go:embed bootstrap/routers.json.sig
+	bootstrapRoutersSig []byte
+)
+
+const defaultBootstrapMaxAge = 90 * 24 * time.Hour
+
+// bootstrapRoutes returns the routers from the embedded router set. Nil is
+// returned if the set is disabled, not signed by the configured key, too old
+// or for another chain.
+func bootstrapRoutes(cfg *Config, accounter Accounter) []*Router {
+	bootstrap := cfg.Forwarder.Routers.Bootstrap
+	if bootstrap.Disabled {
+		return nil
+	}
+	routers, err := verifyBootstrapRoutes(bootstrapRoutersJSON, bootstrapRoutersSig, bootstrap, cfg.BlockChain.Polygon.ChainID, accounter)
+	if err != nil {
+		routingLog.WithError(err).Info("embedded router set not used")
+		return nil
+	}
+	return routers
+}
+
+func verifyBootstrapRoutes(snapshotJSON, signature []byte, cfg ForwarderRoutersBootstrapConfig, chainID uint64, accounter Accounter) ([]*Router, error) {
+	if len(strings.TrimSpace(string(signature))) == 0 {
+		return nil, fmt.Errorf("router set not signed")
+	}
+
+	publicKey := cfg.PublicKey
+	if publicKey == "" {
+		publicKey = utils.ReleasePublicKey()
+	}
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("no valid public key to verify the router set")
+	}
+	sig, err := hex.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || !ed25519.Verify(key, snapshotJSON, sig) {
+		return nil, fmt.Errorf("invalid router set signature")
+	}
+
+	var snapshot routerSnapshot
+	if err := json.Unmarshal(snapshotJSON, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid router set: %w", err)
+	}
+	maxAge := defaultBootstrapMaxAge
+	if cfg.MaxAge != nil {
+		maxAge = *cfg.MaxAge
+	}
+	if snapshot.Time == nil || time.Since(*snapshot.Time) > maxAge {
+		return nil, fmt.Errorf("router set older than %s", maxAge)
+	}
+
+	routers, err := snapshot.routers(chainID, accounter)
+	if err != nil {
+		return nil, err
+	}
+	routingLog.WithFields(logrus.Fields{
+		"#routers":      len(routers),
+		"snapshot_time": snapshot.Time,
+	}).Info("loaded embedded router set")
+	return routers, nil
+}
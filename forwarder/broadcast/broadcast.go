@@ -22,29 +22,57 @@ import (
 
 type Broadcaster[T any] struct {
 	message     chan T
-	subscribe   chan chan<- T
+	priority    chan T
+	subscribe   chan subscription[T]
 	unsubscribe chan chan<- T
-	listeners   map[chan<- T]bool
+	listeners   map[chan<- T]chan<- T
+}
+
+// subscription is a listener channel and the optional channel on which the
+// listener wants to receive priority messages.
+type subscription[T any] struct {
+	ch   chan<- T
+	prio chan<- T
 }
 
 func New[T any](bufsize uint) *Broadcaster[T] {
 	return &Broadcaster[T]{
 		message:     make(chan T, bufsize),
-		subscribe:   make(chan chan<- T),
+		subscribe:   make(chan subscription[T]),
 		unsubscribe: make(chan chan<- T),
-		listeners:   make(map[chan<- T]bool),
+		listeners:   make(map[chan<- T]chan<- T),
 	}
 }
 
+// NewWithPriority returns a broadcaster with an additional priority lane.
+// Messages on the priority lane are broadcasted before pending messages on
+// the normal lane.
+func NewWithPriority[T any](bufsize uint, prioritySize uint) *Broadcaster[T] {
+	bc := New[T](bufsize)
+	bc.priority = make(chan T, prioritySize)
+	return bc
+}
+
 func (bc *Broadcaster[T]) Run() *Broadcaster[T] {
 	go func() {
 		for {
+			// drain the priority lane before anything else, a nil priority
+			// channel is never ready
+			select {
+			case msg := <-bc.priority:
+				bc.broadcastPriority(msg)
+				continue
+			default:
+			}
+
 			select {
+			case msg := <-bc.priority:
+				bc.broadcastPriority(msg)
 			case msg := <-bc.message:
 				bc.broadcast(msg)
-			case ch, ok := <-bc.subscribe:
+			case sub, ok := <-bc.subscribe:
 				if ok {
-					bc.listeners[ch] = true
+					bc.listeners[sub.ch] = sub.prio
 				} else {
 					return
 				}
@@ -57,7 +85,15 @@ func (bc *Broadcaster[T]) Run() *Broadcaster[T] {
 }
 
 func (bc *Broadcaster[T]) Subscribe(ch chan<- T) {
-	bc.subscribe <- ch
+	bc.subscribe <- subscription[T]{ch: ch}
+}
+
+// SubscribeWithPriority subscribes ch for all messages, except for messages
+// broadcasted on the priority lane which are sent to prio. This allows the
+// listener to handle priority messages before other messages that it has not
+// yet received. Unsubscribe with ch.
+func (bc *Broadcaster[T]) SubscribeWithPriority(ch chan<- T, prio chan<- T) {
+	bc.subscribe <- subscription[T]{ch: ch, prio: prio}
 }
 
 func (bc *Broadcaster[T]) Unsubscribe(ch chan<- T) {
@@ -75,6 +111,20 @@ func (bc *Broadcaster[T]) broadcast(msg T) {
 	}
 }
 
+func (bc *Broadcaster[T]) broadcastPriority(msg T) {
+	for ch, prio := range bc.listeners {
+		if prio != nil {
+			ch = prio
+		}
+		select {
+		case ch <- msg:
+			continue
+		default:
+			logrus.Trace("broadcast, drop priority message")
+		}
+	}
+}
+
 func (bc *Broadcaster[T]) Broadcast(msg T) {
 	bc.message <- msg
 }
@@ -87,3 +137,29 @@ func (bc *Broadcaster[T]) TryBroadcast(msg T) bool {
 		return false
 	}
 }
+
+// TryBroadcastPriority queues msg on the priority lane. If the broadcaster
+// has no priority lane it falls back to TryBroadcast.
+func (bc *Broadcaster[T]) TryBroadcastPriority(msg T) bool {
+	if bc.priority == nil {
+		return bc.TryBroadcast(msg)
+	}
+	select {
+	case bc.priority <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pending returns the number of messages waiting to be broadcasted and the
+// capacity of the message buffer.
+func (bc *Broadcaster[T]) Pending() (int, int) {
+	return len(bc.message), cap(bc.message)
+}
+
+// PendingPriority returns the number of messages waiting on the priority lane
+// and its capacity.
+func (bc *Broadcaster[T]) PendingPriority() (int, int) {
+	return len(bc.priority), cap(bc.priority)
+}
@@ -0,0 +1,326 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// channelSilentAfter is the time without uplinks on a channel after
+	// which the channel is reported silent when the gateway still receives
+	// uplinks on its other channels
+	channelSilentAfter = time.Hour
+	// maxGatewayChannels bounds the number of frequencies tracked per
+	// gateway, it covers the 72 uplink channels of US915 and AU915
+	maxGatewayChannels = 80
+)
+
+// uplinkUsage counts the uplinks received on a channel or data rate.
+type uplinkUsage struct {
+	uplinks    uint64
+	lastUplink time.Time
+}
+
+func (u *uplinkUsage) record(at time.Time) {
+	u.uplinks++
+	if at.After(u.lastUplink) {
+		u.lastUplink = at
+	}
+}
+
+// gatewayChannelUsage holds the uplink counts of a gateway per channel and
+// per data rate.
+type gatewayChannelUsage struct {
+	localID    lorawan.EUI64
+	region     frequency_plan.BandName
+	uplinks    uplinkUsage
+	channels   map[uint32]*uplinkUsage
+	dataRates  map[string]*uplinkUsage
+	dataRateDR map[string]int
+}
+
+// ChannelStats tracks per gateway how many uplinks are received on each
+// channel and data rate since the forwarder started. Operators use it to
+// verify devices use all configured channels and to detect concentrator
+// channels that stopped receiving.
+type ChannelStats struct {
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*gatewayChannelUsage
+}
+
+// NewChannelStats returns an empty channel statistics tracker.
+func NewChannelStats() *ChannelStats {
+	return &ChannelStats{
+		gateways: make(map[lorawan.EUI64]*gatewayChannelUsage),
+	}
+}
+
+// Record adds an uplink received by gw in the given region.
+func (c *ChannelStats) Record(gw *gateway.Gateway, region frequency_plan.BandName, frame *gw.UplinkFrame, at time.Time) {
+	var (
+		frequency    = frame.GetTxInfo().GetFrequency()
+		dataRate, dr = uplinkDataRate(region, frame.GetTxInfo().GetModulation())
+	)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage, ok := c.gateways[gw.NetworkID]
+	if !ok {
+		usage = &gatewayChannelUsage{
+			channels:   make(map[uint32]*uplinkUsage),
+			dataRates:  make(map[string]*uplinkUsage),
+			dataRateDR: make(map[string]int),
+		}
+		c.gateways[gw.NetworkID] = usage
+	}
+	usage.localID, usage.region = gw.LocalID, region
+	usage.uplinks.record(at)
+
+	ch, ok := usage.channels[frequency]
+	if !ok && len(usage.channels) < maxGatewayChannels {
+		ch = &uplinkUsage{}
+		usage.channels[frequency] = ch
+	}
+	if ch != nil {
+		ch.record(at)
+	}
+
+	if dataRate != "" {
+		d, ok := usage.dataRates[dataRate]
+		if !ok {
+			d = &uplinkUsage{}
+			usage.dataRates[dataRate] = d
+			if dr >= 0 {
+				usage.dataRateDR[dataRate] = dr
+			}
+		}
+		d.record(at)
+	}
+}
+
+// uplinkDataRate returns the name of the data rate of modulation, e.g.
+// SF7BW125, and its index in the region or -1 if it is unknown.
+func uplinkDataRate(region frequency_plan.BandName, modulation *gw.Modulation) (string, int) {
+	var (
+		name string
+		dr   band.DataRate
+	)
+	switch {
+	case modulation.GetLora() != nil:
+		lora := modulation.GetLora()
+		name = fmt.Sprintf("SF%dBW%d", lora.GetSpreadingFactor(), lora.GetBandwidth()/1000)
+		dr = band.DataRate{
+			Modulation:   band.LoRaModulation,
+			SpreadFactor: int(lora.GetSpreadingFactor()),
+			Bandwidth:    int(lora.GetBandwidth() / 1000),
+		}
+	case modulation.GetFsk() != nil:
+		name = fmt.Sprintf("FSK%d", modulation.GetFsk().GetDatarate())
+		dr = band.DataRate{
+			Modulation: band.FSKModulation,
+			BitRate:    int(modulation.GetFsk().GetDatarate()),
+		}
+	case modulation.GetLrFhss() != nil:
+		return fmt.Sprintf("LRFHSS%d", modulation.GetLrFhss().GetOperatingChannelWidth()/1000), -1
+	default:
+		return "", -1
+	}
+
+	b, err := regionBand(region)
+	if err != nil {
+		return name, -1
+	}
+	index, err := b.GetDataRateIndex(true, dr)
+	if err != nil {
+		return name, -1
+	}
+	return name, index
+}
+
+// ChannelUsage is the number of uplinks a gateway received on a frequency.
+type ChannelUsage struct {
+	// Frequency in Hz
+	Frequency uint32 `json:"frequency"`
+	Uplinks   uint64 `json:"uplinks"`
+	// Share is the fraction of the gateway uplinks received on the channel
+	Share      float64   `json:"share"`
+	LastUplink time.Time `json:"lastUplink"`
+	// Silent is set when the channel received no uplinks for an hour while
+	// the gateway received uplinks on its other channels
+	Silent bool `json:"silent,omitempty"`
+}
+
+// DataRateUsage is the number of uplinks a gateway received on a data rate.
+type DataRateUsage struct {
+	// DataRate is the modulation, e.g. SF7BW125
+	DataRate string `json:"dataRate"`
+	// Index is the data rate index in the gateway region, nil if unknown
+	Index      *int      `json:"index,omitempty"`
+	Uplinks    uint64    `json:"uplinks"`
+	Share      float64   `json:"share"`
+	LastUplink time.Time `json:"lastUplink"`
+}
+
+// GatewayChannelStats holds the channel and data rate usage of a gateway.
+type GatewayChannelStats struct {
+	GatewayNetworkID lorawan.EUI64           `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64           `json:"gatewayLocalId"`
+	Region           frequency_plan.BandName `json:"region,omitempty"`
+	Uplinks          uint64                  `json:"uplinks"`
+	LastUplink       time.Time               `json:"lastUplink"`
+	// SilentChannels is the number of channels reported silent
+	SilentChannels int             `json:"silentChannels"`
+	Channels       []ChannelUsage  `json:"channels"`
+	DataRates      []DataRateUsage `json:"dataRates"`
+}
+
+func (u *gatewayChannelUsage) report(networkID lorawan.EUI64, now time.Time) GatewayChannelStats {
+	report := GatewayChannelStats{
+		GatewayNetworkID: networkID,
+		GatewayLocalID:   u.localID,
+		Region:           u.region,
+		Uplinks:          u.uplinks.uplinks,
+		LastUplink:       u.uplinks.lastUplink,
+		Channels:         make([]ChannelUsage, 0, len(u.channels)),
+		DataRates:        make([]DataRateUsage, 0, len(u.dataRates)),
+	}
+	share := func(n uint64) float64 {
+		if u.uplinks.uplinks == 0 {
+			return 0
+		}
+		return float64(n) / float64(u.uplinks.uplinks)
+	}
+
+	// the gateway must still receive on other channels for a channel to be
+	// silent, otherwise the gateway is offline or there are no devices
+	gatewayActive := now.Sub(u.uplinks.lastUplink) < channelSilentAfter
+	for frequency, ch := range u.channels {
+		silent := gatewayActive && now.Sub(ch.lastUplink) >= channelSilentAfter
+		if silent {
+			report.SilentChannels++
+		}
+		report.Channels = append(report.Channels, ChannelUsage{
+			Frequency:  frequency,
+			Uplinks:    ch.uplinks,
+			Share:      share(ch.uplinks),
+			LastUplink: ch.lastUplink,
+			Silent:     silent,
+		})
+	}
+	for name, d := range u.dataRates {
+		usage := DataRateUsage{
+			DataRate:   name,
+			Uplinks:    d.uplinks,
+			Share:      share(d.uplinks),
+			LastUplink: d.lastUplink,
+		}
+		if dr, ok := u.dataRateDR[name]; ok {
+			dr := dr
+			usage.Index = &dr
+		}
+		report.DataRates = append(report.DataRates, usage)
+	}
+
+	sort.Slice(report.Channels, func(i, j int) bool {
+		return report.Channels[i].Frequency < report.Channels[j].Frequency
+	})
+	sort.Slice(report.DataRates, func(i, j int) bool {
+		a, b := report.DataRates[i], report.DataRates[j]
+		if (a.Index == nil) != (b.Index == nil) {
+			return a.Index != nil
+		}
+		if a.Index != nil && *a.Index != *b.Index {
+			return *a.Index < *b.Index
+		}
+		return a.DataRate < b.DataRate
+	})
+	return report
+}
+
+// ChannelStatsReport holds the channel usage of all gateways.
+type ChannelStatsReport struct {
+	Gateways []GatewayChannelStats `json:"gateways"`
+}
+
+// Report returns the channel usage of all gateways ordered by network id.
+func (c *ChannelStats) Report(now time.Time) ChannelStatsReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := ChannelStatsReport{
+		Gateways: make([]GatewayChannelStats, 0, len(c.gateways)),
+	}
+	for networkID, usage := range c.gateways {
+		report.Gateways = append(report.Gateways, usage.report(networkID, now))
+	}
+	sort.Slice(report.Gateways, func(i, j int) bool {
+		return report.Gateways[i].GatewayNetworkID.String() < report.Gateways[j].GatewayNetworkID.String()
+	})
+	return report
+}
+
+// Gateway returns the channel usage of the gateway with the given network
+// id, false is returned if the gateway sent no uplinks.
+func (c *ChannelStats) Gateway(networkID lorawan.EUI64, now time.Time) (GatewayChannelStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage, ok := c.gateways[networkID]
+	if !ok {
+		return GatewayChannelStats{}, false
+	}
+	return usage.report(networkID, now), true
+}
+
+// ChannelStats returns the uplink channel and data rate usage per gateway.
+func (svc APIService) ChannelStats(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, svc.channelStats.Report(time.Now()))
+}
+
+// GatewayChannelStats returns the uplink channel and data rate usage of the
+// gateway in the path.
+func (svc APIService) GatewayChannelStats(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	stats, ok := svc.channelStats.Gateway(gw.NetworkID, time.Now())
+	if !ok {
+		stats = GatewayChannelStats{
+			GatewayNetworkID: gw.NetworkID,
+			GatewayLocalID:   gw.LocalID,
+			Region:           gatewayRegion(gw, svc.gateways),
+			Channels:         []ChannelUsage{},
+			DataRates:        []DataRateUsage{},
+		}
+	}
+	replyJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/parquet"
+	"github.com/sirupsen/logrus"
+)
+
+// clickHouseTimeFormat is accepted by ClickHouse DateTime64(3) columns
+const clickHouseTimeFormat = "2006-01-02 15:04:05.000"
+
+// clickHouseSink inserts packet events into a ClickHouse table over the HTTP
+// interface. Batches are queued and inserted asynchronously with retries so a
+// slow or unavailable ClickHouse server doesn't hold up other sinks.
+type clickHouseSink struct {
+	schema       []analyticsColumn
+	endpoint     string
+	query        string
+	username     string
+	password     string
+	maxRetries   int
+	retryBackoff time.Duration
+	client       *http.Client
+	queue        chan []byte
+}
+
+func newClickHouseSink(cfg *ForwarderAnalyticsConfig, schema []analyticsColumn) (*clickHouseSink, error) {
+	ch := cfg.ClickHouse
+	if ch.URL == "" || ch.Table == "" {
+		return nil, fmt.Errorf("clickhouse analytics export requires url and table")
+	}
+	endpoint, err := url.Parse(ch.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clickhouse url: %w", err)
+	}
+
+	table := ch.Table
+	if ch.Database != "" {
+		table = ch.Database + "." + ch.Table
+	}
+	columns := make([]string, len(schema))
+	for i, col := range schema {
+		columns[i] = col.Name
+	}
+
+	sink := &clickHouseSink{
+		schema:       schema,
+		endpoint:     endpoint.String(),
+		query:        fmt.Sprintf("INSERT INTO %s (%s) FORMAT JSONEachRow", table, strings.Join(columns, ", ")),
+		username:     ch.Username,
+		password:     ch.Password,
+		maxRetries:   5,
+		retryBackoff: time.Second,
+		client:       &http.Client{Timeout: time.Minute},
+		queue:        make(chan []byte, 64),
+	}
+	if ch.MaxRetries != nil {
+		sink.maxRetries = *ch.MaxRetries
+	}
+	if ch.RetryBackoff != nil && *ch.RetryBackoff > 0 {
+		sink.retryBackoff = *ch.RetryBackoff
+	}
+	if ch.QueueSize > 0 {
+		sink.queue = make(chan []byte, ch.QueueSize)
+	}
+	return sink, nil
+}
+
+func (s *clickHouseSink) Name() string {
+	return "clickhouse"
+}
+
+// Export encodes the batch and queues it for insertion. If the queue is full
+// the oldest batch is dropped.
+func (s *clickHouseSink) Export(ctx context.Context, events []*PacketEvent) error {
+	var (
+		buf bytes.Buffer
+		enc = json.NewEncoder(&buf)
+	)
+	for _, ev := range events {
+		row := make(map[string]interface{}, len(s.schema))
+		for _, col := range s.schema {
+			if col.Type == parquet.Timestamp {
+				row[col.Name] = ev.Time.UTC().Format(clickHouseTimeFormat)
+			} else {
+				row[col.Name] = col.value(ev)
+			}
+		}
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case s.queue <- buf.Bytes():
+			return nil
+		default:
+			select {
+			case <-s.queue:
+				logrus.Warn("clickhouse insert queue full, drop oldest batch")
+				analyticsExportCounter.WithLabelValues(s.Name(), "dropped").Inc()
+			default:
+			}
+		}
+	}
+}
+
+// Run inserts queued batches until the given context expires, queued batches
+// are inserted before it returns.
+func (s *clickHouseSink) Run(ctx context.Context) {
+	for {
+		select {
+		case batch := <-s.queue:
+			s.insertWithRetry(ctx, batch)
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			for {
+				select {
+				case batch := <-s.queue:
+					s.insertWithRetry(drainCtx, batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *clickHouseSink) insertWithRetry(ctx context.Context, batch []byte) {
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.insert(ctx, batch)
+		if err == nil {
+			return
+		}
+
+		log := logrus.WithError(err).WithField("attempt", attempt+1)
+		if attempt >= s.maxRetries {
+			log.Error("unable to insert packet events into clickhouse, drop batch")
+			analyticsExportCounter.WithLabelValues(s.Name(), "dropped").Inc()
+			return
+		}
+		log.Warn("unable to insert packet events into clickhouse, retry")
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			log.Error("stopped before packet events were inserted into clickhouse, drop batch")
+			return
+		}
+	}
+}
+
+func (s *clickHouseSink) insert(ctx context.Context, batch []byte) error {
+	u := s.endpoint + "?query=" + url.QueryEscape(s.query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("clickhouse returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// clockOffsetAlertKind is the kind of the alert raised when the host
+	// clock is off by more than the threshold
+	clockOffsetAlertKind = "host_clock_offset"
+	// clockUnverifiedAlertKind is the kind of the alert raised when none of
+	// the NTP servers answered
+	clockUnverifiedAlertKind = "host_clock_unverified"
+
+	// ntpEpochOffset is the number of seconds between the NTP epoch (1900)
+	// and the unix epoch (1970)
+	ntpEpochOffset = 2208988800
+)
+
+var defaultNTPServers = []string{"pool.ntp.org"}
+
+// ClockChecker periodically compares the host clock against NTP servers.
+// When the host clock is off by more than the threshold an alert is raised
+// and downlinks scheduled at an absolute (GPS) time are refused, the gateway
+// would otherwise transmit them outside the receive window of the device.
+// Downlinks scheduled relative to an uplink use the concentrator counter and
+// are not affected.
+type ClockChecker struct {
+	servers   []string
+	interval  time.Duration
+	threshold time.Duration
+	timeout   time.Duration
+	alerter   *Alerter
+
+	mu sync.RWMutex
+	// offset is the last measured offset of the host clock, nil if the
+	// clock wasn't verified yet
+	offset *time.Duration
+	server string
+}
+
+// NewClockChecker returns a clock checker configured from cfg that raises
+// alerts on alerter.
+func NewClockChecker(cfg *ForwarderClockCheckConfig, alerter *Alerter) *ClockChecker {
+	c := &ClockChecker{
+		servers:   defaultNTPServers,
+		interval:  15 * time.Minute,
+		threshold: 100 * time.Millisecond,
+		timeout:   5 * time.Second,
+		alerter:   alerter,
+	}
+	if len(cfg.Servers) > 0 {
+		c.servers = cfg.Servers
+	}
+	if cfg.Interval != nil && *cfg.Interval > 0 {
+		c.interval = *cfg.Interval
+	}
+	if cfg.Threshold != nil && *cfg.Threshold > 0 {
+		c.threshold = *cfg.Threshold
+	}
+	if cfg.Timeout != nil && *cfg.Timeout > 0 {
+		c.timeout = *cfg.Timeout
+	}
+	return c
+}
+
+// Synchronized returns false when the last measured offset of the host clock
+// exceeds the threshold. The clock is assumed synchronized as long as it
+// could not be verified.
+func (c *ClockChecker) Synchronized() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offset == nil || absDuration(*c.offset) <= c.threshold
+}
+
+// AllowDownlink returns false when the frame is scheduled at an absolute
+// time while the host clock is not synchronized.
+func (c *ClockChecker) AllowDownlink(frame *gw.DownlinkFrame) bool {
+	if len(frame.GetItems()) == 0 || frame.GetItems()[0].GetTxInfo().GetTiming().GetGpsEpoch() == nil {
+		return true
+	}
+	return c.Synchronized()
+}
+
+// Run checks the host clock at startup and each interval until ctx expires.
+func (c *ClockChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check measures the host clock offset against the first NTP server that
+// answers and raises or resolves the clock alerts.
+func (c *ClockChecker) check(ctx context.Context) {
+	var (
+		offset time.Duration
+		server string
+		err    error
+	)
+	for _, server = range c.servers {
+		if offset, err = queryNTPOffset(ctx, server, c.timeout); err == nil {
+			break
+		}
+		logrus.WithError(err).WithField("server", server).Debug("unable to query ntp server")
+	}
+
+	if err != nil {
+		c.alerter.Raise(Alert{
+			Key:      clockUnverifiedAlertKind,
+			Kind:     clockUnverifiedAlertKind,
+			Severity: AlertSeverityWarning,
+			Summary:  "unable to verify the host clock, none of the NTP servers answered",
+			Details: map[string]interface{}{
+				"servers": c.servers,
+				"error":   err.Error(),
+			},
+		})
+		return
+	}
+	c.alerter.Resolve(clockUnverifiedAlertKind)
+
+	c.mu.Lock()
+	c.offset, c.server = &offset, server
+	c.mu.Unlock()
+
+	hostClockOffsetGauge.Set(offset.Seconds())
+
+	log := logrus.WithFields(logrus.Fields{
+		"server":    server,
+		"offset":    offset,
+		"threshold": c.threshold,
+	})
+	if absDuration(offset) > c.threshold {
+		c.alerter.Raise(Alert{
+			Key:      clockOffsetAlertKind,
+			Kind:     clockOffsetAlertKind,
+			Severity: AlertSeverityCritical,
+			Summary:  fmt.Sprintf("host clock is off by %s, downlinks scheduled at GPS time are refused", offset),
+			Details: map[string]interface{}{
+				"server":    server,
+				"offset":    offset.Seconds(),
+				"threshold": c.threshold.Seconds(),
+			},
+		})
+		return
+	}
+	log.Debug("host clock verified")
+	c.alerter.Resolve(clockOffsetAlertKind)
+}
+
+// queryNTPOffset returns the offset of the host clock against the NTP server
+// with a single SNTP (RFC 4330) request. A positive offset means the host
+// clock is behind.
+func queryNTPOffset(ctx context.Context, server string, timeout time.Duration) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var (
+		req  = make([]byte, 48)
+		resp = make([]byte, 48)
+		sent = time.Now()
+	)
+	req[0] = 0x23 // leap indicator 0, version 4, mode 3 (client)
+	binary.BigEndian.PutUint64(req[40:48], toNTPTime(sent))
+
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	if n < 48 || resp[0]&0x07 != 4 {
+		return 0, errors.New("invalid ntp response")
+	}
+	if stratum := resp[1]; stratum == 0 || stratum > 15 {
+		return 0, fmt.Errorf("ntp server not synchronized (stratum %d)", stratum)
+	}
+	if !bytes.Equal(resp[24:32], req[40:48]) {
+		return 0, errors.New("ntp response doesn't match request")
+	}
+
+	var (
+		serverReceived = fromNTPTime(binary.BigEndian.Uint64(resp[32:40]))
+		serverSent     = fromNTPTime(binary.BigEndian.Uint64(resp[40:48]))
+	)
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	var (
+		secs = int64(v>>32) - ntpEpochOffset
+		nsec = int64((v & 0xffffffff) * uint64(time.Second) >> 32)
+	)
+	return time.Unix(secs, nsec)
+}
+
+// refuseUnsynchronizedDownlink returns true and rejects the frame when it is
+// scheduled at GPS time while the host clock is not synchronized.
+func (e *Exchange) refuseUnsynchronizedDownlink(gateway *gateway.Gateway, frame *gw.DownlinkFrame, log *logrus.Entry) bool {
+	if e.clockCheck == nil || e.clockCheck.AllowDownlink(frame) {
+		return false
+	}
+	gatewayCounter(downlinksClockUnsynchronizedCounter, gateway.NetworkID, gateway.LocalID).Inc()
+	droppedFramesCounter.WithLabelValues("downlink", "clock_unsynchronized").Inc()
+	log.Warn("drop downlink: scheduled at GPS time while the host clock is not synchronized")
+
+	ack := &gw.DownlinkTxAck{
+		GatewayId:  gateway.LocalID.String(),
+		DownlinkId: frame.GetDownlinkId(),
+	}
+	for range frame.GetItems() {
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_GPS_UNLOCKED})
+	}
+	e.downlinkTxAck(ack)
+	return true
+}
@@ -0,0 +1,288 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	defaultClockDriftWindow = 10 * time.Minute
+	// defaultClockDriftMax is the maximum drift in ppm that is accepted as
+	// an estimate, larger values indicate a concentrator restart
+	defaultClockDriftMax = 500
+	// clockDriftMaxGap is the maximum time between uplinks, the 32 bit
+	// concentrator counter can't be unwrapped over longer gaps
+	clockDriftMaxGap = time.Hour
+	// clockDriftSmoothing is the weight of a new estimate in the moving
+	// average
+	clockDriftSmoothing = 0.3
+	// clockDriftMinEstimates is the number of estimates required before
+	// downlinks are compensated
+	clockDriftMinEstimates = 2
+)
+
+// clockSample relates the unwrapped concentrator counter to the reference
+// clock, both in µs.
+type clockSample struct {
+	counter   int64
+	reference int64
+}
+
+// offset is the reference time minus the counter. Network jitter only
+// increases it, the sample with the lowest offset in a window is the best
+// approximation of the moment the counter was sampled.
+func (s clockSample) offset() int64 {
+	return s.reference - s.counter
+}
+
+// gatewayClock tracks the concentrator clock of a single gateway.
+type gatewayClock struct {
+	localID lorawan.EUI64
+	// gps is set when the reference is the GPS time reported by the gateway
+	// instead of the time the forwarder received the uplink
+	gps bool
+	// base is the reference time counters are relative to
+	base        time.Time
+	lastCounter uint32
+	lastSeen    time.Time
+	counter     int64
+
+	windowStart time.Time
+	best        *clockSample
+	previous    *clockSample
+
+	// drift is the moving average of the estimated clock drift in ppm, a
+	// positive value indicates a fast concentrator clock
+	drift     float64
+	estimates int
+	updated   time.Time
+}
+
+// ClockDriftEstimator estimates the drift of the concentrator clock of
+// gateways from the counter (count_us) in consecutive uplinks. The counter is
+// compared against the GPS time of the uplink when the gateway reports it
+// and otherwise against the time the forwarder received the uplink. To rule
+// out network jitter the uplink with the lowest latency in each window is
+// used. Downlinks that are scheduled relative to an uplink counter get their
+// delay adjusted for the drift, this reduces TOO_EARLY and TOO_LATE errors on
+// gateways with poor oscillators.
+type ClockDriftEstimator struct {
+	window   time.Duration
+	maxDrift float64
+
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*gatewayClock
+}
+
+// NewClockDriftEstimator returns a clock drift estimator configured from
+// cfg.
+func NewClockDriftEstimator(cfg *ForwarderClockDriftConfig) *ClockDriftEstimator {
+	e := &ClockDriftEstimator{
+		window:   defaultClockDriftWindow,
+		maxDrift: defaultClockDriftMax,
+		gateways: make(map[lorawan.EUI64]*gatewayClock),
+	}
+	if cfg.Window != nil && *cfg.Window > 0 {
+		e.window = *cfg.Window
+	}
+	if cfg.MaxDrift != nil && *cfg.MaxDrift > 0 {
+		e.maxDrift = *cfg.MaxDrift
+	}
+	return e
+}
+
+// Observe updates the clock drift estimate of the gateway with the counter
+// of the uplink it received at the given time.
+func (e *ClockDriftEstimator) Observe(networkID, localID lorawan.EUI64, frame *gw.UplinkFrame, received time.Time) {
+	ctx := frame.GetRxInfo().GetContext()
+	if len(ctx) < 4 {
+		return
+	}
+	var (
+		counter   = binary.BigEndian.Uint32(ctx[0:4])
+		gpsTime   = frame.GetRxInfo().GetTimeSinceGpsEpoch()
+		gps       = gpsTime != nil
+		reference = received
+	)
+	if gps {
+		// only differences are used, the epoch doesn't matter
+		reference = time.Unix(0, 0).Add(gpsTime.AsDuration())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	clock, ok := e.gateways[networkID]
+	if !ok || clock.gps != gps || received.Sub(clock.lastSeen) > clockDriftMaxGap || reference.Before(clock.base) {
+		// keep the estimate, only the counter must be resynchronized
+		if !ok {
+			clock = &gatewayClock{localID: localID}
+			e.gateways[networkID] = clock
+		}
+		clock.resync(counter, reference, received, gps)
+	}
+
+	clock.counter += int64(counter - clock.lastCounter)
+	clock.lastCounter = counter
+	clock.lastSeen = received
+
+	sample := clockSample{counter: clock.counter, reference: reference.Sub(clock.base).Microseconds()}
+	if clock.best == nil || sample.offset() < clock.best.offset() {
+		clock.best = &sample
+	}
+	if reference.Sub(clock.windowStart) < e.window {
+		return
+	}
+
+	// window complete, estimate the drift between the best samples of this
+	// and the previous window
+	best := *clock.best
+	if clock.previous != nil {
+		var (
+			counterDelta   = float64(best.counter - clock.previous.counter)
+			referenceDelta = float64(best.reference - clock.previous.reference)
+		)
+		if referenceDelta >= float64(e.window.Microseconds())/2 {
+			drift := (counterDelta - referenceDelta) / referenceDelta * 1e6
+			if math.Abs(drift) > e.maxDrift {
+				// the counter jumped, most likely the concentrator restarted
+				clock.resync(counter, reference, received, gps)
+				return
+			}
+			if clock.estimates == 0 {
+				clock.drift = drift
+			} else {
+				clock.drift += clockDriftSmoothing * (drift - clock.drift)
+			}
+			clock.estimates++
+			clock.updated = received
+			gatewayGauge(gatewayClockDriftGauge, networkID, localID).Set(clock.drift)
+		}
+	}
+	clock.previous = &best
+	clock.best = nil
+	clock.windowStart = reference
+}
+
+// resync restarts counter tracking from the given uplink counter.
+func (c *gatewayClock) resync(counter uint32, reference, received time.Time, gps bool) {
+	c.gps = gps
+	c.base = reference
+	c.lastCounter = counter
+	c.lastSeen = received
+	c.counter = 0
+	c.windowStart = reference
+	c.best = nil
+	c.previous = nil
+}
+
+// Compensate adjusts the delay of downlink items that are scheduled relative
+// to an uplink counter for the estimated clock drift of the gateway. It
+// returns an indication if the frame was changed.
+func (e *ClockDriftEstimator) Compensate(networkID lorawan.EUI64, frame *gw.DownlinkFrame) bool {
+	e.mu.Lock()
+	clock, ok := e.gateways[networkID]
+	var drift float64
+	if ok && clock.estimates >= clockDriftMinEstimates {
+		drift = clock.drift
+	}
+	e.mu.Unlock()
+
+	if drift == 0 {
+		return false
+	}
+
+	changed := false
+	for _, item := range frame.GetItems() {
+		timing := item.GetTxInfo().GetTiming().GetDelay()
+		if timing == nil || timing.GetDelay() == nil {
+			continue
+		}
+		var (
+			delay      = timing.GetDelay().AsDuration()
+			correction = time.Duration(float64(delay) * drift / 1e6).Round(time.Microsecond)
+		)
+		if correction == 0 {
+			continue
+		}
+		timing.Delay = durationpb.New(delay + correction)
+		changed = true
+	}
+	return changed
+}
+
+// GatewayClockDrift is the estimated concentrator clock drift of a gateway.
+type GatewayClockDrift struct {
+	GatewayNetworkID lorawan.EUI64 `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64 `json:"gatewayLocalId"`
+	// DriftPPM is positive when the concentrator clock runs fast
+	DriftPPM float64 `json:"driftPpm"`
+	// Estimates is the number of windows the drift was estimated over
+	Estimates int `json:"estimates"`
+	// Compensated is set when downlinks are adjusted for the drift
+	Compensated bool `json:"compensated"`
+	// GPS is set when the drift is estimated against GPS time
+	GPS     bool       `json:"gps"`
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// Gateways returns the clock drift estimate of all gateways, ordered by
+// network id.
+func (e *ClockDriftEstimator) Gateways() []GatewayClockDrift {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	drifts := make([]GatewayClockDrift, 0, len(e.gateways))
+	for networkID, clock := range e.gateways {
+		drift := GatewayClockDrift{
+			GatewayNetworkID: networkID,
+			GatewayLocalID:   clock.localID,
+			DriftPPM:         clock.drift,
+			Estimates:        clock.estimates,
+			Compensated:      clock.estimates >= clockDriftMinEstimates,
+			GPS:              clock.gps,
+		}
+		if !clock.updated.IsZero() {
+			updated := clock.updated
+			drift.Updated = &updated
+		}
+		drifts = append(drifts, drift)
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].GatewayNetworkID.String() < drifts[j].GatewayNetworkID.String()
+	})
+	return drifts
+}
+
+// ClockDrift returns the estimated concentrator clock drift per gateway.
+func (svc APIService) ClockDrift(w http.ResponseWriter, r *http.Request) {
+	if svc.clockDrift == nil {
+		http.Error(w, "clock drift compensation not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	replyJSON(w, http.StatusOK, svc.clockDrift.Gateways())
+}
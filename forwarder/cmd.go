@@ -18,13 +18,20 @@ package forwarder
 
 import (
 	"context"
+	"net"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/ThingsIXFoundation/packet-handling/health"
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
+	"github.com/ThingsIXFoundation/packet-handling/upgrade"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // Run the packet exchange.
@@ -34,13 +41,55 @@ func Run(cmd *cobra.Command, args []string) {
 		cfg           = mustLoadConfig(false)
 		wg            sync.WaitGroup
 		sign          = make(chan os.Signal, 1)
+		upgrader      = upgrade.Default()
 		exchange, err = NewExchange(ctx, cfg)
+		apiListener   net.Listener
+		mgmtListener  net.Listener
+		adminListener net.Listener
+		promListener  net.Listener
 	)
 
 	if err != nil {
 		logrus.WithError(err).Fatal("unable to instantiate packet exchange")
 	}
 
+	shutdownTracing, err := tracing.Setup(ctx, "thingsix-forwarder", cfg.Tracing)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to setup tracing")
+	}
+
+	if cfg.Forwarder.Runtime != nil {
+		applyRuntimeTuning(cfg.Forwarder.Runtime)
+		wg.Add(1)
+		go func() {
+			runGCMonitor(ctx, 10*time.Second)
+			wg.Done()
+		}()
+	}
+
+	// bind all listeners before signalling a possible parent process that
+	// this process is ready to take over
+	if cfg.Forwarder.Gateways.HttpAPI.Address != "" {
+		if apiListener, err = upgrader.Listen("tcp", cfg.Forwarder.Gateways.HttpAPI.Address); err != nil {
+			logrus.WithError(err).Fatal("unable to bind forwarder HTTP API")
+		}
+	}
+	if mgmt := cfg.Forwarder.Gateways.Management; mgmt != nil {
+		if mgmtListener, err = upgrader.Listen("tcp", mgmt.Address); err != nil {
+			logrus.WithError(err).Fatal("unable to bind gateway management API")
+		}
+	}
+	if admin := cfg.Forwarder.Admin; admin != nil {
+		if adminListener, err = upgrader.Listen("tcp", admin.Address); err != nil {
+			logrus.WithError(err).Fatal("unable to bind admin API")
+		}
+	}
+	if cfg.PrometheusEnabled() {
+		if promListener, err = upgrader.Listen("tcp", cfg.MetricsPrometheusAddress()); err != nil {
+			logrus.WithError(err).Fatal("unable to bind prometheus metrics endpoint")
+		}
+	}
+
 	// run packet exchange
 	wg.Add(1)
 	go func() {
@@ -48,28 +97,116 @@ func Run(cmd *cobra.Command, args []string) {
 		wg.Done()
 	}()
 
+	// export packet events for analytics if configured
+	if cfg.Forwarder.Analytics != nil {
+		exporter, err := NewAnalyticsExporter(cfg.Forwarder.Analytics)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to instantiate analytics exporter")
+		}
+		wg.Add(1)
+		go func() {
+			exporter.Run(ctx, exchange)
+			wg.Done()
+		}()
+	}
+
+	// notify systemd when ready and feed its watchdog if configured
+	wg.Add(1)
+	go func() {
+		health.RunWatchdog(ctx, exchange.healthChecks)
+		wg.Done()
+	}()
+
 	// run the forwarders http api if configured
 	wg.Add(1)
 	go func() {
 		// run the forwarders private api if configured
-		runAPI(ctx, cfg, exchange.gateways, exchange.recordUnknownGateway)
+		runAPI(ctx, cfg, apiListener, exchange)
 		wg.Done()
 	}()
 
+	// run the gateway management api if configured
+	if mgmtListener != nil {
+		wg.Add(1)
+		go func() {
+			runManagementAPI(ctx, cfg, mgmtListener, exchange)
+			wg.Done()
+		}()
+	}
+
+	// run the grpc admin api if configured
+	if adminListener != nil {
+		wg.Add(1)
+		go func() {
+			runAdminAPI(ctx, cfg, adminListener, exchange)
+			wg.Done()
+		}()
+	}
+
 	// enable prometheus endpoint if configured
 	if cfg.PrometheusEnabled() {
 		wg.Add(1)
 		go func() {
-			runPrometheusHTTPEndpoint(ctx, cfg)
+			runPrometheusHTTPEndpoint(ctx, cfg, promListener, exchange.healthChecks)
 			wg.Done()
 		}()
 	}
 
-	// wait for shutdown signal
-	signal.Notify(sign, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	<-sign
+	if upgrader.HasParent() {
+		logrus.Info("signal parent process upgrade completed")
+	}
+	if err := upgrader.Ready(); err != nil {
+		logrus.WithError(err).Error("unable to complete upgrade")
+	}
+
+	// wait for shutdown signal, or upgrade signal after which a new process
+	// takes over the listeners and this process shuts down
+	signal.Notify(sign, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if upgradeSignals := upgrade.Signals(); len(upgradeSignals) > 0 {
+		signal.Notify(sign, upgradeSignals...)
+	}
+	// apply changes to the default routers in the config file at runtime
+	var configChanged <-chan struct{}
+	if configFile := viper.ConfigFileUsed(); configFile != "" {
+		configChanged = utils.WatchFile(ctx, configFile, routingLog)
+	}
+	for running := true; running; {
+		select {
+		case <-configChanged:
+			if err := reloadDefaultRoutes(exchange.routingTable); err != nil {
+				logrus.WithError(err).Error("unable to apply changed default routers, keep current routers")
+			}
+		case s := <-sign:
+			if s == os.Interrupt || s == syscall.SIGINT || s == syscall.SIGTERM {
+				running = false
+				break
+			}
+			if s == syscall.SIGHUP {
+				if err := reloadLogConfig(); err != nil {
+					logrus.WithError(err).Error("unable to reload log configuration")
+				} else {
+					logrus.Info("log configuration reloaded")
+				}
+				if err := reloadDefaultRoutes(exchange.routingTable); err != nil {
+					logrus.WithError(err).Error("unable to reload default routers, keep current routers")
+				}
+				continue
+			}
+			logrus.Info("upgrade requested")
+			if err := upgrader.Upgrade(); err != nil {
+				logrus.WithError(err).Error("upgrade failed, continue running")
+				continue
+			}
+			running = false
+		}
+	}
 	logrus.Info("initiate shutdown...")
 	shutdown()
 	wg.Wait()
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		logrus.WithError(err).Warn("unable to flush traces")
+	}
+	cancel()
 	logrus.Info("bye")
 }
@@ -0,0 +1,395 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	complianceAuditFile = "audit.log"
+	// complianceQueueSize is the number of records that can wait to be
+	// written, if the queue is full records are dropped and the number of
+	// dropped records is written to the audit log
+	complianceQueueSize = 4096
+)
+
+// complianceHold is a DevAddr range for which packets are exported.
+type complianceHold struct {
+	reference string
+	devAddrs  string
+	prefix    uint32
+	mask      uint8
+	expires   time.Time
+}
+
+// ComplianceRecord is the full record of a packet of a device under a
+// compliance hold. Records are sealed for the recipient key before they are
+// written and are never logged.
+type ComplianceRecord struct {
+	Reference        string          `json:"reference"`
+	Time             time.Time       `json:"time"`
+	Type             PacketEventType `json:"type"`
+	PacketID         string          `json:"packetId,omitempty"`
+	GatewayNetworkID lorawan.EUI64   `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64   `json:"gatewayLocalId"`
+	Owner            string          `json:"owner,omitempty"`
+	DevAddr          lorawan.DevAddr `json:"devAddr"`
+	PHYPayload       []byte          `json:"phyPayload"`
+	// Frame is the uplink or downlink frame including all metadata
+	Frame json.RawMessage `json:"frame"`
+}
+
+// sealedComplianceRecord is a line in an export file. Each line holds the
+// hash of the previous line, this makes it possible to detect records that
+// are removed or changed without opening them.
+type sealedComplianceRecord struct {
+	Seq    uint64 `json:"seq"`
+	Prev   string `json:"prev"`
+	Sealed []byte `json:"sealed"`
+}
+
+// ComplianceHoldExporter writes sealed records of packets of devices in the
+// held DevAddr ranges to an export file. Records are sealed with the public
+// key of the recipient, the forwarder can't open them. All activity is
+// recorded in an audit log next to the export files.
+type ComplianceHoldExporter struct {
+	directory string
+	recipient *[32]byte
+	holds     []complianceHold
+	records   chan *ComplianceRecord
+	dropped   uint64
+}
+
+// NewComplianceHoldExporter returns an exporter configured from cfg. Holds
+// must be configured explicitly with a reference, DevAddr range and expiry.
+func NewComplianceHoldExporter(cfg *ForwarderComplianceHoldConfig) (*ComplianceHoldExporter, error) {
+	if cfg.Directory == "" {
+		return nil, fmt.Errorf("compliance hold requires an export directory")
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(cfg.RecipientKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("compliance hold requires a hex encoded X25519 recipient key")
+	}
+	if len(cfg.Holds) == 0 {
+		return nil, fmt.Errorf("compliance hold without holds")
+	}
+
+	exporter := &ComplianceHoldExporter{
+		directory: cfg.Directory,
+		recipient: new([32]byte),
+		records:   make(chan *ComplianceRecord, complianceQueueSize),
+	}
+	copy(exporter.recipient[:], key)
+
+	for i, c := range cfg.Holds {
+		if c.Reference == "" {
+			return nil, fmt.Errorf("compliance hold %d without reference", i)
+		}
+		prefix, mask, err := parseDevAddrRange(c.DevAddrs)
+		if err != nil {
+			return nil, fmt.Errorf("compliance hold %s: %w", c.Reference, err)
+		}
+		expires, err := time.Parse(time.RFC3339, c.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("compliance hold %s requires an RFC3339 expiry: %w", c.Reference, err)
+		}
+		exporter.holds = append(exporter.holds, complianceHold{
+			reference: c.Reference,
+			devAddrs:  c.DevAddrs,
+			prefix:    prefix,
+			mask:      mask,
+			expires:   expires,
+		})
+	}
+
+	if err := os.MkdirAll(exporter.directory, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create compliance hold directory: %w", err)
+	}
+	if err := os.Chmod(exporter.directory, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to restrict access to compliance hold directory: %w", err)
+	}
+
+	return exporter, nil
+}
+
+// parseDevAddrRange parses a DevAddr range in the form <prefix>/<bits>.
+func parseDevAddrRange(s string) (uint32, uint8, error) {
+	addr, bits, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid DevAddr range %q, expected <prefix>/<bits>", s)
+	}
+	var devAddr lorawan.DevAddr
+	if err := devAddr.UnmarshalText([]byte(addr)); err != nil {
+		return 0, 0, fmt.Errorf("invalid DevAddr range %q: %w", s, err)
+	}
+	mask, err := strconv.ParseUint(bits, 10, 8)
+	if err != nil || mask == 0 || mask > 32 {
+		return 0, 0, fmt.Errorf("invalid DevAddr range %q, bits must be between 1 and 32", s)
+	}
+	prefix := binary.BigEndian.Uint32(devAddr[:]) &^ (^uint32(0) >> mask)
+	return prefix, uint8(mask), nil
+}
+
+// hold returns the active hold for devAddr.
+func (c *ComplianceHoldExporter) hold(devAddr lorawan.DevAddr, now time.Time) (complianceHold, bool) {
+	for _, h := range c.holds {
+		if now.Before(h.expires) && DevAddrHasPrefix(devAddr, h.prefix, h.mask) {
+			return h, true
+		}
+	}
+	return complianceHold{}, false
+}
+
+// Record queues a record of the packet if devAddr is under an active hold.
+// The frame is encoded immediately because it is modified after it is
+// recorded.
+func (c *ComplianceHoldExporter) Record(typ PacketEventType, gateway *gateway.Gateway, packetID string, devAddr lorawan.DevAddr, phy []byte, frame proto.Message) {
+	now := time.Now()
+	h, ok := c.hold(devAddr, now)
+	if !ok {
+		return
+	}
+
+	encoded, err := protojson.Marshal(frame)
+	if err != nil {
+		encoded = []byte("null")
+	}
+	record := &ComplianceRecord{
+		Reference:        h.reference,
+		Time:             now,
+		Type:             typ,
+		PacketID:         packetID,
+		GatewayNetworkID: gateway.NetworkID,
+		GatewayLocalID:   gateway.LocalID,
+		DevAddr:          devAddr,
+		PHYPayload:       append([]byte(nil), phy...),
+		Frame:            encoded,
+	}
+	if gateway.Owner != nil {
+		record.Owner = gateway.Owner.Hex()
+	}
+
+	select {
+	case c.records <- record:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// complianceExport is the state of the hash chain of the open export file.
+type complianceExport struct {
+	seq  uint64
+	prev string
+}
+
+// Run writes queued records to a new export file until ctx expires. The
+// export file is never reused, each run starts a new hash chain.
+func (c *ComplianceHoldExporter) Run(ctx context.Context) {
+	audit, err := os.OpenFile(filepath.Join(c.directory, complianceAuditFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		logrus.WithError(err).Error("unable to open compliance hold audit log, compliance export stopped")
+		return
+	}
+	defer audit.Close()
+
+	auditLog := func(event string, fields map[string]interface{}) {
+		entry := map[string]interface{}{"time": time.Now().UTC(), "event": event}
+		for k, v := range fields {
+			entry[k] = v
+		}
+		line, _ := json.Marshal(entry)
+		if _, err := audit.Write(append(line, '\n')); err != nil {
+			logrus.WithError(err).Error("unable to write compliance hold audit log")
+		}
+	}
+
+	name := fmt.Sprintf("export-%s-%d.jsonl", time.Now().UTC().Format("20060102T150405Z"), os.Getpid())
+	f, err := os.OpenFile(filepath.Join(c.directory, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		auditLog("export_failed", map[string]interface{}{"error": err.Error()})
+		logrus.WithError(err).Error("unable to create compliance hold export, compliance export stopped")
+		return
+	}
+	var (
+		export  = new(complianceExport)
+		writer  = bufio.NewWriter(f)
+		ticker  = time.NewTicker(time.Minute)
+		expired = make([]bool, len(c.holds))
+	)
+	defer ticker.Stop()
+
+	auditLog("export_opened", map[string]interface{}{"file": name, "recipient": hex.EncodeToString(c.recipient[:])})
+	for _, h := range c.holds {
+		auditLog("hold_active", map[string]interface{}{
+			"reference": h.reference,
+			"dev_addrs": h.devAddrs,
+			"expires":   h.expires.UTC(),
+			"expired":   !time.Now().Before(h.expires),
+		})
+	}
+	logrus.WithField("directory", c.directory).Info("compliance hold export enabled")
+
+	flush := func() {
+		if err := writer.Flush(); err != nil {
+			auditLog("export_failed", map[string]interface{}{"file": name, "error": err.Error()})
+			return
+		}
+		_ = f.Sync()
+	}
+
+	for {
+		select {
+		case record := <-c.records:
+			if err := c.write(writer, export, record); err != nil {
+				auditLog("export_failed", map[string]interface{}{"file": name, "error": err.Error()})
+			}
+		case now := <-ticker.C:
+			flush()
+			if dropped := atomic.SwapUint64(&c.dropped, 0); dropped > 0 {
+				auditLog("records_dropped", map[string]interface{}{"file": name, "records": dropped})
+			}
+			for i, h := range c.holds {
+				if !now.Before(h.expires) && !expired[i] {
+					expired[i] = true
+					auditLog("hold_expired", map[string]interface{}{"reference": h.reference, "dev_addrs": h.devAddrs})
+				}
+			}
+		case <-ctx.Done():
+			// write records that are still queued
+			for pending := len(c.records); pending > 0; pending-- {
+				if err := c.write(writer, export, <-c.records); err != nil {
+					auditLog("export_failed", map[string]interface{}{"file": name, "error": err.Error()})
+				}
+			}
+			flush()
+			_ = f.Close()
+			auditLog("export_closed", map[string]interface{}{
+				"file":    name,
+				"records": export.seq,
+				"last":    export.prev,
+				"dropped": atomic.LoadUint64(&c.dropped),
+			})
+			return
+		}
+	}
+}
+
+// write seals the record and appends it to the export.
+func (c *ComplianceHoldExporter) write(w *bufio.Writer, export *complianceExport, record *ComplianceRecord) error {
+	plain, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sealed, err := box.SealAnonymous(nil, plain, c.recipient, rand.Reader)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(sealedComplianceRecord{
+		Seq:    export.seq + 1,
+		Prev:   export.prev,
+		Sealed: sealed,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	hash := sha256.Sum256(line)
+	export.seq++
+	export.prev = hex.EncodeToString(hash[:])
+	return nil
+}
+
+// OpenComplianceExport verifies the hash chain of the export file at path
+// and calls fn with each record opened with the recipient key pair.
+func OpenComplianceExport(path string, publicKey, privateKey *[32]byte, fn func(seq uint64, record *ComplianceRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		scanner = bufio.NewScanner(f)
+		seq     uint64
+		prev    string
+	)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var sealed sealedComplianceRecord
+		if err := json.Unmarshal(line, &sealed); err != nil {
+			return fmt.Errorf("record %d: %w", seq+1, err)
+		}
+		if sealed.Seq != seq+1 || sealed.Prev != prev {
+			return fmt.Errorf("hash chain broken at record %d", seq+1)
+		}
+		plain, ok := box.OpenAnonymous(nil, sealed.Sealed, publicKey, privateKey)
+		if !ok {
+			return fmt.Errorf("unable to open record %d, wrong key or record modified", sealed.Seq)
+		}
+		var record ComplianceRecord
+		if err := json.Unmarshal(plain, &record); err != nil {
+			return fmt.Errorf("record %d: %w", sealed.Seq, err)
+		}
+		if err := fn(sealed.Seq, &record); err != nil {
+			return err
+		}
+		hash := sha256.Sum256(line)
+		seq, prev = sealed.Seq, hex.EncodeToString(hash[:])
+	}
+	return scanner.Err()
+}
+
+// recordComplianceDownlink records the downlink frame if it is addressed to a
+// device under a compliance hold. Join-accepts are not recorded, they don't
+// contain a DevAddr in plain text.
+func (e *Exchange) recordComplianceDownlink(gateway *gateway.Gateway, packetID string, frame *gw.DownlinkFrame) {
+	for _, item := range frame.GetItems() {
+		var phy lorawan.PHYPayload
+		if err := phy.UnmarshalBinary(item.GetPhyPayload()); err != nil {
+			continue
+		}
+		if mac, ok := phy.MACPayload.(*lorawan.MACPayload); ok {
+			e.complianceHold.Record(PacketEventDownlink, gateway, packetID, mac.FHDR.DevAddr, item.GetPhyPayload(), frame)
+			return
+		}
+	}
+}
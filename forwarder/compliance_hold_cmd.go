@@ -0,0 +1,100 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var (
+	ComplianceHoldCmds = &cobra.Command{
+		Use:   "compliance-hold",
+		Short: "Compliance hold export commands",
+	}
+
+	complianceKeygenCmd = &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate the X25519 key pair compliance hold records are sealed for",
+		Long: `Generate the key pair compliance hold records are sealed for. Configure the
+public key as recipient_key in the forwarder, the private key must be kept
+by the party the records are exported for and is required to open them.`,
+		Args: cobra.NoArgs,
+		Run:  generateComplianceKey,
+	}
+
+	complianceOpenCmd = &cobra.Command{
+		Use:   "open --key-file <file> <export>...",
+		Short: "Verify and open compliance hold export files",
+		Long: `Verify the hash chain of compliance hold export files and print the opened
+records as JSON lines. Opening stops at the first record that is missing or
+was modified.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  openComplianceExports,
+	}
+
+	complianceKeyFile string
+)
+
+func init() {
+	ComplianceHoldCmds.AddCommand(complianceKeygenCmd)
+	ComplianceHoldCmds.AddCommand(complianceOpenCmd)
+	complianceOpenCmd.Flags().StringVar(&complianceKeyFile, "key-file", "", "file with the hex encoded X25519 private key")
+	_ = complianceOpenCmd.MarkFlagRequired("key-file")
+}
+
+func generateComplianceKey(cmd *cobra.Command, args []string) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to generate key")
+	}
+	fmt.Printf("private key: %x\npublic key:  %x\n", priv[:], pub[:])
+}
+
+func openComplianceExports(cmd *cobra.Command, args []string) {
+	raw, err := os.ReadFile(complianceKeyFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read key file")
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != curve25519.ScalarSize {
+		logrus.Fatal("invalid compliance hold key")
+	}
+
+	var priv, pub [32]byte
+	copy(priv[:], key)
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	out := json.NewEncoder(os.Stdout)
+	for _, path := range args {
+		err := OpenComplianceExport(path, &pub, &priv, func(seq uint64, record *ComplianceRecord) error {
+			return out.Encode(record)
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("file", path).Fatal("unable to open compliance hold export")
+		}
+	}
+}
@@ -17,10 +17,12 @@
 package forwarder
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
 	"github.com/ThingsIXFoundation/packet-handling/database"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/ethereum/go-ethereum/common"
@@ -29,6 +31,15 @@ import (
 	"github.com/spf13/viper"
 )
 
+// H3Resolution returns the configured H3 resolution for gateway location
+// metadata, or -1 if the registered location resolution must be used.
+func (cfg Config) H3Resolution() int {
+	if cfg.Forwarder.Metadata.H3Resolution != nil {
+		return *cfg.Forwarder.Metadata.H3Resolution
+	}
+	return -1
+}
+
 func (cfg Config) PrometheusEnabled() bool {
 	return cfg.Metrics != nil &&
 		cfg.Metrics.Prometheus != nil
@@ -61,9 +72,6 @@ func getNetConfig(net string) *Config {
 	cfg.Forwarder.Backend.SemtechUDP.FakeRxTime = utils.Ptr(false)
 	cfg.Forwarder.Backend.BasicStation = &BasicStationBackendConfig{}
 	cfg.Forwarder.Backend.BasicStation.Bind = utils.Ptr("0.0.0.0:8887")
-	cfg.Forwarder.Backend.BasicStation.TLSCert = utils.Ptr("/etc/thingsix-forwarder/basic_station/cert.pem")
-	cfg.Forwarder.Backend.BasicStation.TLSKey = utils.Ptr("/etc/thingsix-forwarder/basic_station/private_key.pem")
-	cfg.Forwarder.Backend.BasicStation.CACert = utils.Ptr("/etc/thingsix-forwarder/basic_station/ca_cert.pem")
 	cfg.Forwarder.Backend.BasicStation.StatsInterval = utils.Ptr(30 * time.Second)
 	cfg.Forwarder.Backend.BasicStation.PingInterval = utils.Ptr(time.Minute)
 	cfg.Forwarder.Backend.BasicStation.TimesyncInterval = utils.Ptr(time.Hour)
@@ -128,7 +136,79 @@ func getNetConfig(net string) *Config {
 		return &cfg
 	}
 
-	logrus.Fatalf("invalid net: %s, valid options are: main, test, dev and \"\"", net)
+	if net == "private" {
+		// private deployments don't use ThingsIX on-chain components or
+		// APIs, gateways are registered in the local registry and data is
+		// only forwarded to the default routers from the configuration.
+		cfg.Forwarder.Gateways.Registry.Local = &gateway.RegistrySyncLocalConfig{}
+		cfg.Forwarder.Routers.ThingsIXApi = nil
+		cfg.Forwarder.Mapping.ThingsIXApi = nil
+		return &cfg
+	}
+
+	logrus.Fatalf("invalid net: %s, valid options are: main, test, dev, private and \"\"", net)
+	return nil
+}
+
+// configDecodeHook returns the hook that decodes config values into the
+// types used in Config.
+func configDecodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToSliceHookFunc(","),
+		utils.StringToEthereumAddressHook(),
+		utils.IntToBigIntHook(),
+		utils.HexStringToBigIntHook(),
+		utils.StringToHashHook(),
+		utils.StringToDuration(),
+		utils.StringToLogrusLevel())
+}
+
+// prepareDefaultRouters sets the Default flag on the default routers to
+// distinct them from routes loaded from ThingsIX and validates them.
+func prepareDefaultRouters(routers []*Router) error {
+	seen := make(map[string]bool, len(routers))
+	for _, r := range routers {
+		r.Default = true
+		for i, region := range r.Regions {
+			if err := r.Regions[i].UnmarshalText([]byte(region)); err != nil {
+				return fmt.Errorf("invalid region for default router %s: %w", r, err)
+			}
+		}
+		key := defaultRouteKey(r)
+		if seen[key] {
+			return fmt.Errorf("duplicate default router %s with endpoint %s", r.Name, r.Endpoint)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// reloadDefaultRoutes reads the configuration file again and applies the
+// default routers and the per route dial options, transforms, filters and
+// rate limits in it to the routing table. Default routers whose settings
+// changed are restarted, other routes use the new settings when they
+// reconnect. Other settings require a restart to take effect.
+func reloadDefaultRoutes(routingTable *RoutingTable) error {
+	if viper.ConfigFileUsed() == "" {
+		return fmt.Errorf("no config file loaded")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	var cfg ForwarderRoutersConfig
+	if err := viper.UnmarshalKey("forwarder.routers", &cfg, viper.DecodeHook(configDecodeHook())); err != nil {
+		return err
+	}
+	if err := prepareDefaultRouters(cfg.Default); err != nil {
+		return err
+	}
+	if viper.GetString("net") == "private" && len(cfg.Default) == 0 {
+		return fmt.Errorf("private network requires at least one default router")
+	}
+	if err := routingTable.SetRouteSettings(cfg); err != nil {
+		return err
+	}
+	routingTable.SetDefaultRoutes(cfg.Default)
 	return nil
 }
 
@@ -147,14 +227,7 @@ func mustLoadConfig(ignoreLogLevel bool) *Config {
 			logrus.WithError(err).WithField("file", configFile).Fatal("unable to read config")
 		}
 
-		if err := viper.Unmarshal(cfg, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
-			mapstructure.StringToSliceHookFunc(","),
-			utils.StringToEthereumAddressHook(),
-			utils.IntToBigIntHook(),
-			utils.HexStringToBigIntHook(),
-			utils.StringToHashHook(),
-			utils.StringToDuration(),
-			utils.StringToLogrusLevel()))); err != nil {
+		if err := viper.Unmarshal(cfg, viper.DecodeHook(configDecodeHook())); err != nil {
 			logrus.WithError(err).Fatal("unable to load configuration")
 		}
 	} else if net == "" {
@@ -162,11 +235,9 @@ func mustLoadConfig(ignoreLogLevel bool) *Config {
 	}
 
 	if !ignoreLogLevel {
-		logrus.SetLevel(cfg.Log.Level)
-		logrus.SetFormatter(&logrus.TextFormatter{
-			FullTimestamp:    true,
-			DisableTimestamp: !cfg.Log.Timestamp,
-		})
+		if err := applyLogConfig(cfg.Log); err != nil {
+			logrus.WithError(err).Fatal("invalid log configuration")
+		}
 	}
 
 	if defaultGatewayFreqPlan := viper.GetString("default_frequency_plan"); defaultGatewayFreqPlan != "" {
@@ -200,12 +271,30 @@ func mustLoadConfig(ignoreLogLevel bool) *Config {
 		logrus.Fatal("missing database postgresql configuration")
 	}
 
-	// set the Default flag on the defaultRouters to distinct them from routes
-	// loaded from ThingsIX
-	for _, r := range cfg.Forwarder.Routers.Default {
-		r.Default = true
+	if net == "private" {
+		if cfg.Forwarder.Routers.OnChain != nil || cfg.Forwarder.Gateways.Registry.OnChain != nil {
+			logrus.Fatal("on-chain routers and gateway registry are not available on the private network")
+		}
+		if len(cfg.Forwarder.Routers.Default) == 0 {
+			logrus.Fatal("private network requires at least one default router")
+		}
+	}
+
+	if err := prepareDefaultRouters(cfg.Forwarder.Routers.Default); err != nil {
+		logrus.WithError(err).Fatal("invalid default router")
+	}
+
+	if res := cfg.Forwarder.Metadata.H3Resolution; res != nil && (*res < 0 || *res > 15) {
+		logrus.Fatalf("invalid metadata h3 resolution %d, must be between 0 and 15", *res)
+	}
+
+	if res := cfg.Forwarder.CoverageGaps.Resolution; res != nil && (*res < 0 || *res > 15) {
+		logrus.Fatalf("invalid coverage gaps resolution %d, must be between 0 and 15", *res)
 	}
 
+	// set initial feature flag states, these can be changed at runtime
+	features.Configure(cfg.Forwarder.Features)
+
 	// work-around to prevent circular dependencies
 	if cfg.BlockChain.Polygon != nil && cfg.Forwarder.Gateways.Registry.OnChain != nil {
 		cfg.Forwarder.Gateways.Registry.OnChain.Endpoint = cfg.BlockChain.Polygon.Endpoint
@@ -21,6 +21,8 @@ import (
 
 	"github.com/ThingsIXFoundation/packet-handling/database"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/objectstore"
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/sirupsen/logrus"
 )
@@ -43,9 +45,39 @@ type BasicStationBackendConfig struct {
 	Region           string         `mapstructure:"region"`
 }
 
+// ForwarderBackendMQTTConfig configures the backend for gateways that
+// publish to an MQTT broker through the ChirpStack Gateway Bridge.
+type ForwarderBackendMQTTConfig struct {
+	// Server is the broker address, e.g. tcp://localhost:1883 or
+	// ssl://broker:8883
+	Server string `mapstructure:"server"`
+	// Servers are additional broker addresses
+	Servers  []string `mapstructure:"servers"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	// ClientID defaults to thingsix-forwarder-<hostname>
+	ClientID string `mapstructure:"client_id"`
+	CACert   string `mapstructure:"ca_cert"`
+	TLSCert  string `mapstructure:"tls_cert"`
+	TLSKey   string `mapstructure:"tls_key"`
+	QOS      uint8  `mapstructure:"qos"`
+	// TopicPrefix is the prefix of the gateway topics, e.g. eu868
+	TopicPrefix string `mapstructure:"topic_prefix"`
+	// Marshaler is the encoding the gateway bridge uses, protobuf (default)
+	// or json
+	Marshaler string `mapstructure:"marshaler"`
+	// Timeout for subscribing and publishing, defaults to 10s
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
 type ForwarderBackendConfig struct {
+	// Enabled lists the backends that run simultaneously, e.g.
+	// [semtech_udp, basic_station]. If empty a single backend is selected
+	// from the configured backends.
+	Enabled       []string                          `mapstructure:"enabled"`
 	SemtechUDP    *ForwarderBackendSemtechUDPConfig `mapstructure:"semtech_udp"`
 	BasicStation  *BasicStationBackendConfig        `mapstructure:"basic_station"`
+	MQTT          *ForwarderBackendMQTTConfig       `mapstructure:"mqtt"`
 	Concentratord *struct{}                         `mapstructure:"concentratord"`
 }
 
@@ -53,6 +85,45 @@ type ForwarderHttpApiConfig struct {
 	Address string `mapstructure:"address"`
 }
 
+type ForwarderGatewayManagementConfig struct {
+	// Address the management API binds on
+	Address string `mapstructure:"address"`
+	// Tokens are the bearer tokens that are accepted
+	Tokens []string `mapstructure:"tokens"`
+	// TokensFile is a file with one accepted bearer token per line
+	TokensFile string `mapstructure:"tokens_file"`
+	// CertFile and KeyFile enable TLS when both are set
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+type ForwarderAdminConfig struct {
+	// Address the admin API binds on, it serves gRPC, gRPC-Web and REST
+	Address string `mapstructure:"address"`
+	// Tokens are the bearer tokens that are accepted
+	Tokens []string `mapstructure:"tokens"`
+	// TokensFile is a file with one accepted bearer token per line
+	TokensFile string `mapstructure:"tokens_file"`
+	// CertFile and KeyFile enable TLS when both are set
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+type ForwarderSiteConfig struct {
+	// ID identifies the site, gateways with the tag site:<id> are part of
+	// the site
+	ID string `mapstructure:"id"`
+	// Name is a human readable name for the site
+	Name string `mapstructure:"name"`
+	// Contact is who to contact about the site, e.g. an email address
+	Contact string `mapstructure:"contact"`
+	// Latitude and Longitude in degrees and Altitude in meters of the site,
+	// they apply to gateways of the site without their own location
+	Latitude  *float64 `mapstructure:"latitude"`
+	Longitude *float64 `mapstructure:"longitude"`
+	Altitude  *float64 `mapstructure:"altitude"`
+}
+
 type ForwarderGatewayConfig struct {
 	// BatchOnboarder configures the gateway batch onboarder smart contract plugin.
 	BatchOnboarder struct {
@@ -81,6 +152,16 @@ type ForwarderGatewayConfig struct {
 	// HttpAPI configures the private Forwarder HTTP API
 	HttpAPI ForwarderHttpApiConfig `mapstructure:"api"`
 
+	// Optional management API, if specified a token authenticated HTTP API
+	// to list, add and remove gateways in the store is served.
+	Management *ForwarderGatewayManagementConfig `mapstructure:"management"`
+
+	// Optional sites, if specified gateways tagged with site:<id> are
+	// grouped in the site with that id. Sites share their location with
+	// their gateways, are reported with aggregate stats and all gateways of
+	// a site can be enabled or disabled at once.
+	Sites []ForwarderSiteConfig `mapstructure:"sites"`
+
 	// ThingsIXOnboardEndpoint accepts gateway onboard messages for easy onboarding
 	ThingsIXOnboardEndpoint string
 }
@@ -101,9 +182,16 @@ type ForwarderRoutersThingsIXAPIConfig struct {
 }
 
 type ForwarderRoutersConfig struct {
-	// Default routers that will receive all gateway data unfiltered
+	// Default routers that will receive all gateway data unfiltered. They
+	// are applied at runtime when the configuration file changes, together
+	// with the transforms, filters, rate limits and dial options.
 	Default []*Router
 
+	// DrainPeriod is how long the connection with a default router that is
+	// removed from the configuration is kept to deliver downlinks that are
+	// underway, defaults to 10s
+	DrainPeriod *time.Duration `mapstructure:"drain_period"`
+
 	// OnChain idicates that ThingsIX routers are loaded from the router
 	// registry as deployed on the blockchain.
 	OnChain *ForwarderRoutersOnChainConfig `mapstructure:"on_chain"`
@@ -111,6 +199,176 @@ type ForwarderRoutersConfig struct {
 	// ThingsIXApi indicates when non-nil that router information must be
 	// fetched from the ThingsIX API
 	ThingsIXApi *ForwarderRoutersThingsIXAPIConfig `mapstructure:"thingsix_api"`
+
+	// SigningSchemes lists the signature schemes offered to routers in order
+	// of preference, defaults to all supported schemes
+	SigningSchemes []string `mapstructure:"signing_schemes"`
+
+	// StaleRouteTTL is how long a registered router can be unreachable
+	// before the forwarder stops connecting to it. It is retried when its
+	// registration changes. If not set unreachable routers are retried
+	// forever.
+	StaleRouteTTL *time.Duration `mapstructure:"stale_route_ttl"`
+
+	// Transforms modify the payload of uplinks before they are delivered to
+	// a route
+	Transforms []ForwarderRouteTransformConfig `mapstructure:"transforms"`
+
+	// Filters select the uplinks and join-requests that are delivered to a
+	// route
+	Filters []ForwarderRouteFilterConfig `mapstructure:"filters"`
+
+	// RateLimits limit the rate at which data uplinks are delivered to a
+	// route
+	RateLimits []ForwarderRouteRateLimitConfig `mapstructure:"rate_limits"`
+
+	// Bootstrap configures the embedded router set that is used until the
+	// ThingsIX routers are fetched for the first time
+	Bootstrap ForwarderRoutersBootstrapConfig `mapstructure:"bootstrap"`
+
+	// Dial overrides how the connection with a route is established, e.g.
+	// for routers behind a shared ingress or private load balancer
+	Dial []ForwarderRouteDialConfig `mapstructure:"dial"`
+
+	// Optional resolver, if specified router endpoints are resolved by the
+	// forwarder and cached instead of resolved on each connection attempt
+	Resolver *ForwarderRoutersResolverConfig `mapstructure:"resolver"`
+
+	// Discovery lists DNS SRV records through which default routers are
+	// discovered, e.g. for private deployments without ThingsIX registration
+	Discovery []ForwarderRouteDiscoveryConfig `mapstructure:"discovery"`
+}
+
+type ForwarderRouteDiscoveryConfig struct {
+	// Name of the SRV records that point to the router endpoints, e.g.
+	// _thingsix-router._tcp.example.com. An optional TXT record with the
+	// same name holds router attributes as space separated key=value
+	// pairs.
+	Name string `mapstructure:"name"`
+	// Interval at which the records are resolved again, defaults to 5m
+	Interval *time.Duration `mapstructure:"interval"`
+	// GracePeriod is how long the connection with the previous endpoint is
+	// kept when the records point to another endpoint while the connection
+	// with the new endpoint is established, defaults to 1m
+	GracePeriod *time.Duration `mapstructure:"grace_period"`
+}
+
+type ForwarderRoutersResolverConfig struct {
+	// Nameservers are queried in order until one answers, defaults to the
+	// system resolver
+	Nameservers []string `mapstructure:"nameservers"`
+	// MinTTL is the minimum time resolved addresses are cached, defaults to
+	// 30s
+	MinTTL *time.Duration `mapstructure:"min_ttl"`
+	// MaxTTL is the maximum time resolved addresses are cached, defaults to
+	// 1h
+	MaxTTL *time.Duration `mapstructure:"max_ttl"`
+	// StaleTTL is how long the last resolved addresses are used when
+	// resolving fails, defaults to 24h
+	StaleTTL *time.Duration `mapstructure:"stale_ttl"`
+	// Timeout is the maximum time of a single query, defaults to 2s
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+type ForwarderRouteDialConfig struct {
+	// Route is the name or ThingsIX id of the route, * applies to all
+	// routes without their own dial options
+	Route string `mapstructure:"route"`
+	// TLS connects to the router with TLS instead of plain text
+	TLS bool `mapstructure:"tls"`
+	// ServerName overrides the TLS server name (SNI) and the name the
+	// router certificate is verified against, requires TLS
+	ServerName string `mapstructure:"server_name"`
+	// CACert is a file with the CA certificates the router certificate is
+	// verified against, defaults to the system roots
+	CACert string `mapstructure:"ca_cert"`
+	// InsecureSkipVerify disables verification of the router certificate
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+	// ClientCert and ClientKey are files with the certificate and key the
+	// forwarder authenticates with to the router (mutual TLS), requires TLS.
+	// The files are loaded again when they change.
+	ClientCert string `mapstructure:"client_cert"`
+	ClientKey  string `mapstructure:"client_key"`
+	// SPIFFEIDs, if set, the router certificate must have one of these
+	// SPIFFE IDs as URI SAN, e.g. spiffe://example.com/router. The router
+	// certificate is verified against CACert but not against its host name.
+	SPIFFEIDs []string `mapstructure:"spiffe_ids"`
+	// Authority overrides the :authority header, defaults to the endpoint
+	Authority string `mapstructure:"authority"`
+	// Address is dialed instead of the endpoint, the endpoint is still
+	// used for the authority and SNI
+	Address string `mapstructure:"address"`
+	// ConnectTimeout is the maximum time to establish the connection,
+	// defaults to 30s
+	ConnectTimeout *time.Duration `mapstructure:"connect_timeout"`
+	// KeepaliveInterval is the interval between keepalive pings, defaults
+	// to 20s
+	KeepaliveInterval *time.Duration `mapstructure:"keepalive_interval"`
+	// KeepaliveTimeout is the time to wait for a keepalive ping ack,
+	// defaults to 5s
+	KeepaliveTimeout *time.Duration `mapstructure:"keepalive_timeout"`
+}
+
+type ForwarderRoutersBootstrapConfig struct {
+	// Disabled prevents using the embedded router set
+	Disabled bool `mapstructure:"disabled"`
+	// PublicKey is the hex encoded Ed25519 key the embedded router set must
+	// be signed with, defaults to the release signing key
+	PublicKey string `mapstructure:"public_key"`
+	// MaxAge is the maximum age of the embedded router set, older sets are
+	// not used. Defaults to 90 days.
+	MaxAge *time.Duration `mapstructure:"max_age"`
+}
+
+type ForwarderRouteTransformConfig struct {
+	// Route is the name of the route the transform applies to, * for all
+	// routes without their own transform
+	Route string `mapstructure:"route"`
+	// StripPayload removes the FPort and FRMPayload from data uplinks
+	StripPayload bool `mapstructure:"strip_payload"`
+	// MaxPayloadSize truncates FRMPayloads that are larger than this number
+	// of bytes
+	MaxPayloadSize *int `mapstructure:"max_payload_size"`
+}
+
+type ForwarderRouteFilterConfig struct {
+	// Route is the name or ThingsIX id of the route the filter applies to,
+	// * for all routes without their own filter
+	Route string `mapstructure:"route"`
+	// Allow lists the frames that are delivered, if empty all frames that
+	// are not denied are delivered
+	Allow ForwarderFilterRulesConfig `mapstructure:"allow"`
+	// Deny lists the frames that are dropped, deny takes precedence over
+	// allow
+	Deny ForwarderFilterRulesConfig `mapstructure:"deny"`
+}
+
+type ForwarderRouteRateLimitConfig struct {
+	// Route is the name or ThingsIX id of the route, * applies to all
+	// routes without their own rate limit
+	Route string `mapstructure:"route"`
+	// Rate is the number of data uplinks per second delivered to the route
+	Rate float64 `mapstructure:"rate"`
+	// Burst is the number of data uplinks that can be delivered at once,
+	// defaults to rate
+	Burst *int `mapstructure:"burst"`
+	// Queue is the maximum number of data uplinks per device waiting to be
+	// delivered, defaults to 8
+	Queue *int `mapstructure:"queue"`
+	// MaxDelay is how long a data uplink can wait before it is dropped,
+	// defaults to 1s
+	MaxDelay *time.Duration `mapstructure:"max_delay"`
+}
+
+type ForwarderFilterRulesConfig struct {
+	// NetIDs match data uplinks with a DevAddr of one of these NetIDs
+	NetIDs []string `mapstructure:"net_ids"`
+	// DevAddrPrefixes match data uplinks with a DevAddr in one of these
+	// prefixes, e.g. 26000000/7
+	DevAddrPrefixes []string `mapstructure:"dev_addr_prefixes"`
+	// JoinEUIs match join-requests with a JoinEUI in one of these ranges,
+	// either a single JoinEUI or <from>-<to>
+	JoinEUIs []string `mapstructure:"join_euis"`
 }
 
 type ForwarderMappingThingsIXAPIConfig struct {
@@ -123,6 +381,471 @@ type ForwarderMappingConfig struct {
 	ThingsIXApi *ForwarderMappingThingsIXAPIConfig `mapstructure:"thingsix_api"`
 }
 
+type ForwarderMetadataConfig struct {
+	// H3Resolution is the resolution of the H3 cell of the gateways
+	// registered location that is included in forwarded metadata and stats.
+	// If not set the resolution of the registered location is used.
+	H3Resolution *int `mapstructure:"h3_resolution"`
+
+	// Optional enrichment plugins that add context to the metadata.
+	Enrichment *ForwarderEnrichmentConfig `mapstructure:"enrichment"`
+}
+
+type ForwarderEnrichmentConfig struct {
+	// Elevation adds the terrain elevation at the gateways registered
+	// location, read from a directory with SRTM .hgt tiles
+	Elevation *struct {
+		Directory string `mapstructure:"directory"`
+	} `mapstructure:"elevation"`
+}
+
+type ForwarderCoverageGapConfig struct {
+	// Interval determines the period a coverage gap report covers
+	Interval *time.Duration `mapstructure:"interval"`
+	// Resolution is the H3 resolution of cells in the report
+	Resolution *int `mapstructure:"resolution"`
+	// SNRMargin is the margin in dB above the demodulation floor under which
+	// a packet is considered marginally received
+	SNRMargin *float64 `mapstructure:"snr_margin"`
+}
+
+type ForwarderUplinkCRCConfig struct {
+	// BadCRC is the policy (drop, forward, mapping) for uplinks that failed
+	// the CRC check, defaults to drop
+	BadCRC *string `mapstructure:"bad_crc"`
+	// NoCRC is the policy (drop, forward, mapping) for uplinks received
+	// without CRC, defaults to drop
+	NoCRC *string `mapstructure:"no_crc"`
+}
+
+type ForwarderUplinkMetadataConfig struct {
+	// SNRPrecision is the precision in dB to which the SNR of uplinks is
+	// rounded, 0 to keep the reported SNR, defaults to 0.1
+	SNRPrecision *float64 `mapstructure:"snr_precision"`
+	// FrequencyStep is the step in Hz to which the frequency of uplinks is
+	// rounded, defaults to 1
+	FrequencyStep *uint32 `mapstructure:"frequency_step"`
+}
+
+type ForwarderDownlinkSchedulerConfig struct {
+	// Capacity is the maximum number of in-flight downlinks per gateway
+	Capacity *int `mapstructure:"capacity"`
+	// MulticastReserved is the part of the capacity that is reserved for
+	// multicast sessions while a session is active on the gateway
+	MulticastReserved *int `mapstructure:"multicast_reserved"`
+	// ValidateRXWindows rejects downlinks that are scheduled outside the
+	// class A receive windows or would arrive at the gateway too late
+	ValidateRXWindows bool `mapstructure:"validate_rx_windows"`
+	// TxMargin is the time needed to get a downlink to the gateway before
+	// its receive window opens, defaults to 50ms
+	TxMargin *time.Duration `mapstructure:"tx_margin"`
+	// DutyCycle tracks the duty cycle per gateway and rejects downlinks that
+	// exceed the regional limit
+	DutyCycle bool `mapstructure:"duty_cycle"`
+	// DutyCycleWindow is the period over which the duty cycle is tracked,
+	// defaults to 1h
+	DutyCycleWindow *time.Duration `mapstructure:"duty_cycle_window"`
+}
+
+type ForwarderUplinkLanesConfig struct {
+	// Workers is the number of workers that process data uplinks
+	Workers *int `mapstructure:"workers"`
+	// Queue is the maximum number of data uplinks waiting for a worker
+	Queue *int `mapstructure:"queue"`
+	// JoinWorkers is the number of workers dedicated to join-requests
+	JoinWorkers *int `mapstructure:"join_workers"`
+	// JoinQueue is the maximum number of join-requests waiting for a worker
+	JoinQueue *int `mapstructure:"join_queue"`
+}
+
+type ForwarderSLOConfig struct {
+	// UplinkDeliveryTarget is the objective for the ratio of uplinks that
+	// are delivered to routers that are interested in them
+	UplinkDeliveryTarget *float64 `mapstructure:"uplink_delivery_target"`
+	// DownlinkOnTimeTarget is the objective for the ratio of downlinks that
+	// gateways transmitted
+	DownlinkOnTimeTarget *float64 `mapstructure:"downlink_on_time_target"`
+	// Latency holds uplink delivery latency objectives per route
+	Latency []ForwarderRouteLatencySLOConfig `mapstructure:"latency"`
+}
+
+type ForwarderRouteLatencySLOConfig struct {
+	// Route is the name of the route the objective applies to, * for all
+	// routes without their own objective
+	Route string `mapstructure:"route"`
+	// P95 is the maximum p95 latency between receiving an uplink from a
+	// gateway and delivering it to the router
+	P95 time.Duration `mapstructure:"p95"`
+	// For is how long the p95 latency must exceed the threshold before an
+	// alert is raised, defaults to 5m
+	For *time.Duration `mapstructure:"for"`
+}
+
+type ForwarderDownlinkStatsConfig struct {
+	// MaxDevices is the number of devices (DevAddr) that are tracked, the
+	// least recently active devices are dropped first, defaults to 10000
+	MaxDevices *int `mapstructure:"max_devices"`
+	// MinDownlinks is the number of downlinks a device must have through a
+	// gateway before it can be marked as failing, defaults to 10
+	MinDownlinks *int `mapstructure:"min_downlinks"`
+	// FailureThreshold is the ratio of failed downlinks above which a device
+	// is marked as failing through a gateway, defaults to 0.5
+	FailureThreshold *float64 `mapstructure:"failure_threshold"`
+}
+
+type ForwarderClockDriftConfig struct {
+	// Window is the period over which the uplink with the lowest latency is
+	// selected, the drift is estimated between consecutive windows, defaults
+	// to 10m
+	Window *time.Duration `mapstructure:"window"`
+	// MaxDrift is the largest drift in ppm that is accepted, larger
+	// estimates are considered a concentrator restart, defaults to 500
+	MaxDrift *float64 `mapstructure:"max_drift"`
+}
+
+type ForwarderPseudonymizationConfig struct {
+	// Method used to pseudonymize identifiers, only hmac-sha256 (default)
+	// is supported
+	Method string `mapstructure:"method"`
+	// Key is the secret HMAC key, at least 16 bytes
+	Key string `mapstructure:"key"`
+	// KeyFile is a file with the HMAC key, takes precedence over Key
+	KeyFile string `mapstructure:"key_file"`
+	// Logs pseudonymizes the DevAddr and DevEUI in packet logs
+	Logs bool `mapstructure:"logs"`
+	// Analytics pseudonymizes the DevAddr and DevEUI in analytics exports
+	Analytics bool `mapstructure:"analytics"`
+}
+
+type ForwarderGossipConfig struct {
+	// Address the gossip socket binds to, e.g. 0.0.0.0:1690
+	Address string `mapstructure:"address"`
+	// Peers are the gossip addresses of the other forwarders at the site
+	Peers []string `mapstructure:"peers"`
+	// Key is the shared secret gossip messages are authenticated with, at
+	// least 16 bytes
+	Key string `mapstructure:"key"`
+	// KeyFile is a file with the shared secret, takes precedence over Key
+	KeyFile string `mapstructure:"key_file"`
+	// ID identifies this forwarder among its peers, defaults to the hostname
+	ID string `mapstructure:"id"`
+	// Window is how long uplinks are held for peers to report a better copy,
+	// defaults to 50ms
+	Window *time.Duration `mapstructure:"window"`
+}
+
+type ForwarderComplianceHoldConfig struct {
+	// Directory the sealed export files and the audit log are written to, it
+	// must only be accessible by the forwarder
+	Directory string `mapstructure:"directory"`
+	// RecipientKey is the hex encoded X25519 public key records are sealed
+	// with, generate it with 'forwarder compliance-hold keygen'
+	RecipientKey string `mapstructure:"recipient_key"`
+	// Holds are the DevAddr ranges for which packets are exported
+	Holds []ForwarderComplianceHoldRangeConfig `mapstructure:"holds"`
+}
+
+type ForwarderComplianceHoldRangeConfig struct {
+	// Reference identifies the order the hold is based on, it is included
+	// in exported records and the audit log
+	Reference string `mapstructure:"reference"`
+	// DevAddrs is the DevAddr range in the form <prefix>/<bits>, e.g.
+	// 26011000/24
+	DevAddrs string `mapstructure:"dev_addrs"`
+	// Expires is the RFC3339 time after which the hold no longer applies
+	Expires string `mapstructure:"expires"`
+}
+
+type ForwarderAlertsConfig struct {
+	// Webhooks are the URLs alerts are POSTed to when they fire or resolve
+	Webhooks []string `mapstructure:"webhooks"`
+	// Timeout for a single webhook request, defaults to 10s
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+type ForwarderSFCongestionConfig struct {
+	// Window is the period over which airtime is summed, defaults to 1h
+	Window *time.Duration `mapstructure:"window"`
+	// Threshold is the share of airtime used by SF11 and SF12 uplinks above
+	// which an advisory is raised, defaults to 0.5
+	Threshold *float64 `mapstructure:"threshold"`
+	// MinAirtime is the minimal airtime a gateway must have received in the
+	// window before it is evaluated, defaults to 1m
+	MinAirtime *time.Duration `mapstructure:"min_airtime"`
+}
+
+type ForwarderFCntAnomalyConfig struct {
+	// MaxJump is the largest expected frame counter increase between two
+	// uplinks of a device, defaults to 1000
+	MaxJump *int `mapstructure:"max_jump"`
+	// MaxDevices limits the number of DevAddrs tracked, defaults to 10000
+	MaxDevices *int `mapstructure:"max_devices"`
+	// Retention is how long a DevAddr is tracked after its last uplink,
+	// defaults to 24h
+	Retention *time.Duration `mapstructure:"retention"`
+	// Window is the period over which anomalies are counted, defaults to 1h
+	Window *time.Duration `mapstructure:"window"`
+	// Threshold is the number of anomalies a gateway must observe in the
+	// window before an alert is raised, defaults to 10
+	Threshold *int `mapstructure:"threshold"`
+}
+
+type ForwarderClockCheckConfig struct {
+	// Servers are the NTP servers the host clock is compared against, the
+	// first server that answers is used, defaults to pool.ntp.org
+	Servers []string `mapstructure:"servers"`
+	// Interval between checks, the first check is at startup, defaults to
+	// 15m
+	Interval *time.Duration `mapstructure:"interval"`
+	// Threshold is the maximum offset of the host clock, when exceeded
+	// downlinks scheduled at GPS time are refused, defaults to 100ms
+	Threshold *time.Duration `mapstructure:"threshold"`
+	// Timeout of a single NTP request, defaults to 5s
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+type ForwarderTelemetryConfig struct {
+	// TemperatureKeys are the stats metadata keys that hold the temperature
+	// in degree Celsius, the first key that holds a number is used
+	TemperatureKeys []string `mapstructure:"temperature_keys"`
+	// VoltageKeys are the stats metadata keys that hold the supply voltage
+	VoltageKeys []string `mapstructure:"voltage_keys"`
+	// TemperatureWarning is the temperature at which a warning is raised,
+	// defaults to 70
+	TemperatureWarning *float64 `mapstructure:"temperature_warning"`
+	// TemperatureCritical is the temperature at which the alert becomes
+	// critical, defaults to 85
+	TemperatureCritical *float64 `mapstructure:"temperature_critical"`
+	// VoltageMin raises an alert when the supply voltage drops below it
+	VoltageMin *float64 `mapstructure:"voltage_min"`
+	// VoltageMax raises an alert when the supply voltage exceeds it
+	VoltageMax *float64 `mapstructure:"voltage_max"`
+	// Expire is how long a reading is kept after the last stats with
+	// telemetry, defaults to 1h
+	Expire *time.Duration `mapstructure:"expire"`
+}
+
+type ForwarderCoverageProofsConfig struct {
+	// Interval is the period a signed statistics summary covers, defaults
+	// to 1h
+	Interval *time.Duration `mapstructure:"interval"`
+	// Scheme is the signature scheme (secp256k1, ed25519) the summary is
+	// signed with, defaults to secp256k1
+	Scheme *string `mapstructure:"scheme"`
+	// Deliver sends signed summaries to the coverage mapping service of the
+	// region the gateway is located in
+	Deliver bool `mapstructure:"deliver"`
+}
+
+type ForwarderDeduplicationConfig struct {
+	// Window is how long copies of a frame from other gateways are awaited
+	// before the best copy is forwarded, defaults to 200ms
+	Window *time.Duration `mapstructure:"window"`
+	// History is how long delivered frames are remembered, later copies are
+	// dropped. Defaults to 1m with a cache file and disabled without.
+	History *time.Duration `mapstructure:"history"`
+	// CacheFile stores the delivered frames so they are remembered across
+	// restarts
+	CacheFile string `mapstructure:"cache_file"`
+	// CacheSize is the maximum number of remembered frames, defaults to 4096
+	CacheSize *int `mapstructure:"cache_size"`
+}
+
+type ForwarderRuntimeConfig struct {
+	// Preset applies the tuning for gateway or server class hosts, the
+	// other options override the preset
+	Preset string `mapstructure:"preset"`
+	// GCPercent is the GOGC value, the heap growth in percent that triggers
+	// a collection
+	GCPercent *int `mapstructure:"gc_percent"`
+	// MemoryLimit is the soft memory limit in bytes (GOMEMLIMIT)
+	MemoryLimit *int64 `mapstructure:"memory_limit"`
+	// Ballast is the size in bytes of a heap ballast that lowers the number
+	// of collections
+	Ballast *int64 `mapstructure:"ballast"`
+}
+
+type ForwarderUplinkBufferConfig struct {
+	// Directory the buffer segments are stored in
+	Directory string `mapstructure:"directory"`
+	// MaxSize is the maximum size of the buffer in bytes, the oldest
+	// uplinks are dropped when it is full, defaults to 64MiB
+	MaxSize *int64 `mapstructure:"max_size"`
+	// TTL is how long uplinks are kept, older uplinks are not replayed,
+	// defaults to 24h
+	TTL *time.Duration `mapstructure:"ttl"`
+}
+
+type ForwarderOnboardingWebhooksConfig struct {
+	// Webhooks are the URLs onboarding events are posted to
+	Webhooks []string `mapstructure:"webhooks"`
+	// Secret signs the payload with HMAC-SHA256 in the X-ThingsIX-Signature
+	// header, if empty payloads are not signed
+	Secret string `mapstructure:"secret"`
+	// Interval at which the onboarding state of the gateways in the store
+	// is checked, defaults to 1m
+	Interval *time.Duration `mapstructure:"interval"`
+	// Timeout for posting to a webhook, defaults to 10s
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+type ForwarderHeartbeatConfig struct {
+	// Endpoint is the URL of the ThingsIX monitoring service heartbeats are
+	// posted to
+	Endpoint string `mapstructure:"endpoint"`
+	// KeyFile holds the forwarder identity key heartbeats are signed with,
+	// a new key is generated when the file doesn't exist
+	KeyFile string `mapstructure:"key_file"`
+	// Interval at which heartbeats are sent, defaults to 5m
+	Interval *time.Duration `mapstructure:"interval"`
+	// LivenessWindow is how long a gateway is considered alive after its
+	// last uplink or stats, defaults to 3m
+	LivenessWindow *time.Duration `mapstructure:"liveness_window"`
+	// Timeout for posting a heartbeat, defaults to 10s
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+type ForwarderHealthConfig struct {
+	// MaxRegistrySyncLag is how long ago the gateway store may have last
+	// synced with the ThingsIX registry before the forwarder is reported
+	// not ready, defaults to 2h
+	MaxRegistrySyncLag *time.Duration `mapstructure:"max_registry_sync_lag"`
+}
+
+type ForwarderRegistryChangesConfig struct {
+	// Interval at which the gateway store is compared with the previous
+	// registrations, defaults to 1m
+	Interval *time.Duration `mapstructure:"interval"`
+	// AlertRetention is how long the alert for a change stays active,
+	// defaults to 24h
+	AlertRetention *time.Duration `mapstructure:"alert_retention"`
+}
+
+type ForwarderTxPowerConfig struct {
+	// Country is the ISO 3166-1 alpha-2 code of the profile that applies to
+	// gateways that have no country set in Gateways
+	Country string `mapstructure:"country"`
+	// Gateways maps gateway local ids to the country they are located in
+	Gateways map[string]string `mapstructure:"gateways"`
+	// Profiles add country profiles or override built-in profiles
+	Profiles map[string]ForwarderCountryProfileConfig `mapstructure:"profiles"`
+}
+
+type ForwarderCountryProfileConfig struct {
+	Channels []struct {
+		// MinFrequency is the lower bound of the channel in Hz
+		MinFrequency uint32 `mapstructure:"min_frequency"`
+		// MaxFrequency is the upper bound of the channel in Hz
+		MaxFrequency uint32 `mapstructure:"max_frequency"`
+		// MaxEIRP is the maximum transmit power in dBm EIRP
+		MaxEIRP int32 `mapstructure:"max_eirp"`
+	} `mapstructure:"channels"`
+}
+
+type ForwarderBandPlanConfig struct {
+	// ValidateUplinks drops uplinks outside the band plan of the gateway
+	ValidateUplinks bool `mapstructure:"validate_uplinks"`
+	// ValidateDownlinks drops downlinks outside the band plan of the
+	// gateway and caps their transmit power to the maximum EIRP
+	ValidateDownlinks bool `mapstructure:"validate_downlinks"`
+	// Plans add band plans or override the ranges of built-in plans
+	Plans map[string]ForwarderBandPlanProfileConfig `mapstructure:"plans"`
+}
+
+type ForwarderBandPlanProfileConfig struct {
+	// Uplink frequency ranges, defaults to the built-in ranges
+	Uplink []ForwarderBandPlanChannelConfig `mapstructure:"uplink"`
+	// Downlink frequency ranges, defaults to the built-in ranges
+	Downlink []ForwarderBandPlanChannelConfig `mapstructure:"downlink"`
+}
+
+type ForwarderBandPlanChannelConfig struct {
+	// MinFrequency is the lower bound of the range in Hz
+	MinFrequency uint32 `mapstructure:"min_frequency"`
+	// MaxFrequency is the upper bound of the range in Hz
+	MaxFrequency uint32 `mapstructure:"max_frequency"`
+	// MaxEIRP is the maximum downlink transmit power in dBm EIRP, 0 for
+	// no limit
+	MaxEIRP int32 `mapstructure:"max_eirp"`
+}
+
+type ForwarderLeaderElectionConfig struct {
+	// LeaseName is the name of the Kubernetes lease replicas compete for
+	LeaseName string `mapstructure:"lease_name"`
+	// Namespace of the lease, defaults to the namespace of the pod
+	Namespace string `mapstructure:"namespace"`
+	// Identity of this replica, defaults to the hostname (pod name)
+	Identity string `mapstructure:"identity"`
+	// KubeAPI is the URL of an unauthenticated API server proxy, if empty
+	// the in-cluster service account is used
+	KubeAPI string `mapstructure:"kube_api"`
+	// LeaseDuration is how long followers wait before taking over
+	LeaseDuration *time.Duration `mapstructure:"lease_duration"`
+	// RenewDeadline is how long the leader keeps acting as leader without
+	// renewing the lease
+	RenewDeadline *time.Duration `mapstructure:"renew_deadline"`
+	// RetryPeriod is the interval between acquire/renew attempts
+	RetryPeriod *time.Duration `mapstructure:"retry_period"`
+	// LeaderAffinity confirms that the load balancer routes all gateways to
+	// the leader. Required for the semtech_udp and basic_station backends,
+	// their sessions are held by a single replica and downlinks for
+	// gateways connected to other replicas are dropped.
+	LeaderAffinity bool `mapstructure:"leader_affinity"`
+}
+
+type ForwarderAnalyticsConfig struct {
+	// SchemaVersion of the exported events, defaults to the latest version.
+	SchemaVersion int `mapstructure:"schema_version"`
+	// BatchSize is the maximum number of events per batch
+	BatchSize int `mapstructure:"batch_size"`
+	// FlushInterval is the maximum time events are batched
+	FlushInterval *time.Duration `mapstructure:"flush_interval"`
+
+	// Optional Parquet export, files are written to a local directory or
+	// object storage.
+	Parquet *struct {
+		// Directory files are written to if no object store is configured
+		Directory string `mapstructure:"directory"`
+		// Compression of Parquet files, gzip (default) or none
+		Compression string `mapstructure:"compression"`
+		// Prefix for object keys when files are stored in object storage
+		Prefix      string              `mapstructure:"prefix"`
+		ObjectStore *objectstore.Config `mapstructure:"object_store"`
+	} `mapstructure:"parquet"`
+
+	// Optional BigQuery export, events are streamed into an existing table.
+	BigQuery *struct {
+		Project string `mapstructure:"project"`
+		Dataset string `mapstructure:"dataset"`
+		Table   string `mapstructure:"table"`
+		// CredentialsFile is the service account key file
+		CredentialsFile string `mapstructure:"credentials_file"`
+	} `mapstructure:"bigquery"`
+
+	// Optional ClickHouse export, events are inserted into an existing
+	// table over the ClickHouse HTTP interface.
+	ClickHouse *struct {
+		// URL of the ClickHouse HTTP interface, e.g. http://localhost:8123
+		URL      string `mapstructure:"url"`
+		Database string `mapstructure:"database"`
+		Table    string `mapstructure:"table"`
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+		// QueueSize is the number of batches queued for insertion
+		QueueSize int `mapstructure:"queue_size"`
+		// MaxRetries is the number of retries before a batch is dropped
+		MaxRetries *int `mapstructure:"max_retries"`
+		// RetryBackoff is the initial delay between retries, it doubles
+		// after each retry
+		RetryBackoff *time.Duration `mapstructure:"retry_backoff"`
+	} `mapstructure:"clickhouse"`
+}
+
+type ForwarderHeatmapConfig struct {
+	// Retention determines how long hourly aggregates are kept
+	Retention *time.Duration `mapstructure:"retention"`
+}
+
 type ForwarderConfig struct {
 	// Backend holdsconfiguration related to the forwarders gateway
 	// endpoint and supported protocol.
@@ -135,6 +858,161 @@ type ForwarderConfig struct {
 
 	Mapping ForwarderMappingConfig
 
+	// Metadata holds configuration for the metadata that is added to
+	// uplinks forwarded to routers.
+	Metadata ForwarderMetadataConfig
+
+	// Heatmap holds configuration for the uplink/airtime aggregation that
+	// can be exported as GeoJSON.
+	Heatmap ForwarderHeatmapConfig
+
+	// CoverageGaps holds configuration for the coverage gap reports.
+	CoverageGaps ForwarderCoverageGapConfig `mapstructure:"coverage_gaps"`
+
+	// Features holds the initial state of feature flags by name, flags that
+	// are not set use their default.
+	Features map[string]bool
+
+	// UplinkCRC determines how uplinks without a valid CRC are handled.
+	UplinkCRC ForwarderUplinkCRCConfig `mapstructure:"uplink_crc"`
+
+	// UplinkMetadata determines how the radio metadata of uplinks is
+	// normalized.
+	UplinkMetadata ForwarderUplinkMetadataConfig `mapstructure:"uplink_metadata"`
+
+	// Optional uplink lanes, if specified received uplinks are processed by
+	// a bounded pool of workers and join-requests get their own queue and
+	// workers so they are not delayed by data uplinks.
+	UplinkLanes *ForwarderUplinkLanesConfig `mapstructure:"uplink_lanes"`
+
+	// Optional downlink scheduler, if specified the number of in-flight
+	// downlinks per gateway is limited and capacity is reserved for
+	// multicast sessions. It can also reject downlinks that miss their
+	// receive window or exceed the regional duty cycle.
+	DownlinkScheduler *ForwarderDownlinkSchedulerConfig `mapstructure:"downlink_scheduler"`
+
+	// Optional transmit power capping, if specified downlinks are checked
+	// against the regulatory profile of the country the gateway is located
+	// in. The transmit power is lowered to the maximum EIRP and downlinks on
+	// frequencies that are not allowed are dropped.
+	TxPower *ForwarderTxPowerConfig `mapstructure:"tx_power"`
+
+	// Optional band plan validation, if specified uplinks and downlinks are
+	// checked against the regional band plan of the gateway. This is the
+	// band registered for the gateway, the band plan in the gateway metadata
+	// or the default frequency plan. Uplinks on frequencies or data rates
+	// outside the plan are dropped, downlinks are dropped or their transmit
+	// power is lowered to the maximum EIRP of the plan.
+	BandPlan *ForwarderBandPlanConfig `mapstructure:"band_plan"`
+
+	// Optional clock drift compensation, if specified the concentrator
+	// clock drift of gateways is estimated from uplinks and the delay of
+	// downlinks that are scheduled relative to an uplink is adjusted.
+	ClockDrift *ForwarderClockDriftConfig `mapstructure:"clock_drift"`
+
+	// Optional SLO reporting, if specified delivery SLIs and error budget
+	// burn rates are calculated per router and gateway.
+	SLO *ForwarderSLOConfig `mapstructure:"slo"`
+
+	// Optional downlink statistics, if specified downlink results are
+	// tracked per device and gateway.
+	DownlinkStats *ForwarderDownlinkStatsConfig `mapstructure:"downlink_stats"`
+
+	// Optional alerting, alerts are available through the HTTP API and
+	// if webhooks are configured they are POSTed to them.
+	Alerts *ForwarderAlertsConfig `mapstructure:"alerts"`
+
+	// Optional SF congestion detection, if specified advisories are raised
+	// for gateways where most airtime is used by SF11/SF12 uplinks.
+	SFCongestion *ForwarderSFCongestionConfig `mapstructure:"sf_congestion"`
+
+	// Optional frame counter anomaly detection, if specified the frame
+	// counters of data uplinks are tracked per DevAddr and resets and large
+	// jumps are counted and raise alerts.
+	FCntAnomalies *ForwarderFCntAnomalyConfig `mapstructure:"fcnt_anomalies"`
+
+	// Optional host clock check, if specified the host clock is compared
+	// against NTP at startup and periodically. An alert is raised and
+	// downlinks scheduled at GPS time are refused when it is off by more
+	// than the threshold.
+	ClockCheck *ForwarderClockCheckConfig `mapstructure:"clock_check"`
+
+	// Optional gateway telemetry, if specified the temperature and supply
+	// voltage that gateways report in their stats are tracked and alerts are
+	// raised when they cross thresholds.
+	Telemetry *ForwarderTelemetryConfig `mapstructure:"telemetry"`
+
+	// Optional registry change tracking, if specified alerts are raised when
+	// gateways in the store are transferred, updated or offboarded.
+	RegistryChanges *ForwarderRegistryChangesConfig `mapstructure:"registry_changes"`
+
+	// Optional uplink deduplication, if specified copies of a frame that are
+	// received by several gateways within the window are collapsed into a
+	// single delivery of the best copy that lists all receptions.
+	Deduplication *ForwarderDeduplicationConfig `mapstructure:"deduplication"`
+
+	// Optional store-and-forward buffer, if specified data uplinks are
+	// written to disk while no router is reachable and replayed when
+	// connectivity returns.
+	UplinkBuffer *ForwarderUplinkBufferConfig `mapstructure:"uplink_buffer"`
+
+	// Optional onboarding webhooks, if specified an event is posted to the
+	// webhooks when a gateway in the store transitions between the pending,
+	// onboarded and details set onboarding states.
+	OnboardingWebhooks *ForwarderOnboardingWebhooksConfig `mapstructure:"onboarding_webhooks"`
+
+	// Optional heartbeat, if specified a signed heartbeat with the forwarder
+	// version and the liveness of its gateways is periodically posted to the
+	// ThingsIX monitoring endpoint. Nothing is sent without this section.
+	Heartbeat *ForwarderHeartbeatConfig `mapstructure:"heartbeat"`
+
+	// Optional health thresholds, /healthz and /readyz are always served on
+	// the HTTP API and metrics endpoint, this section only tunes when the
+	// forwarder is reported not ready.
+	Health *ForwarderHealthConfig `mapstructure:"health"`
+
+	// Optional gRPC admin API, if specified a token authenticated gRPC
+	// service to inspect connected gateways, routers and sites, manage
+	// router connections and sites, dump the config and flush buffers is
+	// served.
+	Admin *ForwarderAdminConfig `mapstructure:"admin"`
+
+	// Optional runtime tuning, if specified the garbage collector is tuned
+	// for the host and its pauses are exported as metrics.
+	Runtime *ForwarderRuntimeConfig `mapstructure:"runtime"`
+
+	// Optional leader election, if specified only the replica that holds
+	// the lease sends downlinks to gateways that are connected to it.
+	LeaderElection *ForwarderLeaderElectionConfig `mapstructure:"leader_election"`
+
+	// Optional join-accept cache, if specified the forwarder completes
+	// missing transmission parameters in join-accepts from routers.
+	JoinAcceptCache *struct{} `mapstructure:"join_accept_cache"`
+
+	// Optional analytics exporter, if specified packet events are exported
+	// to Parquet files, BigQuery and/or ClickHouse.
+	Analytics *ForwarderAnalyticsConfig `mapstructure:"analytics"`
+
+	// Optional pseudonymization of device identifiers, if specified the
+	// DevAddr and DevEUI in packet logs and/or analytics exports are
+	// replaced by a keyed hash. Routing is not affected.
+	Pseudonymization *ForwarderPseudonymizationConfig `mapstructure:"pseudonymization"`
+
+	// Optional compliance hold, if specified full packet records of devices
+	// in the configured DevAddr ranges are sealed and written to a
+	// dedicated export directory, separate from the normal logs.
+	ComplianceHold *ForwarderComplianceHoldConfig `mapstructure:"compliance_hold"`
+
+	// Optional gossip with forwarders at the same site, if specified the
+	// forwarders exchange the hashes of received frames and only the
+	// forwarder with the best copy of a frame forwards it.
+	Gossip *ForwarderGossipConfig `mapstructure:"gossip"`
+
+	// Optional coverage proofs, if specified a summary of the reception
+	// statistics of each gateway is periodically signed with the gateway
+	// key and made available to the coverage mapping service.
+	CoverageProofs *ForwarderCoverageProofsConfig `mapstructure:"coverage_proofs"`
+
 	// Optional account strategy configuration, if not specified no account is used meaning
 	// that all packets are exchanged between gateway and routers.
 	Accounting *struct{}
@@ -143,6 +1021,11 @@ type ForwarderConfig struct {
 type LogConfig struct {
 	Level     logrus.Level
 	Timestamp bool
+	// Format is either text (default) or json
+	Format string `mapstructure:"format"`
+	// Modules overrides the level for the given modules (backend, exchange,
+	// routing, accounting, onboarding, keystore, chain_sync)
+	Modules map[string]logrus.Level `mapstructure:"modules"`
 }
 
 type BlockchainPolygonConfig struct {
@@ -160,8 +1043,24 @@ type MetricsPrometheusConfig struct {
 	Path    string
 }
 
+// MetricsCardinalityConfig limits the number of series for metrics with
+// per-gateway labels.
+type MetricsCardinalityConfig struct {
+	// PerGateway enables per-gateway series, if false all gateways are
+	// aggregated in a single series
+	PerGateway bool `mapstructure:"per_gateway"`
+	// MaxGateways is the number of gateways that get their own series,
+	// 0 is unlimited
+	MaxGateways *int `mapstructure:"max_gateways"`
+	// Overflow determines what happens with gateways above MaxGateways,
+	// "aggregate" (default) adds them to a shared series, "drop" drops them
+	Overflow string `mapstructure:"overflow"`
+}
+
 type MetricsConfig struct {
 	Prometheus *MetricsPrometheusConfig
+	// Optional cardinality limits, if not specified gateways are aggregated
+	Cardinality *MetricsCardinalityConfig `mapstructure:"cardinality"`
 }
 
 type Config struct {
@@ -172,4 +1071,7 @@ type Config struct {
 		Postgresql *database.Config
 	}
 	Metrics *MetricsConfig
+	// Optional tracing, if specified spans for each packet are exported to
+	// an OpenTelemetry collector.
+	Tracing *tracing.Config `mapstructure:"tracing"`
 }
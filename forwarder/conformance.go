@@ -0,0 +1,564 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/airtime"
+	"github.com/ThingsIXFoundation/packet-handling/fixtures"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
+	"github.com/ThingsIXFoundation/router-api/go/router"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ConformancePassed indicates the router showed no protocol deviations
+	ConformancePassed = "passed"
+	// ConformanceFailed indicates at least one check found a deviation
+	ConformanceFailed = "failed"
+
+	// results of individual checks
+	conformancePass = "pass"
+	conformanceFail = "fail"
+	conformanceSkip = "skip"
+
+	defaultConformanceTimeout = 10 * time.Second
+	// defaultConformanceSettle is how long the stream must stay open after
+	// an event was sent for the router to have accepted it
+	defaultConformanceSettle = time.Second
+)
+
+// conformanceGatewayID is the local id of the generated gateway that sends
+// the scripted events.
+var conformanceGatewayID = lorawan.EUI64{0x00, 0x00, 'T', 'I', 'X', 'C', 'O', 'N'}
+
+// conformanceUnknownDownlinkID is acknowledged without the router having
+// sent a downlink with this id.
+const conformanceUnknownDownlinkID = 0xffffffff
+
+// ConformanceCheck is the result of a single conformance check.
+type ConformanceCheck struct {
+	Name    string `json:"name"`
+	Result  string `json:"result"`
+	Details string `json:"details,omitempty"`
+}
+
+// ConformanceReport is the outcome of a scripted exchange with a router. It
+// lists the protocol-level deviations of the router implementation.
+type ConformanceReport struct {
+	Router           string             `json:"router"`
+	GatewayNetworkID lorawan.EUI64      `json:"gatewayNetworkId"`
+	Status           string             `json:"status"`
+	Started          time.Time          `json:"started"`
+	Finished         time.Time          `json:"finished"`
+	Deviations       int                `json:"deviations"`
+	Checks           []ConformanceCheck `json:"checks,omitempty"`
+}
+
+// conformanceRun holds the state of a scripted exchange with a router.
+type conformanceRun struct {
+	endpoint string
+	dialOpts []grpc.DialOption
+	timeout  time.Duration
+	settle   time.Duration
+	schemes  []string
+	gw       *gateway.Gateway
+	region   frequency_plan.BandName
+
+	conn   *grpc.ClientConn
+	client router.RouterV1Client
+	stream router.RouterV1_EventsClient
+	cancel context.CancelFunc
+	events chan *router.RouterToGatewayEvent
+	closed chan error
+
+	// receipts is the number of airtime receipts the router received
+	receipts int
+	// payments is the number of airtime payments received from the router
+	payments int
+	// unsolicitedPayments counts payments received before any receipt
+	unsolicitedPayments int
+	// downlinks holds the downlinks received from the router
+	downlinks []*gw.DownlinkFrame
+
+	report ConformanceReport
+}
+
+// RunConformance runs a scripted exchange against the router at endpoint.
+// It performs the handshake, sends status events, uplinks, join-requests and
+// TX acks on behalf of a generated gateway and verifies the router responses
+// and its handling of invalid events. Each step is recorded as a check in
+// the returned report.
+func RunConformance(ctx context.Context, endpoint string, dialOpts []grpc.DialOption, timeout time.Duration) (ConformanceReport, error) {
+	gw, err := gateway.GenerateNewGateway(conformanceGatewayID)
+	if err != nil {
+		return ConformanceReport{}, fmt.Errorf("unable to generate gateway: %w", err)
+	}
+	if timeout <= 0 {
+		timeout = defaultConformanceTimeout
+	}
+
+	r := &conformanceRun{
+		endpoint: endpoint,
+		dialOpts: dialOpts,
+		timeout:  timeout,
+		settle:   defaultConformanceSettle,
+		schemes:  signing.Schemes(),
+		gw:       gw,
+		region:   frequency_plan.EU868,
+		report: ConformanceReport{
+			Router:           endpoint,
+			GatewayNetworkID: gw.NetworkID,
+			Started:          time.Now(),
+		},
+	}
+	defer r.close()
+
+	if r.checkHandshake(ctx) {
+		r.checkJoinFilter(ctx)
+		r.checkStatus(ctx)
+		r.checkUplink(ctx)
+		r.checkJoinRequest(ctx)
+		r.checkDownlink(ctx)
+		r.checkTxAck(ctx)
+		r.checkMissingGatewayInformation(ctx)
+		r.checkInvalidPayload(ctx)
+		r.checkUnknownDownlinkAck(ctx)
+		r.checkAccounting()
+	}
+
+	r.report.Finished = time.Now()
+	r.report.Status = ConformancePassed
+	if r.report.Deviations > 0 {
+		r.report.Status = ConformanceFailed
+	}
+	return r.report, nil
+}
+
+func (r *conformanceRun) record(name, result, details string, args ...interface{}) {
+	if len(args) > 0 {
+		details = fmt.Sprintf(details, args...)
+	}
+	if result == conformanceFail {
+		r.report.Deviations++
+	}
+	r.report.Checks = append(r.report.Checks, ConformanceCheck{Name: name, Result: result, Details: details})
+}
+
+// checkHandshake connects to the router, opens the event stream and verifies
+// the signature scheme the router selected.
+func (r *conformanceRun) checkHandshake(ctx context.Context) bool {
+	dialCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(dialCtx, r.endpoint, append(r.dialOpts, grpc.WithBlock())...)
+	if err != nil {
+		r.record("handshake", conformanceFail, "unable to connect: %v", err)
+		return false
+	}
+	r.conn = conn
+	r.client = router.NewRouterV1Client(conn)
+
+	if err := r.openStream(ctx); err != nil {
+		r.record("handshake", conformanceFail, "unable to open event stream: %v", err)
+		return false
+	}
+
+	header, err := r.stream.Header()
+	if err != nil {
+		r.record("handshake", conformanceFail, "no stream header received: %v", err)
+		return false
+	}
+	selected := header.Get(signingSchemeHeader)
+	if len(selected) == 0 {
+		r.record("handshake", conformanceSkip, "router selected no signature scheme, %s assumed", signing.Secp256k1)
+		return true
+	}
+	scheme, err := signing.Negotiate(r.schemes, selected)
+	if err != nil {
+		r.record("handshake", conformanceFail, "router selected %q, offered %s", strings.Join(selected, ","), strings.Join(r.schemes, ","))
+		return true
+	}
+	r.record("handshake", conformancePass, "signature scheme %s", scheme)
+	return true
+}
+
+// openStream opens a new event stream, events received on it are handled
+// while the run waits for the router.
+func (r *conformanceRun) openStream(ctx context.Context) error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	stream, err := r.client.Events(metadata.AppendToOutgoingContext(ctx,
+		signingSchemesHeader, strings.Join(r.schemes, ",")))
+	if err != nil {
+		return err
+	}
+
+	events, closed := make(chan *router.RouterToGatewayEvent, 64), make(chan error, 1)
+	go func() {
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				closed <- err
+				return
+			}
+			events <- event
+		}
+	}()
+	r.stream, r.events, r.closed = stream, events, closed
+	return nil
+}
+
+func (r *conformanceRun) close() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+}
+
+// wait handles events from the router for d or until until returns true. It
+// returns an error when the router closed the stream, the stream is reopened
+// so the remaining checks can continue.
+func (r *conformanceRun) wait(ctx context.Context, d time.Duration, until func() bool) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		if until != nil && until() {
+			return nil
+		}
+		select {
+		case event := <-r.events:
+			r.handle(event)
+		case err := <-r.closed:
+			if reopenErr := r.openStream(ctx); reopenErr != nil {
+				return fmt.Errorf("%v, unable to reopen stream: %v", err, reopenErr)
+			}
+			return err
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *conformanceRun) handle(event *router.RouterToGatewayEvent) {
+	if event.GetAirtimePaymentEvent() != nil {
+		if r.receipts == 0 {
+			r.unsolicitedPayments++
+		}
+		r.payments++
+	}
+	if downlink := event.GetDownlinkFrameEvent(); downlink != nil {
+		r.downlinks = append(r.downlinks, downlink.GetDownlinkFrame())
+	}
+}
+
+// send sends event and verifies the router keeps the stream open.
+func (r *conformanceRun) send(ctx context.Context, event *router.GatewayToRouterEvent) error {
+	if err := r.stream.Send(event); err != nil {
+		// the actual error is returned by Recv
+		if waitErr := r.wait(ctx, r.timeout, nil); waitErr != nil {
+			return waitErr
+		}
+		return err
+	}
+	// the router can pay as soon as it received the receipt
+	receipt := event.GetUplinkFrameEvent().GetAirtimeReceipt()
+	if receipt == nil {
+		receipt = event.GetDownlinkTXAckEvent().GetAirtimeReceipt()
+	}
+	if receipt.GetAirtime() > 0 {
+		r.receipts++
+	}
+	return r.wait(ctx, r.settle, nil)
+}
+
+func (r *conformanceRun) gatewayInformation() *router.GatewayInformation {
+	return &router.GatewayInformation{
+		PublicKey: r.gw.CompressedPubKeyBytes(),
+		Owner:     r.gw.OwnerBytes(),
+	}
+}
+
+// checkJoinFilter verifies the join filter the router returns can be decoded.
+func (r *conformanceRun) checkJoinFilter(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	resp, err := r.client.JoinFilter(ctx, &router.JoinFilterRequest{})
+	if err != nil {
+		r.record("join filter", conformanceFail, "request failed: %v", err)
+		return
+	}
+	switch filter := resp.GetJoinFilter(); {
+	case len(filter.GetRoaringBitmap()) > 0:
+		bitmap := roaring64.New()
+		if err := bitmap.UnmarshalBinary(filter.GetRoaringBitmap()); err != nil {
+			r.record("join filter", conformanceFail, "invalid roaring bitmap: %v", err)
+			return
+		}
+		r.record("join filter", conformancePass, "roaring bitmap with %d join EUIs", bitmap.GetCardinality())
+	case filter.GetXor8() != nil:
+		xor := filter.GetXor8()
+		if xor.GetBlocklength() == 0 || uint32(len(xor.GetFingerprints())) != 3*xor.GetBlocklength() {
+			r.record("join filter", conformanceFail, "xor8 filter with %d fingerprints and block length %d",
+				len(xor.GetFingerprints()), xor.GetBlocklength())
+			return
+		}
+		r.record("join filter", conformancePass, "xor8 filter with %d fingerprints", len(xor.GetFingerprints()))
+	default:
+		r.record("join filter", conformancePass, "empty filter, router accepts no join-requests")
+	}
+}
+
+// checkStatus sends the online status of the gateway.
+func (r *conformanceRun) checkStatus(ctx context.Context) {
+	err := r.send(ctx, &router.GatewayToRouterEvent{
+		GatewayInformation: r.gatewayInformation(),
+		Event: &router.GatewayToRouterEvent_StatusEvent{
+			StatusEvent: &router.StatusEvent{Online: true},
+		},
+	})
+	if err != nil {
+		r.record("status", conformanceFail, "router closed stream after online status: %v", err)
+		return
+	}
+	r.record("status", conformancePass, "online status accepted")
+}
+
+// sendFrame sends the fixture frame as uplink of the gateway.
+func (r *conformanceRun) sendFrame(ctx context.Context, frame fixtures.Frame) error {
+	uplink := frame.UplinkFrame(r.gw.NetworkID)
+	at, err := airtime.UplinkAirtime(uplink)
+	if err != nil {
+		return fmt.Errorf("unable to determine airtime: %w", err)
+	}
+	return r.send(ctx, &router.GatewayToRouterEvent{
+		GatewayInformation: r.gatewayInformation(),
+		Event: &router.GatewayToRouterEvent_UplinkFrameEvent{
+			UplinkFrameEvent: &router.UplinkFrameEvent{
+				UplinkFrame: uplink,
+				AirtimeReceipt: &router.AirtimeReceipt{
+					Owner:   r.gw.OwnerBytes(),
+					Airtime: uint32(at.Milliseconds()),
+				},
+			},
+		},
+	})
+}
+
+// checkUplink sends a data uplink.
+func (r *conformanceRun) checkUplink(ctx context.Context) {
+	uplinks := fixtures.Uplinks()
+	if len(uplinks) == 0 {
+		r.record("uplink", conformanceSkip, "no uplink fixtures")
+		return
+	}
+	if err := r.sendFrame(ctx, uplinks[0]); err != nil {
+		r.record("uplink", conformanceFail, "router closed stream after uplink %s: %v", uplinks[0].Name, err)
+		return
+	}
+	r.record("uplink", conformancePass, "uplink %s accepted", uplinks[0].Name)
+}
+
+// checkJoinRequest sends a join-request.
+func (r *conformanceRun) checkJoinRequest(ctx context.Context) {
+	joins := fixtures.JoinRequests()
+	if len(joins) == 0 {
+		r.record("join-request", conformanceSkip, "no join-request fixtures")
+		return
+	}
+	if err := r.sendFrame(ctx, joins[0]); err != nil {
+		r.record("join-request", conformanceFail, "router closed stream after join-request %s: %v", joins[0].Name, err)
+		return
+	}
+	r.record("join-request", conformancePass, "join-request %s accepted", joins[0].Name)
+}
+
+// checkDownlink waits for a downlink in reply to the uplinks and validates
+// the downlinks received so far.
+func (r *conformanceRun) checkDownlink(ctx context.Context) {
+	if err := r.wait(ctx, r.timeout, func() bool { return len(r.downlinks) > 0 }); err != nil {
+		r.record("downlink", conformanceFail, "router closed stream while waiting for downlink: %v", err)
+		return
+	}
+	if len(r.downlinks) == 0 {
+		r.record("downlink", conformanceSkip, "router sent no downlink within %s", r.timeout)
+		return
+	}
+	var deviations []string
+	for _, frame := range r.downlinks {
+		deviations = append(deviations, r.validateDownlink(frame)...)
+	}
+	if len(deviations) > 0 {
+		r.record("downlink", conformanceFail, strings.Join(deviations, ", "))
+		return
+	}
+	r.record("downlink", conformancePass, "%d downlink(s) valid", len(r.downlinks))
+}
+
+// validateDownlink returns the protocol deviations in frame.
+func (r *conformanceRun) validateDownlink(frame *gw.DownlinkFrame) []string {
+	var deviations []string
+	if frame.GetGatewayId() != r.gw.NetworkID.String() {
+		deviations = append(deviations, fmt.Sprintf("downlink for unknown gateway %q", frame.GetGatewayId()))
+	}
+	if frame.GetDownlinkId() == 0 {
+		deviations = append(deviations, "downlink without id")
+	}
+	if len(frame.GetItems()) == 0 {
+		deviations = append(deviations, fmt.Sprintf("downlink %d without items", frame.GetDownlinkId()))
+	}
+	for i, item := range frame.GetItems() {
+		switch {
+		case len(item.GetPhyPayload()) == 0:
+			deviations = append(deviations, fmt.Sprintf("downlink %d item %d without payload", frame.GetDownlinkId(), i))
+		case item.GetTxInfo().GetFrequency() == 0:
+			deviations = append(deviations, fmt.Sprintf("downlink %d item %d without frequency", frame.GetDownlinkId(), i))
+		case item.GetTxInfo().GetTiming() == nil:
+			deviations = append(deviations, fmt.Sprintf("downlink %d item %d without timing", frame.GetDownlinkId(), i))
+		}
+		if delay := item.GetTxInfo().GetTiming().GetDelay().GetDelay(); delay != nil {
+			if d := delay.AsDuration(); d < rxWindowMinDelay || d > rxWindowMaxDelay {
+				deviations = append(deviations, fmt.Sprintf("downlink %d item %d delay %s outside RX windows", frame.GetDownlinkId(), i, d))
+			}
+		}
+		if err := validateDownlinkSize(r.region, item); err != nil {
+			deviations = append(deviations, fmt.Sprintf("downlink %d item %d: %v", frame.GetDownlinkId(), i, err))
+		}
+	}
+	return deviations
+}
+
+// checkTxAck acknowledges the first downlink received from the router.
+func (r *conformanceRun) checkTxAck(ctx context.Context) {
+	if len(r.downlinks) == 0 {
+		r.record("tx ack", conformanceSkip, "no downlink to acknowledge")
+		return
+	}
+	frame := r.downlinks[0]
+	at, _ := airtime.DownlinkAirtime(frame)
+	if err := r.sendTxAck(ctx, frame.GetDownlinkId(), len(frame.GetItems()), at); err != nil {
+		r.record("tx ack", conformanceFail, "router closed stream after TX ack: %v", err)
+		return
+	}
+	r.record("tx ack", conformancePass, "TX ack for downlink %d accepted", frame.GetDownlinkId())
+}
+
+func (r *conformanceRun) sendTxAck(ctx context.Context, downlinkID uint32, items int, at time.Duration) error {
+	ack := &gw.DownlinkTxAck{
+		GatewayId:  r.gw.NetworkID.String(),
+		DownlinkId: downlinkID,
+	}
+	for i := 0; i < items; i++ {
+		status := gw.TxAckStatus_IGNORED
+		if i == 0 {
+			status = gw.TxAckStatus_OK
+		}
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: status})
+	}
+	return r.send(ctx, &router.GatewayToRouterEvent{
+		GatewayInformation: r.gatewayInformation(),
+		Event: &router.GatewayToRouterEvent_DownlinkTXAckEvent{
+			DownlinkTXAckEvent: &router.DownlinkTXAckEvent{
+				DownlinkTXAck: ack,
+				AirtimeReceipt: &router.AirtimeReceipt{
+					Owner:   r.gw.OwnerBytes(),
+					Airtime: uint32(at.Milliseconds()),
+				},
+			},
+		},
+	})
+}
+
+// checkMissingGatewayInformation sends an uplink without gateway information,
+// the router must ignore it without closing the stream.
+func (r *conformanceRun) checkMissingGatewayInformation(ctx context.Context) {
+	uplinks := fixtures.Uplinks()
+	if len(uplinks) == 0 {
+		r.record("missing gateway information", conformanceSkip, "no uplink fixtures")
+		return
+	}
+	err := r.send(ctx, &router.GatewayToRouterEvent{
+		Event: &router.GatewayToRouterEvent_UplinkFrameEvent{
+			UplinkFrameEvent: &router.UplinkFrameEvent{
+				UplinkFrame: uplinks[0].UplinkFrame(r.gw.NetworkID),
+			},
+		},
+	})
+	if err != nil {
+		r.record("missing gateway information", conformanceFail, "router closed stream: %v", err)
+		return
+	}
+	r.record("missing gateway information", conformancePass, "event ignored")
+}
+
+// checkInvalidPayload sends an uplink with a payload that is not a LoRaWAN
+// frame, the router must ignore it without closing the stream.
+func (r *conformanceRun) checkInvalidPayload(ctx context.Context) {
+	uplinks := fixtures.Uplinks()
+	if len(uplinks) == 0 {
+		r.record("invalid payload", conformanceSkip, "no uplink fixtures")
+		return
+	}
+	frame := uplinks[0]
+	frame.PHYPayload = []byte{byte(lorawan.UnconfirmedDataUp) << 5, 0x01}
+	if err := r.sendFrame(ctx, frame); err != nil {
+		r.record("invalid payload", conformanceFail, "router closed stream: %v", err)
+		return
+	}
+	r.record("invalid payload", conformancePass, "event ignored")
+}
+
+// checkUnknownDownlinkAck acknowledges a downlink the router never sent, the
+// router must ignore it without closing the stream.
+func (r *conformanceRun) checkUnknownDownlinkAck(ctx context.Context) {
+	if err := r.sendTxAck(ctx, conformanceUnknownDownlinkID, 1, 0); err != nil {
+		r.record("unknown TX ack", conformanceFail, "router closed stream: %v", err)
+		return
+	}
+	r.record("unknown TX ack", conformancePass, "TX ack for unknown downlink ignored")
+}
+
+// checkAccounting verifies the router only pays for delivered airtime
+// receipts.
+func (r *conformanceRun) checkAccounting() {
+	switch {
+	case r.unsolicitedPayments > 0:
+		r.record("accounting", conformanceFail, "%d airtime payment(s) before any airtime receipt", r.unsolicitedPayments)
+	case r.payments == 0:
+		r.record("accounting", conformanceSkip, "no airtime payments for %d airtime receipt(s)", r.receipts)
+	default:
+		r.record("accounting", conformancePass, "%d airtime payment(s) for %d airtime receipt(s)", r.payments, r.receipts)
+	}
+}
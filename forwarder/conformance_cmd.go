@@ -0,0 +1,115 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/logging"
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ConformanceCmd = &cobra.Command{
+		Use:   "conformance",
+		Short: "Check a router implementation against the ThingsIX router protocol",
+		Long: `Run a scripted exchange against a router and report protocol-level deviations.
+
+The forwarder connects on behalf of a generated gateway, performs the handshake
+and signature scheme negotiation, requests the join filter and sends a status
+event, a data uplink and a join-request. Downlinks the router sends in reply
+are validated and acknowledged. Airtime payments are checked against the
+airtime receipts the router received. The router must ignore invalid events
+such as events without gateway information, frames that are not LoRaWAN and
+acknowledgements for unknown downlinks without closing the event stream.
+
+With --json the report is printed in JSON format. The command exits with a
+non-zero status when a deviation was found.`,
+		Args: cobra.NoArgs,
+		Run:  runConformanceCmd,
+	}
+
+	conformanceDial    ForwarderRouteDialConfig
+	conformanceRouter  string
+	conformanceTimeout time.Duration
+	conformanceJSON    bool
+)
+
+func init() {
+	ConformanceCmd.Flags().StringVar(&conformanceRouter, "router", "", "endpoint of the router, host:port")
+	ConformanceCmd.Flags().DurationVar(&conformanceTimeout, "timeout", defaultConformanceTimeout, "maximum time to wait for the router in each check")
+	ConformanceCmd.Flags().BoolVar(&conformanceDial.TLS, "tls", false, "connect with TLS")
+	ConformanceCmd.Flags().StringVar(&conformanceDial.ServerName, "server-name", "", "TLS server name, defaults to the router host")
+	ConformanceCmd.Flags().StringVar(&conformanceDial.CACert, "ca-cert", "", "CA certificates to verify the router certificate, defaults to the system roots")
+	ConformanceCmd.Flags().BoolVar(&conformanceDial.InsecureSkipVerify, "insecure-skip-verify", false, "don't verify the router certificate")
+	ConformanceCmd.Flags().StringVar(&conformanceDial.ClientCert, "client-cert", "", "client certificate to authenticate with to the router")
+	ConformanceCmd.Flags().StringVar(&conformanceDial.ClientKey, "client-key", "", "key of the client certificate")
+	ConformanceCmd.Flags().StringSliceVar(&conformanceDial.SPIFFEIDs, "spiffe-id", nil, "SPIFFE ID the router certificate must have, can be repeated")
+	ConformanceCmd.Flags().StringVar(&conformanceDial.Authority, "authority", "", "override the :authority header")
+	ConformanceCmd.Flags().BoolVar(&conformanceJSON, "json", false, "Output in json format")
+	_ = ConformanceCmd.MarkFlagRequired("router")
+}
+
+func runConformanceCmd(cmd *cobra.Command, args []string) {
+	logging.SetDefaultLevel(logrus.ErrorLevel)
+
+	conformanceDial.Route = "*"
+	dial, err := newRouteDialOptions([]ForwarderRouteDialConfig{conformanceDial})
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid dial options")
+	}
+
+	if !conformanceJSON {
+		fmt.Printf("checking router %s\n", conformanceRouter)
+	}
+
+	report, err := RunConformance(context.Background(), conformanceRouter, dial[0].grpcDialOptions(), conformanceTimeout)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to run conformance checks")
+	}
+
+	if conformanceJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		printConformanceReport(report)
+	}
+
+	if report.Status != ConformancePassed {
+		os.Exit(1)
+	}
+}
+
+func printConformanceReport(report ConformanceReport) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Check", "Result", "Details"})
+	table.SetAutoWrapText(false)
+	for _, check := range report.Checks {
+		table.Append([]string{check.Name, strings.ToUpper(check.Result), check.Details})
+	}
+	table.Render()
+
+	fmt.Printf("router:     %s\ngateway:    %s\nstarted:    %s\nfinished:   %s\ndeviations: %d\nresult:     %s\n",
+		report.Router, report.GatewayNetworkID, report.Started.Format(time.RFC3339),
+		report.Finished.Format(time.RFC3339), report.Deviations, strings.ToUpper(report.Status))
+}
@@ -45,12 +45,15 @@ type CoverageClient struct {
 }
 
 func NewCoverageClient(cfg *Config) (*CoverageClient, error) {
-	return &CoverageClient{
-		indexMutex:           sync.RWMutex{},
-		index:                make(map[h3light.Cell]string),
-		indexEndpoint:        cfg.Forwarder.Mapping.ThingsIXApi.IndexEndpoint,
-		indexRefreshInterval: cfg.Forwarder.Mapping.ThingsIXApi.UpdateInterval,
-	}, nil
+	cc := &CoverageClient{
+		indexMutex: sync.RWMutex{},
+		index:      make(map[h3light.Cell]string),
+	}
+	if api := cfg.Forwarder.Mapping.ThingsIXApi; api != nil {
+		cc.indexEndpoint = api.IndexEndpoint
+		cc.indexRefreshInterval = api.UpdateInterval
+	}
+	return cc, nil
 }
 
 func (cc *CoverageClient) refreshCoverageMappingIndex() error {
@@ -92,6 +95,10 @@ func (cc *CoverageClient) refreshCoverageMappingIndex() error {
 }
 
 func (cc *CoverageClient) Run(ctx context.Context) {
+	if cc.indexEndpoint == nil {
+		logrus.Info("no coverage-mapping-index endpoint configured, mapping packets are not forwarded")
+		return
+	}
 	logrus.Info("coverage-mapping-index refresh started")
 	err := cc.refreshCoverageMappingIndex()
 	if err != nil {
@@ -196,3 +203,36 @@ func (cc *CoverageClient) DeliverDownlinkConfirmationPacketReceipt(ctx context.C
 	return nil
 
 }
+
+// DeliverSignedGatewayStats sends the signed gateway statistics to the
+// coverage-mapping-service of the given region.
+func (cc *CoverageClient) DeliverSignedGatewayStats(ctx context.Context, region h3light.Cell, stats *SignedGatewayStats) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	service := cc.getCoverageMappingServiceUrlForRegion(region)
+	if service == "" {
+		return fmt.Errorf("no coverage-mapping-service found for region: %s", region)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/mapping/gateway-stats", service), bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("received error from coverage-service: %s", string(body))
+	}
+
+	return nil
+}
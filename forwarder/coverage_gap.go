@@ -0,0 +1,315 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	h3light "github.com/ThingsIXFoundation/h3-light"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// coverageGapCollectWindow is how long receptions of the same packet by
+	// different gateways are collected before the packet is evaluated
+	coverageGapCollectWindow = 5 * time.Second
+)
+
+// loraDemodulationFloor is the minimal SNR (dB) at which a LoRa packet can be
+// demodulated per spreading factor.
+var loraDemodulationFloor = map[uint32]float64{
+	5:  -2.5,
+	6:  -5,
+	7:  -7.5,
+	8:  -10,
+	9:  -12.5,
+	10: -15,
+	11: -17.5,
+	12: -20,
+}
+
+// CoverageGapReporter keeps track per H3 cell how many packets were heard by
+// only a single gateway or with an SNR close to the demodulation floor. It
+// periodically turns these statistics in a report with cells that have weak
+// coverage to guide owners where to add gateways.
+//
+// Mapper packets are located on the mapper position, other uplinks are
+// located on the registered location of the receiving gateways.
+type CoverageGapReporter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	resolution int
+	snrMargin  float64
+	// pending holds packets that are still collecting receptions
+	pending map[[32]byte]*coverageObservation
+	// cells holds the statistics for the current report period
+	cells       map[h3light.Cell]*CoverageGapCell
+	periodStart time.Time
+	last        *CoverageGapReport
+}
+
+type coverageObservation struct {
+	firstSeen time.Time
+	cell      h3light.Cell
+	mapper    bool
+	gateways  map[lorawan.EUI64]struct{}
+	bestSNR   float64
+	floor     float64
+}
+
+// CoverageGapCell holds the coverage statistics for a single H3 cell.
+type CoverageGapCell struct {
+	Cell h3light.Cell `json:"h3"`
+	// Packets is the number of packets that originated in this cell
+	Packets uint64 `json:"packets"`
+	// MapperPackets is the number of mapper packets that originated in this cell
+	MapperPackets uint64 `json:"mapperPackets"`
+	// SingleGateway is the number of packets received by only 1 gateway
+	SingleGateway uint64 `json:"singleGateway"`
+	// MarginalSNR is the number of packets where the best SNR was within the
+	// margin of the demodulation floor
+	MarginalSNR uint64 `json:"marginalSnr"`
+	// Gateways is the number of distinct gateways that received packets
+	Gateways int `json:"gateways"`
+
+	gateways map[lorawan.EUI64]struct{}
+}
+
+// CoverageGapReport lists the cells with weak coverage over a period.
+type CoverageGapReport struct {
+	From  time.Time          `json:"from"`
+	To    time.Time          `json:"to"`
+	Cells []*CoverageGapCell `json:"cells"`
+}
+
+// NewCoverageGapReporter creates a reporter from the given cfg.
+func NewCoverageGapReporter(cfg ForwarderCoverageGapConfig) *CoverageGapReporter {
+	r := &CoverageGapReporter{
+		interval:    time.Hour,
+		resolution:  8,
+		snrMargin:   5,
+		pending:     make(map[[32]byte]*coverageObservation),
+		cells:       make(map[h3light.Cell]*CoverageGapCell),
+		periodStart: time.Now(),
+	}
+	if cfg.Interval != nil && *cfg.Interval > 0 {
+		r.interval = *cfg.Interval
+	}
+	if cfg.Resolution != nil {
+		r.resolution = *cfg.Resolution
+	}
+	if cfg.SNRMargin != nil {
+		r.snrMargin = *cfg.SNRMargin
+	}
+	return r
+}
+
+// ObserveUplink records that gw received the given frame. The packet is
+// located on the gateways registered location, frames from gateways without
+// a registered location are ignored.
+func (r *CoverageGapReporter) ObserveUplink(gw *gateway.Gateway, frame *gw.UplinkFrame) {
+	cell, ok := gatewayH3Cell(gw, r.resolution)
+	if !ok {
+		return
+	}
+	r.observe(frame, cell, gw.NetworkID, false)
+}
+
+// ObserveMapper records that gw received the given mapper frame that was sent
+// from the given location.
+func (r *CoverageGapReporter) ObserveMapper(gw *gateway.Gateway, frame *gw.UplinkFrame, lat, lon float64) {
+	r.observe(frame, h3light.LatLonToCell(lat, lon, r.resolution), gw.NetworkID, true)
+}
+
+func (r *CoverageGapReporter) observe(frame *gw.UplinkFrame, cell h3light.Cell, gatewayID lorawan.EUI64, mapper bool) {
+	var (
+		key   = sha256.Sum256(frame.GetPhyPayload())
+		snr   = float64(frame.GetRxInfo().GetSnr())
+		floor = loraDemodulationFloor[frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor()]
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	obs, ok := r.pending[key]
+	if !ok {
+		obs = &coverageObservation{
+			firstSeen: time.Now(),
+			cell:      cell,
+			gateways:  make(map[lorawan.EUI64]struct{}),
+			bestSNR:   snr,
+			floor:     floor,
+		}
+		r.pending[key] = obs
+	}
+	// a mapper packet has a more accurate location than the gateway location
+	if mapper && !obs.mapper {
+		obs.cell = cell
+		obs.mapper = true
+	}
+	if snr > obs.bestSNR {
+		obs.bestSNR = snr
+	}
+	obs.gateways[gatewayID] = struct{}{}
+}
+
+// Run evaluates collected packets and generates a report each interval until
+// the given ctx expires.
+func (r *CoverageGapReporter) Run(ctx context.Context) {
+	var (
+		evaluate = time.NewTicker(coverageGapCollectWindow)
+		report   = time.NewTicker(r.interval)
+	)
+	defer evaluate.Stop()
+	defer report.Stop()
+
+	for {
+		select {
+		case now := <-evaluate.C:
+			r.evaluate(now.Add(-coverageGapCollectWindow))
+		case now := <-report.C:
+			r.evaluate(now)
+			r.rotate(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluate moves packets that were first seen before the given deadline from
+// pending to the cell statistics.
+func (r *CoverageGapReporter) evaluate(deadline time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, obs := range r.pending {
+		if obs.firstSeen.After(deadline) {
+			continue
+		}
+		delete(r.pending, key)
+
+		stats, ok := r.cells[obs.cell]
+		if !ok {
+			stats = &CoverageGapCell{Cell: obs.cell, gateways: make(map[lorawan.EUI64]struct{})}
+			r.cells[obs.cell] = stats
+		}
+		stats.Packets++
+		if obs.mapper {
+			stats.MapperPackets++
+		}
+		if len(obs.gateways) == 1 {
+			stats.SingleGateway++
+		}
+		if obs.bestSNR < obs.floor+r.snrMargin {
+			stats.MarginalSNR++
+		}
+		for id := range obs.gateways {
+			stats.gateways[id] = struct{}{}
+		}
+	}
+}
+
+// rotate turns the statistics of the current period into a report and
+// starts a new period.
+func (r *CoverageGapReporter) rotate(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := r.report(now)
+	r.last = &report
+	r.cells = make(map[h3light.Cell]*CoverageGapCell)
+	r.periodStart = now
+
+	logrus.WithFields(logrus.Fields{
+		"cells": len(report.Cells),
+		"from":  report.From,
+		"to":    report.To,
+	}).Info("generated coverage gap report")
+}
+
+// report returns a report with cells that have packets that were only heard by
+// a single gateway or with a marginal SNR. The caller must hold the lock.
+func (r *CoverageGapReporter) report(now time.Time) CoverageGapReport {
+	report := CoverageGapReport{
+		From:  r.periodStart,
+		To:    now,
+		Cells: make([]*CoverageGapCell, 0),
+	}
+	for _, stats := range r.cells {
+		if stats.SingleGateway == 0 && stats.MarginalSNR == 0 {
+			continue
+		}
+		cell := *stats
+		cell.Gateways = len(stats.gateways)
+		cell.gateways = nil
+		report.Cells = append(report.Cells, &cell)
+	}
+
+	// cells with the largest share of weakly covered packets first
+	weak := func(c *CoverageGapCell) float64 {
+		return float64(c.SingleGateway+c.MarginalSNR) / float64(2*c.Packets)
+	}
+	sort.Slice(report.Cells, func(i, j int) bool {
+		wi, wj := weak(report.Cells[i]), weak(report.Cells[j])
+		if wi != wj {
+			return wi > wj
+		}
+		return report.Cells[i].Packets > report.Cells[j].Packets
+	})
+	return report
+}
+
+// Last returns the last generated report, or nil if none is generated yet.
+func (r *CoverageGapReporter) Last() *CoverageGapReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Current returns a report for the period that is in progress.
+func (r *CoverageGapReporter) Current() CoverageGapReport {
+	now := time.Now()
+	r.evaluate(now.Add(-coverageGapCollectWindow))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report(now)
+}
+
+// CoverageGaps returns the last coverage gap report. If the current query
+// parameter is set to true a report is returned for the period in progress.
+func (svc APIService) CoverageGaps(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("current") == "true" {
+		replyJSON(w, http.StatusOK, svc.coverageGaps.Current())
+		return
+	}
+
+	last := svc.coverageGaps.Last()
+	if last == nil {
+		http.Error(w, "no report generated yet", http.StatusNotFound)
+		return
+	}
+	replyJSON(w, http.StatusOK, last)
+}
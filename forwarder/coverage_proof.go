@@ -0,0 +1,400 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// coverageProofVersion is the version of the signed statistics format
+	coverageProofVersion = 1
+	// coverageProofMaxDevices limits the number of distinct devices that are
+	// tracked per gateway in a period
+	coverageProofMaxDevices = 10000
+)
+
+// SignalStats summarizes a signal quality measurement over a period.
+type SignalStats struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// GatewayStatsSummary summarizes the uplinks a gateway received over a
+// period. It is the message that is signed with the gateway key.
+type GatewayStatsSummary struct {
+	Version   int                `json:"version"`
+	GatewayID gateway.ThingsIxID `json:"gatewayId"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	// Uplinks is the number of uplinks with a valid CRC
+	Uplinks uint64 `json:"uplinks"`
+	// JoinRequests is the number of (re)join requests in Uplinks
+	JoinRequests uint64 `json:"joinRequests"`
+	// Devices is the number of distinct DevAddr and DevEUI's
+	Devices int `json:"devices"`
+	// Channels is the number of distinct frequencies uplinks were received on
+	Channels    int         `json:"channels"`
+	AirtimeMs   int64       `json:"airtimeMs"`
+	RSSI        SignalStats `json:"rssi"`
+	SNR         SignalStats `json:"snr"`
+	FirstUplink time.Time   `json:"firstUplink"`
+	LastUplink  time.Time   `json:"lastUplink"`
+}
+
+// SignedGatewayStats holds a gateway statistics summary and its signature.
+// The signature is calculated over Message, the JSON encoded Stats. Stats is
+// included for convenience, verifiers must use Message.
+type SignedGatewayStats struct {
+	Stats     GatewayStatsSummary `json:"stats"`
+	Message   hexutil.Bytes       `json:"message"`
+	Scheme    string              `json:"scheme"`
+	PublicKey hexutil.Bytes       `json:"publicKey"`
+	Signature hexutil.Bytes       `json:"signature"`
+}
+
+// Verify returns an indication if the signature over the message is valid.
+func (s *SignedGatewayStats) Verify() (bool, error) {
+	return signing.Verify(s.Scheme, s.PublicKey, s.Message, s.Signature)
+}
+
+// gatewayReception accumulates the statistics for a single gateway in the
+// current period.
+type gatewayReception struct {
+	uplinks      uint64
+	joinRequests uint64
+	devices      map[string]struct{}
+	channels     map[uint32]struct{}
+	airtime      time.Duration
+	rssi, snr    signalAccumulator
+	first, last  time.Time
+}
+
+type signalAccumulator struct {
+	min, max, sum float64
+	n             uint64
+}
+
+func (a *signalAccumulator) add(v float64) {
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.n++
+}
+
+func (a signalAccumulator) stats() SignalStats {
+	if a.n == 0 {
+		return SignalStats{}
+	}
+	return SignalStats{
+		Min:  a.min,
+		Max:  a.max,
+		Mean: math.Round(a.sum/float64(a.n)*100) / 100,
+	}
+}
+
+// CoverageProofs periodically signs a summary of the reception statistics of
+// each gateway with the gateway key. A signed summary is stronger evidence of
+// live coverage than raw packet counts because only the forwarder that holds
+// the gateway key can produce it. Signed summaries are available through the
+// API and optionally delivered to the coverage mapping service of the region
+// the gateway is located in.
+type CoverageProofs struct {
+	mu       sync.Mutex
+	interval time.Duration
+	scheme   string
+	deliver  bool
+	store    gateway.GatewayStore
+	coverage *CoverageClient
+	// gateways holds the statistics of the current period per gateway
+	gateways    map[lorawan.EUI64]*gatewayReception
+	periodStart time.Time
+	// signed holds the last signed statistics per gateway
+	signed map[lorawan.EUI64]*SignedGatewayStats
+}
+
+// NewCoverageProofs creates a coverage proof generator from the given cfg.
+func NewCoverageProofs(cfg *ForwarderCoverageProofsConfig, store gateway.GatewayStore, coverage *CoverageClient) (*CoverageProofs, error) {
+	p := &CoverageProofs{
+		interval:    time.Hour,
+		scheme:      signing.Secp256k1,
+		deliver:     cfg.Deliver,
+		store:       store,
+		coverage:    coverage,
+		gateways:    make(map[lorawan.EUI64]*gatewayReception),
+		periodStart: time.Now(),
+		signed:      make(map[lorawan.EUI64]*SignedGatewayStats),
+	}
+	if cfg.Interval != nil && *cfg.Interval > 0 {
+		p.interval = *cfg.Interval
+	}
+	if cfg.Scheme != nil {
+		schemes, err := signing.ParseSchemes([]string{*cfg.Scheme})
+		if err != nil {
+			return nil, fmt.Errorf("invalid coverage proof scheme: %w", err)
+		}
+		if len(schemes) != 1 {
+			return nil, fmt.Errorf("coverage proofs require a single signature scheme")
+		}
+		p.scheme = schemes[0]
+	}
+	return p, nil
+}
+
+// Record adds the uplink the gateway received to the statistics of the current
+// period. Uplinks without a valid CRC are ignored.
+func (p *CoverageProofs) Record(gateway *gateway.Gateway, frame *gw.UplinkFrame, phy *lorawan.PHYPayload, airtime time.Duration, at time.Time) {
+	if !crcOK(frame.GetRxInfo().GetCrcStatus()) {
+		return
+	}
+
+	var device string
+	switch payload := phy.MACPayload.(type) {
+	case *lorawan.MACPayload:
+		device = payload.FHDR.DevAddr.String()
+	case *lorawan.JoinRequestPayload:
+		device = payload.DevEUI.String()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rec, ok := p.gateways[gateway.LocalID]
+	if !ok {
+		rec = &gatewayReception{
+			devices:  make(map[string]struct{}),
+			channels: make(map[uint32]struct{}),
+			first:    at,
+		}
+		p.gateways[gateway.LocalID] = rec
+	}
+	rec.uplinks++
+	if phy.MHDR.MType == lorawan.JoinRequest || phy.MHDR.MType == lorawan.RejoinRequest {
+		rec.joinRequests++
+	}
+	if device != "" && len(rec.devices) < coverageProofMaxDevices {
+		rec.devices[device] = struct{}{}
+	}
+	rec.channels[frame.GetTxInfo().GetFrequency()] = struct{}{}
+	rec.airtime += airtime
+	rec.rssi.add(float64(frame.GetRxInfo().GetRssi()))
+	rec.snr.add(float64(frame.GetRxInfo().GetSnr()))
+	rec.last = at
+}
+
+// Run signs the statistics of all gateways each interval until the given ctx
+// expires.
+func (p *CoverageProofs) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, proof := range p.rotate(now) {
+				if p.deliver {
+					p.deliverProof(ctx, proof)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// signedProof is a signed summary together with the gateway it belongs to.
+type signedProof struct {
+	gateway *gateway.Gateway
+	stats   *SignedGatewayStats
+}
+
+// rotate signs the statistics of the current period for all gateways that
+// received uplinks and starts a new period.
+func (p *CoverageProofs) rotate(now time.Time) []signedProof {
+	p.mu.Lock()
+	gateways, from := p.gateways, p.periodStart
+	p.gateways = make(map[lorawan.EUI64]*gatewayReception)
+	p.periodStart = now
+	p.mu.Unlock()
+
+	var proofs []signedProof
+	for localID, rec := range gateways {
+		gw, err := p.store.ByLocalID(localID)
+		if err != nil {
+			continue // gateway removed from the store
+		}
+		signed, err := p.sign(gw, rec, from, now)
+		if err != nil {
+			logrus.WithError(err).WithField("gw_local_id", localID).Error("unable to sign gateway statistics")
+			continue
+		}
+		proofs = append(proofs, signedProof{gateway: gw, stats: signed})
+	}
+
+	p.mu.Lock()
+	for _, proof := range proofs {
+		p.signed[proof.gateway.LocalID] = proof.stats
+	}
+	p.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"gateways": len(proofs),
+		"from":     from,
+		"to":       now,
+	}).Info("signed gateway statistics")
+
+	return proofs
+}
+
+// sign returns the statistics in rec signed with the gateway key.
+func (p *CoverageProofs) sign(gw *gateway.Gateway, rec *gatewayReception, from, to time.Time) (*SignedGatewayStats, error) {
+	summary := GatewayStatsSummary{
+		Version:      coverageProofVersion,
+		GatewayID:    gw.ID(),
+		From:         from.UTC(),
+		To:           to.UTC(),
+		Uplinks:      rec.uplinks,
+		JoinRequests: rec.joinRequests,
+		Devices:      len(rec.devices),
+		Channels:     len(rec.channels),
+		AirtimeMs:    rec.airtime.Milliseconds(),
+		RSSI:         rec.rssi.stats(),
+		SNR:          rec.snr.stats(),
+		FirstUplink:  rec.first.UTC(),
+		LastUplink:   rec.last.UTC(),
+	}
+	msg, err := json.Marshal(summary)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gw.Signer(p.scheme)
+	if err != nil {
+		return nil, err
+	}
+	signStart := time.Now()
+	sig, err := signer.Sign(msg)
+	signingDurationHistogram.WithLabelValues("coverage_proof").Observe(time.Since(signStart).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedGatewayStats{
+		Stats:     summary,
+		Message:   msg,
+		Scheme:    signer.Scheme(),
+		PublicKey: signer.PublicKey(),
+		Signature: sig,
+	}, nil
+}
+
+// deliverProof sends the signed statistics to the coverage mapping service
+// for the region the gateway is located in.
+func (p *CoverageProofs) deliverProof(ctx context.Context, proof signedProof) {
+	log := logrus.WithField("gw_local_id", proof.gateway.LocalID)
+	cell, ok := gatewayH3Cell(proof.gateway, 1)
+	if !ok {
+		log.Debug("gateway has no location, signed statistics not delivered")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := p.coverage.DeliverSignedGatewayStats(ctx, cell, proof.stats); err != nil {
+		coverageProofsDeliveredCounter.WithLabelValues("failed").Inc()
+		log.WithError(err).Warn("unable to deliver signed gateway statistics")
+		return
+	}
+	coverageProofsDeliveredCounter.WithLabelValues("delivered").Inc()
+}
+
+// Last returns the last signed statistics for the gateway.
+func (p *CoverageProofs) Last(localID lorawan.EUI64) (*SignedGatewayStats, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	signed, ok := p.signed[localID]
+	return signed, ok
+}
+
+// All returns the last signed statistics of all gateways.
+func (p *CoverageProofs) All() []*SignedGatewayStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		ids    = make([]lorawan.EUI64, 0, len(p.signed))
+		signed = make([]*SignedGatewayStats, 0, len(p.signed))
+	)
+	for id := range p.signed {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	for _, id := range ids {
+		signed = append(signed, p.signed[id])
+	}
+	return signed
+}
+
+// CoverageProofs returns the last signed statistics of all gateways.
+func (svc APIService) CoverageProofs(w http.ResponseWriter, r *http.Request) {
+	if svc.coverageProofs == nil {
+		http.Error(w, "coverage proofs not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	replyJSON(w, http.StatusOK, svc.coverageProofs.All())
+}
+
+// GatewayCoverageProof returns the last signed statistics of the gateway with
+// the local id in the path.
+func (svc APIService) GatewayCoverageProof(w http.ResponseWriter, r *http.Request) {
+	if svc.coverageProofs == nil {
+		http.Error(w, "coverage proofs not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	signed, ok := svc.coverageProofs.Last(gw.LocalID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	replyJSON(w, http.StatusOK, signed)
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// CRCPolicy determines what the forwarder does with uplinks that failed the
+// CRC check or were received without CRC (e.g. implicit header mode).
+type CRCPolicy string
+
+const (
+	// CRCPolicyDrop drops the uplink
+	CRCPolicyDrop CRCPolicy = "drop"
+	// CRCPolicyForward forwards the uplink to routers and the mapping service
+	// with the CRC status in the thingsix_crc_status metadata field
+	CRCPolicyForward CRCPolicy = "forward"
+	// CRCPolicyMapping only forwards the uplink to the mapping service
+	CRCPolicyMapping CRCPolicy = "mapping"
+)
+
+// ParseCRCPolicy parses the given policy, an empty string results in
+// CRCPolicyDrop.
+func ParseCRCPolicy(policy string) (CRCPolicy, error) {
+	switch CRCPolicy(strings.ToLower(policy)) {
+	case "", CRCPolicyDrop:
+		return CRCPolicyDrop, nil
+	case CRCPolicyForward:
+		return CRCPolicyForward, nil
+	case CRCPolicyMapping:
+		return CRCPolicyMapping, nil
+	default:
+		return "", fmt.Errorf("invalid crc policy %q", policy)
+	}
+}
+
+// crcPolicies holds the policy for uplinks with a bad CRC and uplinks without CRC.
+type crcPolicies struct {
+	badCRC CRCPolicy
+	noCRC  CRCPolicy
+}
+
+func buildCRCPolicies(cfg *Config) (crcPolicies, error) {
+	var (
+		policies = crcPolicies{badCRC: CRCPolicyDrop, noCRC: CRCPolicyDrop}
+		err      error
+	)
+	if cfg.Forwarder.UplinkCRC.BadCRC != nil {
+		if policies.badCRC, err = ParseCRCPolicy(*cfg.Forwarder.UplinkCRC.BadCRC); err != nil {
+			return policies, err
+		}
+	}
+	if cfg.Forwarder.UplinkCRC.NoCRC != nil {
+		if policies.noCRC, err = ParseCRCPolicy(*cfg.Forwarder.UplinkCRC.NoCRC); err != nil {
+			return policies, err
+		}
+	}
+	return policies, nil
+}
+
+// forwardsCRCErrors returns an indication if uplinks without valid CRC must
+// be passed by the backend to the exchange.
+func (p crcPolicies) forwardsCRCErrors() bool {
+	return p.badCRC != CRCPolicyDrop || p.noCRC != CRCPolicyDrop
+}
+
+// policy returns the policy for uplinks with the given CRC status, uplinks
+// with a valid CRC are always forwarded.
+func (p crcPolicies) policy(status gw.CRCStatus) CRCPolicy {
+	switch status {
+	case gw.CRCStatus_BAD_CRC:
+		return p.badCRC
+	case gw.CRCStatus_NO_CRC:
+		return p.noCRC
+	default:
+		return CRCPolicyForward
+	}
+}
+
+// crcStatusLabel returns the value used in metrics and metadata for status.
+func crcStatusLabel(status gw.CRCStatus) string {
+	switch status {
+	case gw.CRCStatus_BAD_CRC:
+		return "bad"
+	case gw.CRCStatus_NO_CRC:
+		return "none"
+	default:
+		return "ok"
+	}
+}
+
+// crcOK returns an indication if status indicates a valid CRC.
+func crcOK(status gw.CRCStatus) bool {
+	return status == gw.CRCStatus_CRC_OK
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dedupCacheRecordSize is the size of a record in the cache file, the frame
+// hash followed by the delivery time in unix ms.
+const dedupCacheRecordSize = 8 + 8
+
+// dedupCache remembers recently delivered frames so copies that arrive after
+// the deduplication window are not delivered and accounted again. The cache
+// is a ring of fixed size records, if it is backed by a file a restarted
+// forwarder loads the frames the previous process delivered.
+type dedupCache struct {
+	ttl  time.Duration
+	file *os.File
+	// ring holds the records in the order they are written, next is the
+	// slot that is written next
+	ring      []dedupCacheRecord
+	next      int
+	delivered map[gossipHash]time.Time
+}
+
+type dedupCacheRecord struct {
+	hash gossipHash
+	at   time.Time
+}
+
+// newDedupCache returns a cache with the given number of slots. If path is
+// not empty the cache is stored in and loaded from that file.
+func newDedupCache(path string, slots int, ttl time.Duration) (*dedupCache, error) {
+	c := &dedupCache{
+		ttl:       ttl,
+		ring:      make([]dedupCacheRecord, slots),
+		delivered: make(map[gossipHash]time.Time),
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create deduplication cache directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open deduplication cache: %w", err)
+	}
+	raw := make([]byte, slots*dedupCacheRecordSize)
+	if _, err := io.ReadFull(file, raw); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		_ = file.Close()
+		return nil, fmt.Errorf("unable to read deduplication cache: %w", err)
+	}
+	if err := file.Truncate(int64(len(raw))); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("unable to size deduplication cache: %w", err)
+	}
+	c.file = file
+
+	var (
+		now    = time.Now()
+		newest time.Time
+		loaded int
+	)
+	for i := range c.ring {
+		record := raw[i*dedupCacheRecordSize : (i+1)*dedupCacheRecordSize]
+		ms := int64(binary.BigEndian.Uint64(record[8:]))
+		if ms == 0 {
+			continue
+		}
+		at := time.UnixMilli(ms)
+		if at.After(newest) {
+			newest, c.next = at, (i+1)%len(c.ring)
+		}
+		if now.Sub(at) > ttl {
+			continue
+		}
+		copy(c.ring[i].hash[:], record[:8])
+		c.ring[i].at = at
+		c.delivered[c.ring[i].hash] = at
+		loaded++
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":   path,
+		"frames": loaded,
+	}).Info("loaded deduplication cache")
+	return c, nil
+}
+
+// seen returns an indication if the frame was delivered within the ttl.
+func (c *dedupCache) seen(hash gossipHash, now time.Time) bool {
+	at, ok := c.delivered[hash]
+	return ok && now.Sub(at) <= c.ttl
+}
+
+// add records that the frame was delivered, overwriting the oldest record.
+func (c *dedupCache) add(hash gossipHash, now time.Time) {
+	old := c.ring[c.next]
+	if at, ok := c.delivered[old.hash]; ok && at.Equal(old.at) {
+		delete(c.delivered, old.hash)
+	}
+	c.ring[c.next] = dedupCacheRecord{hash: hash, at: now}
+	c.delivered[hash] = now
+
+	if c.file != nil {
+		var record [dedupCacheRecordSize]byte
+		copy(record[:8], hash[:])
+		binary.BigEndian.PutUint64(record[8:], uint64(now.UnixMilli()))
+		if _, err := c.file.WriteAt(record[:], int64(c.next*dedupCacheRecordSize)); err != nil {
+			logrus.WithError(err).Warn("unable to write deduplication cache")
+		}
+	}
+	c.next = (c.next + 1) % len(c.ring)
+}
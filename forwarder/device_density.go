@@ -0,0 +1,154 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/hll"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+)
+
+// deviceDensityHours is the number of hourly sketches kept per gateway
+const deviceDensityHours = 24
+
+// DeviceDensity estimates the number of distinct devices (DevAddr) each
+// gateway received uplinks from. It keeps a HyperLogLog sketch per gateway
+// per hour which bounds memory to ~24KiB per gateway.
+type DeviceDensity struct {
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*gatewayDeviceDensity
+}
+
+type gatewayDeviceDensity struct {
+	localID lorawan.EUI64
+	// hours is a ring buffer with a sketch per hour indexed by hour % size
+	hours [deviceDensityHours]struct {
+		hour   int64
+		sketch hll.Sketch
+	}
+}
+
+// DeviceDensityEstimate holds the estimated number of distinct devices a
+// gateway received uplinks from in the last hour and last day.
+type DeviceDensityEstimate struct {
+	LocalID   lorawan.EUI64 `json:"localId"`
+	NetworkID lorawan.EUI64 `json:"networkId"`
+	LastHour  uint64        `json:"lastHour"`
+	LastDay   uint64        `json:"lastDay"`
+}
+
+// NewDeviceDensity returns an empty device density estimator.
+func NewDeviceDensity() *DeviceDensity {
+	return &DeviceDensity{
+		gateways: make(map[lorawan.EUI64]*gatewayDeviceDensity),
+	}
+}
+
+// Record that gw received an uplink from the device with the given addr.
+func (d *DeviceDensity) Record(gw *gateway.Gateway, addr lorawan.DevAddr, at time.Time) {
+	hour := at.Unix() / 3600
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.gateways[gw.NetworkID]
+	if !ok {
+		g = &gatewayDeviceDensity{localID: gw.LocalID}
+		d.gateways[gw.NetworkID] = g
+	}
+
+	slot := &g.hours[hour%deviceDensityHours]
+	if slot.hour != hour {
+		slot.hour = hour
+		slot.sketch = hll.Sketch{}
+	}
+	slot.sketch.AddUint64(uint64(binary.BigEndian.Uint32(addr[:])))
+}
+
+// Estimates returns the device estimates for all gateways that received
+// uplinks in the last day sorted by local id.
+func (d *DeviceDensity) Estimates(now time.Time) []DeviceDensityEstimate {
+	hour := now.Unix() / 3600
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	estimates := make([]DeviceDensityEstimate, 0, len(d.gateways))
+	for networkID, g := range d.gateways {
+		var (
+			day    hll.Sketch
+			recent bool
+			est    = DeviceDensityEstimate{LocalID: g.localID, NetworkID: networkID}
+		)
+		for i := range g.hours {
+			slot := &g.hours[i]
+			if hour-slot.hour >= deviceDensityHours {
+				continue
+			}
+			recent = true
+			day.Merge(&slot.sketch)
+			if slot.hour == hour {
+				est.LastHour = slot.sketch.Estimate()
+			}
+		}
+		if !recent {
+			delete(d.gateways, networkID)
+			continue
+		}
+		est.LastDay = day.Estimate()
+		estimates = append(estimates, est)
+	}
+
+	sort.Slice(estimates, func(i, j int) bool {
+		return bytes.Compare(estimates[i].LocalID[:], estimates[j].LocalID[:]) < 0
+	})
+	return estimates
+}
+
+// Run periodically exports the estimates as prometheus metrics until the
+// given ctx expires.
+func (d *DeviceDensity) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			estimatedDevicesGauge.Reset()
+			for _, est := range d.Estimates(now) {
+				gatewayGauge(estimatedDevicesGauge, est.NetworkID, est.LocalID, "1h").Set(float64(est.LastHour))
+				gatewayGauge(estimatedDevicesGauge, est.NetworkID, est.LocalID, "24h").Set(float64(est.LastDay))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DeviceDensity returns per gateway the estimated number of distinct devices
+// it received uplinks from in the last hour and last day.
+func (svc APIService) DeviceDensity(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, svc.deviceDensity.Estimates(time.Now()))
+}
@@ -0,0 +1,261 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+const (
+	// downlinkInflightTimeout is how long a downlink is considered in-flight
+	// when the gateway doesn't acknowledge it
+	downlinkInflightTimeout = 30 * time.Second
+	// multicastMinFrames is the number of downlinks at a fixed cadence before
+	// a DevAddr is considered a multicast session
+	multicastMinFrames = 3
+	// multicastCadenceJitter is the allowed deviation from the cadence
+	multicastCadenceJitter = 0.25
+)
+
+// DownlinkScheduler limits the number of downlinks that are in-flight per
+// gateway. It detects multicast sessions, such as FUOTA campaigns, that send
+// class B/C downlinks for the same DevAddr at a fixed cadence and reserves
+// capacity for them. Regular downlinks can't use reserved capacity while a
+// multicast session is active on the gateway, which prevents firmware updates
+// from being starved by regular traffic.
+//
+// Optionally downlinks are validated against the receive windows of the
+// uplink they answer and the duty cycle limits of the region the gateway
+// operates in. Items that can't be transmitted are rejected, the gateway
+// uses the next item of the frame such as the RX2 window.
+type DownlinkScheduler struct {
+	mu                sync.Mutex
+	capacity          int
+	multicastReserved int
+	gateways          map[lorawan.EUI64]*gatewayDownlinkQueue
+
+	// validateRXWindows enables the receive window checks
+	validateRXWindows bool
+	// txMargin is the time needed to get the downlink to the gateway
+	// before the receive window opens
+	txMargin time.Duration
+	// dutyCycleWindow is the period over which the duty cycle is tracked,
+	// 0 if duty cycle is not tracked
+	dutyCycleWindow time.Duration
+	timings         map[lorawan.EUI64]*gatewayTiming
+}
+
+type gatewayDownlinkQueue struct {
+	// inflight holds the downlinks that are not yet acknowledged
+	inflight map[uint32]time.Time
+	// groups tracks the cadence of class B/C downlinks per DevAddr
+	groups map[lorawan.DevAddr]*multicastGroup
+}
+
+type multicastGroup struct {
+	last     time.Time
+	interval time.Duration
+	frames   int
+}
+
+// active returns an indication if the group is a multicast session that is
+// still sending downlinks.
+func (g *multicastGroup) active(now time.Time) bool {
+	return g.frames >= multicastMinFrames && now.Sub(g.last) < 3*g.interval
+}
+
+// NewDownlinkScheduler returns a scheduler configured from cfg.
+func NewDownlinkScheduler(cfg *ForwarderDownlinkSchedulerConfig) *DownlinkScheduler {
+	s := &DownlinkScheduler{
+		capacity:          16,
+		multicastReserved: 4,
+		gateways:          make(map[lorawan.EUI64]*gatewayDownlinkQueue),
+		validateRXWindows: cfg.ValidateRXWindows,
+		txMargin:          50 * time.Millisecond,
+		timings:           make(map[lorawan.EUI64]*gatewayTiming),
+	}
+	if cfg.Capacity != nil && *cfg.Capacity > 0 {
+		s.capacity = *cfg.Capacity
+	}
+	if cfg.MulticastReserved != nil && *cfg.MulticastReserved >= 0 {
+		s.multicastReserved = *cfg.MulticastReserved
+	}
+	if cfg.TxMargin != nil && *cfg.TxMargin >= 0 {
+		s.txMargin = *cfg.TxMargin
+	}
+	if cfg.DutyCycle {
+		s.dutyCycleWindow = time.Hour
+		if cfg.DutyCycleWindow != nil && *cfg.DutyCycleWindow > 0 {
+			s.dutyCycleWindow = *cfg.DutyCycleWindow
+		}
+	}
+	if s.multicastReserved >= s.capacity {
+		s.multicastReserved = s.capacity - 1
+	}
+	return s
+}
+
+// Schedule reserves capacity for the given downlink frame on the gateway with
+// the given network id. It returns an indication if the frame belongs to a
+// multicast session and ErrDownlinkQueueFull if there is no capacity left.
+func (s *DownlinkScheduler) Schedule(gatewayID lorawan.EUI64, frame *gw.DownlinkFrame) (bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.gateways[gatewayID]
+	if !ok {
+		q = &gatewayDownlinkQueue{
+			inflight: make(map[uint32]time.Time),
+			groups:   make(map[lorawan.DevAddr]*multicastGroup),
+		}
+		s.gateways[gatewayID] = q
+	}
+
+	q.expire(now)
+
+	multicast := q.observe(frame, now)
+
+	available := s.capacity
+	if !multicast && q.activeSessions(now) > 0 {
+		available -= s.multicastReserved
+	}
+	if len(q.inflight) >= available {
+		return multicast, ErrDownlinkQueueFull
+	}
+
+	q.inflight[frame.GetDownlinkId()] = now
+	return multicast, nil
+}
+
+// Acked releases the capacity for the downlink with the given id.
+func (s *DownlinkScheduler) Acked(gatewayID lorawan.EUI64, downlinkID uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if q, ok := s.gateways[gatewayID]; ok {
+		delete(q.inflight, downlinkID)
+	}
+}
+
+// MulticastSessions returns the number of active multicast sessions per gateway.
+func (s *DownlinkScheduler) MulticastSessions() map[lorawan.EUI64]int {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make(map[lorawan.EUI64]int, len(s.gateways))
+	for id, q := range s.gateways {
+		sessions[id] = q.activeSessions(now)
+	}
+	return sessions
+}
+
+// Inflight returns the number of unacknowledged downlinks per gateway.
+func (s *DownlinkScheduler) Inflight() map[lorawan.EUI64]int {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inflight := make(map[lorawan.EUI64]int, len(s.gateways))
+	for id, q := range s.gateways {
+		q.expire(now)
+		inflight[id] = len(q.inflight)
+	}
+	return inflight
+}
+
+// expire removes downlinks that are in-flight too long and groups that
+// stopped sending.
+func (q *gatewayDownlinkQueue) expire(now time.Time) {
+	for id, scheduled := range q.inflight {
+		if now.Sub(scheduled) > downlinkInflightTimeout {
+			delete(q.inflight, id)
+		}
+	}
+	for addr, g := range q.groups {
+		if now.Sub(g.last) > time.Hour || (g.interval > 0 && now.Sub(g.last) > 3*g.interval) {
+			delete(q.groups, addr)
+		}
+	}
+}
+
+func (q *gatewayDownlinkQueue) activeSessions(now time.Time) int {
+	active := 0
+	for _, g := range q.groups {
+		if g.active(now) {
+			active++
+		}
+	}
+	return active
+}
+
+// observe tracks the cadence of class B/C unconfirmed data downlinks and
+// returns an indication if the frame is part of a multicast session.
+func (q *gatewayDownlinkQueue) observe(frame *gw.DownlinkFrame, now time.Time) bool {
+	items := frame.GetItems()
+	if len(items) == 0 {
+		return false
+	}
+
+	// class A downlinks are scheduled relative to an uplink, multicast
+	// downlinks are sent immediately (class C) or at a GPS time (class B)
+	timing := items[0].GetTxInfo().GetTiming()
+	if timing.GetImmediately() == nil && timing.GetGpsEpoch() == nil {
+		return false
+	}
+
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(items[0].GetPhyPayload()); err != nil || phy.MHDR.MType != lorawan.UnconfirmedDataDown {
+		return false
+	}
+	mac, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return false
+	}
+
+	g, ok := q.groups[mac.FHDR.DevAddr]
+	if !ok {
+		q.groups[mac.FHDR.DevAddr] = &multicastGroup{last: now, frames: 1}
+		return false
+	}
+
+	interval := now.Sub(g.last)
+	if g.interval > 0 && absDuration(interval-g.interval) <= time.Duration(float64(g.interval)*multicastCadenceJitter) {
+		g.frames++
+	} else {
+		g.frames = 2
+	}
+	g.interval = interval
+	g.last = now
+
+	return g.frames >= multicastMinFrames
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,349 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SimulatedDownlinkPending indicates no TX ACK was received yet
+	SimulatedDownlinkPending = "pending"
+
+	// maxSimulatedDownlinks is the number of simulated downlinks kept per
+	// gateway, older downlinks are forgotten
+	maxSimulatedDownlinks = 16
+)
+
+// simulatedDownlinkPayloadPrefix marks the proprietary payload that is sent
+// when no payload is given, the remainder of the payload is a random nonce.
+var simulatedDownlinkPayloadPrefix = []byte{byte(lorawan.Proprietary) << 5, 'T', 'I', 'X', 'S', 'I', 'M', 'D', 'L'}
+
+// SimulatedDownlinkRequest describes a synthetic downlink. Transmission
+// parameters that are not set default to the RX2 channel of the gateway
+// region.
+type SimulatedDownlinkRequest struct {
+	// DevEUI is the device the downlink is intended for, it is only recorded
+	DevEUI *lorawan.EUI64 `json:"devEui,omitempty"`
+	// PhyPayload is transmitted as is, a proprietary test frame is sent when
+	// not set
+	PhyPayload      []byte `json:"phyPayload,omitempty"`
+	Frequency       uint32 `json:"frequency,omitempty"`
+	Power           *int32 `json:"power,omitempty"`
+	SpreadingFactor uint32 `json:"spreadingFactor,omitempty"`
+	Bandwidth       uint32 `json:"bandwidth,omitempty"`
+	// PolarizationInversion defaults to true, devices only receive downlinks
+	// with inverted polarization
+	PolarizationInversion *bool `json:"polarizationInversion,omitempty"`
+}
+
+// SimulatedDownlink is a synthetic downlink that was sent to a gateway
+// outside of the network, routers are not involved.
+type SimulatedDownlink struct {
+	DownlinkID       uint32         `json:"downlinkId"`
+	GatewayLocalID   lorawan.EUI64  `json:"gatewayLocalId"`
+	GatewayNetworkID lorawan.EUI64  `json:"gatewayNetworkId"`
+	DevEUI           *lorawan.EUI64 `json:"devEui,omitempty"`
+	// Simulated is always true, it flags the downlink as not originating
+	// from the network
+	Simulated       bool       `json:"simulated"`
+	PhyPayload      []byte     `json:"phyPayload"`
+	Frequency       uint32     `json:"frequency"`
+	Power           int32      `json:"power"`
+	SpreadingFactor uint32     `json:"spreadingFactor"`
+	Bandwidth       uint32     `json:"bandwidth"`
+	Sent            time.Time  `json:"sent"`
+	Status          string     `json:"status"`
+	TxAcked         *time.Time `json:"txAcked,omitempty"`
+}
+
+// DownlinkSimulator sends synthetic downlinks to gateways so the transmit
+// chain of a gateway can be verified without involving the network. TX ACKs
+// for these downlinks are consumed and never forwarded to routers.
+type DownlinkSimulator struct {
+	exchange *Exchange
+
+	mu sync.Mutex
+	// downlinks holds the recent simulated downlinks per gateway local id,
+	// the newest last
+	downlinks map[lorawan.EUI64][]*SimulatedDownlink
+}
+
+// NewDownlinkSimulator returns a simulator that sends downlinks through the
+// backend of exchange.
+func NewDownlinkSimulator(exchange *Exchange) *DownlinkSimulator {
+	return &DownlinkSimulator{
+		exchange:  exchange,
+		downlinks: make(map[lorawan.EUI64][]*SimulatedDownlink),
+	}
+}
+
+// Send validates the downlink described by req against the regional and
+// regulatory limits of gw and sends it to the gateway for immediate
+// transmission. Validation errors are returned as ErrInvalidSimulatedDownlink.
+func (ds *DownlinkSimulator) Send(gateway *gateway.Gateway, req SimulatedDownlinkRequest) (SimulatedDownlink, error) {
+	e := ds.exchange
+	if e.leader != nil && !e.leader.IsLeader() {
+		return SimulatedDownlink{}, ErrSimulatedDownlinkNotLeader
+	}
+
+	frame, err := ds.frame(gateway, req)
+	if err != nil {
+		return SimulatedDownlink{}, err
+	}
+
+	var (
+		item   = frame.GetItems()[0]
+		region = gatewayRegion(gateway, e.gateways)
+		now    = time.Now()
+	)
+	if err := validateDownlinkSize(region, item); err != nil {
+		return SimulatedDownlink{}, fmt.Errorf("%w: %s", ErrInvalidSimulatedDownlink, err)
+	}
+	if e.bandPlans != nil {
+		if _, _, err := e.bandPlans.LimitDownlinkItem(region, item); err != nil {
+			return SimulatedDownlink{}, fmt.Errorf("%w: %s", ErrInvalidSimulatedDownlink, err)
+		}
+	}
+	if e.txPower != nil {
+		if _, _, err := e.txPower.Limit(gateway, item); err != nil {
+			return SimulatedDownlink{}, fmt.Errorf("%w: %s", ErrInvalidSimulatedDownlink, err)
+		}
+	}
+	if e.scheduler != nil {
+		if err := e.scheduler.ValidateItem(gateway.NetworkID, region, item, now); err != nil {
+			return SimulatedDownlink{}, fmt.Errorf("%w: %s", ErrInvalidSimulatedDownlink, err)
+		}
+	}
+
+	lora := item.GetTxInfo().GetModulation().GetLora()
+	sim := &SimulatedDownlink{
+		DownlinkID:       frame.GetDownlinkId(),
+		GatewayLocalID:   gateway.LocalID,
+		GatewayNetworkID: gateway.NetworkID,
+		DevEUI:           req.DevEUI,
+		Simulated:        true,
+		PhyPayload:       item.GetPhyPayload(),
+		Frequency:        item.GetTxInfo().GetFrequency(),
+		Power:            item.GetTxInfo().GetPower(),
+		SpreadingFactor:  lora.GetSpreadingFactor(),
+		Bandwidth:        lora.GetBandwidth(),
+		Sent:             now,
+		Status:           SimulatedDownlinkPending,
+	}
+
+	log := exchangeLog.WithFields(logrus.Fields{
+		"gw_local_id":   gateway.LocalID,
+		"gw_network_id": gateway.NetworkID,
+		"downlink_id":   sim.DownlinkID,
+		"frequency":     sim.Frequency,
+		"pwr":           sim.Power,
+		"sf":            sim.SpreadingFactor,
+		"simulated":     true,
+	})
+	if sim.DevEUI != nil {
+		log = log.WithField("dev_eui", *sim.DevEUI)
+	}
+
+	// register before sending, the TX ACK can arrive before Send returns
+	ds.mu.Lock()
+	downlinks := append(ds.downlinks[gateway.LocalID], sim)
+	if len(downlinks) > maxSimulatedDownlinks {
+		downlinks = downlinks[len(downlinks)-maxSimulatedDownlinks:]
+	}
+	ds.downlinks[gateway.LocalID] = downlinks
+	ds.mu.Unlock()
+
+	if err := e.backend.SendDownlinkFrame(frame); err != nil {
+		simulatedDownlinksCounter.WithLabelValues("backend_error").Inc()
+		ds.mu.Lock()
+		sim.Status = gw.TxAckStatus_INTERNAL_ERROR.String()
+		ds.mu.Unlock()
+		log.WithError(err).Error("unable to send simulated downlink to gateway")
+		return SimulatedDownlink{}, err
+	}
+	if e.scheduler != nil {
+		e.scheduler.Transmitted(gateway.NetworkID, region, item, now)
+	}
+
+	simulatedDownlinksCounter.WithLabelValues("sent").Inc()
+	log.Warn("simulated downlink sent to gateway, not originating from the network")
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return *sim, nil
+}
+
+// frame returns the downlink frame for req with the transmission parameters
+// that are not set taken from the RX2 channel of the gateway region.
+func (ds *DownlinkSimulator) frame(gateway *gateway.Gateway, req SimulatedDownlinkRequest) (*gw.DownlinkFrame, error) {
+	band, err := regionBand(gatewayRegion(gateway, ds.exchange.gateways))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSimulatedDownlink, err)
+	}
+	defaults := band.GetDefaults()
+	dr, err := band.GetDataRate(defaults.RX2DataRate)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var (
+		payload               = req.PhyPayload
+		frequency             = defaults.RX2Frequency
+		spreadingFactor       = uint32(dr.SpreadFactor)
+		bandwidth             = uint32(dr.Bandwidth * 1000)
+		polarizationInversion = true
+	)
+	if len(payload) == 0 {
+		payload = append(append([]byte{}, simulatedDownlinkPayloadPrefix...), nonce...)
+	}
+	if req.Frequency != 0 {
+		frequency = req.Frequency
+	}
+	if req.SpreadingFactor != 0 {
+		if req.SpreadingFactor < 5 || req.SpreadingFactor > 12 {
+			return nil, fmt.Errorf("%w: invalid spreading factor %d", ErrInvalidSimulatedDownlink, req.SpreadingFactor)
+		}
+		spreadingFactor = req.SpreadingFactor
+	}
+	if req.Bandwidth != 0 {
+		bandwidth = req.Bandwidth
+	}
+	if req.PolarizationInversion != nil {
+		polarizationInversion = *req.PolarizationInversion
+	}
+	power := int32(band.GetDownlinkTXPower(frequency))
+	if req.Power != nil {
+		power = *req.Power
+	}
+
+	return &gw.DownlinkFrame{
+		DownlinkId: binary.BigEndian.Uint32(nonce),
+		GatewayId:  gateway.LocalID.String(),
+		Items: []*gw.DownlinkFrameItem{{
+			PhyPayload: payload,
+			TxInfo: &gw.DownlinkTxInfo{
+				Frequency: frequency,
+				Power:     power,
+				Modulation: &gw.Modulation{
+					Parameters: &gw.Modulation_Lora{
+						Lora: &gw.LoraModulationInfo{
+							Bandwidth:             bandwidth,
+							SpreadingFactor:       spreadingFactor,
+							CodeRate:              gw.CodeRate_CR_4_5,
+							PolarizationInversion: polarizationInversion,
+						},
+					},
+				},
+				Timing: &gw.Timing{
+					Parameters: &gw.Timing_Immediately{
+						Immediately: &gw.ImmediatelyTimingInfo{},
+					},
+				},
+			},
+		}},
+	}, nil
+}
+
+// TxAck returns true if txack acknowledges a simulated downlink. These ACKs
+// are consumed by the simulator and must not be forwarded to routers.
+func (ds *DownlinkSimulator) TxAck(gateway *gateway.Gateway, txack *gw.DownlinkTxAck) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for _, sim := range ds.downlinks[gateway.LocalID] {
+		if sim.DownlinkID == txack.GetDownlinkId() {
+			now := time.Now()
+			sim.Status, sim.TxAcked = txAckStatus(txack), &now
+			simulatedDownlinksCounter.WithLabelValues("tx_ack").Inc()
+			return true
+		}
+	}
+	return false
+}
+
+// Downlinks returns the recent simulated downlinks for the gateway with the
+// given local id, the newest first.
+func (ds *DownlinkSimulator) Downlinks(localID lorawan.EUI64) []SimulatedDownlink {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	downlinks := ds.downlinks[localID]
+	result := make([]SimulatedDownlink, 0, len(downlinks))
+	for i := len(downlinks) - 1; i >= 0; i-- {
+		result = append(result, *downlinks[i])
+	}
+	return result
+}
+
+// SendSimulatedDownlink sends a synthetic downlink to the gateway in the
+// path, bypassing routers.
+func (svc APIService) SendSimulatedDownlink(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+
+	var req SimulatedDownlinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sim, err := svc.downlinkSimulator.Send(gw, req)
+	switch {
+	case err == nil:
+		replyJSON(w, http.StatusAccepted, sim)
+	case errors.Is(err, ErrInvalidSimulatedDownlink):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrSimulatedDownlinkNotLeader):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		logrus.WithError(err).Error("unable to send simulated downlink")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// SimulatedDownlinks returns the recent simulated downlinks for the gateway
+// in the path.
+func (svc APIService) SimulatedDownlinks(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, svc.downlinkSimulator.Downlinks(gw.LocalID))
+}
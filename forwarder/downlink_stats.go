@@ -0,0 +1,327 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/go-chi/chi/v5"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	defaultDownlinkStatsMaxDevices       = 10000
+	defaultDownlinkStatsMinDownlinks     = 10
+	defaultDownlinkStatsFailureThreshold = 0.5
+)
+
+// downlinkKey identifies a downlink that is waiting for its tx ack.
+type downlinkKey struct {
+	gateway    lorawan.EUI64
+	downlinkID uint32
+}
+
+// gatewayDownlinks counts the downlink results for a device through a single
+// gateway.
+type gatewayDownlinks struct {
+	localID    lorawan.EUI64
+	downlinks  uint64
+	acked      uint64
+	statuses   map[string]uint64
+	lastStatus string
+	lastSeen   time.Time
+}
+
+// DownlinkStats tracks downlink results per device (DevAddr) and gateway
+// since the forwarder started. Only the most recently active devices are
+// kept. Downlinks for which the gateway never sent a tx ack are not counted.
+type DownlinkStats struct {
+	mu sync.Mutex
+	// devices holds per DevAddr the results per gateway network id
+	devices *lru.Cache[lorawan.DevAddr, map[lorawan.EUI64]*gatewayDownlinks]
+	// pending holds the DevAddr of downlinks that wait for their tx ack
+	pending *lru.Cache[downlinkKey, lorawan.DevAddr]
+	// minDownlinks is the number of downlinks a device must have through a
+	// gateway before it can be marked as failing
+	minDownlinks uint64
+	// failureThreshold is the failure ratio above which a device is marked
+	// as failing through a gateway
+	failureThreshold float64
+}
+
+// NewDownlinkStats returns a downlink statistics tracker.
+func NewDownlinkStats(cfg *ForwarderDownlinkStatsConfig) *DownlinkStats {
+	var (
+		maxDevices       = defaultDownlinkStatsMaxDevices
+		minDownlinks     = defaultDownlinkStatsMinDownlinks
+		failureThreshold = defaultDownlinkStatsFailureThreshold
+	)
+	if cfg.MaxDevices != nil && *cfg.MaxDevices > 0 {
+		maxDevices = *cfg.MaxDevices
+	}
+	if cfg.MinDownlinks != nil && *cfg.MinDownlinks > 0 {
+		minDownlinks = *cfg.MinDownlinks
+	}
+	if cfg.FailureThreshold != nil && *cfg.FailureThreshold > 0 {
+		failureThreshold = *cfg.FailureThreshold
+	}
+
+	// an error is only returned for a non-positive size
+	devices, _ := lru.New[lorawan.DevAddr, map[lorawan.EUI64]*gatewayDownlinks](maxDevices)
+	pending, _ := lru.New[downlinkKey, lorawan.DevAddr](maxDevices)
+
+	return &DownlinkStats{
+		devices:          devices,
+		pending:          pending,
+		minDownlinks:     uint64(minDownlinks),
+		failureThreshold: failureThreshold,
+	}
+}
+
+// Sent registers a downlink that is sent to the gateway with the given
+// network id. Downlinks without a DevAddr, such as join-accepts, are ignored.
+func (s *DownlinkStats) Sent(gatewayNetworkID lorawan.EUI64, frame *gw.DownlinkFrame) {
+	items := frame.GetItems()
+	if len(items) == 0 {
+		return
+	}
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(items[0].GetPhyPayload()); err != nil {
+		return
+	}
+	if phy.MHDR.MType != lorawan.UnconfirmedDataDown && phy.MHDR.MType != lorawan.ConfirmedDataDown {
+		return
+	}
+	mac, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return
+	}
+	s.pending.Add(downlinkKey{gatewayNetworkID, frame.GetDownlinkId()}, mac.FHDR.DevAddr)
+}
+
+// TxAck records the result of a downlink that was registered with Sent. A
+// downlink succeeded when the gateway acknowledged one of its items with OK.
+func (s *DownlinkStats) TxAck(gateway *gateway.Gateway, ack *gw.DownlinkTxAck) {
+	status := gw.TxAckStatus_IGNORED
+	for i, item := range ack.GetItems() {
+		if i == 0 || item.GetStatus() != gw.TxAckStatus_IGNORED {
+			status = item.GetStatus()
+		}
+		if item.GetStatus() != gw.TxAckStatus_IGNORED {
+			break
+		}
+	}
+	s.record(gateway, ack.GetDownlinkId(), status, time.Now())
+}
+
+// Failed records that the downlink registered with Sent could not be passed
+// to the gateway.
+func (s *DownlinkStats) Failed(gateway *gateway.Gateway, downlinkID uint32) {
+	s.record(gateway, downlinkID, gw.TxAckStatus_INTERNAL_ERROR, time.Now())
+}
+
+func (s *DownlinkStats) record(gateway *gateway.Gateway, downlinkID uint32, status gw.TxAckStatus, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := downlinkKey{gateway.NetworkID, downlinkID}
+	addr, ok := s.pending.Peek(key)
+	if !ok {
+		return
+	}
+	s.pending.Remove(key)
+
+	device, ok := s.devices.Get(addr)
+	if !ok {
+		device = make(map[lorawan.EUI64]*gatewayDownlinks)
+		s.devices.Add(addr, device)
+	}
+	stats, ok := device[gateway.NetworkID]
+	if !ok {
+		stats = &gatewayDownlinks{
+			localID:  gateway.LocalID,
+			statuses: make(map[string]uint64),
+		}
+		device[gateway.NetworkID] = stats
+	}
+
+	stats.downlinks++
+	if status == gw.TxAckStatus_OK {
+		stats.acked++
+	}
+	stats.statuses[status.String()]++
+	stats.lastStatus = status.String()
+	stats.lastSeen = at
+}
+
+// DeviceGatewayDownlinkStats holds the downlink results for a device through a
+// single gateway.
+type DeviceGatewayDownlinkStats struct {
+	GatewayNetworkID lorawan.EUI64 `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64 `json:"gatewayLocalId"`
+	Downlinks        uint64        `json:"downlinks"`
+	Acked            uint64        `json:"acked"`
+	Failed           uint64        `json:"failed"`
+	SuccessRate      float64       `json:"successRate"`
+	// Failing is set when the device had enough downlinks through the
+	// gateway and the failure ratio exceeds the threshold
+	Failing bool `json:"failing"`
+	// Statuses holds the number of downlinks per tx ack status
+	Statuses   map[string]uint64 `json:"statuses"`
+	LastStatus string            `json:"lastStatus"`
+	LastSeen   time.Time         `json:"lastSeen"`
+}
+
+// DeviceDownlinkStats holds the downlink results for a device.
+type DeviceDownlinkStats struct {
+	DevAddr     string  `json:"devAddr"`
+	Downlinks   uint64  `json:"downlinks"`
+	Acked       uint64  `json:"acked"`
+	Failed      uint64  `json:"failed"`
+	SuccessRate float64 `json:"successRate"`
+	// Failing is set when downlinks for the device fail through at least
+	// one of the gateways
+	Failing  bool                         `json:"failing"`
+	LastSeen time.Time                    `json:"lastSeen"`
+	Gateways []DeviceGatewayDownlinkStats `json:"gateways"`
+}
+
+// Devices returns the downlink results of all tracked devices.
+func (s *DownlinkStats) Devices() []*DeviceDownlinkStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports := make([]*DeviceDownlinkStats, 0, s.devices.Len())
+	for _, addr := range s.devices.Keys() {
+		if device, ok := s.devices.Peek(addr); ok {
+			reports = append(reports, s.report(addr, device))
+		}
+	}
+	return reports
+}
+
+// Device returns the downlink results of the device with the given DevAddr.
+func (s *DownlinkStats) Device(addr lorawan.DevAddr) (*DeviceDownlinkStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices.Peek(addr)
+	if !ok {
+		return nil, false
+	}
+	return s.report(addr, device), true
+}
+
+func (s *DownlinkStats) report(addr lorawan.DevAddr, device map[lorawan.EUI64]*gatewayDownlinks) *DeviceDownlinkStats {
+	report := &DeviceDownlinkStats{
+		DevAddr:  addr.String(),
+		Gateways: make([]DeviceGatewayDownlinkStats, 0, len(device)),
+	}
+	for networkID, stats := range device {
+		gwReport := DeviceGatewayDownlinkStats{
+			GatewayNetworkID: networkID,
+			GatewayLocalID:   stats.localID,
+			Downlinks:        stats.downlinks,
+			Acked:            stats.acked,
+			Failed:           stats.downlinks - stats.acked,
+			SuccessRate:      float64(stats.acked) / float64(stats.downlinks),
+			Statuses:         make(map[string]uint64, len(stats.statuses)),
+			LastStatus:       stats.lastStatus,
+			LastSeen:         stats.lastSeen,
+		}
+		gwReport.Failing = stats.downlinks >= s.minDownlinks &&
+			float64(gwReport.Failed)/float64(stats.downlinks) >= s.failureThreshold
+		for status, n := range stats.statuses {
+			gwReport.Statuses[status] = n
+		}
+
+		report.Downlinks += gwReport.Downlinks
+		report.Acked += gwReport.Acked
+		report.Failed += gwReport.Failed
+		report.Failing = report.Failing || gwReport.Failing
+		if stats.lastSeen.After(report.LastSeen) {
+			report.LastSeen = stats.lastSeen
+		}
+		report.Gateways = append(report.Gateways, gwReport)
+	}
+	if report.Downlinks > 0 {
+		report.SuccessRate = float64(report.Acked) / float64(report.Downlinks)
+	}
+	// gateways with the lowest success rate first
+	sort.Slice(report.Gateways, func(i, j int) bool {
+		a, b := report.Gateways[i], report.Gateways[j]
+		if a.SuccessRate != b.SuccessRate {
+			return a.SuccessRate < b.SuccessRate
+		}
+		return a.GatewayNetworkID.String() < b.GatewayNetworkID.String()
+	})
+	return report
+}
+
+// deviceDownlinkListSpec describes how device downlink stats can be filtered
+// and sorted.
+var deviceDownlinkListSpec = listSpec[*DeviceDownlinkStats]{
+	fields: map[string]func(*DeviceDownlinkStats) string{
+		"devAddr":     func(d *DeviceDownlinkStats) string { return d.DevAddr },
+		"downlinks":   func(d *DeviceDownlinkStats) string { return strconv.FormatUint(d.Downlinks, 10) },
+		"failed":      func(d *DeviceDownlinkStats) string { return strconv.FormatUint(d.Failed, 10) },
+		"successRate": func(d *DeviceDownlinkStats) string { return strconv.FormatFloat(d.SuccessRate, 'f', -1, 64) },
+		"failing":     func(d *DeviceDownlinkStats) string { return strconv.FormatBool(d.Failing) },
+		"lastSeen":    func(d *DeviceDownlinkStats) string { return d.LastSeen.UTC().Format(packetEventTimeFormat) },
+	},
+	numeric:     map[string]bool{"downlinks": true, "failed": true, "successRate": true},
+	id:          func(d *DeviceDownlinkStats) string { return d.DevAddr },
+	defaultSort: "-failed",
+}
+
+// DownlinkStats returns a page with the downlink results per device, by
+// default the devices with the most failed downlinks first.
+func (svc APIService) DownlinkStats(w http.ResponseWriter, r *http.Request) {
+	if svc.downlinkStats == nil {
+		http.Error(w, "downlink statistics not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	replyListPage(w, r, deviceDownlinkListSpec, svc.downlinkStats.Devices())
+}
+
+// DeviceDownlinkStats returns the downlink results for the device with the
+// DevAddr in the path.
+func (svc APIService) DeviceDownlinkStats(w http.ResponseWriter, r *http.Request) {
+	if svc.downlinkStats == nil {
+		http.Error(w, "downlink statistics not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	var addr lorawan.DevAddr
+	if err := addr.UnmarshalText([]byte(strings.TrimPrefix(chi.URLParam(r, "dev_addr"), "0x"))); err != nil {
+		http.Error(w, "invalid DevAddr", http.StatusBadRequest)
+		return
+	}
+	report, ok := svc.downlinkStats.Device(addr)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	replyJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,279 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/airtime"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+const (
+	// rxWindowMinDelay and rxWindowMaxDelay are the bounds of the class A
+	// receive windows, RX1 opens 1 to 15 seconds after the uplink and RX2
+	// a second after RX1
+	rxWindowMinDelay = time.Second
+	rxWindowMaxDelay = 16 * time.Second
+)
+
+// dutyCycleBand is a frequency range with a regulatory duty cycle limit.
+type dutyCycleBand struct {
+	name     string
+	min, max uint32
+	limit    float64
+}
+
+// dutyCycleBands holds per region the sub-bands that are subject to a duty
+// cycle limit. Regions that are not listed have no duty cycle limit or
+// regulate the channel occupancy with dwell times or listen before talk.
+var dutyCycleBands = map[frequency_plan.BandName][]dutyCycleBand{
+	frequency_plan.EU868: {
+		{name: "863.0-865.0", min: 863000000, max: 865000000, limit: 0.001},
+		{name: "865.0-868.0", min: 865000000, max: 868000000, limit: 0.01},
+		{name: "868.0-868.6", min: 868000000, max: 868600000, limit: 0.01},
+		{name: "868.7-869.2", min: 868700000, max: 869200000, limit: 0.001},
+		{name: "869.4-869.65", min: 869400000, max: 869650000, limit: 0.1},
+		{name: "869.7-870.0", min: 869700000, max: 870000000, limit: 0.01},
+	},
+	frequency_plan.EU433: {
+		{name: "433.175-434.665", min: 433175000, max: 434665000, limit: 0.1},
+	},
+}
+
+// dutyCycleBandFor returns the duty cycle band the frequency is in.
+func dutyCycleBandFor(region frequency_plan.BandName, frequency uint32) (dutyCycleBand, bool) {
+	for _, b := range dutyCycleBands[region] {
+		if frequency >= b.min && frequency <= b.max {
+			return b, true
+		}
+	}
+	return dutyCycleBand{}, false
+}
+
+// DownlinkTimingError is returned when a downlink item can't be transmitted
+// in time or within the duty cycle limit. Status is the TX ack status that
+// is reported to the router.
+type DownlinkTimingError struct {
+	Status gw.TxAckStatus
+	Reason string
+}
+
+func (err *DownlinkTimingError) Error() string {
+	return fmt.Sprintf("downlink not scheduled (%s): %s", err.Status, err.Reason)
+}
+
+// Unwrap returns ErrDownlinkDutyCycle for duty cycle violations, which are
+// reported with the QUEUE_FULL status, and ErrDownlinkReceiveWindow otherwise.
+func (err *DownlinkTimingError) Unwrap() error {
+	if err.Status == gw.TxAckStatus_QUEUE_FULL {
+		return ErrDownlinkDutyCycle
+	}
+	return ErrDownlinkReceiveWindow
+}
+
+// gatewayTiming tracks the uplinks received by a gateway recently and the
+// downlinks it transmitted in duty cycle limited bands.
+type gatewayTiming struct {
+	// uplinks holds the receive time of recent uplinks by gateway context
+	uplinks []receivedUplink
+	// transmissions holds per region and duty cycle band the downlinks
+	// transmitted within the duty cycle window
+	transmissions map[dutyCycleKey][]transmission
+}
+
+// dutyCycleKey identifies a duty cycle band within a region, the duty cycle
+// a gateway used in one region is not charged to another region.
+type dutyCycleKey struct {
+	region frequency_plan.BandName
+	band   string
+}
+
+func (k dutyCycleKey) String() string {
+	return fmt.Sprintf("%s/%s", k.region, k.band)
+}
+
+type receivedUplink struct {
+	context []byte
+	at      time.Time
+}
+
+type transmission struct {
+	at      time.Time
+	airtime time.Duration
+}
+
+func (s *DownlinkScheduler) timing(gatewayID lorawan.EUI64) *gatewayTiming {
+	t, ok := s.timings[gatewayID]
+	if !ok {
+		t = &gatewayTiming{transmissions: make(map[dutyCycleKey][]transmission)}
+		s.timings[gatewayID] = t
+	}
+	return t
+}
+
+// ObserveUplink records when the uplink was received, downlinks scheduled
+// relative to it are validated against its receive windows.
+func (s *DownlinkScheduler) ObserveUplink(gatewayID lorawan.EUI64, frame *gw.UplinkFrame, at time.Time) {
+	if !s.validateRXWindows || len(frame.GetRxInfo().GetContext()) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.timing(gatewayID)
+	uplinks := t.uplinks[:0]
+	for _, u := range t.uplinks {
+		if at.Sub(u.at) <= rxWindowMaxDelay {
+			uplinks = append(uplinks, u)
+		}
+	}
+	t.uplinks = append(uplinks, receivedUplink{context: frame.GetRxInfo().GetContext(), at: at})
+}
+
+// ValidateItem returns a *DownlinkTimingError when the downlink item would be
+// transmitted outside the receive window of the uplink it answers, or would
+// exceed the duty cycle limit of the band it is transmitted in.
+func (s *DownlinkScheduler) ValidateItem(gatewayID lorawan.EUI64, region frequency_plan.BandName, item *gw.DownlinkFrameItem, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.timing(gatewayID)
+
+	if delay := item.GetTxInfo().GetTiming().GetDelay().GetDelay(); s.validateRXWindows && delay != nil {
+		d := delay.AsDuration()
+		if d < rxWindowMinDelay {
+			return &DownlinkTimingError{Status: gw.TxAckStatus_TOO_EARLY, Reason: fmt.Sprintf("delay %s before RX1", d)}
+		}
+		if d > rxWindowMaxDelay {
+			return &DownlinkTimingError{Status: gw.TxAckStatus_TOO_LATE, Reason: fmt.Sprintf("delay %s after RX2", d)}
+		}
+		for _, u := range t.uplinks {
+			if !bytes.Equal(u.context, item.GetTxInfo().GetContext()) {
+				continue
+			}
+			if window := u.at.Add(d); now.Add(s.txMargin).After(window) {
+				return &DownlinkTimingError{
+					Status: gw.TxAckStatus_TOO_LATE,
+					Reason: fmt.Sprintf("receive window passed %s ago", now.Add(s.txMargin).Sub(window).Round(time.Millisecond)),
+				}
+			}
+			break
+		}
+	}
+
+	if s.dutyCycleWindow > 0 {
+		band, ok := dutyCycleBandFor(region, item.GetTxInfo().GetFrequency())
+		if !ok {
+			return nil
+		}
+		airtime, err := airtime.DownlinkItemAirtime(item)
+		if err != nil {
+			return nil
+		}
+		used := t.dutyCycleUsed(dutyCycleKey{region, band.name}, now, s.dutyCycleWindow)
+		if allowed := time.Duration(band.limit * float64(s.dutyCycleWindow)); used+airtime > allowed {
+			// the gateway API has no duty cycle status, the transmit queue
+			// of the band is full
+			return &DownlinkTimingError{
+				Status: gw.TxAckStatus_QUEUE_FULL,
+				Reason: fmt.Sprintf("%s used of %s allowed in band %s", used, allowed, band.name),
+			}
+		}
+	}
+	return nil
+}
+
+// Transmitted charges the airtime of the downlink item to the duty cycle of
+// the band it is transmitted in.
+func (s *DownlinkScheduler) Transmitted(gatewayID lorawan.EUI64, region frequency_plan.BandName, item *gw.DownlinkFrameItem, now time.Time) {
+	if s.dutyCycleWindow <= 0 {
+		return
+	}
+	band, ok := dutyCycleBandFor(region, item.GetTxInfo().GetFrequency())
+	if !ok {
+		return
+	}
+	airtime, err := airtime.DownlinkItemAirtime(item)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		t   = s.timing(gatewayID)
+		key = dutyCycleKey{region, band.name}
+	)
+	t.dutyCycleUsed(key, now, s.dutyCycleWindow)
+	t.transmissions[key] = append(t.transmissions[key], transmission{at: now, airtime: airtime})
+}
+
+// DutyCycleUsage returns per gateway the fraction of the duty cycle window
+// that each band was used for transmissions. Bands are keyed by region and
+// band name, e.g. "EU868/869.4-869.65".
+func (s *DownlinkScheduler) DutyCycleUsage() map[lorawan.EUI64]map[string]float64 {
+	usage := make(map[lorawan.EUI64]map[string]float64)
+	if s.dutyCycleWindow <= 0 {
+		return usage
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.timings {
+		for key := range t.transmissions {
+			used := t.dutyCycleUsed(key, now, s.dutyCycleWindow)
+			if used == 0 {
+				continue
+			}
+			if usage[id] == nil {
+				usage[id] = make(map[string]float64)
+			}
+			usage[id][key.String()] = float64(used) / float64(s.dutyCycleWindow)
+		}
+	}
+	return usage
+}
+
+// dutyCycleUsed drops transmissions that are outside the window and returns
+// the airtime used in the band within the window.
+func (t *gatewayTiming) dutyCycleUsed(band dutyCycleKey, now time.Time, window time.Duration) time.Duration {
+	var (
+		used          time.Duration
+		transmissions = t.transmissions[band][:0]
+	)
+	for _, tx := range t.transmissions[band] {
+		if now.Sub(tx.at) < window {
+			transmissions = append(transmissions, tx)
+			used += tx.airtime
+		}
+	}
+	if len(transmissions) == 0 {
+		delete(t.transmissions, band)
+	} else {
+		t.transmissions[band] = transmissions
+	}
+	return used
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+const (
+	// phyPayloadOverhead are the bytes in the PHYPayload that are not part of
+	// the MACPayload, the MHDR (1 byte) and MIC (4 bytes).
+	phyPayloadOverhead = 5
+)
+
+// validateDownlinkSize returns a *DownlinkTooLargeError if the MAC payload in
+// item exceeds the regional maximum for the data rate it is scheduled on. The
+// MAC payload includes the frame header with MAC commands in FOpts, a MAC
+// command only payload (FPort 0) is part of the FRMPayload and is therefore
+// validated as well.
+//
+// Items for which the region or data rate can't be determined are not
+// validated and left to the gateway.
+func validateDownlinkSize(region frequency_plan.BandName, item *gw.DownlinkFrameItem) error {
+	lora := item.GetTxInfo().GetModulation().GetLora()
+	if lora == nil {
+		return nil
+	}
+
+	b, err := regionBand(region)
+	if err != nil {
+		return nil
+	}
+
+	dr, err := b.GetDataRateIndex(false, band.DataRate{
+		Modulation:   band.LoRaModulation,
+		SpreadFactor: int(lora.GetSpreadingFactor()),
+		Bandwidth:    int(lora.GetBandwidth() / 1000),
+	})
+	if err != nil {
+		return nil
+	}
+
+	max, err := b.GetMaxPayloadSizeForDataRateIndex(band.LoRaWAN_1_0_3, band.RegParamRevA, dr)
+	if err != nil {
+		return nil
+	}
+
+	if size := len(item.GetPhyPayload()) - phyPayloadOverhead; size > max.M {
+		return &DownlinkTooLargeError{
+			DataRate: dr,
+			Size:     size,
+			Max:      max.M,
+		}
+	}
+	return nil
+}
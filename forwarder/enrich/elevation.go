@@ -0,0 +1,185 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package enrich
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+
+	h3light "github.com/ThingsIXFoundation/h3-light"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// hgtVoid marks samples without data in SRTM tiles.
+const hgtVoid = -32768
+
+// Elevation adds the terrain elevation at the gateways registered location
+// to the uplink metadata. Elevations are read from a directory with SRTM
+// .hgt tiles (1 or 3 arc-second), as distributed by NASA/USGS. Tiles are
+// named after their south-west corner, e.g. N52E005.hgt, and are read on
+// demand, elevations are cached per location.
+//
+// It sets thingsix_terrain_elevation to the elevation in meters above sea
+// level and, if the gateway registered its altitude, thingsix_antenna_elevation
+// to the terrain elevation plus the gateway altitude.
+type Elevation struct {
+	dir   string
+	cache *lru.Cache[string, elevationSample]
+}
+
+type elevationSample struct {
+	meters float64
+	ok     bool
+}
+
+// NewElevation returns an elevation enricher that reads tiles from dir.
+func NewElevation(dir string) (*Elevation, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid elevation tile directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("invalid elevation tile directory: %s is not a directory", dir)
+	}
+	cache, err := lru.New[string, elevationSample](4096)
+	if err != nil {
+		return nil, err
+	}
+	return &Elevation{dir: dir, cache: cache}, nil
+}
+
+// Name implements Enricher.
+func (e *Elevation) Name() string {
+	return "elevation"
+}
+
+// Enrich implements Enricher.
+func (e *Elevation) Enrich(gw *gateway.Gateway, metadata map[string]string) error {
+	if gw.Details == nil || gw.Details.Location == nil {
+		return nil
+	}
+	location := *gw.Details.Location
+
+	sample, ok := e.cache.Get(location)
+	if !ok {
+		cell, err := h3light.CellFromString(location)
+		if err != nil {
+			return fmt.Errorf("invalid gateway location %q: %w", location, err)
+		}
+		lat, lon := cell.LatLon()
+		if sample.meters, sample.ok, err = e.Lookup(lat, lon); err != nil {
+			return err
+		}
+		e.cache.Add(location, sample)
+	}
+	if !sample.ok {
+		return nil
+	}
+
+	metadata["thingsix_terrain_elevation"] = fmt.Sprintf("%.0f", sample.meters)
+	if gw.Details.Altitude != nil {
+		metadata["thingsix_antenna_elevation"] = fmt.Sprintf("%.0f", sample.meters+float64(*gw.Details.Altitude))
+	}
+	return nil
+}
+
+// Lookup returns the terrain elevation in meters at the given location. It
+// returns false when there is no tile for the location or the tile has no
+// data for it.
+func (e *Elevation) Lookup(lat, lon float64) (float64, bool, error) {
+	lat0, lon0 := math.Floor(lat), math.Floor(lon)
+
+	f, err := os.Open(filepath.Join(e.dir, hgtTileName(int(lat0), int(lon0))))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := int(math.Sqrt(float64(info.Size() / 2)))
+	if size < 2 || int64(size*size*2) != info.Size() {
+		return 0, false, fmt.Errorf("invalid elevation tile %s", f.Name())
+	}
+
+	// rows run from north to south, columns from west to east
+	var (
+		y      = (lat0 + 1 - lat) * float64(size-1)
+		x      = (lon - lon0) * float64(size-1)
+		row    = int(y)
+		col    = int(x)
+		dy, dx = y - float64(row), x - float64(col)
+	)
+	read := func(r, c int) (float64, bool, error) {
+		if r >= size {
+			r = size - 1
+		}
+		if c >= size {
+			c = size - 1
+		}
+		var buf [2]byte
+		if _, err := f.ReadAt(buf[:], int64(r*size+c)*2); err != nil {
+			return 0, false, err
+		}
+		v := int16(binary.BigEndian.Uint16(buf[:]))
+		return float64(v), v != hgtVoid, nil
+	}
+
+	var (
+		samples [4]float64
+		valid   = true
+	)
+	for i, rc := range [4][2]int{{row, col}, {row, col + 1}, {row + 1, col}, {row + 1, col + 1}} {
+		v, ok, err := read(rc[0], rc[1])
+		if err != nil {
+			return 0, false, err
+		}
+		samples[i], valid = v, valid && ok
+	}
+
+	if !valid {
+		// don't interpolate with voids, fall back to the nearest sample
+		return read(int(math.Round(y)), int(math.Round(x)))
+	}
+
+	// bilinear interpolation between the surrounding samples
+	top := samples[0]*(1-dx) + samples[1]*dx
+	bottom := samples[2]*(1-dx) + samples[3]*dx
+	return top*(1-dy) + bottom*dy, true, nil
+}
+
+// hgtTileName returns the name of the tile with the given south-west corner.
+func hgtTileName(lat, lon int) string {
+	ns, ew := 'N', 'E'
+	if lat < 0 {
+		ns, lat = 'S', -lat
+	}
+	if lon < 0 {
+		ew, lon = 'W', -lon
+	}
+	return fmt.Sprintf("%c%02d%c%03d.hgt", ns, lat, ew, lon)
+}
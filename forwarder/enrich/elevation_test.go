@@ -0,0 +1,83 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package enrich
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTile(t *testing.T, dir, name string, samples []int16) {
+	t.Helper()
+	buf := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.BigEndian.PutUint16(buf[2*i:], uint16(s))
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestElevationLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeTile(t, dir, "N52E005.hgt", []int16{
+		0, 10, 20,
+		30, 40, 50,
+		60, 70, hgtVoid,
+	})
+
+	e, err := NewElevation(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lat, lon float64
+		want     float64
+		ok       bool
+	}{
+		{52.5, 5, 30, true},
+		{52, 5, 60, true},
+		{52.75, 5.25, 20, true},
+		{52.5, 5.5, 40, true},
+		// interpolation would use the void, use the nearest sample instead
+		{52.2, 5.6, 70, true},
+		{52.1, 5.9, 0, false},
+		// no tile
+		{10, 10, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok, err := e.Lookup(tt.lat, tt.lon)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("lookup %f,%f: got %f (%v), want %f (%v)", tt.lat, tt.lon, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHgtTileName(t *testing.T) {
+	if got := hgtTileName(52, 5); got != "N52E005.hgt" {
+		t.Errorf("got %s", got)
+	}
+	if got := hgtTileName(-1, -74); got != "S01W074.hgt" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package enrich contains optional plugins that add context to the metadata
+// of uplinks before they are forwarded to routers.
+package enrich
+
+import (
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/sirupsen/logrus"
+)
+
+// Enricher adds metadata to uplinks received by a gateway.
+type Enricher interface {
+	// Name identifies the enricher in logs.
+	Name() string
+	// Enrich adds metadata for an uplink received by gw. It is called for
+	// each uplink and must therefore be fast, expensive lookups must be
+	// cached. Keys must not collide with metadata set by the forwarder.
+	Enrich(gw *gateway.Gateway, metadata map[string]string) error
+}
+
+// Chain runs multiple enrichers in order.
+type Chain []Enricher
+
+// Enrich runs all enrichers in the chain. Errors are logged and don't stop
+// the remaining enrichers from running.
+func (c Chain) Enrich(gw *gateway.Gateway, metadata map[string]string) {
+	for _, e := range c {
+		if err := e.Enrich(gw, metadata); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"enricher":      e.Name(),
+				"gw_network_id": gw.NetworkID,
+			}).Debug("unable to enrich uplink metadata")
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+)
+
+var (
+	// ErrDownlinkTooLarge is the error that DownlinkTooLargeError wraps, it can
+	// be used with errors.Is.
+	ErrDownlinkTooLarge = errs.New(errs.ErrInvalidArgument, "downlink payload too large")
+	// ErrDownlinkQueueFull is returned when a gateway has no downlink
+	// capacity left.
+	ErrDownlinkQueueFull = errs.New(errs.ErrResourceExhausted, "gateway downlink queue full")
+	// ErrDownlinkFrequencyNotAllowed is the error that
+	// DownlinkFrequencyNotAllowedError wraps, it can be used with errors.Is.
+	ErrDownlinkFrequencyNotAllowed = errs.New(errs.ErrInvalidArgument, "downlink frequency not allowed")
+	// ErrUnknownCountryProfile is returned when a country is configured for
+	// which no regulatory profile exists.
+	ErrUnknownCountryProfile = errs.New(errs.ErrInvalidArgument, "unknown country profile")
+	// ErrBandPlanViolation is the error that BandPlanViolationError wraps, it
+	// can be used with errors.Is.
+	ErrBandPlanViolation = errs.New(errs.ErrInvalidArgument, "band plan violation")
+	// ErrSelfTestInProgress is returned when a self-test is requested for a
+	// gateway that is already being tested.
+	ErrSelfTestInProgress = errs.New(errs.ErrAlreadyExists, "self-test already in progress")
+	// ErrSelfTestNotFound is returned when no self-test ran for a gateway.
+	ErrSelfTestNotFound = errs.New(errs.ErrNotFound, "no self-test for gateway")
+	// ErrInvalidSimulatedDownlink is returned when a simulated downlink can't
+	// be transmitted by the gateway or violates its regional limits.
+	ErrInvalidSimulatedDownlink = errs.New(errs.ErrInvalidArgument, "invalid simulated downlink")
+	// ErrInvalidInjectedUplink is returned when an injected uplink is not a
+	// valid LoRaWAN frame or has invalid transmission parameters.
+	ErrInvalidInjectedUplink = errs.New(errs.ErrInvalidArgument, "invalid injected uplink")
+	// ErrSimulatedDownlinkNotLeader is returned when a simulated downlink is
+	// requested on a replica that is not the leader and doesn't transmit.
+	ErrSimulatedDownlinkNotLeader = errs.New(errs.ErrFailedPrecondition, "replica is not the leader")
+	// ErrRouterNotFound is returned when no router client runs for the
+	// requested router.
+	ErrRouterNotFound = errs.New(errs.ErrNotFound, "router not found")
+	// ErrNoUplinkBuffer is returned when buffered uplinks are flushed while
+	// the uplink buffer is not enabled.
+	ErrNoUplinkBuffer = errs.New(errs.ErrFailedPrecondition, "uplink buffer not enabled")
+	// ErrNoRouterOnline is returned when buffered uplinks are replayed while
+	// no router is connected.
+	ErrNoRouterOnline = errs.New(errs.ErrNoRoute, "no router online")
+	// ErrSiteNotFound is returned when the requested site is not
+	// configured.
+	ErrSiteNotFound = errs.New(errs.ErrNotFound, "site not found")
+	// ErrGatewayStoreReadOnly is returned when gateways are changed in a
+	// store that doesn't support changes.
+	ErrGatewayStoreReadOnly = errs.New(errs.ErrNotSupported, "gateway store doesn't support changes")
+	// ErrDownlinkDutyCycle is the error that DownlinkTimingError wraps when
+	// the downlink would exceed the duty cycle limit.
+	ErrDownlinkDutyCycle = errs.New(errs.ErrDutyCycle, "downlink exceeds duty cycle limit")
+	// ErrDownlinkReceiveWindow is the error that DownlinkTimingError wraps
+	// when the downlink can't be transmitted within the receive windows.
+	ErrDownlinkReceiveWindow = errs.New(errs.ErrInvalidArgument, "downlink outside receive window")
+)
+
+// DownlinkTooLargeError is returned for downlinks with a MAC payload that
+// exceeds the regional maximum for the data rate the downlink is scheduled on.
+type DownlinkTooLargeError struct {
+	// DataRate is the regional data rate index the downlink is scheduled on
+	DataRate int
+	// Size is the size of the MAC payload including MAC commands in FOpts
+	Size int
+	// Max is the maximum MAC payload size for the data rate
+	Max int
+}
+
+func (e *DownlinkTooLargeError) Error() string {
+	return fmt.Sprintf("downlink MAC payload of %d bytes exceeds maximum of %d bytes for DR%d", e.Size, e.Max, e.DataRate)
+}
+
+func (e *DownlinkTooLargeError) Unwrap() error {
+	return ErrDownlinkTooLarge
+}
+
+// DownlinkFrequencyNotAllowedError is returned for downlinks scheduled on a
+// frequency that is not allowed in the country the gateway is located in.
+type DownlinkFrequencyNotAllowedError struct {
+	// Frequency the downlink is scheduled on in Hz
+	Frequency uint32
+	// Country is the country profile that was applied
+	Country string
+}
+
+func (e *DownlinkFrequencyNotAllowedError) Error() string {
+	return fmt.Sprintf("downlink frequency %d Hz not allowed in %s", e.Frequency, e.Country)
+}
+
+func (e *DownlinkFrequencyNotAllowedError) Unwrap() error {
+	return ErrDownlinkFrequencyNotAllowed
+}
+
+// BandPlanViolationError is returned for uplinks and downlinks on a
+// frequency or data rate that is not part of the band plan of the region the
+// gateway operates in.
+type BandPlanViolationError struct {
+	Region frequency_plan.BandName
+	// Direction is uplink or downlink
+	Direction string
+	// Reason is frequency or data_rate
+	Reason string
+	// Details describes the frequency or data rate that is not allowed
+	Details string
+}
+
+func (e *BandPlanViolationError) Error() string {
+	return fmt.Sprintf("%s %s not allowed in band plan %s", e.Direction, e.Details, e.Region)
+}
+
+func (e *BandPlanViolationError) Unwrap() error {
+	return ErrBandPlanViolation
+}
@@ -0,0 +1,298 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventStreamQueueSize is the number of events that are queued for a
+	// connection before events are dropped.
+	eventStreamQueueSize = 512
+	// eventStreamWriteTimeout is the time a client has to accept a message
+	// before the connection is closed.
+	eventStreamWriteTimeout = 10 * time.Second
+	// eventStreamPingInterval is the interval on which pings are sent to
+	// detect dead connections.
+	eventStreamPingInterval = 30 * time.Second
+)
+
+var eventStreamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// the API allows cross origin requests, dashboards are served from
+	// different origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// eventStreamFilter determines which packet events are sent to a client.
+// Empty fields match all events.
+type eventStreamFilter struct {
+	Types    []PacketEventType `json:"types,omitempty"`
+	Gateways []lorawan.EUI64   `json:"gateways,omitempty"`
+	DevAddrs []string          `json:"devAddrs,omitempty"`
+	Regions  []string          `json:"regions,omitempty"`
+}
+
+// eventStreamFilterFromQuery returns the filter from the comma separated
+// type, gateway, devaddr and region query parameters.
+func eventStreamFilterFromQuery(r *http.Request) (*eventStreamFilter, error) {
+	var (
+		q      = r.URL.Query()
+		filter eventStreamFilter
+	)
+	for _, typ := range splitQuery(q.Get("type")) {
+		filter.Types = append(filter.Types, PacketEventType(typ))
+	}
+	for _, id := range splitQuery(q.Get("gateway")) {
+		var eui lorawan.EUI64
+		if err := eui.UnmarshalText([]byte(id)); err != nil {
+			return nil, err
+		}
+		filter.Gateways = append(filter.Gateways, eui)
+	}
+	filter.DevAddrs = splitQuery(q.Get("devaddr"))
+	filter.Regions = splitQuery(q.Get("region"))
+	return &filter, nil
+}
+
+func splitQuery(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func (f *eventStreamFilter) match(ev *PacketEvent) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, typ := range f.Types {
+			found = found || typ == ev.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Gateways) > 0 {
+		found := false
+		for _, id := range f.Gateways {
+			found = found || id == ev.GatewayNetworkID || id == ev.GatewayLocalID
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.DevAddrs) > 0 {
+		found := false
+		for _, addr := range f.DevAddrs {
+			found = found || strings.EqualFold(addr, ev.DevAddr)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Regions) > 0 {
+		found := false
+		for _, region := range f.Regions {
+			found = found || strings.EqualFold(region, ev.Region)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// eventStreamMessage is sent to clients. It either carries a packet event or
+// reports the number of events that were dropped because the client didn't
+// keep up.
+type eventStreamMessage struct {
+	Type    string       `json:"type"`
+	Event   *PacketEvent `json:"event,omitempty"`
+	Dropped uint64       `json:"dropped,omitempty"`
+}
+
+// eventStreamConn is a websocket client that receives packet events.
+type eventStreamConn struct {
+	conn *websocket.Conn
+	log  *logrus.Entry
+
+	mu      sync.Mutex
+	filter  *eventStreamFilter
+	queue   []*PacketEvent
+	dropped uint64
+	// pending is signalled when events are queued
+	pending chan struct{}
+
+	// done is closed when the client is disconnected
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// EventStream upgrades the connection to a websocket and streams packet
+// events as JSON. The initial filter is taken from the query parameters and
+// can be replaced by sending a filter object over the websocket. If the
+// client can't keep up events are dropped and the client is informed with a
+// dropped message.
+func (svc APIService) EventStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := eventStreamFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, "invalid filter", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := eventStreamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // upgrader replied with an error
+	}
+
+	client := &eventStreamConn{
+		conn:    conn,
+		log:     logrus.WithField("remote", r.RemoteAddr),
+		filter:  filter,
+		pending: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	// the connection is hijacked from the HTTP server and is kept alive as
+	// long as the client answers pings
+	_ = conn.SetReadDeadline(time.Now().Add(2 * eventStreamPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * eventStreamPingInterval))
+	})
+
+	events := make(chan *PacketEvent, eventStreamQueueSize)
+	svc.packetEvents.Subscribe(events)
+	defer svc.packetEvents.Unsubscribe(events)
+
+	client.log.Debug("event stream client connected")
+	defer client.log.Debug("event stream client disconnected")
+
+	go client.readFilters()
+	go client.write()
+
+	for {
+		select {
+		case ev := <-events:
+			client.enqueue(ev)
+		case <-client.done:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// enqueue adds the event to the send queue if it matches the filter. If the
+// queue is full the oldest event is dropped.
+func (c *eventStreamConn) enqueue(ev *PacketEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.filter.match(ev) {
+		return
+	}
+	if len(c.queue) >= eventStreamQueueSize {
+		c.queue = c.queue[1:]
+		c.dropped++
+	}
+	c.queue = append(c.queue, ev)
+
+	select {
+	case c.pending <- struct{}{}:
+	default:
+	}
+}
+
+// readFilters reads filter updates from the client until the connection is
+// closed.
+func (c *eventStreamConn) readFilters() {
+	defer c.close()
+	for {
+		var filter eventStreamFilter
+		if err := c.conn.ReadJSON(&filter); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				c.log.WithError(err).Debug("invalid event stream filter")
+			}
+			return
+		}
+		c.mu.Lock()
+		c.filter = &filter
+		c.mu.Unlock()
+	}
+}
+
+// write sends queued events to the client. The connection is closed when
+// the client doesn't accept messages within eventStreamWriteTimeout.
+func (c *eventStreamConn) write() {
+	defer c.close()
+
+	ping := time.NewTicker(eventStreamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.pending:
+			c.mu.Lock()
+			queue, dropped := c.queue, c.dropped
+			c.queue, c.dropped = nil, 0
+			c.mu.Unlock()
+
+			if dropped > 0 {
+				if !c.send(&eventStreamMessage{Type: "dropped", Dropped: dropped}) {
+					return
+				}
+			}
+			for _, ev := range queue {
+				if !c.send(&eventStreamMessage{Type: "event", Event: ev}) {
+					return
+				}
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(eventStreamWriteTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *eventStreamConn) send(msg *eventStreamMessage) bool {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(eventStreamWriteTimeout))
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.log.WithError(err).Debug("unable to write to event stream client")
+		return false
+	}
+	return true
+}
+
+// close signals all routines serving the client to stop.
+func (c *eventStreamConn) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
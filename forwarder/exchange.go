@@ -20,11 +20,17 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/ThingsIXFoundation/packet-handling/airtime"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/broadcast"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/enrich"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/ThingsIXFoundation/router-api/go/router"
 	"github.com/brocaar/lorawan"
@@ -52,18 +58,120 @@ type Exchange struct {
 	routingTable *RoutingTable
 	// checks if a packet is possibly a mapper packet and if yes handles it.
 	mapperForwarder *MapperForwarder
+	// heatmap aggregates uplinks and airtime per gateway per hour
+	heatmap *AirtimeHeatmap
+	// deviceDensity estimates the number of devices per gateway
+	deviceDensity *DeviceDensity
+	// joinAccepts holds join-accept parameters for received join requests,
+	// nil if disabled
+	joinAccepts *JoinAcceptCache
+	// selfTests runs end-to-end tests against gateways
+	selfTests *SelfTester
+	// downlinkSimulator sends synthetic downlinks to gateways
+	downlinkSimulator *DownlinkSimulator
+	// sites groups gateways by their site tag
+	sites *Sites
+	// health tracks the state reported on the health endpoints
+	health *forwarderHealth
+	// txPower caps downlink transmit power to the country profile of the
+	// gateway, nil if disabled
+	txPower *TxPowerLimiter
+	// bandPlans validates uplinks and downlinks against the band plan of
+	// the gateway, nil if disabled
+	bandPlans *BandPlans
+	// uplinkLanes queues received uplinks for workers and gives join-requests
+	// precedence, nil if disabled
+	uplinkLanes *UplinkLanes
+	// scheduler limits in-flight downlinks per gateway, nil if disabled
+	scheduler *DownlinkScheduler
+	// slo tracks delivery SLIs, nil if disabled
+	slo *SLOTracker
+	// downlinkStats tracks downlink results per device, nil if disabled
+	downlinkStats *DownlinkStats
+	// clockDrift estimates gateway clock drift and compensates downlink
+	// delays for it, nil if disabled
+	clockDrift *ClockDriftEstimator
+	// leader elects the replica that sends downlinks, nil if disabled
+	leader *LeaderElector
+	// crcPolicies determines how uplinks without valid CRC are handled
+	crcPolicies crcPolicies
+	// uplinkMetadata normalizes the radio metadata of received uplinks
+	uplinkMetadata uplinkMetadata
+	// coverageGaps reports H3 cells with weak coverage
+	coverageGaps *CoverageGapReporter
+	// coverageProofs signs reception statistics per gateway, nil if disabled
+	coverageProofs *CoverageProofs
+	// h3Resolution is the resolution of the gateway location H3 cell that is
+	// included in metadata and stats, -1 for the registered resolution
+	h3Resolution int
+	// enrichers add optional context to the metadata of uplinks
+	enrichers enrich.Chain
+	// packetEvents publishes metadata of packets that passed the exchange
+	packetEvents *broadcast.Broadcaster[*PacketEvent]
+	// recentEvents holds the last packet events for the API
+	recentEvents *recentPacketEvents
+	// downlinkPackets correlates downlink ACKs with the downlink packet id
+	downlinkPackets *downlinkPacketIDs
+	// payloadStats tracks FPort and payload size distributions
+	payloadStats *PayloadStats
+	// channelStats counts uplinks per channel and data rate per gateway
+	channelStats *ChannelStats
+	// alerter keeps track of active alerts and notifies webhooks
+	alerter *Alerter
+	// sfCongestion raises advisories for gateways dominated by SF11/SF12
+	// traffic, nil if disabled
+	sfCongestion *SFCongestionDetector
+	// fcntAnomalies flags unexpected frame counter progressions, nil if
+	// disabled
+	fcntAnomalies *FCntAnomalyDetector
+	// telemetry tracks gateway temperature and supply voltage, nil if
+	// disabled
+	telemetry *GatewayTelemetry
+	// registryChanges raises alerts when the registration of a gateway in
+	// the store changes, nil if disabled
+	registryChanges *RegistryWatcher
+	// dedup collapses copies of a frame received by several gateways, nil
+	// if disabled
+	dedup *UplinkDeduplicator
+	// uplinkBuffer queues uplinks on disk while no router is reachable, nil
+	// if disabled
+	uplinkBuffer *UplinkBuffer
+	// onboarding posts onboarding state changes of gateways in the store to
+	// webhooks, nil if disabled
+	onboarding *OnboardingNotifier
+	// complianceHold exports sealed records of packets of devices under a
+	// compliance hold, nil if disabled
+	complianceHold *ComplianceHoldExporter
+	// clockCheck verifies the host clock against NTP, nil if disabled
+	clockCheck *ClockChecker
+	// gossip exchanges received frames with forwarders at the same site,
+	// nil if disabled
+	gossip *GossipPeers
+	// heartbeat posts signed forwarder health to the monitoring endpoint,
+	// nil if disabled
+	heartbeat *Heartbeat
+	// logIDs formats device identifiers in packet logs
+	logIDs IDObfuscator
+	// analyticsIDs pseudonymizes device identifiers in analytics exports,
+	// nil if disabled
+	analyticsIDs IDObfuscator
 }
 
 // NewExchange instantiates a new packet exchange where gateways and
 // routers can exchange packets.
 func NewExchange(ctx context.Context, cfg *Config) (*Exchange, error) {
+	// limit metric series before the first packet is counted
+	if cfg.Metrics != nil {
+		configureMetricsCardinality(cfg.Metrics.Cardinality)
+	}
+
 	// currently allow all gateways. Once the forwarders exchange only forwards
 	// packets for onboarded gateway we need to use a filtered gateway store
 	// that filters out gateways that are not onboarded.
 	store, err := gateway.NewGatewayStore(ctx,
 		&cfg.Forwarder.Gateways.Store, &cfg.Forwarder.Gateways.Registry)
 	if err != nil {
-		logrus.WithError(err).Fatal("unable to load gateway store")
+		exchangeLog.WithError(err).Fatal("unable to load gateway store")
 	}
 
 	// create gateway backend
@@ -78,27 +186,178 @@ func NewExchange(ctx context.Context, cfg *Config) (*Exchange, error) {
 		return nil, err
 	}
 	// build routing table to determine where data must be forwarded to
+	payloadStats := NewPayloadStats()
 	routingTable, err := buildRoutingTable(cfg, store, accounter)
 	if err != nil {
 		return nil, err
 	}
+	routingTable.payloadStats = payloadStats
+
+	crcPolicies, err := buildCRCPolicies(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	uplinkMetadata, err := buildUplinkMetadata(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	// create a logger that logs gateways that have not been seen earlier
 	recorder := gateway.NewUnknownGatewayLogger(cfg.Forwarder.Gateways.RecordUnknown)
 
 	// instantiate exchange
 	exchange := &Exchange{
+		downlinkPackets:      newDownlinkPacketIDs(),
+		payloadStats:         payloadStats,
+		channelStats:         NewChannelStats(),
 		backend:              backend,
 		accounter:            accounter,
 		routingTable:         routingTable,
 		gateways:             store,
 		recordUnknownGateway: recorder,
+		heatmap:              NewAirtimeHeatmap(cfg.Forwarder.Heatmap, cfg.H3Resolution()),
+		h3Resolution:         cfg.H3Resolution(),
+		coverageGaps:         NewCoverageGapReporter(cfg.Forwarder.CoverageGaps),
+		deviceDensity:        NewDeviceDensity(),
+		crcPolicies:          crcPolicies,
+		uplinkMetadata:       uplinkMetadata,
+		packetEvents:         newPacketEventBroadcaster(),
+		recentEvents:         newRecentPacketEvents(1000),
+		alerter:              NewAlerter(cfg.Forwarder.Alerts),
+		logIDs:               plainIDs{},
+	}
+
+	if cfg.Forwarder.Pseudonymization != nil {
+		ids, err := NewIDObfuscator(cfg.Forwarder.Pseudonymization)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Forwarder.Pseudonymization.Logs {
+			exchange.logIDs = ids
+		}
+		if cfg.Forwarder.Pseudonymization.Analytics {
+			exchange.analyticsIDs = ids
+		}
+	}
+	routingTable.logIDs = exchange.logIDs
+
+	if cfg.Forwarder.ComplianceHold != nil {
+		if exchange.complianceHold, err = NewComplianceHoldExporter(cfg.Forwarder.ComplianceHold); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Forwarder.Gossip != nil {
+		if exchange.gossip, err = NewGossipPeers(cfg.Forwarder.Gossip); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Forwarder.UplinkLanes != nil {
+		exchange.uplinkLanes = NewUplinkLanes(cfg.Forwarder.UplinkLanes, exchange.handleUplinkFrame)
+	}
+
+	if cfg.Forwarder.DownlinkScheduler != nil {
+		exchange.scheduler = NewDownlinkScheduler(cfg.Forwarder.DownlinkScheduler)
+	}
+
+	if cfg.Forwarder.SLO != nil {
+		exchange.slo = NewSLOTracker(cfg.Forwarder.SLO, exchange.alerter)
+		routingTable.slo = exchange.slo
+	}
+
+	if cfg.Forwarder.DownlinkStats != nil {
+		exchange.downlinkStats = NewDownlinkStats(cfg.Forwarder.DownlinkStats)
+	}
+
+	if cfg.Forwarder.ClockDrift != nil {
+		exchange.clockDrift = NewClockDriftEstimator(cfg.Forwarder.ClockDrift)
+	}
+
+	if cfg.Forwarder.SFCongestion != nil {
+		exchange.sfCongestion = NewSFCongestionDetector(cfg.Forwarder.SFCongestion, exchange.alerter)
+	}
+
+	if cfg.Forwarder.FCntAnomalies != nil {
+		exchange.fcntAnomalies = NewFCntAnomalyDetector(cfg.Forwarder.FCntAnomalies, exchange.alerter)
+	}
+
+	if cfg.Forwarder.Telemetry != nil {
+		exchange.telemetry = NewGatewayTelemetry(cfg.Forwarder.Telemetry, exchange.alerter)
+	}
+
+	if cfg.Forwarder.ClockCheck != nil {
+		exchange.clockCheck = NewClockChecker(cfg.Forwarder.ClockCheck, exchange.alerter)
+	}
+	if cfg.Forwarder.RegistryChanges != nil {
+		exchange.registryChanges = NewRegistryWatcher(cfg.Forwarder.RegistryChanges, store, exchange.alerter)
+	}
+	if cfg.Forwarder.Deduplication != nil {
+		if exchange.dedup, err = NewUplinkDeduplicator(cfg.Forwarder.Deduplication); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Forwarder.UplinkBuffer != nil {
+		if exchange.uplinkBuffer, err = NewUplinkBuffer(cfg.Forwarder.UplinkBuffer); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Forwarder.OnboardingWebhooks != nil {
+		if exchange.onboarding, err = NewOnboardingNotifier(cfg.Forwarder.OnboardingWebhooks, store); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Forwarder.Heartbeat != nil {
+		if exchange.heartbeat, err = NewHeartbeat(cfg.Forwarder.Heartbeat, store); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Forwarder.LeaderElection != nil {
+		if exchange.leader, err = NewLeaderElector(cfg.Forwarder.LeaderElection, cfg.Forwarder.Backend); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Forwarder.JoinAcceptCache != nil {
+		exchange.joinAccepts = NewJoinAcceptCache()
+	}
+
+	exchange.selfTests = NewSelfTester(exchange)
+	exchange.downlinkSimulator = NewDownlinkSimulator(exchange)
+	exchange.health = newForwarderHealth(cfg.Forwarder.Health)
+	if exchange.sites, err = NewSites(cfg.Forwarder.Gateways.Sites, store, exchange.channelStats, exchange.health.connectedGatewayPresence); err != nil {
+		return nil, err
+	}
+
+	if exchange.enrichers, err = buildEnrichers(cfg.Forwarder.Metadata.Enrichment); err != nil {
+		return nil, err
+	}
+
+	if cfg.Forwarder.TxPower != nil {
+		if exchange.txPower, err = NewTxPowerLimiter(cfg.Forwarder.TxPower); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Forwarder.BandPlan != nil {
+		if exchange.bandPlans, err = NewBandPlans(cfg.Forwarder.BandPlan); err != nil {
+			return nil, err
+		}
 	}
 
 	if exchange.mapperForwarder, err = NewMapperForwarder(cfg, exchange, store); err != nil {
 		return nil, err
 	}
 
+	if cfg.Forwarder.CoverageProofs != nil {
+		if exchange.coverageProofs, err = NewCoverageProofs(cfg.Forwarder.CoverageProofs, store, exchange.mapperForwarder.coverageClient); err != nil {
+			return nil, err
+		}
+	}
+
 	// backend uses callbacks to inform the exchange of events
 	backend.SetUplinkFrameFunc(exchange.uplinkFrameCallback)
 	backend.SetDownlinkTxAckFunc(exchange.downlinkTxAck)
@@ -114,11 +373,17 @@ func (e *Exchange) Run(ctx context.Context) {
 	// run the gateway store background tasks
 	go e.gateways.Run(ctx)
 
+	// start processing uplinks before the backend delivers them
+	if e.uplinkLanes != nil {
+		go e.uplinkLanes.Run(ctx)
+	}
+
 	// start backend and accept gateways
 	err := e.backend.Start()
 	if err != nil {
-		logrus.WithError(err).Fatal("could not start backend")
+		exchangeLog.WithError(err).Fatal("could not start backend")
 	}
+	atomic.StoreInt32(&e.health.backendStarted, 1)
 
 	// update the routing table periodically
 	go e.routingTable.Run(ctx)
@@ -126,17 +391,76 @@ func (e *Exchange) Run(ctx context.Context) {
 	// update the coverage-mapping-index periodically
 	go e.mapperForwarder.Run(ctx)
 
+	// generate coverage gap reports periodically
+	go e.coverageGaps.Run(ctx)
+
+	// sign gateway reception statistics periodically
+	if e.coverageProofs != nil {
+		go e.coverageProofs.Run(ctx)
+	}
+
+	// export device density estimates periodically
+	go e.deviceDensity.Run(ctx)
+
+	// keep recent packet events for the API
+	go e.recentEvents.Run(ctx, e)
+
+	// calculate SLIs and burn rates periodically
+	if e.slo != nil {
+		go e.slo.Run(ctx)
+	}
+
+	go e.alerter.Run(ctx)
+	if e.sfCongestion != nil {
+		go e.sfCongestion.Run(ctx)
+	}
+	if e.fcntAnomalies != nil {
+		go e.fcntAnomalies.Run(ctx)
+	}
+	if e.telemetry != nil {
+		go e.telemetry.Run(ctx)
+	}
+	if e.complianceHold != nil {
+		go e.complianceHold.Run(ctx)
+	}
+	if e.gossip != nil {
+		go e.gossip.Run(ctx)
+	}
+	if e.clockCheck != nil {
+		go e.clockCheck.Run(ctx)
+	}
+	if e.registryChanges != nil {
+		go e.registryChanges.Run(ctx)
+	}
+	if e.onboarding != nil {
+		go e.onboarding.Run(ctx)
+	}
+	if e.heartbeat != nil {
+		go e.heartbeat.Run(ctx)
+	}
+	if e.uplinkBuffer != nil {
+		go e.replayUplinks(ctx)
+	}
+
+	// compete with other replicas for sending downlinks
+	if e.leader != nil {
+		go e.leader.Run(ctx)
+	}
+
 	// wait for messages from the network and dispatch them to the chirpstack backend
 	for {
 		select {
 		case in, ok := <-e.routingTable.networkEvents: // incoming event from the network
 			if ok {
 				if frame := in.event.GetDownlinkFrameEvent(); frame != nil {
+					if e.slo != nil {
+						e.recordSLODownlink(in.source, frame)
+					}
 					e.handleDownlinkFrame(frame)
 				} else if airtimePayment := in.event.GetAirtimePaymentEvent(); airtimePayment != nil {
 					e.accounter.AddPayment(airtimePayment)
 				} else {
-					logrus.WithFields(logrus.Fields{
+					exchangeLog.WithFields(logrus.Fields{
 						"source": in.source.Endpoint,
 						"event":  fmt.Sprintf("%T", in.event),
 					}).Error("received unsupported network event")
@@ -145,34 +469,70 @@ func (e *Exchange) Run(ctx context.Context) {
 		case <-ctx.Done():
 			err := e.backend.Stop()
 			if err != nil {
-				logrus.WithError(err).Error("could not stop backend, stopping anyway")
+				exchangeLog.WithError(err).Error("could not stop backend, stopping anyway")
 			}
-			logrus.Info("packet exchange stopped")
+			exchangeLog.Info("packet exchange stopped")
 			return
 		}
 	}
 }
 
 func (e *Exchange) uplinkFrameCallback(frame *gw.UplinkFrame) {
+	if e.uplinkLanes != nil {
+		e.uplinkLanes.Dispatch(frame)
+		return
+	}
+	e.handleUplinkFrame(frame)
+}
+
+func (e *Exchange) handleUplinkFrame(frame *gw.UplinkFrame) {
+	e.processUplinkFrame(frame, newPacketID(), false)
+}
+
+// processUplinkFrame handles an uplink that is identified by packetID.
+// Injected uplinks are crafted through the API instead of received by the
+// gateway, they are flagged in their metadata and don't count as gateway
+// activity.
+func (e *Exchange) processUplinkFrame(frame *gw.UplinkFrame, packetID string, injected bool) {
 	gatewayLocalID, err := utils.Eui64FromString(frame.GetRxInfo().GetGatewayId())
 	if err != nil {
-		logrus.WithError(err).Warn("received uplink from gateway with invalid gateway ID")
+		exchangeLog.WithError(err).Warn("received uplink from gateway with invalid gateway ID")
 		return
 	}
 
-	log := logrus.WithField("gw_local_id", gatewayLocalID)
+	log := exchangeLog.WithFields(logrus.Fields{
+		"gw_local_id": gatewayLocalID,
+		"packet_id":   packetID,
+	})
+	if injected {
+		log = log.WithField("injected", true)
+	}
+
+	spanCtx, span := startUplinkSpan(frame, packetID)
+	defer span.End()
 
 	// ensure that received frame is from a trusted gateway if not drop it
 	gw, err := e.gateways.ByLocalIDString(frame.RxInfo.GatewayId)
 	if err != nil {
+		droppedFramesCounter.WithLabelValues("uplink", "unknown_gateway").Inc()
 		log.Warn("uplink from unknown gateway, drop packet")
 		_ = e.recordUnknownGateway.Record(gatewayLocalID)
 		return
 	}
+	if gw.Disabled {
+		droppedFramesCounter.WithLabelValues("uplink", "disabled_gateway").Inc()
+		log.Debug("uplink from disabled gateway, drop packet")
+		return
+	}
+
+	// round the radio metadata to the canonical representation
+	e.uplinkMetadata.normalize(frame)
 
 	// log frame details
+	region := gatewayRegion(gw, e.gateways)
 	log = log.WithField("gw_network_id", gw.NetworkID)
 	frameLog := log.WithFields(logrus.Fields{
+		"region":      region,
 		"rssi":        frame.GetRxInfo().GetRssi(),
 		"snr":         frame.GetRxInfo().GetSnr(),
 		"freq":        frame.GetTxInfo().GetFrequency(),
@@ -184,21 +544,62 @@ func (e *Exchange) uplinkFrameCallback(frame *gw.UplinkFrame) {
 		"payload_len": len(frame.GetPhyPayload()),
 	})
 
-	rxPacketsCounter.WithLabelValues(gw.NetworkID.String(), gw.LocalID.String()).Inc()
-	rxPacketPerFreqCounter.WithLabelValues(
-		gw.NetworkID.String(),
-		gw.LocalID.String(),
+	if !injected {
+		e.health.gatewaySeen(gw.LocalID, time.Now())
+		e.selfTests.ObserveUplink(gw, frame, time.Now())
+		if e.heartbeat != nil {
+			e.heartbeat.Seen(gw.NetworkID, time.Now())
+		}
+
+		if e.clockDrift != nil {
+			e.clockDrift.Observe(gw.NetworkID, gw.LocalID, frame, time.Now())
+		}
+	}
+
+	gatewayCounter(rxPacketsCounter, gw.NetworkID, gw.LocalID).Inc()
+	rxPacketsPerRegionCounter.WithLabelValues(string(region)).Inc()
+	gatewayCounter(rxPacketPerFreqCounter, gw.NetworkID, gw.LocalID,
 		fmt.Sprint(frame.GetTxInfo().GetFrequency())).Inc()
-	rxPacketPerModulationCounter.WithLabelValues(
-		gw.NetworkID.String(),
-		gw.LocalID.String(),
+	gatewayCounter(rxPacketPerModulationCounter, gw.NetworkID, gw.LocalID,
 		fmt.Sprint(frame.GetTxInfo().GetFrequency()),
 		fmt.Sprint(frame.GetTxInfo().GetModulation().GetLora().GetBandwidth()),
 		fmt.Sprint(frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor())).Inc()
 
+	// apply the CRC policy for uplinks without valid CRC
+	var (
+		crcStatus = frame.GetRxInfo().GetCrcStatus()
+		crcPolicy = e.crcPolicies.policy(crcStatus)
+	)
+	if !crcOK(crcStatus) {
+		frameLog = frameLog.WithField("crc", crcStatusLabel(crcStatus))
+		if crcPolicy == CRCPolicyDrop {
+			crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "dropped").Inc()
+			droppedFramesCounter.WithLabelValues("uplink", "crc").Inc()
+			frameLog.Debug("uplink without valid crc, drop packet")
+			return
+		}
+	}
+
+	// drop uplinks the gateway can't have received in its band plan, these
+	// are caused by misconfigured gateways or packet forwarders
+	if e.bandPlans != nil {
+		if err := e.bandPlans.ValidateUplink(region, frame); err != nil {
+			var violation *BandPlanViolationError
+			if errors.As(err, &violation) {
+				gatewayCounter(bandPlanViolationsCounter, gw.NetworkID, gw.LocalID, "uplink", violation.Reason).Inc()
+			}
+			droppedFramesCounter.WithLabelValues("uplink", "band_plan").Inc()
+			frameLog.WithError(err).Warn("uplink outside band plan, drop packet")
+			return
+		}
+	}
+
+	e.channelStats.Record(gw, region, frame, time.Now())
+
 	// convert the frame from its local format (gateway <-> exchange) into its network
 	// representation (exchange <-> router) so it can be broadcasted onto the network
 	if frame, err = localUplinkFrameToNetwork(gw, frame); err != nil {
+		droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
 		frameLog.WithError(err).Error("update uplink frame to network format failed, drop packet")
 		return
 	}
@@ -206,14 +607,37 @@ func (e *Exchange) uplinkFrameCallback(frame *gw.UplinkFrame) {
 	// decode it into a lorawan packet to determine what needs to be done
 	var phy lorawan.PHYPayload
 	if err := phy.UnmarshalBinary(frame.PhyPayload); err != nil {
+		droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
 		frameLog.WithError(err).Error("could not decode lorawan packet, drop packet")
 		return
 	}
 
 	airtime, _ := airtime.UplinkAirtime(frame)
 
+	if e.scheduler != nil {
+		e.scheduler.ObserveUplink(gw.NetworkID, frame, time.Now())
+	}
+
 	// Add some metadata to the frame that will be forwarded to end-applications
-	setChaindataInFrameMetadata(frame, gw, airtime)
+	setChaindataInFrameMetadata(frame, gw, airtime, e.h3Resolution)
+	e.sites.setFrameMetadata(frame, gw)
+	e.enrichers.Enrich(gw, frame.RxInfo.Metadata)
+	frame.RxInfo.Metadata[packetIDMetadataKey] = packetID
+	tracing.InjectMetadata(spanCtx, frame.RxInfo.Metadata)
+	if injected {
+		frame.RxInfo.Metadata[injectedMetadataKey] = "true"
+	}
+	if !crcOK(crcStatus) {
+		frame.RxInfo.Metadata["thingsix_crc_status"] = crcStatusLabel(crcStatus)
+	}
+	if cell, ok := gatewayH3Cell(gw, e.h3Resolution); ok {
+		cellCounter(rxPacketsPerCellCounter, cell.String()).Inc()
+	}
+
+	// injected uplinks were not received over the air and uplinks without a
+	// valid crc can be corrupt, neither must end up in coverage data signed
+	// on behalf of the gateway or in the traffic statistics
+	trusted := !injected && crcOK(crcStatus)
 
 	frameLog = frameLog.WithFields(logrus.Fields{
 		"type":    phy.MHDR.MType,
@@ -224,117 +648,263 @@ func (e *Exchange) uplinkFrameCallback(frame *gw.UplinkFrame) {
 	case lorawan.ConfirmedDataUp, lorawan.UnconfirmedDataUp:
 		mac, ok := phy.MACPayload.(*lorawan.MACPayload)
 		if !ok {
+			droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
 			frameLog.Error("invalid packet: data-up but no mac-payload, drop packet")
 			return
 		}
 		frameLog = frameLog.WithFields(logrus.Fields{
-			"dev_addr": mac.FHDR.DevAddr,
+			"dev_addr": e.logIDs.DevAddr(mac.FHDR.DevAddr),
 			"fcnt":     mac.FHDR.FCnt,
 			"nwk_id":   utils.NwkIdString(mac.FHDR.DevAddr),
 		})
 
-		rxPacketPerNwkIdCounter.WithLabelValues(gw.NetworkID.String(), gw.LocalID.String(), utils.NwkIdString(mac.FHDR.DevAddr)).Inc()
+		gatewayCounter(rxPacketPerNwkIdCounter, gw.NetworkID, gw.LocalID, utils.NwkIdString(mac.FHDR.DevAddr)).Inc()
+
+		if e.complianceHold != nil {
+			e.complianceHold.Record(PacketEventUplink, gw, packetID, mac.FHDR.DevAddr, frame.GetPhyPayload(), frame)
+		}
 
 		// check if the packet received could be a mapper packet and process it
-		if IsMaybeMapperPacket(frame, mac) {
+		if !injected && mapperForwardingFeature.Enabled() && IsMaybeMapperPacket(frame, mac) {
+			if !crcOK(crcStatus) {
+				crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "mapping").Inc()
+			} else {
+				e.recordCoverage(gw, frame, &phy, airtime)
+			}
 			e.mapperForwarder.HandleMapperPacket(frame, mac)
 			return
 		}
 
-		event := router.GatewayToRouterEvent{
-			GatewayInformation: &router.GatewayInformation{
-				PublicKey: gw.CompressedPubKeyBytes(),
-				Owner:     gw.OwnerBytes(),
-			},
-			Event: &router.GatewayToRouterEvent_UplinkFrameEvent{
-				UplinkFrameEvent: &router.UplinkFrameEvent{
-					UplinkFrame: frame,
-					AirtimeReceipt: &router.AirtimeReceipt{
-						Owner:   gw.OwnerBytes(),
-						Airtime: uint32(airtime.Milliseconds()),
-					},
-				},
-			},
+		if !crcOK(crcStatus) {
+			if crcPolicy == CRCPolicyMapping {
+				crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "dropped").Inc()
+				droppedFramesCounter.WithLabelValues("uplink", "crc").Inc()
+				frameLog.Debug("uplink without valid crc is not a mapper packet, drop packet")
+				return
+			}
+			crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "forwarded").Inc()
+		}
+
+		if trusted {
+			e.recordCoverage(gw, frame, &phy, airtime)
+			e.coverageGaps.ObserveUplink(gw, frame)
+			e.deviceDensity.Record(gw, mac.FHDR.DevAddr, time.Now())
+		}
+		if crcOK(crcStatus) {
+			e.payloadStats.RecordGateway(gw, frame, mac.FPort)
+			if e.sfCongestion != nil {
+				e.sfCongestion.Record(gw, frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor(),
+					airtime, mac.FHDR.DevAddr.String(), time.Now())
+			}
+			if e.fcntAnomalies != nil {
+				if kind := e.fcntAnomalies.Record(gw, mac.FHDR.DevAddr, mac.FHDR.FCnt, time.Now()); kind != "" {
+					frameLog.WithField("anomaly", kind).Debug("unexpected frame counter")
+				}
+			}
+		}
+
+		// uplinks forwarded by a relay are routed on the relays DevAddr
+		if isRelayedUplink(mac) {
+			gatewayCounter(relayFramesCounter, gw.NetworkID, gw.LocalID, "relayed_uplink").Inc()
+			setRelayMetadata(frame, mac)
+			frameLog = frameLog.WithField("relay", true)
+		}
+
+		ev, err := newUplinkGatewayEvent(gw, region, &phy, frame, airtime)
+		if err != nil {
+			droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
+			frameLog.WithError(err).Error("invalid packet, drop packet")
+			return
 		}
 
 		// packet is valid, router clients are subscribed to this uplink broadcaster
 		// and will receive it. If the router they are connected to is interested in
 		// the package it will send the packet to the router.
-		if !e.routingTable.gatewayEvents.TryBroadcast(&GatewayEvent{
-			uplink: &struct {
-				device lorawan.DevAddr
-				event  *router.GatewayToRouterEvent
-			}{
-				device: mac.FHDR.DevAddr,
-				event:  &event,
-			},
-			receivedFrom: gw,
-		}) {
-			frameLog.Warn("unable to broadcast uplink to routing table, drop packet")
+		e.broadcastUplink(ev, frame, false, frameLog)
+
+		pev := newUplinkPacketEvent(PacketEventUplink, gw, string(region), frame, airtime, &phy)
+		pev.DevAddr = mac.FHDR.DevAddr.String()
+		pev.FCnt = mac.FHDR.FCnt
+		e.publishPacketEvent(pev)
+	case lorawan.Proprietary:
+		// proprietary frames such as relay wake-on-radio frames, these don't
+		// have a DevAddr and are only forwarded to default routers
+		if !crcOK(crcStatus) {
+			if crcPolicy == CRCPolicyMapping {
+				crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "dropped").Inc()
+				droppedFramesCounter.WithLabelValues("uplink", "crc").Inc()
+				frameLog.WithField("uplink_id", frame.GetRxInfo().GetUplinkId()).
+					Debug("proprietary uplink without valid crc is not a mapper packet, drop packet")
+				return
+			}
+			crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "forwarded").Inc()
+		}
+
+		if trusted {
+			e.recordCoverage(gw, frame, &phy, airtime)
+		}
+
+		gatewayCounter(relayFramesCounter, gw.NetworkID, gw.LocalID, "proprietary").Inc()
+		setProprietaryMetadata(frame)
+
+		ev, err := newUplinkGatewayEvent(gw, region, &phy, frame, airtime)
+		if err != nil {
+			droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
+			frameLog.WithError(err).Error("invalid packet, drop packet")
+			return
+		}
+
+		if !e.routingTable.gatewayEvents.TryBroadcast(ev) {
+			droppedFramesCounter.WithLabelValues("uplink", "queue_full").Inc()
+			frameLog.Warn("unable to broadcast proprietary uplink to routing table, drop packet")
 		} else {
-			frameLog.Info("received packet")
+			frameLog.Info("received proprietary packet")
 		}
+
+		e.publishPacketEvent(newUplinkPacketEvent(PacketEventProprietary, gw, string(region), frame, airtime, &phy))
 	case lorawan.JoinRequest, lorawan.RejoinRequest:
 		// Filter by Xor8 filter on devEUI
 		jr, ok := phy.MACPayload.(*lorawan.JoinRequestPayload)
 		if !ok {
+			droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
 			log.Error("invalid packet: join but no join-payload, drop packet")
 			return
 		}
 
 		frameLog = frameLog.WithFields(logrus.Fields{
-			"dev_eui": jr.DevEUI,
+			"dev_eui": e.logIDs.DevEUI(jr.DevEUI),
 		})
 
+		if !crcOK(crcStatus) {
+			if crcPolicy == CRCPolicyMapping {
+				crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "dropped").Inc()
+				droppedFramesCounter.WithLabelValues("uplink", "crc").Inc()
+				frameLog.Debug("join without valid crc, drop packet")
+				return
+			}
+			crcPolicyCounter.WithLabelValues(crcStatusLabel(crcStatus), "forwarded").Inc()
+		}
+
+		if trusted {
+			e.recordCoverage(gw, frame, &phy, airtime)
+			e.coverageGaps.ObserveUplink(gw, frame)
+		}
+		if crcOK(crcStatus) && e.sfCongestion != nil {
+			e.sfCongestion.Record(gw, frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor(),
+				airtime, jr.DevEUI.String(), time.Now())
+		}
+
+		if e.joinAccepts != nil {
+			e.joinAccepts.Record(gw, region, frame)
+		}
+
 		// Join is internally an Uplink
-		event := router.GatewayToRouterEvent{
-			GatewayInformation: &router.GatewayInformation{
-				PublicKey: gw.CompressedPubKeyBytes(),
-				Owner:     gw.OwnerBytes(),
-			},
-			Event: &router.GatewayToRouterEvent_UplinkFrameEvent{
-				UplinkFrameEvent: &router.UplinkFrameEvent{
-					UplinkFrame: frame,
-					AirtimeReceipt: &router.AirtimeReceipt{
-						Owner:   gw.OwnerBytes(),
-						Airtime: uint32(airtime.Milliseconds()),
-					},
-				},
-			},
+		ev, err := newUplinkGatewayEvent(gw, region, &phy, frame, airtime)
+		if err != nil {
+			droppedFramesCounter.WithLabelValues("uplink", "invalid").Inc()
+			frameLog.WithError(err).Error("invalid packet, drop packet")
+			return
 		}
 
 		// packet is valid, router clients are subscribed to this uplink broadcaster
-		// and will receive it. If the router they are connected to is interested in
-		// the package it will send the packet to the router.
-		if !e.routingTable.gatewayEvents.TryBroadcast(&GatewayEvent{
-			receivedFrom: gw,
-			join: &struct {
-				devEUI lorawan.EUI64
-				event  *router.GatewayToRouterEvent
-			}{
-				jr.DevEUI, &event,
-			},
-		}) {
+		// and will receive it. Join-requests use the priority lane so they are
+		// delivered to routers before pending data uplinks.
+		e.broadcastUplink(ev, frame, true, frameLog)
+
+		pev := newUplinkPacketEvent(PacketEventJoin, gw, string(region), frame, airtime, &phy)
+		pev.DevEUI = jr.DevEUI.String()
+		e.publishPacketEvent(pev)
+	}
+}
+
+// recordCoverage records an uplink that was received over the air with a
+// valid crc in the coverage heatmap and the coverage proofs of the gateway.
+func (e *Exchange) recordCoverage(gateway *gateway.Gateway, frame *gw.UplinkFrame, phy *lorawan.PHYPayload, airtime time.Duration) {
+	e.heatmap.Record(gateway, airtime, time.Now())
+	if e.coverageProofs != nil {
+		e.coverageProofs.Record(gateway, frame, phy, airtime, time.Now())
+	}
+}
+
+// broadcastUplink hands the uplink to the router clients. Uplinks that the
+// packet filters of all routes reject are dropped. If deduplication
+// is enabled copies of the frame received by other gateways are collapsed
+// first and only the best copy is forwarded.
+func (e *Exchange) broadcastUplink(ev *GatewayEvent, frame *gw.UplinkFrame, priority bool, frameLog *logrus.Entry) {
+	if rejectedByAllRoutes(e.routingTable.packetFilters(), ev) {
+		filteredUplinksCounter.WithLabelValues("*", packetFilterFrameType(ev)).Inc()
+		droppedFramesCounter.WithLabelValues("uplink", "filtered").Inc()
+		frameLog.Debug("no route accepts packet by its filter, drop packet")
+		return
+	}
+	if e.dedup == nil || !uplinkDedupFeature.Enabled() {
+		e.forwardUplink(ev, frame, priority, frameLog)
+		return
+	}
+	e.dedup.Hold(ev, frame, frameLog, func(ev *GatewayEvent, frame *gw.UplinkFrame, frameLog *logrus.Entry) {
+		e.forwardUplink(ev, frame, priority, frameLog)
+	})
+}
+
+// forwardUplink hands the uplink to the router clients, join-requests are
+// broadcasted on the priority lane. If gossip is enabled the uplink is held
+// until peer forwarders had the chance to report a better copy of the frame,
+// in which case this copy is dropped. Data uplinks are buffered instead when
+// no router is reachable.
+func (e *Exchange) forwardUplink(ev *GatewayEvent, frame *gw.UplinkFrame, priority bool, frameLog *logrus.Entry) {
+	broadcast := func() {
+		if e.bufferUplink(ev, frameLog) {
+			return
+		}
+
+		var ok bool
+		if priority {
+			ok = e.routingTable.gatewayEvents.TryBroadcastPriority(ev)
+		} else {
+			ok = e.routingTable.gatewayEvents.TryBroadcast(ev)
+		}
+		if !ok {
+			droppedFramesCounter.WithLabelValues("uplink", "queue_full").Inc()
 			frameLog.Warn("unable to broadcast uplink to routing table, drop packet")
 		} else {
 			frameLog.Info("received packet")
 		}
 	}
+
+	if e.gossip == nil {
+		broadcast()
+		return
+	}
+	e.gossip.Hold(frame, func(duplicate bool) {
+		if duplicate {
+			droppedFramesCounter.WithLabelValues("uplink", "peer_duplicate").Inc()
+			frameLog.Debug("peer forwarder received a better copy, drop packet")
+			return
+		}
+		broadcast()
+	})
 }
 
 func (e *Exchange) gatewayStats(stats *gw.GatewayStats) {
-	_, err := e.gateways.ByLocalIDString(stats.GetGatewayId())
+	gw, err := e.gateways.ByLocalIDString(stats.GetGatewayId())
 	if err != nil {
-		logrus.Warnf("gateway stats from unknown gateway: %s, drop stats", stats.GatewayId)
+		exchangeLog.Warnf("gateway stats from unknown gateway: %s, drop stats", stats.GatewayId)
 		return
 	}
-
+	e.health.gatewaySeen(gw.LocalID, time.Now())
+	e.selfTests.ObserveStats(gw)
+	if e.heartbeat != nil {
+		e.heartbeat.Seen(gw.NetworkID, time.Now())
+	}
+	if e.telemetry != nil {
+		e.telemetry.Record(gw, stats)
+	}
 }
 
 // subscribeEvent is called by the chirpstack backend, currently only when a gateway
 // is online this callback is called.
 func (e *Exchange) subscribeEvent(event events.Subscribe) {
-	log := logrus.WithField("gw_local_id", hex.EncodeToString(event.GatewayID[:]))
+	log := exchangeLog.WithField("gw_local_id", hex.EncodeToString(event.GatewayID[:]))
 	localGatewayID, err := gateway.BytesToGatewayID(event.GatewayID[:])
 	if err != nil {
 		log.Warn("event from gateway with invalid local id, drop event")
@@ -348,10 +918,17 @@ func (e *Exchange) subscribeEvent(event events.Subscribe) {
 		_ = e.recordUnknownGateway.Record(localGatewayID)
 		return
 	}
+	e.health.gatewayConnected(gw.LocalID, event.Subscribe)
 	if event.Subscribe {
-		gatewaysOnlineGauge.WithLabelValues(gw.NetworkID.String(), gw.LocalID.String()).Set(1)
+		gatewayGauge(gatewaysOnlineGauge, gw.NetworkID, gw.LocalID).Set(1)
+		if e.heartbeat != nil {
+			e.heartbeat.Seen(gw.NetworkID, time.Now())
+		}
 	} else {
-		gatewaysOnlineGauge.WithLabelValues(gw.NetworkID.String(), gw.LocalID.String()).Set(0)
+		gatewayGauge(gatewaysOnlineGauge, gw.NetworkID, gw.LocalID).Set(0)
+		if e.heartbeat != nil {
+			e.heartbeat.Offline(gw.NetworkID)
+		}
 	}
 
 	log = log.WithField("gw_network_id", gw.NetworkID)
@@ -361,6 +938,7 @@ func (e *Exchange) subscribeEvent(event events.Subscribe) {
 	// interested in the package it will send the packet to the router.
 	if !e.routingTable.gatewayEvents.TryBroadcast(&GatewayEvent{
 		receivedFrom: gw,
+		region:       gatewayRegion(gw, e.gateways),
 		subOnlineOfflineEvent: &struct {
 			event *router.GatewayToRouterEvent
 		}{
@@ -385,30 +963,49 @@ func (e *Exchange) handleDownlinkFrame(event *router.DownlinkFrameEvent) {
 	frame := event.GetDownlinkFrame()
 	gwNetworkId, err := utils.Eui64FromString(frame.GetGatewayId())
 	if err != nil {
-		logrus.WithError(err).Errorf("unable to decode gateway-id: %s", frame.GetGatewayId())
+		exchangeLog.WithError(err).Errorf("unable to decode gateway-id: %s", frame.GetGatewayId())
 	}
 
-	log := logrus.WithField("gw_network_id", gwNetworkId)
+	log := exchangeLog.WithField("gw_network_id", gwNetworkId)
 	gw, err := e.gateways.ByNetworkID(gwNetworkId)
 
 	if err != nil {
+		droppedFramesCounter.WithLabelValues("downlink", "unknown_gateway").Inc()
 		log.WithFields(logrus.Fields{
 			"payload": base64.RawStdEncoding.EncodeToString(frame.Items[0].GetPhyPayload()),
 		}).Warn("drop downlink frame - target gateway not found")
 		return
 	}
+	if gw.Disabled {
+		droppedFramesCounter.WithLabelValues("downlink", "disabled_gateway").Inc()
+		log.Warn("drop downlink frame - target gateway is disabled")
+		return
+	}
 
-	log = log.WithField("gw_local_id", gw.LocalID)
+	packetID := newPacketID()
+	log = log.WithFields(logrus.Fields{
+		"gw_local_id": gw.LocalID,
+		"packet_id":   packetID,
+		"downlink_id": frame.GetDownlinkId(),
+	})
 	frameLog := log
 
-	txPacketsCounter.WithLabelValues(gw.NetworkID.String(), gw.LocalID.String()).Inc()
+	if e.leader != nil && !e.leader.IsLeader() {
+		downlinksNotLeaderCounter.Inc()
+		droppedFramesCounter.WithLabelValues("downlink", "not_leader").Inc()
+		log.Debug("drop downlink frame - replica is not the leader")
+		return
+	}
+
+	if e.downlinkStats != nil {
+		e.downlinkStats.Sent(gw.NetworkID, frame)
+	}
+
+	gatewayCounter(txPacketsCounter, gw.NetworkID, gw.LocalID).Inc()
 	if len(frame.GetItems()) > 0 {
-		txPacketPerFreqCounter.WithLabelValues(gw.NetworkID.String(),
-			gw.LocalID.String(),
+		gatewayCounter(txPacketPerFreqCounter, gw.NetworkID, gw.LocalID,
 			fmt.Sprint(frame.GetItems()[0].GetTxInfo().GetFrequency())).Inc()
-		txPacketPerModulationCounter.WithLabelValues(
-			gw.NetworkID.String(),
-			gw.LocalID.String(),
+		gatewayCounter(txPacketPerModulationCounter, gw.NetworkID, gw.LocalID,
 			fmt.Sprint(frame.GetItems()[0].GetTxInfo().GetFrequency()),
 			fmt.Sprint(frame.GetItems()[0].GetTxInfo().GetModulation().GetLora().GetBandwidth()),
 			fmt.Sprint(frame.GetItems()[0].GetTxInfo().GetModulation().GetLora().GetSpreadingFactor())).Inc()
@@ -425,21 +1022,299 @@ func (e *Exchange) handleDownlinkFrame(event *router.DownlinkFrameEvent) {
 		})
 	}
 
+	// complete join-accept transmission parameters the router left out
+	if e.joinAccepts != nil && e.joinAccepts.Complete(gw, frame) {
+		gatewayCounter(joinAcceptsCompletedCounter, gw.NetworkID, gw.LocalID).Inc()
+		frameLog.Info("completed join-accept transmission parameters from cache")
+	}
+
+	// reject items that exceed the regional maximum payload size for the
+	// data rate they are scheduled on, the gateway would otherwise fail to
+	// transmit them or transmit a truncated frame
+	if !e.validateDownlinkFrameSize(gw, frame, frameLog) {
+		return
+	}
+
+	// drop items outside the band plan of the gateway and cap their transmit
+	// power to the maximum EIRP of the plan
+	if e.bandPlans != nil && !e.validateDownlinkBandPlan(gw, frame, frameLog) {
+		return
+	}
+
+	// never instruct the gateway to transmit outside the regulatory limits
+	// of the country it is located in, even if the router asks for it
+	if e.txPower != nil && !e.limitDownlinkTxPower(gw, frame, frameLog) {
+		return
+	}
+
+	// downlinks scheduled at an absolute time miss the receive window when
+	// the host clock is off
+	if e.refuseUnsynchronizedDownlink(gw, frame, frameLog) {
+		return
+	}
+
+	// reject items that miss their receive window or exceed the duty cycle,
+	// the gateway falls back to the next item
+	if e.scheduler != nil && !e.validateDownlinkTiming(gw, frame, frameLog) {
+		return
+	}
+
+	if e.scheduler != nil {
+		multicast, err := e.scheduler.Schedule(gw.NetworkID, frame)
+		if err != nil {
+			gatewayCounter(downlinksQueueFullCounter, gw.NetworkID, gw.LocalID, fmt.Sprint(multicast)).Inc()
+			droppedFramesCounter.WithLabelValues("downlink", "queue_full").Inc()
+			frameLog.WithError(err).WithField("multicast", multicast).Warn("drop downlink")
+			e.rejectDownlinkFrame(gw, frame)
+			return
+		}
+		if multicast {
+			gatewayCounter(multicastDownlinksCounter, gw.NetworkID, gw.LocalID).Inc()
+			frameLog = frameLog.WithField("multicast", true)
+		}
+	}
+
+	// adjust the delay of downlinks scheduled relative to an uplink for the
+	// drift of the concentrator clock
+	if e.clockDrift != nil && e.clockDrift.Compensate(gw.NetworkID, frame) {
+		gatewayCounter(downlinksClockDriftCompensatedCounter, gw.NetworkID, gw.LocalID).Inc()
+	}
+
 	// convert the network downlink frame into a local frame
 	frame = networkDownlinkFrameToLocal(gw, frame)
 
 	// order backend to send the downlink to the gateway so it can be broadcasted
 	if err := e.backend.SendDownlinkFrame(frame); err != nil {
+		droppedFramesCounter.WithLabelValues("downlink", "backend_error").Inc()
 		frameLog.WithError(err).Error("drop downlink: unable to send to gateway")
+		if e.scheduler != nil {
+			e.scheduler.Acked(gw.NetworkID, frame.GetDownlinkId())
+		}
+		if e.downlinkStats != nil {
+			e.downlinkStats.Failed(gw, frame.GetDownlinkId())
+		}
 		return
 	} else {
 		frameLog.Info("downlink sent to backend")
 	}
+	if e.scheduler != nil && len(frame.GetItems()) > 0 {
+		// gateways transmit the first item they can, charge that one
+		e.scheduler.Transmitted(gw.NetworkID, gatewayRegion(gw, e.gateways), frame.GetItems()[0], time.Now())
+	}
+	e.downlinkPackets.add(gw.NetworkID, frame.GetDownlinkId(), packetID)
+
+	if e.complianceHold != nil {
+		e.recordComplianceDownlink(gw, packetID, frame)
+	}
+
+	pev := newDownlinkPacketEvent(gw, frame)
+	pev.PacketID = packetID
+	e.publishPacketEvent(pev)
+}
+
+// validateDownlinkFrameSize removes items from frame that are too large for
+// the data rate they are scheduled on. If no valid items remain the router is
+// sent a downlink ACK with an error status for all items and false is
+// returned to indicate that the frame must not be sent to the gateway.
+func (e *Exchange) validateDownlinkFrameSize(gateway *gateway.Gateway, frame *gw.DownlinkFrame, log *logrus.Entry) bool {
+	var (
+		region = gatewayRegion(gateway, e.gateways)
+		valid  = make([]*gw.DownlinkFrameItem, 0, len(frame.GetItems()))
+		ack    = &gw.DownlinkTxAck{
+			GatewayId:  gateway.LocalID.String(),
+			DownlinkId: frame.GetDownlinkId(),
+		}
+	)
+
+	for i, item := range frame.GetItems() {
+		if err := validateDownlinkSize(region, item); err != nil {
+			gatewayCounter(downlinksTooLargeCounter, gateway.NetworkID, gateway.LocalID).Inc()
+			log.WithError(err).WithField("item", i).Warn("drop downlink item")
+			ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_INTERNAL_ERROR})
+			continue
+		}
+		valid = append(valid, item)
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_IGNORED})
+	}
+
+	if len(valid) == 0 && len(frame.GetItems()) > 0 {
+		droppedFramesCounter.WithLabelValues("downlink", "too_large").Inc()
+		log.Error("drop downlink: all items exceed maximum payload size")
+		e.downlinkTxAck(ack)
+		return false
+	}
+
+	frame.Items = valid
+	return true
+}
+
+// validateDownlinkBandPlan removes items from frame that are scheduled on a
+// frequency or data rate outside the band plan of the gateway and lowers the
+// transmit power of the remaining items to the maximum EIRP of the plan. If
+// no items remain the router is sent a downlink ACK with an error status for
+// all items and false is returned to indicate that the frame must not be sent
+// to the gateway.
+func (e *Exchange) validateDownlinkBandPlan(gateway *gateway.Gateway, frame *gw.DownlinkFrame, log *logrus.Entry) bool {
+	var (
+		region = gatewayRegion(gateway, e.gateways)
+		valid  = make([]*gw.DownlinkFrameItem, 0, len(frame.GetItems()))
+		ack    = &gw.DownlinkTxAck{
+			GatewayId:  gateway.LocalID.String(),
+			DownlinkId: frame.GetDownlinkId(),
+		}
+	)
+
+	for i, item := range frame.GetItems() {
+		requested, capped, err := e.bandPlans.LimitDownlinkItem(region, item)
+		if err != nil {
+			status := gw.TxAckStatus_INTERNAL_ERROR
+			var violation *BandPlanViolationError
+			if errors.As(err, &violation) {
+				gatewayCounter(bandPlanViolationsCounter, gateway.NetworkID, gateway.LocalID, "downlink", violation.Reason).Inc()
+				if violation.Reason == bandPlanReasonFrequency {
+					status = gw.TxAckStatus_TX_FREQ
+				}
+			}
+			log.WithError(err).WithField("item", i).Warn("drop downlink item")
+			ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: status})
+			continue
+		}
+		if capped {
+			gatewayCounter(bandPlanViolationsCounter, gateway.NetworkID, gateway.LocalID, "downlink", "eirp").Inc()
+			log.WithFields(logrus.Fields{
+				"item":          i,
+				"requested_pwr": requested,
+				"pwr":           item.GetTxInfo().GetPower(),
+				"frequency":     item.GetTxInfo().GetFrequency(),
+				"region":        region,
+			}).Warn("lowered downlink transmit power to band plan maximum")
+		}
+		valid = append(valid, item)
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_IGNORED})
+	}
+
+	if len(valid) == 0 && len(frame.GetItems()) > 0 {
+		droppedFramesCounter.WithLabelValues("downlink", "band_plan").Inc()
+		log.Error("drop downlink: all items outside the band plan of the gateway")
+		e.downlinkTxAck(ack)
+		return false
+	}
+
+	frame.Items = valid
+	return true
+}
+
+// limitDownlinkTxPower lowers the transmit power of items in frame to the
+// maximum allowed in the country of the gateway and removes items scheduled
+// on frequencies that are not allowed. If no items remain the router is sent
+// a downlink ACK with a TX_FREQ status for all items and false is returned
+// to indicate that the frame must not be sent to the gateway.
+func (e *Exchange) limitDownlinkTxPower(gateway *gateway.Gateway, frame *gw.DownlinkFrame, log *logrus.Entry) bool {
+	var (
+		valid = make([]*gw.DownlinkFrameItem, 0, len(frame.GetItems()))
+		ack   = &gw.DownlinkTxAck{
+			GatewayId:  gateway.LocalID.String(),
+			DownlinkId: frame.GetDownlinkId(),
+		}
+	)
+
+	for i, item := range frame.GetItems() {
+		requested, capped, err := e.txPower.Limit(gateway, item)
+		if err != nil {
+			gatewayCounter(downlinksFrequencyNotAllowedCounter, gateway.NetworkID, gateway.LocalID).Inc()
+			log.WithError(err).WithField("item", i).Warn("drop downlink item")
+			ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_TX_FREQ})
+			continue
+		}
+		if capped {
+			gatewayCounter(downlinksTxPowerCappedCounter, gateway.NetworkID, gateway.LocalID).Inc()
+			log.WithFields(logrus.Fields{
+				"item":          i,
+				"requested_pwr": requested,
+				"pwr":           item.GetTxInfo().GetPower(),
+				"frequency":     item.GetTxInfo().GetFrequency(),
+				"country":       e.txPower.Profile(gateway).Country,
+			}).Warn("lowered downlink transmit power to country maximum")
+		}
+		valid = append(valid, item)
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_IGNORED})
+	}
+
+	if len(valid) == 0 && len(frame.GetItems()) > 0 {
+		droppedFramesCounter.WithLabelValues("downlink", "frequency").Inc()
+		log.Error("drop downlink: all items on frequencies not allowed in the gateway country")
+		e.downlinkTxAck(ack)
+		return false
+	}
+
+	frame.Items = valid
+	return true
+}
+
+// validateDownlinkTiming removes items from frame that can't be transmitted
+// in their receive window or would exceed the duty cycle of the gateway. If
+// the first item is removed the gateway transmits a later item, such as the
+// RX2 window, instead. If no items remain the router is sent a downlink ACK
+// with the reason for each item and false is returned to indicate that the
+// frame must not be sent to the gateway.
+func (e *Exchange) validateDownlinkTiming(gateway *gateway.Gateway, frame *gw.DownlinkFrame, log *logrus.Entry) bool {
+	var (
+		now    = time.Now()
+		region = gatewayRegion(gateway, e.gateways)
+		valid  = make([]*gw.DownlinkFrameItem, 0, len(frame.GetItems()))
+		ack    = &gw.DownlinkTxAck{
+			GatewayId:  gateway.LocalID.String(),
+			DownlinkId: frame.GetDownlinkId(),
+		}
+	)
+
+	for i, item := range frame.GetItems() {
+		if err := e.scheduler.ValidateItem(gateway.NetworkID, region, item, now); err != nil {
+			status := gw.TxAckStatus_INTERNAL_ERROR
+			var timingErr *DownlinkTimingError
+			if errors.As(err, &timingErr) {
+				status = timingErr.Status
+			}
+			gatewayCounter(downlinksTimingRejectedCounter, gateway.NetworkID, gateway.LocalID, status.String()).Inc()
+			log.WithError(err).WithField("item", i).Warn("drop downlink item")
+			ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: status})
+			continue
+		}
+		valid = append(valid, item)
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_IGNORED})
+	}
+
+	if len(valid) == 0 && len(frame.GetItems()) > 0 {
+		droppedFramesCounter.WithLabelValues("downlink", "timing").Inc()
+		log.Error("drop downlink: no item can be transmitted in time and within the duty cycle")
+		e.downlinkTxAck(ack)
+		return false
+	}
+	if len(valid) > 0 && valid[0] != frame.GetItems()[0] {
+		gatewayCounter(downlinksRescheduledCounter, gateway.NetworkID, gateway.LocalID).Inc()
+		log.Info("downlink rescheduled to a later item")
+	}
+
+	frame.Items = valid
+	return true
+}
+
+// rejectDownlinkFrame sends a queue full ACK for all items in frame to the
+// router that sent it, the frame is not sent to the gateway.
+func (e *Exchange) rejectDownlinkFrame(gateway *gateway.Gateway, frame *gw.DownlinkFrame) {
+	ack := &gw.DownlinkTxAck{
+		GatewayId:  gateway.LocalID.String(),
+		DownlinkId: frame.GetDownlinkId(),
+	}
+	for range frame.GetItems() {
+		ack.Items = append(ack.Items, &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_QUEUE_FULL})
+	}
+	e.downlinkTxAck(ack)
 }
 
 func (e *Exchange) downlinkTxAck(txack *gw.DownlinkTxAck) {
 	var (
-		log = logrus.WithFields(logrus.Fields{
+		log = exchangeLog.WithFields(logrus.Fields{
 			"gw_local_id": txack.GatewayId,
 		})
 	)
@@ -458,11 +1333,41 @@ func (e *Exchange) downlinkTxAck(txack *gw.DownlinkTxAck) {
 		_ = e.recordUnknownGateway.Record(localGatewayID)
 		return
 	}
-	log = log.WithField("gw_network_id", gw.NetworkID)
+	if e.selfTests.TxAck(gw, txack) {
+		log.WithField("downlink_id", txack.GetDownlinkId()).Info("received self-test downlink tx ack")
+		return
+	}
+	if e.downlinkSimulator.TxAck(gw, txack) {
+		log.WithField("downlink_id", txack.GetDownlinkId()).Info("received simulated downlink tx ack")
+		return
+	}
+
+	packetID := e.downlinkPackets.take(gw.NetworkID, txack.GetDownlinkId())
+	log = log.WithFields(logrus.Fields{
+		"gw_network_id": gw.NetworkID,
+		"downlink_id":   txack.GetDownlinkId(),
+		"packet_id":     packetID,
+	})
+
+	if e.scheduler != nil {
+		e.scheduler.Acked(gw.NetworkID, txack.GetDownlinkId())
+	}
+
+	pev := newTxAckPacketEvent(gw, txack)
+	pev.PacketID = packetID
+	e.publishPacketEvent(pev)
+
+	if e.slo != nil {
+		e.slo.RecordTxAck(gw.NetworkID, txack)
+	}
+
+	if e.downlinkStats != nil {
+		e.downlinkStats.TxAck(gw, txack)
+	}
 
 	// convert txack to network format
 	if txack, err = localDownlinkTxAckToNetwork(gw, txack); err != nil {
-		logrus.WithError(err).Errorf("could update txack to network format")
+		exchangeLog.WithError(err).Errorf("could update txack to network format")
 		return
 	}
 
@@ -496,3 +1401,11 @@ func (e *Exchange) downlinkTxAck(txack *gw.DownlinkTxAck) {
 		log.Warn("unable to broadcast downlink ACK to routing table, drop packet")
 	}
 }
+
+// recordSLODownlink attributes the downlink to the router that sent it.
+func (e *Exchange) recordSLODownlink(source *Router, event *router.DownlinkFrameEvent) {
+	frame := event.GetDownlinkFrame()
+	if gatewayID, err := utils.Eui64FromString(frame.GetGatewayId()); err == nil {
+		e.slo.DownlinkSent(source.String(), gatewayID, frame.GetDownlinkId())
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+)
+
+// fcntAnomalyAlertKind is the kind of alerts raised by the frame counter
+// anomaly detector.
+const fcntAnomalyAlertKind = "fcnt_anomalies"
+
+const (
+	// fcntAnomalyReset is a frame counter that restarted near zero
+	fcntAnomalyReset = "reset"
+	// fcntAnomalyJump is a frame counter that increased more than expected
+	fcntAnomalyJump = "jump"
+	// fcntAnomalyRollback is a frame counter that went back, but not to zero
+	fcntAnomalyRollback = "rollback"
+)
+
+const (
+	// fcntAnomalyMaxRecent limits the anomalies kept per gateway
+	fcntAnomalyMaxRecent = 256
+	// fcntAnomalyTopDevices is the number of devices listed in alerts
+	fcntAnomalyTopDevices = 5
+)
+
+// FCntAnomalyDetector tracks the frame counters of data uplinks per DevAddr
+// and flags resets and large jumps. Resets often mean a device rebooted and
+// lost its session state, jumps and rollbacks can indicate a key mismatch,
+// DevAddr collisions between networks or spoofed traffic. Only the 16 least
+// significant bits of the frame counter are transmitted, counters that wrap
+// around are not anomalies.
+type FCntAnomalyDetector struct {
+	maxJump    uint16
+	maxDevices int
+	retention  time.Duration
+	window     time.Duration
+	threshold  int
+	alerter    *Alerter
+
+	mu       sync.Mutex
+	devices  map[lorawan.DevAddr]*fcntDevice
+	gateways map[lorawan.EUI64]*fcntGateway
+}
+
+type fcntDevice struct {
+	fcnt     uint16
+	lastSeen time.Time
+}
+
+type fcntAnomaly struct {
+	at      time.Time
+	kind    string
+	devAddr lorawan.DevAddr
+}
+
+type fcntGateway struct {
+	localID lorawan.EUI64
+	// recent holds the anomalies observed by the gateway, oldest first
+	recent []fcntAnomaly
+}
+
+// NewFCntAnomalyDetector returns a detector configured from cfg that raises
+// alerts on alerter.
+func NewFCntAnomalyDetector(cfg *ForwarderFCntAnomalyConfig, alerter *Alerter) *FCntAnomalyDetector {
+	d := &FCntAnomalyDetector{
+		maxJump:    1000,
+		maxDevices: 10000,
+		retention:  24 * time.Hour,
+		window:     time.Hour,
+		threshold:  10,
+		alerter:    alerter,
+		devices:    make(map[lorawan.DevAddr]*fcntDevice),
+		gateways:   make(map[lorawan.EUI64]*fcntGateway),
+	}
+	if cfg.MaxJump != nil && *cfg.MaxJump > 0 && *cfg.MaxJump < 1<<15 {
+		d.maxJump = uint16(*cfg.MaxJump)
+	}
+	if cfg.MaxDevices != nil && *cfg.MaxDevices > 0 {
+		d.maxDevices = *cfg.MaxDevices
+	}
+	if cfg.Retention != nil && *cfg.Retention > 0 {
+		d.retention = *cfg.Retention
+	}
+	if cfg.Window != nil && *cfg.Window > 0 {
+		d.window = *cfg.Window
+	}
+	if cfg.Threshold != nil && *cfg.Threshold > 0 {
+		d.threshold = *cfg.Threshold
+	}
+	return d
+}
+
+// classifyFCnt returns the anomaly kind of a frame counter that went from
+// last to fcnt, or an empty string if the progression is expected.
+func classifyFCnt(last, fcnt, maxJump uint16) string {
+	diff := fcnt - last
+	switch {
+	case diff <= maxJump:
+		// includes retransmissions and counters that wrapped around
+		return ""
+	case fcnt <= maxJump:
+		return fcntAnomalyReset
+	case diff >= 1<<15:
+		return fcntAnomalyRollback
+	default:
+		return fcntAnomalyJump
+	}
+}
+
+// Record adds a data uplink with the given frame counter from devAddr that
+// was received by gw. It returns the anomaly kind if the frame counter
+// progression is unexpected.
+func (d *FCntAnomalyDetector) Record(gw *gateway.Gateway, devAddr lorawan.DevAddr, fcnt uint32, at time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dev, ok := d.devices[devAddr]
+	if !ok {
+		if len(d.devices) >= d.maxDevices {
+			return ""
+		}
+		d.devices[devAddr] = &fcntDevice{fcnt: uint16(fcnt), lastSeen: at}
+		return ""
+	}
+
+	kind := classifyFCnt(dev.fcnt, uint16(fcnt), d.maxJump)
+	dev.fcnt, dev.lastSeen = uint16(fcnt), at
+	if kind == "" {
+		return ""
+	}
+
+	g, ok := d.gateways[gw.NetworkID]
+	if !ok {
+		g = &fcntGateway{localID: gw.LocalID}
+		d.gateways[gw.NetworkID] = g
+	}
+	if len(g.recent) >= fcntAnomalyMaxRecent {
+		g.recent = g.recent[1:]
+	}
+	g.recent = append(g.recent, fcntAnomaly{at: at, kind: kind, devAddr: devAddr})
+
+	gatewayCounter(fcntAnomaliesCounter, gw.NetworkID, gw.LocalID, kind).Inc()
+	return kind
+}
+
+// fcntAnomalyStatus are the anomalies a gateway observed in the window.
+type fcntAnomalyStatus struct {
+	GatewayNetworkID lorawan.EUI64
+	GatewayLocalID   lorawan.EUI64
+	Anomalies        int
+	Kinds            map[string]int
+	TopDevices       []string
+}
+
+func (d *FCntAnomalyDetector) status(now time.Time) []fcntAnomalyStatus {
+	from := now.Add(-d.window)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for devAddr, dev := range d.devices {
+		if now.Sub(dev.lastSeen) > d.retention {
+			delete(d.devices, devAddr)
+		}
+	}
+
+	statuses := make([]fcntAnomalyStatus, 0, len(d.gateways))
+	for networkID, g := range d.gateways {
+		i := sort.Search(len(g.recent), func(i int) bool { return g.recent[i].at.After(from) })
+		g.recent = g.recent[i:]
+		if len(g.recent) == 0 {
+			delete(d.gateways, networkID)
+			continue
+		}
+
+		s := fcntAnomalyStatus{
+			GatewayNetworkID: networkID,
+			GatewayLocalID:   g.localID,
+			Anomalies:        len(g.recent),
+			Kinds:            make(map[string]int),
+		}
+		perDevice := make(map[lorawan.DevAddr]int)
+		for _, a := range g.recent {
+			s.Kinds[a.kind]++
+			perDevice[a.devAddr]++
+		}
+		devices := make([]lorawan.DevAddr, 0, len(perDevice))
+		for devAddr := range perDevice {
+			devices = append(devices, devAddr)
+		}
+		sort.Slice(devices, func(i, j int) bool { return perDevice[devices[i]] > perDevice[devices[j]] })
+		if len(devices) > fcntAnomalyTopDevices {
+			devices = devices[:fcntAnomalyTopDevices]
+		}
+		for _, devAddr := range devices {
+			s.TopDevices = append(s.TopDevices, devAddr.String())
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// evaluate raises alerts for gateways that observed at least threshold
+// anomalies in the window and resolves alerts of gateways that no longer do.
+func (d *FCntAnomalyDetector) evaluate(now time.Time) {
+	active := make(map[string]bool)
+	for _, s := range d.status(now) {
+		if s.Anomalies < d.threshold {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s", fcntAnomalyAlertKind, s.GatewayNetworkID)
+		active[key] = true
+
+		networkID, localID := s.GatewayNetworkID, s.GatewayLocalID
+		d.alerter.Raise(Alert{
+			Key:              key,
+			Kind:             fcntAnomalyAlertKind,
+			Severity:         AlertSeverityWarning,
+			GatewayNetworkID: &networkID,
+			GatewayLocalID:   &localID,
+			Summary: fmt.Sprintf("gateway %s received %d uplinks with unexpected frame counters, devices may have rebooted or traffic is spoofed",
+				s.GatewayNetworkID, s.Anomalies),
+			Details: map[string]interface{}{
+				"window":     d.window.String(),
+				"anomalies":  s.Anomalies,
+				"kinds":      s.Kinds,
+				"topDevices": s.TopDevices,
+			},
+		})
+	}
+	d.alerter.ResolveKind(fcntAnomalyAlertKind, func(key string) bool { return active[key] })
+}
+
+// Run evaluates the gateways periodically until ctx expires.
+func (d *FCntAnomalyDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.evaluate(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package features implements runtime feature flags. Experimental forwarder
+// behavior registers a flag and checks it at the point where the behavior
+// diverges. Flags get their initial value from the configuration and can be
+// toggled at runtime through the forwarder API without restarting.
+package features
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUnknownFlag is returned when a flag is referenced that isn't registered.
+var ErrUnknownFlag = errs.New(errs.ErrNotFound, "unknown feature flag")
+
+var (
+	mu    sync.RWMutex
+	flags = make(map[string]*Flag)
+)
+
+// Flag is a named toggle that guards experimental behavior.
+type Flag struct {
+	name        string
+	description string
+	def         bool
+	enabled     int32
+}
+
+// Status describes a flag and its current state.
+type Status struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// Register a new flag with the given name and default state. It is expected
+// to be called from a package level variable declaration and panics when a
+// flag with the same name was already registered.
+func Register(name, description string, def bool) *Flag {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, found := flags[name]; found {
+		panic("feature flag " + name + " registered twice")
+	}
+
+	f := &Flag{name: name, description: description, def: def}
+	f.set(def)
+	flags[name] = f
+	return f
+}
+
+// Name returns the flag name.
+func (f *Flag) Name() string {
+	return f.name
+}
+
+// Enabled returns an indication if the flag is currently enabled.
+func (f *Flag) Enabled() bool {
+	return atomic.LoadInt32(&f.enabled) == 1
+}
+
+func (f *Flag) set(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&f.enabled, 1)
+	} else {
+		atomic.StoreInt32(&f.enabled, 0)
+	}
+}
+
+func (f *Flag) status() Status {
+	return Status{
+		Name:        f.name,
+		Description: f.description,
+		Default:     f.def,
+		Enabled:     f.Enabled(),
+	}
+}
+
+// Configure sets the initial flag states as loaded from the configuration.
+// Unknown flags are logged and ignored to allow configurations to outlive
+// experiments that have been removed.
+func Configure(cfg map[string]bool) {
+	for name, enabled := range cfg {
+		if _, err := Set(name, enabled); err != nil {
+			logrus.WithField("flag", name).Warn("ignore unknown feature flag in configuration")
+		}
+	}
+}
+
+// Set enables or disables the flag with the given name.
+func Set(name string, enabled bool) (Status, error) {
+	mu.RLock()
+	f, found := flags[name]
+	mu.RUnlock()
+
+	if !found {
+		return Status{}, ErrUnknownFlag
+	}
+
+	if f.Enabled() != enabled {
+		logrus.WithFields(logrus.Fields{
+			"flag":    name,
+			"enabled": enabled,
+		}).Info("feature flag changed")
+	}
+	f.set(enabled)
+	return f.status(), nil
+}
+
+// Reset sets the flag with the given name back to its default state.
+func Reset(name string) (Status, error) {
+	mu.RLock()
+	f, found := flags[name]
+	mu.RUnlock()
+
+	if !found {
+		return Status{}, ErrUnknownFlag
+	}
+	return Set(name, f.def)
+}
+
+// Get returns the status of the flag with the given name.
+func Get(name string) (Status, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if f, found := flags[name]; found {
+		return f.status(), nil
+	}
+	return Status{}, ErrUnknownFlag
+}
+
+// All returns the status of all registered flags sorted by name.
+func All() []Status {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	all := make([]Status, 0, len(flags))
+	for _, f := range flags {
+		all = append(all, f.status())
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// maxBulkGateways is the maximum number of gateways in a single bulk request.
+const maxBulkGateways = 1000
+
+// bulk gateway operations
+const (
+	bulkEnable  = "enable"
+	bulkDisable = "disable"
+	bulkTag     = "tag"
+	bulkUntag   = "untag"
+	bulkDelete  = "delete"
+	bulkRotate  = "rotate"
+)
+
+var errGatewayOnboarded = errs.New(errs.ErrFailedPrecondition, "gateway is onboarded, set force to rotate its key")
+
+// BulkGatewayRequest is the body of a bulk gateway operation.
+type BulkGatewayRequest struct {
+	// Operation is one of enable, disable, tag, untag, delete or rotate.
+	Operation string `json:"operation"`
+	// Gateways holds the identifiers of the gateways to apply the operation
+	// on, in any of the formats accepted by the single gateway endpoints.
+	Gateways []string `json:"gateways"`
+	// Tags are added or removed by the tag and untag operations.
+	Tags []string `json:"tags,omitempty"`
+	// Force allows rotating the key of onboarded gateways. The gateway gets a
+	// new identity and must be onboarded again.
+	Force bool `json:"force,omitempty"`
+}
+
+// BulkGatewayResult is the outcome of a bulk operation for a single gateway.
+type BulkGatewayResult struct {
+	// Gateway is the identifier as given in the request.
+	Gateway string `json:"gateway"`
+	// LocalID is set when the gateway was found in the store.
+	LocalID string `json:"localId,omitempty"`
+	// NetworkID is the network id of the gateway after the operation, it
+	// changes when its key was rotated.
+	NetworkID string `json:"networkId,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BulkGatewayReply is returned for a bulk gateway operation.
+type BulkGatewayReply struct {
+	Operation string              `json:"operation"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Results   []BulkGatewayResult `json:"results"`
+}
+
+// BulkGateways applies an operation on a list of gateways. The operation is
+// applied on each gateway independently, failures are reported per gateway
+// and don't abort the operation for the remaining gateways. The delete and
+// rotate operations are refused, these are served by ManageBulkGateways on
+// the gateway management API.
+func (svc APIService) BulkGateways(w http.ResponseWriter, r *http.Request) {
+	svc.bulkGateways(w, r, false)
+}
+
+// ManageBulkGateways is BulkGateways for the gateway management API that also
+// applies the delete and rotate operations.
+func (svc APIService) ManageBulkGateways(w http.ResponseWriter, r *http.Request) {
+	svc.bulkGateways(w, r, true)
+}
+
+func (svc APIService) bulkGateways(w http.ResponseWriter, r *http.Request, management bool) {
+	var req BulkGatewayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !management && (req.Operation == bulkDelete || req.Operation == bulkRotate) {
+		http.Error(w, fmt.Sprintf("operation %q is only served by the gateway management API", req.Operation), http.StatusForbidden)
+		return
+	}
+
+	manager, ok := svc.gateways.(gateway.GatewayManager)
+	if !ok {
+		http.Error(w, "gateway store doesn't support bulk operations", http.StatusNotImplemented)
+		return
+	}
+
+	apply, err := bulkOperation(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Gateways) == 0 {
+		http.Error(w, "missing gateways", http.StatusBadRequest)
+		return
+	}
+	if len(req.Gateways) > maxBulkGateways {
+		http.Error(w, fmt.Sprintf("too many gateways, max %d", maxBulkGateways), http.StatusBadRequest)
+		return
+	}
+
+	reply := BulkGatewayReply{
+		Operation: req.Operation,
+		Results:   make([]BulkGatewayResult, 0, len(req.Gateways)),
+	}
+
+	for _, id := range req.Gateways {
+		result := BulkGatewayResult{Gateway: id, Status: "ok"}
+
+		gw, err := gateway.Lookup(svc.gateways, id)
+		if err == nil {
+			result.LocalID = gw.LocalID.String()
+			if req.Operation == bulkDelete {
+				err = manager.Remove(r.Context(), gw.LocalID)
+			} else if gw, err = manager.Update(r.Context(), gw.LocalID, apply); err == nil {
+				result.NetworkID = gw.NetworkID.String()
+			}
+		}
+
+		if err != nil {
+			result.Status, result.Error = "error", err.Error()
+			reply.Failed++
+		} else {
+			reply.Succeeded++
+		}
+		reply.Results = append(reply.Results, result)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"operation": req.Operation,
+		"succeeded": reply.Succeeded,
+		"failed":    reply.Failed,
+	}).Info("bulk gateway operation")
+
+	replyJSON(w, http.StatusOK, reply)
+}
+
+// bulkOperation returns the update func for the requested operation, it
+// returns nil for the delete operation that isn't an update.
+func bulkOperation(req BulkGatewayRequest) (func(*gateway.Gateway) error, error) {
+	switch req.Operation {
+	case bulkEnable:
+		return func(gw *gateway.Gateway) error {
+			gw.Disabled = false
+			return nil
+		}, nil
+	case bulkDisable:
+		return func(gw *gateway.Gateway) error {
+			gw.Disabled = true
+			return nil
+		}, nil
+	case bulkTag, bulkUntag:
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		add := req.Operation == bulkTag
+		return func(gw *gateway.Gateway) error {
+			gw.Tags = updateTags(gw.Tags, tags, add)
+			return nil
+		}, nil
+	case bulkDelete:
+		return nil, nil
+	case bulkRotate:
+		return func(gw *gateway.Gateway) error {
+			if gw.Onboarded() && !req.Force {
+				return errGatewayOnboarded
+			}
+			key, err := utils.GeneratePrivateKey()
+			if err != nil {
+				return err
+			}
+			gw.PrivateKey = key
+			return nil
+		}, nil
+	case "":
+		return nil, errs.New(errs.ErrInvalidArgument, "missing operation")
+	default:
+		return nil, errs.New(errs.ErrInvalidArgument, fmt.Sprintf("unknown operation %q", req.Operation))
+	}
+}
+
+// normalizeTags trims the given tags and ensures they are not empty. Tags are
+// stored comma separated and therefore can't contain a comma.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, errs.New(errs.ErrInvalidArgument, "missing tags")
+	}
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.Contains(tag, ",") {
+			return nil, errs.New(errs.ErrInvalidArgument, fmt.Sprintf("invalid tag %q", tag))
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized, nil
+}
+
+// updateTags returns current with the given tags added or removed, the order
+// of existing tags is kept and tags are not duplicated.
+func updateTags(current, tags []string, add bool) []string {
+	updated := make([]string, 0, len(current)+len(tags))
+	for _, tag := range current {
+		if add || !containsString(tags, tag) {
+			updated = append(updated, tag)
+		}
+	}
+	if add {
+		for _, tag := range tags {
+			if !containsString(updated, tag) {
+				updated = append(updated, tag)
+			}
+		}
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+	return updated
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
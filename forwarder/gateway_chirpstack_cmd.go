@@ -0,0 +1,233 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/logging"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	importChirpStackCmd = &cobra.Command{
+		Use:   "chirpstack --target <host:port> --tenant-id <id>",
+		Short: "Import the gateways of a ChirpStack tenant in the gateway store",
+		Long: `Retrieve the gateway list of a ChirpStack tenant through the ChirpStack API
+and add each gateway to the gateway store with a key generated by the
+forwarder. Gateways that are already in the store keep their key. The
+resulting ThingsIX ids are printed, onboard the gateways afterwards with
+'forwarder gateway onboard'.`,
+		Args: cobra.NoArgs,
+		Run:  importChirpStackGateways,
+	}
+
+	chirpStackTarget     string
+	chirpStackAPIKey     string
+	chirpStackAPIKeyFile string
+	chirpStackTenantID   string
+	chirpStackInsecure   bool
+)
+
+func init() {
+	importGatewayCmd.AddCommand(importChirpStackCmd)
+
+	importChirpStackCmd.Flags().StringVar(&chirpStackTarget, "target", "", "ChirpStack API address, e.g. localhost:8080")
+	importChirpStackCmd.Flags().StringVar(&chirpStackAPIKey, "api-key", "", "ChirpStack API key")
+	importChirpStackCmd.Flags().StringVar(&chirpStackAPIKeyFile, "api-key-file", "", "file with the ChirpStack API key, takes precedence over --api-key")
+	importChirpStackCmd.Flags().StringVar(&chirpStackTenantID, "tenant-id", "", "ChirpStack tenant id the gateways are retrieved from")
+	importChirpStackCmd.Flags().BoolVar(&chirpStackInsecure, "insecure", false, "connect to the ChirpStack API without TLS")
+	_ = importChirpStackCmd.MarkFlagRequired("target")
+	_ = importChirpStackCmd.MarkFlagRequired("tenant-id")
+}
+
+// chirpStackAPIToken authenticates ChirpStack API calls with an API key, it
+// is also sent over (internal) connections without TLS.
+type chirpStackAPIToken string
+
+func (t chirpStackAPIToken) GetRequestMetadata(ctx context.Context, url ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + string(t),
+	}, nil
+}
+
+func (t chirpStackAPIToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// chirpStackImport is the outcome of the import of a single gateway.
+type chirpStackImport struct {
+	Name    string           `json:"name"`
+	Status  string           `json:"status"`
+	Gateway *gateway.Gateway `json:"gateway"`
+}
+
+func importChirpStackGateways(cmd *cobra.Command, args []string) {
+	logging.SetDefaultLevel(logrus.ErrorLevel)
+
+	cfg := mustLoadConfig(true)
+	if cfg.Forwarder.Gateways.HttpAPI.Address == "" {
+		logrus.Fatal("HTTP API endpoint missing")
+	}
+
+	apiKey := chirpStackAPIKey
+	if chirpStackAPIKeyFile != "" {
+		raw, err := os.ReadFile(chirpStackAPIKeyFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to read ChirpStack API key")
+		}
+		apiKey = strings.TrimSpace(string(raw))
+	}
+	if apiKey == "" {
+		logrus.Fatal("ChirpStack API key missing")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	listed, err := listChirpStackGateways(ctx, chirpStackTarget, apiKey, chirpStackInsecure, chirpStackTenantID)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to retrieve gateways from ChirpStack")
+	}
+
+	imported := make([]chirpStackImport, 0, len(listed))
+	for _, item := range listed {
+		localID, err := gateway.ParseEUI64(item.GetGatewayId())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skip gateway %s (%s): invalid gateway id\n", item.GetGatewayId(), item.GetName())
+			continue
+		}
+		gw, created := addGatewayByLocalID(cfg, localID)
+		status := "existing"
+		if created {
+			status = "added"
+		}
+		imported = append(imported, chirpStackImport{Name: item.GetName(), Status: status, Gateway: gw})
+	}
+
+	if jsonOutput {
+		_ = json.NewEncoder(os.Stdout).Encode(imported)
+	} else {
+		printChirpStackImport(imported)
+	}
+}
+
+// listChirpStackGateways returns the gateways of the tenant from the
+// ChirpStack API.
+func listChirpStackGateways(ctx context.Context, target, apiKey string, insecureConn bool, tenantID string) ([]*api.GatewayListItem, error) {
+	dialOpts := []grpc.DialOption{
+		grpc.WithPerRPCCredentials(chirpStackAPIToken(apiKey)),
+	}
+	if insecureConn {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	}
+
+	conn, err := grpc.DialContext(ctx, target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ChirpStack: %w", err)
+	}
+	defer conn.Close()
+
+	var (
+		client           = api.NewGatewayServiceClient(conn)
+		hasMore          = true
+		limit     uint32 = 500
+		processed uint32 = 0
+		gateways  []*api.GatewayListItem
+	)
+	for hasMore {
+		resp, err := client.List(ctx, &api.ListGatewaysRequest{
+			TenantId: tenantID,
+			Limit:    limit,
+			Offset:   processed,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("got error while listing gateways: %w", err)
+		}
+
+		processed += uint32(len(resp.GetResult()))
+		hasMore = len(resp.GetResult()) >= int(limit)
+		gateways = append(gateways, resp.GetResult()...)
+	}
+	return gateways, nil
+}
+
+// addGatewayByLocalID adds the gateway with a key generated by the forwarder
+// and returns it. Created is false when the gateway was already in the store.
+func addGatewayByLocalID(cfg *Config, localID lorawan.EUI64) (*gateway.Gateway, bool) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"localId": localID,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to prepare request")
+	}
+
+	endpoint := fmt.Sprintf("http://%s/v1/gateways", cfg.Forwarder.Gateways.HttpAPI.Address)
+	resp, err := http.Post(endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to add gateway")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var gw gateway.Gateway
+		if err := json.NewDecoder(resp.Body).Decode(&gw); err != nil {
+			logrus.WithError(err).Fatal("unable to decode response")
+		}
+		return &gw, resp.StatusCode == http.StatusCreated
+	default:
+		msg, _ := io.ReadAll(resp.Body)
+		logrus.Fatalf("unexpected reply from API: %d - %s", resp.StatusCode, msg)
+	}
+	return nil, false
+}
+
+func printChirpStackImport(imported []chirpStackImport) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"", "name", "thingsix_id", "local_id", "network_id", "status"})
+	for i, imp := range imported {
+		table.Append([]string{
+			fmt.Sprintf("%d", i+1),
+			imp.Name,
+			gateway.FormatThingsIxID(imp.Gateway.ThingsIxID, idFormat),
+			gateway.FormatEUI64(imp.Gateway.LocalID, idFormat),
+			gateway.FormatEUI64(imp.Gateway.NetworkID, idFormat),
+			imp.Status,
+		})
+	}
+	table.Render()
+}
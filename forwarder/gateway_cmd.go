@@ -18,15 +18,21 @@ package forwarder
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/gatewayid"
+	"github.com/ThingsIXFoundation/packet-handling/logging"
 	"github.com/brocaar/lorawan"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -61,8 +67,25 @@ var (
 	addGatewayCmd = &cobra.Command{
 		Use:   "add <local-id>",
 		Short: "Add gateway to gateway store",
-		Args:  cobra.ExactArgs(1),
-		Run:   addGatewayToStore,
+		Long: `Add gateway to the gateway store with a key generated by the forwarder.
+
+With --generate the key is generated by this command instead. Combined with
+--network-id-prefix keys are generated until the derived network id starts
+with the given hex prefix, for example a site code. Each hex digit makes this
+16 times harder, a 4 digit prefix takes 65536 attempts on average. The search
+stops after --max-attempts keys.
+
+With --key-ref the gateway uses a secp256k1 key held in a HSM or PKCS#11
+token, the store only holds the reference. The key must exist on the token,
+for example created with:
+
+  pkcs11-tool --module <module> --login --keypairgen --key-type EC:secp256k1 --label <label>
+
+and is referenced with a PKCS#11 URI:
+
+  pkcs11:token=<token>;object=<label>?module-path=<module>&pin-source=<pin-file>`,
+		Args: cobra.ExactArgs(1),
+		Run:  addGatewayToStore,
 	}
 
 	onboardGatewayCmd = &cobra.Command{
@@ -86,11 +109,58 @@ var (
 		Run:   gatewayDetails,
 	}
 
+	ensureGatewayCmd = &cobra.Command{
+		Use:   "ensure --local-id <local-id> --key-file <file>",
+		Short: "Add gateway with the given key to the gateway store if absent, verify its key if present",
+		Long: `Ensure the gateway is in the gateway store with the private key from the
+key file. The gateway is added when it is not in the store. If it is already
+in the store it is verified that it uses the same key. The command exits
+with code 2 when the gateway is in the store with a different key or the key
+is in use by another gateway. This makes the command safe to run repeatedly
+from configuration management tools.`,
+		Args: cobra.NoArgs,
+		Run:  ensureGateway,
+	}
+
+	gatewayIDCmd = &cobra.Command{
+		Use:   "id --key <key>",
+		Short: "Derive the ThingsIX id, network id and address from a gateway key",
+		Long: `Derive the gateway ids from a hex encoded private key, compressed or
+uncompressed public key. The ids are derived with the same rules as the
+forwarder uses, see the gatewayid package for the published test vectors.`,
+		Args: cobra.NoArgs,
+		Run:  deriveGatewayID,
+	}
+
+	encryptStoreCmd = &cobra.Command{
+		Use:   "encrypt-store",
+		Short: "Encrypt the plain text gateway keys in the file based gateway store",
+		Long: `Encrypt the private keys in the file based gateway store with the
+passphrase of the keystore that is configured in gateways.store.keystore.
+Keys that are already encrypted are kept as is. Stop the forwarder before
+running this command and start it with the keystore configured afterwards.`,
+		Args: cobra.NoArgs,
+		Run:  encryptGatewayStore,
+	}
+
+	encryptStoreFile string
+
+	ensureLocalID string
+	ensureKeyFile string
+	idKey         string
+
+	addGenerate        bool
+	addKeyRef          string
+	addNetworkIDPrefix string
+	addMaxAttempts     uint64
+
 	jsonOutput bool
+	idFormat   = gateway.IDFormatCanonical
 )
 
 func init() {
 	GatewayCmds.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Output in json format")
+	GatewayCmds.PersistentFlags().Var(&idFormatFlag{&idFormat}, "id-format", "Format of ids in table output (canonical, colon or short)")
 
 	GatewayCmds.AddCommand(importGatewayCmd)
 	GatewayCmds.AddCommand(importAndPushGatewayCmd)
@@ -99,10 +169,28 @@ func init() {
 	GatewayCmds.AddCommand(onboardGatewayCmd)
 	GatewayCmds.AddCommand(onboardAndPushGatewayCmd)
 	GatewayCmds.AddCommand(gatewayDetailsCmd)
+	GatewayCmds.AddCommand(ensureGatewayCmd)
+	GatewayCmds.AddCommand(gatewayIDCmd)
+	GatewayCmds.AddCommand(encryptStoreCmd)
+
+	ensureGatewayCmd.Flags().StringVar(&ensureLocalID, "local-id", "", "gateway local id")
+	ensureGatewayCmd.Flags().StringVar(&ensureKeyFile, "key-file", "", "file with the hex encoded gateway private key")
+	_ = ensureGatewayCmd.MarkFlagRequired("local-id")
+	_ = ensureGatewayCmd.MarkFlagRequired("key-file")
+
+	addGatewayCmd.Flags().BoolVar(&addGenerate, "generate", false, "generate the gateway key locally")
+	addGatewayCmd.Flags().StringVar(&addKeyRef, "key-ref", "", "reference to a key in a HSM or PKCS#11 token instead of a generated key")
+	addGatewayCmd.Flags().StringVar(&addNetworkIDPrefix, "network-id-prefix", "", "hex prefix the network id must start with, requires --generate")
+	addGatewayCmd.Flags().Uint64Var(&addMaxAttempts, "max-attempts", 10_000_000, "maximum number of keys to generate when searching a network id prefix")
+
+	encryptStoreCmd.Flags().StringVar(&encryptStoreFile, "file", "", "gateway store file, defaults to the configured store file")
+
+	gatewayIDCmd.Flags().StringVar(&idKey, "key", "", "hex encoded gateway private or public key")
+	_ = gatewayIDCmd.MarkFlagRequired("key")
 }
 
 func onboardGateway(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg     = mustLoadConfig(true)
@@ -114,7 +202,7 @@ func onboardGateway(cmd *cobra.Command, args []string) {
 }
 
 func onboardAndPushGateway(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg     = mustLoadConfig(true)
@@ -157,7 +245,7 @@ func onboardGatewayInternal(cfg *Config, localID lorawan.EUI64, owner common.Add
 }
 
 func gatewayDetails(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg     = mustLoadConfig(true)
@@ -187,7 +275,7 @@ func gatewayDetails(cmd *cobra.Command, args []string) {
 }
 
 func importGatewayStore(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg   = mustLoadConfig(true)
@@ -198,7 +286,7 @@ func importGatewayStore(cmd *cobra.Command, args []string) {
 }
 
 func importAndPushGatewayStore(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg   = mustLoadConfig(true)
@@ -241,7 +329,7 @@ func importGatewaysInternal(cfg *Config, owner common.Address, pushToThingsIX bo
 }
 
 func listGatewayStore(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg      = mustLoadConfig(true)
@@ -271,7 +359,7 @@ func listGatewayStore(cmd *cobra.Command, args []string) {
 }
 
 func addGatewayToStore(cmd *cobra.Command, args []string) {
-	logrus.SetLevel(logrus.ErrorLevel)
+	logging.SetDefaultLevel(logrus.ErrorLevel)
 
 	var (
 		cfg        = mustLoadConfig(true)
@@ -285,6 +373,26 @@ func addGatewayToStore(cmd *cobra.Command, args []string) {
 		logrus.Fatal("HTTP API endpoint missing")
 	}
 
+	if addNetworkIDPrefix != "" && !addGenerate {
+		logrus.Fatal("--network-id-prefix requires --generate")
+	}
+	if addKeyRef != "" && addGenerate {
+		logrus.Fatal("--key-ref and --generate are mutually exclusive")
+	}
+	if addGenerate {
+		addGeneratedGatewayToStore(cfg, localID)
+		return
+	}
+	if addKeyRef != "" {
+		stored := putGateway(cfg, localID, map[string]interface{}{"keyRef": addKeyRef})
+		if jsonOutput {
+			_ = json.NewEncoder(os.Stdout).Encode(stored)
+		} else {
+			printGatewaysAsTable([]*gateway.Gateway{stored})
+		}
+		return
+	}
+
 	endpoint := fmt.Sprintf("http://%s/v1/gateways", cfg.Forwarder.Gateways.HttpAPI.Address)
 	payload, err := json.Marshal(reqPayload)
 	if err != nil {
@@ -314,3 +422,232 @@ func addGatewayToStore(cmd *cobra.Command, args []string) {
 			resp.StatusCode, msg)
 	}
 }
+
+// addGeneratedGatewayToStore generates the gateway key, optionally with a
+// network id prefix, and adds it to the store through the ensure endpoint.
+func addGeneratedGatewayToStore(cfg *Config, localID lorawan.EUI64) {
+	var (
+		gw       *gateway.Gateway
+		attempts uint64
+		err      error
+	)
+	if addNetworkIDPrefix != "" {
+		gw, attempts, err = gateway.GenerateNewGatewayWithNetworkIDPrefix(context.Background(), localID, addNetworkIDPrefix, addMaxAttempts)
+	} else {
+		gw, err = gateway.GenerateNewGateway(localID)
+		attempts = 1
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to generate gateway key")
+	}
+
+	stored := putGateway(cfg, localID, map[string]interface{}{
+		"privateKey": hex.EncodeToString(crypto.FromECDSA(gw.PrivateKey)),
+	})
+
+	if jsonOutput {
+		_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"attempts": attempts,
+			"gateway":  stored,
+		})
+	} else {
+		if addNetworkIDPrefix != "" {
+			fmt.Printf("found network id with prefix %s after %d attempts\n", addNetworkIDPrefix, attempts)
+		}
+		printGatewaysAsTable([]*gateway.Gateway{stored})
+	}
+}
+
+// putGateway adds the gateway through the ensure endpoint and returns the
+// stored gateway. It exits when the gateway is already in the store.
+func putGateway(cfg *Config, localID lorawan.EUI64, body map[string]interface{}) *gateway.Gateway {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to prepare request")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/v1/gateways/%s",
+		cfg.Forwarder.Gateways.HttpAPI.Address, localID), bytes.NewReader(payload))
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to prepare request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to add gateway")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		var stored gateway.Gateway
+		if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+			logrus.WithError(err).Fatal("unable to decode response")
+		}
+		return &stored
+	case http.StatusOK, http.StatusConflict:
+		logrus.Fatal("gateway already in store")
+	default:
+		msg, _ := io.ReadAll(resp.Body)
+		logrus.Fatalf("unexpected reply from API: %d - %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// ensureConflictExitCode is the exit code of the ensure command when the
+// gateway store contains conflicting details.
+const ensureConflictExitCode = 2
+
+func ensureGateway(cmd *cobra.Command, args []string) {
+	logging.SetDefaultLevel(logrus.ErrorLevel)
+
+	var (
+		cfg     = mustLoadConfig(true)
+		localID = mustDecodeGatewayID(ensureLocalID)
+	)
+
+	if cfg.Forwarder.Gateways.HttpAPI.Address == "" {
+		logrus.Fatal("HTTP API endpoint missing")
+	}
+
+	key, err := os.ReadFile(ensureKeyFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read key file")
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"privateKey": strings.TrimSpace(string(key)),
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to prepare request")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/v1/gateways/%s",
+		cfg.Forwarder.Gateways.HttpAPI.Address, localID), bytes.NewReader(payload))
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to prepare request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to ensure gateway")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var (
+			gw      gateway.Gateway
+			changed = resp.StatusCode == http.StatusCreated
+		)
+		if err := json.NewDecoder(resp.Body).Decode(&gw); err != nil {
+			logrus.WithError(err).Fatal("unable to decode response")
+		}
+
+		if jsonOutput {
+			_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+				"changed": changed,
+				"gateway": gw,
+			})
+		} else {
+			if changed {
+				fmt.Println("gateway added")
+			} else {
+				fmt.Println("gateway present with same key")
+			}
+			printGatewaysAsTable([]*gateway.Gateway{&gw})
+		}
+	case http.StatusConflict:
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "conflict: %s", msg)
+		os.Exit(ensureConflictExitCode)
+	default:
+		msg, _ := io.ReadAll(resp.Body)
+		logrus.Fatalf("unexpected reply from API: %d - %s", resp.StatusCode, msg)
+	}
+}
+
+func encryptGatewayStore(cmd *cobra.Command, args []string) {
+	logging.SetDefaultLevel(logrus.ErrorLevel)
+
+	var (
+		cfg  = mustLoadConfig(true)
+		path = encryptStoreFile
+	)
+
+	if path == "" && cfg.Forwarder.Gateways.Store.YamlStorePath != nil {
+		path = *cfg.Forwarder.Gateways.Store.YamlStorePath
+	}
+	if path == "" {
+		logrus.Fatal("gateway store file missing")
+	}
+	if cfg.Forwarder.Gateways.Store.Keystore == nil {
+		logrus.Fatal("gateway keystore not configured")
+	}
+
+	ks, err := gateway.NewKeystore(cfg.Forwarder.Gateways.Store.Keystore)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to open gateway keystore")
+	}
+
+	encrypted, err := gateway.EncryptYamlFileStore(path, ks)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to encrypt gateway store")
+	}
+
+	if jsonOutput {
+		_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"file":      path,
+			"encrypted": encrypted,
+		})
+	} else {
+		fmt.Printf("encrypted %d gateway key(s) in %s\n", encrypted, path)
+	}
+}
+
+// idFormatFlag parses the --id-format flag.
+type idFormatFlag struct {
+	format *gateway.IDFormat
+}
+
+func (f *idFormatFlag) String() string {
+	if f.format == nil {
+		return string(gateway.IDFormatCanonical)
+	}
+	return string(*f.format)
+}
+
+func (f *idFormatFlag) Set(s string) error {
+	format, err := gateway.ParseIDFormat(s)
+	if err != nil {
+		return err
+	}
+	*f.format = format
+	return nil
+}
+
+func (f *idFormatFlag) Type() string {
+	return "format"
+}
+
+func deriveGatewayID(cmd *cobra.Command, args []string) {
+	ids, err := gatewayid.Parse(idKey)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to derive gateway ids")
+	}
+
+	if jsonOutput {
+		_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"gatewayId": ids.ThingsIxIDHex(),
+			"networkId": ids.NetworkID.String(),
+			"address":   ids.Address.Hex(),
+		})
+		return
+	}
+
+	fmt.Printf("ThingsIX ID: %s\n", gateway.FormatThingsIxID(ids.ThingsIxID, idFormat))
+	fmt.Printf("Network ID:  %s\n", gateway.FormatEUI64(ids.NetworkID, idFormat))
+	fmt.Printf("Address:     %s\n", ids.Address.Hex())
+}
@@ -0,0 +1,276 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// GatewayOnboardingStatus describes if a gateway in the store is onboarded
+// in the ThingsIX gateway registry.
+type GatewayOnboardingStatus struct {
+	LocalID    lorawan.EUI64      `json:"localId"`
+	NetworkID  lorawan.EUI64      `json:"networkId"`
+	ThingsIxID gateway.ThingsIxID `json:"gatewayId"`
+	Onboarded  bool               `json:"onboarded"`
+	Owner      *common.Address    `json:"owner,omitempty"`
+	Version    *uint8             `json:"version,omitempty"`
+	// DetailsSet is set when the owner set the gateway details, such as its
+	// location, which is required before the gateway is used for mapping
+	DetailsSet bool `json:"detailsSet"`
+}
+
+// DeleteGateway removes the gateway from the store.
+func (svc APIService) DeleteGateway(w http.ResponseWriter, r *http.Request) {
+	manager, ok := svc.gateways.(gateway.GatewayManager)
+	if !ok {
+		http.Error(w, "gateway store doesn't support removing gateways", http.StatusNotImplemented)
+		return
+	}
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	if err := manager.Remove(r.Context(), gw.LocalID); err != nil {
+		if errors.Is(err, gateway.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		logrus.WithError(err).Error("unable to remove gateway from store")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"gw_local_id":   gw.LocalID,
+		"gw_network_id": gw.NetworkID,
+	}).Info("removed gateway from store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetGatewayMetadata replaces the metadata of the gateway with the metadata
+// from the request body, an empty object removes the metadata.
+func (svc APIService) SetGatewayMetadata(w http.ResponseWriter, r *http.Request) {
+	manager, ok := svc.gateways.(gateway.GatewayManager)
+	if !ok {
+		http.Error(w, "gateway store doesn't support changing gateways", http.StatusNotImplemented)
+		return
+	}
+
+	var metadata gateway.GatewayMetadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := metadata.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	gw, err = manager.Update(r.Context(), gw.LocalID, func(gw *gateway.Gateway) error {
+		if metadata.Equal(&gateway.GatewayMetadata{}) {
+			gw.Metadata = nil
+		} else {
+			gw.Metadata = &metadata
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		replyJSON(w, http.StatusOK, gw)
+	case errors.Is(err, gateway.ErrNotFound):
+		http.NotFound(w, r)
+	default:
+		logrus.WithError(err).Error("unable to update gateway metadata")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// GatewayOnboarding replies with the onboarding status of the gateway.
+// If the sync query parameter is true the gateway is synced with the gateway
+// registry first.
+func (svc APIService) GatewayOnboarding(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("sync") == "true" {
+		if gw, err = svc.gateways.SyncGatewayByLocalID(r.Context(), gw.LocalID, true); err != nil {
+			logrus.WithError(err).Error("unable to sync gateway")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	replyJSON(w, http.StatusOK, GatewayOnboardingStatus{
+		LocalID:    gw.LocalID,
+		NetworkID:  gw.NetworkID,
+		ThingsIxID: gw.ThingsIxID,
+		Onboarded:  gw.Onboarded(),
+		Owner:      gw.Owner,
+		Version:    gw.Version,
+		DetailsSet: gatewayOnboardingState(gw) == GatewayOnboardingDetailsSet,
+	})
+}
+
+// newManagementRouter returns the routes of the gateway management API, a
+// subset of the private API that requires one of the given tokens.
+func newManagementRouter(service APIService, tokens [][sha256.Size]byte) chi.Router {
+	root := chi.NewRouter()
+	root.Use(bearerTokenAuth(tokens))
+	root.Route("/v1/gateways", func(r chi.Router) {
+		r.Get("/", service.ListGateways)
+		r.Post("/", service.AddGateway)
+		r.Post("/bulk", service.ManageBulkGateways)
+		r.Get("/{local_id}", service.Gateway)
+		r.Delete("/{local_id}", service.DeleteGateway)
+		r.Get("/{local_id}/onboarding", service.GatewayOnboarding)
+		r.Post("/{local_id}/uplink", service.InjectUplink)
+	})
+	root.Route("/v1/sites", func(r chi.Router) {
+		r.Get("/", service.ListSites)
+		r.Get("/{site_id}", service.Site)
+		r.Post("/{site_id}/enable", service.EnableSite)
+		r.Post("/{site_id}/disable", service.DisableSite)
+	})
+	return root
+}
+
+// bearerTokenAuth returns middleware that only passes requests with a bearer
+// token of which the hash is in tokens.
+func bearerTokenAuth(tokens [][sha256.Size]byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				if validBearerToken(tokens, strings.TrimPrefix(auth, "Bearer ")) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="thingsix-forwarder"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		})
+	}
+}
+
+// validBearerToken returns an indication if the hash of token is in tokens.
+func validBearerToken(tokens [][sha256.Size]byte, token string) bool {
+	var (
+		hash  = sha256.Sum256([]byte(token))
+		match = 0
+	)
+	// compare against all tokens in constant time
+	for i := range tokens {
+		match |= subtle.ConstantTimeCompare(hash[:], tokens[i][:])
+	}
+	return match == 1
+}
+
+// loadBearerTokens returns the hashes of the given tokens and the tokens in
+// tokensFile.
+func loadBearerTokens(configured []string, tokensFile string) ([][sha256.Size]byte, error) {
+	var tokens [][sha256.Size]byte
+	for _, token := range configured {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, sha256.Sum256([]byte(token)))
+		}
+	}
+	if tokensFile != "" {
+		f, err := os.Open(tokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open tokens file: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if token := strings.TrimSpace(scanner.Text()); token != "" && !strings.HasPrefix(token, "#") {
+				tokens = append(tokens, sha256.Sum256([]byte(token)))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read tokens file: %w", err)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens configured")
+	}
+	return tokens, nil
+}
+
+// runManagementAPI serves the gateway management API on ln until ctx
+// expires.
+func runManagementAPI(ctx context.Context, cfg *Config, ln net.Listener, exchange *Exchange) {
+	mcfg := cfg.Forwarder.Gateways.Management
+	tokens, err := loadBearerTokens(mcfg.Tokens, mcfg.TokensFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to load gateway management API tokens")
+	}
+
+	srv := http.Server{
+		Handler:      newManagementRouter(newAPIService(cfg, exchange), tokens),
+		Addr:         mcfg.Address,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"addr":   mcfg.Address,
+		"tokens": len(tokens),
+		"tls":    mcfg.CertFile != "" && mcfg.KeyFile != "",
+	}).Info("start gateway management API")
+
+	stopped := make(chan error)
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		stopped <- srv.Shutdown(ctx)
+	}()
+
+	if mcfg.CertFile != "" && mcfg.KeyFile != "" {
+		err = srv.ServeTLS(ln, mcfg.CertFile, mcfg.KeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).Fatal("gateway management API crashed")
+	}
+
+	<-stopped
+}
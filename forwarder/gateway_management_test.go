@@ -0,0 +1,108 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeleteGatewayRequiresToken(t *testing.T) {
+	const path = "/v1/gateways/0016c001f1500812"
+
+	var (
+		tokens     = [][sha256.Size]byte{sha256.Sum256([]byte("management-token"))}
+		management = newManagementRouter(APIService{}, tokens)
+		private    = newAPIRouter(APIService{})
+	)
+
+	for name, auth := range map[string]string{
+		"no token":      "",
+		"invalid token": "Bearer other-token",
+		"basic auth":    "Basic bWFuYWdlbWVudC10b2tlbg==",
+	} {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		management.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d from the management API, got %d", name, http.StatusUnauthorized, rec.Code)
+		}
+	}
+
+	// the private API is not authenticated and must not serve the delete
+	rec := httptest.NewRecorder()
+	private.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d from the private API, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestInjectUplinkRequiresToken(t *testing.T) {
+	const path = "/v1/gateways/0016c001f1500812/uplink"
+
+	var (
+		tokens     = [][sha256.Size]byte{sha256.Sum256([]byte("management-token"))}
+		management = newManagementRouter(APIService{}, tokens)
+		private    = newAPIRouter(APIService{})
+	)
+
+	rec := httptest.NewRecorder()
+	management.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d from the management API, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	// the private API is not authenticated and must not inject uplinks
+	rec = httptest.NewRecorder()
+	private.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	if rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d or %d from the private API, got %d", http.StatusNotFound, http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestBulkDeleteAndRotateRequireToken(t *testing.T) {
+	const path = "/v1/gateways/bulk"
+
+	var (
+		tokens     = [][sha256.Size]byte{sha256.Sum256([]byte("management-token"))}
+		management = newManagementRouter(APIService{}, tokens)
+		private    = newAPIRouter(APIService{})
+	)
+
+	for _, operation := range []string{bulkDelete, bulkRotate} {
+		body := `{"operation":"` + operation + `","gateways":["0016c001f1500812"],"force":true}`
+
+		rec := httptest.NewRecorder()
+		management.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d from the management API, got %d", operation, http.StatusUnauthorized, rec.Code)
+		}
+
+		// the private API is not authenticated and must refuse the operation
+		rec = httptest.NewRecorder()
+		private.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %d from the private API, got %d", operation, http.StatusForbidden, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	runtimePresetGateway = "gateway"
+	runtimePresetServer  = "server"
+)
+
+// runtimeTuning holds the garbage collector settings applied at startup.
+type runtimeTuning struct {
+	// gcPercent is the GOGC value, 0 to keep the default
+	gcPercent int
+	// memoryLimit is the soft memory limit in bytes, 0 for no limit
+	memoryLimit int64
+	// ballast is the size of the heap ballast in bytes, 0 for no ballast
+	ballast int64
+}
+
+// runtimePresets are tuned for the hosts the forwarder typically runs on.
+// Gateway-class hosts have little memory and a low packet rate, the
+// collector runs often to keep the heap small. Server-class hosts handle
+// many gateways, a ballast and a higher GOGC reduce the number of collections
+// and the pauses that delay packets.
+var runtimePresets = map[string]runtimeTuning{
+	runtimePresetGateway: {gcPercent: 50, memoryLimit: 96 << 20},
+	runtimePresetServer:  {gcPercent: 200, ballast: 256 << 20},
+}
+
+// gcBallast is allocated but never written, the memory is virtual and not
+// resident. It raises the heap size the collector paces against so that it
+// runs less often.
+var gcBallast []byte
+
+// applyRuntimeTuning applies the garbage collector settings in cfg. GOGC and
+// GOMEMLIMIT set in the environment take precedence over the configuration.
+func applyRuntimeTuning(cfg *ForwarderRuntimeConfig) {
+	var tuning runtimeTuning
+	if cfg.Preset != "" {
+		preset, ok := runtimePresets[cfg.Preset]
+		if !ok {
+			logrus.WithField("preset", cfg.Preset).Fatal("unknown runtime preset, expected gateway or server")
+		}
+		tuning = preset
+	}
+	if cfg.GCPercent != nil {
+		tuning.gcPercent = *cfg.GCPercent
+	}
+	if cfg.MemoryLimit != nil {
+		tuning.memoryLimit = *cfg.MemoryLimit
+	}
+	if cfg.Ballast != nil {
+		tuning.ballast = *cfg.Ballast
+	}
+
+	log := logrus.WithField("preset", cfg.Preset)
+	if tuning.gcPercent != 0 {
+		if os.Getenv("GOGC") != "" {
+			log.Info("GOGC set in environment, ignore configured gc_percent")
+		} else {
+			debug.SetGCPercent(tuning.gcPercent)
+			log = log.WithField("gc_percent", tuning.gcPercent)
+		}
+	}
+	if tuning.memoryLimit > 0 {
+		if os.Getenv("GOMEMLIMIT") != "" {
+			log.Info("GOMEMLIMIT set in environment, ignore configured memory_limit")
+		} else if setMemoryLimit(tuning.memoryLimit) {
+			log = log.WithField("memory_limit", tuning.memoryLimit)
+		} else {
+			log.Warn("memory limit not supported by this build, ignore configured memory_limit")
+		}
+	}
+	if tuning.ballast > 0 {
+		gcBallast = make([]byte, tuning.ballast)
+		log = log.WithField("ballast", tuning.ballast)
+	}
+	log.Info("applied runtime tuning")
+}
+
+// runGCMonitor periodically records the garbage collector pauses until ctx
+// expires. Packets that are processed during a pause are delayed by it, the
+// pause durations show the latency the collector adds.
+func runGCMonitor(ctx context.Context, interval time.Duration) {
+	var (
+		ticker = time.NewTicker(interval)
+		stats  debug.GCStats
+		last   int64
+	)
+	defer ticker.Stop()
+
+	debug.ReadGCStats(&stats)
+	last = stats.NumGC
+
+	for {
+		select {
+		case <-ticker.C:
+			debug.ReadGCStats(&stats)
+			// stats.Pause holds the most recent pauses first
+			var paused time.Duration
+			for i := 0; i < int(stats.NumGC-last) && i < len(stats.Pause); i++ {
+				gcPauseHistogram.Observe(stats.Pause[i].Seconds())
+				paused += stats.Pause[i]
+			}
+			gcPauseRatioGauge.Set(float64(paused) / float64(interval))
+			last = stats.NumGC
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/upgrade"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	gossipVersion       = 1
+	minGossipKeySize    = 16
+	defaultGossipWindow = 50 * time.Millisecond
+	// gossipRetention is how long peer reports are kept, and the maximum
+	// age of a message that is accepted
+	gossipRetention = 10 * time.Second
+	// gossipMaxFrames limits the number of peer reports that are kept
+	gossipMaxFrames = 65536
+	// gossipHeaderSize is the size of a gossip message without the forwarder
+	// id and hmac
+	gossipHeaderSize = 1 + 8 + 8 + 4 + 4 + 1
+)
+
+type gossipHash [8]byte
+
+// gossipCopy describes a copy of a frame received by a forwarder.
+type gossipCopy struct {
+	forwarder string
+	snr       float32
+	rssi      int32
+}
+
+// betterThan returns true if c has a better signal quality than o. The
+// forwarder id breaks ties, this ensures all forwarders agree which copy is
+// best.
+func (c gossipCopy) betterThan(o gossipCopy) bool {
+	if c.snr != o.snr {
+		return c.snr > o.snr
+	}
+	if c.rssi != o.rssi {
+		return c.rssi > o.rssi
+	}
+	return c.forwarder < o.forwarder
+}
+
+// gossipReport is the best copy of a frame reported by a peer.
+type gossipReport struct {
+	at   time.Time
+	best gossipCopy
+}
+
+// GossipPeers exchanges the hashes of received frames with the forwarders at
+// the same site. Each forwarder holds uplinks for a short window and drops
+// them when a peer reported a better copy of the same frame. This way only
+// the best copy is forwarded and routers send downlinks through the gateway
+// with the best reception, even if the gateways are connected to different
+// forwarders. If messages are lost all forwarders forward their copy.
+type GossipPeers struct {
+	id     string
+	conn   *net.UDPConn
+	peers  []*net.UDPAddr
+	key    []byte
+	window time.Duration
+
+	mu      sync.Mutex
+	reports map[gossipHash]gossipReport
+}
+
+// NewGossipPeers returns the gossip peers configured from cfg and binds the
+// gossip socket.
+func NewGossipPeers(cfg *ForwarderGossipConfig) (*GossipPeers, error) {
+	key := []byte(cfg.Key)
+	if cfg.KeyFile != "" {
+		raw, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gossip key: %w", err)
+		}
+		key = []byte(strings.TrimSpace(string(raw)))
+	}
+	if len(key) < minGossipKeySize {
+		return nil, fmt.Errorf("gossip key must be at least %d bytes", minGossipKeySize)
+	}
+	if len(cfg.Peers) == 0 {
+		return nil, fmt.Errorf("gossip requires at least 1 peer")
+	}
+
+	g := &GossipPeers{
+		id:      cfg.ID,
+		key:     key,
+		window:  defaultGossipWindow,
+		reports: make(map[gossipHash]gossipReport),
+	}
+	if g.id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine gossip id: %w", err)
+		}
+		g.id = hostname
+	}
+	if len(g.id) > math.MaxUint8 {
+		return nil, fmt.Errorf("gossip id too long")
+	}
+	if cfg.Window != nil && *cfg.Window >= 0 {
+		g.window = *cfg.Window
+	}
+	for _, peer := range cfg.Peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gossip peer %s: %w", peer, err)
+		}
+		g.peers = append(g.peers, addr)
+	}
+
+	// bind through the upgrader to reuse the socket from a parent process
+	// when this process was started as part of a zero-downtime upgrade
+	conn, err := upgrade.Default().ListenUDP(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to bind gossip socket: %w", err)
+	}
+	g.conn = conn
+
+	logrus.WithFields(logrus.Fields{
+		"address": cfg.Address,
+		"id":      g.id,
+		"peers":   len(g.peers),
+		"window":  g.window,
+	}).Info("gossip with peer forwarders")
+
+	return g, nil
+}
+
+func gossipFrameHash(frame *gw.UplinkFrame) gossipHash {
+	var h gossipHash
+	sum := sha256.Sum256(frame.GetPhyPayload())
+	copy(h[:], sum[:])
+	return h
+}
+
+// Hold announces the frame to the peers and calls deliver after the gossip
+// window. Duplicate is set when a peer reported a better copy of the frame
+// and this copy must not be forwarded.
+func (g *GossipPeers) Hold(frame *gw.UplinkFrame, deliver func(duplicate bool)) {
+	var (
+		hash = gossipFrameHash(frame)
+		own  = gossipCopy{
+			forwarder: g.id,
+			snr:       frame.GetRxInfo().GetSnr(),
+			rssi:      frame.GetRxInfo().GetRssi(),
+		}
+	)
+	g.announce(hash, own)
+
+	time.AfterFunc(g.window, func() {
+		g.mu.Lock()
+		report, ok := g.reports[hash]
+		g.mu.Unlock()
+
+		duplicate := ok && report.best.betterThan(own)
+		if duplicate {
+			gossipUplinksCounter.WithLabelValues("duplicate").Inc()
+		} else {
+			gossipUplinksCounter.WithLabelValues("forwarded").Inc()
+		}
+		deliver(duplicate)
+	})
+}
+
+// announce sends the copy of the frame with the given hash to all peers.
+func (g *GossipPeers) announce(hash gossipHash, c gossipCopy) {
+	msg := g.encode(hash, c, time.Now())
+	for _, peer := range g.peers {
+		if _, err := g.conn.WriteToUDP(msg, peer); err != nil {
+			logrus.WithError(err).WithField("peer", peer).Debug("unable to send gossip message")
+			gossipMessagesCounter.WithLabelValues("failed").Inc()
+			continue
+		}
+		gossipMessagesCounter.WithLabelValues("sent").Inc()
+	}
+}
+
+// encode returns the gossip message for the copy:
+// version(1) | time(8) | hash(8) | snr(4) | rssi(4) | len(id)(1) | id | hmac(32)
+func (g *GossipPeers) encode(hash gossipHash, c gossipCopy, now time.Time) []byte {
+	msg := make([]byte, gossipHeaderSize, gossipHeaderSize+len(c.forwarder)+sha256.Size)
+	msg[0] = gossipVersion
+	binary.BigEndian.PutUint64(msg[1:9], uint64(now.UnixMilli()))
+	copy(msg[9:17], hash[:])
+	binary.BigEndian.PutUint32(msg[17:21], math.Float32bits(c.snr))
+	binary.BigEndian.PutUint32(msg[21:25], uint32(c.rssi))
+	msg[25] = byte(len(c.forwarder))
+	msg = append(msg, c.forwarder...)
+
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(msg)
+	return mac.Sum(msg)
+}
+
+// decode verifies and decodes a gossip message.
+func (g *GossipPeers) decode(msg []byte, now time.Time) (gossipHash, gossipCopy, error) {
+	var (
+		hash gossipHash
+		c    gossipCopy
+	)
+	if len(msg) < gossipHeaderSize+sha256.Size || msg[0] != gossipVersion {
+		return hash, c, errors.New("invalid gossip message")
+	}
+	body, sum := msg[:len(msg)-sha256.Size], msg[len(msg)-sha256.Size:]
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(body)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return hash, c, errors.New("invalid gossip message signature")
+	}
+	if len(body) != gossipHeaderSize+int(body[gossipHeaderSize-1]) {
+		return hash, c, errors.New("invalid gossip message")
+	}
+
+	sent := time.UnixMilli(int64(binary.BigEndian.Uint64(body[1:9])))
+	if age := now.Sub(sent); age > gossipRetention || age < -gossipRetention {
+		return hash, c, errors.New("gossip message expired")
+	}
+	copy(hash[:], body[9:17])
+	c.snr = math.Float32frombits(binary.BigEndian.Uint32(body[17:21]))
+	c.rssi = int32(binary.BigEndian.Uint32(body[21:25]))
+	c.forwarder = string(body[gossipHeaderSize:])
+	return hash, c, nil
+}
+
+// record keeps the copy reported by a peer if it is the best copy of the
+// frame.
+func (g *GossipPeers) record(hash gossipHash, c gossipCopy, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	report, ok := g.reports[hash]
+	if !ok && len(g.reports) >= gossipMaxFrames {
+		return
+	}
+	if !ok || c.betterThan(report.best) {
+		g.reports[hash] = gossipReport{at: now, best: c}
+	}
+}
+
+// expire removes peer reports that are older than the retention.
+func (g *GossipPeers) expire(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for hash, report := range g.reports {
+		if now.Sub(report.at) > gossipRetention {
+			delete(g.reports, hash)
+		}
+	}
+}
+
+// Run receives gossip messages from peers until ctx expires.
+func (g *GossipPeers) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		_ = g.conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				g.expire(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 512)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithError(err).Warn("unable to read gossip message")
+			continue
+		}
+		now := time.Now()
+		hash, c, err := g.decode(buf[:n], now)
+		if err != nil {
+			logrus.WithError(err).WithField("peer", from).Debug("drop gossip message")
+			gossipMessagesCounter.WithLabelValues("invalid").Inc()
+			continue
+		}
+		if c.forwarder == g.id {
+			continue
+		}
+		gossipMessagesCounter.WithLabelValues("received").Inc()
+		g.record(hash, c, now)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package graphql implements a small read-only GraphQL executor. It supports
+// query operations with fields, aliases, arguments and variables. Mutations,
+// subscriptions, fragments, directives and introspection are not supported.
+// Schemas are defined in Go with objects whose fields are resolved by
+// functions.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ResolveFunc resolves a field value for the given source object, which is
+// the value returned by the parent field or nil for query fields.
+type ResolveFunc func(ctx context.Context, source interface{}, args Args) (interface{}, error)
+
+// Field is a field of an object.
+type Field struct {
+	// Description of the field
+	Description string
+	// Type is the object type of the field value, or of the list elements
+	// if the field returns a slice. Nil for scalar fields, their value is
+	// encoded as JSON.
+	Type *Object
+	// Args are the names of the arguments the field accepts
+	Args []string
+	// Resolve returns the field value
+	Resolve ResolveFunc
+}
+
+// Object is an object type with fields that can be selected.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Schema describes the data that can be queried.
+type Schema struct {
+	Query *Object
+}
+
+// Request is a GraphQL request as posted by clients.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Error is a GraphQL error.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Response is the result of a query.
+type Response struct {
+	Data   *OrderedMap `json:"data"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// Args holds the resolved arguments of a field.
+type Args map[string]interface{}
+
+// String returns the string argument with the given name.
+func (a Args) String(name string) (string, bool) {
+	s, ok := a[name].(string)
+	return s, ok
+}
+
+// Int returns the int argument with the given name. Integers in variables
+// decoded from JSON are float64 and are accepted if they are whole numbers.
+func (a Args) Int(name string) (int, bool) {
+	switch v := a[name].(type) {
+	case int64:
+		return int(v), true
+	case float64:
+		if v == float64(int64(v)) {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// Bool returns the bool argument with the given name.
+func (a Args) Bool(name string) (bool, bool) {
+	b, ok := a[name].(bool)
+	return b, ok
+}
+
+// OrderedMap is a JSON object that keeps keys in insertion order, GraphQL
+// returns fields in the order they are selected.
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedMap() *OrderedMap {
+	return &OrderedMap{values: make(map[string]interface{})}
+}
+
+// Set sets key to value, new keys are appended.
+func (m *OrderedMap) Set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value for key.
+func (m *OrderedMap) Get(key string) (interface{}, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+// MarshalJSON encodes the map as JSON object with keys in insertion order.
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+		v, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Execute runs the query in req against the schema.
+func Execute(ctx context.Context, schema *Schema, req Request) *Response {
+	op, err := parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	if req.OperationName != "" && op.name != "" && req.OperationName != op.name {
+		return &Response{Errors: []*Error{{Message: fmt.Sprintf("unknown operation %q", req.OperationName)}}}
+	}
+
+	variables := make(map[string]interface{}, len(op.variables))
+	for name, def := range op.variables {
+		if v, ok := req.Variables[name]; ok {
+			variables[name] = v
+		} else {
+			variables[name] = resolveValue(def, nil)
+		}
+	}
+
+	e := &executor{variables: variables}
+	data := e.selectionSet(ctx, schema.Query, nil, op.selection, nil)
+	return &Response{Data: data, Errors: e.errors}
+}
+
+type executor struct {
+	variables map[string]interface{}
+	errors    []*Error
+}
+
+func (e *executor) fail(path []interface{}, format string, args ...interface{}) {
+	e.errors = append(e.errors, &Error{
+		Message: fmt.Sprintf(format, args...),
+		Path:    append([]interface{}{}, path...),
+	})
+}
+
+func (e *executor) selectionSet(ctx context.Context, obj *Object, source interface{}, selections []*selection, path []interface{}) *OrderedMap {
+	result := newOrderedMap()
+	for _, sel := range selections {
+		var (
+			key       = sel.responseKey()
+			fieldPath = append(append([]interface{}{}, path...), key)
+		)
+
+		if sel.name == "__typename" {
+			result.Set(key, obj.Name)
+			continue
+		}
+
+		field, ok := obj.Fields[sel.name]
+		if !ok {
+			e.fail(fieldPath, "unknown field %q on %s", sel.name, obj.Name)
+			result.Set(key, nil)
+			continue
+		}
+
+		args, err := e.arguments(field, sel)
+		if err != nil {
+			e.fail(fieldPath, "%s", err)
+			result.Set(key, nil)
+			continue
+		}
+
+		value, err := field.Resolve(ctx, source, args)
+		if err != nil {
+			e.fail(fieldPath, "%s", err)
+			result.Set(key, nil)
+			continue
+		}
+
+		result.Set(key, e.complete(ctx, field, sel, value, fieldPath))
+	}
+	return result
+}
+
+func (e *executor) arguments(field *Field, sel *selection) (Args, error) {
+	args := make(Args, len(sel.arguments))
+	for name, v := range sel.arguments {
+		known := false
+		for _, a := range field.Args {
+			if a == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown argument %q on field %q", name, sel.name)
+		}
+		args[name] = resolveValue(v, e.variables)
+	}
+	return args, nil
+}
+
+// complete turns a resolved field value into its response representation.
+func (e *executor) complete(ctx context.Context, field *Field, sel *selection, value interface{}, path []interface{}) interface{} {
+	if field.Type == nil {
+		if sel.selection != nil {
+			e.fail(path, "field %q is a scalar and can't have a selection", sel.name)
+			return nil
+		}
+		return value
+	}
+
+	if sel.selection == nil {
+		e.fail(path, "field %q of type %s must have a selection", sel.name, field.Type.Name)
+		return nil
+	}
+	if isNil(value) {
+		return nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice {
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			elem := rv.Index(i).Interface()
+			if isNil(elem) {
+				continue
+			}
+			list[i] = e.selectionSet(ctx, field.Type, elem, sel.selection, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	}
+	return e.selectionSet(ctx, field.Type, value, sel.selection, path)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// resolveValue replaces variable references in v with their values.
+func resolveValue(v value, variables map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case variableRef:
+		return variables[string(v)]
+	case enumValue:
+		return string(v)
+	case []value:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = resolveValue(elem, variables)
+		}
+		return list
+	case map[string]value:
+		obj := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			obj[k] = resolveValue(elem, variables)
+		}
+		return obj
+	default:
+		return v
+	}
+}
+
+// SchemaSDL returns a description of the schema in the GraphQL schema
+// definition language. Scalar fields are described with the JSON type since
+// their type is not declared.
+func SchemaSDL(schema *Schema) string {
+	var (
+		sb      strings.Builder
+		seen    = map[*Object]bool{}
+		pending = []*Object{schema.Query}
+	)
+	for len(pending) > 0 {
+		obj := pending[0]
+		pending = pending[1:]
+		if seen[obj] {
+			continue
+		}
+		seen[obj] = true
+
+		names := make([]string, 0, len(obj.Fields))
+		for name := range obj.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(&sb, "type %s {\n", obj.Name)
+		for _, name := range names {
+			field := obj.Fields[name]
+			if field.Description != "" {
+				fmt.Fprintf(&sb, "  # %s\n", field.Description)
+			}
+			typ := "JSON"
+			if field.Type != nil {
+				typ = field.Type.Name
+				pending = append(pending, field.Type)
+			}
+			args := ""
+			if len(field.Args) > 0 {
+				args = "(" + strings.Join(field.Args, ", ") + ")"
+			}
+			fmt.Fprintf(&sb, "  %s%s: %s\n", name, args, typ)
+		}
+		sb.WriteString("}\n\n")
+	}
+	return strings.TrimSpace(sb.String()) + "\n"
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type testGateway struct {
+	ID    string
+	Owner string
+}
+
+func testSchema() *Schema {
+	gatewayType := &Object{Name: "Gateway", Fields: map[string]*Field{
+		"id": {Resolve: func(ctx context.Context, source interface{}, args Args) (interface{}, error) {
+			return source.(*testGateway).ID, nil
+		}},
+		"owner": {Resolve: func(ctx context.Context, source interface{}, args Args) (interface{}, error) {
+			if source.(*testGateway).Owner == "" {
+				return nil, errors.New("owner unknown")
+			}
+			return source.(*testGateway).Owner, nil
+		}},
+	}}
+	gateways := []*testGateway{{ID: "a", Owner: "alice"}, {ID: "b"}, {ID: "c", Owner: "carol"}}
+
+	return &Schema{Query: &Object{Name: "Query", Fields: map[string]*Field{
+		"gateways": {
+			Type: gatewayType,
+			Args: []string{"first"},
+			Resolve: func(ctx context.Context, source interface{}, args Args) (interface{}, error) {
+				if first, ok := args.Int("first"); ok && first < len(gateways) {
+					return gateways[:first], nil
+				}
+				return gateways, nil
+			},
+		},
+		"gateway": {
+			Type: gatewayType,
+			Args: []string{"id"},
+			Resolve: func(ctx context.Context, source interface{}, args Args) (interface{}, error) {
+				id, _ := args.String("id")
+				for _, gw := range gateways {
+					if gw.ID == id {
+						return gw, nil
+					}
+				}
+				return nil, nil
+			},
+		},
+		"version": {Resolve: func(ctx context.Context, source interface{}, args Args) (interface{}, error) {
+			return "1.0", nil
+		}},
+	}}}
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		query     string
+		variables map[string]interface{}
+		expected  string
+	}{
+		{
+			query:    `{ version gateways(first: 1) { id owner } }`,
+			expected: `{"data":{"version":"1.0","gateways":[{"id":"a","owner":"alice"}]}}`,
+		},
+		{
+			query:    `query Q($id: String = "c") { gw: gateway(id: $id) { __typename id } }`,
+			expected: `{"data":{"gw":{"__typename":"Gateway","id":"c"}}}`,
+		},
+		{
+			query:     `query Q($id: String) { gateway(id: $id) { id } missing: gateway(id: "x") { id } }`,
+			variables: map[string]interface{}{"id": "a"},
+			expected:  `{"data":{"gateway":{"id":"a"},"missing":null}}`,
+		},
+		{
+			query:    `{ gateways(first: 2) { owner } }`,
+			expected: `{"data":{"gateways":[{"owner":"alice"},{"owner":null}]},"errors":[{"message":"owner unknown","path":["gateways",1,"owner"]}]}`,
+		},
+		{
+			query:    `{ version { id } gateway(id: "a") unknown }`,
+			expected: `{"data":{"version":null,"gateway":null,"unknown":null},"errors":[{"message":"field \"version\" is a scalar and can't have a selection","path":["version"]},{"message":"field \"gateway\" of type Gateway must have a selection","path":["gateway"]},{"message":"unknown field \"unknown\" on Query","path":["unknown"]}]}`,
+		},
+		{
+			query:    `mutation { version }`,
+			expected: `{"data":null,"errors":[{"message":"mutation operations are not supported"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		resp := Execute(context.Background(), testSchema(), Request{Query: tt.query, Variables: tt.variables})
+		got, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatalf("unable to encode response: %v", err)
+		}
+		if string(got) != tt.expected {
+			t.Errorf("query %s:\n got: %s\nwant: %s", tt.query, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// selection is a field in a selection set.
+type selection struct {
+	alias     string
+	name      string
+	arguments map[string]value
+	selection []*selection
+}
+
+// responseKey returns the key under which the field is returned.
+func (s *selection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// operation is a parsed query operation.
+type operation struct {
+	name      string
+	variables map[string]value // default values
+	selection []*selection
+}
+
+// value is an argument value that is resolved against the variables when the
+// query is executed.
+type value interface{}
+
+type variableRef string
+
+type enumValue string
+
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+// parse parses a document with a single query operation. Mutations,
+// subscriptions, fragments and directives are not supported.
+func parse(query string) (*operation, error) {
+	p := &parser{lex: &lexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	op := &operation{variables: make(map[string]value)}
+	if p.tok.kind == tokenName {
+		switch p.tok.value {
+		case "query":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind == tokenName {
+				op.name = p.tok.value
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+			}
+			if p.is("(") {
+				if err := p.variableDefinitions(op); err != nil {
+					return nil, err
+				}
+			}
+		case "mutation", "subscription":
+			return nil, fmt.Errorf("%s operations are not supported", p.tok.value)
+		case "fragment":
+			return nil, fmt.Errorf("fragments are not supported")
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	selection, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selection = selection
+
+	if p.tok.kind != tokenEOF {
+		if p.tok.kind == tokenName && p.tok.value == "fragment" {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		return nil, fmt.Errorf("only a single operation is supported")
+	}
+	return op, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) is(punct string) bool {
+	return p.tok.kind == tokenPunct && p.tok.value == punct
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.is(punct) {
+		return fmt.Errorf("expected %q at %d", punct, p.tok.pos)
+	}
+	return p.advance()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokenName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of query")
+	}
+	return fmt.Errorf("unexpected %q at %d", p.tok.value, p.tok.pos)
+}
+
+func (p *parser) variableDefinitions(op *operation) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		// types are not validated, values are checked by the resolvers
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		op.variables[name] = nil
+		if p.is("=") {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			def, err := p.value()
+			if err != nil {
+				return err
+			}
+			op.variables[name] = def
+		}
+	}
+	return p.advance()
+}
+
+func (p *parser) skipType() error {
+	if p.is("[") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.is("!") {
+		return p.advance()
+	}
+	return nil
+}
+
+func (p *parser) selectionSet() ([]*selection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var fields []*selection
+	for !p.is("}") {
+		if p.is("...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty selection set at %d", p.tok.pos)
+	}
+	return fields, p.advance()
+}
+
+func (p *parser) field() (*selection, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field := &selection{name: name, arguments: make(map[string]value)}
+
+	if p.is(":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		field.alias = name
+		if field.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.is("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		for !p.is(")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if field.arguments[arg], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.is("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+
+	if p.is("{") {
+		if field.selection, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *parser) value() (value, error) {
+	tok := p.tok
+	switch {
+	case p.is("$"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return variableRef(name), err
+	case p.is("["):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []value{}
+		for !p.is("]") {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.advance()
+	case p.is("{"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := map[string]value{}
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.advance()
+	case tok.kind == tokenInt:
+		v, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %q at %d", tok.value, tok.pos)
+		}
+		return v, p.advance()
+	case tok.kind == tokenFloat:
+		v, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %q at %d", tok.value, tok.pos)
+		}
+		return v, p.advance()
+	case tok.kind == tokenString:
+		return tok.value, p.advance()
+	case tok.kind == tokenName:
+		switch tok.value {
+		case "true":
+			return true, p.advance()
+		case "false":
+			return false, p.advance()
+		case "null":
+			return nil, p.advance()
+		default:
+			return enumValue(tok.value), p.advance()
+		}
+	default:
+		return nil, p.unexpected()
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/graphql"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+)
+
+// graphQLMaxListSize limits the number of items list fields return.
+const graphQLMaxListSize = 1000
+
+// GraphQL executes a read-only GraphQL query over the forwarder state. It
+// accepts the query as JSON body in a POST request or as query parameter in
+// a GET request.
+func (svc APIService) GraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphql.Request
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Query == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	replyJSON(w, http.StatusOK, graphql.Execute(r.Context(), svc.graphQLSchema(), req))
+}
+
+// GraphQLSchema returns the schema of the GraphQL endpoint.
+func (svc APIService) GraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(graphql.SchemaSDL(svc.graphQLSchema())))
+}
+
+func (svc APIService) graphQLSchema() *graphql.Schema {
+	var (
+		gatewayType = &graphql.Object{Name: "Gateway", Fields: map[string]*graphql.Field{
+			"localId":   gatewayField(func(gw *gateway.Gateway) interface{} { return gw.LocalID }),
+			"networkId": gatewayField(func(gw *gateway.Gateway) interface{} { return gw.NetworkID }),
+			"thingsIxId": gatewayField(func(gw *gateway.Gateway) interface{} {
+				return gw.ThingsIxID.String()
+			}),
+			"owner": gatewayField(func(gw *gateway.Gateway) interface{} {
+				if gw.Owner == nil {
+					return nil
+				}
+				return gw.Owner.Hex()
+			}),
+			"onboarded": gatewayField(func(gw *gateway.Gateway) interface{} { return gw.Onboarded() }),
+			"version":   gatewayField(func(gw *gateway.Gateway) interface{} { return gw.Version }),
+			"antennaGain": gatewayField(func(gw *gateway.Gateway) interface{} {
+				if gw.Details == nil {
+					return nil
+				}
+				return gw.Details.AntennaGain
+			}),
+			"band": gatewayField(func(gw *gateway.Gateway) interface{} {
+				if gw.Details == nil {
+					return nil
+				}
+				return gw.Details.Band
+			}),
+			"location": gatewayField(func(gw *gateway.Gateway) interface{} {
+				if gw.Details == nil {
+					return nil
+				}
+				return gw.Details.Location
+			}),
+			"altitude": gatewayField(func(gw *gateway.Gateway) interface{} {
+				if gw.Details == nil {
+					return nil
+				}
+				return gw.Details.Altitude
+			}),
+			"region": gatewayField(func(gw *gateway.Gateway) interface{} {
+				if region := gatewayRegion(gw, svc.gateways); region != frequency_plan.Invalid {
+					return region
+				}
+				return nil
+			}),
+		}}
+
+		routeType = &graphql.Object{Name: "Route", Fields: map[string]*graphql.Field{
+			"id":       routeField(func(r *Router) interface{} { return r.ThingsIXID.String() }),
+			"name":     routeField(func(r *Router) interface{} { return r.String() }),
+			"endpoint": routeField(func(r *Router) interface{} { return r.Endpoint }),
+			"default":  routeField(func(r *Router) interface{} { return r.Default }),
+			"netId":    routeField(func(r *Router) interface{} { return r.NetID.String() }),
+			"prefix":   routeField(func(r *Router) interface{} { return fmt.Sprintf("%08x", r.Prefix) }),
+			"mask":     routeField(func(r *Router) interface{} { return r.Mask }),
+			"owner":    routeField(func(r *Router) interface{} { return r.Owner.Hex() }),
+			"frequencyPlan": routeField(func(r *Router) interface{} {
+				if r.Default {
+					return nil
+				}
+				return frequency_plan.FromBlockchain(r.FrequencyPlan)
+			}),
+			"regions": routeField(func(r *Router) interface{} { return r.Regions }),
+		}}
+
+		eventType = &graphql.Object{Name: "PacketEvent", Fields: map[string]*graphql.Field{
+			"time":             eventField(func(ev *PacketEvent) interface{} { return ev.Time }),
+			"type":             eventField(func(ev *PacketEvent) interface{} { return ev.Type }),
+			"gatewayNetworkId": eventField(func(ev *PacketEvent) interface{} { return ev.GatewayNetworkID }),
+			"gatewayLocalId":   eventField(func(ev *PacketEvent) interface{} { return ev.GatewayLocalID }),
+			"owner":            eventField(func(ev *PacketEvent) interface{} { return ev.Owner }),
+			"region":           eventField(func(ev *PacketEvent) interface{} { return ev.Region }),
+			"frequency":        eventField(func(ev *PacketEvent) interface{} { return ev.Frequency }),
+			"spreadingFactor":  eventField(func(ev *PacketEvent) interface{} { return ev.SpreadingFactor }),
+			"bandwidth":        eventField(func(ev *PacketEvent) interface{} { return ev.Bandwidth }),
+			"rssi":             eventField(func(ev *PacketEvent) interface{} { return ev.RSSI }),
+			"snr":              eventField(func(ev *PacketEvent) interface{} { return ev.SNR }),
+			"payloadSize":      eventField(func(ev *PacketEvent) interface{} { return ev.PayloadSize }),
+			"airtimeMs": eventField(func(ev *PacketEvent) interface{} {
+				return float64(ev.Airtime) / float64(time.Millisecond)
+			}),
+			"mtype":       eventField(func(ev *PacketEvent) interface{} { return ev.MType }),
+			"devAddr":     eventField(func(ev *PacketEvent) interface{} { return ev.DevAddr }),
+			"devEui":      eventField(func(ev *PacketEvent) interface{} { return ev.DevEUI }),
+			"fCnt":        eventField(func(ev *PacketEvent) interface{} { return ev.FCnt }),
+			"downlinkId":  eventField(func(ev *PacketEvent) interface{} { return ev.DownlinkID }),
+			"txAckStatus": eventField(func(ev *PacketEvent) interface{} { return ev.TxAckStatus }),
+			"packetId":    eventField(func(ev *PacketEvent) interface{} { return ev.PacketID }),
+		}}
+
+		featureType = &graphql.Object{Name: "Feature", Fields: map[string]*graphql.Field{
+			"name":        featureField(func(f features.Status) interface{} { return f.Name }),
+			"description": featureField(func(f features.Status) interface{} { return f.Description }),
+			"default":     featureField(func(f features.Status) interface{} { return f.Default }),
+			"enabled":     featureField(func(f features.Status) interface{} { return f.Enabled }),
+		}}
+
+		deviceDensityType = &graphql.Object{Name: "DeviceDensity", Fields: map[string]*graphql.Field{
+			"localId":   densityField(func(d *DeviceDensityEstimate) interface{} { return d.LocalID }),
+			"networkId": densityField(func(d *DeviceDensityEstimate) interface{} { return d.NetworkID }),
+			"lastHour":  densityField(func(d *DeviceDensityEstimate) interface{} { return d.LastHour }),
+			"lastDay":   densityField(func(d *DeviceDensityEstimate) interface{} { return d.LastDay }),
+		}}
+
+		statsType = &graphql.Object{Name: "Stats", Fields: map[string]*graphql.Field{
+			"devices": {
+				Description: "estimated number of distinct devices per gateway",
+				Type:        deviceDensityType,
+				Resolve: func(ctx context.Context, _ interface{}, _ graphql.Args) (interface{}, error) {
+					estimates := svc.deviceDensity.Estimates(time.Now())
+					result := make([]*DeviceDensityEstimate, len(estimates))
+					for i := range estimates {
+						result[i] = &estimates[i]
+					}
+					return result, nil
+				},
+			},
+			"coverageGaps": {
+				Description: "last generated coverage gap report",
+				Resolve: func(ctx context.Context, _ interface{}, _ graphql.Args) (interface{}, error) {
+					return svc.coverageGaps.Last(), nil
+				},
+			},
+		}}
+	)
+
+	return &graphql.Schema{Query: &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"gateways": {
+			Description: "gateways in the gateway store ordered by local id",
+			Type:        gatewayType,
+			Args:        []string{"first", "onboarded"},
+			Resolve: func(ctx context.Context, _ interface{}, args graphql.Args) (interface{}, error) {
+				var collector gateway.Collector
+				svc.gateways.Range(&collector)
+
+				gateways := make([]*gateway.Gateway, 0, len(collector.Gateways))
+				onboarded, filter := args.Bool("onboarded")
+				for _, gw := range collector.Gateways {
+					if !filter || gw.Onboarded() == onboarded {
+						gateways = append(gateways, gw)
+					}
+				}
+				sort.Slice(gateways, func(i, j int) bool {
+					return bytes.Compare(gateways[i].LocalID[:], gateways[j].LocalID[:]) < 0
+				})
+
+				first, err := graphQLFirst(args)
+				if err != nil {
+					return nil, err
+				}
+				if len(gateways) > first {
+					gateways = gateways[:first]
+				}
+				return gateways, nil
+			},
+		},
+		"gateway": {
+			Description: "gateway identified by its local, network or ThingsIX id in any format",
+			Type:        gatewayType,
+			Args:        []string{"id", "localId", "networkId"},
+			Resolve: func(ctx context.Context, _ interface{}, args graphql.Args) (interface{}, error) {
+				var (
+					gw  *gateway.Gateway
+					err error
+				)
+				if id, ok := args.String("id"); ok {
+					gw, err = gateway.Lookup(svc.gateways, id)
+				} else if id, ok := args.String("localId"); ok {
+					localID, perr := gateway.ParseEUI64(id)
+					if perr != nil {
+						return nil, fmt.Errorf("invalid localId")
+					}
+					gw, err = svc.gateways.ByLocalID(localID)
+				} else if id, ok := args.String("networkId"); ok {
+					networkID, perr := gateway.ParseEUI64(id)
+					if perr != nil {
+						return nil, fmt.Errorf("invalid networkId")
+					}
+					gw, err = svc.gateways.ByNetworkID(networkID)
+				} else {
+					return nil, fmt.Errorf("id, localId or networkId required")
+				}
+				if errors.Is(err, gateway.ErrNotFound) {
+					return nil, nil
+				}
+				return gw, err
+			},
+		},
+		"routes": {
+			Description: "default routers and routers registered in ThingsIX",
+			Type:        routeType,
+			Resolve: func(ctx context.Context, _ interface{}, _ graphql.Args) (interface{}, error) {
+				return svc.routingTable.Routes(), nil
+			},
+		},
+		"stats": {
+			Description: "forwarder statistics",
+			Type:        statsType,
+			Resolve: func(ctx context.Context, _ interface{}, _ graphql.Args) (interface{}, error) {
+				return struct{}{}, nil
+			},
+		},
+		"events": {
+			Description: "recent packet events, newest first",
+			Type:        eventType,
+			Args:        []string{"first", "type", "gatewayNetworkId"},
+			Resolve: func(ctx context.Context, _ interface{}, args graphql.Args) (interface{}, error) {
+				first, err := graphQLFirst(args)
+				if err != nil {
+					return nil, err
+				}
+				typ, byType := args.String("type")
+				networkID, byGateway := args.String("gatewayNetworkId")
+				return svc.recentEvents.Recent(first, func(ev *PacketEvent) bool {
+					return (!byType || string(ev.Type) == typ) &&
+						(!byGateway || ev.GatewayNetworkID.String() == networkID)
+				}), nil
+			},
+		},
+		"features": {
+			Description: "feature flags and their state",
+			Type:        featureType,
+			Resolve: func(ctx context.Context, _ interface{}, _ graphql.Args) (interface{}, error) {
+				return features.All(), nil
+			},
+		},
+	}}}
+}
+
+// graphQLFirst returns the first argument that limits the number of items a
+// list field returns.
+func graphQLFirst(args graphql.Args) (int, error) {
+	if _, ok := args["first"]; !ok || args["first"] == nil {
+		return graphQLMaxListSize, nil
+	}
+	first, ok := args.Int("first")
+	if !ok || first < 0 || first > graphQLMaxListSize {
+		return 0, fmt.Errorf("first must be between 0 and %d", graphQLMaxListSize)
+	}
+	return first, nil
+}
+
+func gatewayField(get func(*gateway.Gateway) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(ctx context.Context, source interface{}, _ graphql.Args) (interface{}, error) {
+		return get(source.(*gateway.Gateway)), nil
+	}}
+}
+
+func routeField(get func(*Router) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(ctx context.Context, source interface{}, _ graphql.Args) (interface{}, error) {
+		return get(source.(*Router)), nil
+	}}
+}
+
+func eventField(get func(*PacketEvent) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(ctx context.Context, source interface{}, _ graphql.Args) (interface{}, error) {
+		return get(source.(*PacketEvent)), nil
+	}}
+}
+
+func featureField(get func(features.Status) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(ctx context.Context, source interface{}, _ graphql.Args) (interface{}, error) {
+		return get(source.(features.Status)), nil
+	}}
+}
+
+func densityField(get func(*DeviceDensityEstimate) interface{}) *graphql.Field {
+	return &graphql.Field{Resolve: func(ctx context.Context, source interface{}, _ graphql.Args) (interface{}, error) {
+		return get(source.(*DeviceDensityEstimate)), nil
+	}}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/health"
+	"github.com/brocaar/lorawan"
+)
+
+// defaultMaxRegistrySyncLag covers several sync intervals of the gateway
+// stores before the forwarder is reported not ready.
+const defaultMaxRegistrySyncLag = 2 * time.Hour
+
+// forwarderHealth tracks the state of the components the exchange doesn't
+// keep itself and that is reported on the health endpoints.
+type forwarderHealth struct {
+	started            time.Time
+	maxRegistrySyncLag time.Duration
+	// backendStarted is 1 after the backend started
+	backendStarted int32
+
+	mu sync.Mutex
+	// connected holds by local id the gateways that are connected to the
+	// backend
+	connected map[lorawan.EUI64]gatewayPresence
+}
+
+// gatewayPresence describes when a gateway connected and was last heard.
+type gatewayPresence struct {
+	ConnectedSince time.Time
+	LastSeen       time.Time
+}
+
+func newForwarderHealth(cfg *ForwarderHealthConfig) *forwarderHealth {
+	h := &forwarderHealth{
+		started:            time.Now(),
+		maxRegistrySyncLag: defaultMaxRegistrySyncLag,
+		connected:          make(map[lorawan.EUI64]gatewayPresence),
+	}
+	if cfg != nil && cfg.MaxRegistrySyncLag != nil {
+		h.maxRegistrySyncLag = *cfg.MaxRegistrySyncLag
+	}
+	return h
+}
+
+// gatewayConnected records that the gateway with the given local id
+// connected to, or disconnected from the backend.
+func (h *forwarderHealth) gatewayConnected(localID lorawan.EUI64, connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if connected {
+		now := time.Now()
+		h.connected[localID] = gatewayPresence{ConnectedSince: now, LastSeen: now}
+	} else {
+		delete(h.connected, localID)
+	}
+}
+
+// gatewaySeen records that a frame was received from the gateway with the
+// given local id at the given time. Backends that don't report connects
+// have the gateway connected since the first frame.
+func (h *forwarderHealth) gatewaySeen(localID lorawan.EUI64, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	presence, ok := h.connected[localID]
+	if !ok {
+		presence.ConnectedSince = at
+	}
+	presence.LastSeen = at
+	h.connected[localID] = presence
+}
+
+// connectedGatewayPresence returns a copy of the connected gateways.
+func (h *forwarderHealth) connectedGatewayPresence() map[lorawan.EUI64]gatewayPresence {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	presence := make(map[lorawan.EUI64]gatewayPresence, len(h.connected))
+	for id, p := range h.connected {
+		presence[id] = p
+	}
+	return presence
+}
+
+func (h *forwarderHealth) connectedGateways() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.connected)
+}
+
+// healthChecks returns the state of the exchange components. The backend is
+// critical, the forwarder can't recover when it stopped accepting gateways.
+func (e *Exchange) healthChecks() []health.Check {
+	var checks []health.Check
+
+	if atomic.LoadInt32(&e.health.backendStarted) == 1 {
+		checks = append(checks, health.Critical(health.Pass("backend", "accepting gateways")))
+	} else {
+		checks = append(checks, health.Critical(health.Fail("backend", "not started")))
+	}
+
+	checks = append(checks, health.Pass("gateways", "%d of %d gateways connected",
+		e.health.connectedGateways(), e.gateways.Count()))
+
+	routers := e.routingTable.RouterClients()
+	online := 0
+	for _, router := range routers {
+		if router.Online {
+			online++
+		}
+	}
+	switch {
+	case len(routers) == 0:
+		checks = append(checks, health.Pass("routers", "no routers configured"))
+	case online == 0:
+		checks = append(checks, health.Fail("routers", "none of %d routers connected", len(routers)))
+	default:
+		checks = append(checks, health.Pass("routers", "%d of %d routers connected", online, len(routers)))
+	}
+
+	reporter, ok := e.gateways.(gateway.StatusReporter)
+	if !ok {
+		return append(checks,
+			health.Pass("keystore", "%d gateways loaded", e.gateways.Count()))
+	}
+	status := reporter.Status()
+
+	switch {
+	case !status.Loaded && status.LoadError != nil:
+		checks = append(checks, health.Fail("keystore", "gateways not loaded: %s", status.LoadError))
+	case !status.Loaded:
+		checks = append(checks, health.Fail("keystore", "gateways not loaded"))
+	case status.LoadError != nil:
+		checks = append(checks, health.Fail("keystore", "%d gateways loaded, last reload failed: %s",
+			e.gateways.Count(), status.LoadError))
+	default:
+		checks = append(checks, health.Pass("keystore", "%d gateways loaded", e.gateways.Count()))
+	}
+
+	// stores that didn't sync yet are given the same time since the
+	// forwarder started
+	if status.Registry {
+		switch {
+		case status.LastRegistrySync.IsZero() && time.Since(e.health.started) <= e.health.maxRegistrySyncLag:
+			checks = append(checks, health.Pass("chain_sync", "gateways not yet synced with the registry"))
+		case status.LastRegistrySync.IsZero():
+			checks = append(checks, health.Fail("chain_sync", "gateways never synced with the registry"))
+		case time.Since(status.LastRegistrySync) > e.health.maxRegistrySyncLag:
+			checks = append(checks, health.Fail("chain_sync", "last registry sync %s ago, max %s",
+				time.Since(status.LastRegistrySync).Round(time.Second), e.health.maxRegistrySyncLag))
+		default:
+			checks = append(checks, health.Pass("chain_sync", "last registry sync %s ago",
+				time.Since(status.LastRegistrySync).Round(time.Second)))
+		}
+	}
+
+	return checks
+}
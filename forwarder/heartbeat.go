@@ -0,0 +1,344 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// heartbeatVersion is the version of the heartbeat message format.
+const heartbeatVersion = 1
+
+// ForwarderHeartbeat describes the health of the forwarder at the time it
+// was sent. Liveness holds a bit per gateway in Gateways, the most
+// significant bit of the first byte belongs to the first gateway. A bit is
+// set when the gateway sent an uplink or stats within the liveness window.
+type ForwarderHeartbeat struct {
+	Version      int             `json:"version"`
+	ForwarderID  string          `json:"forwarderId"`
+	Software     string          `json:"software"`
+	Commit       string          `json:"commit"`
+	Sequence     uint64          `json:"sequence"`
+	Time         time.Time       `json:"time"`
+	GatewayCount int             `json:"gatewayCount"`
+	OnlineCount  int             `json:"onlineCount"`
+	Gateways     []lorawan.EUI64 `json:"gateways"`
+	Liveness     hexutil.Bytes   `json:"liveness"`
+}
+
+// SignedForwarderHeartbeat holds a heartbeat and its signature. The
+// signature is calculated over Message, the JSON encoded Heartbeat.
+// Heartbeat is included for convenience, verifiers must use Message.
+type SignedForwarderHeartbeat struct {
+	Heartbeat ForwarderHeartbeat `json:"heartbeat"`
+	Message   hexutil.Bytes      `json:"message"`
+	Scheme    string             `json:"scheme"`
+	PublicKey hexutil.Bytes      `json:"publicKey"`
+	Signature hexutil.Bytes      `json:"signature"`
+}
+
+// Verify returns an indication if the signature over the message is valid.
+func (s *SignedForwarderHeartbeat) Verify() (bool, error) {
+	return signing.Verify(s.Scheme, s.PublicKey, s.Message, s.Signature)
+}
+
+// forwarderKeyfile is the file format of the forwarder identity key.
+type forwarderKeyfile struct {
+	Forwarder struct {
+		ID         string `yaml:"id"`
+		PrivateKey string `yaml:"private_key"`
+	} `yaml:"forwarder"`
+}
+
+// Heartbeat periodically posts a signed heartbeat to the ThingsIX
+// monitoring endpoint. Heartbeats are signed with the forwarder identity key
+// that allows the monitoring service to track a forwarder over time without
+// knowing who operates it. Nothing is sent unless the operator configured
+// the endpoint.
+type Heartbeat struct {
+	store    gateway.GatewayStore
+	endpoint string
+	interval time.Duration
+	window   time.Duration
+	signer   signing.Signer
+	id       string
+	client   *http.Client
+
+	mu       sync.Mutex
+	seen     map[lorawan.EUI64]time.Time
+	sequence uint64
+	last     *SignedForwarderHeartbeat
+}
+
+// NewHeartbeat returns a heartbeat for the gateways in store. The forwarder
+// identity key is loaded from the configured key file, it is generated when
+// the file doesn't exist.
+func NewHeartbeat(cfg *ForwarderHeartbeatConfig, store gateway.GatewayStore) (*Heartbeat, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("heartbeat enabled without endpoint")
+	}
+	if cfg.KeyFile == "" {
+		return nil, fmt.Errorf("heartbeat enabled without key file")
+	}
+	key, err := loadOrGenerateForwarderKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := signing.NewSigner(signing.Secp256k1, key)
+	if err != nil {
+		return nil, err
+	}
+	id := utils.DeriveThingsIxID(&key.PublicKey)
+
+	h := &Heartbeat{
+		store:    store,
+		endpoint: cfg.Endpoint,
+		interval: 5 * time.Minute,
+		window:   3 * time.Minute,
+		signer:   signer,
+		id:       hex.EncodeToString(id[:]),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		seen:     make(map[lorawan.EUI64]time.Time),
+	}
+	if cfg.Interval != nil && *cfg.Interval > 0 {
+		h.interval = *cfg.Interval
+	}
+	if cfg.LivenessWindow != nil && *cfg.LivenessWindow > 0 {
+		h.window = *cfg.LivenessWindow
+	}
+	if cfg.Timeout != nil && *cfg.Timeout > 0 {
+		h.client.Timeout = *cfg.Timeout
+	}
+	return h, nil
+}
+
+// loadOrGenerateForwarderKey returns the forwarder identity key from the key
+// file at path, a new key is generated and stored when it doesn't exist.
+func loadOrGenerateForwarderKey(path string) (*ecdsa.PrivateKey, error) {
+	var keyfile forwarderKeyfile
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := utils.GeneratePrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate forwarder key: %w", err)
+		}
+		id := utils.DeriveThingsIxID(&key.PublicKey)
+		keyfile.Forwarder.ID = hex.EncodeToString(id[:])
+		keyfile.Forwarder.PrivateKey = hex.EncodeToString(crypto.FromECDSA(key))
+		if data, err = yaml.Marshal(keyfile); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, fmt.Errorf("unable to write forwarder key to %s: %w", path, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"file":         path,
+			"forwarder_id": keyfile.Forwarder.ID,
+		}).Info("generated forwarder key")
+		return key, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read forwarder key file %s: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, &keyfile); err != nil {
+		return nil, fmt.Errorf("unable to decode forwarder key file %s: %w", path, err)
+	}
+	key, err := crypto.HexToECDSA(keyfile.Forwarder.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode forwarder private key from %s", path)
+	}
+	return key, nil
+}
+
+// Seen records that the gateway with the given network id is alive.
+func (h *Heartbeat) Seen(networkID lorawan.EUI64, at time.Time) {
+	h.mu.Lock()
+	h.seen[networkID] = at
+	h.mu.Unlock()
+}
+
+// Offline records that the gateway with the given network id disconnected.
+func (h *Heartbeat) Offline(networkID lorawan.EUI64) {
+	h.mu.Lock()
+	delete(h.seen, networkID)
+	h.mu.Unlock()
+}
+
+// build returns the signed heartbeat for the gateways in the store at now.
+func (h *Heartbeat) build(now time.Time) (*SignedForwarderHeartbeat, error) {
+	var gateways []lorawan.EUI64
+	h.store.Range(gateway.GatewayRangerFunc(func(gw *gateway.Gateway) bool {
+		gateways = append(gateways, gw.NetworkID)
+		return true
+	}))
+	sort.Slice(gateways, func(i, j int) bool {
+		return bytes.Compare(gateways[i][:], gateways[j][:]) < 0
+	})
+
+	version, commit := utils.Info()
+	heartbeat := ForwarderHeartbeat{
+		Version:      heartbeatVersion,
+		ForwarderID:  h.id,
+		Software:     version,
+		Commit:       commit,
+		Time:         now.UTC(),
+		GatewayCount: len(gateways),
+		Gateways:     gateways,
+		Liveness:     make([]byte, (len(gateways)+7)/8),
+	}
+
+	h.mu.Lock()
+	for networkID, at := range h.seen {
+		if now.Sub(at) > h.window {
+			delete(h.seen, networkID)
+		}
+	}
+	for i, networkID := range gateways {
+		if _, ok := h.seen[networkID]; ok {
+			heartbeat.Liveness[i/8] |= 0x80 >> (i % 8)
+			heartbeat.OnlineCount++
+		}
+	}
+	h.sequence++
+	heartbeat.Sequence = h.sequence
+	h.mu.Unlock()
+
+	msg, err := json.Marshal(heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	signStart := time.Now()
+	sig, err := h.signer.Sign(msg)
+	signingDurationHistogram.WithLabelValues("heartbeat").Observe(time.Since(signStart).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedForwarderHeartbeat{
+		Heartbeat: heartbeat,
+		Message:   msg,
+		Scheme:    h.signer.Scheme(),
+		PublicKey: h.signer.PublicKey(),
+		Signature: sig,
+	}, nil
+}
+
+// send builds a heartbeat and posts it to the monitoring endpoint.
+func (h *Heartbeat) send(ctx context.Context, now time.Time) error {
+	signed, err := h.build(now)
+	if err != nil {
+		return fmt.Errorf("unable to sign heartbeat: %w", err)
+	}
+
+	h.mu.Lock()
+	h.last = signed
+	h.mu.Unlock()
+
+	body, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("monitoring endpoint replied with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Last returns the last heartbeat that was sent, nil if none was sent yet.
+func (h *Heartbeat) Last() *SignedForwarderHeartbeat {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+// Run sends a heartbeat each interval until ctx expires.
+func (h *Heartbeat) Run(ctx context.Context) {
+	logrus.WithFields(logrus.Fields{
+		"endpoint":     h.endpoint,
+		"interval":     h.interval,
+		"forwarder_id": h.id,
+	}).Info("send heartbeats to monitoring endpoint")
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	h.beat(ctx, time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			h.beat(ctx, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// beat sends a heartbeat and records the result.
+func (h *Heartbeat) beat(ctx context.Context, now time.Time) {
+	if err := h.send(ctx, now); err != nil {
+		heartbeatsCounter.WithLabelValues("failed").Inc()
+		logrus.WithError(err).Warn("unable to send heartbeat")
+		return
+	}
+	heartbeatsCounter.WithLabelValues("success").Inc()
+}
+
+// Heartbeat returns the last heartbeat sent to the monitoring endpoint.
+func (svc APIService) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	if svc.heartbeat == nil {
+		http.Error(w, "heartbeat not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	last := svc.heartbeat.Last()
+	if last == nil {
+		http.Error(w, "no heartbeat sent yet", http.StatusNotFound)
+		return
+	}
+	replyJSON(w, http.StatusOK, last)
+}
@@ -0,0 +1,250 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	h3light "github.com/ThingsIXFoundation/h3-light"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+)
+
+// AirtimeHeatmap aggregates the number of uplinks and the airtime they used
+// per gateway per hour. The aggregates can be exported as GeoJSON keyed on
+// the gateways registered location to visualize traffic density.
+type AirtimeHeatmap struct {
+	mu        sync.Mutex
+	retention time.Duration
+	// buckets holds per gateway network id the aggregates per hour
+	buckets map[lorawan.EUI64]map[int64]*heatmapBucket
+	// locations holds the last known location for each gateway
+	locations map[lorawan.EUI64]h3light.Cell
+	lastPrune time.Time
+	// resolution is the default H3 resolution used when exporting
+	resolution int
+}
+
+type heatmapBucket struct {
+	uplinks uint64
+	airtime time.Duration
+}
+
+// NewAirtimeHeatmap returns an empty heatmap that keeps hourly aggregates
+// for the configured retention, by default 7 days. Exports aggregate on H3
+// cells with the given resolution unless a resolution is requested.
+func NewAirtimeHeatmap(cfg ForwarderHeatmapConfig, resolution int) *AirtimeHeatmap {
+	retention := 7 * 24 * time.Hour
+	if cfg.Retention != nil && *cfg.Retention > 0 {
+		retention = *cfg.Retention
+	}
+	return &AirtimeHeatmap{
+		retention:  retention,
+		buckets:    make(map[lorawan.EUI64]map[int64]*heatmapBucket),
+		locations:  make(map[lorawan.EUI64]h3light.Cell),
+		resolution: resolution,
+	}
+}
+
+// Record adds an uplink with the given airtime received by gw at the given
+// time to the heatmap.
+func (h *AirtimeHeatmap) Record(gw *gateway.Gateway, airtime time.Duration, at time.Time) {
+	hour := at.Truncate(time.Hour).Unix()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if gw.Details != nil && gw.Details.Location != nil {
+		if cell, err := h3light.CellFromString(*gw.Details.Location); err == nil {
+			h.locations[gw.NetworkID] = cell
+		}
+	}
+
+	perHour, ok := h.buckets[gw.NetworkID]
+	if !ok {
+		perHour = make(map[int64]*heatmapBucket)
+		h.buckets[gw.NetworkID] = perHour
+	}
+	bucket, ok := perHour[hour]
+	if !ok {
+		bucket = new(heatmapBucket)
+		perHour[hour] = bucket
+	}
+	bucket.uplinks++
+	bucket.airtime += airtime
+
+	if at.Sub(h.lastPrune) > time.Hour {
+		h.prune(at)
+		h.lastPrune = at
+	}
+}
+
+// prune removes aggregates that are older than the retention period, the
+// caller must hold the lock.
+func (h *AirtimeHeatmap) prune(now time.Time) {
+	deadline := now.Add(-h.retention).Unix()
+	for id, perHour := range h.buckets {
+		for hour := range perHour {
+			if hour < deadline {
+				delete(perHour, hour)
+			}
+		}
+		if len(perHour) == 0 {
+			delete(h.buckets, id)
+			delete(h.locations, id)
+		}
+	}
+}
+
+// GeoJSONFeatureCollection is a GeoJSON (RFC 7946) feature collection.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// GeoJSONFeature is a GeoJSON feature with a point geometry.
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONPoint is a GeoJSON point geometry, coordinates are [lon, lat].
+type GeoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type heatmapKey struct {
+	cell h3light.Cell
+	hour int64
+}
+
+// GeoJSON exports the aggregates between from and to as a feature collection
+// with a feature per H3 cell per hour. The location of each gateway is
+// flattened to its parent cell at the given resolution, if resolution is
+// negative the registered location cell is used. Gateways without a
+// registered location are not included.
+func (h *AirtimeHeatmap) GeoJSON(from, to time.Time, resolution int) GeoJSONFeatureCollection {
+	var (
+		fromHour = from.Truncate(time.Hour).Unix()
+		toHour   = to.Unix()
+		cells    = make(map[heatmapKey]*heatmapBucket)
+		gwCount  = make(map[heatmapKey]int)
+	)
+
+	h.mu.Lock()
+	for id, perHour := range h.buckets {
+		cell, ok := h.locations[id]
+		if !ok {
+			continue
+		}
+		if resolution >= 0 && resolution < cell.Resolution() {
+			cell = cell.Parent(resolution)
+		}
+		for hour, bucket := range perHour {
+			if hour < fromHour || hour > toHour {
+				continue
+			}
+			key := heatmapKey{cell: cell, hour: hour}
+			agg, ok := cells[key]
+			if !ok {
+				agg = new(heatmapBucket)
+				cells[key] = agg
+			}
+			agg.uplinks += bucket.uplinks
+			agg.airtime += bucket.airtime
+			gwCount[key]++
+		}
+	}
+	h.mu.Unlock()
+
+	collection := GeoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]GeoJSONFeature, 0, len(cells)),
+	}
+
+	for key, agg := range cells {
+		lat, lon := key.cell.LatLon()
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type: "Feature",
+			Geometry: GeoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]float64{lon, lat},
+			},
+			Properties: map[string]interface{}{
+				"h3":         key.cell.String(),
+				"hour":       time.Unix(key.hour, 0).UTC().Format(time.RFC3339),
+				"gateways":   gwCount[key],
+				"uplinks":    agg.uplinks,
+				"airtime_ms": agg.airtime.Milliseconds(),
+			},
+		})
+	}
+
+	sort.Slice(collection.Features, func(i, j int) bool {
+		pi, pj := collection.Features[i].Properties, collection.Features[j].Properties
+		if pi["hour"] != pj["hour"] {
+			return pi["hour"].(string) < pj["hour"].(string)
+		}
+		return pi["h3"].(string) < pj["h3"].(string)
+	})
+
+	return collection
+}
+
+// AirtimeHeatmap returns the hourly uplink and airtime aggregates as GeoJSON.
+// The optional from and to query parameters (RFC3339) select the period, by
+// default the last 24 hours. The optional resolution query parameter
+// aggregates gateways into H3 cells of the given resolution, by default the
+// configured metadata H3 resolution.
+func (svc APIService) AirtimeHeatmap(w http.ResponseWriter, r *http.Request) {
+	var (
+		to         = time.Now()
+		from       = to.Add(-24 * time.Hour)
+		resolution = svc.heatmap.resolution
+		err        error
+	)
+
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("resolution"); v != "" {
+		if resolution, err = strconv.Atoi(v); err != nil || resolution < 0 || resolution > 15 {
+			http.Error(w, "invalid resolution", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(svc.heatmap.GeoJSON(from, to, resolution))
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package hll implements a HyperLogLog sketch to estimate the number of
+// distinct items in a set with a fixed amount of memory.
+package hll
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// precision determines the number of registers (2^precision), the
+	// standard error of the estimate is 1.04/sqrt(2^precision) ~ 3.25%
+	precision = 10
+	registers = 1 << precision
+)
+
+// Sketch is a HyperLogLog sketch, the zero value is an empty sketch.
+type Sketch struct {
+	registers [registers]uint8
+}
+
+// AddUint64 adds the given item to the sketch.
+func (s *Sketch) AddUint64(item uint64) {
+	h := mix(item)
+	idx := h >> (64 - precision)
+	// ensure the remaining bits are never all 0
+	w := h<<precision | 1<<(precision-1)
+	rank := uint8(bits.LeadingZeros64(w) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge adds all items from other into s.
+func (s *Sketch) Merge(other *Sketch) {
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct items added.
+func (s *Sketch) Estimate() uint64 {
+	var (
+		m     = float64(registers)
+		alpha = 0.7213 / (1 + 1.079/m)
+		sum   float64
+		zeros int
+	)
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	// small range correction, use linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// mix is the splitmix64 finalizer that spreads the bits of small items such as
+// device addresses over the entire 64 bit range.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
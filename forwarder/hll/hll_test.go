@@ -0,0 +1,51 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package hll
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []uint64{0, 1, 10, 100, 1000, 10000, 100000} {
+		var s Sketch
+		for i := uint64(0); i < n; i++ {
+			s.AddUint64(i)
+			s.AddUint64(i) // duplicates must not be counted
+		}
+		var (
+			got     = s.Estimate()
+			allowed = math.Max(1, 0.1*float64(n))
+		)
+		if math.Abs(float64(got)-float64(n)) > allowed {
+			t.Errorf("estimate for %d items: got %d", n, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var a, b Sketch
+	for i := uint64(0); i < 5000; i++ {
+		a.AddUint64(i)
+		b.AddUint64(i + 2500)
+	}
+	a.Merge(&b)
+	if got := a.Estimate(); math.Abs(float64(got)-7500) > 750 {
+		t.Errorf("merged estimate: got %d, want ~7500", got)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// JoinAcceptCache keeps the RX1 and RX2 transmission parameters for received
+// join requests. They are computed from the regional parameters when the join
+// request is received. When a router replies with a join-accept that misses
+// transmission parameters the forwarder completes them from the cache. This
+// allows routers with high latency to reply with the minimal information and
+// still have the join-accept transmitted in the correct receive window.
+type JoinAcceptCache struct {
+	mu sync.Mutex
+	// pending holds per gateway network id the join requests received recently
+	pending map[lorawan.EUI64][]*joinAcceptParams
+}
+
+type joinAcceptParams struct {
+	received time.Time
+	expires  time.Time
+	context  []byte
+	rx1      *gw.DownlinkTxInfo
+	rx2      *gw.DownlinkTxInfo
+}
+
+// NewJoinAcceptCache returns an empty join-accept parameter cache.
+func NewJoinAcceptCache() *JoinAcceptCache {
+	return &JoinAcceptCache{
+		pending: make(map[lorawan.EUI64][]*joinAcceptParams),
+	}
+}
+
+// Record computes the join-accept transmission parameters for the join
+// request frame that was received by gw in the given region.
+func (c *JoinAcceptCache) Record(gateway *gateway.Gateway, region frequency_plan.BandName, frame *gw.UplinkFrame) {
+	lora := frame.GetTxInfo().GetModulation().GetLora()
+	if lora == nil {
+		return
+	}
+
+	b, err := regionBand(region)
+	if err != nil {
+		return
+	}
+
+	uplinkDR, err := b.GetDataRateIndex(true, band.DataRate{
+		Modulation:   band.LoRaModulation,
+		SpreadFactor: int(lora.GetSpreadingFactor()),
+		Bandwidth:    int(lora.GetBandwidth() / 1000),
+	})
+	if err != nil {
+		return
+	}
+
+	var (
+		defaults = b.GetDefaults()
+		now      = time.Now()
+		params   = &joinAcceptParams{
+			received: now,
+			expires:  now.Add(defaults.JoinAcceptDelay2 + time.Second),
+			context:  frame.GetRxInfo().GetContext(),
+		}
+	)
+
+	if rx1Freq, err := b.GetRX1FrequencyForUplinkFrequency(frame.GetTxInfo().GetFrequency()); err == nil {
+		if rx1DR, err := b.GetRX1DataRateIndex(uplinkDR, 0); err == nil {
+			params.rx1 = joinAcceptTxInfo(b, rx1Freq, rx1DR, defaults.JoinAcceptDelay1, params.context)
+		}
+	}
+	params.rx2 = joinAcceptTxInfo(b, defaults.RX2Frequency, defaults.RX2DataRate, defaults.JoinAcceptDelay2, params.context)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// drop expired entries for this gateway
+	pending := c.pending[gateway.NetworkID][:0]
+	for _, p := range c.pending[gateway.NetworkID] {
+		if now.Before(p.expires) {
+			pending = append(pending, p)
+		}
+	}
+	c.pending[gateway.NetworkID] = append(pending, params)
+}
+
+func joinAcceptTxInfo(b band.Band, frequency uint32, dr int, delay time.Duration, context []byte) *gw.DownlinkTxInfo {
+	rate, err := b.GetDataRate(dr)
+	if err != nil || rate.Modulation != band.LoRaModulation {
+		return nil
+	}
+	return &gw.DownlinkTxInfo{
+		Frequency: frequency,
+		Power:     int32(b.GetDownlinkTXPower(frequency)),
+		Modulation: &gw.Modulation{
+			Parameters: &gw.Modulation_Lora{
+				Lora: &gw.LoraModulationInfo{
+					Bandwidth:             uint32(rate.Bandwidth * 1000),
+					SpreadingFactor:       uint32(rate.SpreadFactor),
+					CodeRate:              gw.CodeRate_CR_4_5,
+					PolarizationInversion: true,
+				},
+			},
+		},
+		Timing: &gw.Timing{
+			Parameters: &gw.Timing_Delay{
+				Delay: &gw.DelayTimingInfo{
+					Delay: durationpb.New(delay),
+				},
+			},
+		},
+		Context: context,
+	}
+}
+
+// Complete fills missing transmission parameters in the given join-accept
+// frame for gateway. The first item is completed with the RX1 parameters and
+// the second item with the RX2 parameters. If the router only sent a single
+// item without transmission parameters an RX2 item is added. It returns an
+// indication if the frame was changed.
+func (c *JoinAcceptCache) Complete(gateway *gateway.Gateway, frame *gw.DownlinkFrame) bool {
+	items := frame.GetItems()
+	if len(items) == 0 || !isJoinAccept(items[0].GetPhyPayload()) {
+		return false
+	}
+
+	params := c.lookup(gateway.NetworkID, items[0].GetTxInfo().GetContext())
+	if params == nil {
+		return false
+	}
+
+	var (
+		changed    bool
+		incomplete = items[0].GetTxInfo().GetFrequency() == 0
+	)
+	for i, item := range items {
+		var cached *gw.DownlinkTxInfo
+		switch i {
+		case 0:
+			cached = params.rx1
+		case 1:
+			cached = params.rx2
+		}
+		if cached != nil && completeTxInfo(item, cached) {
+			changed = true
+		}
+	}
+
+	if len(items) == 1 && incomplete && params.rx2 != nil {
+		frame.Items = append(frame.Items, &gw.DownlinkFrameItem{
+			PhyPayload: items[0].GetPhyPayload(),
+			TxInfo:     proto.Clone(params.rx2).(*gw.DownlinkTxInfo),
+		})
+		changed = true
+	}
+
+	return changed
+}
+
+// lookup returns the cached parameters for the join request with the given
+// gateway context. If the context is not set the join-accept can't be matched
+// with its join request, the parameters are only returned when the gateway
+// has a single pending join request.
+func (c *JoinAcceptCache) lookup(gatewayID lorawan.EUI64, context []byte) *joinAcceptParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		now     = time.Now()
+		match   *joinAcceptParams
+		matches int
+	)
+	for _, p := range c.pending[gatewayID] {
+		if now.After(p.expires) {
+			continue
+		}
+		if len(context) > 0 {
+			if bytes.Equal(p.context, context) {
+				return p
+			}
+			continue
+		}
+		match = p
+		matches++
+	}
+	if matches != 1 {
+		return nil
+	}
+	return match
+}
+
+// completeTxInfo sets transmission parameters that are not set in item from
+// cached and returns an indication if item was changed. 0 dBm is a valid
+// transmit power, the power is only taken from cached when the router didn't
+// set the frequency either.
+func completeTxInfo(item *gw.DownlinkFrameItem, cached *gw.DownlinkTxInfo) bool {
+	if item.TxInfo == nil {
+		item.TxInfo = proto.Clone(cached).(*gw.DownlinkTxInfo)
+		return true
+	}
+
+	changed := false
+	if item.TxInfo.Frequency == 0 {
+		item.TxInfo.Frequency = cached.Frequency
+		item.TxInfo.Power = cached.Power
+		changed = true
+	}
+	if item.TxInfo.Modulation == nil {
+		item.TxInfo.Modulation = proto.Clone(cached.Modulation).(*gw.Modulation)
+		changed = true
+	}
+	if item.TxInfo.Timing == nil {
+		item.TxInfo.Timing = proto.Clone(cached.Timing).(*gw.Timing)
+		changed = true
+	}
+	if len(item.TxInfo.Context) == 0 {
+		item.TxInfo.Context = cached.Context
+		changed = true
+	}
+	return changed
+}
+
+func isJoinAccept(phy []byte) bool {
+	var mhdr lorawan.MHDR
+	if len(phy) == 0 {
+		return false
+	}
+	if err := mhdr.UnmarshalBinary(phy[:1]); err != nil {
+		logrus.WithError(err).Debug("unable to decode downlink MHDR")
+		return false
+	}
+	return mhdr.MType == lorawan.JoinAccept
+}
@@ -0,0 +1,235 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/kube"
+	"github.com/sirupsen/logrus"
+)
+
+// LeaderElector elects one forwarder replica as leader using a Kubernetes
+// lease. Multiple replicas can run behind a single UDP load balancer, they
+// all forward uplinks to routers but only the leader sends downlinks to
+// gateways. This ensures a single active downlink scheduler for the
+// deployment. Gateways are not partitioned over the replicas, a replica can
+// only send downlinks to gateways that have their UDP or websocket session
+// with it. Downlinks for gateways connected to other replicas are dropped,
+// the load balancer must therefore route all gateways to the leader.
+type LeaderElector struct {
+	client        *kube.Client
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	// leaderUntil is the unix nano timestamp until which this replica
+	// considers itself leader, 0 if it is not the leader
+	leaderUntil int64
+	lease       *kube.Lease
+}
+
+// NewLeaderElector returns a leader elector configured from cfg. It refuses
+// backends that keep gateway sessions per replica unless the operator
+// confirmed that the load balancer routes all gateways to the leader.
+func NewLeaderElector(cfg *ForwarderLeaderElectionConfig, backend ForwarderBackendConfig) (*LeaderElector, error) {
+	if (backend.SemtechUDP != nil || backend.BasicStation != nil) && !cfg.LeaderAffinity {
+		return nil, fmt.Errorf("leader election only sends downlinks to gateways connected to the leader, set leader_election.leader_affinity when the load balancer routes all gateways to the leader")
+	}
+
+	var (
+		client    *kube.Client
+		namespace = cfg.Namespace
+		err       error
+	)
+	if cfg.KubeAPI != "" {
+		client = kube.NewProxyClient(cfg.KubeAPI)
+	} else {
+		var podNamespace string
+		if client, podNamespace, err = kube.NewInClusterClient(); err != nil {
+			return nil, fmt.Errorf("unable to create Kubernetes client: %w", err)
+		}
+		if namespace == "" {
+			namespace = podNamespace
+		}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	le := &LeaderElector{
+		client:        client,
+		namespace:     namespace,
+		name:          "thingsix-forwarder",
+		identity:      cfg.Identity,
+		leaseDuration: 15 * time.Second,
+		renewDeadline: 10 * time.Second,
+		retryPeriod:   2 * time.Second,
+	}
+	if cfg.LeaseName != "" {
+		le.name = cfg.LeaseName
+	}
+	if le.identity == "" {
+		if le.identity, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("unable to determine identity: %w", err)
+		}
+	}
+	if cfg.LeaseDuration != nil {
+		le.leaseDuration = *cfg.LeaseDuration
+	}
+	if cfg.RenewDeadline != nil {
+		le.renewDeadline = *cfg.RenewDeadline
+	}
+	if cfg.RetryPeriod != nil {
+		le.retryPeriod = *cfg.RetryPeriod
+	}
+	if le.renewDeadline >= le.leaseDuration || le.retryPeriod >= le.renewDeadline {
+		return nil, fmt.Errorf("leader election requires retry_period < renew_deadline < lease_duration")
+	}
+	return le, nil
+}
+
+// IsLeader returns an indication if this replica currently holds the lease.
+func (le *LeaderElector) IsLeader() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&le.leaderUntil)
+}
+
+// Run tries to acquire and renew the lease until ctx expires. The lease is
+// released on shutdown so another replica can take over immediately.
+func (le *LeaderElector) Run(ctx context.Context) {
+	log := logrus.WithFields(logrus.Fields{
+		"lease":     le.name,
+		"namespace": le.namespace,
+		"identity":  le.identity,
+	})
+	log.Info("start leader election")
+
+	wasLeader := false
+	for {
+		if err := le.tryAcquireOrRenew(ctx); err != nil && !errors.Is(err, kube.ErrConflict) {
+			log.WithError(err).Warn("unable to acquire or renew lease")
+		}
+
+		isLeader := le.IsLeader()
+		if isLeader != wasLeader {
+			if isLeader {
+				log.Info("became leader, start sending downlinks")
+				leaderGauge.Set(1)
+			} else {
+				log.Warn("lost leadership, stop sending downlinks")
+				leaderGauge.Set(0)
+			}
+			wasLeader = isLeader
+		}
+
+		select {
+		case <-time.After(le.retryPeriod):
+		case <-ctx.Done():
+			le.release()
+			leaderGauge.Set(0)
+			log.Info("leader election stopped")
+			return
+		}
+	}
+}
+
+func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, le.renewDeadline)
+	defer cancel()
+
+	var (
+		now      = time.Now()
+		nowMicro = now.UTC().Format(kube.MicroTimeFormat)
+		spec     = kube.LeaseSpec{
+			HolderIdentity:       le.identity,
+			LeaseDurationSeconds: int(le.leaseDuration / time.Second),
+			AcquireTime:          nowMicro,
+			RenewTime:            nowMicro,
+		}
+	)
+
+	lease, err := le.client.GetLease(ctx, le.namespace, le.name)
+	switch {
+	case errors.Is(err, kube.ErrNotFound):
+		lease, err = le.client.CreateLease(ctx, le.namespace, &kube.Lease{
+			Metadata: kube.ObjectMeta{Name: le.name},
+			Spec:     spec,
+		})
+		if err != nil {
+			return err
+		}
+		le.acquired(lease, now)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if lease.Spec.HolderIdentity != le.identity && !lease.Spec.Expired(now) {
+		// another replica is leader
+		le.lease = nil
+		atomic.StoreInt64(&le.leaderUntil, 0)
+		return nil
+	}
+
+	if lease.Spec.HolderIdentity == le.identity {
+		spec.AcquireTime = lease.Spec.AcquireTime
+		spec.LeaseTransitions = lease.Spec.LeaseTransitions
+	} else {
+		spec.LeaseTransitions = lease.Spec.LeaseTransitions + 1
+	}
+	lease.Spec = spec
+
+	// the update fails with a conflict if another replica modified the lease
+	if lease, err = le.client.UpdateLease(ctx, le.namespace, lease); err != nil {
+		return err
+	}
+	le.acquired(lease, now)
+	return nil
+}
+
+// acquired marks this replica leader until the renew deadline passes, the
+// replica stops acting as leader before the lease expires for others.
+func (le *LeaderElector) acquired(lease *kube.Lease, renewed time.Time) {
+	le.lease = lease
+	atomic.StoreInt64(&le.leaderUntil, renewed.Add(le.renewDeadline).UnixNano())
+}
+
+// release gives up the lease if this replica holds it.
+func (le *LeaderElector) release() {
+	if !le.IsLeader() || le.lease == nil {
+		return
+	}
+	atomic.StoreInt64(&le.leaderUntil, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lease := le.lease
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.RenewTime = ""
+	if _, err := le.client.UpdateLease(ctx, le.namespace, lease); err != nil {
+		logrus.WithError(err).Warn("unable to release lease")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ThingsIXFoundation/packet-handling/logging"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// loggers for the subsystems whose log level can be changed at runtime
+var (
+	backendLog    = logging.Module("backend")
+	exchangeLog   = logging.Module("exchange")
+	routingLog    = logging.Module("routing")
+	accountingLog = logging.Module("accounting")
+	onboardingLog = logging.Module("onboarding")
+)
+
+// applyLogConfig sets the log format, the default log level and the levels
+// of the modules in the given cfg. Levels set at runtime are discarded.
+func applyLogConfig(cfg LogConfig) error {
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		logging.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:    true,
+			DisableTimestamp: !cfg.Timestamp,
+		})
+	case "json":
+		logging.SetFormatter(&logrus.JSONFormatter{
+			DisableTimestamp: !cfg.Timestamp,
+		})
+	default:
+		return fmt.Errorf("unsupported log format %q", cfg.Format)
+	}
+	return logging.Configure(cfg.Level, cfg.Modules)
+}
+
+// reloadLogConfig reads the log configuration from the config file again and
+// applies it. Other configuration is not reloaded.
+func reloadLogConfig() error {
+	if viper.ConfigFileUsed() == "" {
+		return fmt.Errorf("no config file loaded")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	cfg := LogConfig{
+		Level:     logrus.InfoLevel,
+		Timestamp: true,
+	}
+	if err := viper.UnmarshalKey("log", &cfg, viper.DecodeHook(configDecodeHook())); err != nil {
+		return err
+	}
+	return applyLogConfig(cfg)
+}
+
+// LogLevels returns the log level of all modules.
+func (svc APIService) LogLevels(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, struct {
+		Default string                `json:"default"`
+		Modules []logging.ModuleLevel `json:"modules"`
+	}{
+		Default: logrus.GetLevel().String(),
+		Modules: logging.Levels(),
+	})
+}
+
+// SetLogLevel sets the log level of the module in the path. The change
+// takes effect immediately and is not persisted.
+func (svc APIService) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := logrus.ParseLevel(req.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := chi.URLParam(r, "module")
+	if err := logging.SetLevel(name, level); err != nil {
+		replyLogLevel(w, name, err)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"module": name,
+		"level":  level,
+	}).Info("log level of module changed")
+	replyLogLevel(w, name, nil)
+}
+
+// ResetLogLevel lets the module in the path follow the default log level.
+func (svc APIService) ResetLogLevel(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "module")
+	replyLogLevel(w, name, logging.ResetLevel(name))
+}
+
+func replyLogLevel(w http.ResponseWriter, name string, err error) {
+	if err == nil {
+		var level logging.ModuleLevel
+		level, err = logging.Level(name)
+		if err == nil {
+			replyJSON(w, http.StatusOK, level)
+			return
+		}
+	}
+	if errors.Is(err, logging.ErrUnknownModule) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
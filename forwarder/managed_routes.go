@@ -0,0 +1,256 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrRouteNotManaged is returned when a route that is configured in the
+	// configuration file is modified through the API.
+	ErrRouteNotManaged = errs.New(errs.ErrFailedPrecondition, "route is configured in the configuration file")
+	// ErrRoutingNotStarted is returned when a managed route is set before
+	// the routing table is running.
+	ErrRoutingNotStarted = errs.New(errs.ErrUnavailable, "routing table not started")
+)
+
+// managedRoute is a default router that is added at runtime through the API
+// instead of the configuration file. Managed routes are not persisted, they
+// are expected to be reconciled by an external controller.
+type managedRoute struct {
+	router *Router
+	stop   context.CancelFunc
+}
+
+// SetManagedRoute adds or replaces the default router with the given name. If
+// a router with the same name and endpoint is already running it is updated
+// in place, otherwise its client is restarted.
+func (r *RoutingTable) SetManagedRoute(name, endpoint string, regions []frequency_plan.BandName) (*Router, bool, error) {
+	if r.isDefaultRoute(name) {
+		return nil, false, ErrRouteNotManaged
+	}
+
+	r.managedMu.Lock()
+	defer r.managedMu.Unlock()
+
+	if r.runCtx == nil {
+		return nil, false, ErrRoutingNotStarted
+	}
+
+	if existing, ok := r.managed[name]; ok {
+		if existing.router.Endpoint == endpoint && sameRegions(existing.router.Regions, regions) {
+			return existing.router, false, nil
+		}
+		existing.stop()
+		delete(r.managed, name)
+	}
+
+	router := &Router{
+		Endpoint: endpoint,
+		Default:  true,
+		Name:     name,
+		Regions:  regions,
+	}
+	ctx, cancel := context.WithCancel(r.runCtx)
+	r.managed[name] = &managedRoute{router: router, stop: cancel}
+
+	ignore := make(chan *RouterDetails) // managed routes are replaced, never updated
+	go r.runClient(ctx, NewRouterClient(router, r.routesTableBroadcaster, r.networkEvents, r.gatewayEvents, ignore))
+
+	routingLog.WithFields(logrus.Fields{
+		"name":     name,
+		"endpoint": endpoint,
+		"regions":  regions,
+	}).Info("managed route set")
+
+	return router, true, nil
+}
+
+// DeleteManagedRoute stops the managed default router with the given name. It
+// returns an indication if the route existed.
+func (r *RoutingTable) DeleteManagedRoute(name string) (bool, error) {
+	if r.isDefaultRoute(name) {
+		return false, ErrRouteNotManaged
+	}
+
+	r.managedMu.Lock()
+	defer r.managedMu.Unlock()
+
+	existing, ok := r.managed[name]
+	if !ok {
+		return false, nil
+	}
+	existing.stop()
+	delete(r.managed, name)
+
+	routingLog.WithField("name", name).Info("managed route deleted")
+	return true, nil
+}
+
+// managedRoutes returns the managed routes ordered by name.
+func (r *RoutingTable) managedRoutes() []*Router {
+	r.managedMu.Lock()
+	defer r.managedMu.Unlock()
+
+	routes := make([]*Router, 0, len(r.managed))
+	for _, m := range r.managed {
+		routes = append(routes, m.router)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Name < routes[j].Name })
+	return routes
+}
+
+func sameRegions(a, b []frequency_plan.BandName) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// RouteReply is the API representation of a route.
+type RouteReply struct {
+	ID         string                    `json:"id"`
+	Name       string                    `json:"name,omitempty"`
+	Endpoint   string                    `json:"endpoint"`
+	Default    bool                      `json:"default"`
+	Managed    bool                      `json:"managed"`
+	Discovered bool                      `json:"discovered"`
+	NetID      string                    `json:"netId,omitempty"`
+	Regions    []frequency_plan.BandName `json:"regions,omitempty"`
+}
+
+// routeListSpec describes how routes can be filtered and sorted.
+var routeListSpec = listSpec[RouteReply]{
+	fields: map[string]func(RouteReply) string{
+		"id":         func(r RouteReply) string { return r.ID },
+		"name":       func(r RouteReply) string { return r.Name },
+		"endpoint":   func(r RouteReply) string { return r.Endpoint },
+		"netId":      func(r RouteReply) string { return r.NetID },
+		"default":    func(r RouteReply) string { return strconv.FormatBool(r.Default) },
+		"managed":    func(r RouteReply) string { return strconv.FormatBool(r.Managed) },
+		"discovered": func(r RouteReply) string { return strconv.FormatBool(r.Discovered) },
+	},
+	id:          func(r RouteReply) string { return r.ID + "/" + r.Name + "/" + r.Endpoint },
+	defaultSort: "name",
+}
+
+// ListRoutes returns the default, managed, discovered and ThingsIX registered
+// routes. If the request has pagination, filter or sort parameters a single
+// page of routes is returned instead.
+func (svc APIService) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	managed := make(map[*Router]bool)
+	for _, m := range svc.routingTable.managedRoutes() {
+		managed[m] = true
+	}
+	discovered := make(map[*Router]bool)
+	for _, d := range svc.routingTable.discoveredRoutes() {
+		discovered[d] = true
+	}
+
+	routes := make([]RouteReply, 0)
+	for _, route := range svc.routingTable.Routes() {
+		reply := RouteReply{
+			ID:         route.ThingsIXID.String(),
+			Name:       route.Name,
+			Endpoint:   route.Endpoint,
+			Default:    route.Default,
+			Managed:    managed[route],
+			Discovered: discovered[route],
+			Regions:    route.Regions,
+		}
+		if !route.Default {
+			reply.NetID = route.NetID.String()
+		}
+		routes = append(routes, reply)
+	}
+	if routeListSpec.requested(r) {
+		replyListPage(w, r, routeListSpec, routes)
+		return
+	}
+	replyJSON(w, http.StatusOK, routes)
+}
+
+// SetRoute adds or updates the managed default route with the name from the
+// path. It replies with 201 when the route was created or changed and 200
+// when it was already up to date.
+func (svc APIService) SetRoute(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Endpoint string                    `json:"endpoint"`
+		Regions  []frequency_plan.BandName `json:"regions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Endpoint == "" {
+		http.Error(w, "missing endpoint", http.StatusBadRequest)
+		return
+	}
+
+	router, changed, err := svc.routingTable.SetManagedRoute(chi.URLParam(r, "name"), req.Endpoint, req.Regions)
+	switch {
+	case errors.Is(err, ErrRouteNotManaged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		status := http.StatusOK
+		if changed {
+			status = http.StatusCreated
+		}
+		replyJSON(w, status, RouteReply{
+			ID:       router.ThingsIXID.String(),
+			Name:     router.Name,
+			Endpoint: router.Endpoint,
+			Default:  true,
+			Managed:  true,
+			Regions:  router.Regions,
+		})
+	}
+}
+
+// DeleteRoute removes the managed default route with the name from the path.
+func (svc APIService) DeleteRoute(w http.ResponseWriter, r *http.Request) {
+	found, err := svc.routingTable.DeleteManagedRoute(chi.URLParam(r, "name"))
+	switch {
+	case errors.Is(err, ErrRouteNotManaged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case !found:
+		http.NotFound(w, r)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
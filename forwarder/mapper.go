@@ -23,6 +23,7 @@ import (
 
 	gnsssystemtime "github.com/ThingsIXFoundation/gnss-system-time"
 	h3light "github.com/ThingsIXFoundation/h3-light"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/ThingsIXFoundation/types"
@@ -32,6 +33,7 @@ import (
 
 	"github.com/ThingsIXFoundation/coverage-api/go/mapper"
 	"github.com/ThingsIXFoundation/packet-handling/mapperpacket"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
 	"github.com/ThingsIXFoundation/router-api/go/router"
 	"github.com/brocaar/lorawan"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -39,6 +41,9 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+var mapperForwardingFeature = features.Register("mapper_forwarding",
+	"forward packets that look like ThingsIX mapper packets to the coverage API instead of routers", true)
+
 type MapperForwarder struct {
 	gatewayStore      gateway.GatewayStore
 	exchange          *Exchange
@@ -104,7 +109,7 @@ func (mc *MapperForwarder) handleDiscoveryPacket(frame *gw.UplinkFrame) {
 		"bandwidth":     frame.GetTxInfo().GetModulation().GetLora().GetBandwidth(),
 	})
 
-	rxPacketsMapperCounter.WithLabelValues(gateway.NetworkID.String(), gateway.LocalID.String(), "discovery").Inc()
+	gatewayCounter(rxPacketsMapperCounter, gateway.NetworkID, gateway.LocalID, "discovery").Inc()
 
 	dp, err := mapperpacket.NewDiscoveryPacketFromBytes(frame.PhyPayload)
 	if err != nil {
@@ -140,6 +145,7 @@ func (mc *MapperForwarder) handleDiscoveryPacket(frame *gw.UplinkFrame) {
 		return
 	}
 	lat, lon := dp.LatLonFloat()
+	mc.exchange.coverageGaps.ObserveMapper(gateway, frame, lat, lon)
 	mapTime := gnsssystemtime.GalileoTowToTime(dp.TOW(), time.Now().Add(1*time.Minute), 18)
 	region := h3light.LatLonToCell(lat, lon, 1)
 
@@ -172,8 +178,15 @@ func (mc *MapperForwarder) handleDiscoveryPacket(frame *gw.UplinkFrame) {
 		frameLog.WithError(err).Error("could not marshal packet receipt")
 		return
 	}
-	dprbh := sha256.Sum256(dprb)
-	gwsig, err := crypto.Sign(dprbh[:], gateway.PrivateKey)
+	// the mapper protocol only supports secp256k1 signatures
+	signer, err := gateway.Signer(signing.Secp256k1)
+	if err != nil {
+		frameLog.WithError(err).Error("could not sign packet receipt: no signer")
+		return
+	}
+	signStart := time.Now()
+	gwsig, err := signer.Sign(dprb)
+	signingDurationHistogram.WithLabelValues("mapper_receipt").Observe(time.Since(signStart).Seconds())
 	if err != nil {
 		frameLog.WithError(err).Error("could not sign packet receipt: error while signing packet")
 		return
@@ -198,7 +211,7 @@ func (mc *MapperForwarder) handleDiscoveryPacket(frame *gw.UplinkFrame) {
 			frameLog.Info("gateway was selected as winner!")
 		}
 
-		txPacketsMapperCounter.WithLabelValues(gateway.NetworkID.String(), gateway.LocalID.String()).Inc()
+		gatewayCounter(txPacketsMapperCounter, gateway.NetworkID, gateway.LocalID).Inc()
 
 		dfi := gw.DownlinkFrameItem{
 			TxInfo: &gw.DownlinkTxInfo{
@@ -262,7 +275,7 @@ func (mc *MapperForwarder) handleDownlinkConfirmationPacket(frame *gw.UplinkFram
 		"bandwidth":     frame.GetTxInfo().GetModulation().GetLora().GetBandwidth(),
 	})
 
-	rxPacketsMapperCounter.WithLabelValues(gateway.NetworkID.String(), gateway.LocalID.String(), "downlink_confirmation").Inc()
+	gatewayCounter(rxPacketsMapperCounter, gateway.NetworkID, gateway.LocalID, "downlink_confirmation").Inc()
 
 	_, err = mapperpacket.NewDownlinkConfirmationPacketFromBytes(frame.PhyPayload)
 	if err != nil {
@@ -329,8 +342,15 @@ func (mc *MapperForwarder) handleDownlinkConfirmationPacket(frame *gw.UplinkFram
 		frameLog.WithError(err).Error("could not marshal packet receipt")
 		return
 	}
-	dprbh := sha256.Sum256(dprb)
-	gwsig, err := crypto.Sign(dprbh[:], gateway.PrivateKey)
+	// the mapper protocol only supports secp256k1 signatures
+	signer, err := gateway.Signer(signing.Secp256k1)
+	if err != nil {
+		frameLog.WithError(err).Error("could not sign packet receipt: no signer")
+		return
+	}
+	signStart := time.Now()
+	gwsig, err := signer.Sign(dprb)
+	signingDurationHistogram.WithLabelValues("mapper_receipt").Observe(time.Since(signStart).Seconds())
 	if err != nil {
 		frameLog.WithError(err).Error("could not sign packet receipt: error while signing packet")
 		return
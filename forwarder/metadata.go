@@ -18,15 +18,52 @@ package forwarder
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	h3light "github.com/ThingsIXFoundation/h3-light"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/enrich"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
 	"github.com/chirpstack/chirpstack/api/go/v4/common"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
 )
 
-func setChaindataInFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway, airtime time.Duration) {
+// gatewayH3Cell returns the H3 cell of the gateways registered location at
+// the given resolution. If resolution is negative or finer than the
+// registered location the registered location cell is returned.
+func gatewayH3Cell(gw *gateway.Gateway, resolution int) (h3light.Cell, bool) {
+	if gw.Details == nil || gw.Details.Location == nil {
+		return 0, false
+	}
+	c, err := h3light.CellFromString(*gw.Details.Location)
+	if err != nil {
+		return 0, false
+	}
+	if resolution >= 0 && resolution < c.Resolution() {
+		c = c.Parent(resolution)
+	}
+	return c, true
+}
+
+// buildEnrichers returns the enrichment plugins enabled in cfg.
+func buildEnrichers(cfg *ForwarderEnrichmentConfig) (enrich.Chain, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	var chain enrich.Chain
+	if cfg.Elevation != nil {
+		elevation, err := enrich.NewElevation(cfg.Elevation.Directory)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithField("directory", cfg.Elevation.Directory).Info("enrich uplinks with terrain elevation")
+		chain = append(chain, elevation)
+	}
+	return chain, nil
+}
+
+func setChaindataInFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway, airtime time.Duration, h3Resolution int) {
 	frame.RxInfo.Metadata = map[string]string{}
 	metadata := frame.RxInfo.Metadata
 	metadata["thingsix_gateway_id"] = gw.ID().String()
@@ -36,6 +73,9 @@ func setChaindataInFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway, air
 		metadata["thingsix_owner"] = gw.Owner.String()
 	}
 
+	// the registered location takes precedence over the operator location
+	defer setOperatorMetadataInFrameMetadata(frame, gw)
+
 	if gw.Details == nil {
 		return
 	}
@@ -48,6 +88,10 @@ func setChaindataInFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway, air
 			metadata["thingsix_location_latitude"] = fmt.Sprintf("%f", lat)
 			metadata["thingsix_location_longitude"] = fmt.Sprintf("%f", lon)
 			metadata["thingsix_altitude"] = fmt.Sprintf("%d", *gw.Details.Altitude)
+			if cell, ok := gatewayH3Cell(gw, h3Resolution); ok {
+				metadata["thingsix_location_h3"] = cell.String()
+				metadata["thingsix_location_h3_resolution"] = fmt.Sprintf("%d", cell.Resolution())
+			}
 			if frame.RxInfo.Location == nil {
 				frame.RxInfo.Location = &common.Location{
 					Source:    common.LocationSource_CONFIG,
@@ -68,3 +112,37 @@ func setChaindataInFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway, air
 		metadata["thingsix_antenna_gain"] = *gw.Details.AntennaGain
 	}
 }
+
+// setOperatorMetadataInFrameMetadata adds the metadata the operator set for
+// the gateway, except for the contact. The operator location is only used
+// when the frame has no location from the gateway or the registry.
+func setOperatorMetadataInFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway) {
+	m := gw.Metadata
+	if m == nil {
+		return
+	}
+	metadata := frame.RxInfo.Metadata
+	if m.Name != "" {
+		metadata["thingsix_gateway_name"] = m.Name
+	}
+	if m.AntennaGain != nil {
+		metadata["thingsix_gateway_antenna_gain"] = strconv.FormatFloat(*m.AntennaGain, 'f', -1, 64)
+	}
+	if m.Altitude != nil {
+		metadata["thingsix_gateway_altitude"] = strconv.FormatFloat(*m.Altitude, 'f', -1, 64)
+	}
+	if m.Latitude != nil && m.Longitude != nil {
+		metadata["thingsix_gateway_latitude"] = fmt.Sprintf("%f", *m.Latitude)
+		metadata["thingsix_gateway_longitude"] = fmt.Sprintf("%f", *m.Longitude)
+		if frame.RxInfo.Location == nil {
+			frame.RxInfo.Location = &common.Location{
+				Source:    common.LocationSource_CONFIG,
+				Latitude:  *m.Latitude,
+				Longitude: *m.Longitude,
+			}
+			if m.Altitude != nil {
+				frame.RxInfo.Location.Altitude = *m.Altitude
+			}
+		}
+	}
+}
@@ -18,8 +18,10 @@ package forwarder
 
 import (
 	"context"
+	"net"
 	"net/http"
 
+	"github.com/ThingsIXFoundation/packet-handling/health"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -32,6 +34,18 @@ var (
 		Help:      "packets received, grouped by gateway local id and gateway network id",
 	}, []string{"gw_network_id", "gw_local_id"})
 
+	rxPacketsPerRegionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "rx_packets_per_region",
+		Help:      "packets received, grouped by the region (frequency plan) of the receiving gateway",
+	}, []string{"region"})
+
+	rxPacketsPerCellCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "rx_packets_per_cell",
+		Help:      "packets received, grouped by the H3 cell of the receiving gateways registered location",
+	}, []string{"h3"})
+
 	rxPacketPerFreqCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "thingsix_forwarder",
 		Name:      "rx_packets_per_freq",
@@ -98,6 +112,324 @@ var (
 		Help:      "packets received, grouped by gateway local id, gateway network id",
 	}, []string{"gw_network_id", "gw_local_id"})
 
+	joinAcceptsCompletedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "join_accepts_completed",
+		Help:      "join-accepts with transmission parameters completed from the join-accept cache, grouped by gateway",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	downlinksTooLargeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "downlinks_too_large",
+		Help:      "downlink items dropped because they exceed the regional maximum payload size, grouped by gateway",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	crcPolicyCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "crc_policy_outcomes",
+		Help:      "uplinks without valid crc, grouped by crc status and policy outcome (dropped, forwarded, mapping)",
+	}, []string{"crc", "outcome"})
+
+	relayFramesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "relay_frames",
+		Help:      "relayed uplinks and proprietary (e.g. relay wake-on-radio) frames received, grouped by gateway and type",
+	}, []string{"gw_network_id", "gw_local_id", "type"})
+
+	downlinksTimingRejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "downlinks_timing_rejected",
+		Help:      "downlink items rejected because they miss their receive window or exceed the duty cycle, grouped by gateway and TX ack status",
+	}, []string{"gw_network_id", "gw_local_id", "status"})
+
+	downlinksRescheduledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "downlinks_rescheduled",
+		Help:      "downlinks transmitted in a later item after their first item was rejected, grouped by gateway",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	downlinksQueueFullCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "downlinks_queue_full",
+		Help:      "downlinks dropped because the gateway has no downlink capacity left, grouped by gateway and if the downlink is multicast",
+	}, []string{"gw_network_id", "gw_local_id", "multicast"})
+
+	multicastDownlinksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "multicast_downlinks",
+		Help:      "downlinks detected as part of a multicast (e.g. FUOTA) session, grouped by gateway",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	packetEventsDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "packet_events_dropped",
+		Help:      "packet events dropped because consumers (e.g. analytics exporters) could not keep up",
+	})
+
+	analyticsExportCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "analytics_exported_events",
+		Help:      "packet events exported for analytics, grouped by sink and status",
+	}, []string{"sink", "status"})
+
+	downlinksNotLeaderCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "downlinks_not_leader",
+		Help:      "downlinks dropped because this replica is not the leader",
+	})
+
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "leader",
+		Help:      "1 if this replica holds the leader lease",
+	})
+
+	sliRatioGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "sli_ratio",
+		Help:      "ratio of good events over the window per router or gateway",
+	}, []string{"sli", "scope", "id", "window"})
+
+	sloBurnRateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "slo_burn_rate",
+		Help:      "rate at which the error budget is consumed over the window, 1 exhausts the budget exactly at the end of the SLO period",
+	}, []string{"sli", "scope", "id", "window"})
+
+	uplinkPayloadSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "uplink_payload_size_bytes",
+		Help:      "size of received uplink PHY payloads",
+		Buckets:   payloadSizeBuckets,
+	}, []string{"gw_network_id", "gw_local_id", "spreading_factor"})
+
+	uplinkFPortCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "rx_packets_per_fport",
+		Help:      "number of received data uplinks per fport",
+	}, []string{"gw_network_id", "gw_local_id", "fport"})
+
+	routerPayloadSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "router_uplink_payload_size_bytes",
+		Help:      "size of uplink PHY payloads delivered to routers",
+		Buckets:   payloadSizeBuckets,
+	}, []string{"router", "spreading_factor"})
+
+	staleRoutesPrunedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "stale_routes_pruned",
+		Help:      "number of registered routers that were stopped because they were unreachable for longer than the TTL",
+	})
+
+	uplinkDeliveryLatencyHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "router_uplink_delivery_latency_seconds",
+		Help:      "time between receiving an uplink from a gateway and delivering it to the router",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"router"})
+
+	routerFPortCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "router_packets_per_fport",
+		Help:      "number of data uplinks delivered to routers per fport",
+	}, []string{"router", "fport"})
+
+	downlinksTxPowerCappedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "tx_power_capped",
+		Help:      "number of downlink items for which the transmit power was lowered to the country maximum",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	bandPlanViolationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "band_plan_violations",
+		Help:      "uplinks and downlink items outside the band plan of the gateway, grouped by direction and reason (frequency, data_rate, eirp)",
+	}, []string{"gw_network_id", "gw_local_id", "direction", "reason"})
+
+	droppedFramesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "dropped_frames",
+		Help:      "number of uplink and downlink frames dropped by the exchange, grouped by direction and reason",
+	}, []string{"direction", "reason"})
+
+	routerRoundTripHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "router_round_trip_seconds",
+		Help:      "time between delivering an uplink to the router and receiving a downlink for the same gateway",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, .75, 1, 1.5, 2, 3, 5},
+	}, []string{"router"})
+
+	signingDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "signing_duration_seconds",
+		Help:      "time it takes to sign a message with a gateway key, grouped by the kind of message",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	}, []string{"kind"})
+
+	injectedUplinksCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "injected_uplinks",
+		Help:      "number of crafted uplinks injected through the admin API",
+	})
+
+	simulatedDownlinksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "simulated_downlinks",
+		Help:      "number of synthetic downlinks sent through the admin API, grouped by event (sent, tx_ack or backend_error)",
+	}, []string{"event"})
+
+	heartbeatsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "heartbeats",
+		Help:      "number of heartbeats posted to the monitoring endpoint, grouped by result (success or failed)",
+	}, []string{"result"})
+
+	backendEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "backend_events",
+		Help:      "number of events exchanged with the gateway backends, grouped by backend and event",
+	}, []string{"backend", "event"})
+
+	downlinksFrequencyNotAllowedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "tx_frequency_not_allowed",
+		Help:      "number of downlink items dropped because the frequency is not allowed in the gateway country",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	highSFAirtimeRatioGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "high_sf_airtime_ratio",
+		Help:      "share of uplink airtime used by SF11 and SF12 frames over the congestion window",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	gatewayClockDriftGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gateway_clock_drift_ppm",
+		Help:      "estimated drift of the gateway concentrator clock in ppm, positive when it runs fast",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	downlinksClockDriftCompensatedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "downlinks_clock_drift_compensated",
+		Help:      "number of downlinks with a delay adjusted for the gateway clock drift",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	coverageProofsDeliveredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "coverage_proofs_delivered",
+		Help:      "signed gateway statistics sent to the coverage mapping service, grouped by result",
+	}, []string{"result"})
+
+	gatewayTemperatureGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gateway_temperature_celsius",
+		Help:      "last temperature reported in the stats of the gateway",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	gatewayVoltageGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gateway_voltage_volts",
+		Help:      "last supply voltage reported in the stats of the gateway",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	uplinksQueueFullCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "uplinks_queue_full",
+		Help:      "uplinks that didn't fit in the queue of their lane (data, join), data uplinks are dropped and join-requests are processed immediately",
+	}, []string{"lane"})
+
+	routeTransformedFramesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "route_transformed_frames",
+		Help:      "uplinks whose payload was transformed (strip, truncate) before delivery to the route",
+	}, []string{"route", "transform"})
+
+	hostClockOffsetGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "host_clock_offset_seconds",
+		Help:      "last measured offset of the host clock against NTP, positive if the host clock is behind",
+	})
+
+	downlinksClockUnsynchronizedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "tx_clock_unsynchronized",
+		Help:      "number of downlinks scheduled at GPS time that were dropped because the host clock is not synchronized",
+	}, []string{"gw_network_id", "gw_local_id"})
+
+	fcntAnomaliesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "fcnt_anomalies",
+		Help:      "number of data uplinks with an unexpected frame counter, grouped by gateway and kind (reset, jump or rollback)",
+	}, []string{"gw_network_id", "gw_local_id", "kind"})
+
+	uplinkDedupCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "uplink_dedup",
+		Help:      "number of uplinks handled by deduplication, grouped by result (delivered, collapsed into a delivered copy or duplicate of an already delivered frame)",
+	}, []string{"result"})
+
+	filteredUplinksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "filtered_uplinks",
+		Help:      "uplinks and join-requests dropped by packet filters, grouped by route (* when no route accepts it) and frame type",
+	}, []string{"route", "type"})
+
+	routeSchedulerCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "route_rate_limited_uplinks",
+		Help:      "data uplinks handled by route rate limits, grouped by route and result (delivered, queue_full or expired)",
+	}, []string{"route", "result"})
+
+	routeDNSLookupsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "route_dns_lookups",
+		Help:      "router endpoint lookups by the resolver, grouped by result (cached, resolved, stale or failed)",
+	}, []string{"result"})
+
+	gcPauseHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gc_pause_seconds",
+		Help:      "garbage collector stop-the-world pauses, packets processed during a pause are delayed by it",
+		Buckets:   []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1},
+	})
+
+	gcPauseRatioGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gc_pause_ratio",
+		Help:      "fraction of time spent in garbage collector pauses over the last monitoring interval",
+	})
+
+	uplinkBufferFramesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "uplink_buffer_frames",
+		Help:      "number of uplinks handled by the store-and-forward buffer, grouped by result (buffered, replayed, expired or dropped)",
+	}, []string{"result"})
+
+	uplinkBufferBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "uplink_buffer_bytes",
+		Help:      "size of the uplinks waiting in the store-and-forward buffer",
+	})
+
+	gossipUplinksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gossip_uplinks",
+		Help:      "uplinks held for gossip with peer forwarders, grouped by result (forwarded, duplicate)",
+	}, []string{"result"})
+
+	gossipMessagesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "gossip_messages",
+		Help:      "gossip messages exchanged with peer forwarders, grouped by result (sent, failed, received, invalid)",
+	}, []string{"result"})
+
+	estimatedDevicesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "thingsix_forwarder",
+		Name:      "estimated_devices",
+		Help:      "estimated number of distinct devices a gateway received uplinks from, grouped by gateway and window",
+	}, []string{"gw_network_id", "gw_local_id", "window"})
+
 	routersOnlineGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "thingsix_forwarder",
 		Name:      "router_online",
@@ -112,16 +444,69 @@ var (
 // init registers Prometheus couters/gauges
 func init() {
 	prometheus.MustRegister(
-		rxPacketsCounter, rxPacketPerFreqCounter, rxPacketPerModulationCounter, rxPacketPerNwkIdCounter, rxPacketsPerRouterCounter, rxPacketsMapperCounter,
+		rxPacketsCounter, rxPacketsPerRegionCounter, rxPacketsPerCellCounter, rxPacketPerFreqCounter, rxPacketPerModulationCounter, rxPacketPerNwkIdCounter, rxPacketsPerRouterCounter, rxPacketsMapperCounter,
 		txPacketsCounter, txPacketPerFreqCounter, txPacketPerModulationCounter, txPacketPerNwkIdCounter, txPacketsPerRouterCounter, txPacketsMapperCounter,
 		routersOnlineGauge,
-		gatewaysOnlineGauge)
+		gatewaysOnlineGauge,
+		estimatedDevicesGauge,
+		joinAcceptsCompletedCounter,
+		downlinksTooLargeCounter,
+		crcPolicyCounter,
+		relayFramesCounter,
+		downlinksQueueFullCounter,
+		multicastDownlinksCounter,
+		packetEventsDroppedCounter,
+		analyticsExportCounter,
+		downlinksNotLeaderCounter,
+		leaderGauge,
+		sliRatioGauge,
+		sloBurnRateGauge,
+		uplinkPayloadSizeHistogram,
+		uplinkFPortCounter,
+		routerPayloadSizeHistogram,
+		routerFPortCounter,
+		uplinkDeliveryLatencyHistogram,
+		staleRoutesPrunedCounter,
+		gatewayClockDriftGauge,
+		downlinksClockDriftCompensatedCounter,
+		highSFAirtimeRatioGauge,
+		downlinksTxPowerCappedCounter,
+		downlinksFrequencyNotAllowedCounter,
+		coverageProofsDeliveredCounter,
+		uplinksQueueFullCounter,
+		gatewayTemperatureGauge,
+		gatewayVoltageGauge,
+		routeTransformedFramesCounter,
+		gossipUplinksCounter,
+		gossipMessagesCounter,
+		hostClockOffsetGauge,
+		downlinksClockUnsynchronizedCounter,
+		fcntAnomaliesCounter,
+		uplinkBufferFramesCounter,
+		uplinkBufferBytesGauge,
+		uplinkDedupCounter,
+		filteredUplinksCounter,
+		routeDNSLookupsCounter,
+		routeSchedulerCounter,
+		downlinksTimingRejectedCounter,
+		downlinksRescheduledCounter,
+		gcPauseHistogram,
+		gcPauseRatioGauge,
+		bandPlanViolationsCounter,
+		droppedFramesCounter,
+		routerRoundTripHistogram,
+		signingDurationHistogram,
+		backendEventsCounter,
+		heartbeatsCounter,
+		simulatedDownlinksCounter,
+		injectedUplinksCounter)
 
 }
 
-// runPrometheusHTTPEndpoint opens a Prometheus metrics endpoint on the
-// configured location until the given ctx expires.
-func runPrometheusHTTPEndpoint(ctx context.Context, cfg *Config) {
+// runPrometheusHTTPEndpoint serves the Prometheus metrics endpoint and the
+// health endpoints of the given checker on the given ln until the given ctx
+// expires.
+func runPrometheusHTTPEndpoint(ctx context.Context, cfg *Config, ln net.Listener, checker health.Checker) {
 	var (
 		addr = cfg.MetricsPrometheusAddress()
 		path = cfg.MetricsPrometheusPath()
@@ -145,10 +530,12 @@ func runPrometheusHTTPEndpoint(ctx context.Context, cfg *Config) {
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/healthz", health.LivenessHandler(checker))
+	mux.HandleFunc("/readyz", health.ReadinessHandler(checker))
 
 	go func() {
 		defer close(done)
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		if err := httpServer.Serve(ln); err != http.ErrServerClosed {
 			logrus.WithError(err).Error("prometheus http server stopped unexpected")
 		} else {
 			logrus.Info("prometheus metrics stopped")
@@ -0,0 +1,183 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"sync"
+
+	"github.com/brocaar/lorawan"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// aggregatedGatewayLabel replaces the gateway id labels of all gateways
+	// when per-gateway metrics are disabled
+	aggregatedGatewayLabel = "all"
+	// overflowLabel replaces label values once the limit of distinct values
+	// is reached
+	overflowLabel = "other"
+
+	defaultMaxGatewaySeries = 1000
+)
+
+var (
+	// gatewayLabels limits the number of distinct gateway label values
+	gatewayLabels = newLabelLimiter(false, 0, false)
+	// cellLabels limits the number of distinct H3 cell label values, cells
+	// follow the gateway locations and are limited as gateways
+	cellLabels = newLabelLimiter(false, 0, false)
+
+	// discardCounter, discardGauge and discardObserver are returned for series that are
+	// dropped, they are not registered
+	discardCounter  = prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"})
+	discardGauge    = prometheus.NewGauge(prometheus.GaugeOpts{Name: "discarded"})
+	discardObserver = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "discarded"})
+)
+
+// labelLimiter limits the number of distinct values a high cardinality label
+// can have. The first max values are passed through, values seen after that
+// are aggregated under overflowLabel or dropped.
+type labelLimiter struct {
+	enabled bool
+	max     int
+	drop    bool
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newLabelLimiter(enabled bool, max int, drop bool) *labelLimiter {
+	return &labelLimiter{
+		enabled: enabled,
+		max:     max,
+		drop:    drop,
+		seen:    make(map[string]struct{}),
+	}
+}
+
+// configureMetricsCardinality configures the label limiters from cfg.
+func configureMetricsCardinality(cfg *MetricsCardinalityConfig) {
+	if cfg == nil {
+		gatewayLabels = newLabelLimiter(false, 0, false)
+		cellLabels = newLabelLimiter(false, 0, false)
+		return
+	}
+
+	max := defaultMaxGatewaySeries
+	if cfg.MaxGateways != nil {
+		max = *cfg.MaxGateways
+	}
+	drop := false
+	switch cfg.Overflow {
+	case "", "aggregate":
+	case "drop":
+		drop = true
+	default:
+		logrus.WithField("overflow", cfg.Overflow).Warn("invalid metrics overflow mode, aggregate")
+	}
+	gatewayLabels = newLabelLimiter(cfg.PerGateway, max, drop)
+	cellLabels = newLabelLimiter(cfg.PerGateway, max, drop)
+
+	logrus.WithFields(logrus.Fields{
+		"per_gateway":  cfg.PerGateway,
+		"max_gateways": max,
+		"drop":         drop,
+	}).Info("configured metrics cardinality")
+}
+
+// allow returns the label value to use for value and false if the series
+// must be dropped.
+func (l *labelLimiter) allow(value string) (string, bool) {
+	if !l.enabled {
+		return aggregatedGatewayLabel, true
+	}
+	if l.max <= 0 {
+		return value, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[value]; ok {
+		return value, true
+	}
+	if len(l.seen) < l.max {
+		l.seen[value] = struct{}{}
+		return value, true
+	}
+	if l.drop {
+		return "", false
+	}
+	return overflowLabel, true
+}
+
+// distinct returns the label value to use for value if it gets its own
+// series. Gauges can't be aggregated, for these the series is dropped when
+// the value doesn't get its own series.
+func (l *labelLimiter) distinct(value string) (string, bool) {
+	v, ok := l.allow(value)
+	return v, ok && v == value
+}
+
+// gatewayCounter returns the counter for the gateway within the configured
+// cardinality limits.
+func gatewayCounter(vec *prometheus.CounterVec, networkID, localID lorawan.EUI64, labels ...string) prometheus.Counter {
+	id, ok := gatewayLabels.allow(networkID.String())
+	if !ok {
+		return discardCounter
+	}
+	local := id
+	if id == networkID.String() {
+		local = localID.String()
+	}
+	return vec.WithLabelValues(append([]string{id, local}, labels...)...)
+}
+
+// cellCounter returns the counter for the H3 cell of a gateway location
+// within the configured cardinality limits.
+func cellCounter(vec *prometheus.CounterVec, cell string) prometheus.Counter {
+	id, ok := cellLabels.allow(cell)
+	if !ok {
+		return discardCounter
+	}
+	return vec.WithLabelValues(id)
+}
+
+// gatewayObserver returns the histogram for the gateway within the configured
+// cardinality limits.
+func gatewayObserver(vec *prometheus.HistogramVec, networkID, localID lorawan.EUI64, labels ...string) prometheus.Observer {
+	id, ok := gatewayLabels.allow(networkID.String())
+	if !ok {
+		return discardObserver
+	}
+	local := id
+	if id == networkID.String() {
+		local = localID.String()
+	}
+	return vec.WithLabelValues(append([]string{id, local}, labels...)...)
+}
+
+// gatewayGauge returns the gauge for the gateway, if the gateway doesn't get
+// its own series within the configured cardinality limits a gauge that is
+// not exported is returned.
+func gatewayGauge(vec *prometheus.GaugeVec, networkID, localID lorawan.EUI64, labels ...string) prometheus.Gauge {
+	if _, ok := gatewayLabels.distinct(networkID.String()); !ok {
+		return discardGauge
+	}
+	return vec.WithLabelValues(append([]string{networkID.String(), localID.String()}, labels...)...)
+}
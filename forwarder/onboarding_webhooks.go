@@ -0,0 +1,255 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+var onboardingWebhooksFeature = features.Register("onboarding_webhooks",
+	"post gateway onboarding events to the configured webhooks", true)
+
+// GatewayOnboardingState is the onboarding state of a gateway in the store.
+type GatewayOnboardingState string
+
+const (
+	// GatewayOnboardingPending is a gateway in the store that is not yet
+	// onboarded in the ThingsIX gateway registry
+	GatewayOnboardingPending GatewayOnboardingState = "pending"
+	// GatewayOnboardingOnboarded is an onboarded gateway without details
+	GatewayOnboardingOnboarded GatewayOnboardingState = "onboarded"
+	// GatewayOnboardingDetailsSet is an onboarded gateway for which the owner
+	// set the details, including its location
+	GatewayOnboardingDetailsSet GatewayOnboardingState = "details_set"
+)
+
+const (
+	// onboardingEventType is the type of the events posted to webhooks
+	onboardingEventType = "gateway.onboarding"
+	// onboardingSignatureHeader holds the HMAC-SHA256 of the payload
+	onboardingSignatureHeader = "X-ThingsIX-Signature"
+	// onboardingDeliveryAttempts is the number of times delivery of an
+	// event to a webhook is attempted
+	onboardingDeliveryAttempts = 3
+)
+
+// gatewayOnboardingState returns the onboarding state of gw.
+func gatewayOnboardingState(gw *gateway.Gateway) GatewayOnboardingState {
+	switch {
+	case !gw.Onboarded():
+		return GatewayOnboardingPending
+	case gw.Details != nil && gw.Details.Location != nil:
+		return GatewayOnboardingDetailsSet
+	default:
+		return GatewayOnboardingOnboarded
+	}
+}
+
+// GatewayOnboardingEvent is posted to webhooks when the onboarding state of
+// a gateway in the store changes.
+type GatewayOnboardingEvent struct {
+	Type             string                 `json:"type"`
+	GatewayNetworkID lorawan.EUI64          `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64          `json:"gatewayLocalId"`
+	ThingsIxID       gateway.ThingsIxID     `json:"gatewayId"`
+	Owner            *common.Address        `json:"owner,omitempty"`
+	PreviousState    GatewayOnboardingState `json:"previousState,omitempty"`
+	State            GatewayOnboardingState `json:"state"`
+	Detected         time.Time              `json:"detected"`
+}
+
+// OnboardingNotifier periodically determines the onboarding state of the
+// gateways in the store and posts an event to the webhooks for each state
+// change. Gateways that are added to the store after startup are reported
+// without previous state. Fleet management systems can use these events to
+// advance their workflows without polling the registry.
+type OnboardingNotifier struct {
+	store    gateway.GatewayStore
+	webhooks []string
+	secret   []byte
+	interval time.Duration
+	client   *http.Client
+
+	// states holds the last seen onboarding state by gateway local id, nil
+	// until the store is checked for the first time
+	states map[lorawan.EUI64]GatewayOnboardingState
+	events chan GatewayOnboardingEvent
+}
+
+// NewOnboardingNotifier returns a notifier for the gateways in store.
+func NewOnboardingNotifier(cfg *ForwarderOnboardingWebhooksConfig, store gateway.GatewayStore) (*OnboardingNotifier, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, fmt.Errorf("onboarding webhooks enabled without webhooks")
+	}
+	n := &OnboardingNotifier{
+		store:    store,
+		webhooks: cfg.Webhooks,
+		secret:   []byte(cfg.Secret),
+		interval: time.Minute,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		events:   make(chan GatewayOnboardingEvent, 256),
+	}
+	if cfg.Interval != nil && *cfg.Interval > 0 {
+		n.interval = *cfg.Interval
+	}
+	if cfg.Timeout != nil && *cfg.Timeout > 0 {
+		n.client.Timeout = *cfg.Timeout
+	}
+	return n, nil
+}
+
+// Run checks the store for onboarding state changes and delivers events to
+// the webhooks until ctx expires.
+func (n *OnboardingNotifier) Run(ctx context.Context) {
+	go n.deliver(ctx)
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	n.check(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			n.check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check compares the onboarding state of the gateways in the store with the
+// previous check. The first check only records the states.
+func (n *OnboardingNotifier) check(now time.Time) {
+	first := n.states == nil
+	states := make(map[lorawan.EUI64]GatewayOnboardingState)
+
+	n.store.Range(gateway.GatewayRangerFunc(func(gw *gateway.Gateway) bool {
+		state := gatewayOnboardingState(gw)
+		states[gw.LocalID] = state
+
+		previous, ok := n.states[gw.LocalID]
+		if first || (ok && previous == state) {
+			return true
+		}
+		event := GatewayOnboardingEvent{
+			Type:             onboardingEventType,
+			GatewayNetworkID: gw.NetworkID,
+			GatewayLocalID:   gw.LocalID,
+			ThingsIxID:       gw.ThingsIxID,
+			Owner:            gw.Owner,
+			PreviousState:    previous,
+			State:            state,
+			Detected:         now,
+		}
+
+		onboardingLog.WithFields(logrus.Fields{
+			"gw_network_id":  gw.NetworkID,
+			"gw_local_id":    gw.LocalID,
+			"previous_state": previous,
+			"state":          state,
+		}).Info("gateway onboarding state changed")
+
+		select {
+		case n.events <- event:
+		default:
+			onboardingLog.WithField("gw_local_id", gw.LocalID).Warn("onboarding event queue full, drop event")
+		}
+		return true
+	}))
+	n.states = states
+}
+
+// deliver posts events to the webhooks until ctx expires.
+func (n *OnboardingNotifier) deliver(ctx context.Context) {
+	for {
+		select {
+		case event := <-n.events:
+			if !onboardingWebhooksFeature.Enabled() {
+				onboardingLog.WithField("gw_local_id", event.GatewayLocalID).Debug("onboarding webhooks feature disabled, drop onboarding event")
+				continue
+			}
+			for _, webhook := range n.webhooks {
+				if err := n.postWithRetry(ctx, webhook, event); err != nil {
+					onboardingLog.WithError(err).WithFields(logrus.Fields{
+						"gw_local_id": event.GatewayLocalID,
+						"webhook":     webhook,
+					}).Warn("unable to deliver onboarding event")
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *OnboardingNotifier) postWithRetry(ctx context.Context, webhook string, event GatewayOnboardingEvent) error {
+	var err error
+	for attempt := 0; attempt < onboardingDeliveryAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * 5 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = n.post(ctx, webhook, event); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *OnboardingNotifier) post(ctx context.Context, webhook string, event GatewayOnboardingEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(payload)
+		req.Header.Set(onboardingSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// apiSpecYAML is the OpenAPI 3 definition of the forwarder API.
+//
+//go:embed api.yaml
+var apiSpecYAML []byte
+
+var (
+	apiSpecOnce sync.Once
+	apiSpecJSON []byte
+	apiSpecErr  error
+)
+
+// OpenAPISpec returns the OpenAPI 3 definition of the forwarder API as JSON.
+// It can be used to generate API clients.
+func OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	apiSpecOnce.Do(func() {
+		version, _ := utils.Info()
+		apiSpecJSON, apiSpecErr = openAPISpecJSON(apiSpecYAML, version)
+	})
+	if apiSpecErr != nil {
+		logrus.WithError(apiSpecErr).Error("unable to generate OpenAPI spec")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(apiSpecJSON)
+}
+
+// openAPISpecJSON converts the given YAML OpenAPI definition to JSON. If
+// version is not empty it replaces the version in the info section.
+func openAPISpecJSON(spec []byte, version string) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec: %w", err)
+	}
+	doc = jsonCompatible(doc)
+
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid OpenAPI spec: expected object")
+	}
+	if info, ok := root["info"].(map[string]interface{}); ok && version != "" {
+		info["version"] = version
+	}
+	return json.Marshal(root)
+}
+
+// jsonCompatible converts the maps yaml decodes into maps with string keys
+// that can be encoded as JSON. Keys such as response status codes are decoded
+// as integers and are converted to their textual representation.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestOpenAPISpecCoversRoutes ensures that all API routes are documented in
+// api.yaml and that all documented operations are served.
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	specJSON, err := openAPISpecJSON(apiSpecYAML, "test")
+	if err != nil {
+		t.Fatalf("unable to convert spec: %v", err)
+	}
+
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Info    struct{ Version string }              `json:"info"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(specJSON, &spec); err != nil {
+		t.Fatalf("unable to decode spec: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("unexpected openapi version %q", spec.OpenAPI)
+	}
+	if spec.Info.Version != "test" {
+		t.Errorf("unexpected info version %q", spec.Info.Version)
+	}
+
+	walk := func(router chi.Router) map[string]bool {
+		routed := make(map[string]bool)
+		err := chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			path := route
+			if len(path) > 1 {
+				path = strings.TrimSuffix(path, "/")
+			}
+			operation := strings.ToLower(method) + " " + path
+			routed[operation] = true
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("route %s not documented in api.yaml", operation)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unable to walk routes: %v", err)
+		}
+		return routed
+	}
+	var (
+		private    = walk(newAPIRouter(APIService{}))
+		management = walk(newManagementRouter(APIService{}, nil))
+	)
+
+	// operations with security are only served by the management API
+	for path, operations := range spec.Paths {
+		for method, operation := range operations {
+			if method == "parameters" {
+				continue
+			}
+			var op struct {
+				Security []map[string]interface{} `json:"security"`
+			}
+			if err := json.Unmarshal(operation, &op); err != nil {
+				t.Fatalf("unable to decode operation %s %s: %v", method, path, err)
+			}
+			key := method + " " + path
+			switch {
+			case len(op.Security) > 0 && private[key]:
+				t.Errorf("token authenticated operation %s served by the private API", key)
+			case len(op.Security) > 0 && !management[key]:
+				t.Errorf("token authenticated operation %s not routed on the management API", key)
+			case len(op.Security) == 0 && !private[key]:
+				t.Errorf("documented operation %s not routed", key)
+			}
+		}
+	}
+}
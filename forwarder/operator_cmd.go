@@ -0,0 +1,72 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/operator"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	OperatorCmd = &cobra.Command{
+		Use:   "operator",
+		Short: "Reconcile Gateway and Route Kubernetes resources into the forwarder",
+		Long: `Run a Kubernetes controller that reconciles Gateway and Route custom
+resources (thingsix.io/v1alpha1) into the forwarder through its admin API.
+Gateways are added to the gateway store with the key from the referenced
+secret, routes are set as managed default routers.`,
+		Args: cobra.NoArgs,
+		Run:  runOperator,
+	}
+
+	operatorCfg operator.Config
+)
+
+func init() {
+	OperatorCmd.Flags().StringVar(&operatorCfg.ForwarderAPI, "forwarder-api", "", "forwarder admin API URL (default from forwarder config)")
+	OperatorCmd.Flags().StringVar(&operatorCfg.KubeAPI, "kube-api", "", "Kubernetes API proxy URL, in-cluster service account is used when empty")
+	OperatorCmd.Flags().StringVar(&operatorCfg.Namespace, "namespace", "", "namespace to watch (default namespace of the service account)")
+	OperatorCmd.Flags().DurationVar(&operatorCfg.Interval, "interval", 30*time.Second, "reconciliation interval")
+}
+
+func runOperator(cmd *cobra.Command, args []string) {
+	if operatorCfg.ForwarderAPI == "" {
+		cfg := mustLoadConfig(false)
+		if cfg.Forwarder.Gateways.HttpAPI.Address == "" {
+			logrus.Fatal("HTTP API endpoint missing")
+		}
+		operatorCfg.ForwarderAPI = fmt.Sprintf("http://%s", cfg.Forwarder.Gateways.HttpAPI.Address)
+	}
+
+	controller, err := operator.New(operatorCfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to start operator")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	controller.Run(ctx)
+}
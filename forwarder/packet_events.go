@@ -0,0 +1,253 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/broadcast"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// PacketEventType describes what happened to a packet.
+type PacketEventType string
+
+const (
+	// PacketEventUplink is a data uplink received from a gateway
+	PacketEventUplink PacketEventType = "uplink"
+	// PacketEventJoin is a (re)join request received from a gateway
+	PacketEventJoin PacketEventType = "join"
+	// PacketEventProprietary is a proprietary uplink received from a gateway
+	PacketEventProprietary PacketEventType = "proprietary"
+	// PacketEventDownlink is a downlink sent to a gateway
+	PacketEventDownlink PacketEventType = "downlink"
+	// PacketEventTxAck is a downlink ACK received from a gateway
+	PacketEventTxAck PacketEventType = "txack"
+)
+
+// PacketEvent describes a packet that passed through the exchange. Packet
+// events are published for consumers like analytics exporters, they contain
+// metadata only and not the packet payload.
+type PacketEvent struct {
+	Time             time.Time       `json:"time"`
+	Type             PacketEventType `json:"type"`
+	PacketID         string          `json:"packetId,omitempty"`
+	GatewayNetworkID lorawan.EUI64   `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64   `json:"gatewayLocalId"`
+	Owner            string          `json:"owner,omitempty"`
+	Region           string          `json:"region,omitempty"`
+	Frequency        uint32          `json:"frequency,omitempty"`
+	SpreadingFactor  uint32          `json:"spreadingFactor,omitempty"`
+	Bandwidth        uint32          `json:"bandwidth,omitempty"`
+	RSSI             int32           `json:"rssi,omitempty"`
+	SNR              float32         `json:"snr,omitempty"`
+	PayloadSize      int             `json:"payloadSize"`
+	Airtime          time.Duration   `json:"airtime,omitempty"`
+	MType            string          `json:"mtype,omitempty"`
+	DevAddr          string          `json:"devAddr,omitempty"`
+	DevEUI           string          `json:"devEui,omitempty"`
+	FCnt             uint32          `json:"fCnt,omitempty"`
+	DownlinkID       uint32          `json:"downlinkId,omitempty"`
+	TxAckStatus      string          `json:"txAckStatus,omitempty"`
+}
+
+func newPacketEvent(typ PacketEventType, gateway *gateway.Gateway) *PacketEvent {
+	ev := &PacketEvent{
+		Time:             time.Now(),
+		Type:             typ,
+		GatewayNetworkID: gateway.NetworkID,
+		GatewayLocalID:   gateway.LocalID,
+	}
+	if gateway.Owner != nil {
+		ev.Owner = gateway.Owner.Hex()
+	}
+	return ev
+}
+
+// newUplinkPacketEvent returns a packet event for the given uplink.
+func newUplinkPacketEvent(typ PacketEventType, gateway *gateway.Gateway, region string, frame *gw.UplinkFrame, airtime time.Duration, phy *lorawan.PHYPayload) *PacketEvent {
+	ev := newPacketEvent(typ, gateway)
+	ev.Region = region
+	ev.Frequency = frame.GetTxInfo().GetFrequency()
+	ev.SpreadingFactor = frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor()
+	ev.Bandwidth = frame.GetTxInfo().GetModulation().GetLora().GetBandwidth()
+	ev.RSSI = frame.GetRxInfo().GetRssi()
+	ev.SNR = frame.GetRxInfo().GetSnr()
+	ev.PayloadSize = len(frame.GetPhyPayload())
+	ev.Airtime = airtime
+	ev.MType = phy.MHDR.MType.String()
+	ev.PacketID = uplinkPacketID(frame)
+	return ev
+}
+
+// newDownlinkPacketEvent returns a packet event for the given downlink, the
+// transmission parameters are taken from the first item.
+func newDownlinkPacketEvent(gateway *gateway.Gateway, frame *gw.DownlinkFrame) *PacketEvent {
+	ev := newPacketEvent(PacketEventDownlink, gateway)
+	ev.DownlinkID = frame.GetDownlinkId()
+	if items := frame.GetItems(); len(items) > 0 {
+		ev.Frequency = items[0].GetTxInfo().GetFrequency()
+		ev.SpreadingFactor = items[0].GetTxInfo().GetModulation().GetLora().GetSpreadingFactor()
+		ev.Bandwidth = items[0].GetTxInfo().GetModulation().GetLora().GetBandwidth()
+		ev.PayloadSize = len(items[0].GetPhyPayload())
+	}
+	return ev
+}
+
+// newTxAckPacketEvent returns a packet event for the given downlink ACK, the
+// status is the status of the item that was sent or the first status if no
+// item was sent.
+func newTxAckPacketEvent(gateway *gateway.Gateway, ack *gw.DownlinkTxAck) *PacketEvent {
+	ev := newPacketEvent(PacketEventTxAck, gateway)
+	ev.DownlinkID = ack.GetDownlinkId()
+	for i, item := range ack.GetItems() {
+		if i == 0 || item.GetStatus() != gw.TxAckStatus_IGNORED {
+			ev.TxAckStatus = item.GetStatus().String()
+		}
+		if item.GetStatus() != gw.TxAckStatus_IGNORED {
+			break
+		}
+	}
+	return ev
+}
+
+// newPacketEventBroadcaster returns the broadcaster packet events are
+// published on.
+func newPacketEventBroadcaster() *broadcast.Broadcaster[*PacketEvent] {
+	return broadcast.New[*PacketEvent](1024).Run()
+}
+
+// SubscribePacketEvents subscribes ch to packet events. Events are dropped
+// when ch is full.
+func (e *Exchange) SubscribePacketEvents(ch chan<- *PacketEvent) {
+	e.packetEvents.Subscribe(ch)
+}
+
+// UnsubscribePacketEvents stops sending packet events to ch.
+func (e *Exchange) UnsubscribePacketEvents(ch chan<- *PacketEvent) {
+	e.packetEvents.Unsubscribe(ch)
+}
+
+func (e *Exchange) publishPacketEvent(ev *PacketEvent) {
+	if !e.packetEvents.TryBroadcast(ev) {
+		packetEventsDroppedCounter.Inc()
+	}
+}
+
+// recentPacketEvents keeps the last packet events in memory so they can be
+// queried through the API.
+type recentPacketEvents struct {
+	mu     sync.RWMutex
+	events []*PacketEvent
+	next   int
+	full   bool
+}
+
+func newRecentPacketEvents(size int) *recentPacketEvents {
+	return &recentPacketEvents{events: make([]*PacketEvent, size)}
+}
+
+// Run records packet events published by the exchange until ctx expires.
+func (r *recentPacketEvents) Run(ctx context.Context, exchange *Exchange) {
+	events := make(chan *PacketEvent, 256)
+	exchange.SubscribePacketEvents(events)
+	defer exchange.UnsubscribePacketEvents(events)
+
+	for {
+		select {
+		case ev := <-events:
+			r.add(ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *recentPacketEvents) add(ev *PacketEvent) {
+	r.mu.Lock()
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// Recent returns up to n of the most recent events, newest first, for which
+// filter returns true. If filter is nil all events match.
+func (r *recentPacketEvents) Recent(n int, filter func(*PacketEvent) bool) []*PacketEvent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.events)
+	}
+
+	result := make([]*PacketEvent, 0)
+	for i := 1; i <= count && len(result) < n; i++ {
+		ev := r.events[(r.next-i+len(r.events))%len(r.events)]
+		if filter == nil || filter(ev) {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// packetEventTimeFormat is a fixed width time format, it sorts
+// lexicographically in chronological order.
+const packetEventTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// packetEventListSpec describes how recent packet events can be filtered and
+// sorted.
+var packetEventListSpec = listSpec[*PacketEvent]{
+	fields: map[string]func(*PacketEvent) string{
+		"time":             func(ev *PacketEvent) string { return ev.Time.UTC().Format(packetEventTimeFormat) },
+		"type":             func(ev *PacketEvent) string { return string(ev.Type) },
+		"packetId":         func(ev *PacketEvent) string { return ev.PacketID },
+		"gatewayNetworkId": func(ev *PacketEvent) string { return ev.GatewayNetworkID.String() },
+		"gatewayLocalId":   func(ev *PacketEvent) string { return ev.GatewayLocalID.String() },
+		"owner":            func(ev *PacketEvent) string { return ev.Owner },
+		"region":           func(ev *PacketEvent) string { return ev.Region },
+		"frequency":        func(ev *PacketEvent) string { return strconv.FormatUint(uint64(ev.Frequency), 10) },
+		"spreadingFactor":  func(ev *PacketEvent) string { return strconv.FormatUint(uint64(ev.SpreadingFactor), 10) },
+		"rssi":             func(ev *PacketEvent) string { return strconv.Itoa(int(ev.RSSI)) },
+		"snr":              func(ev *PacketEvent) string { return strconv.FormatFloat(float64(ev.SNR), 'f', -1, 32) },
+		"mtype":            func(ev *PacketEvent) string { return ev.MType },
+		"devAddr":          func(ev *PacketEvent) string { return ev.DevAddr },
+		"devEui":           func(ev *PacketEvent) string { return ev.DevEUI },
+		"txAckStatus":      func(ev *PacketEvent) string { return ev.TxAckStatus },
+	},
+	numeric: map[string]bool{"frequency": true, "spreadingFactor": true, "rssi": true, "snr": true},
+	id: func(ev *PacketEvent) string {
+		return fmt.Sprintf("%d/%s/%s/%s/%d", ev.Time.UnixNano(), ev.Type, ev.GatewayNetworkID, ev.PacketID, ev.DownlinkID)
+	},
+	defaultSort: "-time",
+}
+
+// ListPacketEvents returns a page of the recent packet events, by default
+// newest first.
+func (svc APIService) ListPacketEvents(w http.ResponseWriter, r *http.Request) {
+	replyListPage(w, r, packetEventListSpec, svc.recentEvents.Recent(len(svc.recentEvents.events), nil))
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brocaar/lorawan"
+)
+
+// packetFilter decides which uplinks are delivered to a route. Data uplinks
+// are matched on the NetID and prefix of their DevAddr, join-requests on
+// their JoinEUI. A frame that matches a deny rule is dropped. If there are
+// allow rules for the kind of frame it must match at least one of them.
+// Proprietary frames have no device identifiers and are never filtered.
+type packetFilter struct {
+	// route is the name of the route, empty for all routes
+	route string
+	allow packetFilterRules
+	deny  packetFilterRules
+}
+
+type packetFilterRules struct {
+	netIDs          []lorawan.NetID
+	devAddrPrefixes []devAddrPrefix
+	joinEUIs        []joinEUIRange
+}
+
+// devAddrPrefix matches the first bits of a DevAddr.
+type devAddrPrefix struct {
+	prefix uint32
+	bits   int
+}
+
+// joinEUIRange matches JoinEUIs between from and to, inclusive.
+type joinEUIRange struct {
+	from, to uint64
+}
+
+func newPacketFilters(cfg []ForwarderRouteFilterConfig) ([]packetFilter, error) {
+	filters := make([]packetFilter, 0, len(cfg))
+	for _, c := range cfg {
+		f := packetFilter{route: c.Route}
+		var err error
+		if f.allow, err = newPacketFilterRules(c.Allow); err != nil {
+			return nil, fmt.Errorf("invalid allow filter for route %s: %w", c.Route, err)
+		}
+		if f.deny, err = newPacketFilterRules(c.Deny); err != nil {
+			return nil, fmt.Errorf("invalid deny filter for route %s: %w", c.Route, err)
+		}
+		if f.route == "*" {
+			f.route = ""
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func newPacketFilterRules(cfg ForwarderFilterRulesConfig) (packetFilterRules, error) {
+	var rules packetFilterRules
+	for _, s := range cfg.NetIDs {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(s)); err != nil {
+			return rules, fmt.Errorf("invalid NetID %q: %w", s, err)
+		}
+		rules.netIDs = append(rules.netIDs, netID)
+	}
+	for _, s := range cfg.DevAddrPrefixes {
+		prefix, err := parseDevAddrPrefix(s)
+		if err != nil {
+			return rules, err
+		}
+		rules.devAddrPrefixes = append(rules.devAddrPrefixes, prefix)
+	}
+	for _, s := range cfg.JoinEUIs {
+		r, err := parseJoinEUIRange(s)
+		if err != nil {
+			return rules, err
+		}
+		rules.joinEUIs = append(rules.joinEUIs, r)
+	}
+	return rules, nil
+}
+
+// parseDevAddrPrefix parses a prefix in the form <devaddr>/<bits>, e.g.
+// 26000000/7. Without a length all 32 bits must match.
+func parseDevAddrPrefix(s string) (devAddrPrefix, error) {
+	addr, bits := s, 32
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		var err error
+		if bits, err = strconv.Atoi(s[i+1:]); err != nil || bits < 0 || bits > 32 {
+			return devAddrPrefix{}, fmt.Errorf("invalid DevAddr prefix length in %q", s)
+		}
+		addr = s[:i]
+	}
+	var devAddr lorawan.DevAddr
+	if err := devAddr.UnmarshalText([]byte(addr)); err != nil {
+		return devAddrPrefix{}, fmt.Errorf("invalid DevAddr prefix %q: %w", s, err)
+	}
+	p := devAddrPrefix{bits: bits}
+	p.prefix = binary.BigEndian.Uint32(devAddr[:]) & p.mask()
+	return p, nil
+}
+
+func (p devAddrPrefix) mask() uint32 {
+	if p.bits == 0 {
+		return 0
+	}
+	return ^uint32(0) << (32 - p.bits)
+}
+
+func (p devAddrPrefix) matches(devAddr lorawan.DevAddr) bool {
+	return binary.BigEndian.Uint32(devAddr[:])&p.mask() == p.prefix
+}
+
+// parseJoinEUIRange parses a single JoinEUI or a range in the form
+// <from>-<to>.
+func parseJoinEUIRange(s string) (joinEUIRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	var fromEUI, toEUI lorawan.EUI64
+	if err := fromEUI.UnmarshalText([]byte(strings.TrimSpace(from))); err != nil {
+		return joinEUIRange{}, fmt.Errorf("invalid JoinEUI range %q: %w", s, err)
+	}
+	if err := toEUI.UnmarshalText([]byte(strings.TrimSpace(to))); err != nil {
+		return joinEUIRange{}, fmt.Errorf("invalid JoinEUI range %q: %w", s, err)
+	}
+	r := joinEUIRange{
+		from: binary.BigEndian.Uint64(fromEUI[:]),
+		to:   binary.BigEndian.Uint64(toEUI[:]),
+	}
+	if r.from > r.to {
+		return joinEUIRange{}, fmt.Errorf("invalid JoinEUI range %q: start after end", s)
+	}
+	return r, nil
+}
+
+func (r joinEUIRange) matches(joinEUI lorawan.EUI64) bool {
+	eui := binary.BigEndian.Uint64(joinEUI[:])
+	return eui >= r.from && eui <= r.to
+}
+
+func (r packetFilterRules) hasDevAddrRules() bool {
+	return len(r.netIDs) > 0 || len(r.devAddrPrefixes) > 0
+}
+
+func (r packetFilterRules) matchesDevAddr(devAddr lorawan.DevAddr) bool {
+	for _, netID := range r.netIDs {
+		if devAddr.IsNetID(netID) {
+			return true
+		}
+	}
+	for _, p := range r.devAddrPrefixes {
+		if p.matches(devAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r packetFilterRules) matchesJoinEUI(joinEUI lorawan.EUI64) bool {
+	for _, jr := range r.joinEUIs {
+		if jr.matches(joinEUI) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts returns an indication if the uplink or join-request passes the
+// filter.
+func (f packetFilter) accepts(ev *GatewayEvent) bool {
+	switch {
+	case ev.IsUplink():
+		if ev.uplink.proprietary {
+			return true
+		}
+		if f.deny.matchesDevAddr(ev.uplink.device) {
+			return false
+		}
+		return !f.allow.hasDevAddrRules() || f.allow.matchesDevAddr(ev.uplink.device)
+	case ev.IsJoin():
+		if f.deny.matchesJoinEUI(ev.join.joinEUI) {
+			return false
+		}
+		return len(f.allow.joinEUIs) == 0 || f.allow.matchesJoinEUI(ev.join.joinEUI)
+	}
+	return true
+}
+
+// packetFilterFrameType returns the frame type label for filtered frames.
+func packetFilterFrameType(ev *GatewayEvent) string {
+	if ev.IsJoin() {
+		return "join"
+	}
+	return "uplink"
+}
+
+// routePacketFilter returns the packet filter for the route, a filter for a
+// specific route takes precedence over a filter for all routes.
+func routePacketFilter(filters []packetFilter, route string) (packetFilter, bool) {
+	var (
+		found packetFilter
+		ok    bool
+	)
+	for _, f := range filters {
+		if f.route == route {
+			return f, true
+		}
+		if f.route == "" && !ok {
+			found, ok = f, true
+		}
+	}
+	return found, ok
+}
+
+// rejectedByAllRoutes returns an indication if no route accepts the uplink
+// or join-request. Routes without their own filter use the filter for all
+// routes, if there is none they accept everything.
+func rejectedByAllRoutes(filters []packetFilter, ev *GatewayEvent) bool {
+	if _, ok := routePacketFilter(filters, ""); !ok {
+		return false
+	}
+	for _, f := range filters {
+		if f.accepts(ev) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/google/uuid"
+)
+
+// packetIDMetadataKey is the uplink metadata key that holds the packet id.
+// The metadata is forwarded by routers to ChirpStack, this allows a frame to
+// be traced through the forwarder, router and network server logs.
+const packetIDMetadataKey = "thingsix_packet_id"
+
+// newPacketID returns a unique id for a packet received by the forwarder.
+func newPacketID() string {
+	return uuid.NewString()
+}
+
+// uplinkPacketID returns the packet id of an uplink frame, or an empty string
+// if the frame has no packet id.
+func uplinkPacketID(frame *gw.UplinkFrame) string {
+	return frame.GetRxInfo().GetMetadata()[packetIDMetadataKey]
+}
+
+type downlinkPacketKey struct {
+	gateway    lorawan.EUI64
+	downlinkID uint32
+}
+
+type downlinkPacket struct {
+	id   string
+	sent time.Time
+}
+
+// downlinkPacketIDs remembers the packet id of downlinks sent to gateways so
+// the gateway ACK can be correlated with the downlink.
+type downlinkPacketIDs struct {
+	mu      sync.Mutex
+	packets map[downlinkPacketKey]downlinkPacket
+}
+
+func newDownlinkPacketIDs() *downlinkPacketIDs {
+	return &downlinkPacketIDs{packets: make(map[downlinkPacketKey]downlinkPacket)}
+}
+
+// add records id as packet id for the downlink and removes expired entries.
+func (d *downlinkPacketIDs) add(gateway lorawan.EUI64, downlinkID uint32, id string) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, packet := range d.packets {
+		if now.Sub(packet.sent) > downlinkInflightTimeout {
+			delete(d.packets, key)
+		}
+	}
+	d.packets[downlinkPacketKey{gateway: gateway, downlinkID: downlinkID}] = downlinkPacket{id: id, sent: now}
+}
+
+// take returns the packet id of the downlink and forgets it. It returns an
+// empty string when the downlink is unknown.
+func (d *downlinkPacketIDs) take(gateway lorawan.EUI64, downlinkID uint32) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := downlinkPacketKey{gateway: gateway, downlinkID: downlinkID}
+	packet, ok := d.packets[key]
+	if !ok {
+		return ""
+	}
+	delete(d.packets, key)
+	return packet.id
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// listPage is a single page of a paginated list reply.
+type listPage[T any] struct {
+	Items []T `json:"items"`
+	// Total is the number of items that match the filters
+	Total int `json:"total"`
+	// NextCursor must be passed as cursor to retrieve the next page, empty
+	// when this is the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// listSpec describes how items of a list endpoint can be filtered and sorted.
+// Filters are query parameters with a field name, items match when the field
+// equals (case-insensitive) one of the given values. The sort parameter holds
+// a field name, prefixed with - to sort descending. Pages are requested with
+// the limit and cursor parameters.
+type listSpec[T any] struct {
+	// fields holds the fields items can be filtered and sorted on
+	fields map[string]func(T) string
+	// numeric holds fields that are sorted numerically instead of
+	// lexicographically
+	numeric map[string]bool
+	// id uniquely identifies an item and breaks ties when sorting
+	id func(T) string
+	// defaultSort is used when the request has no sort parameter
+	defaultSort string
+}
+
+// listCursor is the position after which the next page starts.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"i"`
+}
+
+var listQueryParams = map[string]bool{"limit": true, "cursor": true, "sort": true}
+
+// requested returns an indication if the request asks for a paginated,
+// filtered or sorted list. List endpoints that existed before pagination
+// keep their original reply when it isn't.
+func (spec listSpec[T]) requested(r *http.Request) bool {
+	for param := range r.URL.Query() {
+		if _, ok := spec.fields[param]; ok || listQueryParams[param] {
+			return true
+		}
+	}
+	return false
+}
+
+// page filters, sorts and paginates items as requested in r.
+func (spec listSpec[T]) page(r *http.Request, items []T) (*listPage[T], error) {
+	query := r.URL.Query()
+
+	limit := defaultPageSize
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", l)
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+	}
+
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = spec.defaultSort
+	}
+	field, ok := spec.fields[strings.TrimPrefix(sortBy, "-")]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort field %q", sortBy)
+	}
+	var (
+		desc    = strings.HasPrefix(sortBy, "-")
+		numeric = spec.numeric[strings.TrimPrefix(sortBy, "-")]
+	)
+
+	var cursor *listCursor
+	if c := query.Get("cursor"); c != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			cursor = new(listCursor)
+			err = json.Unmarshal(raw, cursor)
+		}
+		if err != nil || cursor.Sort != sortBy {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	// keep items that match all filters
+	matched := make([]T, 0, len(items))
+	for _, item := range items {
+		if spec.match(query, item) {
+			matched = append(matched, item)
+		}
+	}
+
+	// before returns an indication if item a is listed before b, the id
+	// breaks ties so the order is stable between requests
+	before := func(av, aid, bv, bid string) bool {
+		if c := compareListValues(av, bv, numeric); c != 0 {
+			return (c < 0) != desc
+		}
+		return aid < bid
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return before(field(matched[i]), spec.id(matched[i]), field(matched[j]), spec.id(matched[j]))
+	})
+
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return before(cursor.Value, cursor.ID, field(matched[i]), spec.id(matched[i]))
+		})
+	}
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := &listPage[T]{Items: matched[start:end], Total: len(matched)}
+	if end < len(matched) {
+		last := matched[end-1]
+		raw, _ := json.Marshal(listCursor{Sort: sortBy, Value: field(last), ID: spec.id(last)})
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return page, nil
+}
+
+func (spec listSpec[T]) match(query map[string][]string, item T) bool {
+	for param, values := range query {
+		field, ok := spec.fields[param]
+		if !ok {
+			continue
+		}
+		value, found := field(item), false
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// compareListValues compares numeric values numerically, if the values are
+// not numeric or can't be parsed they are compared lexicographically.
+func compareListValues(a, b string, numeric bool) int {
+	if !numeric {
+		return strings.Compare(a, b)
+	}
+	if af, err := strconv.ParseFloat(a, 64); err == nil {
+		if bf, err := strconv.ParseFloat(b, 64); err == nil {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// replyListPage replies with the requested page of items.
+func replyListPage[T any](w http.ResponseWriter, r *http.Request, spec listSpec[T], items []T) {
+	page, err := spec.page(r, items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replyJSON(w, http.StatusOK, page)
+}
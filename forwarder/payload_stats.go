@@ -0,0 +1,228 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// payloadSizeBuckets are the upper bounds of the payload size histograms in
+// bytes, they follow the maximum LoRaWAN payload sizes per data rate.
+var payloadSizeBuckets = []float64{12, 24, 51, 64, 115, 128, 222, 242, 255}
+
+// payloadDistribution counts frames per FPort and payload size.
+type payloadDistribution struct {
+	uplinks uint64
+	fports  map[uint8]uint64
+	// sizes holds per spreading factor the counts per payload size bucket,
+	// with an extra bucket for frames larger than the last bucket
+	sizes map[uint32][]uint64
+}
+
+func newPayloadDistribution() *payloadDistribution {
+	return &payloadDistribution{
+		fports: make(map[uint8]uint64),
+		sizes:  make(map[uint32][]uint64),
+	}
+}
+
+func (d *payloadDistribution) record(sf uint32, fport *uint8, size int) {
+	d.uplinks++
+	if fport != nil {
+		d.fports[*fport]++
+	}
+	counts, ok := d.sizes[sf]
+	if !ok {
+		counts = make([]uint64, len(payloadSizeBuckets)+1)
+		d.sizes[sf] = counts
+	}
+	i := sort.SearchFloat64s(payloadSizeBuckets, float64(size))
+	counts[i]++
+}
+
+// PayloadDistribution describes the FPort usage and payload sizes of the
+// uplinks received by a gateway or delivered to a router.
+type PayloadDistribution struct {
+	GatewayNetworkID *lorawan.EUI64 `json:"gatewayNetworkId,omitempty"`
+	GatewayLocalID   *lorawan.EUI64 `json:"gatewayLocalId,omitempty"`
+	Router           string         `json:"router,omitempty"`
+	Uplinks          uint64         `json:"uplinks"`
+	// FPorts holds the number of uplinks per FPort
+	FPorts map[string]uint64 `json:"fports"`
+	// Sizes holds per spreading factor the number of uplinks per payload
+	// size bucket, the last count is for uplinks larger than the last bucket
+	Sizes map[string][]uint64 `json:"sizes"`
+}
+
+func (d *payloadDistribution) report() PayloadDistribution {
+	report := PayloadDistribution{
+		Uplinks: d.uplinks,
+		FPorts:  make(map[string]uint64, len(d.fports)),
+		Sizes:   make(map[string][]uint64, len(d.sizes)),
+	}
+	for port, n := range d.fports {
+		report.FPorts[fmt.Sprint(port)] = n
+	}
+	for sf, counts := range d.sizes {
+		report.Sizes[fmt.Sprintf("SF%d", sf)] = append([]uint64(nil), counts...)
+	}
+	return report
+}
+
+// PayloadStats tracks FPort and payload size distributions per gateway and
+// per router since the forwarder started.
+type PayloadStats struct {
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*payloadDistribution
+	local    map[lorawan.EUI64]lorawan.EUI64
+	routers  map[string]*payloadDistribution
+}
+
+// NewPayloadStats returns an empty payload statistics tracker.
+func NewPayloadStats() *PayloadStats {
+	return &PayloadStats{
+		gateways: make(map[lorawan.EUI64]*payloadDistribution),
+		local:    make(map[lorawan.EUI64]lorawan.EUI64),
+		routers:  make(map[string]*payloadDistribution),
+	}
+}
+
+// RecordGateway records an uplink received by the gateway.
+func (p *PayloadStats) RecordGateway(gw *gateway.Gateway, frame *gw.UplinkFrame, fport *uint8) {
+	var (
+		sf   = frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor()
+		size = len(frame.GetPhyPayload())
+	)
+
+	gatewayObserver(uplinkPayloadSizeHistogram, gw.NetworkID, gw.LocalID, fmt.Sprint(sf)).Observe(float64(size))
+	if fport != nil {
+		gatewayCounter(uplinkFPortCounter, gw.NetworkID, gw.LocalID, fmt.Sprint(*fport)).Inc()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d, ok := p.gateways[gw.NetworkID]
+	if !ok {
+		d = newPayloadDistribution()
+		p.gateways[gw.NetworkID] = d
+		p.local[gw.NetworkID] = gw.LocalID
+	}
+	d.record(sf, fport, size)
+}
+
+// RecordRouter records an uplink delivered to the router.
+func (p *PayloadStats) RecordRouter(router string, frame *gw.UplinkFrame) {
+	var (
+		sf        = frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor()
+		size      = len(frame.GetPhyPayload())
+		fport, ok = uplinkFPort(frame.GetPhyPayload())
+	)
+
+	routerPayloadSizeHistogram.WithLabelValues(router, fmt.Sprint(sf)).Observe(float64(size))
+	if ok {
+		routerFPortCounter.WithLabelValues(router, fmt.Sprint(fport)).Inc()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d, found := p.routers[router]
+	if !found {
+		d = newPayloadDistribution()
+		p.routers[router] = d
+	}
+	if ok {
+		d.record(sf, &fport, size)
+	} else {
+		d.record(sf, nil, size)
+	}
+}
+
+// PayloadStatsReport holds the payload distributions of all gateways and
+// routers.
+type PayloadStatsReport struct {
+	// Buckets are the upper bounds of the payload size buckets in bytes
+	Buckets  []float64             `json:"buckets"`
+	Gateways []PayloadDistribution `json:"gateways"`
+	Routers  []PayloadDistribution `json:"routers"`
+}
+
+// Report returns the payload distributions ordered by gateway network id and
+// router.
+func (p *PayloadStats) Report() PayloadStatsReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := PayloadStatsReport{
+		Buckets:  payloadSizeBuckets,
+		Gateways: make([]PayloadDistribution, 0, len(p.gateways)),
+		Routers:  make([]PayloadDistribution, 0, len(p.routers)),
+	}
+	for networkID, d := range p.gateways {
+		var (
+			r       = d.report()
+			netID   = networkID
+			localID = p.local[networkID]
+		)
+		r.GatewayNetworkID, r.GatewayLocalID = &netID, &localID
+		report.Gateways = append(report.Gateways, r)
+	}
+	for router, d := range p.routers {
+		r := d.report()
+		r.Router = router
+		report.Routers = append(report.Routers, r)
+	}
+	sort.Slice(report.Gateways, func(i, j int) bool {
+		return report.Gateways[i].GatewayNetworkID.String() < report.Gateways[j].GatewayNetworkID.String()
+	})
+	sort.Slice(report.Routers, func(i, j int) bool {
+		return report.Routers[i].Router < report.Routers[j].Router
+	})
+	return report
+}
+
+// uplinkFPort returns the FPort of a data uplink PHYPayload without decoding
+// the complete frame. It returns false if the frame has no FPort.
+func uplinkFPort(phy []byte) (uint8, bool) {
+	// MHDR (1) | DevAddr (4) | FCtrl (1) | FCnt (2) | FOpts (0..15) | FPort | ... | MIC (4)
+	if len(phy) < 13 {
+		return 0, false
+	}
+	mtype := lorawan.MType(phy[0] >> 5)
+	if mtype != lorawan.UnconfirmedDataUp && mtype != lorawan.ConfirmedDataUp {
+		return 0, false
+	}
+	i := 8 + int(phy[5]&0x0f)
+	if i >= len(phy)-4 {
+		return 0, false
+	}
+	return phy[i], true
+}
+
+// PayloadStats returns the FPort and payload size distributions per gateway
+// and per router.
+func (svc APIService) PayloadStats(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, svc.payloadStats.Report())
+}
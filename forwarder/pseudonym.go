@@ -0,0 +1,116 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brocaar/lorawan"
+)
+
+// minPseudonymizationKeySize is the minimal size of the HMAC key in bytes
+const minPseudonymizationKeySize = 16
+
+// IDObfuscator replaces device identifiers before they leave the forwarder
+// through packet logs or analytics exports. Routing always uses the real
+// identifiers.
+type IDObfuscator interface {
+	DevAddr(devAddr lorawan.DevAddr) string
+	DevEUI(devEUI lorawan.EUI64) string
+}
+
+// plainIDs returns identifiers as is, it is used when pseudonymization is
+// disabled.
+type plainIDs struct{}
+
+func (plainIDs) DevAddr(devAddr lorawan.DevAddr) string { return devAddr.String() }
+func (plainIDs) DevEUI(devEUI lorawan.EUI64) string     { return devEUI.String() }
+
+// hmacIDs replaces identifiers with a HMAC-SHA256 of the identifier that is
+// truncated to the size of the identifier. Pseudonyms are stable for a key,
+// exports and logs from forwarders that share the key can be correlated
+// without revealing the real identifiers.
+type hmacIDs struct {
+	key []byte
+}
+
+func (h hmacIDs) DevAddr(devAddr lorawan.DevAddr) string {
+	return h.sum("devaddr", devAddr[:])
+}
+
+func (h hmacIDs) DevEUI(devEUI lorawan.EUI64) string {
+	return h.sum("deveui", devEUI[:])
+}
+
+// sum returns the hex encoded HMAC of id truncated to the length of id, kind
+// ensures a DevAddr and DevEUI with the same bytes get different pseudonyms.
+func (h hmacIDs) sum(kind string, id []byte) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(kind))
+	mac.Write(id)
+	return hex.EncodeToString(mac.Sum(nil)[:len(id)])
+}
+
+// NewIDObfuscator returns the identifier obfuscator configured in cfg.
+func NewIDObfuscator(cfg *ForwarderPseudonymizationConfig) (IDObfuscator, error) {
+	switch strings.ToLower(cfg.Method) {
+	case "", "hmac-sha256":
+		key := []byte(cfg.Key)
+		if cfg.KeyFile != "" {
+			raw, err := os.ReadFile(cfg.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read pseudonymization key: %w", err)
+			}
+			key = []byte(strings.TrimSpace(string(raw)))
+		}
+		if len(key) < minPseudonymizationKeySize {
+			return nil, fmt.Errorf("pseudonymization key must be at least %d bytes", minPseudonymizationKeySize)
+		}
+		return hmacIDs{key: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported pseudonymization method %q", cfg.Method)
+	}
+}
+
+// pseudonymizePacketEvent returns a copy of ev with its device identifiers
+// replaced by ids. Events are shared between consumers and must not be
+// changed in place.
+func pseudonymizePacketEvent(ids IDObfuscator, ev *PacketEvent) *PacketEvent {
+	cpy := *ev
+	if ev.DevAddr != "" {
+		var devAddr lorawan.DevAddr
+		if err := devAddr.UnmarshalText([]byte(ev.DevAddr)); err == nil {
+			cpy.DevAddr = ids.DevAddr(devAddr)
+		} else {
+			cpy.DevAddr = ""
+		}
+	}
+	if ev.DevEUI != "" {
+		var devEUI lorawan.EUI64
+		if err := devEUI.UnmarshalText([]byte(ev.DevEUI)); err == nil {
+			cpy.DevEUI = ids.DevEUI(devEUI)
+		} else {
+			cpy.DevEUI = ""
+		}
+	}
+	return &cpy
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan/band"
+)
+
+var (
+	regionBandsMu sync.Mutex
+	regionBands   = make(map[frequency_plan.BandName]band.Band)
+)
+
+// regionBand returns the regional parameters for the given region. They are
+// computed once per region and cached afterwards.
+func regionBand(region frequency_plan.BandName) (band.Band, error) {
+	regionBandsMu.Lock()
+	defer regionBandsMu.Unlock()
+
+	if b, ok := regionBands[region]; ok {
+		return b, nil
+	}
+	b, err := frequency_plan.GetBand(strings.ToUpper(string(region)))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported region %s: %w", region, err)
+	}
+	regionBands[region] = b
+	return b, nil
+}
+
+// gatewayRegion returns the region (frequency plan) the given gateway
+// operates in. This is the band registered for the gateway, the band plan the
+// operator set in the gateway metadata or the configured default frequency
+// plan if the gateway has no band registered or set. If none is available
+// frequency_plan.Invalid is returned.
+//
+// The region is used to partition state and routing within the forwarder,
+// this allows a single forwarder to serve gateways that operate in different
+// regions.
+func gatewayRegion(gw *gateway.Gateway, store gateway.GatewayStore) frequency_plan.BandName {
+	if gw.Details != nil && gw.Details.Band != nil {
+		var band frequency_plan.BandName
+		if err := band.UnmarshalText([]byte(*gw.Details.Band)); err == nil {
+			return band
+		}
+	}
+	if gw.Metadata != nil && gw.Metadata.BandPlan != "" {
+		var band frequency_plan.BandName
+		if err := band.UnmarshalText([]byte(gw.Metadata.BandPlan)); err == nil {
+			return band
+		}
+	}
+	return store.DefaultFrequencyPlan()
+}
+
+// ServesRegion returns an indication if the router wants to receive traffic
+// from gateways in the given region. Routers from ThingsIX serve the region
+// they are registered for. Default routers serve all regions unless a set of
+// regions is configured for them.
+//
+// Traffic from gateways for which the region is unknown is forwarded to all
+// routers to remain compatible with forwarders that serve gateways without a
+// registered band and without a default frequency plan.
+func (r *Router) ServesRegion(region frequency_plan.BandName) bool {
+	if region == frequency_plan.Invalid || region == "" {
+		return true
+	}
+
+	if r.Default {
+		if len(r.Regions) == 0 {
+			return true
+		}
+		for _, served := range r.Regions {
+			if served == region {
+				return true
+			}
+		}
+		return false
+	}
+
+	return frequency_plan.FromBlockchain(r.FrequencyPlan) == region
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDedupPerRegion(t *testing.T) {
+	window := 10 * time.Millisecond
+	dedup, err := NewUplinkDeduplicator(&ForwarderDeduplicationConfig{Window: &window})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		delivered = make(map[frequency_plan.BandName]int)
+		deliver   = func(ev *GatewayEvent, frame *gw.UplinkFrame, frameLog *logrus.Entry) {
+			mu.Lock()
+			delivered[ev.region]++
+			mu.Unlock()
+			wg.Done()
+		}
+		log = logrus.NewEntry(logrus.New())
+	)
+	wg.Add(2)
+	for _, rx := range []struct {
+		gateway string
+		region  frequency_plan.BandName
+	}{
+		{"0016c001ff10a235", frequency_plan.EU868},
+		{"0016c001ff10a236", frequency_plan.EU868},
+		{"0016c001ff10a237", frequency_plan.US915},
+	} {
+		frame := &gw.UplinkFrame{
+			PhyPayload: []byte{0x40, 0xda, 0x1b, 0x01, 0x26, 0x00, 0x01, 0x00},
+			RxInfo:     &gw.UplinkRxInfo{GatewayId: rx.gateway},
+		}
+		dedup.Hold(&GatewayEvent{region: rx.region}, frame, log, deliver)
+	}
+	wg.Wait()
+
+	if delivered[frequency_plan.EU868] != 1 || delivered[frequency_plan.US915] != 1 {
+		t.Errorf("expected one delivery per region, got %v", delivered)
+	}
+}
+
+func TestDutyCyclePerRegion(t *testing.T) {
+	s := NewDownlinkScheduler(&ForwarderDownlinkSchedulerConfig{DutyCycle: true})
+	var (
+		gatewayID = lorawan.EUI64{0x00, 0x16, 0xc0, 0x01, 0xff, 0x10, 0xa2, 0x35}
+		item      = &gw.DownlinkFrameItem{
+			PhyPayload: make([]byte, 32),
+			TxInfo: &gw.DownlinkTxInfo{
+				Frequency: 869525000,
+				Modulation: &gw.Modulation{Parameters: &gw.Modulation_Lora{Lora: &gw.LoraModulationInfo{
+					Bandwidth:       125000,
+					SpreadingFactor: 12,
+					CodeRate:        gw.CodeRate_CR_4_5,
+				}}},
+			},
+		}
+		now = time.Now()
+	)
+	s.Transmitted(gatewayID, frequency_plan.EU868, item, now)
+
+	usage := s.DutyCycleUsage()[gatewayID]
+	if len(usage) != 1 || usage["EU868/869.4-869.65"] == 0 {
+		t.Errorf("expected usage of EU868/869.4-869.65, got %v", usage)
+	}
+}
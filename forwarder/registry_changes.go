@@ -0,0 +1,328 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+// RegistryChangeKind describes how the registration of a gateway changed.
+type RegistryChangeKind string
+
+const (
+	RegistryChangeOnboarded            RegistryChangeKind = "onboarded"
+	RegistryChangeOwnershipTransferred RegistryChangeKind = "ownership_transferred"
+	RegistryChangeDetailsUpdated       RegistryChangeKind = "details_updated"
+	RegistryChangeOffboarded           RegistryChangeKind = "offboarded"
+)
+
+const (
+	registryChangeAlertKind = "registry_change"
+	// maxRegistryChanges is the number of changes kept for the API
+	maxRegistryChanges = 1000
+)
+
+// RegistryChange is a change in the ThingsIX gateway registry that affects a
+// gateway in the gateway store.
+type RegistryChange struct {
+	Kind             RegistryChangeKind      `json:"kind"`
+	GatewayNetworkID lorawan.EUI64           `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64           `json:"gatewayLocalId"`
+	PreviousOwner    *common.Address         `json:"previousOwner,omitempty"`
+	Owner            *common.Address         `json:"owner,omitempty"`
+	PreviousDetails  *gateway.GatewayDetails `json:"previousDetails,omitempty"`
+	Details          *gateway.GatewayDetails `json:"details,omitempty"`
+	// Fields lists the details fields that changed
+	Fields   []string  `json:"fields,omitempty"`
+	Detected time.Time `json:"detected"`
+}
+
+// registrySnapshot is the registration of a gateway as last seen in the store.
+type registrySnapshot struct {
+	owner   *common.Address
+	details *gateway.GatewayDetails
+}
+
+// newRegistrySnapshot copies the registration of gw, stores can update
+// gateways in place when they sync with the registry.
+func newRegistrySnapshot(gw *gateway.Gateway) registrySnapshot {
+	var snapshot registrySnapshot
+	if gw.Owner != nil {
+		owner := *gw.Owner
+		snapshot.owner = &owner
+	}
+	if gw.Details != nil {
+		details := *gw.Details
+		snapshot.details = &details
+	}
+	return snapshot
+}
+
+// RegistryWatcher periodically compares the registration of the gateways in
+// the store with the previous registration. Changes raise an alert and are
+// kept for the API so hosting providers notice when a gateway they host is
+// transferred, updated or offboarded.
+type RegistryWatcher struct {
+	store     gateway.GatewayStore
+	alerter   *Alerter
+	interval  time.Duration
+	retention time.Duration
+
+	mu        sync.Mutex
+	snapshots map[lorawan.EUI64]registrySnapshot
+	changes   []RegistryChange
+	// raised holds when alerts were raised, alerts are resolved after the
+	// retention period
+	raised map[string]time.Time
+}
+
+// NewRegistryWatcher returns a watcher for the gateways in store.
+func NewRegistryWatcher(cfg *ForwarderRegistryChangesConfig, store gateway.GatewayStore, alerter *Alerter) *RegistryWatcher {
+	w := &RegistryWatcher{
+		store:     store,
+		alerter:   alerter,
+		interval:  time.Minute,
+		retention: 24 * time.Hour,
+		raised:    make(map[string]time.Time),
+	}
+	if cfg.Interval != nil && *cfg.Interval > 0 {
+		w.interval = *cfg.Interval
+	}
+	if cfg.AlertRetention != nil && *cfg.AlertRetention > 0 {
+		w.retention = *cfg.AlertRetention
+	}
+	return w
+}
+
+// Run checks the store for registry changes until ctx expires.
+func (w *RegistryWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	w.check(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			w.check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check compares the store with the previous snapshot. The first check only
+// records the snapshot.
+func (w *RegistryWatcher) check(now time.Time) {
+	snapshots := make(map[lorawan.EUI64]registrySnapshot)
+	var changes []RegistryChange
+
+	w.mu.Lock()
+	first := w.snapshots == nil
+	w.store.Range(gateway.GatewayRangerFunc(func(gw *gateway.Gateway) bool {
+		current := newRegistrySnapshot(gw)
+		snapshots[gw.LocalID] = current
+		if previous, ok := w.snapshots[gw.LocalID]; ok && !first {
+			changes = append(changes, registryChanges(gw, previous, current, now)...)
+		}
+		return true
+	}))
+	w.snapshots = snapshots
+	w.changes = append(w.changes, changes...)
+	if overflow := len(w.changes) - maxRegistryChanges; overflow > 0 {
+		w.changes = append([]RegistryChange(nil), w.changes[overflow:]...)
+	}
+	for _, change := range changes {
+		w.raised[registryChangeAlertKey(change)] = now
+	}
+	for key, raised := range w.raised {
+		if now.Sub(raised) >= w.retention {
+			delete(w.raised, key)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, change := range changes {
+		w.raise(change)
+	}
+	w.alerter.ResolveKind(registryChangeAlertKind, func(key string) bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		_, ok := w.raised[key]
+		return ok
+	})
+}
+
+// registryChanges returns the changes between the previous and current
+// registration of gw.
+func registryChanges(gw *gateway.Gateway, previous, current registrySnapshot, now time.Time) []RegistryChange {
+	change := RegistryChange{
+		GatewayNetworkID: gw.NetworkID,
+		GatewayLocalID:   gw.LocalID,
+		PreviousOwner:    previous.owner,
+		Owner:            current.owner,
+		Detected:         now,
+	}
+
+	switch {
+	case previous.owner == nil && current.owner == nil:
+		return nil
+	case previous.owner == nil:
+		change.Kind = RegistryChangeOnboarded
+		change.Details = current.details
+		return []RegistryChange{change}
+	case current.owner == nil:
+		change.Kind = RegistryChangeOffboarded
+		change.PreviousDetails = previous.details
+		return []RegistryChange{change}
+	}
+
+	var changes []RegistryChange
+	if *previous.owner != *current.owner {
+		transfer := change
+		transfer.Kind = RegistryChangeOwnershipTransferred
+		changes = append(changes, transfer)
+	}
+	if fields := changedDetails(previous.details, current.details); len(fields) > 0 {
+		updated := change
+		updated.Kind = RegistryChangeDetailsUpdated
+		updated.PreviousOwner, updated.Owner = nil, nil
+		updated.PreviousDetails, updated.Details = previous.details, current.details
+		updated.Fields = fields
+		changes = append(changes, updated)
+	}
+	return changes
+}
+
+// changedDetails returns the names of the fields that differ between a and b.
+func changedDetails(a, b *gateway.GatewayDetails) []string {
+	if a == nil {
+		a = &gateway.GatewayDetails{}
+	}
+	if b == nil {
+		b = &gateway.GatewayDetails{}
+	}
+
+	var fields []string
+	if !equalStringPtr(a.AntennaGain, b.AntennaGain) {
+		fields = append(fields, "antennaGain")
+	}
+	if !equalStringPtr(a.Band, b.Band) {
+		fields = append(fields, "band")
+	}
+	if !equalStringPtr(a.Location, b.Location) {
+		fields = append(fields, "location")
+	}
+	if (a.Altitude == nil) != (b.Altitude == nil) || (a.Altitude != nil && *a.Altitude != *b.Altitude) {
+		fields = append(fields, "altitude")
+	}
+	return fields
+}
+
+func equalStringPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func registryChangeAlertKey(change RegistryChange) string {
+	return fmt.Sprintf("%s/%s/%s", registryChangeAlertKind, change.GatewayNetworkID, change.Kind)
+}
+
+func (w *RegistryWatcher) raise(change RegistryChange) {
+	alert := Alert{
+		Key:              registryChangeAlertKey(change),
+		Kind:             registryChangeAlertKind,
+		GatewayNetworkID: &change.GatewayNetworkID,
+		GatewayLocalID:   &change.GatewayLocalID,
+		Details:          map[string]interface{}{"change": change.Kind},
+	}
+	if change.PreviousOwner != nil {
+		alert.Details["previousOwner"] = change.PreviousOwner.Hex()
+	}
+	if change.Owner != nil {
+		alert.Details["owner"] = change.Owner.Hex()
+	}
+
+	switch change.Kind {
+	case RegistryChangeOnboarded:
+		alert.Severity = AlertSeverityInfo
+		alert.Summary = fmt.Sprintf("gateway %s onboarded by %s", change.GatewayNetworkID, change.Owner.Hex())
+	case RegistryChangeOwnershipTransferred:
+		alert.Severity = AlertSeverityWarning
+		alert.Summary = fmt.Sprintf("gateway %s transferred from %s to %s",
+			change.GatewayNetworkID, change.PreviousOwner.Hex(), change.Owner.Hex())
+	case RegistryChangeDetailsUpdated:
+		alert.Severity = AlertSeverityInfo
+		alert.Summary = fmt.Sprintf("gateway %s details updated", change.GatewayNetworkID)
+		alert.Details["fields"] = change.Fields
+	case RegistryChangeOffboarded:
+		alert.Severity = AlertSeverityCritical
+		alert.Summary = fmt.Sprintf("gateway %s offboarded, was owned by %s", change.GatewayNetworkID, change.PreviousOwner.Hex())
+	}
+
+	onboardingLog.WithFields(logrus.Fields{
+		"gw_network_id": change.GatewayNetworkID,
+		"gw_local_id":   change.GatewayLocalID,
+		"change":        change.Kind,
+	}).Info("gateway registration changed")
+
+	w.alerter.Raise(alert)
+}
+
+// Changes returns up to n of the most recent registry changes, newest first.
+func (w *RegistryWatcher) Changes(n int) []RegistryChange {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n <= 0 || n > len(w.changes) {
+		n = len(w.changes)
+	}
+	changes := make([]RegistryChange, 0, n)
+	for i := len(w.changes) - 1; i >= 0 && len(changes) < n; i-- {
+		changes = append(changes, w.changes[i])
+	}
+	return changes
+}
+
+// RegistryChanges returns the most recent registry changes for gateways in
+// the store.
+func (svc APIService) RegistryChanges(w http.ResponseWriter, r *http.Request) {
+	if svc.registryChanges == nil {
+		http.Error(w, "registry change tracking not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	replyJSON(w, http.StatusOK, svc.registryChanges.Changes(limit))
+}
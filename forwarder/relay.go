@@ -0,0 +1,50 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+const (
+	// relayFPort is the FPort on which a relay (LoRaWAN TS011 relay
+	// specification) forwards uplinks of end-devices to the network. The
+	// payload is encrypted with the relays keys, the frame is therefore
+	// routed on the relays DevAddr.
+	relayFPort = 226
+)
+
+// isRelayedUplink returns an indication if the data-up payload carries an
+// uplink that a relay forwards on behalf of an end-device.
+func isRelayedUplink(mac *lorawan.MACPayload) bool {
+	return mac.FPort != nil && *mac.FPort == relayFPort
+}
+
+// setRelayMetadata flags uplinks forwarded by a relay in the frame metadata so
+// network servers and applications can distinguish them from direct uplinks.
+func setRelayMetadata(frame *gw.UplinkFrame, mac *lorawan.MACPayload) {
+	if isRelayedUplink(mac) {
+		frame.RxInfo.Metadata["thingsix_relay"] = "true"
+	}
+}
+
+// setProprietaryMetadata flags proprietary frames in the frame metadata. Relay
+// wake-on-radio (WOR) and WOR-ACK frames use the proprietary message type.
+func setProprietaryMetadata(frame *gw.UplinkFrame) {
+	frame.RxInfo.Metadata["thingsix_proprietary"] = "true"
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// routeChangeStreamQueueSize is the number of route changes that are queued
+// for a client before changes are dropped.
+const routeChangeStreamQueueSize = 64
+
+// RouteChangeType describes how a route changed.
+type RouteChangeType string
+
+const (
+	// RouteAdded is emitted when a client for a router is started
+	RouteAdded RouteChangeType = "added"
+	// RouteRemoved is emitted when the client for a router is stopped
+	RouteRemoved RouteChangeType = "removed"
+	// RouteUpdated is emitted when the registration of a router changed
+	RouteUpdated RouteChangeType = "updated"
+	// RouteOnline is emitted when the connection with a router is established
+	RouteOnline RouteChangeType = "online"
+	// RouteOffline is emitted when the connection with a router is lost
+	RouteOffline RouteChangeType = "offline"
+)
+
+// RouteChangeEvent describes a change in the routing table.
+type RouteChangeEvent struct {
+	// Seq increases by one for each change, clients use it to detect missed
+	// changes
+	Seq    uint64            `json:"seq"`
+	Type   RouteChangeType   `json:"type"`
+	Time   time.Time         `json:"time"`
+	Router RouterClientStats `json:"router"`
+}
+
+// routeChangeMessage is sent to route change stream clients. The first
+// message has type snapshot and holds all routers, followed by a message per
+// change with the change type.
+type routeChangeMessage struct {
+	Seq     uint64              `json:"seq"`
+	Type    RouteChangeType     `json:"type"`
+	Time    time.Time           `json:"time"`
+	Router  *RouterClientStats  `json:"router,omitempty"`
+	Routers []RouterClientStats `json:"routers,omitempty"`
+}
+
+// publishRouteChange sends the change of the given client to all route
+// change stream subscribers.
+func (r *RoutingTable) publishRouteChange(typ RouteChangeType, client *RouterClient) {
+	ev := &RouteChangeEvent{
+		Seq:    atomic.AddUint64(&r.routeChangeSeq, 1),
+		Type:   typ,
+		Time:   time.Now(),
+		Router: client.Stats(),
+	}
+	if !r.routeChanges.TryBroadcast(ev) {
+		routingLog.WithField("router", ev.Router.Name).Warn("unable to broadcast route change")
+	}
+}
+
+// RouteChanges upgrades the connection to a websocket and streams changes in
+// the routing table as JSON. The first message is a snapshot of all routers,
+// followed by a message for each router that is added, removed, updated or
+// goes online or offline. Changes for clients that don't keep up are dropped,
+// clients detect this by a gap in the sequence numbers and must reconnect to
+// get a fresh snapshot.
+func (svc APIService) RouteChanges(w http.ResponseWriter, r *http.Request) {
+	conn, err := eventStreamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // upgrader replied with an error
+	}
+	defer conn.Close()
+
+	log := routingLog.WithField("remote", r.RemoteAddr)
+	log.Debug("route change stream client connected")
+	defer log.Debug("route change stream client disconnected")
+
+	// subscribe before the snapshot is taken so no change is missed, changes
+	// that are already in the snapshot can be received again
+	changes := make(chan *RouteChangeEvent, routeChangeStreamQueueSize)
+	svc.routingTable.routeChanges.Subscribe(changes)
+	defer svc.routingTable.routeChanges.Unsubscribe(changes)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * eventStreamPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * eventStreamPingInterval))
+	})
+
+	// clients don't send messages, reading is required to process pongs and
+	// detect closed connections
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg *routeChangeMessage) bool {
+		_ = conn.SetWriteDeadline(time.Now().Add(eventStreamWriteTimeout))
+		if err := conn.WriteJSON(msg); err != nil {
+			log.WithError(err).Debug("unable to write to route change stream client")
+			return false
+		}
+		return true
+	}
+
+	if !send(&routeChangeMessage{
+		Seq:     atomic.LoadUint64(&svc.routingTable.routeChangeSeq),
+		Type:    "snapshot",
+		Time:    time.Now(),
+		Routers: svc.routingTable.RouterClients(),
+	}) {
+		return
+	}
+
+	ping := time.NewTicker(eventStreamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case ev := <-changes:
+			router := ev.Router
+			if !send(&routeChangeMessage{Seq: ev.Seq, Type: ev.Type, Time: ev.Time, Router: &router}) {
+				return
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(eventStreamWriteTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
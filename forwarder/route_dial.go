@@ -0,0 +1,181 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// routeDialOptions determine how the connection with a route is established.
+type routeDialOptions struct {
+	route          string
+	tls            *tls.Config
+	authority      string
+	address        string
+	connectTimeout time.Duration
+	keepalive      keepalive.ClientParameters
+	// resolver resolves the endpoint, nil to let gRPC resolve it
+	resolver *routeResolver
+}
+
+// defaultRouteDialOptions are used for routes without dial options, these
+// connect in plain text.
+func defaultRouteDialOptions() routeDialOptions {
+	return routeDialOptions{
+		connectTimeout: 30 * time.Second,
+		keepalive: keepalive.ClientParameters{
+			Time:                20 * time.Second, // send pings every 20 seconds if there is no activity
+			Timeout:             5 * time.Second,  // wait 5 seconds for ping ack before considering the connection dead
+			PermitWithoutStream: true,             // send pings even without active streams
+		},
+	}
+}
+
+// newRouteDialOptions returns the dial options of the routes in cfg.
+func newRouteDialOptions(cfg []ForwarderRouteDialConfig) ([]routeDialOptions, error) {
+	options := make([]routeDialOptions, 0, len(cfg))
+	for _, c := range cfg {
+		o := defaultRouteDialOptions()
+		o.route = c.Route
+		o.authority = c.Authority
+		o.address = c.Address
+		if o.route == "*" {
+			o.route = ""
+		}
+		if c.ConnectTimeout != nil && *c.ConnectTimeout > 0 {
+			o.connectTimeout = *c.ConnectTimeout
+		}
+		if c.KeepaliveInterval != nil && *c.KeepaliveInterval > 0 {
+			o.keepalive.Time = *c.KeepaliveInterval
+		}
+		if c.KeepaliveTimeout != nil && *c.KeepaliveTimeout > 0 {
+			o.keepalive.Timeout = *c.KeepaliveTimeout
+		}
+
+		if !c.TLS && (c.ServerName != "" || c.CACert != "" || c.InsecureSkipVerify ||
+			c.ClientCert != "" || c.ClientKey != "" || len(c.SPIFFEIDs) > 0) {
+			return nil, fmt.Errorf("dial options of route %s set TLS options without tls", c.Route)
+		}
+		if c.TLS {
+			if err := o.setTLS(c); err != nil {
+				return nil, err
+			}
+		}
+		options = append(options, o)
+	}
+	return options, nil
+}
+
+// setTLS configures the TLS connection with the route. When a client
+// certificate is configured the forwarder authenticates itself to the router.
+// With SPIFFE IDs the router certificate chain and ID are verified in
+// VerifyConnection instead of the host name verification of crypto/tls.
+func (o *routeDialOptions) setTLS(c ForwarderRouteDialConfig) error {
+	o.tls = &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACert != "" {
+		pool, err := utils.LoadCertPool(c.CACert)
+		if err != nil {
+			return fmt.Errorf("unable to load CA certificate of route %s: %w", c.Route, err)
+		}
+		o.tls.RootCAs = pool
+	}
+
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return fmt.Errorf("dial options of route %s require both client_cert and client_key", c.Route)
+	}
+	if c.ClientCert != "" {
+		pair, err := utils.LoadTLSKeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return fmt.Errorf("unable to load client certificate of route %s: %w", c.Route, err)
+		}
+		o.tls.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return pair.Certificate()
+		}
+	}
+
+	if len(c.SPIFFEIDs) > 0 {
+		if c.InsecureSkipVerify {
+			return fmt.Errorf("dial options of route %s set spiffe_ids with insecure_skip_verify", c.Route)
+		}
+		verify, err := utils.SPIFFEVerifier(c.SPIFFEIDs, o.tls.RootCAs, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return fmt.Errorf("dial options of route %s: %w", c.Route, err)
+		}
+		o.tls.InsecureSkipVerify = true // verified by verify
+		o.tls.VerifyConnection = verify
+	}
+	return nil
+}
+
+// routeDial returns the dial options for the route, dial options for a
+// specific route take precedence over dial options for all routes.
+func routeDial(options []routeDialOptions, route string) routeDialOptions {
+	var (
+		found = defaultRouteDialOptions()
+		ok    bool
+	)
+	for _, o := range options {
+		if o.route == route {
+			return o
+		}
+		if o.route == "" && !ok {
+			found, ok = o, true
+		}
+	}
+	return found
+}
+
+// grpcDialOptions returns the gRPC dial options.
+func (o routeDialOptions) grpcDialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithKeepaliveParams(o.keepalive)}
+	if o.tls != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(o.tls)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if o.authority != "" {
+		opts = append(opts, grpc.WithAuthority(o.authority))
+	}
+	if o.address != "" || o.resolver != nil {
+		override, resolver := o.address, o.resolver
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			if override != "" {
+				address = override
+			}
+			if resolver != nil {
+				return resolver.dialContext(ctx, address)
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", address)
+		}))
+	}
+	return opts
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/sirupsen/logrus"
+)
+
+// routeDiscovery discovers a default router through DNS. The SRV records
+// with name point to the router endpoints, one endpoint is selected as
+// described in RFC 2782. An optional TXT record with the same name holds
+// the router attributes as space separated key=value pairs:
+//
+//	name=<router name, defaults to the SRV record name>
+//	regions=<comma separated list of regions, e.g. EU868,US915>
+//
+// The records are resolved every interval. When they point to another
+// endpoint a client for the new endpoint is started and the client for the
+// previous endpoint is stopped once the new client is connected, or after
+// the grace period.
+type routeDiscovery struct {
+	name     string
+	interval time.Duration
+	grace    time.Duration
+	resolver *routeResolver
+}
+
+// newRouteDiscoveries returns the route discoveries configured in cfg. The
+// records are resolved by resolver, or the system resolver if nil.
+func newRouteDiscoveries(cfg []ForwarderRouteDiscoveryConfig, resolver *routeResolver) ([]*routeDiscovery, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	if resolver == nil {
+		var err error
+		if resolver, err = newRouteResolver(&ForwarderRoutersResolverConfig{}); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		discoveries = make([]*routeDiscovery, 0, len(cfg))
+		seen        = make(map[string]bool, len(cfg))
+	)
+	for _, c := range cfg {
+		if c.Name == "" {
+			return nil, fmt.Errorf("router discovery without name")
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate router discovery %s", c.Name)
+		}
+		seen[c.Name] = true
+
+		d := &routeDiscovery{
+			name:     c.Name,
+			interval: 5 * time.Minute,
+			grace:    time.Minute,
+			resolver: resolver,
+		}
+		if c.Interval != nil && *c.Interval > 0 {
+			d.interval = *c.Interval
+		}
+		if c.GracePeriod != nil && *c.GracePeriod >= 0 {
+			d.grace = *c.GracePeriod
+		}
+		discoveries = append(discoveries, d)
+	}
+	return discoveries, nil
+}
+
+// discover resolves the records and returns the router they describe, or
+// nil if there are no records. The current endpoint is kept as long as the
+// records allow it to prevent needless reconnects.
+func (d *routeDiscovery) discover(ctx context.Context, current string) (*Router, error) {
+	records, err := d.resolver.lookupSRV(ctx, d.name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lookup SRV records: %w", err)
+	}
+	endpoint := selectSRV(records, current)
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	attributes, err := d.resolver.lookupTXT(ctx, d.name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lookup TXT records: %w", err)
+	}
+
+	router := &Router{
+		Endpoint: endpoint,
+		Default:  true,
+		Name:     d.name,
+	}
+	for _, txt := range attributes {
+		for _, attr := range strings.Fields(txt) {
+			key, value, _ := strings.Cut(attr, "=")
+			switch key {
+			case "name":
+				if value != "" {
+					router.Name = value
+				}
+			case "regions":
+				router.Regions = nil
+				for _, region := range strings.Split(value, ",") {
+					if region != "" {
+						router.Regions = append(router.Regions, frequency_plan.BandName(region))
+					}
+				}
+			}
+		}
+	}
+	return router, nil
+}
+
+// selectSRV returns the endpoint of one of the records with the lowest
+// priority, selected randomly in proportion to their weight. The current
+// endpoint is returned if it is one of them. It returns an empty string if
+// there are no usable records.
+func selectSRV(records []*net.SRV, current string) string {
+	var candidates []*net.SRV
+	for _, record := range records {
+		if record.Target == "" || record.Target == "." {
+			continue // service explicitly not available at this name
+		}
+		switch {
+		case len(candidates) == 0 || record.Priority < candidates[0].Priority:
+			candidates = []*net.SRV{record}
+		case record.Priority == candidates[0].Priority:
+			candidates = append(candidates, record)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	total := 0
+	for _, c := range candidates {
+		if srvEndpoint(c) == current {
+			return current
+		}
+		total += int(c.Weight)
+	}
+	if total == 0 {
+		return srvEndpoint(candidates[rand.Intn(len(candidates))])
+	}
+	n := rand.Intn(total)
+	for _, c := range candidates {
+		if n -= int(c.Weight); n < 0 {
+			return srvEndpoint(c)
+		}
+	}
+	return srvEndpoint(candidates[len(candidates)-1])
+}
+
+func srvEndpoint(record *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+}
+
+// runDiscovery periodically resolves the records of d and keeps a client
+// running for the router they describe until ctx expires. When resolving
+// fails the current router is kept.
+func (r *RoutingTable) runDiscovery(ctx context.Context, d *routeDiscovery) {
+	var current *runningRoute
+	defer r.setDiscoveredRoute(d.name, nil)
+
+	for {
+		var endpoint string
+		if current != nil {
+			endpoint = current.router.Endpoint
+		}
+
+		router, err := d.discover(ctx, endpoint)
+		switch {
+		case err != nil:
+			routingLog.WithError(err).WithField("discovery", d.name).Warn("unable to discover router, keep current route")
+		case router == nil && current != nil:
+			routingLog.WithFields(logrus.Fields{
+				"discovery": d.name,
+				"name":      current.router.Name,
+				"endpoint":  current.router.Endpoint,
+			}).Info("discovered router removed")
+			current.stop()
+			current = nil
+			r.setDiscoveredRoute(d.name, nil)
+		case router == nil:
+			routingLog.WithField("discovery", d.name).Debug("no router discovered")
+		case current == nil || !sameDiscoveredRouter(current.router, router):
+			next := r.startRoute(ctx, router)
+			r.setDiscoveredRoute(d.name, router)
+
+			logger := routingLog.WithFields(logrus.Fields{
+				"discovery": d.name,
+				"name":      router.Name,
+				"endpoint":  router.Endpoint,
+				"regions":   router.Regions,
+			})
+			if current != nil {
+				logger = logger.WithField("previous_endpoint", current.router.Endpoint)
+				go retireDiscoveredRoute(ctx, current, next.client, d.grace)
+			}
+			logger.Info("router discovered")
+			current = next
+		}
+
+		select {
+		case <-time.After(d.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retireDiscoveredRoute stops the client of the previous route once the
+// client of its replacement is connected or the grace period has passed.
+func retireDiscoveredRoute(ctx context.Context, previous *runningRoute, next *RouterClient, grace time.Duration) {
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for atomic.LoadInt32(&next.online) == 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			routingLog.WithFields(logrus.Fields{
+				"name":     previous.router.Name,
+				"endpoint": previous.router.Endpoint,
+			}).Warn("replacement of discovered router not connected within grace period")
+			previous.stop()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+	previous.stop()
+}
+
+// setDiscoveredRoute records the router that is discovered through the
+// records with the given name, nil if there is none.
+func (r *RoutingTable) setDiscoveredRoute(name string, router *Router) {
+	r.discoveredMu.Lock()
+	defer r.discoveredMu.Unlock()
+	if router == nil {
+		delete(r.discovered, name)
+	} else {
+		r.discovered[name] = router
+	}
+}
+
+// discoveredRoutes returns the discovered routes in configuration order.
+func (r *RoutingTable) discoveredRoutes() []*Router {
+	r.discoveredMu.Lock()
+	defer r.discoveredMu.Unlock()
+
+	routes := make([]*Router, 0, len(r.discovered))
+	for _, d := range r.discovery {
+		if router, ok := r.discovered[d.name]; ok {
+			routes = append(routes, router)
+		}
+	}
+	return routes
+}
+
+func sameDiscoveredRouter(a, b *Router) bool {
+	return a.Endpoint == b.Endpoint && a.Name == b.Name && sameRegions(a.Regions, b.Regions)
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	routeLatencyAlertKind = "route_latency"
+	// routeLatencyWindow is the window over which the p95 latency is
+	// calculated when the SLOs are evaluated
+	routeLatencyWindow = time.Minute
+	// routeLatencyMaxSamples is the maximum number of samples per route
+	// within the window, older samples are dropped first
+	routeLatencyMaxSamples = 4096
+	defaultRouteLatencyFor = 5 * time.Minute
+)
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// routeLatencySLO is a latency objective for one or all routes.
+type routeLatencySLO struct {
+	// route is the name of the route, empty for all routes
+	route     string
+	threshold time.Duration
+	// duration is how long the p95 latency must exceed the threshold before
+	// an alert is raised
+	duration time.Duration
+}
+
+// routeLatencyState tracks latency samples and the SLO state of a route.
+type routeLatencyState struct {
+	samples []latencySample
+	// breachedSince is the first evaluation in the current series of
+	// evaluations in which the p95 latency exceeded the threshold
+	breachedSince time.Time
+	p95           time.Duration
+}
+
+// RouteLatencyReport describes the delivery latency of a route.
+type RouteLatencyReport struct {
+	Route string `json:"route"`
+	// Samples is the number of uplinks delivered in the last minute
+	Samples int `json:"samples"`
+	// P95Ms is the p95 delivery latency over the last minute
+	P95Ms       float64 `json:"p95Ms"`
+	ThresholdMs float64 `json:"thresholdMs,omitempty"`
+	// BreachedSince is set when the p95 latency exceeds the threshold
+	BreachedSince *time.Time `json:"breachedSince,omitempty"`
+	// Alerting is set when the threshold was exceeded longer than allowed
+	Alerting bool `json:"alerting"`
+}
+
+func newRouteLatencySLOs(cfg []ForwarderRouteLatencySLOConfig) []routeLatencySLO {
+	slos := make([]routeLatencySLO, 0, len(cfg))
+	for _, c := range cfg {
+		if c.P95 <= 0 {
+			routingLog.WithField("route", c.Route).Warn("ignore route latency SLO without p95 threshold")
+			continue
+		}
+		slo := routeLatencySLO{
+			route:     c.Route,
+			threshold: c.P95,
+			duration:  defaultRouteLatencyFor,
+		}
+		if slo.route == "*" {
+			slo.route = ""
+		}
+		if c.For != nil && *c.For >= 0 {
+			slo.duration = *c.For
+		}
+		slos = append(slos, slo)
+	}
+	return slos
+}
+
+// latencySLO returns the latency objective for the route, an objective for
+// a specific route takes precedence over an objective for all routes.
+func (t *SLOTracker) latencySLO(route string) (routeLatencySLO, bool) {
+	var (
+		found routeLatencySLO
+		ok    bool
+	)
+	for _, slo := range t.latencySLOs {
+		if slo.route == route {
+			return slo, true
+		}
+		if slo.route == "" && !ok {
+			found, ok = slo, true
+		}
+	}
+	return found, ok
+}
+
+// RecordLatency records the time between receiving an uplink from a gateway
+// and delivering it to the router.
+func (t *SLOTracker) RecordLatency(route string, latency time.Duration) {
+	uplinkDeliveryLatencyHistogram.WithLabelValues(route).Observe(latency.Seconds())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.latency[route]
+	if !ok {
+		state = new(routeLatencyState)
+		t.latency[route] = state
+	}
+	if len(state.samples) >= routeLatencyMaxSamples {
+		state.samples = state.samples[1:]
+	}
+	state.samples = append(state.samples, latencySample{at: time.Now(), latency: latency})
+}
+
+// evaluateLatency calculates the p95 delivery latency per route and raises
+// an alert for routes that exceed their threshold longer than allowed. The
+// alert is resolved when the latency drops below the threshold or when no
+// uplinks were delivered to the route within the window.
+func (t *SLOTracker) evaluateLatency(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for route, state := range t.latency {
+		from := now.Add(-routeLatencyWindow)
+		i := sort.Search(len(state.samples), func(i int) bool { return state.samples[i].at.After(from) })
+		state.samples = append(state.samples[:0], state.samples[i:]...)
+
+		if len(state.samples) == 0 {
+			delete(t.latency, route)
+			t.resolveLatencyAlert(route)
+			continue
+		}
+		state.p95 = latencyPercentile(state.samples, 0.95)
+
+		slo, ok := t.latencySLO(route)
+		if !ok {
+			continue
+		}
+		if state.p95 <= slo.threshold {
+			state.breachedSince = time.Time{}
+			t.resolveLatencyAlert(route)
+			continue
+		}
+		if state.breachedSince.IsZero() {
+			state.breachedSince = now
+		}
+		if now.Sub(state.breachedSince) >= slo.duration && t.alerter != nil {
+			t.alerter.Raise(Alert{
+				Key:      routeLatencyAlertKind + "/" + route,
+				Kind:     routeLatencyAlertKind,
+				Severity: AlertSeverityWarning,
+				Summary: fmt.Sprintf("p95 uplink delivery latency to route %s is %s, above the %s objective since %s",
+					route, state.p95.Round(time.Millisecond), slo.threshold, state.breachedSince.Format(time.RFC3339)),
+				Details: map[string]interface{}{
+					"route":         route,
+					"p95Ms":         durationMs(state.p95),
+					"thresholdMs":   durationMs(slo.threshold),
+					"samples":       len(state.samples),
+					"breachedSince": state.breachedSince,
+				},
+			})
+		}
+	}
+}
+
+func (t *SLOTracker) resolveLatencyAlert(route string) {
+	if t.alerter != nil {
+		t.alerter.Resolve(routeLatencyAlertKind + "/" + route)
+	}
+}
+
+// LatencyReports returns the delivery latency per route as calculated
+// during the last evaluation, ordered by route.
+func (t *SLOTracker) LatencyReports(now time.Time) []RouteLatencyReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports := make([]RouteLatencyReport, 0, len(t.latency))
+	for route, state := range t.latency {
+		report := RouteLatencyReport{
+			Route:   route,
+			Samples: len(state.samples),
+			P95Ms:   durationMs(state.p95),
+		}
+		if slo, ok := t.latencySLO(route); ok {
+			report.ThresholdMs = durationMs(slo.threshold)
+			if !state.breachedSince.IsZero() {
+				since := state.breachedSince
+				report.BreachedSince = &since
+				report.Alerting = now.Sub(since) >= slo.duration
+			}
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Route < reports[j].Route })
+	return reports
+}
+
+// latencyPercentile returns the p-th percentile of the sample latencies
+// using the nearest rank method.
+func latencyPercentile(samples []latencySample, p float64) time.Duration {
+	latencies := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		latencies[i] = s.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	rank := int(math.Ceil(p*float64(len(latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return latencies[rank]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
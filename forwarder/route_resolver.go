@@ -0,0 +1,419 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// routeResolver resolves the host names of router endpoints and caches the
+// results for their TTL, clamped between minTTL and maxTTL. Nameservers are
+// queried in order until one answers, without nameservers the system
+// resolver is used. When resolving fails the last resolved addresses keep
+// being used for up to staleTTL, this prevents a flaky resolver on the
+// gateway host from interrupting delivery to routers.
+type routeResolver struct {
+	nameservers []string
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	staleTTL    time.Duration
+	timeout     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	addrs []net.IP
+	// resolvedAt is when the addresses were last resolved
+	resolvedAt time.Time
+	// expires is when the addresses must be resolved again
+	expires time.Time
+}
+
+// newRouteResolver returns the resolver configured in cfg, or nil if there
+// is none and router endpoints are resolved by gRPC.
+func newRouteResolver(cfg *ForwarderRoutersResolverConfig) (*routeResolver, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	r := &routeResolver{
+		minTTL:   30 * time.Second,
+		maxTTL:   time.Hour,
+		staleTTL: 24 * time.Hour,
+		timeout:  2 * time.Second,
+		cache:    make(map[string]*resolvedHost),
+	}
+	if cfg.MinTTL != nil && *cfg.MinTTL >= 0 {
+		r.minTTL = *cfg.MinTTL
+	}
+	if cfg.MaxTTL != nil && *cfg.MaxTTL > 0 {
+		r.maxTTL = *cfg.MaxTTL
+	}
+	if cfg.StaleTTL != nil && *cfg.StaleTTL >= 0 {
+		r.staleTTL = *cfg.StaleTTL
+	}
+	if cfg.Timeout != nil && *cfg.Timeout > 0 {
+		r.timeout = *cfg.Timeout
+	}
+	if r.minTTL > r.maxTTL {
+		return nil, fmt.Errorf("resolver min_ttl %s is larger than max_ttl %s", r.minTTL, r.maxTTL)
+	}
+	for _, ns := range cfg.Nameservers {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		if host, _, _ := net.SplitHostPort(ns); net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid resolver nameserver %q, expected an IP address", ns)
+		}
+		r.nameservers = append(r.nameservers, ns)
+	}
+	return r, nil
+}
+
+// dialContext dials the router at address, its host name is resolved by the
+// resolver. Resolved addresses are tried in order until a connection is
+// established.
+func (r *routeResolver) dialContext(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// lookup returns the addresses of host.
+func (r *routeResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	cached := r.cache[host]
+	r.mu.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		routeDNSLookupsCounter.WithLabelValues("cached").Inc()
+		return cached.addrs, nil
+	}
+
+	addrs, ttl, err := r.resolve(ctx, host)
+	if err != nil {
+		if cached != nil && now.Sub(cached.resolvedAt) < r.staleTTL {
+			routeDNSLookupsCounter.WithLabelValues("stale").Inc()
+			routingLog.WithError(err).WithFields(logrus.Fields{
+				"host":        host,
+				"resolved_at": cached.resolvedAt,
+			}).Warn("unable to resolve router endpoint, use last resolved addresses")
+			return cached.addrs, nil
+		}
+		routeDNSLookupsCounter.WithLabelValues("failed").Inc()
+		return nil, fmt.Errorf("unable to resolve %s: %w", host, err)
+	}
+	routeDNSLookupsCounter.WithLabelValues("resolved").Inc()
+
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	r.mu.Lock()
+	r.cache[host] = &resolvedHost{addrs: addrs, resolvedAt: now, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// resolve resolves host and returns its addresses and their TTL. The system
+// resolver doesn't report a TTL, its results are kept for minTTL.
+func (r *routeResolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if len(r.nameservers) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs := make([]net.IP, 0, len(ipAddrs))
+		for _, a := range ipAddrs {
+			addrs = append(addrs, a.IP)
+		}
+		return addrs, r.minTTL, nil
+	}
+
+	var err error
+	for _, ns := range r.nameservers {
+		var (
+			addrs []net.IP
+			ttl   time.Duration
+		)
+		if addrs, ttl, err = r.resolveWith(ctx, ns, host); err == nil {
+			return addrs, ttl, nil
+		}
+		routingLog.WithError(err).WithFields(logrus.Fields{
+			"host":       host,
+			"nameserver": ns,
+		}).Debug("nameserver unable to resolve router endpoint, try next")
+	}
+	return nil, 0, err
+}
+
+// resolveWith resolves the IPv4 and IPv6 addresses of host with the given
+// nameserver. The returned TTL is the lowest TTL of the answers.
+func (r *routeResolver) resolveWith(ctx context.Context, nameserver, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		addrs []net.IP
+		ttl   = uint32(r.maxTTL / time.Second)
+	)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := r.query(ctx, nameserver, name, typ)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, answer := range answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]))
+			default:
+				continue
+			}
+			if answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// lookupSRV returns the SRV records with the given name. It returns no
+// records and no error when the name doesn't exist.
+func (r *routeResolver) lookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	if len(r.nameservers) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if isDNSNotFound(err) {
+			return nil, nil
+		}
+		return records, err
+	}
+
+	answers, err := r.queryNameservers(ctx, name, dnsmessage.TypeSRV)
+	if isDNSNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*net.SRV
+	for _, answer := range answers {
+		if body, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+			records = append(records, &net.SRV{
+				Target:   body.Target.String(),
+				Port:     body.Port,
+				Priority: body.Priority,
+				Weight:   body.Weight,
+			})
+		}
+	}
+	return records, nil
+}
+
+// lookupTXT returns the TXT records with the given name, the strings of a
+// record are concatenated. It returns no records and no error when the name
+// doesn't exist.
+func (r *routeResolver) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	if len(r.nameservers) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		records, err := net.DefaultResolver.LookupTXT(ctx, name)
+		if isDNSNotFound(err) {
+			return nil, nil
+		}
+		return records, err
+	}
+
+	answers, err := r.queryNameservers(ctx, name, dnsmessage.TypeTXT)
+	if isDNSNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for _, answer := range answers {
+		if body, ok := answer.Body.(*dnsmessage.TXTResource); ok {
+			records = append(records, strings.Join(body.TXT, ""))
+		}
+	}
+	return records, nil
+}
+
+// queryNameservers queries the nameservers in order until one answers. A
+// name that doesn't exist is not retried with the next nameserver.
+func (r *routeResolver) queryNameservers(ctx context.Context, host string, typ dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range r.nameservers {
+		var answers []dnsmessage.Resource
+		if answers, err = r.query(ctx, ns, name, typ); err == nil || isDNSNotFound(err) {
+			return answers, err
+		}
+		routingLog.WithError(err).WithFields(logrus.Fields{
+			"name":       host,
+			"type":       typ,
+			"nameserver": ns,
+		}).Debug("nameserver unable to answer query, try next")
+	}
+	return nil, err
+}
+
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// query sends a query for name to the nameserver and returns the answers.
+// Truncated responses are retried over TCP.
+func (r *routeResolver) query(ctx context.Context, nameserver string, name dnsmessage.Name, typ dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	resp, err := exchangeDNS(ctx, "udp", nameserver, query)
+	if err == nil && resp.Header.Truncated {
+		resp, err = exchangeDNS(ctx, "tcp", nameserver, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.ID != id {
+		return nil, fmt.Errorf("nameserver %s replied with unexpected id", nameserver)
+	}
+	if resp.Header.RCode == dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: "no such host", Name: name.String(), Server: nameserver, IsNotFound: true}
+	}
+	if resp.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("nameserver %s replied %s", nameserver, resp.Header.RCode)
+	}
+	return resp.Answers, nil
+}
+
+// exchangeDNS sends the packed query over the given network and returns the
+// response.
+func exchangeDNS(ctx context.Context, network, nameserver string, query []byte) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var resp []byte
+	if network == "tcp" {
+		// TCP messages are prefixed with their length
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, 1232)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("invalid response from nameserver %s: %w", nameserver, err)
+	}
+	return &msg, nil
+}
+
+// dnsName returns host as a fully qualified domain name.
+func dnsName(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
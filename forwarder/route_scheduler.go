@@ -0,0 +1,220 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// routeRateLimit limits the rate at which data uplinks are delivered to a
+// route.
+type routeRateLimit struct {
+	// route is the name of the route, empty for all routes
+	route string
+	// rate is the number of uplinks per second
+	rate rate.Limit
+	// burst is the number of uplinks that can be delivered at once
+	burst int
+	// queue is the maximum number of uplinks per device waiting to be
+	// delivered
+	queue int
+	// maxDelay is how long an uplink can wait in the queue before it is
+	// dropped
+	maxDelay time.Duration
+}
+
+func newRouteRateLimits(cfg []ForwarderRouteRateLimitConfig) []routeRateLimit {
+	limits := make([]routeRateLimit, 0, len(cfg))
+	for _, c := range cfg {
+		if c.Rate <= 0 {
+			continue
+		}
+		l := routeRateLimit{
+			route:    c.Route,
+			rate:     rate.Limit(c.Rate),
+			burst:    int(c.Rate),
+			queue:    8,
+			maxDelay: time.Second,
+		}
+		if c.Burst != nil && *c.Burst > 0 {
+			l.burst = *c.Burst
+		}
+		if l.burst < 1 {
+			l.burst = 1
+		}
+		if c.Queue != nil && *c.Queue > 0 {
+			l.queue = *c.Queue
+		}
+		if c.MaxDelay != nil && *c.MaxDelay > 0 {
+			l.maxDelay = *c.MaxDelay
+		}
+		if l.route == "*" {
+			l.route = ""
+		}
+		limits = append(limits, l)
+	}
+	return limits
+}
+
+// routeRateLimitFor returns the rate limit for the route, a rate limit for a
+// specific route takes precedence over a rate limit for all routes.
+func routeRateLimitFor(limits []routeRateLimit, route string) (routeRateLimit, bool) {
+	var (
+		found routeRateLimit
+		ok    bool
+	)
+	for _, l := range limits {
+		if l.route == route {
+			return l, true
+		}
+		if l.route == "" && !ok {
+			found, ok = l, true
+		}
+	}
+	return found, ok
+}
+
+// routeScheduler delivers data uplinks to a route at a limited rate. Uplinks
+// are queued per device and devices take turns, a device that floods the
+// route only fills its own queue and doesn't delay uplinks of other devices.
+type routeScheduler struct {
+	route   string
+	limit   routeRateLimit
+	limiter *rate.Limiter
+
+	mu sync.Mutex
+	// flows holds the queued uplinks per device
+	flows map[string][]queuedUplink
+	// active holds the devices with queued uplinks in the order they take
+	// turns
+	active []string
+	// notify is signalled when an uplink is queued
+	notify chan struct{}
+	out    chan *GatewayEvent
+}
+
+type queuedUplink struct {
+	ev       *GatewayEvent
+	queuedAt time.Time
+}
+
+func newRouteScheduler(route string, limit routeRateLimit) *routeScheduler {
+	return &routeScheduler{
+		route:   route,
+		limit:   limit,
+		limiter: rate.NewLimiter(limit.rate, limit.burst),
+		flows:   make(map[string][]queuedUplink),
+		notify:  make(chan struct{}, 1),
+		out:     make(chan *GatewayEvent),
+	}
+}
+
+// Push queues the uplink for delivery, it is dropped when the queue of its
+// device is full.
+func (s *routeScheduler) Push(ev *GatewayEvent) {
+	key := "proprietary"
+	if !ev.uplink.proprietary {
+		key = ev.uplink.device.String()
+	}
+
+	s.mu.Lock()
+	queue := s.flows[key]
+	if len(queue) >= s.limit.queue {
+		s.mu.Unlock()
+		routeSchedulerCounter.WithLabelValues(s.route, "queue_full").Inc()
+		return
+	}
+	if len(queue) == 0 {
+		s.active = append(s.active, key)
+	}
+	s.flows[key] = append(queue, queuedUplink{ev: ev, queuedAt: time.Now()})
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Out returns the channel on which uplinks are delivered once they are
+// allowed by the rate limit.
+func (s *routeScheduler) Out() <-chan *GatewayEvent {
+	return s.out
+}
+
+// Run delivers queued uplinks until ctx expires.
+func (s *routeScheduler) Run(ctx context.Context) {
+	for {
+		if s.pending() == 0 {
+			select {
+			case <-s.notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := s.limiter.Wait(ctx); err != nil {
+			return
+		}
+		ev := s.next(time.Now())
+		if ev == nil {
+			continue
+		}
+		select {
+		case s.out <- ev:
+			routeSchedulerCounter.WithLabelValues(s.route, "delivered").Inc()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *routeScheduler) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
+
+// next returns the first uplink of the device whose turn it is, or nil if
+// there are no queued uplinks. Uplinks that waited longer than the maximum
+// delay are dropped.
+func (s *routeScheduler) next(now time.Time) *GatewayEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.active) > 0 {
+		key := s.active[0]
+		s.active = s.active[1:]
+		queue := s.flows[key]
+		uplink := queue[0]
+		if queue = queue[1:]; len(queue) == 0 {
+			delete(s.flows, key)
+		} else {
+			s.flows[key] = queue
+			s.active = append(s.active, key)
+		}
+		if now.Sub(uplink.queuedAt) > s.limit.maxDelay {
+			routeSchedulerCounter.WithLabelValues(s.route, "expired").Inc()
+			continue
+		}
+		return uplink.ev
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+)
+
+// routeSettingsConfig holds the per route settings as configured, it is kept
+// to detect which routes are affected when the configuration changes.
+type routeSettingsConfig struct {
+	dial       []ForwarderRouteDialConfig
+	transforms []ForwarderRouteTransformConfig
+	filters    []ForwarderRouteFilterConfig
+	rateLimits []ForwarderRouteRateLimitConfig
+}
+
+func newRouteSettingsConfig(cfg ForwarderRoutersConfig) routeSettingsConfig {
+	return routeSettingsConfig{
+		dial:       cfg.Dial,
+		transforms: cfg.Transforms,
+		filters:    cfg.Filters,
+		rateLimits: cfg.RateLimits,
+	}
+}
+
+// SetRouteSettings replaces the per route dial options, transforms, filters
+// and rate limits, e.g. after the configuration is reloaded. Clients that
+// are started afterwards use them, running clients keep their settings until
+// they are restarted.
+func (r *RoutingTable) SetRouteSettings(cfg ForwarderRoutersConfig) error {
+	dialOptions, err := newRouteDialOptions(cfg.Dial)
+	if err != nil {
+		return err
+	}
+	filters, err := newPacketFilters(cfg.Filters)
+	if err != nil {
+		return err
+	}
+
+	r.routeSettingsMu.Lock()
+	defer r.routeSettingsMu.Unlock()
+
+	r.dialOptions = dialOptions
+	r.transforms = newPayloadTransforms(cfg.Transforms)
+	r.filters = filters
+	r.rateLimits = newRouteRateLimits(cfg.RateLimits)
+	r.routeSettingsCfg = newRouteSettingsConfig(cfg)
+	return nil
+}
+
+// packetFilters returns the filters that select the uplinks that are
+// delivered to the routes.
+func (r *RoutingTable) packetFilters() []packetFilter {
+	r.routeSettingsMu.RLock()
+	defer r.routeSettingsMu.RUnlock()
+	return r.filters
+}
+
+// routeConfigHash returns a hash of the router configuration and the per
+// route settings that apply to it. A running default route is restarted when
+// its hash changes.
+func (r *RoutingTable) routeConfigHash(router *Router) [sha256.Size]byte {
+	r.routeSettingsMu.RLock()
+	cfg := r.routeSettingsCfg
+	r.routeSettingsMu.RUnlock()
+
+	route := router.String()
+	// all fields are plain configuration values that can be marshalled
+	data, _ := json.Marshal(struct {
+		Router    *Router
+		Dial      *ForwarderRouteDialConfig
+		Transform *ForwarderRouteTransformConfig
+		Filter    *ForwarderRouteFilterConfig
+		RateLimit *ForwarderRouteRateLimitConfig
+	}{
+		Router:    router,
+		Dial:      routeSettingsEntry(cfg.dial, route, func(c ForwarderRouteDialConfig) string { return c.Route }),
+		Transform: routeSettingsEntry(cfg.transforms, route, func(c ForwarderRouteTransformConfig) string { return c.Route }),
+		Filter:    routeSettingsEntry(cfg.filters, route, func(c ForwarderRouteFilterConfig) string { return c.Route }),
+		RateLimit: routeSettingsEntry(cfg.rateLimits, route, func(c ForwarderRouteRateLimitConfig) string { return c.Route }),
+	})
+	return sha256.Sum256(data)
+}
+
+// routeSettingsEntry returns the entry for the route, an entry for the route
+// takes precedence over an entry for all routes. It returns nil if no entry
+// applies to the route.
+func routeSettingsEntry[T any](entries []T, route string, routeOf func(T) string) *T {
+	var found *T
+	for i := range entries {
+		switch routeOf(entries[i]) {
+		case route:
+			return &entries[i]
+		case "*", "":
+			if found == nil {
+				found = &entries[i]
+			}
+		}
+	}
+	return found
+}
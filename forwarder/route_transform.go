@@ -0,0 +1,144 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"github.com/ThingsIXFoundation/router-api/go/router"
+	"github.com/brocaar/lorawan"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	transformStrip    = "strip"
+	transformTruncate = "truncate"
+)
+
+// payloadTransform modifies the PHYPayload of data uplinks before they are
+// delivered to a route. Transformed frames carry an invalid MIC, routes that
+// receive them can't verify or decrypt the frame and are expected to only
+// use its metadata.
+type payloadTransform struct {
+	// route is the name of the route, empty for all routes
+	route string
+	// stripPayload removes the FPort and FRMPayload from the frame
+	stripPayload bool
+	// maxPayloadSize truncates the FRMPayload to this many bytes, negative
+	// to not truncate
+	maxPayloadSize int
+}
+
+func newPayloadTransforms(cfg []ForwarderRouteTransformConfig) []payloadTransform {
+	transforms := make([]payloadTransform, 0, len(cfg))
+	for _, c := range cfg {
+		t := payloadTransform{
+			route:          c.Route,
+			stripPayload:   c.StripPayload,
+			maxPayloadSize: -1,
+		}
+		if c.MaxPayloadSize != nil && *c.MaxPayloadSize >= 0 {
+			t.maxPayloadSize = *c.MaxPayloadSize
+		}
+		if !t.stripPayload && t.maxPayloadSize < 0 {
+			routingLog.WithField("route", c.Route).Warn("ignore route payload transform without transformation")
+			continue
+		}
+		if t.route == "*" {
+			t.route = ""
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms
+}
+
+// routePayloadTransform returns the payload transform for the route, a
+// transform for a specific route takes precedence over a transform for all
+// routes.
+func routePayloadTransform(transforms []payloadTransform, route string) (payloadTransform, bool) {
+	var (
+		found payloadTransform
+		ok    bool
+	)
+	for _, t := range transforms {
+		if t.route == route {
+			return t, true
+		}
+		if t.route == "" && !ok {
+			found, ok = t, true
+		}
+	}
+	return found, ok
+}
+
+// apply returns the event with the transformation applied to its uplink
+// frame. The given event is shared with other routes and is never modified,
+// if the frame is transformed a copy is returned.
+func (t payloadTransform) apply(route string, event *router.GatewayToRouterEvent) *router.GatewayToRouterEvent {
+	frame := event.GetUplinkFrameEvent().GetUplinkFrame()
+	if frame == nil {
+		return event
+	}
+	phy, transformed := transformPHYPayload(frame.GetPhyPayload(), t.stripPayload, t.maxPayloadSize)
+	if transformed == "" {
+		return event
+	}
+
+	routeTransformedFramesCounter.WithLabelValues(route, transformed).Inc()
+
+	event = proto.Clone(event).(*router.GatewayToRouterEvent)
+	event.GetUplinkFrameEvent().GetUplinkFrame().PhyPayload = phy
+	return event
+}
+
+// transformPHYPayload strips or truncates the FRMPayload of a data uplink.
+// It returns the resulting PHYPayload and the transformation that was
+// applied, or an empty string when the payload was left as is. The MIC is
+// kept but no longer matches the frame.
+func transformPHYPayload(phy []byte, strip bool, maxPayloadSize int) ([]byte, string) {
+	// MHDR(1) | DevAddr(4) | FCtrl(1) | FCnt(2) | FOpts(0..15) | FPort(0..1) | FRMPayload | MIC(4)
+	const fhdrLen = 1 + 4 + 1 + 2
+	if len(phy) < fhdrLen+4 {
+		return phy, ""
+	}
+	mtype := lorawan.MType(phy[0] >> 5)
+	if mtype != lorawan.UnconfirmedDataUp && mtype != lorawan.ConfirmedDataUp {
+		return phy, ""
+	}
+
+	foptsEnd := fhdrLen + int(phy[5]&0x0f)
+	micStart := len(phy) - 4
+	if foptsEnd >= micStart {
+		// no FPort and FRMPayload
+		return phy, ""
+	}
+
+	var (
+		end         int
+		transformed string
+	)
+	switch payloadStart := foptsEnd + 1; {
+	case strip:
+		end, transformed = foptsEnd, transformStrip
+	case maxPayloadSize >= 0 && micStart-payloadStart > maxPayloadSize:
+		end, transformed = payloadStart+maxPayloadSize, transformTruncate
+	default:
+		return phy, ""
+	}
+
+	out := make([]byte, 0, end+4)
+	out = append(out, phy[:end]...)
+	return append(out, phy[micStart:]...), transformed
+}
@@ -20,7 +20,11 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/FastFilter/xorfilter"
@@ -29,13 +33,27 @@ import (
 
 	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
 	"github.com/ThingsIXFoundation/packet-handling/forwarder/broadcast"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
 	"github.com/ThingsIXFoundation/router-api/go/router"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// errRouterConnectionDropped is returned by runConnection when the
+// connection was dropped on operator request.
+var errRouterConnectionDropped = errors.New("connection dropped on request")
+
+const (
+	// signingSchemesHeader lists the signature schemes the forwarder offers
+	// in order of preference when opening the event stream
+	signingSchemesHeader = signing.OfferHeader
+	// signingSchemeHeader holds the scheme the router selected
+	signingSchemeHeader = signing.SelectHeader
 )
 
 // RouterClient communicates with a remote router and exchanges messages
@@ -71,6 +89,254 @@ type RouterClient struct {
 	// Tracks the last time an event for a certain gateway was sent to the router
 	// this is used to send additional online events to prevent a timeout
 	lastGatewayEvent map[lorawan.EUI64]time.Time
+
+	// lastUplinkSent tracks when the last uplink or join for a gateway was
+	// sent to the router, it is used to estimate the router response latency
+	lastUplinkSent map[string]time.Time
+
+	// online is 1 when the client is connected to the router
+	online int32
+	// latency is the moving average of the router response latency in ns
+	latency int64
+	// unreachableSince is the time in unix ns since which the client is not
+	// connected to the router, 0 while connected
+	unreachableSince int64
+
+	// slo tracks uplink delivery, nil if disabled
+	slo *SLOTracker
+
+	// signingSchemes are offered to the router in order of preference
+	signingSchemes []string
+	// signingScheme holds the scheme negotiated with the router
+	signingScheme atomic.Value
+
+	// payloadStats tracks payload distributions, nil if not tracked
+	payloadStats *PayloadStats
+
+	// dial determines how the connection with the router is established
+	dial routeDialOptions
+
+	// transform modifies uplink payloads before they are sent to the
+	// router, nil if uplinks are sent as is
+	transform *payloadTransform
+
+	// rateLimit limits the rate of data uplinks delivered to the router,
+	// nil if not limited
+	rateLimit *routeRateLimit
+
+	// filter drops uplinks and join-requests that are not delivered to the
+	// router, nil if all are delivered
+	filter *packetFilter
+
+	// logIDs formats device identifiers in packet logs
+	logIDs IDObfuscator
+
+	// changed is called when the connection state or configuration of the
+	// router changes, nil if not tracked
+	changed func(RouteChangeType)
+
+	// suspended is 1 while the client stays disconnected on operator
+	// request
+	suspended int32
+	// wake is signalled when the client must reconnect without waiting for
+	// the reconnect interval
+	wake chan struct{}
+	// dropMu protects drop
+	dropMu sync.Mutex
+	// drop closes the active connection with the router, nil while not
+	// connecting or connected
+	drop context.CancelFunc
+	// draining is 1 when the router is removed and the client only
+	// delivers downlinks that are still underway until it is stopped
+	draining int32
+}
+
+// RouterClientStats describes the connection with a router.
+type RouterClientStats struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Default  bool   `json:"default"`
+	Online   bool   `json:"online"`
+	// LatencyMs is the average time between sending an uplink to the router
+	// and receiving a downlink for the same gateway, 0 if unknown
+	LatencyMs float64 `json:"latencyMs"`
+	// SigningScheme is the signature scheme negotiated with the router
+	SigningScheme string `json:"signingScheme,omitempty"`
+	// UnreachableSince is set when the client is not connected to the router
+	UnreachableSince *time.Time `json:"unreachableSince,omitempty"`
+	// Suspended is set while the client is disconnected on operator request
+	Suspended bool `json:"suspended,omitempty"`
+	// Draining is set while the client no longer receives uplinks because
+	// its router is removed from the configuration
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Stats returns the connection statistics of the client.
+func (rc *RouterClient) Stats() RouterClientStats {
+	stats := RouterClientStats{
+		ID:            rc.router.ThingsIXID.String(),
+		Name:          rc.router.String(),
+		Endpoint:      rc.router.Endpoint,
+		Default:       rc.router.Default,
+		Online:        atomic.LoadInt32(&rc.online) == 1,
+		LatencyMs:     float64(atomic.LoadInt64(&rc.latency)) / float64(time.Millisecond),
+		SigningScheme: rc.SigningScheme(),
+		Suspended:     atomic.LoadInt32(&rc.suspended) == 1,
+		Draining:      atomic.LoadInt32(&rc.draining) == 1,
+	}
+	if since, ok := rc.UnreachableSince(); ok {
+		stats.UnreachableSince = &since
+	}
+	return stats
+}
+
+// UnreachableSince returns since when the client is not connected to the
+// router. It returns false while the client is connected.
+func (rc *RouterClient) UnreachableSince() (time.Time, bool) {
+	since := atomic.LoadInt64(&rc.unreachableSince)
+	if since == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, since), true
+}
+
+// Disconnect closes the connection with the router and keeps the client
+// disconnected until Reconnect is called.
+func (rc *RouterClient) Disconnect() {
+	atomic.StoreInt32(&rc.suspended, 1)
+	rc.dropConnection()
+}
+
+// Reconnect closes the connection with the router, if any, and connects
+// again immediately. It resumes a client that was disconnected.
+func (rc *RouterClient) Reconnect() {
+	atomic.StoreInt32(&rc.suspended, 0)
+	rc.dropConnection()
+	select {
+	case rc.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// Drain stops forwarding uplinks and join-requests to the router. The
+// connection is kept so downlinks for uplinks that were already forwarded
+// are still delivered.
+func (rc *RouterClient) Drain() {
+	atomic.StoreInt32(&rc.draining, 1)
+}
+
+func (rc *RouterClient) dropConnection() {
+	rc.dropMu.Lock()
+	defer rc.dropMu.Unlock()
+	if rc.drop != nil {
+		rc.drop()
+	}
+}
+
+// SigningScheme returns the signature scheme negotiated with the router or
+// an empty string when not connected.
+func (rc *RouterClient) SigningScheme() string {
+	scheme, _ := rc.signingScheme.Load().(string)
+	return scheme
+}
+
+// negotiateSigningScheme determines the signature scheme from the scheme the
+// router selected in the stream headers. Routers that predate negotiation
+// don't select a scheme and use secp256k1. A router that selects a scheme
+// that wasn't offered can't verify receipts, the error is sent on failed and
+// the connection is closed.
+func (rc *RouterClient) negotiateSigningScheme(log *logrus.Entry, eventStream router.RouterV1_EventsClient, failed chan<- error) {
+	header, err := eventStream.Header()
+	if err != nil {
+		return
+	}
+	scheme, err := signing.Negotiate(rc.signingSchemes, header.Get(signingSchemeHeader))
+	if err != nil {
+		failed <- fmt.Errorf("unable to negotiate signature scheme: %w", err)
+		return
+	}
+	rc.signingScheme.Store(scheme)
+	log.WithField("scheme", scheme).Debug("negotiated signature scheme")
+}
+
+// signReceipt returns a copy of the uplink or join event with the airtime
+// receipt signed by the gateway in the scheme negotiated with the router.
+// The signature is sent in the rx_info metadata. Until the router selected a
+// scheme, and for gateways with an external key that only signs secp256k1,
+// receipts are signed with secp256k1, which all routers support.
+func (rc *RouterClient) signReceipt(log *logrus.Entry, gw *gateway.Gateway, event *router.GatewayToRouterEvent) (*router.GatewayToRouterEvent, error) {
+	scheme := rc.SigningScheme()
+	if scheme == "" {
+		scheme = signing.Secp256k1
+	}
+	signer, err := gw.Signer(scheme)
+	if errors.Is(err, signing.ErrUnsupportedScheme) && scheme != signing.Secp256k1 {
+		log.WithError(err).Debug("gateway key doesn't support negotiated scheme, sign receipt with secp256k1")
+		signer, err = gw.Signer(signing.Secp256k1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event = proto.Clone(event).(*router.GatewayToRouterEvent)
+	var (
+		uplink  = event.GetUplinkFrameEvent()
+		rxInfo  = uplink.GetUplinkFrame().GetRxInfo()
+		receipt = uplink.GetAirtimeReceipt()
+	)
+	if rxInfo == nil {
+		return nil, fmt.Errorf("uplink without rx info")
+	}
+	if rxInfo.Metadata == nil {
+		rxInfo.Metadata = make(map[string]string)
+	}
+	err = signing.SignReceipt(signer, rxInfo.Metadata, uplink.GetUplinkFrame().GetPhyPayload(), receipt.GetOwner(), receipt.GetAirtime())
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// recordDelivery records the uplink delivery SLI for the gateway.
+func (rc *RouterClient) recordDelivery(gatewayID lorawan.EUI64, delivered bool) {
+	if rc.slo != nil {
+		rc.slo.RecordUplink(rc.router.String(), gatewayID, delivered)
+	}
+}
+
+// recordDeliveryLatency records the time between receiving the event from
+// the gateway and delivering it to the router.
+func (rc *RouterClient) recordDeliveryLatency(ev *GatewayEvent) {
+	if rc.slo != nil && !ev.receivedAt.IsZero() {
+		rc.slo.RecordLatency(rc.router.String(), time.Since(ev.receivedAt))
+	}
+}
+
+// recordLatency updates the router response latency when a downlink for
+// the given gateway is received shortly after an uplink was sent.
+func (rc *RouterClient) recordLatency(gatewayID string, now time.Time) {
+	sent, ok := rc.lastUplinkSent[gatewayID]
+	if !ok {
+		return
+	}
+	delete(rc.lastUplinkSent, gatewayID)
+
+	// downlinks are expected within the RX windows, anything later is not
+	// a reply to the last uplink
+	latency := now.Sub(sent)
+	if latency > 5*time.Second {
+		return
+	}
+	routerRoundTripHistogram.WithLabelValues(rc.router.String()).Observe(latency.Seconds())
+
+	avg := atomic.LoadInt64(&rc.latency)
+	if avg == 0 {
+		avg = int64(latency)
+	} else {
+		avg += (int64(latency) - avg) / 8
+	}
+	atomic.StoreInt64(&rc.latency, avg)
 }
 
 // NewRouterClient create a new client that connects to a remote routers and
@@ -91,6 +357,10 @@ func NewRouterClient(router *Router,
 		gatewayEvents:         gatewayEvents,
 		routerDetails:         routerDetails,
 		lastGatewayEvent:      make(map[lorawan.EUI64]time.Time),
+		lastUplinkSent:        make(map[string]time.Time),
+		unreachableSince:      time.Now().UnixNano(),
+		logIDs:                plainIDs{},
+		wake:                  make(chan struct{}, 1),
 	}
 }
 
@@ -112,7 +382,7 @@ func (rc *RouterClient) Run(ctx context.Context) {
 			}
 			return reconnectInterval
 		}
-		log = logrus.WithFields(logrus.Fields{
+		log = routingLog.WithFields(logrus.Fields{
 			"endpoint": rc.router.Endpoint,
 			"band":     frequency_plan.FromBlockchain(rc.router.FrequencyPlan),
 			"default":  rc.router.Default,
@@ -124,7 +394,7 @@ func (rc *RouterClient) Run(ctx context.Context) {
 
 	for {
 		lastConnectAttempt = time.Now()
-		err := rc.run(ctx)
+		err := rc.runConnection(ctx)
 		if err == nil {
 			return
 		}
@@ -142,7 +412,7 @@ func (rc *RouterClient) Run(ctx context.Context) {
 			rc.router.Mask = details.Mask
 			rc.router.Owner = details.Owner
 
-			log = logrus.WithFields(logrus.Fields{
+			log = routingLog.WithFields(logrus.Fields{
 				"endpoint": rc.router.Endpoint,
 				"default":  rc.router.Default,
 			})
@@ -162,13 +432,24 @@ func (rc *RouterClient) Run(ctx context.Context) {
 			}
 		}
 
-		log.WithError(err).WithField("reconnect", reconnectInterval).Errorf("router client stopped unexpected")
+		if errors.Is(err, errRouterConnectionDropped) {
+			log.Info("router connection dropped on request")
+		} else {
+			log.WithError(err).WithField("reconnect", reconnectInterval).Errorf("router client stopped unexpected")
+		}
 		wait := true
 		retry := time.After(nextReconnectInterval())
 		for wait {
 			select {
 			case <-retry:
-				wait = false
+				// a suspended client only reconnects when woken
+				if atomic.LoadInt32(&rc.suspended) == 1 {
+					retry = nil
+				} else {
+					wait = false
+				}
+			case <-rc.wake:
+				wait = atomic.LoadInt32(&rc.suspended) == 1
 			case details := <-rc.routerDetails:
 				rc.router.Endpoint = details.Endpoint
 				rc.router.NetID = details.NetID
@@ -176,7 +457,7 @@ func (rc *RouterClient) Run(ctx context.Context) {
 				rc.router.Mask = details.Mask
 				rc.router.Owner = details.Owner
 
-				log = logrus.WithFields(logrus.Fields{
+				log = routingLog.WithFields(logrus.Fields{
 					"endpoint": rc.router.Endpoint,
 					"default":  rc.router.Default,
 				})
@@ -188,8 +469,34 @@ func (rc *RouterClient) Run(ctx context.Context) {
 	}
 }
 
+// runConnection connects with the router until ctx expires, the connection
+// fails or it is dropped on operator request.
+func (rc *RouterClient) runConnection(ctx context.Context) error {
+	if atomic.LoadInt32(&rc.suspended) == 1 {
+		return errRouterConnectionDropped
+	}
+
+	connCtx, drop := context.WithCancel(ctx)
+	defer drop()
+
+	rc.dropMu.Lock()
+	rc.drop = drop
+	rc.dropMu.Unlock()
+	defer func() {
+		rc.dropMu.Lock()
+		rc.drop = nil
+		rc.dropMu.Unlock()
+	}()
+
+	err := rc.run(connCtx)
+	if err != nil && connCtx.Err() != nil && ctx.Err() == nil {
+		return errRouterConnectionDropped
+	}
+	return err
+}
+
 func logRouterDialDetails(router *Router) {
-	log := logrus.WithFields(logrus.Fields{
+	log := routingLog.WithFields(logrus.Fields{
 		"router":   router,
 		"endpoint": router.Endpoint,
 		"default":  router.Default,
@@ -206,23 +513,17 @@ func logRouterDialDetails(router *Router) {
 
 func (rc *RouterClient) run(ctx context.Context) error {
 	var (
-		log                   = logrus.WithField("router_id", rc.router)
+		log                   = routingLog.WithField("router_id", rc.router)
 		joinFilterRenewTicker = time.NewTicker(30 * time.Minute)
 		pendingDownlinkAcks   = make(map[[32]byte]time.Time)
-		dialCtx, cancel       = context.WithTimeout(ctx, 30*time.Second)
-		kacp                  = keepalive.ClientParameters{
-			Time:                20 * time.Second, // send pings every 20 seconds if there is no activity
-			Timeout:             5 * time.Second,  // wait 5 seconds for ping ack before considering the connection dead
-			PermitWithoutStream: true,             // send pings even without active streams
-		}
+		dial                  = rc.dial
+		dialCtx, cancel       = context.WithTimeout(ctx, dial.connectTimeout)
 	)
 	defer cancel()
 	logRouterDialDetails(rc.router)
 
 	// connect to the router
-	conn, err := grpc.DialContext(dialCtx, rc.router.Endpoint,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithKeepaliveParams(kacp))
+	conn, err := grpc.DialContext(dialCtx, rc.router.Endpoint, dial.grpcDialOptions()...)
 
 	if err != nil {
 		return fmt.Errorf("unable to dial router: %w", err)
@@ -231,14 +532,24 @@ func (rc *RouterClient) run(ctx context.Context) error {
 	log.Info("router connected")
 
 	client := router.NewRouterV1Client(conn)
-	eventStream, err := client.Events(ctx)
+	eventStream, err := client.Events(metadata.AppendToOutgoingContext(ctx,
+		signingSchemesHeader, strings.Join(rc.signingSchemes, ",")))
 	if err != nil {
 		return fmt.Errorf("unable to open bi-directional event stream with router: %w", err)
 	}
-
-	// subscribe to message from the packet exchange
-	fromGateway := make(chan *GatewayEvent)
-	rc.gatewayEvents.Subscribe(fromGateway)
+	// routers send headers with their first event, don't block on it
+	negotiationFailed := make(chan error, 1)
+	go rc.negotiateSigningScheme(log, eventStream, negotiationFailed)
+	defer rc.signingScheme.Store("")
+
+	// subscribe to message from the packet exchange, join-requests are
+	// received on a separate channel so they can be handled before pending
+	// data uplinks
+	var (
+		fromGateway      = make(chan *GatewayEvent)
+		fromGatewayJoins = make(chan *GatewayEvent, 64)
+	)
+	rc.gatewayEvents.SubscribeWithPriority(fromGateway, fromGatewayJoins)
 
 	// unsubscribe on disconnect
 	defer rc.gatewayEvents.Unsubscribe(fromGateway)
@@ -261,12 +572,58 @@ func (rc *RouterClient) run(ctx context.Context) error {
 	log.Trace("start router message exchange")
 	routersOnlineGauge.WithLabelValues(rc.router.String()).Set(1)
 	defer routersOnlineGauge.WithLabelValues(rc.router.String()).Set(0)
+	atomic.StoreInt32(&rc.online, 1)
+	atomic.StoreInt64(&rc.unreachableSince, 0)
+	rc.notifyChange(RouteOnline)
+	defer func() {
+		atomic.StoreInt32(&rc.online, 0)
+		atomic.StoreInt64(&rc.unreachableSince, time.Now().UnixNano())
+		rc.notifyChange(RouteOffline)
+	}()
 
 	// Get the JoinFilter now and update it later every joinFilterRenewInterval
 	go rc.updateJoinFilter(ctx, client)
 
+	// data uplinks are delivered through the scheduler when the router is
+	// rate limited, a nil channel is never ready
+	var (
+		scheduler    *routeScheduler
+		fromSchedule <-chan *GatewayEvent
+	)
+	if rc.rateLimit != nil {
+		schedulerCtx, cancelScheduler := context.WithCancel(ctx)
+		defer cancelScheduler()
+		scheduler = newRouteScheduler(rc.router.String(), *rc.rateLimit)
+		fromSchedule = scheduler.Out()
+		go scheduler.Run(schedulerCtx)
+	}
+
 	for {
+		// join-requests take precedence over all other events
+		select {
+		case ev := <-fromGatewayJoins:
+			if !rc.accepts(ev) {
+				continue
+			}
+			if err := rc.forwardJoin(log, eventStream, ev); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+
 		select {
+		case ev := <-fromGatewayJoins:
+			if !rc.accepts(ev) {
+				continue
+			}
+			if err := rc.forwardJoin(log, eventStream, ev); err != nil {
+				return err
+			}
+		case ev := <-fromSchedule:
+			if err := rc.forwardUplink(log, eventStream, ev); err != nil {
+				return err
+			}
 		case <-pendingDownlinkAcksTicker.C:
 			// delete expired pending downlink acks
 			deadline := time.Now().Add(-pendingDownlinkAckDeadline)
@@ -284,6 +641,7 @@ func (rc *RouterClient) run(ctx context.Context) error {
 			rc.router.Mask = details.Mask
 			rc.router.Owner = details.Owner
 			rc.router.FrequencyPlan = details.FrequencyPlan
+			rc.notifyChange(RouteUpdated)
 
 			if reconnect {
 				log.WithField("new-endpoint", rc.router.Endpoint).Info("reconnect router on new endpoint")
@@ -291,63 +649,28 @@ func (rc *RouterClient) run(ctx context.Context) error {
 			}
 		case ev, ok := <-fromGateway:
 			if ok {
-				if ev.IsUplink() {
-					// send event if router is interested in it
-					if rc.router.InterestedIn(ev.uplink.device) {
-						pktlog := log.WithFields(logrus.Fields{
-							"dev_addr":      ev.uplink.device,
-							"gw_network_id": ev.receivedFrom.NetworkID,
-							"gw_local_id":   ev.receivedFrom.LocalID,
-							"uplink_id":     ev.uplink.event.GetUplinkFrameEvent().UplinkFrame.GetRxInfo().GetUplinkId(),
-						})
-
-						rxPacketsPerRouterCounter.WithLabelValues(ev.receivedFrom.NetworkID.String(), ev.receivedFrom.LocalID.String(), rc.router.String()).Inc()
-
-						var (
-							owner   = rc.router.Owner
-							airtime = time.Duration(ev.uplink.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime()) * time.Millisecond
-						)
-						if rc.router.AllowAirtime(owner, airtime) {
-							if err := eventStream.Send(ev.uplink.event); err != nil {
-								return fmt.Errorf("unable to send event to router: %w", err)
-							}
+				if ev.IsOnlineOfflineEvent() && !rc.router.ServesRegion(ev.region) {
+					// gateway operates in a region this router doesn't serve
+					continue
+				}
 
-							// Update the last gateway event because an event was successfully sent
-							rc.lastGatewayEvent[ev.receivedFrom.NetworkID] = time.Now()
+				if (ev.IsUplink() || ev.IsJoin()) && !rc.accepts(ev) {
+					continue
+				}
 
-							pktlog.Info("forwarded uplink packet to router")
-						} else {
-							pktlog.Warn("accounting prevents forwarding uplink packet to router, drop packet")
+				if ev.IsUplink() {
+					if scheduler != nil {
+						// only uplinks the router is interested in take
+						// up its rate limit
+						if rc.router.interest(ev) == routeForward {
+							scheduler.Push(ev)
 						}
+					} else if err := rc.forwardUplink(log, eventStream, ev); err != nil {
+						return err
 					}
 				} else if ev.IsJoin() {
-					// send event if router is accepts the join request
-					if rc.router.AcceptsJoin(ev.join.devEUI) {
-						pktlog := log.WithFields(logrus.Fields{
-							"dev_eui":       ev.join.devEUI,
-							"gw_network_id": ev.receivedFrom.NetworkID,
-							"gw_local_id":   ev.receivedFrom.LocalID,
-							"uplink_id":     ev.join.event.GetUplinkFrameEvent().UplinkFrame.GetRxInfo().GetUplinkId(),
-						})
-
-						rxPacketsPerRouterCounter.WithLabelValues(ev.receivedFrom.NetworkID.String(), ev.receivedFrom.LocalID.String(), rc.router.String()).Inc()
-
-						var (
-							owner   = rc.router.Owner
-							airtime = time.Duration(ev.join.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime()) * time.Millisecond
-						)
-						if rc.router.AllowAirtime(owner, airtime) {
-							if err := eventStream.Send(ev.join.event); err != nil {
-								return fmt.Errorf("unable to send event to router: %w", err)
-							}
-
-							// Update the last gateway event because an event was successfully sent
-							rc.lastGatewayEvent[ev.receivedFrom.NetworkID] = time.Now()
-
-							pktlog.Info("forwarded join packet to router")
-						} else {
-							pktlog.Warn("accounting prevents forwarding join packet to router, drop packet")
-						}
+					if err := rc.forwardJoin(log, eventStream, ev); err != nil {
+						return err
 					}
 				} else if ev.IsDownlinkAck() {
 					downlinkID := sha256.Sum256(binary.BigEndian.AppendUint32(rc.router.ThingsIXID[:], ev.downlinkAck.downlinkID))
@@ -396,6 +719,8 @@ func (rc *RouterClient) run(ctx context.Context) error {
 					}
 				}
 			}
+		case err := <-negotiationFailed:
+			return err
 		case event, ok := <-fromRouter:
 			if !ok {
 				return fmt.Errorf("connection with router lost")
@@ -416,6 +741,7 @@ func (rc *RouterClient) run(ctx context.Context) error {
 				downlinkID := sha256.Sum256(binary.BigEndian.AppendUint32(rc.router.ThingsIXID[:], downlinkEvent.GetDownlinkFrame().GetDownlinkId()))
 				log.WithField("downlink_id", fmt.Sprintf("%x", downlinkID[:8])).Info("received downlink from router")
 				pendingDownlinkAcks[downlinkID] = time.Now()
+				rc.recordLatency(downlinkEvent.GetDownlinkFrame().GetGatewayId(), time.Now())
 			}
 			rc.routerEvents <- &NetworkEvent{
 				source: rc.router,
@@ -455,12 +781,127 @@ func (rc *RouterClient) run(ctx context.Context) error {
 	}
 }
 
+// notifyChange reports a change of the router or its connection state.
+func (rc *RouterClient) notifyChange(typ RouteChangeType) {
+	if rc.changed != nil {
+		rc.changed(typ)
+	}
+}
+
+// forwardJoin sends the join-request event to the router when the router
+// accepts it.
+func (rc *RouterClient) forwardJoin(log *logrus.Entry, eventStream router.RouterV1_EventsClient, ev *GatewayEvent) error {
+	// send event if router is accepts the join request
+	if decision := rc.router.route(ev); decision.interested() {
+		pktlog := log.WithFields(logrus.Fields{
+			"dev_eui":       rc.logIDs.DevEUI(ev.join.devEUI),
+			"gw_network_id": ev.receivedFrom.NetworkID,
+			"gw_local_id":   ev.receivedFrom.LocalID,
+			"uplink_id":     ev.join.event.GetUplinkFrameEvent().UplinkFrame.GetRxInfo().GetUplinkId(),
+			"packet_id":     uplinkPacketID(ev.join.event.GetUplinkFrameEvent().GetUplinkFrame()),
+			"airtime_ms":    ev.join.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime(),
+		})
+
+		gatewayCounter(rxPacketsPerRouterCounter, ev.receivedFrom.NetworkID, ev.receivedFrom.LocalID, rc.router.String()).Inc()
+
+		if decision == routeForward {
+			event, err := rc.signReceipt(pktlog, ev.receivedFrom, ev.join.event)
+			if err != nil {
+				pktlog.WithError(err).Warn("unable to sign airtime receipt, drop packet")
+				return nil
+			}
+			span := startDeliverySpan(event.GetUplinkFrameEvent().GetUplinkFrame(), rc.router.String())
+			if err := eventStream.Send(event); err != nil {
+				endSpan(span, err)
+				rc.recordDelivery(ev.receivedFrom.NetworkID, false)
+				return fmt.Errorf("unable to send event to router: %w", err)
+			}
+			endSpan(span, nil)
+			rc.recordDelivery(ev.receivedFrom.NetworkID, true)
+			rc.recordDeliveryLatency(ev)
+
+			// Update the last gateway event because an event was successfully sent
+			rc.lastGatewayEvent[ev.receivedFrom.NetworkID] = time.Now()
+			rc.lastUplinkSent[ev.receivedFrom.NetworkID.String()] = time.Now()
+
+			pktlog.Info("forwarded join packet to router")
+		} else {
+			pktlog.WithError(decision.err()).Warn("accounting prevents forwarding join packet to router, drop packet")
+		}
+	}
+	return nil
+}
+
+// forwardUplink sends the data uplink to the router if it is interested in
+// it and accounting allows it.
+func (rc *RouterClient) forwardUplink(log *logrus.Entry, eventStream router.RouterV1_EventsClient, ev *GatewayEvent) error {
+	// send event if router is interested in it
+	if decision := rc.router.route(ev); decision.interested() {
+		pktlog := log.WithFields(logrus.Fields{
+			"dev_addr":      rc.logIDs.DevAddr(ev.uplink.device),
+			"gw_network_id": ev.receivedFrom.NetworkID,
+			"gw_local_id":   ev.receivedFrom.LocalID,
+			"uplink_id":     ev.uplink.event.GetUplinkFrameEvent().UplinkFrame.GetRxInfo().GetUplinkId(),
+			"packet_id":     uplinkPacketID(ev.uplink.event.GetUplinkFrameEvent().GetUplinkFrame()),
+			"airtime_ms":    ev.uplink.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime(),
+		})
+
+		gatewayCounter(rxPacketsPerRouterCounter, ev.receivedFrom.NetworkID, ev.receivedFrom.LocalID, rc.router.String()).Inc()
+
+		if decision == routeForward {
+			event := ev.uplink.event
+			if rc.transform != nil {
+				event = rc.transform.apply(rc.router.String(), event)
+			}
+			event, err := rc.signReceipt(pktlog, ev.receivedFrom, event)
+			if err != nil {
+				pktlog.WithError(err).Warn("unable to sign airtime receipt, drop packet")
+				return nil
+			}
+			span := startDeliverySpan(event.GetUplinkFrameEvent().GetUplinkFrame(), rc.router.String())
+			if err := eventStream.Send(event); err != nil {
+				endSpan(span, err)
+				rc.recordDelivery(ev.receivedFrom.NetworkID, false)
+				return fmt.Errorf("unable to send event to router: %w", err)
+			}
+			endSpan(span, nil)
+			rc.recordDelivery(ev.receivedFrom.NetworkID, true)
+			rc.recordDeliveryLatency(ev)
+			if rc.payloadStats != nil {
+				rc.payloadStats.RecordRouter(rc.router.String(), event.GetUplinkFrameEvent().GetUplinkFrame())
+			}
+
+			// Update the last gateway event because an event was successfully sent
+			rc.lastGatewayEvent[ev.receivedFrom.NetworkID] = time.Now()
+			rc.lastUplinkSent[ev.receivedFrom.NetworkID.String()] = time.Now()
+
+			pktlog.Info("forwarded uplink packet to router")
+		} else {
+			pktlog.WithError(decision.err()).Warn("accounting prevents forwarding uplink packet to router, drop packet")
+		}
+	}
+	return nil
+}
+
+// accepts returns an indication if the uplink or join-request passes the
+// packet filter of the router. A draining client accepts nothing.
+func (rc *RouterClient) accepts(ev *GatewayEvent) bool {
+	if atomic.LoadInt32(&rc.draining) == 1 {
+		return false
+	}
+	if rc.filter == nil || rc.filter.accepts(ev) {
+		return true
+	}
+	filteredUplinksCounter.WithLabelValues(rc.router.String(), packetFilterFrameType(ev)).Inc()
+	return false
+}
+
 func (rc *RouterClient) updateJoinFilter(ctx context.Context, client router.RouterV1Client) {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
 	resp, err := client.JoinFilter(ctx, &router.JoinFilterRequest{})
 	if err != nil {
-		logrus.WithError(err).WithField("router", rc.router).Error("error while updating JoinFilter for router")
+		routingLog.WithError(err).WithField("router", rc.router).Error("error while updating JoinFilter for router")
 		return
 	}
 
@@ -471,7 +912,7 @@ func (rc *RouterClient) updateJoinFilter(ctx context.Context, client router.Rout
 		bitmap = roaring64.New()
 		err := bitmap.UnmarshalBinary(resp.JoinFilter.RoaringBitmap)
 		if err != nil {
-			logrus.WithError(err).WithField("router", rc.router).Error("error while updating JoinFilter for router")
+			routingLog.WithError(err).WithField("router", rc.router).Error("error while updating JoinFilter for router")
 			return
 		}
 	} else if resp.GetJoinFilter().GetXor8() != nil {
@@ -484,9 +925,9 @@ func (rc *RouterClient) updateJoinFilter(ctx context.Context, client router.Rout
 
 	rc.router.SetJoinFilter(filter, bitmap)
 	if bitmap != nil {
-		logrus.WithField("router", rc.router).Infof("updated the JoinFilter with bitmap with %d items", bitmap.GetCardinality())
+		routingLog.WithField("router", rc.router).Infof("updated the JoinFilter with bitmap with %d items", bitmap.GetCardinality())
 	} else if filter != nil {
-		logrus.WithField("router", rc.router).Infof("updated the JoinFilter with %d fingerprints", len(filter.Fingerprints))
+		routingLog.WithField("router", rc.router).Infof("updated the JoinFilter with %d fingerprints", len(filter.Fingerprints))
 	}
 }
 
@@ -505,7 +946,7 @@ func routerEventsChan(events router.RouterV1_EventsClient) <-chan *router.Router
 			case codes.Canceled, codes.Unavailable, codes.Unknown:
 				return
 			default:
-				logrus.WithError(err).WithFields(logrus.Fields{
+				routingLog.WithError(err).WithFields(logrus.Fields{
 					"status": statusCode.String(),
 				}).Error("unable to receive router message")
 			}
@@ -0,0 +1,157 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
+	"github.com/ThingsIXFoundation/router-api/go/router"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+)
+
+// recordingEventStream records the events that are sent to the router.
+type recordingEventStream struct {
+	router.RouterV1_EventsClient
+	header metadata.MD
+	sent   []*router.GatewayToRouterEvent
+}
+
+func (s *recordingEventStream) Send(event *router.GatewayToRouterEvent) error {
+	s.sent = append(s.sent, event)
+	return nil
+}
+
+func (s *recordingEventStream) Header() (metadata.MD, error) {
+	return s.header, nil
+}
+
+func TestRouterReceivesSignedReceipt(t *testing.T) {
+	key, err := crypto.HexToECDSA(strings.Repeat("0", 63) + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gtw, err := gateway.NewGateway(lorawan.EUI64{0x00, 0x16, 0xc0, 0x01, 0xff, 0x10, 0xa2, 0x35}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phy := lorawan.PHYPayload{
+		MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataUp, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: lorawan.DevAddr{0x26, 0x01, 0x1b, 0xda}}},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := &gw.UplinkFrame{
+		PhyPayload: phyBytes,
+		RxInfo:     &gw.UplinkRxInfo{GatewayId: gtw.NetworkID.String()},
+	}
+	ev, err := newUplinkGatewayEvent(gtw, frequency_plan.EU868, &phy, frame, 41*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		accounter = &budgetAccounter{remaining: make(map[common.Address]time.Duration)}
+		rt        = NewRouter([32]byte{}, "", true, lorawan.NetID{}, 0, 0, 0, common.Address{}, accounter)
+		rc        = &RouterClient{
+			router:           rt,
+			logIDs:           plainIDs{},
+			lastGatewayEvent: make(map[lorawan.EUI64]time.Time),
+			lastUplinkSent:   make(map[string]time.Time),
+		}
+		log = logrus.NewEntry(logrus.StandardLogger())
+	)
+
+	for negotiated, expected := range map[string]string{
+		"":                signing.Secp256k1, // not negotiated yet
+		signing.Ed25519:   signing.Ed25519,
+		signing.Secp256k1: signing.Secp256k1,
+	} {
+		rc.signingScheme.Store(negotiated)
+		stream := &recordingEventStream{}
+		if err := rc.forwardUplink(log, stream, ev); err != nil {
+			t.Fatal(err)
+		}
+		if len(stream.sent) != 1 {
+			t.Fatalf("negotiated %q: expected 1 event sent to router, got %d", negotiated, len(stream.sent))
+		}
+
+		var (
+			received = stream.sent[0].GetUplinkFrameEvent()
+			md       = received.GetUplinkFrame().GetRxInfo().GetMetadata()
+			receipt  = received.GetAirtimeReceipt()
+		)
+		if md[signing.ReceiptSchemeMetadata] != expected {
+			t.Errorf("negotiated %q: receipt signed with %q, expected %q", negotiated, md[signing.ReceiptSchemeMetadata], expected)
+		}
+		signed, err := signing.VerifyReceipt(gtw.CompressedPubKeyBytes(), md, received.GetUplinkFrame().GetPhyPayload(), receipt.GetOwner(), receipt.GetAirtime())
+		if !signed || err != nil {
+			t.Errorf("negotiated %q: router rejects receipt: signed=%v, err=%v", negotiated, signed, err)
+		}
+		if _, err := signing.VerifyReceipt(gtw.CompressedPubKeyBytes(), md, received.GetUplinkFrame().GetPhyPayload(), receipt.GetOwner(), receipt.GetAirtime()+1); err == nil {
+			t.Errorf("negotiated %q: receipt with other airtime accepted", negotiated)
+		}
+	}
+
+	// the event is shared with other router clients and must not be signed
+	if len(frame.GetRxInfo().GetMetadata()) != 0 {
+		t.Errorf("shared event modified: %v", frame.GetRxInfo().GetMetadata())
+	}
+}
+
+func TestNegotiateSigningScheme(t *testing.T) {
+	rc := &RouterClient{signingSchemes: signing.Schemes()}
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	failed := make(chan error, 1)
+	rc.negotiateSigningScheme(log, &recordingEventStream{header: metadata.Pairs(signingSchemeHeader, signing.Ed25519)}, failed)
+	if scheme := rc.SigningScheme(); scheme != signing.Ed25519 {
+		t.Errorf("expected %s, got %q", signing.Ed25519, scheme)
+	}
+
+	rc.signingScheme.Store("")
+	rc.negotiateSigningScheme(log, &recordingEventStream{header: metadata.MD{}}, failed)
+	if scheme := rc.SigningScheme(); scheme != signing.Secp256k1 {
+		t.Errorf("router without negotiation: expected %s, got %q", signing.Secp256k1, scheme)
+	}
+
+	rc.signingScheme.Store("")
+	rc.negotiateSigningScheme(log, &recordingEventStream{header: metadata.Pairs(signingSchemeHeader, "rsa")}, failed)
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("expected negotiation error")
+		}
+	default:
+		t.Error("router selecting a scheme that wasn't offered must fail the connection")
+	}
+	if scheme := rc.SigningScheme(); scheme != "" {
+		t.Errorf("failed negotiation stored scheme %q", scheme)
+	}
+}
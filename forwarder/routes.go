@@ -18,13 +18,19 @@ package forwarder
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/errs"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 
 	"github.com/FastFilter/xorfilter"
@@ -82,6 +88,9 @@ type Router struct {
 	Owner common.Address
 	// FrequencyPlan is the frequency plan this router is registered for
 	FrequencyPlan frequency_plan.BlockchainFrequencyPlan
+	// Regions is an optional set of regions a default router wants to
+	// receive traffic for, if empty it receives traffic from all regions
+	Regions []frequency_plan.BandName
 
 	joinFilterMutex sync.RWMutex
 	// JoinFilter is the filter of devices that are allowed to join the network this router is part of
@@ -160,6 +169,89 @@ func (r *Router) AcceptsJoin(devEUI lorawan.EUI64) bool {
 	return false
 }
 
+// routeDecision is the outcome of offering an uplink or join to a router.
+type routeDecision string
+
+const (
+	// routeForward indicates the event must be sent to the router
+	routeForward routeDecision = "forward"
+	// routeRegionNotServed indicates the gateway operates in a region the
+	// router doesn't serve
+	routeRegionNotServed routeDecision = "region_not_served"
+	// routeNotInterested indicates the router has no interest in the device
+	routeNotInterested routeDecision = "not_interested"
+	// routeAccountingDenied indicates the router is interested in the event
+	// but accounting doesn't allow it to receive the airtime
+	routeAccountingDenied routeDecision = "accounting_denied"
+)
+
+// interested returns an indication if the router wants to receive the event,
+// regardless if accounting allows it.
+func (d routeDecision) interested() bool {
+	return d == routeForward || d == routeAccountingDenied
+}
+
+// err returns the error kind that describes why the event is not forwarded,
+// or nil if it is forwarded.
+func (d routeDecision) err() error {
+	switch d {
+	case routeForward:
+		return nil
+	case routeAccountingDenied:
+		return errs.ErrUnpaidRouter
+	default:
+		return errs.ErrNoRoute
+	}
+}
+
+// route decides if the uplink or join in ev must be forwarded to the router.
+// When the router is interested the airtime is charged to the router owner
+// through accounting.
+func (r *Router) route(ev *GatewayEvent) routeDecision {
+	if decision := r.interest(ev); decision != routeForward {
+		return decision
+	}
+
+	var airtime uint32
+	if ev.IsUplink() {
+		airtime = ev.uplink.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime()
+	} else {
+		airtime = ev.join.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime()
+	}
+
+	if !r.AllowAirtime(r.Owner, time.Duration(airtime)*time.Millisecond) {
+		return routeAccountingDenied
+	}
+	return routeForward
+}
+
+// interest decides if the router is interested in the uplink or join in ev,
+// without charging accounting. It returns routeForward if the router is
+// interested.
+func (r *Router) interest(ev *GatewayEvent) routeDecision {
+	if !r.ServesRegion(ev.region) {
+		return routeRegionNotServed
+	}
+
+	switch {
+	case ev.IsUplink():
+		interested := r.InterestedIn(ev.uplink.device)
+		if ev.uplink.proprietary {
+			interested = r.Default
+		}
+		if !interested {
+			return routeNotInterested
+		}
+	case ev.IsJoin():
+		if !r.AcceptsJoin(ev.join.devEUI) {
+			return routeNotInterested
+		}
+	default:
+		return routeNotInterested
+	}
+	return routeForward
+}
+
 // RoutingTable takes care of the communication between the Packet Exchange and
 // external routers. Received data from the packet exchange is routed to routers
 // that have expressed interest in it.
@@ -193,11 +285,209 @@ type RoutingTable struct {
 
 	// defaultRoutes contains the set of default routers, these are configured
 	// locally and always get send all data that is received from the gateways.
-	// These routers don't have to be registered in ThingsIX.
+	// These routers don't have to be registered in ThingsIX. They are
+	// replaced when the configuration is reloaded and protected by routesMu.
 	defaultRoutes []*Router
+	// drainPeriod is how long the client of a default router that is
+	// removed from the configuration keeps delivering downlinks
+	drainPeriod time.Duration
 
 	// gatewayStore provides access to the gateway store.
 	gatewayStore gateway.GatewayStore
+
+	// routesMu protects routes
+	routesMu sync.RWMutex
+	// routes holds the last successful fetched set of registered routers
+	routes []*Router
+
+	// clients holds the running router clients
+	clients sync.Map
+
+	// managedMu protects runCtx, managed and static
+	managedMu sync.Mutex
+	// runCtx is the context the routing table runs in, nil when not started
+	runCtx context.Context
+	// managed holds the default routes that are added through the API
+	managed map[string]*managedRoute
+	// static holds the running default routes by defaultRouteKey
+	static map[string]*runningRoute
+
+	// discovery discovers default routes through DNS
+	discovery []*routeDiscovery
+	// discoveredMu protects discovered
+	discoveredMu sync.Mutex
+	// discovered holds the routes that are currently discovered by name of
+	// their discovery
+	discovered map[string]*Router
+
+	// slo tracks uplink delivery to routers, nil if disabled
+	slo *SLOTracker
+
+	// signingSchemes are offered to routers in order of preference
+	signingSchemes []string
+
+	// payloadStats tracks payload distributions per router
+	payloadStats *PayloadStats
+
+	// logIDs formats device identifiers in packet logs
+	logIDs IDObfuscator
+
+	// staleRouteTTL is how long a registered router can be unreachable
+	// before its client is stopped, 0 to retry unreachable routers forever
+	staleRouteTTL time.Duration
+
+	// routeSettingsMu protects the per route settings below, they are
+	// replaced when the configuration is reloaded
+	routeSettingsMu sync.RWMutex
+	// routeSettingsCfg holds the per route settings as configured
+	routeSettingsCfg routeSettingsConfig
+	// transforms modify uplink payloads before delivery to a route
+	transforms []payloadTransform
+	// filters select the uplinks that are delivered to a route
+	filters []packetFilter
+	// rateLimits limit the rate of data uplinks delivered to a route
+	rateLimits []routeRateLimit
+	// dialOptions determine how connections with routes are established
+	dialOptions []routeDialOptions
+	// resolver resolves router endpoints, nil to let gRPC resolve them
+	resolver *routeResolver
+
+	// bootstrapRoutes are used until the ThingsIX routers are fetched for
+	// the first time, nil if there is no usable embedded router set
+	bootstrapRoutes []*Router
+
+	// routeChanges emits changes in the set of router clients and their
+	// connection state
+	routeChanges *broadcast.Broadcaster[*RouteChangeEvent]
+	// routeChangeSeq is the sequence number of the last route change
+	routeChangeSeq uint64
+}
+
+// runningRoute is a route with a client that is started outside the
+// routing table updates, e.g. a default or discovered route.
+type runningRoute struct {
+	router *Router
+	client *RouterClient
+	stop   context.CancelFunc
+	// configHash is the hash of the route configuration the client was
+	// started with
+	configHash [sha256.Size]byte
+}
+
+// startRoute starts a client for the router that runs until ctx expires or
+// the route is stopped.
+func (r *RoutingTable) startRoute(ctx context.Context, router *Router) *runningRoute {
+	ctx, cancel := context.WithCancel(ctx)
+	ignore := make(chan *RouterDetails) // these routes are replaced, never updated
+	client := NewRouterClient(router, r.routesTableBroadcaster, r.networkEvents, r.gatewayEvents, ignore)
+	go r.runClient(ctx, client)
+	return &runningRoute{router: router, client: client, stop: cancel, configHash: r.routeConfigHash(router)}
+}
+
+// runClient runs the router client until ctx expires and keeps track of it
+// while it runs.
+func (r *RoutingTable) runClient(ctx context.Context, client *RouterClient) {
+	client.slo = r.slo
+	client.signingSchemes = r.signingSchemes
+	client.payloadStats = r.payloadStats
+	r.routeSettingsMu.RLock()
+	client.dial = routeDial(r.dialOptions, client.router.String())
+	client.dial.resolver = r.resolver
+	if transform, ok := routePayloadTransform(r.transforms, client.router.String()); ok {
+		client.transform = &transform
+	}
+	if filter, ok := routePacketFilter(r.filters, client.router.String()); ok {
+		client.filter = &filter
+	}
+	if limit, ok := routeRateLimitFor(r.rateLimits, client.router.String()); ok {
+		client.rateLimit = &limit
+	}
+	r.routeSettingsMu.RUnlock()
+	if r.logIDs != nil {
+		client.logIDs = r.logIDs
+	}
+	client.changed = func(typ RouteChangeType) { r.publishRouteChange(typ, client) }
+	r.clients.Store(client, struct{}{})
+	r.publishRouteChange(RouteAdded, client)
+	defer func() {
+		r.clients.Delete(client)
+		r.publishRouteChange(RouteRemoved, client)
+	}()
+	client.Run(ctx)
+}
+
+// RouterClients returns the statistics of the running router clients.
+func (r *RoutingTable) RouterClients() []RouterClientStats {
+	stats := make([]RouterClientStats, 0)
+	r.clients.Range(func(key, _ interface{}) bool {
+		stats = append(stats, key.(*RouterClient).Stats())
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// DisconnectRouter disconnects from the router with the given id and stays
+// disconnected until ReconnectRouter is called.
+func (r *RoutingTable) DisconnectRouter(id string) error {
+	client, ok := r.routerClient(id)
+	if !ok {
+		return ErrRouterNotFound
+	}
+	client.Disconnect()
+	routingLog.WithField("router_id", client.router).Info("router disconnected on request")
+	return nil
+}
+
+// ReconnectRouter drops the connection with the router with the given id and
+// connects again immediately.
+func (r *RoutingTable) ReconnectRouter(id string) error {
+	client, ok := r.routerClient(id)
+	if !ok {
+		return ErrRouterNotFound
+	}
+	client.Reconnect()
+	routingLog.WithField("router_id", client.router).Info("router reconnect requested")
+	return nil
+}
+
+// routerClient returns the running client for the router with the given id
+// or name. Default routers share the same id and are found by name.
+func (r *RoutingTable) routerClient(id string) (*RouterClient, bool) {
+	var found *RouterClient
+	r.clients.Range(func(key, _ interface{}) bool {
+		client := key.(*RouterClient)
+		registered := client.router.ThingsIXID != ID{}
+		if (registered && strings.EqualFold(client.router.ThingsIXID.String(), id)) || client.router.String() == id {
+			found = client
+		}
+		return found == nil
+	})
+	return found, found != nil
+}
+
+// anyRouterOnline returns an indication if at least one router client is
+// connected to its router.
+func (r *RoutingTable) anyRouterOnline() bool {
+	online := false
+	r.clients.Range(func(key, _ interface{}) bool {
+		online = atomic.LoadInt32(&key.(*RouterClient).online) == 1
+		return !online
+	})
+	return online
+}
+
+// Routes returns the default, managed and discovered routers followed by the
+// last fetched set of routers that are registered in ThingsIX.
+func (r *RoutingTable) Routes() []*Router {
+	r.routesMu.RLock()
+	defer r.routesMu.RUnlock()
+
+	routes := make([]*Router, 0, len(r.defaultRoutes)+len(r.routes))
+	routes = append(routes, r.defaultRoutes...)
+	routes = append(routes, r.managedRoutes()...)
+	routes = append(routes, r.discoveredRoutes()...)
+	return append(routes, r.routes...)
 }
 
 // Run starts the integration with the routers on the ThingsIX network until the
@@ -213,13 +503,34 @@ func (r *RoutingTable) Run(ctx context.Context) {
 	// events for router clients are broadcasted over this event channel.
 	r.routesTableBroadcaster.Run()
 
+	r.managedMu.Lock()
+	r.runCtx = ctx
+	r.managedMu.Unlock()
+
 	// wait for routing table updates and forward them to the router clients or
-	// start/stop clients in case of new routers/deleted routers.
-	go r.keepRouteTableUpToDate(ctx)
+	// start/stop clients in case of new routers/deleted routers. Subscribe
+	// before routes are broadcasted to ensure the first set isn't missed.
+	newRoutes := make(chan []*Router)
+	r.routesTableBroadcaster.Subscribe(newRoutes)
+	go r.keepRouteTableUpToDate(ctx, newRoutes)
 
 	// run router clients to default configured routers
 	go r.runDefaultRouting(ctx)
 
+	// discover default routers through DNS
+	for _, d := range r.discovery {
+		go r.runDiscovery(ctx, d)
+	}
+
+	// connect to the routers from the embedded router set while the
+	// ThingsIX routers are fetched for the first time
+	if len(r.bootstrapRoutes) > 0 {
+		r.routesMu.Lock()
+		r.routes = r.bootstrapRoutes
+		r.routesMu.Unlock()
+		r.routesTableBroadcaster.Broadcast(r.bootstrapRoutes)
+	}
+
 	for {
 		select {
 		case <-time.After(r.routesUpdateInterval):
@@ -229,38 +540,68 @@ func (r *RoutingTable) Run(ctx context.Context) {
 			// fetch the latest known set of routers from ThingsIX
 			routers, err := r.routesFetcher()
 			if err != nil {
-				logrus.WithError(err).Warn("unable to refresh routers")
+				routingLog.WithError(err).Warn("unable to refresh routers")
 				continue
 			}
 
+			r.routesMu.Lock()
+			r.routes = routers
+			r.routesMu.Unlock()
+
 			// try to submit routing information to router clients
 			if r.routesTableBroadcaster.TryBroadcast(routers) {
 				// successfull, refresh on configured update interval
 				r.routesUpdateInterval = r.routesUpdateIntervalCfg
 				continue
 			}
-			logrus.Warn("unable to refresh routing table")
+			routingLog.Warn("unable to refresh routing table")
 		case <-ctx.Done():
-			logrus.Info("routing table stopped")
+			routingLog.Info("routing table stopped")
 			return
 		}
 	}
 }
 
-func (r *RoutingTable) keepRouteTableUpToDate(ctx context.Context) {
+func (r *RoutingTable) keepRouteTableUpToDate(ctx context.Context, newRoutes chan []*Router) {
 	var (
-		newRoutes       = make(chan []*Router)
 		existingRouters = make(map[[32]byte]*struct {
 			stop    context.CancelFunc
 			details chan *RouterDetails
+			client  *RouterClient
 		})
+		// pruned holds the endpoint of registered routers that were stopped
+		// because they were unreachable for longer than the stale route TTL,
+		// they are only reconnected when their registration changes
+		pruned  = make(map[[32]byte]string)
+		gcTimer <-chan time.Time
 	)
 	// routes table broadcaster emits the latest retrieved routes periodically.
-	r.routesTableBroadcaster.Subscribe(newRoutes)
 	defer r.routesTableBroadcaster.Unsubscribe(newRoutes)
 
+	if r.staleRouteTTL > 0 {
+		gcTicker := time.NewTicker(staleRouteGCInterval(r.staleRouteTTL))
+		defer gcTicker.Stop()
+		gcTimer = gcTicker.C
+	}
+
 	for {
 		select {
+		case now := <-gcTimer:
+			for id, existing := range existingRouters {
+				since, unreachable := existing.client.UnreachableSince()
+				if !unreachable || now.Sub(since) < r.staleRouteTTL {
+					continue
+				}
+				routingLog.WithFields(logrus.Fields{
+					"router":            existing.client.router,
+					"endpoint":          existing.client.router.Endpoint,
+					"unreachable_since": since,
+				}).Warn("prune stale router, unreachable for longer than TTL")
+				go existing.stop()
+				delete(existingRouters, id)
+				pruned[id] = existing.client.router.Endpoint
+				staleRoutesPrunedCounter.Inc()
+			}
 		// new set of routes fetched, determine which one are new and
 		// startup a client for them. Or broadcast routing details update
 		// for existing routes, or stop routes if the router is removed.
@@ -297,11 +638,32 @@ func (r *RoutingTable) keepRouteTableUpToDate(ctx context.Context) {
 				}
 			}
 
+			// forget pruned routers that are removed from the registry and
+			// retry pruned routers that registered a new endpoint
+			for id, endpoint := range pruned {
+				removed := true
+				for _, router := range routers {
+					if router.ThingsIXID == id {
+						removed = false
+						if router.Endpoint != endpoint {
+							delete(pruned, id)
+						}
+						break
+					}
+				}
+				if removed {
+					delete(pruned, id)
+				}
+			}
+
 			for _, router := range routers {
+				if _, ok := pruned[router.ThingsIXID]; ok {
+					continue
+				}
 				if !uniqueBands.ContainsFrequencyPlan(router.FrequencyPlan) {
 					// router supports frequency plan that non of the gateways
 					// in this store use, no need to connect to it.
-					logrus.WithFields(logrus.Fields{
+					routingLog.WithFields(logrus.Fields{
 						"id":   router.ThingsIXID,
 						"band": frequency_plan.FromBlockchain(router.FrequencyPlan),
 					}).Debug("ignore router - no gateways for routers frequency plan in gateway store")
@@ -331,23 +693,27 @@ func (r *RoutingTable) keepRouteTableUpToDate(ctx context.Context) {
 					var (
 						clientCtx, clientCancel = context.WithCancel(ctx)
 						details                 = make(chan *RouterDetails)
+						client                  = NewRouterClient(copy, r.routesTableBroadcaster, r.networkEvents, r.gatewayEvents, details)
 					)
-					go NewRouterClient(copy, r.routesTableBroadcaster, r.networkEvents, r.gatewayEvents, details).Run(clientCtx)
+					go r.runClient(clientCtx, client)
 					existingRouters[router.ThingsIXID] = &struct {
 						stop    context.CancelFunc
 						details chan *RouterDetails
+						client  *RouterClient
 					}{
 						clientCancel,
 						details,
+						client,
 					}
 					newRoutesCount++
 				}
 			}
 
-			logrus.WithFields(logrus.Fields{
+			routingLog.WithFields(logrus.Fields{
 				"new":      newRoutesCount,
 				"existing": existingRoutesCount,
 				"deleted":  deletedRoutesCount,
+				"pruned":   len(pruned),
 			}).Info("refreshed routing table")
 		case <-ctx.Done():
 			return
@@ -355,23 +721,116 @@ func (r *RoutingTable) keepRouteTableUpToDate(ctx context.Context) {
 	}
 }
 
+// staleRouteGCInterval returns how often routers are checked for being
+// unreachable longer than ttl.
+func staleRouteGCInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
 // runDefaultRouting start router clients for default configured routers
 func (r *RoutingTable) runDefaultRouting(ctx context.Context) {
-	var allStopped sync.WaitGroup
-	for _, dr := range r.defaultRoutes {
-		allStopped.Add(1)
-		cpy := dr
-		go func() {
-			// run router client until ctx expires
-			ignore := make(chan *RouterDetails) // default routes are never updated
-			NewRouterClient(cpy, r.routesTableBroadcaster, r.networkEvents, r.gatewayEvents, ignore).Run(ctx)
-			allStopped.Done()
-		}()
-	}
-	// wait for shutdown signal and all router clients have stopped
+	r.routesMu.RLock()
+	routes := r.defaultRoutes
+	r.routesMu.RUnlock()
+	r.SetDefaultRoutes(routes)
+
+	// router clients run until ctx expires
 	<-ctx.Done()
-	allStopped.Wait()
-	logrus.Trace("default routers disconnected")
+	routingLog.Trace("default routers disconnected")
+}
+
+// SetDefaultRoutes replaces the default routers, e.g. after the
+// configuration is reloaded. Clients are started for added routers. The
+// clients of removed routers drain for the drain period before they are
+// stopped. A router whose configuration or route settings changed is
+// restarted, its previous client drains as if it was removed.
+func (r *RoutingTable) SetDefaultRoutes(routes []*Router) {
+	r.managedMu.Lock()
+	if r.runCtx == nil {
+		r.managedMu.Unlock()
+		r.routesMu.Lock()
+		r.defaultRoutes = routes
+		r.routesMu.Unlock()
+		return
+	}
+
+	var (
+		running = make(map[string]*runningRoute, len(routes))
+		current = make([]*Router, 0, len(routes))
+	)
+	for _, router := range routes {
+		key := defaultRouteKey(router)
+		if _, dup := running[key]; dup {
+			continue
+		}
+		if existing, ok := r.static[key]; ok {
+			delete(r.static, key)
+			if existing.configHash == r.routeConfigHash(router) {
+				running[key] = existing
+				current = append(current, existing.router)
+				continue
+			}
+			routingLog.WithFields(logrus.Fields{
+				"name":         router.Name,
+				"endpoint":     router.Endpoint,
+				"drain_period": r.drainPeriod,
+			}).Info("default router configuration changed, restart connection")
+			existing.client.Drain()
+			time.AfterFunc(r.drainPeriod, existing.stop)
+			running[key] = r.startRoute(r.runCtx, router)
+			current = append(current, router)
+			continue
+		}
+		running[key] = r.startRoute(r.runCtx, router)
+		current = append(current, router)
+		routingLog.WithFields(logrus.Fields{
+			"name":     router.Name,
+			"endpoint": router.Endpoint,
+			"regions":  router.Regions,
+		}).Info("default router added")
+	}
+	for _, removed := range r.static {
+		routingLog.WithFields(logrus.Fields{
+			"name":         removed.router.Name,
+			"endpoint":     removed.router.Endpoint,
+			"drain_period": r.drainPeriod,
+		}).Info("default router removed, drain connection")
+		removed.client.Drain()
+		time.AfterFunc(r.drainPeriod, removed.stop)
+	}
+	r.static = running
+	r.managedMu.Unlock()
+
+	// routesMu is taken after managedMu is released since Routes takes
+	// managedMu while holding routesMu
+	r.routesMu.Lock()
+	r.defaultRoutes = current
+	r.routesMu.Unlock()
+}
+
+// defaultRouteKey identifies a default router across configuration reloads.
+func defaultRouteKey(router *Router) string {
+	return router.Name + "@" + router.Endpoint
+}
+
+// isDefaultRoute returns an indication if there is a default router with
+// the given name.
+func (r *RoutingTable) isDefaultRoute(name string) bool {
+	r.routesMu.RLock()
+	defer r.routesMu.RUnlock()
+	for _, dr := range r.defaultRoutes {
+		if dr.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 // buildRoutingTable constructs a new routing table
@@ -381,15 +840,72 @@ func buildRoutingTable(cfg *Config, gatewayStore gateway.GatewayStore, accounter
 		return nil, fmt.Errorf("unable to determine method to fetch ThingsIX routes: %w", err)
 	}
 
+	signingSchemes := signing.Schemes()
+	if len(cfg.Forwarder.Routers.SigningSchemes) > 0 {
+		if signingSchemes, err = signing.ParseSchemes(cfg.Forwarder.Routers.SigningSchemes); err != nil {
+			return nil, fmt.Errorf("invalid router signing schemes: %w", err)
+		}
+	}
+
+	var bootstrap []*Router
+	if cfg.Forwarder.Routers.OnChain != nil || (cfg.Forwarder.Routers.ThingsIXApi != nil && cfg.Forwarder.Routers.ThingsIXApi.Endpoint != nil) {
+		bootstrap = bootstrapRoutes(cfg, accounter)
+	}
+
+	dialOptions, err := newRouteDialOptions(cfg.Forwarder.Routers.Dial)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := newPacketFilters(cfg.Forwarder.Routers.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := newRouteResolver(cfg.Forwarder.Routers.Resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery, err := newRouteDiscoveries(cfg.Forwarder.Routers.Discovery, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	drainPeriod := 10 * time.Second
+	if cfg.Forwarder.Routers.DrainPeriod != nil && *cfg.Forwarder.Routers.DrainPeriod >= 0 {
+		drainPeriod = *cfg.Forwarder.Routers.DrainPeriod
+	}
+
+	var staleRouteTTL time.Duration
+	if cfg.Forwarder.Routers.StaleRouteTTL != nil {
+		staleRouteTTL = *cfg.Forwarder.Routers.StaleRouteTTL
+	}
+
 	return &RoutingTable{
 		routesFetcher:           routes,
 		routesUpdateInterval:    time.Millisecond, // first time try to fetch routing information immediately
 		routesUpdateIntervalCfg: interval,
 		routesTableBroadcaster:  broadcast.New[[]*Router](1),
 		defaultRoutes:           cfg.Forwarder.Routers.Default,
+		routeSettingsCfg:        newRouteSettingsConfig(cfg.Forwarder.Routers),
+		managed:                 make(map[string]*managedRoute),
+		static:                  make(map[string]*runningRoute),
+		drainPeriod:             drainPeriod,
+		discovery:               discovery,
+		discovered:              make(map[string]*Router),
 		networkEvents:           make(chan *NetworkEvent, 1024),
-		gatewayEvents:           broadcast.New[*GatewayEvent](1024).Run(),
+		gatewayEvents:           broadcast.NewWithPriority[*GatewayEvent](1024, 256).Run(),
 		gatewayStore:            gatewayStore,
+		signingSchemes:          signingSchemes,
+		staleRouteTTL:           staleRouteTTL,
+		transforms:              newPayloadTransforms(cfg.Forwarder.Routers.Transforms),
+		filters:                 filters,
+		resolver:                resolver,
+		rateLimits:              newRouteRateLimits(cfg.Forwarder.Routers.RateLimits),
+		dialOptions:             dialOptions,
+		bootstrapRoutes:         bootstrap,
+		routeChanges:            broadcast.New[*RouteChangeEvent](64).Run(),
 	}, nil
 }
 
@@ -405,7 +921,7 @@ func obtainThingsIXRoutesFunc(cfg *Config, accounter Accounter) (RoutesUpdaterFu
 	}
 
 	// no routes source configured, only use default routers
-	logrus.Warn("no ThingsIX routing table source configured, only use default routers from configuration")
+	routingLog.Warn("no ThingsIX routing table source configured, only use default routers from configuration")
 	return func() ([]*Router, error) {
 		return nil, nil
 	}, 24 * time.Hour, nil
@@ -0,0 +1,77 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/broadcast"
+	"github.com/brocaar/lorawan"
+)
+
+func TestSetDefaultRoutesRestartsChangedRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	table := &RoutingTable{
+		runCtx:                 ctx,
+		static:                 make(map[string]*runningRoute),
+		drainPeriod:            time.Millisecond,
+		routesTableBroadcaster: broadcast.New[[]*Router](1).Run(),
+		networkEvents:          make(chan *NetworkEvent, 16),
+		gatewayEvents:          broadcast.NewWithPriority[*GatewayEvent](16, 16).Run(),
+		routeChanges:           broadcast.New[*RouteChangeEvent](16).Run(),
+	}
+	route := func(netID lorawan.NetID) *Router {
+		return &Router{
+			Name:     "v47",
+			Endpoint: "127.0.0.1:1",
+			Default:  true,
+			NetID:    netID,
+			Regions:  []frequency_plan.BandName{frequency_plan.EU868},
+		}
+	}
+	key := defaultRouteKey(route(lorawan.NetID{}))
+
+	table.SetDefaultRoutes([]*Router{route(lorawan.NetID{})})
+	started := table.static[key]
+
+	table.SetDefaultRoutes([]*Router{route(lorawan.NetID{})})
+	if table.static[key] != started {
+		t.Fatal("unchanged default router restarted")
+	}
+
+	table.SetDefaultRoutes([]*Router{route(lorawan.NetID{0x00, 0x00, 0x13})})
+	if table.static[key] == started {
+		t.Fatal("default router with changed NetID not restarted")
+	}
+	started = table.static[key]
+
+	timeout := 5 * time.Second
+	if err := table.SetRouteSettings(ForwarderRoutersConfig{
+		Dial: []ForwarderRouteDialConfig{{Route: "v47", ConnectTimeout: &timeout}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	table.SetDefaultRoutes([]*Router{route(lorawan.NetID{0x00, 0x00, 0x13})})
+	if table.static[key] == started {
+		t.Error("default router with changed dial options not restarted")
+	}
+}
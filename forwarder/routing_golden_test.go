@@ -0,0 +1,256 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/airtime"
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/ThingsIXFoundation/router-api/go/router"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The routing golden test replays a corpus of captured uplinks through the
+// code that decides which routers receive them and which airtime is charged
+// through accounting. The decisions are compared against a golden file, any
+// change in routing behavior fails the test. After an intended change the
+// golden file is regenerated with:
+//
+//	go test ./forwarder -run TestRoutingGolden -update
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+const routingTestdata = "testdata/routing"
+
+// goldenUplink is a captured uplink in the corpus.
+type goldenUplink struct {
+	Name            string `json:"name"`
+	Region          string `json:"region"`
+	Frequency       uint32 `json:"frequency"`
+	SpreadingFactor uint32 `json:"spreadingFactor"`
+	Bandwidth       uint32 `json:"bandwidth"`
+	PHYPayload      []byte `json:"phyPayload"`
+}
+
+// goldenRouter describes a router uplinks are offered to.
+type goldenRouter struct {
+	Name          string                    `json:"name"`
+	Default       bool                      `json:"default"`
+	Regions       []frequency_plan.BandName `json:"regions"`
+	NetID         string                    `json:"netId"`
+	Prefix        string                    `json:"prefix"`
+	Mask          uint8                     `json:"mask"`
+	FrequencyPlan frequency_plan.BandName   `json:"frequencyPlan"`
+	Owner         common.Address            `json:"owner"`
+	AirtimeBudget string                    `json:"airtimeBudget"`
+	JoinDevEUIs   []lorawan.EUI64           `json:"joinDevEuis"`
+}
+
+// budgetAccounter allows airtime until the budget of the owner is spent.
+type budgetAccounter struct {
+	remaining map[common.Address]time.Duration
+}
+
+func (a *budgetAccounter) Allow(owner common.Address, airtime time.Duration) bool {
+	if a.remaining[owner] < airtime {
+		return false
+	}
+	a.remaining[owner] -= airtime
+	return true
+}
+
+func (a *budgetAccounter) AddPayment(payment *router.AirtimePaymentEvent) {}
+
+func loadGoldenJSON(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(routingTestdata, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+}
+
+func goldenRouters(t *testing.T, accounter *budgetAccounter) []*Router {
+	var configs []goldenRouter
+	loadGoldenJSON(t, "routers.json", &configs)
+
+	routers := make([]*Router, 0, len(configs))
+	for _, cfg := range configs {
+		var netID lorawan.NetID
+		if cfg.NetID != "" {
+			if err := netID.UnmarshalText([]byte(cfg.NetID)); err != nil {
+				t.Fatalf("router %s: %v", cfg.Name, err)
+			}
+		}
+		var prefix uint64
+		if cfg.Prefix != "" {
+			var err error
+			if prefix, err = strconv.ParseUint(cfg.Prefix, 16, 32); err != nil {
+				t.Fatalf("router %s: %v", cfg.Name, err)
+			}
+		}
+		if cfg.AirtimeBudget != "" {
+			budget, err := time.ParseDuration(cfg.AirtimeBudget)
+			if err != nil {
+				t.Fatalf("router %s: %v", cfg.Name, err)
+			}
+			accounter.remaining[cfg.Owner] = budget
+		}
+
+		r := NewRouter([32]byte{}, "", cfg.Default, netID, uint32(prefix), cfg.Mask,
+			cfg.FrequencyPlan.ToBlockchain(), cfg.Owner, accounter)
+		r.Name = cfg.Name
+		r.Regions = cfg.Regions
+		if len(cfg.JoinDevEUIs) > 0 {
+			bitmap := roaring64.New()
+			for _, devEUI := range cfg.JoinDevEUIs {
+				bitmap.Add(utils.Eui64ToUint64(devEUI))
+			}
+			r.SetJoinFilter(nil, bitmap)
+		}
+		routers = append(routers, r)
+	}
+	return routers
+}
+
+func TestRoutingGolden(t *testing.T) {
+	key, err := crypto.HexToECDSA(strings.Repeat("0", 63) + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gtw, err := gateway.NewGateway(lorawan.EUI64{0x00, 0x16, 0xc0, 0x01, 0xff, 0x10, 0xa2, 0x35}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		uplinks   []goldenUplink
+		accounter = &budgetAccounter{remaining: make(map[common.Address]time.Duration)}
+		routers   = goldenRouters(t, accounter)
+		out       bytes.Buffer
+	)
+	loadGoldenJSON(t, "uplinks.json", &uplinks)
+
+	for _, uplink := range uplinks {
+		frame := &gw.UplinkFrame{
+			PhyPayload: uplink.PHYPayload,
+			TxInfo: &gw.UplinkTxInfo{
+				Frequency: uplink.Frequency,
+				Modulation: &gw.Modulation{
+					Parameters: &gw.Modulation_Lora{
+						Lora: &gw.LoraModulationInfo{
+							Bandwidth:       uplink.Bandwidth,
+							SpreadingFactor: uplink.SpreadingFactor,
+							CodeRate:        gw.CodeRate_CR_4_5,
+						},
+					},
+				},
+			},
+			RxInfo: &gw.UplinkRxInfo{GatewayId: gtw.NetworkID.String()},
+		}
+
+		var phy lorawan.PHYPayload
+		if err := phy.UnmarshalBinary(frame.PhyPayload); err != nil {
+			fmt.Fprintf(&out, "uplink %s: drop: %v\n", uplink.Name, err)
+			continue
+		}
+		at, err := airtime.UplinkAirtime(frame)
+		if err != nil {
+			t.Fatalf("uplink %s: %v", uplink.Name, err)
+		}
+
+		ev, err := newUplinkGatewayEvent(gtw, frequency_plan.BandName(uplink.Region), &phy, frame, at)
+		if err != nil {
+			fmt.Fprintf(&out, "uplink %s: drop: %v\n", uplink.Name, err)
+			continue
+		}
+
+		fmt.Fprintf(&out, "uplink %s: type=%s region=%s airtime=%s\n", uplink.Name, phy.MHDR.MType, uplink.Region, at)
+		for _, r := range routers {
+			fmt.Fprintf(&out, "\t%-20s %s\n", r.Name, r.route(ev))
+		}
+	}
+
+	owners := make([]string, 0, len(accounter.remaining))
+	for owner := range accounter.remaining {
+		owners = append(owners, owner.Hex())
+	}
+	sort.Strings(owners)
+	fmt.Fprintf(&out, "accounting:\n")
+	for _, owner := range owners {
+		fmt.Fprintf(&out, "\t%s remaining=%s\n", owner, accounter.remaining[common.HexToAddress(owner)])
+	}
+
+	compareGolden(t, filepath.Join(routingTestdata, "decisions.golden"), out.Bytes())
+}
+
+// compareGolden compares got with the golden file at path, or rewrites the
+// golden file when the test runs with -update.
+func compareGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create the golden file", err)
+	}
+	if bytes.Equal(expected, got) {
+		return
+	}
+
+	var (
+		expectedLines = strings.Split(string(expected), "\n")
+		gotLines      = strings.Split(string(got), "\n")
+	)
+	for i := 0; i < len(expectedLines) || i < len(gotLines); i++ {
+		var e, g string
+		if i < len(expectedLines) {
+			e = expectedLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if e != g {
+			t.Errorf("%s:%d\n\texpected: %q\n\tgot:      %q", path, i+1, e, g)
+		}
+	}
+	t.Errorf("routing decisions drifted from %s, run with -update if the change is intended", path)
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+
+	"github.com/brocaar/lorawan"
+)
+
+// RuntimeStats describes the internal state of the forwarder, it is used for
+// on-host diagnostics.
+type RuntimeStats struct {
+	Routers   []RouterClientStats    `json:"routers"`
+	Queues    []QueueStats           `json:"queues"`
+	Downlinks []GatewayDownlinkStats `json:"downlinks"`
+}
+
+// QueueStats describes the fill level of an internal queue.
+type QueueStats struct {
+	Name     string `json:"name"`
+	Length   int    `json:"length"`
+	Capacity int    `json:"capacity"`
+}
+
+// GatewayDownlinkStats describes the downlink queue of a gateway.
+type GatewayDownlinkStats struct {
+	NetworkID         lorawan.EUI64 `json:"networkId"`
+	Inflight          int           `json:"inflight"`
+	MulticastSessions int           `json:"multicastSessions"`
+	// DutyCycle holds per region and band the fraction of the duty cycle window used
+	// for transmissions, only set when the duty cycle is tracked
+	DutyCycle map[string]float64 `json:"dutyCycle,omitempty"`
+}
+
+// RuntimeStats returns router connection, queue and downlink statistics.
+func (svc APIService) RuntimeStats(w http.ResponseWriter, r *http.Request) {
+	stats := RuntimeStats{
+		Routers: svc.routingTable.RouterClients(),
+		Queues: []QueueStats{{
+			Name:     "network_events",
+			Length:   len(svc.routingTable.networkEvents),
+			Capacity: cap(svc.routingTable.networkEvents),
+		}},
+		Downlinks: make([]GatewayDownlinkStats, 0),
+	}
+
+	length, capacity := svc.routingTable.gatewayEvents.Pending()
+	stats.Queues = append(stats.Queues, QueueStats{Name: "gateway_events", Length: length, Capacity: capacity})
+	length, capacity = svc.routingTable.gatewayEvents.PendingPriority()
+	stats.Queues = append(stats.Queues, QueueStats{Name: "gateway_join_events", Length: length, Capacity: capacity})
+	length, capacity = svc.packetEvents.Pending()
+	stats.Queues = append(stats.Queues, QueueStats{Name: "packet_events", Length: length, Capacity: capacity})
+
+	if svc.uplinkLanes != nil {
+		data, dataCap, joins, joinsCap := svc.uplinkLanes.Pending()
+		stats.Queues = append(stats.Queues,
+			QueueStats{Name: "uplinks", Length: data, Capacity: dataCap},
+			QueueStats{Name: "join_uplinks", Length: joins, Capacity: joinsCap})
+	}
+
+	if svc.scheduler != nil {
+		var (
+			sessions  = svc.scheduler.MulticastSessions()
+			dutyCycle = svc.scheduler.DutyCycleUsage()
+		)
+		for id, inflight := range svc.scheduler.Inflight() {
+			stats.Downlinks = append(stats.Downlinks, GatewayDownlinkStats{
+				NetworkID:         id,
+				Inflight:          inflight,
+				MulticastSessions: sessions[id],
+				DutyCycle:         dutyCycle[id],
+			})
+		}
+		sort.Slice(stats.Downlinks, func(i, j int) bool {
+			return bytes.Compare(stats.Downlinks[i].NetworkID[:], stats.Downlinks[j].NetworkID[:]) < 0
+		})
+	}
+
+	replyJSON(w, http.StatusOK, stats)
+}
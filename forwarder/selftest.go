@@ -0,0 +1,502 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SelfTestRunning indicates the self-test has not yet finished
+	SelfTestRunning = "running"
+	// SelfTestPassed indicates all checks passed or were skipped
+	SelfTestPassed = "passed"
+	// SelfTestFailed indicates at least one check failed
+	SelfTestFailed = "failed"
+
+	// results of individual checks
+	selfTestPass = "pass"
+	selfTestFail = "fail"
+	selfTestSkip = "skip"
+
+	// defaultSelfTestDuration covers at least 2 stats intervals of the
+	// Semtech UDP packet forwarder
+	defaultSelfTestDuration = 2 * time.Minute
+	maxSelfTestDuration     = 10 * time.Minute
+	// maxSelfTestClockOffset is the maximum difference between the gateway
+	// receive timestamp and the forwarder clock for the timing check to pass
+	maxSelfTestClockOffset = 500 * time.Millisecond
+)
+
+// selfTestPayloadPrefix marks the proprietary test downlink, the remainder of
+// the payload is a random nonce to recognize the frame when the gateway
+// receives its own transmission.
+var selfTestPayloadPrefix = []byte{byte(lorawan.Proprietary) << 5, 'T', 'I', 'X', 'S', 'E', 'L', 'F', 'T', 'E', 'S', 'T'}
+
+// SelfTestCheck is the result of a single self-test check.
+type SelfTestCheck struct {
+	Name    string `json:"name"`
+	Result  string `json:"result"`
+	Details string `json:"details,omitempty"`
+}
+
+// SelfTestReport is the outcome of a gateway self-test. It can be attached
+// to an onboarding request as evidence that the gateway works end-to-end.
+type SelfTestReport struct {
+	GatewayLocalID   lorawan.EUI64   `json:"gatewayLocalId"`
+	GatewayNetworkID lorawan.EUI64   `json:"gatewayNetworkId"`
+	GatewayID        string          `json:"gatewayId"`
+	Status           string          `json:"status"`
+	Started          time.Time       `json:"started"`
+	Finished         *time.Time      `json:"finished,omitempty"`
+	Duration         string          `json:"duration"`
+	Checks           []SelfTestCheck `json:"checks,omitempty"`
+}
+
+// selfTest holds the observations for a running self-test.
+type selfTest struct {
+	gw       *gateway.Gateway
+	region   string
+	started  time.Time
+	duration time.Duration
+	done     chan struct{}
+
+	mu sync.Mutex
+	// stats holds when gateway stats were received
+	stats []time.Time
+	// uplinks is the number of uplinks received during the test
+	uplinks int
+	// clockOffset is the largest difference between the gateway receive
+	// time and the forwarder clock, nil if no uplink carried a timestamp
+	clockOffset *time.Duration
+	gpsTime     bool
+	// downlink is the test downlink, nil if it could not be sent
+	downlinkID uint32
+	downlink   *gw.DownlinkFrame
+	sendErr    error
+	sent       time.Time
+	txAck      *gw.DownlinkTxAck
+	txAckAt    time.Time
+	loopback   bool
+	report     SelfTestReport
+}
+
+// SelfTester runs end-to-end tests against connected gateways.
+type SelfTester struct {
+	exchange *Exchange
+
+	mu    sync.Mutex
+	tests map[lorawan.EUI64]*selfTest
+}
+
+// NewSelfTester returns a self-tester that uses the backend of exchange to
+// communicate with gateways.
+func NewSelfTester(exchange *Exchange) *SelfTester {
+	return &SelfTester{
+		exchange: exchange,
+		tests:    make(map[lorawan.EUI64]*selfTest),
+	}
+}
+
+// Start begins a self-test for gw that runs for the given duration. It
+// returns ErrSelfTestInProgress when gw is already being tested.
+func (st *SelfTester) Start(gw *gateway.Gateway, duration time.Duration) (SelfTestReport, error) {
+	st.mu.Lock()
+	if test, ok := st.tests[gw.LocalID]; ok {
+		select {
+		case <-test.done:
+		default:
+			st.mu.Unlock()
+			return SelfTestReport{}, ErrSelfTestInProgress
+		}
+	}
+
+	test := &selfTest{
+		gw:       gw,
+		region:   string(gatewayRegion(gw, st.exchange.gateways)),
+		started:  time.Now(),
+		duration: duration,
+		done:     make(chan struct{}),
+	}
+	test.report = SelfTestReport{
+		GatewayLocalID:   gw.LocalID,
+		GatewayNetworkID: gw.NetworkID,
+		GatewayID:        gw.ThingsIxID.String(),
+		Status:           SelfTestRunning,
+		Started:          test.started,
+		Duration:         duration.String(),
+	}
+	st.tests[gw.LocalID] = test
+	st.mu.Unlock()
+
+	go st.run(test)
+
+	return test.report, nil
+}
+
+// Report returns the report of the last self-test for the gateway with the
+// given local id.
+func (st *SelfTester) Report(localID lorawan.EUI64) (SelfTestReport, error) {
+	st.mu.Lock()
+	test, ok := st.tests[localID]
+	st.mu.Unlock()
+	if !ok {
+		return SelfTestReport{}, ErrSelfTestNotFound
+	}
+
+	test.mu.Lock()
+	defer test.mu.Unlock()
+	return test.report, nil
+}
+
+func (st *SelfTester) running(localID lorawan.EUI64) *selfTest {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	test, ok := st.tests[localID]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-test.done:
+		return nil
+	default:
+		return test
+	}
+}
+
+// ObserveStats must be called for gateway stats.
+func (st *SelfTester) ObserveStats(gw *gateway.Gateway) {
+	if test := st.running(gw.LocalID); test != nil {
+		test.mu.Lock()
+		test.stats = append(test.stats, time.Now())
+		test.mu.Unlock()
+	}
+}
+
+// ObserveUplink must be called for uplinks received at the given time.
+func (st *SelfTester) ObserveUplink(gw *gateway.Gateway, frame *gw.UplinkFrame, received time.Time) {
+	test := st.running(gw.LocalID)
+	if test == nil {
+		return
+	}
+
+	test.mu.Lock()
+	defer test.mu.Unlock()
+
+	test.uplinks++
+	if rxTime := frame.GetRxInfo().GetTime(); rxTime != nil {
+		offset := received.Sub(rxTime.AsTime())
+		if offset < 0 {
+			offset = -offset
+		}
+		if test.clockOffset == nil || offset > *test.clockOffset {
+			test.clockOffset = &offset
+		}
+	}
+	if frame.GetRxInfo().GetTimeSinceGpsEpoch() != nil {
+		test.gpsTime = true
+	}
+	if test.downlink != nil && bytes.Equal(frame.GetPhyPayload(), test.downlink.GetItems()[0].GetPhyPayload()) {
+		test.loopback = true
+	}
+}
+
+// TxAck returns true if txack acknowledges a self-test downlink. These ACKs
+// are consumed by the self-test and must not be forwarded to routers.
+func (st *SelfTester) TxAck(gw *gateway.Gateway, txack *gw.DownlinkTxAck) bool {
+	test := st.running(gw.LocalID)
+	if test == nil {
+		return false
+	}
+
+	test.mu.Lock()
+	defer test.mu.Unlock()
+
+	if test.downlink == nil || txack.GetDownlinkId() != test.downlinkID {
+		return false
+	}
+	test.txAck, test.txAckAt = txack, time.Now()
+	return true
+}
+
+func (st *SelfTester) run(test *selfTest) {
+	log := logrus.WithFields(logrus.Fields{
+		"gw_local_id":   test.gw.LocalID,
+		"gw_network_id": test.gw.NetworkID,
+	})
+	log.WithField("duration", test.duration).Info("start gateway self-test")
+
+	downlink, err := st.downlink(test)
+
+	test.mu.Lock()
+	test.downlink, test.sendErr = downlink, err
+	if downlink != nil {
+		test.downlinkID = downlink.GetDownlinkId()
+		test.sent = time.Now()
+	}
+	test.mu.Unlock()
+
+	if err == nil {
+		err = st.exchange.backend.SendDownlinkFrame(downlink)
+		test.mu.Lock()
+		test.sendErr = err
+		test.mu.Unlock()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.NewTimer(test.duration)
+	defer deadline.Stop()
+
+wait:
+	for !test.conclusive() {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			break wait
+		}
+	}
+
+	test.mu.Lock()
+	test.finish()
+	report := test.report
+	test.mu.Unlock()
+	close(test.done)
+
+	log.WithField("status", report.Status).Info("gateway self-test finished")
+}
+
+// downlink returns the test downlink. It is sent on the RX2 channel of the
+// gateway region with non-inverted polarity so gateways that support it can
+// receive their own transmission.
+func (st *SelfTester) downlink(test *selfTest) (*gw.DownlinkFrame, error) {
+	band, err := regionBand(gatewayRegion(test.gw, st.exchange.gateways))
+	if err != nil {
+		return nil, err
+	}
+	defaults := band.GetDefaults()
+	dr, err := band.GetDataRate(defaults.RX2DataRate)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	payload := append(append([]byte{}, selfTestPayloadPrefix...), nonce...)
+
+	frame := &gw.DownlinkFrame{
+		DownlinkId: binary.BigEndian.Uint32(nonce),
+		GatewayId:  test.gw.LocalID.String(),
+		Items: []*gw.DownlinkFrameItem{{
+			PhyPayload: payload,
+			TxInfo: &gw.DownlinkTxInfo{
+				Frequency: defaults.RX2Frequency,
+				Power:     int32(band.GetDownlinkTXPower(defaults.RX2Frequency)),
+				Modulation: &gw.Modulation{
+					Parameters: &gw.Modulation_Lora{
+						Lora: &gw.LoraModulationInfo{
+							Bandwidth:       uint32(dr.Bandwidth * 1000),
+							SpreadingFactor: uint32(dr.SpreadFactor),
+							CodeRate:        gw.CodeRate_CR_4_5,
+						},
+					},
+				},
+				Timing: &gw.Timing{
+					Parameters: &gw.Timing_Immediately{
+						Immediately: &gw.ImmediatelyTimingInfo{},
+					},
+				},
+			},
+		}},
+	}
+
+	if st.exchange.txPower != nil {
+		if _, _, err := st.exchange.txPower.Limit(test.gw, frame.Items[0]); err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+// conclusive returns true when all checks have a definitive result and the
+// test can stop before its deadline.
+func (test *selfTest) conclusive() bool {
+	test.mu.Lock()
+	defer test.mu.Unlock()
+	return len(test.stats) >= 2 && test.clockOffset != nil &&
+		(test.sendErr != nil || (test.txAck != nil && test.loopback))
+}
+
+// finish evaluates the checks, the caller must hold test.mu.
+func (test *selfTest) finish() {
+	var (
+		now    = time.Now()
+		checks []SelfTestCheck
+		add    = func(name, result, details string, args ...interface{}) {
+			checks = append(checks, SelfTestCheck{Name: name, Result: result, Details: fmt.Sprintf(details, args...)})
+		}
+	)
+
+	if test.gw.Onboarded() {
+		add("registered", selfTestPass, "onboarded by %s", test.gw.Owner)
+	} else {
+		add("registered", selfTestPass, "in gateway store, not yet onboarded")
+	}
+
+	if test.region == "" || test.region == "INVALID" {
+		add("region", selfTestFail, "gateway has no band and no default frequency plan is configured")
+	} else {
+		add("region", selfTestPass, "%s", test.region)
+	}
+
+	switch len(test.stats) {
+	case 0:
+		add("stats", selfTestFail, "no gateway stats received within %s", test.duration)
+	case 1:
+		add("stats", selfTestPass, "first stats after %s", test.stats[0].Sub(test.started).Round(time.Millisecond))
+	default:
+		add("stats", selfTestPass, "first stats after %s, interval %s",
+			test.stats[0].Sub(test.started).Round(time.Millisecond),
+			test.stats[1].Sub(test.stats[0]).Round(time.Millisecond))
+	}
+
+	switch {
+	case test.uplinks == 0:
+		add("uplink", selfTestSkip, "no uplinks received, have a device transmit during the test")
+	default:
+		add("uplink", selfTestPass, "%d uplinks received", test.uplinks)
+	}
+
+	switch {
+	case test.clockOffset == nil:
+		add("timing", selfTestSkip, "no uplink with a gateway receive timestamp")
+	case *test.clockOffset > maxSelfTestClockOffset:
+		add("timing", selfTestFail, "gateway clock differs %s from forwarder clock, max %s (gps: %v)",
+			test.clockOffset.Round(time.Millisecond), maxSelfTestClockOffset, test.gpsTime)
+	default:
+		add("timing", selfTestPass, "gateway clock within %s from forwarder clock (gps: %v)",
+			test.clockOffset.Round(time.Millisecond), test.gpsTime)
+	}
+
+	switch {
+	case test.sendErr != nil:
+		add("downlink", selfTestFail, "unable to send test downlink: %s", test.sendErr)
+	case test.txAck == nil:
+		add("downlink", selfTestFail, "no TX ACK received for test downlink %d", test.downlinkID)
+	case !txAckOK(test.txAck):
+		add("downlink", selfTestFail, "gateway rejected test downlink: %s", txAckStatus(test.txAck))
+	default:
+		add("downlink", selfTestPass, "transmitted on %d Hz, TX ACK after %s",
+			test.downlink.GetItems()[0].GetTxInfo().GetFrequency(), test.txAckAt.Sub(test.sent).Round(time.Millisecond))
+	}
+
+	if test.loopback {
+		add("loopback", selfTestPass, "gateway received its own test downlink")
+	} else {
+		add("loopback", selfTestSkip, "test downlink not received back, not all gateways support this")
+	}
+
+	test.report.Status = SelfTestPassed
+	for _, check := range checks {
+		if check.Result == selfTestFail {
+			test.report.Status = SelfTestFailed
+		}
+	}
+	test.report.Checks = checks
+	test.report.Finished = &now
+}
+
+func txAckOK(txack *gw.DownlinkTxAck) bool {
+	for _, item := range txack.GetItems() {
+		if item.GetStatus() == gw.TxAckStatus_OK {
+			return true
+		}
+	}
+	return len(txack.GetItems()) == 0
+}
+
+func txAckStatus(txack *gw.DownlinkTxAck) string {
+	if len(txack.GetItems()) == 0 {
+		return gw.TxAckStatus_OK.String()
+	}
+	return txack.GetItems()[0].GetStatus().String()
+}
+
+// StartSelfTest starts a self-test for the gateway in the path.
+func (svc APIService) StartSelfTest(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+
+	duration := defaultSelfTestDuration
+	if d := r.URL.Query().Get("duration"); d != "" {
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 || duration > maxSelfTestDuration {
+			http.Error(w, fmt.Sprintf("invalid duration, must be between 0 and %s", maxSelfTestDuration), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := svc.selfTests.Start(gw, duration)
+	switch {
+	case err == nil:
+		replyJSON(w, http.StatusAccepted, report)
+	case errors.Is(err, ErrSelfTestInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		logrus.WithError(err).Error("unable to start self-test")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// SelfTestReport returns the report of the last self-test for the gateway in
+// the path.
+func (svc APIService) SelfTestReport(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+
+	report, err := svc.selfTests.Report(gw.LocalID)
+	switch {
+	case err == nil:
+		replyJSON(w, http.StatusOK, report)
+	case errors.Is(err, ErrSelfTestNotFound):
+		http.NotFound(w, r)
+	default:
+		logrus.WithError(err).Error("unable to retrieve self-test report")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
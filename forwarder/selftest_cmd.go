@@ -0,0 +1,136 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/logging"
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	SelfTestCmd = &cobra.Command{
+		Use:   "selftest",
+		Short: "Test a gateway end-to-end and print a pass/fail report",
+		Long: `Test a gateway connected to the running forwarder end-to-end.
+
+The forwarder waits for gateway stats, measures the gateway clock against the
+forwarder clock on received uplinks and sends a test downlink on the RX2
+channel of the gateway region for which it expects a TX ACK. Gateways that can
+receive their own transmissions also pass the loopback check. The report can
+be attached to onboarding requests, with --json it is printed in JSON format.
+
+The command exits with a non-zero status when a check failed.`,
+		Args: cobra.NoArgs,
+		Run:  runSelfTest,
+	}
+
+	selfTestGateway  string
+	selfTestDuration time.Duration
+	selfTestJSON     bool
+)
+
+func init() {
+	SelfTestCmd.Flags().StringVar(&selfTestGateway, "gateway", "", "local id, network id or ThingsIX id of the gateway to test")
+	SelfTestCmd.Flags().DurationVar(&selfTestDuration, "duration", defaultSelfTestDuration, "maximum test duration")
+	SelfTestCmd.Flags().BoolVar(&selfTestJSON, "json", false, "Output in json format")
+	_ = SelfTestCmd.MarkFlagRequired("gateway")
+}
+
+func runSelfTest(cmd *cobra.Command, args []string) {
+	logging.SetDefaultLevel(logrus.ErrorLevel)
+
+	cfg := mustLoadConfig(true)
+	if cfg.Forwarder.Gateways.HttpAPI.Address == "" {
+		logrus.Fatal("HTTP API endpoint missing")
+	}
+
+	endpoint := fmt.Sprintf("http://%s/v1/gateways/%s/selftest",
+		cfg.Forwarder.Gateways.HttpAPI.Address, url.PathEscape(selfTestGateway))
+
+	resp, err := http.Post(fmt.Sprintf("%s?duration=%s", endpoint, selfTestDuration), "application/json", nil)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to start self-test")
+	}
+	report := mustDecodeSelfTestReport(resp)
+
+	if !selfTestJSON {
+		fmt.Printf("testing gateway %s (network id %s) for at most %s\n",
+			report.GatewayLocalID, report.GatewayNetworkID, report.Duration)
+	}
+
+	for report.Status == SelfTestRunning {
+		time.Sleep(2 * time.Second)
+		resp, err := http.Get(endpoint)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to retrieve self-test report")
+		}
+		report = mustDecodeSelfTestReport(resp)
+	}
+
+	if selfTestJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		printSelfTestReport(report)
+	}
+
+	if report.Status != SelfTestPassed {
+		os.Exit(1)
+	}
+}
+
+func mustDecodeSelfTestReport(resp *http.Response) SelfTestReport {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		msg, _ := io.ReadAll(resp.Body)
+		logrus.Fatalf("self-test failed: %s", strings.TrimSpace(string(msg)))
+	}
+
+	var report SelfTestReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		logrus.WithError(err).Fatal("unable to decode self-test report")
+	}
+	return report
+}
+
+func printSelfTestReport(report SelfTestReport) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Check", "Result", "Details"})
+	table.SetAutoWrapText(false)
+	for _, check := range report.Checks {
+		table.Append([]string{check.Name, strings.ToUpper(check.Result), check.Details})
+	}
+	table.Render()
+
+	finished := "-"
+	if report.Finished != nil {
+		finished = report.Finished.Format(time.RFC3339)
+	}
+	fmt.Printf("gateway:  %s\nlocal id: %s\nstarted:  %s\nfinished: %s\nresult:   %s\n",
+		report.GatewayID, report.GatewayLocalID, report.Started.Format(time.RFC3339), finished, strings.ToUpper(report.Status))
+}
@@ -0,0 +1,287 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/selfupdate"
+	"github.com/ThingsIXFoundation/packet-handling/upgrade"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	VersionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Print build information",
+		Args:  cobra.NoArgs,
+		Run:   printBuildInfo,
+	}
+
+	SelfUpdateCmd = &cobra.Command{
+		Use:   "self-update",
+		Short: "Replace the forwarder binary with a release binary",
+		Long: `Download the forwarder binary for this platform from a release, verify the
+signature over the release checksums and the checksum of the release archive
+and replace the installed binary with it. Without --version the latest
+release is installed.
+
+The running forwarder keeps running the old binary. Pass its process id with
+--restart-pid to let it hand over to the new binary without dropping gateway
+connections, or restart it afterwards.`,
+		Args: cobra.NoArgs,
+		Run:  runSelfUpdate,
+	}
+
+	ReleaseCmds = &cobra.Command{
+		Use:   "release",
+		Short: "Release signing commands",
+	}
+
+	releaseKeygenCmd = &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate an Ed25519 key pair to sign release checksums with",
+		Args:  cobra.NoArgs,
+		Run:   generateReleaseKey,
+	}
+
+	releaseSignCmd = &cobra.Command{
+		Use:   "sign --key-file <file> <archive>...",
+		Short: "Write the signed checksums file for release archives",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   signRelease,
+	}
+
+	releaseBootstrapRoutersCmd = &cobra.Command{
+		Use:   "bootstrap-routers --key-file <file>",
+		Short: "Write the signed router set that is embedded in the forwarder",
+		Long: `Fetch the router snapshot from the ThingsIX API and write it with its
+signature to forwarder/bootstrap so it is embedded in the forwarder binary at
+build time. Forwarders use the embedded routers until they fetched the
+routers themselves. Sign with the release key, forwarders only accept a set
+signed with the key they verify releases with.`,
+		Args: cobra.NoArgs,
+		Run:  writeBootstrapRouters,
+	}
+
+	versionJSON bool
+
+	selfUpdateVersion    string
+	selfUpdateCheck      bool
+	selfUpdateReleaseURL string
+	selfUpdateLatestURL  string
+	selfUpdatePublicKey  string
+	selfUpdateRestartPID int
+
+	releaseKeyFile   string
+	releaseOutputDir string
+
+	bootstrapSnapshotURL string
+	bootstrapOutputDir   string
+)
+
+func init() {
+	VersionCmd.Flags().BoolVar(&versionJSON, "json", false, "Output in json format")
+
+	SelfUpdateCmd.Flags().StringVar(&selfUpdateVersion, "version", "", "release version to install, defaults to the latest release")
+	SelfUpdateCmd.Flags().BoolVar(&selfUpdateCheck, "check", false, "only report if an update is available")
+	SelfUpdateCmd.Flags().StringVar(&selfUpdateReleaseURL, "release-url", selfupdate.DefaultReleaseURL, "base URL of release artifacts, {version} is replaced with the release version")
+	SelfUpdateCmd.Flags().StringVar(&selfUpdateLatestURL, "latest-url", selfupdate.DefaultLatestURL, "URL that returns the latest release")
+	SelfUpdateCmd.Flags().StringVar(&selfUpdatePublicKey, "public-key", utils.ReleasePublicKey(), "hex encoded Ed25519 key the release checksums are signed with")
+	SelfUpdateCmd.Flags().IntVar(&selfUpdateRestartPID, "restart-pid", 0, "process id of the running forwarder that must switch to the new binary")
+
+	ReleaseCmds.AddCommand(releaseKeygenCmd)
+	ReleaseCmds.AddCommand(releaseSignCmd)
+	releaseSignCmd.Flags().StringVar(&releaseKeyFile, "key-file", "", "file with the hex encoded Ed25519 private key")
+	releaseSignCmd.Flags().StringVar(&releaseOutputDir, "output", ".", "directory the checksums and signature files are written to")
+	_ = releaseSignCmd.MarkFlagRequired("key-file")
+
+	ReleaseCmds.AddCommand(releaseBootstrapRoutersCmd)
+	releaseBootstrapRoutersCmd.Flags().StringVar(&releaseKeyFile, "key-file", "", "file with the hex encoded Ed25519 private key")
+	releaseBootstrapRoutersCmd.Flags().StringVar(&bootstrapSnapshotURL, "snapshot-url", "https://api.thingsix.com/routers/v1/snapshot", "ThingsIX API router snapshot URL")
+	releaseBootstrapRoutersCmd.Flags().StringVar(&bootstrapOutputDir, "output", filepath.Join("forwarder", "bootstrap"), "directory the router set and signature are written to")
+	_ = releaseBootstrapRoutersCmd.MarkFlagRequired("key-file")
+}
+
+func printBuildInfo(cmd *cobra.Command, args []string) {
+	info := utils.Build()
+	if versionJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(info)
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.AppendBulk([][]string{
+		{"version", info.Version},
+		{"commit", info.Commit},
+		{"commit time", info.CommitTime},
+		{"modified", fmt.Sprint(info.Modified)},
+		{"go", info.GoVersion},
+		{"platform", fmt.Sprintf("%s/%s%s%s", info.OS, info.Arch, info.Arm, info.Mips)},
+	})
+	table.Render()
+}
+
+func runSelfUpdate(cmd *cobra.Command, args []string) {
+	updater, err := selfupdate.New(selfUpdatePublicKey)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to verify releases, provide the release public key with --public-key")
+	}
+	updater.ReleaseURL = selfUpdateReleaseURL
+	updater.LatestURL = selfUpdateLatestURL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	var (
+		build   = utils.Build()
+		version = selfUpdateVersion
+	)
+	if version == "" {
+		if version, err = updater.Latest(ctx); err != nil {
+			logrus.WithError(err).Fatal("unable to determine latest release")
+		}
+	}
+
+	if version == build.Version {
+		fmt.Printf("forwarder %s is up to date\n", version)
+		return
+	}
+	if selfUpdateCheck {
+		fmt.Printf("forwarder %s is available, installed %s\n", version, build.Version)
+		return
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to determine executable")
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		logrus.WithError(err).Fatal("unable to determine executable")
+	}
+
+	binary, err := updater.Download(ctx, version, build)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to download release")
+	}
+	if err := selfupdate.Replace(executable, binary); err != nil {
+		logrus.WithError(err).Fatal("unable to install release")
+	}
+	fmt.Printf("installed forwarder %s in %s\n", version, executable)
+
+	if selfUpdateRestartPID == 0 {
+		return
+	}
+	signals := upgrade.Signals()
+	if len(signals) == 0 {
+		logrus.Fatal("in place restarts are not supported on this platform, restart the forwarder")
+	}
+	proc, err := os.FindProcess(selfUpdateRestartPID)
+	if err == nil {
+		err = proc.Signal(signals[0])
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to signal forwarder to restart")
+	}
+	fmt.Printf("signalled forwarder (pid %d) to switch to the new binary\n", selfUpdateRestartPID)
+}
+
+func generateReleaseKey(cmd *cobra.Command, args []string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to generate key")
+	}
+	fmt.Printf("private key: %x\npublic key:  %x\n", priv, pub)
+}
+
+func signRelease(cmd *cobra.Command, args []string) {
+	raw, err := os.ReadFile(releaseKeyFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read key file")
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		logrus.Fatal("invalid release signing key")
+	}
+
+	checksums, signature, err := selfupdate.Checksums(key, args)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to calculate checksums")
+	}
+	if err := os.WriteFile(filepath.Join(releaseOutputDir, selfupdate.ChecksumsFile), checksums, 0644); err != nil {
+		logrus.WithError(err).Fatal("unable to write checksums")
+	}
+	if err := os.WriteFile(filepath.Join(releaseOutputDir, selfupdate.SignatureFile), signature, 0644); err != nil {
+		logrus.WithError(err).Fatal("unable to write signature")
+	}
+}
+
+func writeBootstrapRouters(cmd *cobra.Command, args []string) {
+	raw, err := os.ReadFile(releaseKeyFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read key file")
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		logrus.Fatal("invalid release signing key")
+	}
+
+	resp, err := http.Get(bootstrapSnapshotURL)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to fetch router snapshot")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logrus.WithField("status", resp.Status).Fatal("unable to fetch router snapshot")
+	}
+	var snapshot routerSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		logrus.WithError(err).Fatal("invalid router snapshot")
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	snapshot.Time = &now
+
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to encode router snapshot")
+	}
+	encoded = append(encoded, '\n')
+	signature := hex.EncodeToString(ed25519.Sign(key, encoded))
+
+	if err := os.WriteFile(filepath.Join(bootstrapOutputDir, "routers.json"), encoded, 0644); err != nil {
+		logrus.WithError(err).Fatal("unable to write router set")
+	}
+	if err := os.WriteFile(filepath.Join(bootstrapOutputDir, "routers.json.sig"), []byte(signature+"\n"), 0644); err != nil {
+		logrus.WithError(err).Fatal("unable to write router set signature")
+	}
+	fmt.Printf("wrote %d routers for chain %d\n", len(snapshot.Routers), snapshot.ChainID)
+}
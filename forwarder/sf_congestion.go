@@ -0,0 +1,236 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+)
+
+// sfCongestionAlertKind is the kind of alerts raised by the SF congestion
+// detector.
+const sfCongestionAlertKind = "sf_congestion"
+
+const (
+	// sfCongestionBuckets is the number of buckets the window is divided in
+	sfCongestionBuckets = 12
+	// sfCongestionMaxDevices limits the devices tracked per gateway
+	sfCongestionMaxDevices = 256
+	// sfCongestionTopDevices is the number of devices listed in advisories
+	sfCongestionTopDevices = 5
+)
+
+// SFCongestionDetector detects gateways where most airtime is used by uplinks
+// on spreading factor 11 and 12. These frames take up to 20 times longer than
+// SF7 frames and saturate the channel, often because devices don't use
+// ADR. Advisories list the devices that use most high-SF airtime.
+type SFCongestionDetector struct {
+	window     time.Duration
+	threshold  float64
+	minAirtime time.Duration
+	alerter    *Alerter
+
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*sfCongestionGateway
+}
+
+type sfCongestionBucket struct {
+	stamp  int64
+	total  time.Duration
+	highSF time.Duration
+}
+
+type sfCongestionGateway struct {
+	localID lorawan.EUI64
+	buckets [sfCongestionBuckets]sfCongestionBucket
+	// devices holds the high SF airtime per device in the current window
+	devices map[string]time.Duration
+	// devicesReset is when devices was last cleared
+	devicesReset time.Time
+}
+
+// NewSFCongestionDetector returns a detector configured from cfg that raises
+// advisories on alerter.
+func NewSFCongestionDetector(cfg *ForwarderSFCongestionConfig, alerter *Alerter) *SFCongestionDetector {
+	d := &SFCongestionDetector{
+		window:     time.Hour,
+		threshold:  0.5,
+		minAirtime: time.Minute,
+		alerter:    alerter,
+		gateways:   make(map[lorawan.EUI64]*sfCongestionGateway),
+	}
+	if cfg.Window != nil && *cfg.Window >= sfCongestionBuckets*time.Second {
+		d.window = *cfg.Window
+	}
+	if cfg.Threshold != nil && *cfg.Threshold > 0 && *cfg.Threshold <= 1 {
+		d.threshold = *cfg.Threshold
+	}
+	if cfg.MinAirtime != nil {
+		d.minAirtime = *cfg.MinAirtime
+	}
+	return d
+}
+
+func (d *SFCongestionDetector) bucketSize() time.Duration {
+	return d.window / sfCongestionBuckets
+}
+
+// Record adds an uplink received by gw on the given spreading factor. Device
+// identifies the sender, the DevAddr for data uplinks or the DevEUI for join
+// requests.
+func (d *SFCongestionDetector) Record(gw *gateway.Gateway, sf uint32, airtime time.Duration, device string, at time.Time) {
+	stamp := at.UnixNano() / int64(d.bucketSize())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.gateways[gw.NetworkID]
+	if !ok {
+		g = &sfCongestionGateway{
+			localID:      gw.LocalID,
+			devices:      make(map[string]time.Duration),
+			devicesReset: at,
+		}
+		d.gateways[gw.NetworkID] = g
+	}
+
+	b := &g.buckets[stamp%sfCongestionBuckets]
+	if b.stamp != stamp {
+		*b = sfCongestionBucket{stamp: stamp}
+	}
+	b.total += airtime
+	if sf < 11 {
+		return
+	}
+	b.highSF += airtime
+
+	if _, ok := g.devices[device]; ok || len(g.devices) < sfCongestionMaxDevices {
+		g.devices[device] += airtime
+	}
+}
+
+// sfCongestionStatus is the high SF airtime share of a gateway in the window.
+type sfCongestionStatus struct {
+	GatewayNetworkID lorawan.EUI64
+	GatewayLocalID   lorawan.EUI64
+	Airtime          time.Duration
+	HighSFAirtime    time.Duration
+	Ratio            float64
+	TopDevices       []string
+}
+
+func (d *SFCongestionDetector) status(now time.Time) []sfCongestionStatus {
+	from := now.Add(-d.window).UnixNano() / int64(d.bucketSize())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	statuses := make([]sfCongestionStatus, 0, len(d.gateways))
+	for networkID, g := range d.gateways {
+		s := sfCongestionStatus{GatewayNetworkID: networkID, GatewayLocalID: g.localID}
+		for _, b := range g.buckets {
+			if b.stamp > from {
+				s.Airtime += b.total
+				s.HighSFAirtime += b.highSF
+			}
+		}
+		if s.Airtime == 0 {
+			delete(d.gateways, networkID)
+			continue
+		}
+		s.Ratio = float64(s.HighSFAirtime) / float64(s.Airtime)
+
+		devices := make([]string, 0, len(g.devices))
+		for device := range g.devices {
+			devices = append(devices, device)
+		}
+		sort.Slice(devices, func(i, j int) bool { return g.devices[devices[i]] > g.devices[devices[j]] })
+		if len(devices) > sfCongestionTopDevices {
+			devices = devices[:sfCongestionTopDevices]
+		}
+		s.TopDevices = devices
+
+		// device attribution covers roughly one window
+		if now.Sub(g.devicesReset) >= d.window {
+			g.devices = make(map[string]time.Duration)
+			g.devicesReset = now
+		}
+
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// evaluate raises advisories for congested gateways and resolves advisories
+// of gateways that are no longer congested.
+func (d *SFCongestionDetector) evaluate(now time.Time) {
+	congested := make(map[string]bool)
+	for _, s := range d.status(now) {
+		gatewayGauge(highSFAirtimeRatioGauge, s.GatewayNetworkID, s.GatewayLocalID).Set(s.Ratio)
+		if s.Airtime < d.minAirtime || s.Ratio < d.threshold {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s", sfCongestionAlertKind, s.GatewayNetworkID)
+		congested[key] = true
+
+		severity := AlertSeverityWarning
+		if s.Ratio >= (1+d.threshold)/2 {
+			severity = AlertSeverityCritical
+		}
+		networkID, localID := s.GatewayNetworkID, s.GatewayLocalID
+		d.alerter.Raise(Alert{
+			Key:              key,
+			Kind:             sfCongestionAlertKind,
+			Severity:         severity,
+			GatewayNetworkID: &networkID,
+			GatewayLocalID:   &localID,
+			Summary: fmt.Sprintf("%.0f%% of airtime on gateway %s is used by SF11/SF12 uplinks, devices likely don't use ADR",
+				100*s.Ratio, s.GatewayNetworkID),
+			Details: map[string]interface{}{
+				"window":        d.window.String(),
+				"airtimeMs":     s.Airtime.Milliseconds(),
+				"highSfAirtime": s.HighSFAirtime.Milliseconds(),
+				"ratio":         s.Ratio,
+				"topDevices":    s.TopDevices,
+			},
+		})
+	}
+	d.alerter.ResolveKind(sfCongestionAlertKind, func(key string) bool { return congested[key] })
+}
+
+// Run evaluates the gateways periodically until ctx expires.
+func (d *SFCongestionDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			highSFAirtimeRatioGauge.Reset()
+			d.evaluate(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
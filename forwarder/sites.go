@@ -0,0 +1,378 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/common"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// siteTagPrefix is the prefix of the gateway tag that assigns a gateway to a
+// site, e.g. site:amsterdam-north.
+const siteTagPrefix = "site:"
+
+// site states
+const (
+	siteEnabled  = "enabled"
+	siteDisabled = "disabled"
+	sitePartial  = "partial"
+)
+
+// Site groups the gateways of a deployment at the same location.
+type Site struct {
+	ID string
+	// Metadata holds the name, contact and location of the site
+	Metadata gateway.GatewayMetadata
+}
+
+// Sites groups gateways by their site tag and reports on them per site.
+type Sites struct {
+	sites        []*Site
+	byID         map[string]*Site
+	gateways     gateway.GatewayStore
+	channelStats *ChannelStats
+	presence     func() map[lorawan.EUI64]gatewayPresence
+}
+
+// NewSites returns the sites from cfg, gateways are looked up in store and
+// their stats in channelStats and presence.
+func NewSites(cfg []ForwarderSiteConfig, store gateway.GatewayStore, channelStats *ChannelStats, presence func() map[lorawan.EUI64]gatewayPresence) (*Sites, error) {
+	sites := &Sites{
+		byID:         make(map[string]*Site),
+		gateways:     store,
+		channelStats: channelStats,
+		presence:     presence,
+	}
+	for i, c := range cfg {
+		id := strings.TrimSpace(c.ID)
+		if id == "" || strings.ContainsAny(id, ", \t") {
+			return nil, fmt.Errorf("site %d: invalid id %q", i, c.ID)
+		}
+		if _, ok := sites.byID[id]; ok {
+			return nil, fmt.Errorf("site %d: duplicate id %q", i, id)
+		}
+		site := &Site{
+			ID: id,
+			Metadata: gateway.GatewayMetadata{
+				Name:      c.Name,
+				Contact:   c.Contact,
+				Latitude:  c.Latitude,
+				Longitude: c.Longitude,
+				Altitude:  c.Altitude,
+			},
+		}
+		if err := site.Metadata.Validate(); err != nil {
+			return nil, fmt.Errorf("site %s: %w", id, err)
+		}
+		sites.sites = append(sites.sites, site)
+		sites.byID[id] = site
+	}
+	if len(sites.sites) > 0 {
+		logrus.WithField("sites", len(sites.sites)).Info("group gateways in sites")
+	}
+	return sites, nil
+}
+
+// Of returns the site gw is tagged with, the first tag of a configured site
+// is used when the gateway has multiple site tags.
+func (s *Sites) Of(gw *gateway.Gateway) (*Site, bool) {
+	if len(s.sites) == 0 {
+		return nil, false
+	}
+	for _, tag := range gw.Tags {
+		if strings.HasPrefix(tag, siteTagPrefix) {
+			if site, ok := s.byID[strings.TrimPrefix(tag, siteTagPrefix)]; ok {
+				return site, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// setFrameMetadata adds the site of gw to the frame metadata. The site
+// location is used when the frame has no location from the gateway, the
+// registry or the gateway metadata.
+func (s *Sites) setFrameMetadata(frame *gw.UplinkFrame, gw *gateway.Gateway) {
+	site, ok := s.Of(gw)
+	if !ok {
+		return
+	}
+	metadata := frame.RxInfo.Metadata
+	metadata["thingsix_site"] = site.ID
+	if site.Metadata.Name != "" {
+		metadata["thingsix_site_name"] = site.Metadata.Name
+	}
+	m := site.Metadata
+	if m.Latitude != nil && m.Longitude != nil {
+		metadata["thingsix_site_latitude"] = fmt.Sprintf("%f", *m.Latitude)
+		metadata["thingsix_site_longitude"] = fmt.Sprintf("%f", *m.Longitude)
+		if frame.RxInfo.Location == nil {
+			frame.RxInfo.Location = &common.Location{
+				Source:    common.LocationSource_CONFIG,
+				Latitude:  *m.Latitude,
+				Longitude: *m.Longitude,
+			}
+			if m.Altitude != nil {
+				frame.RxInfo.Location.Altitude = *m.Altitude
+			}
+		}
+	}
+}
+
+// SiteGateway is a gateway in a site report.
+type SiteGateway struct {
+	LocalID   lorawan.EUI64 `json:"localId"`
+	NetworkID lorawan.EUI64 `json:"networkId"`
+	Name      string        `json:"name,omitempty"`
+	Disabled  bool          `json:"disabled,omitempty"`
+	Connected bool          `json:"connected"`
+	// LastSeen is the time the last uplink or stats message was received
+	// since the forwarder started
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	// Uplinks is the number of uplinks received since the forwarder started
+	Uplinks uint64 `json:"uplinks"`
+}
+
+// SiteReport describes a site and the aggregate stats of its gateways.
+type SiteReport struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	Contact   string   `json:"contact,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	// State is enabled, disabled or partial when only some of the gateways
+	// are disabled
+	State     string `json:"state"`
+	Gateways  int    `json:"gateways"`
+	Connected int    `json:"connected"`
+	Disabled  int    `json:"disabled"`
+	// Uplinks is the number of uplinks received by the gateways of the site
+	// since the forwarder started
+	Uplinks    uint64        `json:"uplinks"`
+	LastUplink *time.Time    `json:"lastUplink,omitempty"`
+	LastSeen   *time.Time    `json:"lastSeen,omitempty"`
+	Members    []SiteGateway `json:"members"`
+}
+
+// SitesReport holds the reports of all sites.
+type SitesReport struct {
+	Sites []SiteReport `json:"sites"`
+}
+
+// Report returns the reports of all sites in configuration order.
+func (s *Sites) Report(now time.Time) SitesReport {
+	members := s.members()
+	report := SitesReport{Sites: make([]SiteReport, 0, len(s.sites))}
+	for _, site := range s.sites {
+		report.Sites = append(report.Sites, s.report(site, members[site.ID], now))
+	}
+	return report
+}
+
+// Site returns the report of the site with the given id.
+func (s *Sites) Site(id string, now time.Time) (SiteReport, error) {
+	site, ok := s.byID[id]
+	if !ok {
+		return SiteReport{}, ErrSiteNotFound
+	}
+	return s.report(site, s.members()[id], now), nil
+}
+
+// members returns the gateways in the store by site id.
+func (s *Sites) members() map[string][]*gateway.Gateway {
+	members := make(map[string][]*gateway.Gateway)
+	if len(s.sites) == 0 {
+		return members
+	}
+	s.gateways.Range(gateway.GatewayRangerFunc(func(gw *gateway.Gateway) bool {
+		if site, ok := s.Of(gw); ok {
+			members[site.ID] = append(members[site.ID], gw)
+		}
+		return true
+	}))
+	return members
+}
+
+func (s *Sites) report(site *Site, gateways []*gateway.Gateway, now time.Time) SiteReport {
+	var (
+		presence = s.presence()
+		report   = SiteReport{
+			ID:        site.ID,
+			Name:      site.Metadata.Name,
+			Contact:   site.Metadata.Contact,
+			Latitude:  site.Metadata.Latitude,
+			Longitude: site.Metadata.Longitude,
+			Altitude:  site.Metadata.Altitude,
+			State:     siteEnabled,
+			Gateways:  len(gateways),
+			Members:   make([]SiteGateway, 0, len(gateways)),
+		}
+	)
+
+	for _, gw := range gateways {
+		member := SiteGateway{
+			LocalID:   gw.LocalID,
+			NetworkID: gw.NetworkID,
+			Disabled:  gw.Disabled,
+		}
+		if gw.Metadata != nil {
+			member.Name = gw.Metadata.Name
+		}
+		if p, ok := presence[gw.LocalID]; ok {
+			lastSeen := p.LastSeen
+			member.Connected, member.LastSeen = true, &lastSeen
+			report.Connected++
+			if report.LastSeen == nil || lastSeen.After(*report.LastSeen) {
+				report.LastSeen = &lastSeen
+			}
+		}
+		if stats, ok := s.channelStats.Gateway(gw.NetworkID, now); ok {
+			member.Uplinks = stats.Uplinks
+			report.Uplinks += stats.Uplinks
+			if report.LastUplink == nil || stats.LastUplink.After(*report.LastUplink) {
+				lastUplink := stats.LastUplink
+				report.LastUplink = &lastUplink
+			}
+		}
+		if gw.Disabled {
+			report.Disabled++
+		}
+		report.Members = append(report.Members, member)
+	}
+
+	switch {
+	case report.Disabled > 0 && report.Disabled == report.Gateways:
+		report.State = siteDisabled
+	case report.Disabled > 0:
+		report.State = sitePartial
+	}
+
+	sort.Slice(report.Members, func(i, j int) bool {
+		return bytes.Compare(report.Members[i].LocalID[:], report.Members[j].LocalID[:]) < 0
+	})
+	return report
+}
+
+// SetEnabled enables or disables all gateways of the site with the given id.
+// Gateways are updated independently, failures are reported per gateway.
+func (s *Sites) SetEnabled(ctx context.Context, id string, enabled bool) (BulkGatewayReply, error) {
+	if _, ok := s.byID[id]; !ok {
+		return BulkGatewayReply{}, ErrSiteNotFound
+	}
+	manager, ok := s.gateways.(gateway.GatewayManager)
+	if !ok {
+		return BulkGatewayReply{}, ErrGatewayStoreReadOnly
+	}
+
+	operation := bulkEnable
+	if !enabled {
+		operation = bulkDisable
+	}
+	apply, _ := bulkOperation(BulkGatewayRequest{Operation: operation})
+
+	members := s.members()[id]
+	reply := BulkGatewayReply{
+		Operation: operation,
+		Results:   make([]BulkGatewayResult, 0, len(members)),
+	}
+	for _, gw := range members {
+		result := BulkGatewayResult{
+			Gateway: gw.LocalID.String(),
+			LocalID: gw.LocalID.String(),
+			Status:  "ok",
+		}
+		if updated, err := manager.Update(ctx, gw.LocalID, apply); err != nil {
+			result.Status, result.Error = "error", err.Error()
+			reply.Failed++
+		} else {
+			result.NetworkID = updated.NetworkID.String()
+			reply.Succeeded++
+		}
+		reply.Results = append(reply.Results, result)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"site":      id,
+		"operation": operation,
+		"succeeded": reply.Succeeded,
+		"failed":    reply.Failed,
+	}).Info("site gateways updated")
+
+	return reply, nil
+}
+
+// ListSites returns the sites with the aggregate stats of their gateways.
+func (svc APIService) ListSites(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, svc.sites.Report(time.Now()))
+}
+
+// Site returns the site in the path with the aggregate stats of its
+// gateways.
+func (svc APIService) Site(w http.ResponseWriter, r *http.Request) {
+	report, err := svc.sites.Site(chi.URLParam(r, "site_id"), time.Now())
+	if err != nil {
+		replySiteError(w, r, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, report)
+}
+
+// EnableSite enables all gateways of the site in the path.
+func (svc APIService) EnableSite(w http.ResponseWriter, r *http.Request) {
+	svc.setSiteEnabled(w, r, true)
+}
+
+// DisableSite disables all gateways of the site in the path, data from and
+// to them is dropped until the site or gateways are enabled again.
+func (svc APIService) DisableSite(w http.ResponseWriter, r *http.Request) {
+	svc.setSiteEnabled(w, r, false)
+}
+
+func (svc APIService) setSiteEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	reply, err := svc.sites.SetEnabled(r.Context(), chi.URLParam(r, "site_id"), enabled)
+	if err != nil {
+		replySiteError(w, r, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, reply)
+}
+
+func replySiteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrSiteNotFound):
+		http.NotFound(w, r)
+	case errors.Is(err, ErrGatewayStoreReadOnly):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		logrus.WithError(err).Error("unable to update site")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// Service level indicators tracked by the SLO tracker.
+const (
+	// SLIUplinkDelivery is the ratio of uplinks a router is interested in
+	// that were delivered to the router
+	SLIUplinkDelivery = "uplink_delivery"
+	// SLIDownlinkOnTime is the ratio of downlinks that the gateway reported
+	// as transmitted, other statuses such as TOO_LATE count as failures
+	SLIDownlinkOnTime = "downlink_on_time"
+)
+
+const (
+	sloMinuteBuckets = 6 * 60
+	sloHourBuckets   = 3 * 24
+)
+
+// sloWindows are the rolling windows over which SLIs and burn rates are
+// calculated, pairs of short and long windows are used for multi-window
+// burn rate alerts.
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"1d", 24 * time.Hour},
+	{"3d", 72 * time.Hour},
+}
+
+type sloBucket struct {
+	stamp int64
+	good  uint64
+	total uint64
+}
+
+// sloCounter counts good and total events in per-minute buckets for the
+// last 6 hours and per-hour buckets for the last 3 days.
+type sloCounter struct {
+	minutes [sloMinuteBuckets]sloBucket
+	hours   [sloHourBuckets]sloBucket
+}
+
+func (c *sloCounter) add(now time.Time, good bool) {
+	add := func(b *sloBucket, stamp int64) {
+		if b.stamp != stamp {
+			*b = sloBucket{stamp: stamp}
+		}
+		b.total++
+		if good {
+			b.good++
+		}
+	}
+	minute, hour := now.Unix()/60, now.Unix()/3600
+	add(&c.minutes[minute%sloMinuteBuckets], minute)
+	add(&c.hours[hour%sloHourBuckets], hour)
+}
+
+// sum returns the good and total events within the window before now.
+func (c *sloCounter) sum(now time.Time, window time.Duration) (good, total uint64) {
+	if window <= sloMinuteBuckets*time.Minute {
+		from := now.Add(-window).Unix() / 60
+		for _, b := range c.minutes {
+			if b.stamp > from {
+				good, total = good+b.good, total+b.total
+			}
+		}
+		return good, total
+	}
+	from := now.Add(-window).Unix() / 3600
+	for _, b := range c.hours {
+		if b.stamp > from {
+			good, total = good+b.good, total+b.total
+		}
+	}
+	return good, total
+}
+
+type sloKey struct {
+	sli   string
+	scope string
+	id    string
+}
+
+// SLOTracker computes delivery SLIs per router and per gateway over rolling
+// windows and the rate at which the error budget is burned.
+type SLOTracker struct {
+	targets map[string]float64
+
+	mu     sync.Mutex
+	series map[sloKey]*sloCounter
+	// downlinks maps in-flight downlinks to the router that sent them
+	downlinks map[sloDownlink]sloPendingDownlink
+
+	// latencySLOs are the configured uplink delivery latency objectives
+	latencySLOs []routeLatencySLO
+	// latency holds the uplink delivery latency samples per route
+	latency map[string]*routeLatencyState
+	// alerter is notified when a route exceeds its latency objective
+	alerter *Alerter
+}
+
+type sloDownlink struct {
+	gateway lorawan.EUI64
+	id      uint32
+}
+
+type sloPendingDownlink struct {
+	router string
+	sent   time.Time
+}
+
+// SLOReport is the SLI and burn rate for a router or gateway in a window.
+type SLOReport struct {
+	SLI      string  `json:"sli"`
+	Scope    string  `json:"scope"`
+	ID       string  `json:"id"`
+	Window   string  `json:"window"`
+	Target   float64 `json:"target"`
+	Good     uint64  `json:"good"`
+	Total    uint64  `json:"total"`
+	Ratio    float64 `json:"ratio"`
+	BurnRate float64 `json:"burnRate"`
+}
+
+// NewSLOTracker returns a tracker configured from cfg. Routes that exceed
+// their latency objective are reported to alerter.
+func NewSLOTracker(cfg *ForwarderSLOConfig, alerter *Alerter) *SLOTracker {
+	t := &SLOTracker{
+		targets: map[string]float64{
+			SLIUplinkDelivery: 0.999,
+			SLIDownlinkOnTime: 0.99,
+		},
+		series:      make(map[sloKey]*sloCounter),
+		downlinks:   make(map[sloDownlink]sloPendingDownlink),
+		latencySLOs: newRouteLatencySLOs(cfg.Latency),
+		latency:     make(map[string]*routeLatencyState),
+		alerter:     alerter,
+	}
+	if cfg.UplinkDeliveryTarget != nil && *cfg.UplinkDeliveryTarget > 0 && *cfg.UplinkDeliveryTarget < 1 {
+		t.targets[SLIUplinkDelivery] = *cfg.UplinkDeliveryTarget
+	}
+	if cfg.DownlinkOnTimeTarget != nil && *cfg.DownlinkOnTimeTarget > 0 && *cfg.DownlinkOnTimeTarget < 1 {
+		t.targets[SLIDownlinkOnTime] = *cfg.DownlinkOnTimeTarget
+	}
+	return t
+}
+
+func (t *SLOTracker) record(now time.Time, sli, router string, gateway lorawan.EUI64, good bool) {
+	for _, key := range []sloKey{
+		{sli: sli, scope: "router", id: router},
+		{sli: sli, scope: "gateway", id: gateway.String()},
+	} {
+		c, ok := t.series[key]
+		if !ok {
+			c = new(sloCounter)
+			t.series[key] = c
+		}
+		c.add(now, good)
+	}
+}
+
+// RecordUplink records if an uplink from the gateway that the router is
+// interested in was delivered to the router.
+func (t *SLOTracker) RecordUplink(router string, gateway lorawan.EUI64, delivered bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record(time.Now(), SLIUplinkDelivery, router, gateway, delivered)
+}
+
+// DownlinkSent remembers the router that sent the downlink so its ACK can be
+// attributed to it.
+func (t *SLOTracker) DownlinkSent(router string, gateway lorawan.EUI64, downlinkID uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downlinks[sloDownlink{gateway: gateway, id: downlinkID}] = sloPendingDownlink{router: router, sent: time.Now()}
+}
+
+// RecordTxAck records if the downlink acknowledged by the gateway was
+// transmitted on time.
+func (t *SLOTracker) RecordTxAck(gateway lorawan.EUI64, txack *gw.DownlinkTxAck) {
+	status := gw.TxAckStatus_IGNORED
+	for _, item := range txack.GetItems() {
+		if status = item.GetStatus(); status != gw.TxAckStatus_IGNORED {
+			break
+		}
+	}
+	if status == gw.TxAckStatus_IGNORED {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := sloDownlink{gateway: gateway, id: txack.GetDownlinkId()}
+	pending, ok := t.downlinks[key]
+	if !ok {
+		return // downlink not sent by a router, e.g. simulated
+	}
+	delete(t.downlinks, key)
+	t.record(time.Now(), SLIDownlinkOnTime, pending.router, gateway, status == gw.TxAckStatus_OK)
+}
+
+// Reports returns the SLI and burn rate for all routers and gateways in all
+// windows, ordered by sli, scope, id and window.
+func (t *SLOTracker) Reports(now time.Time) []SLOReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make([]sloKey, 0, len(t.series))
+	for key := range t.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].sli != keys[j].sli {
+			return keys[i].sli < keys[j].sli
+		}
+		if keys[i].scope != keys[j].scope {
+			return keys[i].scope < keys[j].scope
+		}
+		return keys[i].id < keys[j].id
+	})
+
+	reports := make([]SLOReport, 0, len(keys)*len(sloWindows))
+	for _, key := range keys {
+		target := t.targets[key.sli]
+		for _, window := range sloWindows {
+			good, total := t.series[key].sum(now, window.duration)
+			if total == 0 {
+				continue
+			}
+			ratio := float64(good) / float64(total)
+			reports = append(reports, SLOReport{
+				SLI:      key.sli,
+				Scope:    key.scope,
+				ID:       key.id,
+				Window:   window.name,
+				Target:   target,
+				Good:     good,
+				Total:    total,
+				Ratio:    ratio,
+				BurnRate: (1 - ratio) / (1 - target),
+			})
+		}
+	}
+	return reports
+}
+
+// Run periodically exports the SLIs and burn rates as metrics, evaluates
+// the latency objectives and removes series without events in the longest
+// window until ctx expires.
+func (t *SLOTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			t.cleanup(now)
+			t.evaluateLatency(now)
+
+			sliRatioGauge.Reset()
+			sloBurnRateGauge.Reset()
+			for _, r := range t.Reports(now) {
+				if r.Scope == "gateway" {
+					if _, ok := gatewayLabels.distinct(r.ID); !ok {
+						continue
+					}
+				}
+				sliRatioGauge.WithLabelValues(r.SLI, r.Scope, r.ID, r.Window).Set(r.Ratio)
+				sloBurnRateGauge.WithLabelValues(r.SLI, r.Scope, r.ID, r.Window).Set(r.BurnRate)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *SLOTracker) cleanup(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	longest := sloWindows[len(sloWindows)-1].duration
+	for key, c := range t.series {
+		if _, total := c.sum(now, longest); total == 0 {
+			delete(t.series, key)
+		}
+	}
+	for key, pending := range t.downlinks {
+		if now.Sub(pending.sent) > downlinkInflightTimeout {
+			delete(t.downlinks, key)
+		}
+	}
+}
+
+// SLO returns the SLIs and burn rates per router and gateway.
+func (svc APIService) SLO(w http.ResponseWriter, r *http.Request) {
+	if svc.slo == nil {
+		http.Error(w, "SLO reporting not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	replyJSON(w, http.StatusOK, svc.slo.Reports(time.Now()))
+}
+
+// RouteLatency returns the p95 uplink delivery latency per route and the
+// state of its latency objective.
+func (svc APIService) RouteLatency(w http.ResponseWriter, r *http.Request) {
+	if svc.slo == nil {
+		http.Error(w, "SLO reporting not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	replyJSON(w, http.StatusOK, svc.slo.LatencyReports(time.Now()))
+}
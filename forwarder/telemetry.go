@@ -0,0 +1,274 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+const (
+	// telemetryTemperatureAlertKind is the kind of alerts raised for
+	// gateways that run too hot
+	telemetryTemperatureAlertKind = "gateway_temperature"
+	// telemetryVoltageAlertKind is the kind of alerts raised for gateways
+	// with a supply voltage out of range
+	telemetryVoltageAlertKind = "gateway_voltage"
+)
+
+var (
+	defaultTelemetryTemperatureKeys = []string{"temperature", "temp"}
+	defaultTelemetryVoltageKeys     = []string{"voltage", "volt", "vin"}
+)
+
+// GatewayTelemetry keeps the last temperature and supply voltage reported in
+// the stats of each gateway and raises alerts when they cross the configured
+// thresholds. Backends report these values in the stats metadata, gateways
+// that don't report them are not tracked.
+type GatewayTelemetry struct {
+	temperatureKeys     []string
+	voltageKeys         []string
+	temperatureWarning  float64
+	temperatureCritical float64
+	voltageMin          *float64
+	voltageMax          *float64
+	expire              time.Duration
+	alerter             *Alerter
+
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*GatewayTelemetryReading
+}
+
+// GatewayTelemetryReading is the last telemetry reported by a gateway.
+type GatewayTelemetryReading struct {
+	GatewayNetworkID lorawan.EUI64 `json:"gatewayNetworkId"`
+	GatewayLocalID   lorawan.EUI64 `json:"gatewayLocalId"`
+	// Temperature in degree Celsius, nil if not reported
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Voltage is the supply voltage in Volt, nil if not reported
+	Voltage *float64  `json:"voltage,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// NewGatewayTelemetry returns telemetry tracking configured from cfg that
+// raises alerts on alerter.
+func NewGatewayTelemetry(cfg *ForwarderTelemetryConfig, alerter *Alerter) *GatewayTelemetry {
+	t := &GatewayTelemetry{
+		temperatureKeys:     defaultTelemetryTemperatureKeys,
+		voltageKeys:         defaultTelemetryVoltageKeys,
+		temperatureWarning:  70,
+		temperatureCritical: 85,
+		voltageMin:          cfg.VoltageMin,
+		voltageMax:          cfg.VoltageMax,
+		expire:              time.Hour,
+		alerter:             alerter,
+		gateways:            make(map[lorawan.EUI64]*GatewayTelemetryReading),
+	}
+	if len(cfg.TemperatureKeys) > 0 {
+		t.temperatureKeys = cfg.TemperatureKeys
+	}
+	if len(cfg.VoltageKeys) > 0 {
+		t.voltageKeys = cfg.VoltageKeys
+	}
+	if cfg.TemperatureWarning != nil {
+		t.temperatureWarning = *cfg.TemperatureWarning
+	}
+	if cfg.TemperatureCritical != nil {
+		t.temperatureCritical = *cfg.TemperatureCritical
+	}
+	if t.temperatureCritical < t.temperatureWarning {
+		t.temperatureCritical = t.temperatureWarning
+	}
+	if cfg.Expire != nil && *cfg.Expire > 0 {
+		t.expire = *cfg.Expire
+	}
+	return t
+}
+
+// metadataFloat returns the first metadata value of the given keys that is
+// a number.
+func metadataFloat(metadata map[string]string, keys []string) *float64 {
+	for _, key := range keys {
+		if v, ok := metadata[key]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return &f
+			}
+		}
+	}
+	return nil
+}
+
+// Record stores the telemetry from the stats that gw sent and raises or
+// resolves alerts for it.
+func (t *GatewayTelemetry) Record(gw *gateway.Gateway, stats *gw.GatewayStats) {
+	var (
+		temperature = metadataFloat(stats.GetMetadata(), t.temperatureKeys)
+		voltage     = metadataFloat(stats.GetMetadata(), t.voltageKeys)
+	)
+	if temperature == nil && voltage == nil {
+		return
+	}
+
+	reading := GatewayTelemetryReading{
+		GatewayNetworkID: gw.NetworkID,
+		GatewayLocalID:   gw.LocalID,
+		Temperature:      temperature,
+		Voltage:          voltage,
+		Updated:          time.Now(),
+	}
+
+	t.mu.Lock()
+	t.gateways[gw.NetworkID] = &reading
+	t.mu.Unlock()
+
+	if temperature != nil {
+		gatewayGauge(gatewayTemperatureGauge, gw.NetworkID, gw.LocalID).Set(*temperature)
+	}
+	if voltage != nil {
+		gatewayGauge(gatewayVoltageGauge, gw.NetworkID, gw.LocalID).Set(*voltage)
+	}
+	t.evaluate(&reading)
+}
+
+// evaluate raises alerts for readings that cross a threshold and resolves
+// alerts for readings that are back within range.
+func (t *GatewayTelemetry) evaluate(r *GatewayTelemetryReading) {
+	var (
+		networkID, localID = r.GatewayNetworkID, r.GatewayLocalID
+		temperatureKey     = fmt.Sprintf("%s/%s", telemetryTemperatureAlertKind, networkID)
+		voltageKey         = fmt.Sprintf("%s/%s", telemetryVoltageAlertKind, networkID)
+	)
+
+	if r.Temperature != nil {
+		if *r.Temperature >= t.temperatureWarning {
+			severity, threshold := AlertSeverityWarning, t.temperatureWarning
+			if *r.Temperature >= t.temperatureCritical {
+				severity, threshold = AlertSeverityCritical, t.temperatureCritical
+			}
+			t.alerter.Raise(Alert{
+				Key:              temperatureKey,
+				Kind:             telemetryTemperatureAlertKind,
+				Severity:         severity,
+				GatewayNetworkID: &networkID,
+				GatewayLocalID:   &localID,
+				Summary:          fmt.Sprintf("gateway %s reports a temperature of %.1f°C", networkID, *r.Temperature),
+				Details: map[string]interface{}{
+					"temperature": *r.Temperature,
+					"threshold":   threshold,
+				},
+			})
+		} else {
+			t.alerter.Resolve(temperatureKey)
+		}
+	}
+
+	if r.Voltage != nil {
+		low := t.voltageMin != nil && *r.Voltage < *t.voltageMin
+		high := t.voltageMax != nil && *r.Voltage > *t.voltageMax
+		if low || high {
+			details := map[string]interface{}{"voltage": *r.Voltage}
+			if t.voltageMin != nil {
+				details["min"] = *t.voltageMin
+			}
+			if t.voltageMax != nil {
+				details["max"] = *t.voltageMax
+			}
+			t.alerter.Raise(Alert{
+				Key:              voltageKey,
+				Kind:             telemetryVoltageAlertKind,
+				Severity:         AlertSeverityWarning,
+				GatewayNetworkID: &networkID,
+				GatewayLocalID:   &localID,
+				Summary:          fmt.Sprintf("gateway %s reports a supply voltage of %.2fV which is out of range", networkID, *r.Voltage),
+				Details:          details,
+			})
+		} else {
+			t.alerter.Resolve(voltageKey)
+		}
+	}
+}
+
+// Gateways returns the last telemetry of all gateways, ordered by network id.
+func (t *GatewayTelemetry) Gateways() []GatewayTelemetryReading {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	readings := make([]GatewayTelemetryReading, 0, len(t.gateways))
+	for _, r := range t.gateways {
+		readings = append(readings, *r)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].GatewayNetworkID.String() < readings[j].GatewayNetworkID.String()
+	})
+	return readings
+}
+
+// expireReadings removes readings of gateways that didn't report telemetry
+// within the expire period and resolves their alerts.
+func (t *GatewayTelemetry) expireReadings(now time.Time) {
+	var expired []*GatewayTelemetryReading
+
+	t.mu.Lock()
+	for networkID, r := range t.gateways {
+		if now.Sub(r.Updated) > t.expire {
+			delete(t.gateways, networkID)
+			expired = append(expired, r)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, r := range expired {
+		gatewayTemperatureGauge.DeleteLabelValues(r.GatewayNetworkID.String(), r.GatewayLocalID.String())
+		gatewayVoltageGauge.DeleteLabelValues(r.GatewayNetworkID.String(), r.GatewayLocalID.String())
+		t.alerter.Resolve(fmt.Sprintf("%s/%s", telemetryTemperatureAlertKind, r.GatewayNetworkID))
+		t.alerter.Resolve(fmt.Sprintf("%s/%s", telemetryVoltageAlertKind, r.GatewayNetworkID))
+	}
+}
+
+// Run expires stale readings periodically until ctx expires.
+func (t *GatewayTelemetry) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.expireReadings(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GatewayTelemetry returns the last reported temperature and supply voltage
+// per gateway.
+func (svc APIService) GatewayTelemetry(w http.ResponseWriter, r *http.Request) {
+	if svc.telemetry == nil {
+		http.Error(w, "gateway telemetry not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	replyJSON(w, http.StatusOK, svc.telemetry.Gateways())
+}
@@ -0,0 +1,329 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/logging"
+	"github.com/brocaar/lorawan"
+	"github.com/gorilla/websocket"
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	TopCmd = &cobra.Command{
+		Use:   "top",
+		Short: "Show live per-site and per-gateway packet rates, router latency and queue depths",
+		Args:  cobra.NoArgs,
+		Run:   top,
+	}
+
+	topInterval time.Duration
+	topWindow   time.Duration
+)
+
+func init() {
+	TopCmd.Flags().DurationVar(&topInterval, "interval", 2*time.Second, "screen refresh interval")
+	TopCmd.Flags().DurationVar(&topWindow, "window", time.Minute, "window over which packet rates are calculated")
+}
+
+// topGateway holds the packet counts for a gateway in one second buckets.
+type topGateway struct {
+	localID lorawan.EUI64
+	// buckets holds per second counts for uplinks, joins and downlinks
+	buckets  map[int64]*[3]uint64
+	lastRSSI int32
+	lastSNR  float32
+	lastSeen time.Time
+}
+
+type topState struct {
+	mu       sync.Mutex
+	gateways map[lorawan.EUI64]*topGateway
+	dropped  uint64
+	events   uint64
+}
+
+func top(cmd *cobra.Command, args []string) {
+	logging.SetDefaultLevel(logrus.ErrorLevel)
+
+	cfg := mustLoadConfig(true)
+	if cfg.Forwarder.Gateways.HttpAPI.Address == "" {
+		logrus.Fatal("HTTP API endpoint missing")
+	}
+	if topWindow < time.Second {
+		logrus.Fatal("window must be at least 1s")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var (
+		addr  = cfg.Forwarder.Gateways.HttpAPI.Address
+		state = &topState{gateways: make(map[lorawan.EUI64]*topGateway)}
+	)
+
+	go state.stream(ctx, fmt.Sprintf("ws://%s/v1/events/stream", addr))
+
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	for {
+		var (
+			stats RuntimeStats
+			sites SitesReport
+		)
+		err := topFetch(ctx, fmt.Sprintf("http://%s/v1/stats/runtime", addr), &stats)
+		// older forwarders don't serve sites, don't show them in that case
+		if topFetch(ctx, fmt.Sprintf("http://%s/v1/sites", addr), &sites) != nil {
+			sites.Sites = nil
+		}
+		state.render(addr, &stats, err, sites.Sites)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stream receives packet events from the forwarder until ctx expires, the
+// connection is re-established when it is lost.
+func (s *topState) stream(ctx context.Context, url string) {
+	for ctx.Err() == nil {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if err != nil {
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		go func() {
+			<-ctx.Done()
+			_ = conn.Close()
+		}()
+
+		for {
+			var msg eventStreamMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				_ = conn.Close()
+				break
+			}
+			s.record(&msg)
+		}
+	}
+}
+
+func (s *topState) record(msg *eventStreamMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.Type == "dropped" {
+		s.dropped += msg.Dropped
+		return
+	}
+	ev := msg.Event
+	if ev == nil {
+		return
+	}
+	s.events++
+
+	gw, ok := s.gateways[ev.GatewayNetworkID]
+	if !ok {
+		gw = &topGateway{localID: ev.GatewayLocalID, buckets: make(map[int64]*[3]uint64)}
+		s.gateways[ev.GatewayNetworkID] = gw
+	}
+
+	sec := ev.Time.Unix()
+	bucket, ok := gw.buckets[sec]
+	if !ok {
+		bucket = new([3]uint64)
+		gw.buckets[sec] = bucket
+	}
+	switch ev.Type {
+	case PacketEventUplink, PacketEventProprietary:
+		bucket[0]++
+		gw.lastRSSI, gw.lastSNR = ev.RSSI, ev.SNR
+	case PacketEventJoin:
+		bucket[1]++
+		gw.lastRSSI, gw.lastSNR = ev.RSSI, ev.SNR
+	case PacketEventDownlink:
+		bucket[2]++
+	}
+	gw.lastSeen = ev.Time
+}
+
+// topFetch retrieves url from the API and decodes the JSON reply into v.
+func topFetch(ctx context.Context, url string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected reply from API: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// render draws the screen in one write to prevent flickering.
+func (s *topState) render(addr string, stats *RuntimeStats, statsErr error, sites []SiteReport) {
+	var (
+		out   bytes.Buffer
+		now   = time.Now()
+		since = now.Add(-topWindow).Unix()
+		perS  = float64(topWindow) / float64(time.Second)
+	)
+
+	s.mu.Lock()
+	type row struct {
+		networkID lorawan.EUI64
+		gw        *topGateway
+		counts    [3]uint64
+	}
+	rows := make([]row, 0, len(s.gateways))
+	for id, gw := range s.gateways {
+		r := row{networkID: id, gw: gw}
+		for sec, bucket := range gw.buckets {
+			if sec < since {
+				delete(gw.buckets, sec)
+				continue
+			}
+			for i := range r.counts {
+				r.counts[i] += bucket[i]
+			}
+		}
+		rows = append(rows, r)
+	}
+	events, dropped := s.events, s.dropped
+	s.mu.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].counts[0] != rows[j].counts[0] {
+			return rows[i].counts[0] > rows[j].counts[0]
+		}
+		return bytes.Compare(rows[i].networkID[:], rows[j].networkID[:]) < 0
+	})
+
+	downlinks := make(map[lorawan.EUI64]GatewayDownlinkStats)
+	for _, d := range stats.Downlinks {
+		downlinks[d.NetworkID] = d
+	}
+
+	out.WriteString("\033[H\033[2J") // move cursor home and clear screen
+	fmt.Fprintf(&out, "forwarder %s - %s - events: %d, dropped: %d, window: %s\n\n",
+		addr, now.Format("15:04:05"), events, dropped, topWindow)
+
+	if statsErr != nil {
+		fmt.Fprintf(&out, "unable to retrieve runtime stats: %v\n\n", statsErr)
+	} else {
+		table := tablewriter.NewWriter(&out)
+		table.SetHeader([]string{"router", "endpoint", "online", "latency"})
+		for _, r := range stats.Routers {
+			latency := "-"
+			if r.LatencyMs > 0 {
+				latency = fmt.Sprintf("%.0fms", r.LatencyMs)
+			}
+			table.Append([]string{r.Name, r.Endpoint, fmt.Sprintf("%v", r.Online), latency})
+		}
+		table.Render()
+		out.WriteString("\n")
+
+		table = tablewriter.NewWriter(&out)
+		table.SetHeader([]string{"queue", "length", "capacity"})
+		for _, q := range stats.Queues {
+			table.Append([]string{q.Name, fmt.Sprintf("%d", q.Length), fmt.Sprintf("%d", q.Capacity)})
+		}
+		table.Render()
+		out.WriteString("\n")
+	}
+
+	if len(sites) > 0 {
+		counts := make(map[lorawan.EUI64][3]uint64, len(rows))
+		for _, r := range rows {
+			counts[r.networkID] = r.counts
+		}
+		table := tablewriter.NewWriter(&out)
+		table.SetHeader([]string{"site", "state", "connected", "disabled", "uplinks/s", "joins/s", "downlinks/s"})
+		for _, site := range sites {
+			var total [3]uint64
+			for _, member := range site.Members {
+				c := counts[member.NetworkID]
+				for i := range total {
+					total[i] += c[i]
+				}
+			}
+			name := site.ID
+			if site.Name != "" {
+				name = site.Name
+			}
+			table.Append([]string{
+				name,
+				site.State,
+				fmt.Sprintf("%d/%d", site.Connected, site.Gateways),
+				fmt.Sprintf("%d", site.Disabled),
+				fmt.Sprintf("%.2f", float64(total[0])/perS),
+				fmt.Sprintf("%.2f", float64(total[1])/perS),
+				fmt.Sprintf("%.2f", float64(total[2])/perS),
+			})
+		}
+		table.Render()
+		out.WriteString("\n")
+	}
+
+	table := tablewriter.NewWriter(&out)
+	table.SetHeader([]string{"network_id", "local_id", "uplinks/s", "joins/s", "downlinks/s", "inflight", "rssi", "snr", "last seen"})
+	for _, r := range rows {
+		table.Append([]string{
+			r.networkID.String(),
+			r.gw.localID.String(),
+			fmt.Sprintf("%.2f", float64(r.counts[0])/perS),
+			fmt.Sprintf("%.2f", float64(r.counts[1])/perS),
+			fmt.Sprintf("%.2f", float64(r.counts[2])/perS),
+			fmt.Sprintf("%d", downlinks[r.networkID].Inflight),
+			fmt.Sprintf("%d", r.gw.lastRSSI),
+			fmt.Sprintf("%.1f", r.gw.lastSNR),
+			fmt.Sprintf("%s ago", now.Sub(r.gw.lastSeen).Truncate(time.Second)),
+		})
+	}
+	table.Render()
+
+	_, _ = os.Stdout.Write(out.Bytes())
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/ThingsIXFoundation/packet-handling/forwarder")
+
+// startUplinkSpan starts the root span for an uplink that is received from
+// a gateway backend. The span covers the exchange, delivery to each router
+// is recorded in child spans.
+func startUplinkSpan(frame *gw.UplinkFrame, packetID string) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "forwarder.uplink",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("thingsix.packet_id", packetID),
+			attribute.String("thingsix.gw_local_id", frame.GetRxInfo().GetGatewayId()),
+			attribute.Int64("lora.frequency", int64(frame.GetTxInfo().GetFrequency())),
+			attribute.Int64("lora.spreading_factor", int64(frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor())),
+		))
+}
+
+// startDeliverySpan starts the span for sending the uplink to the router as
+// child of the uplink span in the frame metadata. The router continues the
+// trace from the same metadata.
+func startDeliverySpan(frame *gw.UplinkFrame, router string) trace.Span {
+	ctx := tracing.ExtractMetadata(context.Background(), frame.GetRxInfo().GetMetadata())
+	_, span := tracer.Start(ctx, "forwarder.deliver",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("thingsix.packet_id", uplinkPacketID(frame)),
+			attribute.String("thingsix.router", router),
+		))
+	return span
+}
+
+// endSpan ends the span and marks it as failed when err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
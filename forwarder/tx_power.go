@@ -0,0 +1,224 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// CountryChannel is a frequency range in which transmissions are allowed up
+// to a maximum EIRP.
+type CountryChannel struct {
+	// MinFrequency is the lower bound of the range in Hz
+	MinFrequency uint32 `json:"minFrequency"`
+	// MaxFrequency is the upper bound of the range in Hz
+	MaxFrequency uint32 `json:"maxFrequency"`
+	// MaxEIRP is the maximum transmit power in dBm EIRP
+	MaxEIRP int32 `json:"maxEirp"`
+}
+
+// CountryProfile holds the regulatory limits for downlinks in a country.
+type CountryProfile struct {
+	// Country is the ISO 3166-1 alpha-2 code
+	Country string `json:"country"`
+	// Channels are the frequency ranges the forwarder is allowed to transmit
+	// on, downlinks outside these ranges are dropped
+	Channels []CountryChannel `json:"channels"`
+}
+
+// channel returns the channel that contains the given frequency.
+func (p *CountryProfile) channel(frequency uint32) (CountryChannel, bool) {
+	for _, ch := range p.Channels {
+		if frequency >= ch.MinFrequency && frequency <= ch.MaxFrequency {
+			return ch, true
+		}
+	}
+	return CountryChannel{}, false
+}
+
+// Channel plans shared by countries that follow the same regulation. The
+// limits follow the LoRaWAN regional parameters and are conservative, a
+// profile can be overridden from the configuration when local regulation
+// allows more.
+var (
+	// ETSI EN 300 220, sub-bands h1.3 - h1.7
+	etsiChannels = []CountryChannel{
+		{MinFrequency: 863_000_000, MaxFrequency: 869_200_000, MaxEIRP: 16},
+		{MinFrequency: 869_400_000, MaxFrequency: 869_650_000, MaxEIRP: 27},
+		{MinFrequency: 869_700_000, MaxFrequency: 870_000_000, MaxEIRP: 16},
+	}
+	// FCC part 15.247
+	fccChannels = []CountryChannel{
+		{MinFrequency: 902_000_000, MaxFrequency: 928_000_000, MaxEIRP: 30},
+	}
+	// ACMA LIPD class licence
+	acmaChannels = []CountryChannel{
+		{MinFrequency: 915_000_000, MaxFrequency: 928_000_000, MaxEIRP: 30},
+	}
+	// ARIB STD-T108
+	aribChannels = []CountryChannel{
+		{MinFrequency: 920_600_000, MaxFrequency: 928_000_000, MaxEIRP: 16},
+	}
+)
+
+// countryProfiles are the built-in regulatory profiles.
+var countryProfiles = map[string]*CountryProfile{
+	"AT": {Country: "AT", Channels: etsiChannels},
+	"BE": {Country: "BE", Channels: etsiChannels},
+	"CH": {Country: "CH", Channels: etsiChannels},
+	"CZ": {Country: "CZ", Channels: etsiChannels},
+	"DE": {Country: "DE", Channels: etsiChannels},
+	"DK": {Country: "DK", Channels: etsiChannels},
+	"ES": {Country: "ES", Channels: etsiChannels},
+	"FI": {Country: "FI", Channels: etsiChannels},
+	"FR": {Country: "FR", Channels: etsiChannels},
+	"GB": {Country: "GB", Channels: etsiChannels},
+	"IE": {Country: "IE", Channels: etsiChannels},
+	"IT": {Country: "IT", Channels: etsiChannels},
+	"LU": {Country: "LU", Channels: etsiChannels},
+	"NL": {Country: "NL", Channels: etsiChannels},
+	"NO": {Country: "NO", Channels: etsiChannels},
+	"PL": {Country: "PL", Channels: etsiChannels},
+	"PT": {Country: "PT", Channels: etsiChannels},
+	"SE": {Country: "SE", Channels: etsiChannels},
+	"US": {Country: "US", Channels: fccChannels},
+	"CA": {Country: "CA", Channels: fccChannels},
+	"MX": {Country: "MX", Channels: fccChannels},
+	"AU": {Country: "AU", Channels: acmaChannels},
+	"NZ": {Country: "NZ", Channels: acmaChannels},
+	"BR": {Country: "BR", Channels: []CountryChannel{
+		{MinFrequency: 902_000_000, MaxFrequency: 907_500_000, MaxEIRP: 30},
+		{MinFrequency: 915_000_000, MaxFrequency: 928_000_000, MaxEIRP: 30},
+	}},
+	"IN": {Country: "IN", Channels: []CountryChannel{
+		{MinFrequency: 865_000_000, MaxFrequency: 867_000_000, MaxEIRP: 30},
+	}},
+	"JP": {Country: "JP", Channels: aribChannels},
+	"KR": {Country: "KR", Channels: []CountryChannel{
+		{MinFrequency: 920_900_000, MaxFrequency: 923_300_000, MaxEIRP: 14},
+	}},
+	"RU": {Country: "RU", Channels: []CountryChannel{
+		{MinFrequency: 864_000_000, MaxFrequency: 870_000_000, MaxEIRP: 16},
+	}},
+	"CN": {Country: "CN", Channels: []CountryChannel{
+		{MinFrequency: 470_000_000, MaxFrequency: 510_000_000, MaxEIRP: 19},
+	}},
+}
+
+// TxPowerLimiter enforces the regulatory profile of the country a gateway is
+// located in on downlinks. Routers can request any transmit power and
+// frequency, the limiter makes sure the forwarder never instructs a gateway
+// to transmit outside the local limits.
+type TxPowerLimiter struct {
+	profiles map[string]*CountryProfile
+	// defaultCountry is used for gateways without an explicit country
+	defaultCountry string
+	// gateways maps gateway local ids to their country
+	gateways map[lorawan.EUI64]string
+}
+
+// NewTxPowerLimiter returns a limiter with the built-in profiles extended and
+// overridden by the profiles in cfg.
+func NewTxPowerLimiter(cfg *ForwarderTxPowerConfig) (*TxPowerLimiter, error) {
+	l := &TxPowerLimiter{
+		profiles:       make(map[string]*CountryProfile, len(countryProfiles)),
+		defaultCountry: strings.ToUpper(cfg.Country),
+		gateways:       make(map[lorawan.EUI64]string, len(cfg.Gateways)),
+	}
+	for country, profile := range countryProfiles {
+		l.profiles[country] = profile
+	}
+
+	for country, profile := range cfg.Profiles {
+		country = strings.ToUpper(country)
+		p := &CountryProfile{Country: country}
+		for _, ch := range profile.Channels {
+			if ch.MinFrequency > ch.MaxFrequency {
+				return nil, fmt.Errorf("invalid channel %d-%d Hz in country profile %s", ch.MinFrequency, ch.MaxFrequency, country)
+			}
+			p.Channels = append(p.Channels, CountryChannel{
+				MinFrequency: ch.MinFrequency,
+				MaxFrequency: ch.MaxFrequency,
+				MaxEIRP:      ch.MaxEIRP,
+			})
+		}
+		l.profiles[country] = p
+	}
+
+	if l.defaultCountry != "" && l.profiles[l.defaultCountry] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCountryProfile, l.defaultCountry)
+	}
+	for id, country := range cfg.Gateways {
+		localID, err := utils.Eui64FromString(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway id %q in tx power config: %w", id, err)
+		}
+		country = strings.ToUpper(country)
+		if l.profiles[country] == nil {
+			return nil, fmt.Errorf("%w: %s for gateway %s", ErrUnknownCountryProfile, country, localID)
+		}
+		l.gateways[localID] = country
+	}
+
+	return l, nil
+}
+
+// Profile returns the country profile that applies to gw, or nil if no
+// profile is selected for the gateway.
+func (l *TxPowerLimiter) Profile(gw *gateway.Gateway) *CountryProfile {
+	if country, ok := l.gateways[gw.LocalID]; ok {
+		return l.profiles[country]
+	}
+	if l.defaultCountry != "" {
+		return l.profiles[l.defaultCountry]
+	}
+	return nil
+}
+
+// Limit prepares item for transmission by gateway. If the item is scheduled on a
+// frequency that is not allowed a *DownlinkFrequencyNotAllowedError is
+// returned. If the requested transmit power exceeds the maximum EIRP for the
+// channel the power is lowered and the requested power is returned together
+// with capped set to true.
+func (l *TxPowerLimiter) Limit(gateway *gateway.Gateway, item *gw.DownlinkFrameItem) (requested int32, capped bool, err error) {
+	profile := l.Profile(gateway)
+	if profile == nil || item.GetTxInfo() == nil {
+		return 0, false, nil
+	}
+
+	txInfo := item.GetTxInfo()
+	ch, ok := profile.channel(txInfo.GetFrequency())
+	if !ok {
+		return 0, false, &DownlinkFrequencyNotAllowedError{
+			Frequency: txInfo.GetFrequency(),
+			Country:   profile.Country,
+		}
+	}
+
+	requested = txInfo.GetPower()
+	if requested > ch.MaxEIRP {
+		txInfo.Power = ch.MaxEIRP
+		return requested, true, nil
+	}
+	return requested, false, nil
+}
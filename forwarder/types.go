@@ -17,6 +17,10 @@
 package forwarder
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/backend/events"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
 	"github.com/ThingsIXFoundation/router-api/go/router"
@@ -68,12 +72,16 @@ type NetworkEvent struct {
 // what kind of event was received.
 type GatewayEvent struct {
 	join *struct {
-		devEUI lorawan.EUI64
-		event  *router.GatewayToRouterEvent
+		devEUI  lorawan.EUI64
+		joinEUI lorawan.EUI64
+		event   *router.GatewayToRouterEvent
 	}
 	uplink *struct {
 		device lorawan.DevAddr
-		event  *router.GatewayToRouterEvent
+		// proprietary is set for frames with the proprietary message type,
+		// these don't have a device address
+		proprietary bool
+		event       *router.GatewayToRouterEvent
 	}
 	subOnlineOfflineEvent *struct {
 		event *router.GatewayToRouterEvent
@@ -83,6 +91,10 @@ type GatewayEvent struct {
 		event      *router.GatewayToRouterEvent
 	}
 	receivedFrom *gateway.Gateway
+	// region the gateway that received the event operates in
+	region frequency_plan.BandName
+	// receivedAt is when the forwarder received the uplink or join
+	receivedAt time.Time
 }
 
 // IsUplink returns an indication if the event is an uplink event.
@@ -104,3 +116,71 @@ func (ge GatewayEvent) IsOnlineOfflineEvent() bool {
 func (ge GatewayEvent) IsDownlinkAck() bool {
 	return ge.downlinkAck != nil
 }
+
+// newUplinkGatewayEvent returns the event that is offered to router clients
+// for an uplink frame in network format received by gw. The PHY payload
+// determines how routers are selected, data uplinks are routed on the DevAddr,
+// join requests on the DevEUI and proprietary frames to default routers.
+func newUplinkGatewayEvent(gw *gateway.Gateway, region frequency_plan.BandName, phy *lorawan.PHYPayload, frame *gw.UplinkFrame, airtime time.Duration) (*GatewayEvent, error) {
+	event := &router.GatewayToRouterEvent{
+		GatewayInformation: &router.GatewayInformation{
+			PublicKey: gw.CompressedPubKeyBytes(),
+			Owner:     gw.OwnerBytes(),
+		},
+		Event: &router.GatewayToRouterEvent_UplinkFrameEvent{
+			UplinkFrameEvent: &router.UplinkFrameEvent{
+				UplinkFrame: frame,
+				AirtimeReceipt: &router.AirtimeReceipt{
+					Owner:   gw.OwnerBytes(),
+					Airtime: uint32(airtime.Milliseconds()),
+				},
+			},
+		},
+	}
+
+	ev := &GatewayEvent{
+		receivedFrom: gw,
+		region:       region,
+		receivedAt:   time.Now(),
+	}
+
+	switch phy.MHDR.MType {
+	case lorawan.ConfirmedDataUp, lorawan.UnconfirmedDataUp:
+		mac, ok := phy.MACPayload.(*lorawan.MACPayload)
+		if !ok {
+			return nil, fmt.Errorf("data-up but no mac-payload")
+		}
+		ev.uplink = &struct {
+			device      lorawan.DevAddr
+			proprietary bool
+			event       *router.GatewayToRouterEvent
+		}{
+			device: mac.FHDR.DevAddr,
+			event:  event,
+		}
+	case lorawan.Proprietary:
+		ev.uplink = &struct {
+			device      lorawan.DevAddr
+			proprietary bool
+			event       *router.GatewayToRouterEvent
+		}{
+			proprietary: true,
+			event:       event,
+		}
+	case lorawan.JoinRequest, lorawan.RejoinRequest:
+		jr, ok := phy.MACPayload.(*lorawan.JoinRequestPayload)
+		if !ok {
+			return nil, fmt.Errorf("join but no join-payload")
+		}
+		ev.join = &struct {
+			devEUI  lorawan.EUI64
+			joinEUI lorawan.EUI64
+			event   *router.GatewayToRouterEvent
+		}{
+			jr.DevEUI, jr.JoinEUI, event,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported message type %s", phy.MHDR.MType)
+	}
+	return ev, nil
+}
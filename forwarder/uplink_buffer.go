@@ -0,0 +1,571 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
+	"github.com/ThingsIXFoundation/router-api/go/router"
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+var uplinkBufferFeature = features.Register("uplink_buffer",
+	"buffer data uplinks while no router is reachable and deliver them in batches when a router is back, requires the uplink buffer to be configured", true)
+
+const (
+	// uplinkBufferSegmentExt is the extension of buffer segment files
+	uplinkBufferSegmentExt = ".seg"
+	// uplinkBufferSegments is the number of segments the buffer is divided
+	// in, the oldest segment is removed when the buffer is full
+	uplinkBufferSegments = 16
+	// uplinkBufferRecordHeader is the size of the record header: length,
+	// crc, received time, gateway local id and region length
+	uplinkBufferRecordHeader = 4 + 4 + 8 + 8 + 1
+)
+
+// UplinkBuffer queues data uplinks on disk while no router is reachable and
+// replays them when connectivity returns. The buffer is a ring of segment
+// files, when it is full the oldest segment is removed. Replayed uplinks are
+// marked as delayed in their metadata, uplinks older than the TTL are
+// dropped.
+type UplinkBuffer struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	ttl         time.Duration
+
+	mu sync.Mutex
+	// segments holds the sequence numbers of the segments on disk, oldest
+	// first
+	segments []uint64
+	// sizes holds the size of each segment in bytes
+	sizes map[uint64]int64
+	// active is the segment that is appended to, nil if a new segment must
+	// be created for the next record
+	active   *os.File
+	activeID uint64
+
+	// replayMu ensures buffered uplinks are replayed by one caller at a
+	// time
+	replayMu sync.Mutex
+}
+
+// uplinkBufferRecord is an uplink in the buffer.
+type uplinkBufferRecord struct {
+	receivedAt time.Time
+	localID    lorawan.EUI64
+	region     frequency_plan.BandName
+	event      *router.GatewayToRouterEvent
+	// size is the encoded size of the record in bytes
+	size int64
+}
+
+// NewUplinkBuffer returns a buffer that stores its segments in the directory
+// from cfg. Segments left by a previous run are replayed.
+func NewUplinkBuffer(cfg *ForwarderUplinkBufferConfig) (*UplinkBuffer, error) {
+	if cfg.Directory == "" {
+		return nil, fmt.Errorf("uplink buffer enabled without directory")
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create uplink buffer directory: %w", err)
+	}
+
+	b := &UplinkBuffer{
+		dir:     cfg.Directory,
+		maxSize: 64 << 20,
+		ttl:     24 * time.Hour,
+		sizes:   make(map[uint64]int64),
+	}
+	if cfg.MaxSize != nil && *cfg.MaxSize > 0 {
+		b.maxSize = *cfg.MaxSize
+	}
+	if cfg.TTL != nil && *cfg.TTL > 0 {
+		b.ttl = *cfg.TTL
+	}
+	b.segmentSize = b.maxSize / uplinkBufferSegments
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read uplink buffer directory: %w", err)
+	}
+	for _, entry := range entries {
+		id, ok := uplinkBufferSegmentID(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read uplink buffer segment: %w", err)
+		}
+		b.segments = append(b.segments, id)
+		b.sizes[id] = info.Size()
+		if id >= b.activeID {
+			b.activeID = id + 1
+		}
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i] < b.segments[j] })
+	uplinkBufferBytesGauge.Set(float64(b.size()))
+
+	exchangeLog.WithFields(logrus.Fields{
+		"directory": b.dir,
+		"max_size":  b.maxSize,
+		"ttl":       b.ttl,
+		"segments":  len(b.segments),
+	}).Info("uplink buffer")
+
+	return b, nil
+}
+
+func uplinkBufferSegmentID(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, uplinkBufferSegmentExt) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, uplinkBufferSegmentExt), 10, 64)
+	return id, err == nil
+}
+
+func (b *UplinkBuffer) segmentPath(id uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%016d%s", id, uplinkBufferSegmentExt))
+}
+
+// size returns the total size of the segments, the caller must hold mu or
+// own b exclusively.
+func (b *UplinkBuffer) size() int64 {
+	var size int64
+	for _, s := range b.sizes {
+		size += s
+	}
+	return size
+}
+
+// Size returns the size in bytes of the buffered uplinks.
+func (b *UplinkBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size()
+}
+
+// Pending returns an indication if there are uplinks in the buffer.
+func (b *UplinkBuffer) Pending() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.segments) > 0
+}
+
+// Add appends the uplink ev to the buffer.
+func (b *UplinkBuffer) Add(ev *GatewayEvent) error {
+	payload, err := proto.Marshal(ev.uplink.event)
+	if err != nil {
+		return fmt.Errorf("unable to encode uplink: %w", err)
+	}
+	record := encodeUplinkBufferRecord(ev.receivedAt, ev.receivedFrom.LocalID, ev.region, payload)
+	if int64(len(record)) > b.segmentSize {
+		return fmt.Errorf("uplink too large for buffer")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active != nil && b.sizes[b.activeID]+int64(len(record)) > b.segmentSize {
+		_ = b.active.Close()
+		b.active = nil
+		b.activeID++
+	}
+	if b.active == nil {
+		if b.active, err = os.OpenFile(b.segmentPath(b.activeID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+			return fmt.Errorf("unable to create uplink buffer segment: %w", err)
+		}
+		b.segments = append(b.segments, b.activeID)
+		b.sizes[b.activeID] = 0
+	}
+
+	// the buffer is a ring, make room by removing the oldest segments
+	for len(b.segments) > 1 && b.size()+int64(len(record)) > b.maxSize {
+		oldest := b.segments[0]
+		if err := os.Remove(b.segmentPath(oldest)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove uplink buffer segment: %w", err)
+		}
+		exchangeLog.WithField("segment", oldest).Warn("uplink buffer full, drop oldest uplinks")
+		delete(b.sizes, oldest)
+		b.segments = b.segments[1:]
+	}
+
+	if _, err := b.active.Write(record); err != nil {
+		return fmt.Errorf("unable to write uplink buffer: %w", err)
+	}
+	b.sizes[b.activeID] += int64(len(record))
+	uplinkBufferBytesGauge.Set(float64(b.size()))
+	return nil
+}
+
+// encodeUplinkBufferRecord encodes a record as: length | crc32 | received
+// time in unix ms | gateway local id | region length | region | event. The
+// length and crc cover everything after the crc.
+func encodeUplinkBufferRecord(receivedAt time.Time, localID lorawan.EUI64, region frequency_plan.BandName, payload []byte) []byte {
+	record := make([]byte, uplinkBufferRecordHeader+len(region)+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(record)-8))
+	binary.BigEndian.PutUint64(record[8:16], uint64(receivedAt.UnixMilli()))
+	copy(record[16:24], localID[:])
+	record[24] = byte(len(region))
+	copy(record[25:], region)
+	copy(record[25+len(region):], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+// readUplinkBufferRecord reads the next record from r. It returns io.EOF
+// when there are no more complete records.
+func readUplinkBufferRecord(r io.Reader) (*uplinkBufferRecord, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, io.EOF
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < uplinkBufferRecordHeader-8 || length > 1<<20 {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		// partially written record, e.g. because the process crashed
+		return nil, io.EOF
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+
+	record := &uplinkBufferRecord{
+		receivedAt: time.UnixMilli(int64(binary.BigEndian.Uint64(body[0:8]))),
+		size:       int64(len(header) + len(body)),
+	}
+	copy(record.localID[:], body[8:16])
+	regionLen := int(body[16])
+	if 17+regionLen > len(body) {
+		return nil, fmt.Errorf("invalid region length %d", regionLen)
+	}
+	record.region = frequency_plan.BandName(body[17 : 17+regionLen])
+	record.event = &router.GatewayToRouterEvent{}
+	if err := proto.Unmarshal(body[17+regionLen:], record.event); err != nil {
+		return nil, fmt.Errorf("unable to decode uplink: %w", err)
+	}
+	return record, nil
+}
+
+// Replay reads the buffered uplinks oldest first and passes them to deliver.
+// When deliver returns false replay stops and the remaining uplinks are kept
+// for the next replay.
+func (b *UplinkBuffer) Replay(deliver func(*uplinkBufferRecord) bool) error {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+
+	b.mu.Lock()
+	// stop appending to the active segment so all segments can be read
+	if b.active != nil {
+		_ = b.active.Close()
+		b.active = nil
+		b.activeID++
+	}
+	segments := append([]uint64(nil), b.segments...)
+	b.mu.Unlock()
+
+	for _, id := range segments {
+		remaining, err := b.replaySegment(id, deliver)
+		if err != nil {
+			return err
+		}
+		if remaining {
+			return nil
+		}
+	}
+	return nil
+}
+
+// replaySegment replays the segment with the given id, it returns true when
+// deliver stopped the replay before the end of the segment.
+func (b *UplinkBuffer) replaySegment(id uint64, deliver func(*uplinkBufferRecord) bool) (bool, error) {
+	path := b.segmentPath(id)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// removed to make room for new uplinks
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to open uplink buffer segment: %w", err)
+	}
+
+	var (
+		r      = bufio.NewReader(f)
+		now    = time.Now()
+		offset int64
+	)
+	for {
+		record, err := readUplinkBufferRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			exchangeLog.WithError(err).WithField("segment", id).Error("corrupt uplink buffer segment, drop remaining uplinks")
+			break
+		}
+		if now.Sub(record.receivedAt) > b.ttl {
+			uplinkBufferFramesCounter.WithLabelValues("expired").Inc()
+		} else if !deliver(record) {
+			_ = f.Close()
+			return true, b.truncateSegment(id, offset)
+		} else {
+			uplinkBufferFramesCounter.WithLabelValues("replayed").Inc()
+		}
+		offset += record.size
+	}
+	_ = f.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("unable to remove uplink buffer segment: %w", err)
+	}
+	b.removeSegment(id)
+	return false, nil
+}
+
+// truncateSegment removes the first offset bytes of the segment with the
+// given id, these uplinks are replayed.
+func (b *UplinkBuffer) truncateSegment(id uint64, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	path := b.segmentPath(id)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read uplink buffer segment: %w", err)
+	}
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw[offset:], 0o600); err != nil {
+		return fmt.Errorf("unable to write uplink buffer segment: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to replace uplink buffer segment: %w", err)
+	}
+	if _, ok := b.sizes[id]; ok {
+		b.sizes[id] = int64(len(raw)) - offset
+	}
+	uplinkBufferBytesGauge.Set(float64(b.size()))
+	return nil
+}
+
+// removeSegment forgets the segment with the given id, the caller must hold
+// mu.
+func (b *UplinkBuffer) removeSegment(id uint64) {
+	for i, s := range b.segments {
+		if s == id {
+			b.segments = append(b.segments[:i], b.segments[i+1:]...)
+			break
+		}
+	}
+	delete(b.sizes, id)
+	uplinkBufferBytesGauge.Set(float64(b.size()))
+}
+
+// Discard removes all buffered uplinks, it returns the number of bytes
+// removed.
+func (b *UplinkBuffer) Discard() (int64, error) {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active != nil {
+		_ = b.active.Close()
+		b.active = nil
+		b.activeID++
+	}
+	size := b.size()
+	for _, id := range append([]uint64(nil), b.segments...) {
+		if err := os.Remove(b.segmentPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return size - b.size(), fmt.Errorf("unable to remove uplink buffer segment: %w", err)
+		}
+		b.removeSegment(id)
+	}
+	return size, nil
+}
+
+// Close closes the active segment.
+func (b *UplinkBuffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active != nil {
+		_ = b.active.Close()
+		b.active = nil
+	}
+}
+
+// bufferUplink stores the uplink in the buffer when no router is reachable.
+// It returns false if the uplink must be broadcasted to the routers.
+func (e *Exchange) bufferUplink(ev *GatewayEvent, frameLog *logrus.Entry) bool {
+	if e.uplinkBuffer == nil || !ev.IsUplink() || e.routingTable.anyRouterOnline() {
+		return false
+	}
+	if !uplinkBufferFeature.Enabled() {
+		frameLog.Warn("no router reachable and uplink buffer feature disabled, packet is lost")
+		return false
+	}
+	if err := e.uplinkBuffer.Add(ev); err != nil {
+		frameLog.WithError(err).Error("unable to buffer uplink, drop packet")
+		uplinkBufferFramesCounter.WithLabelValues("dropped").Inc()
+		return true
+	}
+	uplinkBufferFramesCounter.WithLabelValues("buffered").Inc()
+	frameLog.Info("no router reachable, buffered packet")
+	return true
+}
+
+// replayUplinks replays buffered uplinks while routers are reachable until
+// ctx expires.
+func (e *Exchange) replayUplinks(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	defer e.uplinkBuffer.Close()
+
+	for {
+		select {
+		case <-ticker.C:
+			// with the uplink buffer disabled buffered uplinks are kept
+			// until it is enabled again or the buffer is flushed
+			if !uplinkBufferFeature.Enabled() || !e.uplinkBuffer.Pending() || !e.routingTable.anyRouterOnline() {
+				continue
+			}
+			if err := e.uplinkBuffer.Replay(func(record *uplinkBufferRecord) bool {
+				return e.replayUplink(ctx, record)
+			}); err != nil {
+				exchangeLog.WithError(err).Error("unable to replay buffered uplinks")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replayUplink broadcasts a buffered uplink to the router clients. It returns
+// false when replay must stop because routers became unreachable or ctx
+// expired.
+func (e *Exchange) replayUplink(ctx context.Context, record *uplinkBufferRecord) bool {
+	frame := record.event.GetUplinkFrameEvent().GetUplinkFrame()
+	gw, err := e.gateways.ByLocalID(record.localID)
+	if err != nil {
+		exchangeLog.WithField("gw_local_id", record.localID).Debug("gateway of buffered uplink not in store, drop packet")
+		uplinkBufferFramesCounter.WithLabelValues("dropped").Inc()
+		return true
+	}
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(frame.GetPhyPayload()); err != nil {
+		uplinkBufferFramesCounter.WithLabelValues("dropped").Inc()
+		return true
+	}
+
+	if frame.RxInfo.Metadata == nil {
+		frame.RxInfo.Metadata = make(map[string]string)
+	}
+	frame.RxInfo.Metadata["thingsix_delayed"] = "true"
+	frame.RxInfo.Metadata["thingsix_delay_ms"] = strconv.FormatInt(time.Since(record.receivedAt).Milliseconds(), 10)
+
+	airtime := time.Duration(record.event.GetUplinkFrameEvent().GetAirtimeReceipt().GetAirtime()) * time.Millisecond
+	ev, err := newUplinkGatewayEvent(gw, record.region, &phy, frame, airtime)
+	if err != nil || !ev.IsUplink() {
+		uplinkBufferFramesCounter.WithLabelValues("dropped").Inc()
+		return true
+	}
+
+	// don't overflow the router clients, wait until the broadcaster has room
+	for !e.routingTable.gatewayEvents.TryBroadcast(ev) {
+		if !e.routingTable.anyRouterOnline() {
+			return false
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// UplinkBufferFlush describes the result of flushing the uplink buffer.
+type UplinkBufferFlush struct {
+	// Replayed is the number of buffered uplinks that were handled, uplinks
+	// of gateways no longer in the store are dropped
+	Replayed int `json:"replayed"`
+	// DiscardedBytes is the size of the uplinks that were dropped on request
+	DiscardedBytes int64 `json:"discardedBytes"`
+	// RemainingBytes is the size of the uplinks still in the buffer
+	RemainingBytes int64 `json:"remainingBytes"`
+}
+
+// FlushUplinkBuffer replays the buffered uplinks to the connected routers now
+// instead of waiting for the next replay. When discard is set the buffered
+// uplinks are dropped instead.
+func (e *Exchange) FlushUplinkBuffer(ctx context.Context, discard bool) (UplinkBufferFlush, error) {
+	var flush UplinkBufferFlush
+	if e.uplinkBuffer == nil {
+		return flush, ErrNoUplinkBuffer
+	}
+
+	if discard {
+		discarded, err := e.uplinkBuffer.Discard()
+		flush.DiscardedBytes = discarded
+		flush.RemainingBytes = e.uplinkBuffer.Size()
+		if discarded > 0 {
+			exchangeLog.WithField("bytes", discarded).Warn("discarded buffered uplinks on request")
+		}
+		return flush, err
+	}
+
+	if !e.routingTable.anyRouterOnline() {
+		return flush, ErrNoRouterOnline
+	}
+	err := e.uplinkBuffer.Replay(func(record *uplinkBufferRecord) bool {
+		if !e.replayUplink(ctx, record) {
+			return false
+		}
+		flush.Replayed++
+		return true
+	})
+	flush.RemainingBytes = e.uplinkBuffer.Size()
+	return flush, err
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/forwarder/features"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+)
+
+var uplinkDedupFeature = features.Register("uplink_dedup",
+	"collapse copies of a frame received by several gateways into one delivery, requires deduplication to be configured", true)
+
+const (
+	// dedupReceptionsMetadataKey holds the receptions of all gateways that
+	// received a deduplicated frame as JSON list
+	dedupReceptionsMetadataKey = "thingsix_receptions"
+	// dedupReceptionCountMetadataKey holds the number of gateways that
+	// received a deduplicated frame
+	dedupReceptionCountMetadataKey = "thingsix_reception_count"
+)
+
+// UplinkDeduplicator collapses copies of the same frame received by several
+// gateways of this forwarder into a single delivery. Frames are deduplicated
+// per region, copies received by gateways in different regions are not
+// collapsed into each other. The first copy starts
+// the deduplication window, after the window the copy with the best signal
+// quality is delivered and the receptions of all gateways are added to its
+// metadata. The router API carries one reception per uplink, only the
+// gateway of the delivered copy is credited with the airtime. Optionally
+// delivered frames are remembered for a while, copies that arrive after the
+// window are dropped instead of delivered and accounted again.
+type UplinkDeduplicator struct {
+	window time.Duration
+	// delivered holds recently delivered frames, nil if not remembered
+	delivered *dedupCache
+
+	mu      sync.Mutex
+	pending map[gossipHash]*dedupGroup
+}
+
+// dedupGroup holds the copies of a frame received within the window.
+type dedupGroup struct {
+	best       *GatewayEvent
+	bestFrame  *gw.UplinkFrame
+	bestLog    *logrus.Entry
+	bestCopy   gossipCopy
+	receptions []dedupReception
+}
+
+// dedupReception is the reception of a frame by a gateway, as included in the
+// metadata of the delivered copy.
+type dedupReception struct {
+	GatewayID string  `json:"gatewayId"`
+	RSSI      int32   `json:"rssi"`
+	SNR       float32 `json:"snr"`
+	Channel   uint32  `json:"channel"`
+	Context   []byte  `json:"context,omitempty"`
+}
+
+// NewUplinkDeduplicator returns a deduplicator configured from cfg.
+func NewUplinkDeduplicator(cfg *ForwarderDeduplicationConfig) (*UplinkDeduplicator, error) {
+	d := &UplinkDeduplicator{
+		window:  200 * time.Millisecond,
+		pending: make(map[gossipHash]*dedupGroup),
+	}
+	if cfg.Window != nil && *cfg.Window > 0 {
+		d.window = *cfg.Window
+	}
+
+	var history time.Duration
+	if cfg.CacheFile != "" {
+		history = time.Minute
+	}
+	if cfg.History != nil && *cfg.History >= 0 {
+		history = *cfg.History
+	}
+	if history > 0 {
+		slots := 4096
+		if cfg.CacheSize != nil && *cfg.CacheSize > 0 {
+			slots = *cfg.CacheSize
+		}
+		var err error
+		if d.delivered, err = newDedupCache(cfg.CacheFile, slots, history); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Hold adds the copy of the frame that ev was built for. The first copy of a
+// frame calls deliver after the window with the best copy, later copies
+// within the window are collapsed into it.
+func (d *UplinkDeduplicator) Hold(ev *GatewayEvent, frame *gw.UplinkFrame, frameLog *logrus.Entry, deliver func(*GatewayEvent, *gw.UplinkFrame, *logrus.Entry)) {
+	var (
+		hash = dedupFrameHash(ev.region, frame)
+		rx   = frame.GetRxInfo()
+		own  = gossipCopy{
+			forwarder: rx.GetGatewayId(),
+			snr:       rx.GetSnr(),
+			rssi:      rx.GetRssi(),
+		}
+		reception = dedupReception{
+			GatewayID: rx.GetGatewayId(),
+			RSSI:      rx.GetRssi(),
+			SNR:       rx.GetSnr(),
+			Channel:   rx.GetChannel(),
+			Context:   rx.GetContext(),
+		}
+	)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.delivered != nil && d.delivered.seen(hash, time.Now()) {
+		uplinkDedupCounter.WithLabelValues("duplicate").Inc()
+		frameLog.Debug("frame already delivered, drop packet")
+		return
+	}
+
+	if group, ok := d.pending[hash]; ok {
+		group.receptions = append(group.receptions, reception)
+		if own.betterThan(group.bestCopy) {
+			group.bestLog.Debug("gateway received a better copy, collapse packet")
+			group.best, group.bestFrame, group.bestLog, group.bestCopy = ev, frame, frameLog, own
+		} else {
+			frameLog.Debug("weaker copy of a pending frame, collapse packet")
+		}
+		uplinkDedupCounter.WithLabelValues("collapsed").Inc()
+		return
+	}
+
+	d.pending[hash] = &dedupGroup{
+		best:       ev,
+		bestFrame:  frame,
+		bestLog:    frameLog,
+		bestCopy:   own,
+		receptions: []dedupReception{reception},
+	}
+
+	time.AfterFunc(d.window, func() {
+		d.mu.Lock()
+		group := d.pending[hash]
+		delete(d.pending, hash)
+		if d.delivered != nil {
+			d.delivered.add(hash, time.Now())
+		}
+		d.mu.Unlock()
+
+		if len(group.receptions) > 1 {
+			setDedupMetadata(group.bestFrame, group.receptions)
+		}
+		uplinkDedupCounter.WithLabelValues("delivered").Inc()
+		deliver(group.best, group.bestFrame, group.bestLog.WithField("receptions", len(group.receptions)))
+	})
+}
+
+// dedupFrameHash returns the hash of the frame within the region, the same
+// frame received in different regions has a different hash.
+func dedupFrameHash(region frequency_plan.BandName, frame *gw.UplinkFrame) gossipHash {
+	var h gossipHash
+	s := sha256.New()
+	s.Write([]byte(region))
+	s.Write([]byte{0})
+	s.Write(frame.GetPhyPayload())
+	copy(h[:], s.Sum(nil))
+	return h
+}
+
+// setDedupMetadata adds the receptions of all gateways to the frame metadata.
+func setDedupMetadata(frame *gw.UplinkFrame, receptions []dedupReception) {
+	raw, err := json.Marshal(receptions)
+	if err != nil {
+		return
+	}
+	if frame.RxInfo.Metadata == nil {
+		frame.RxInfo.Metadata = make(map[string]string)
+	}
+	frame.RxInfo.Metadata[dedupReceptionsMetadataKey] = string(raw)
+	frame.RxInfo.Metadata[dedupReceptionCountMetadataKey] = strconv.Itoa(len(receptions))
+}
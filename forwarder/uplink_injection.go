@@ -0,0 +1,211 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// injectedMetadataKey is the uplink metadata key that flags uplinks that
+// were injected through the API instead of received by the gateway.
+const injectedMetadataKey = "thingsix_injected"
+
+const (
+	defaultInjectedUplinkRSSI = -60
+	defaultInjectedUplinkSNR  = 7
+)
+
+// InjectUplinkRequest describes a crafted uplink. Transmission parameters
+// that are not set default to the first uplink channel of the gateway
+// region at its highest data rate.
+type InjectUplinkRequest struct {
+	// PhyPayload is the LoRaWAN frame, it is required
+	PhyPayload      []byte   `json:"phyPayload"`
+	Frequency       uint32   `json:"frequency,omitempty"`
+	SpreadingFactor uint32   `json:"spreadingFactor,omitempty"`
+	Bandwidth       uint32   `json:"bandwidth,omitempty"`
+	RSSI            *int32   `json:"rssi,omitempty"`
+	SNR             *float32 `json:"snr,omitempty"`
+}
+
+// InjectedUplink is an uplink that was injected as if received by a gateway.
+type InjectedUplink struct {
+	// PacketID identifies the uplink in packet events, logs and the
+	// thingsix_packet_id metadata forwarded to routers
+	PacketID         string        `json:"packetId"`
+	GatewayLocalID   lorawan.EUI64 `json:"gatewayLocalId"`
+	GatewayNetworkID lorawan.EUI64 `json:"gatewayNetworkId"`
+	// Injected is always true, routers receive the uplink with the
+	// thingsix_injected metadata set
+	Injected        bool   `json:"injected"`
+	Frequency       uint32 `json:"frequency"`
+	SpreadingFactor uint32 `json:"spreadingFactor"`
+	Bandwidth       uint32 `json:"bandwidth"`
+}
+
+// InjectUplink handles req as if it was received by gw. The uplink takes
+// the same path as uplinks received over the air, including routing and
+// accounting, but isn't recorded as gateway activity or coverage.
+func (e *Exchange) InjectUplink(gateway *gateway.Gateway, req InjectUplinkRequest) (InjectedUplink, error) {
+	if len(req.PhyPayload) == 0 {
+		return InjectedUplink{}, fmt.Errorf("%w: missing phyPayload", ErrInvalidInjectedUplink)
+	}
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(req.PhyPayload); err != nil {
+		return InjectedUplink{}, fmt.Errorf("%w: %s", ErrInvalidInjectedUplink, err)
+	}
+
+	frame, err := e.injectedUplinkFrame(gateway, req)
+	if err != nil {
+		return InjectedUplink{}, err
+	}
+
+	injected := InjectedUplink{
+		PacketID:         newPacketID(),
+		GatewayLocalID:   gateway.LocalID,
+		GatewayNetworkID: gateway.NetworkID,
+		Injected:         true,
+		Frequency:        frame.GetTxInfo().GetFrequency(),
+		SpreadingFactor:  frame.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor(),
+		Bandwidth:        frame.GetTxInfo().GetModulation().GetLora().GetBandwidth(),
+	}
+
+	injectedUplinksCounter.Inc()
+	exchangeLog.WithFields(logrus.Fields{
+		"gw_local_id":   gateway.LocalID,
+		"gw_network_id": gateway.NetworkID,
+		"packet_id":     injected.PacketID,
+		"type":          phy.MHDR.MType,
+	}).Warn("inject uplink, not received by the gateway")
+
+	e.processUplinkFrame(frame, injected.PacketID, true)
+	return injected, nil
+}
+
+// injectedUplinkFrame returns the uplink frame for req as the backend would
+// have delivered it for gw.
+func (e *Exchange) injectedUplinkFrame(gateway *gateway.Gateway, req InjectUplinkRequest) (*gw.UplinkFrame, error) {
+	band, err := regionBand(gatewayRegion(gateway, e.gateways))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidInjectedUplink, err)
+	}
+	channel, err := band.GetUplinkChannel(0)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := band.GetDataRate(channel.MaxDR)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now             = time.Now()
+		frequency       = channel.Frequency
+		spreadingFactor = uint32(dr.SpreadFactor)
+		bandwidth       = uint32(dr.Bandwidth * 1000)
+		rssi            = int32(defaultInjectedUplinkRSSI)
+		snr             = float32(defaultInjectedUplinkSNR)
+		// the concentrator counter the gateway would have reported
+		context = make([]byte, 4)
+	)
+	if req.Frequency != 0 {
+		frequency = req.Frequency
+	}
+	if req.SpreadingFactor != 0 {
+		if req.SpreadingFactor < 5 || req.SpreadingFactor > 12 {
+			return nil, fmt.Errorf("%w: invalid spreading factor %d", ErrInvalidInjectedUplink, req.SpreadingFactor)
+		}
+		spreadingFactor = req.SpreadingFactor
+	}
+	if req.Bandwidth != 0 {
+		bandwidth = req.Bandwidth
+	}
+	if req.RSSI != nil {
+		rssi = *req.RSSI
+	}
+	if req.SNR != nil {
+		snr = *req.SNR
+	}
+	binary.BigEndian.PutUint32(context, uint32(now.UnixNano()/int64(time.Microsecond)))
+
+	return &gw.UplinkFrame{
+		PhyPayload: req.PhyPayload,
+		TxInfo: &gw.UplinkTxInfo{
+			Frequency: frequency,
+			Modulation: &gw.Modulation{
+				Parameters: &gw.Modulation_Lora{
+					Lora: &gw.LoraModulationInfo{
+						Bandwidth:       bandwidth,
+						SpreadingFactor: spreadingFactor,
+						CodeRate:        gw.CodeRate_CR_4_5,
+					},
+				},
+			},
+		},
+		RxInfo: &gw.UplinkRxInfo{
+			GatewayId: gateway.LocalID.String(),
+			Time:      timestamppb.New(now),
+			Rssi:      rssi,
+			Snr:       snr,
+			Context:   context,
+			CrcStatus: gw.CRCStatus_CRC_OK,
+		},
+	}, nil
+}
+
+// InjectUplink handles the uplink in the request body as if it was received
+// by the gateway in the path.
+func (svc APIService) InjectUplink(w http.ResponseWriter, r *http.Request) {
+	gw, err := gateway.Lookup(svc.gateways, chi.URLParam(r, "local_id"))
+	if err != nil {
+		replyGatewayLookupError(w, r, err)
+		return
+	}
+	if gw.Disabled {
+		http.Error(w, "gateway is disabled", http.StatusConflict)
+		return
+	}
+
+	var req InjectUplinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	injected, err := svc.injectUplink(gw, req)
+	switch {
+	case err == nil:
+		replyJSON(w, http.StatusAccepted, injected)
+	case errors.Is(err, ErrInvalidInjectedUplink):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		logrus.WithError(err).Error("unable to inject uplink")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
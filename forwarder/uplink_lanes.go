@@ -0,0 +1,144 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+)
+
+// UplinkLanes decouples receiving uplinks from processing them. Data uplinks
+// are queued for a bounded pool of workers and dropped when the queue is
+// full. Join-requests are queued on a separate lane with dedicated workers so
+// that OTAA activations are not delayed by a backlog of data uplinks.
+type UplinkLanes struct {
+	handle      func(*gw.UplinkFrame)
+	data        chan *gw.UplinkFrame
+	joins       chan *gw.UplinkFrame
+	workers     int
+	joinWorkers int
+}
+
+// NewUplinkLanes returns uplink lanes configured from cfg that process frames
+// with handle.
+func NewUplinkLanes(cfg *ForwarderUplinkLanesConfig, handle func(*gw.UplinkFrame)) *UplinkLanes {
+	var (
+		workers     = runtime.NumCPU()
+		queue       = 1024
+		joinWorkers = 1
+		joinQueue   = 256
+	)
+	if cfg.Workers != nil && *cfg.Workers > 0 {
+		workers = *cfg.Workers
+	}
+	if cfg.Queue != nil && *cfg.Queue >= 0 {
+		queue = *cfg.Queue
+	}
+	if cfg.JoinWorkers != nil && *cfg.JoinWorkers > 0 {
+		joinWorkers = *cfg.JoinWorkers
+	}
+	if cfg.JoinQueue != nil && *cfg.JoinQueue >= 0 {
+		joinQueue = *cfg.JoinQueue
+	}
+
+	return &UplinkLanes{
+		handle:      handle,
+		data:        make(chan *gw.UplinkFrame, queue),
+		joins:       make(chan *gw.UplinkFrame, joinQueue),
+		workers:     workers,
+		joinWorkers: joinWorkers,
+	}
+}
+
+// Dispatch queues the frame on its lane. Join-requests that don't fit in the
+// join queue are processed immediately by the caller, data uplinks that
+// don't fit in the data queue are dropped.
+func (l *UplinkLanes) Dispatch(frame *gw.UplinkFrame) {
+	if isJoinFrame(frame.GetPhyPayload()) {
+		select {
+		case l.joins <- frame:
+		default:
+			uplinksQueueFullCounter.WithLabelValues("join").Inc()
+			l.handle(frame)
+		}
+		return
+	}
+
+	select {
+	case l.data <- frame:
+	default:
+		uplinksQueueFullCounter.WithLabelValues("data").Inc()
+		exchangeLog.WithFields(logrus.Fields{
+			"gw_local_id": frame.GetRxInfo().GetGatewayId(),
+			"uplink_id":   frame.GetRxInfo().GetUplinkId(),
+		}).Warn("uplink queue full, drop packet")
+	}
+}
+
+// Run starts the workers and blocks until the given ctx expires.
+func (l *UplinkLanes) Run(ctx context.Context) {
+	for i := 0; i < l.joinWorkers; i++ {
+		go l.work(ctx, l.joins, nil)
+	}
+	for i := 0; i < l.workers; i++ {
+		// data workers also take join-requests, a join-request waiting in
+		// the queue is always picked before the next data uplink
+		go l.work(ctx, l.data, l.joins)
+	}
+	<-ctx.Done()
+}
+
+func (l *UplinkLanes) work(ctx context.Context, frames <-chan *gw.UplinkFrame, joins <-chan *gw.UplinkFrame) {
+	for {
+		// a nil joins channel is never ready
+		select {
+		case frame := <-joins:
+			l.handle(frame)
+			continue
+		default:
+		}
+
+		select {
+		case frame := <-joins:
+			l.handle(frame)
+		case frame := <-frames:
+			l.handle(frame)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Pending returns the number of queued data uplinks and join-requests and
+// the capacity of both queues.
+func (l *UplinkLanes) Pending() (data int, dataCap int, joins int, joinsCap int) {
+	return len(l.data), cap(l.data), len(l.joins), cap(l.joins)
+}
+
+// isJoinFrame returns an indication if the PHYPayload is a join-request or a
+// rejoin-request.
+func isJoinFrame(phy []byte) bool {
+	if len(phy) == 0 {
+		return false
+	}
+	mtype := lorawan.MType(phy[0] >> 5)
+	return mtype == lorawan.JoinRequest || mtype == lorawan.RejoinRequest
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// uplinkMetadata normalizes the radio metadata of received uplinks to the
+// canonical representation before they are processed. Backends report
+// these values with different precision, e.g. the Semtech UDP protocol
+// reports the SNR with 0.1 dB precision while Basic Station reports it
+// with full float precision. Normalizing ensures routers see the same
+// values regardless of the backend the gateway uses.
+//
+// The canonical representation is:
+//
+//	RSSI      dBm, rounded half away from zero to an integer by the backend
+//	SNR       dB, rounded half away from zero to snrPrecision
+//	frequency Hz, rounded half away from zero to frequencyStep
+type uplinkMetadata struct {
+	// snrPrecision in dB, 0 leaves the SNR as reported
+	snrPrecision float64
+	// frequencyStep in Hz, 0 or 1 leaves the frequency as reported
+	frequencyStep uint32
+}
+
+func buildUplinkMetadata(cfg *Config) (uplinkMetadata, error) {
+	m := uplinkMetadata{snrPrecision: 0.1, frequencyStep: 1}
+	if cfg.Forwarder.UplinkMetadata.SNRPrecision != nil {
+		if m.snrPrecision = *cfg.Forwarder.UplinkMetadata.SNRPrecision; m.snrPrecision < 0 {
+			return m, fmt.Errorf("invalid uplink metadata snr_precision %v, must not be negative", m.snrPrecision)
+		}
+	}
+	if cfg.Forwarder.UplinkMetadata.FrequencyStep != nil {
+		m.frequencyStep = *cfg.Forwarder.UplinkMetadata.FrequencyStep
+	}
+	return m, nil
+}
+
+// normalize rounds the SNR and frequency of the frame in place.
+func (m uplinkMetadata) normalize(frame *gw.UplinkFrame) {
+	if rxInfo := frame.GetRxInfo(); rxInfo != nil && m.snrPrecision > 0 {
+		rxInfo.Snr = float32(roundToPrecision(float64(rxInfo.Snr), m.snrPrecision))
+	}
+	if txInfo := frame.GetTxInfo(); txInfo != nil && m.frequencyStep > 1 {
+		step := uint64(m.frequencyStep)
+		txInfo.Frequency = uint32((uint64(txInfo.Frequency) + step/2) / step * step)
+	}
+}
+
+// roundToPrecision rounds v half away from zero to a multiple of precision.
+// Values are scaled by the inverse of precision when it is a fraction to
+// prevent representation errors, e.g. 9.75 with precision 0.1 is 9.8.
+func roundToPrecision(v, precision float64) float64 {
+	if precision < 1 {
+		scale := math.Round(1 / precision)
+		if math.Abs(scale*precision-1) < 1e-9 {
+			return math.Round(v*scale) / scale
+		}
+	}
+	return math.Round(v/precision) * precision
+}
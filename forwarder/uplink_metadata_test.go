@@ -0,0 +1,85 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+func TestUplinkMetadataNormalize(t *testing.T) {
+	float64Ptr := func(v float64) *float64 { return &v }
+	uint32Ptr := func(v uint32) *uint32 { return &v }
+
+	tests := []struct {
+		name          string
+		cfg           ForwarderUplinkMetadataConfig
+		snr           float32
+		frequency     uint32
+		wantSNR       float32
+		wantFrequency uint32
+	}{
+		{name: "udp", snr: float32(9.8), frequency: 868100000, wantSNR: 9.8, wantFrequency: 868100000},
+		{name: "basic station", snr: 9.78125, frequency: 868100000, wantSNR: 9.8, wantFrequency: 868100000},
+		{name: "half away from zero", snr: 9.75, frequency: 868100000, wantSNR: 9.8, wantFrequency: 868100000},
+		{name: "negative half away from zero", snr: -7.25, frequency: 868100000, wantSNR: -7.3, wantFrequency: 868100000},
+		{name: "keep snr", cfg: ForwarderUplinkMetadataConfig{SNRPrecision: float64Ptr(0)}, snr: 9.78125, frequency: 868100000, wantSNR: 9.78125, wantFrequency: 868100000},
+		{name: "snr in whole dB", cfg: ForwarderUplinkMetadataConfig{SNRPrecision: float64Ptr(1)}, snr: -7.5, frequency: 868100000, wantSNR: -8, wantFrequency: 868100000},
+		{name: "snr in quarter dB", cfg: ForwarderUplinkMetadataConfig{SNRPrecision: float64Ptr(0.25)}, snr: 9.8, frequency: 868100000, wantSNR: 9.75, wantFrequency: 868100000},
+		{name: "frequency step down", cfg: ForwarderUplinkMetadataConfig{FrequencyStep: uint32Ptr(100)}, snr: 5, frequency: 868099999, wantSNR: 5, wantFrequency: 868100000},
+		{name: "frequency step up", cfg: ForwarderUplinkMetadataConfig{FrequencyStep: uint32Ptr(100)}, snr: 5, frequency: 868100049, wantSNR: 5, wantFrequency: 868100000},
+		{name: "frequency step half", cfg: ForwarderUplinkMetadataConfig{FrequencyStep: uint32Ptr(100)}, snr: 5, frequency: 868100050, wantSNR: 5, wantFrequency: 868100100},
+		{name: "keep frequency", cfg: ForwarderUplinkMetadataConfig{FrequencyStep: uint32Ptr(0)}, snr: 5, frequency: 868099999, wantSNR: 5, wantFrequency: 868099999},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.Forwarder.UplinkMetadata = tt.cfg
+			m, err := buildUplinkMetadata(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frame := &gw.UplinkFrame{
+				TxInfo: &gw.UplinkTxInfo{Frequency: tt.frequency},
+				RxInfo: &gw.UplinkRxInfo{Rssi: -97, Snr: tt.snr},
+			}
+			m.normalize(frame)
+
+			if frame.RxInfo.Snr != tt.wantSNR {
+				t.Errorf("unexpected snr, want %v, got %v", tt.wantSNR, frame.RxInfo.Snr)
+			}
+			if frame.TxInfo.Frequency != tt.wantFrequency {
+				t.Errorf("unexpected frequency, want %d, got %d", tt.wantFrequency, frame.TxInfo.Frequency)
+			}
+			if frame.RxInfo.Rssi != -97 {
+				t.Errorf("unexpected rssi, want -97, got %d", frame.RxInfo.Rssi)
+			}
+		})
+	}
+}
+
+func TestUplinkMetadataInvalidPrecision(t *testing.T) {
+	var cfg Config
+	precision := -0.1
+	cfg.Forwarder.UplinkMetadata.SNRPrecision = &precision
+	if _, err := buildUplinkMetadata(&cfg); err == nil {
+		t.Fatal("expected error for negative snr precision")
+	}
+}
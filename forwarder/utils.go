@@ -19,7 +19,6 @@ package forwarder
 import (
 	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -164,6 +163,51 @@ func dialRPCNode(cfg *Config) (*ethclient.Client, error) {
 	return client, nil
 }
 
+// routerSnapshot is the set of registered routers as returned by the ThingsIX
+// API.
+type routerSnapshot struct {
+	BlockNumber uint64
+	ChainID     uint64 `json:"chainId"`
+	// Time is when the snapshot was taken, only set for the embedded
+	// bootstrap router set
+	Time    *time.Time `json:"time,omitempty"`
+	Routers []struct {
+		Endpoint      string
+		ID            string
+		Owner         common.Address
+		NetId         uint32
+		Prefix        uint32
+		FrequencyPlan frequency_plan.BandName
+		Mask          uint8
+	}
+}
+
+// routers converts the snapshot routers to the internal format.
+func (snapshot *routerSnapshot) routers(chainID uint64, accounter Accounter) ([]*Router, error) {
+	if snapshot.ChainID != chainID {
+		return nil, fmt.Errorf("router snapshot from wrong chain, got %d, want %d", snapshot.ChainID, chainID)
+	}
+
+	routers := make([]*Router, 0, len(snapshot.Routers))
+	for _, r := range snapshot.Routers {
+		var (
+			id [32]byte
+		)
+		rID := common.FromHex(r.ID)
+		if len(rID) != 32 {
+			logrus.WithField("id", r.ID).Error("invalid router id")
+			continue
+		}
+
+		copy(id[:], rID)
+		var netidb [4]byte
+		binary.BigEndian.PutUint32(netidb[:], r.NetId)
+		netid := lorawan.NetID{netidb[1], netidb[2], netidb[3]}
+		routers = append(routers, NewRouter(id, r.Endpoint, false, netid, r.Prefix, r.Mask, r.FrequencyPlan.ToBlockchain(), r.Owner, accounter))
+	}
+	return routers, nil
+}
+
 func fetchRoutersFromThingsIXAPI(cfg *Config, accounter Accounter) (RoutesUpdaterFunc, time.Duration, error) {
 	interval := 30 * time.Minute // default refresh interval
 	if cfg.Forwarder.Routers.ThingsIXApi.UpdateInterval != nil {
@@ -182,47 +226,16 @@ func fetchRoutersFromThingsIXAPI(cfg *Config, accounter Accounter) (RoutesUpdate
 			return nil, err
 		}
 
-		snapshot := struct {
-			BlockNumber uint64
-			ChainID     uint64 `json:"chainId"`
-			Routers     []struct {
-				Endpoint      string
-				ID            string
-				Owner         common.Address
-				NetId         uint32
-				Prefix        uint32
-				FrequencyPlan frequency_plan.BandName
-				Mask          uint8
-			}
-		}{}
-
+		var snapshot routerSnapshot
 		if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
 			_ = resp.Body.Close()
 			return nil, err
 		}
 		_ = resp.Body.Close()
 
-		if snapshot.ChainID != cfg.BlockChain.Polygon.ChainID {
-			return nil, fmt.Errorf("router snapshot from wrong chain, got %d, want %d", snapshot.ChainID, cfg.BlockChain.Polygon.ChainID)
-		}
-
-		// convert from snapshot to internal format
-		routers := make([]*Router, len(snapshot.Routers))
-		for i, r := range snapshot.Routers {
-			var (
-				id [32]byte
-			)
-			rID := common.FromHex(r.ID)
-			if len(rID) != 32 {
-				logrus.WithError(err).Error("invalid router id")
-				continue
-			}
-
-			copy(id[:], rID)
-			var netidb [4]byte
-			binary.BigEndian.PutUint32(netidb[:], r.NetId)
-			netid := lorawan.NetID{netidb[1], netidb[2], netidb[3]}
-			routers[i] = NewRouter(id, r.Endpoint, false, netid, r.Prefix, r.Mask, r.FrequencyPlan.ToBlockchain(), r.Owner, accounter)
+		routers, err := snapshot.routers(cfg.BlockChain.Polygon.ChainID, accounter)
+		if err != nil {
+			return nil, err
 		}
 		logrus.WithField("#routers", len(routers)).Info("fetched routing table from ThingsIX API")
 		return routers, nil
@@ -260,12 +273,7 @@ func DevAddrHasPrefix(devAddr lorawan.DevAddr, prefix uint32, mask uint8) bool {
 }
 
 func mustDecodeGatewayID(input string) lorawan.EUI64 {
-	bytes, err := hex.DecodeString(input)
-	if err != nil {
-		logrus.WithError(err).Fatal("invalid gateway local id")
-	}
-
-	id, err := gateway.BytesToGatewayID(bytes)
+	id, err := gateway.ParseEUI64(input)
 	if err != nil {
 		logrus.WithError(err).Fatal("invalid gateway local id")
 	}
@@ -358,9 +366,9 @@ func printGatewaysAsTable(gateways []*gateway.Gateway) {
 		}
 		row := []string{
 			fmt.Sprintf("%d", i+1),
-			hex.EncodeToString(gw.ThingsIxID[:]),
-			gw.LocalID.String(),
-			gw.NetworkID.String(),
+			gateway.FormatThingsIxID(gw.ThingsIxID, idFormat),
+			gateway.FormatEUI64(gw.LocalID, idFormat),
+			gateway.FormatEUI64(gw.NetworkID, idFormat),
 			owner,
 			band,
 			version,
@@ -63,10 +63,37 @@ type StoreConfig struct {
 	// Only data for gateways in the store is forwarded.
 	YamlStorePath *string `mapstructure:"file"`
 
+	// Keystore if non nil encrypts the private keys of gateways in the
+	// YAML based file store with a passphrase.
+	Keystore *KeystoreConfig `mapstructure:"keystore"`
+
 	// Use a PGSQL database to store gateways.
 	Postgresql *bool `mapstructure:"postgresql"`
 }
 
+// KeystoreConfig enables encryption of gateway private keys in the file
+// based gateway store. Keys are encrypted with a key derived from the
+// passphrase with scrypt and AES-128-CTR, the format go-ethereum uses for
+// its keystore.
+type KeystoreConfig struct {
+	// Passphrase used to encrypt gateway keys
+	Passphrase string `mapstructure:"passphrase"`
+	// PassphraseFile is a file that contains the passphrase, takes
+	// precedence over Passphrase
+	PassphraseFile string `mapstructure:"passphrase_file"`
+	// PassphraseEnv is the environment variable the passphrase is read
+	// from when neither Passphrase nor PassphraseFile is set, defaults to
+	// THINGSIX_GATEWAY_STORE_PASSPHRASE
+	PassphraseEnv string `mapstructure:"passphrase_env"`
+	// Prompt for the passphrase on the terminal when it is not configured
+	Prompt bool `mapstructure:"prompt"`
+	// ScryptN and ScryptP are the scrypt parameters for newly encrypted
+	// keys, they default to 4096 and 6. Higher values increase the cost of
+	// a brute force attack but also the time it takes to load the store.
+	ScryptN int `mapstructure:"scrypt_n"`
+	ScryptP int `mapstructure:"scrypt_p"`
+}
+
 func (sc StoreConfig) Type() GatewayStoreType {
 	if sc.Postgresql != nil && *sc.Postgresql {
 		return PostgresqlGatewayStore
@@ -97,4 +124,35 @@ type RegistrySyncOnChainConfig struct {
 type RegistrySyncConfig struct {
 	ThingsIxApi RegistrySyncAPIConfig      `mapstructure:"thingsix_api"`
 	OnChain     *RegistrySyncOnChainConfig `mapstructure:"on_chain"`
+	Local       *RegistrySyncLocalConfig   `mapstructure:"local"`
+}
+
+// RegistrySyncLocalConfig serves gateway information from the configuration
+// instead of the ThingsIX gateway registry. It is used in private deployments
+// without on-chain components.
+type RegistrySyncLocalConfig struct {
+	// Owner of gateways that are not listed in Gateways, if not set these
+	// gateways are not onboarded
+	Owner common.Address `mapstructure:"owner"`
+	// Version of gateways that are not listed in Gateways
+	Version uint8 `mapstructure:"version"`
+	// Details of gateways that are not listed in Gateways
+	Details RegistrySyncLocalDetailsConfig `mapstructure:"details"`
+	// Gateways holds per gateway registrations, keyed by ThingsIX id
+	Gateways map[string]RegistrySyncLocalGatewayConfig `mapstructure:"gateways"`
+}
+
+type RegistrySyncLocalGatewayConfig struct {
+	// Owner of the gateway, defaults to the registry owner
+	Owner   common.Address                 `mapstructure:"owner"`
+	Version uint8                          `mapstructure:"version"`
+	Details RegistrySyncLocalDetailsConfig `mapstructure:"details"`
+}
+
+type RegistrySyncLocalDetailsConfig struct {
+	AntennaGain string `mapstructure:"antenna_gain"`
+	Band        string `mapstructure:"band"`
+	// Location is the H3 cell of the gateway location
+	Location string `mapstructure:"location"`
+	Altitude uint16 `mapstructure:"altitude"`
 }
@@ -16,18 +16,18 @@
 
 package gateway
 
-import (
-	"errors"
-	"fmt"
-)
+import "github.com/ThingsIXFoundation/packet-handling/errs"
 
 var (
-	ErrStoreNotExists               = fmt.Errorf("gateway store doesn't exists")
-	ErrNotFound                     = fmt.Errorf("not found")
-	ErrServiceNotAvailable          = fmt.Errorf("service not available")
-	ErrAlreadyExists                = fmt.Errorf("already exists")
-	ErrInvalidConfig                = errors.New("invalid gateway store config")
-	ErrInvalidGatewayID             = errors.New("invalid gateway id")
-	ErrGatewayRegistryConfigMissing = errors.New("gateway ThingsIX registry config missing")
-	ErrTooManySyncRequests          = errors.New("too fast gateway sync request")
+	ErrStoreNotExists               = errs.New(errs.ErrNotFound, "gateway store doesn't exists")
+	ErrNotFound                     = errs.New(errs.ErrNotFound, "not found")
+	ErrServiceNotAvailable          = errs.New(errs.ErrUnavailable, "service not available")
+	ErrAlreadyExists                = errs.New(errs.ErrAlreadyExists, "already exists")
+	ErrInvalidConfig                = errs.New(errs.ErrInvalidArgument, "invalid gateway store config")
+	ErrInvalidGatewayID             = errs.New(errs.ErrInvalidArgument, "invalid gateway id")
+	ErrAmbiguousGatewayID           = errs.New(errs.ErrInvalidArgument, "gateway id matches multiple gateways")
+	ErrGatewayRegistryConfigMissing = errs.New(errs.ErrInvalidArgument, "gateway ThingsIX registry config missing")
+	ErrTooManySyncRequests          = errs.New(errs.ErrResourceExhausted, "too fast gateway sync request")
+	ErrInvalidNetworkIDPrefix       = errs.New(errs.ErrInvalidArgument, "invalid network id prefix")
+	ErrNetworkIDPrefixNotFound      = errs.New(errs.ErrNotFound, "no key found with network id prefix")
 )
@@ -21,6 +21,8 @@ import (
 	"encoding/hex"
 	"fmt"
 
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/brocaar/lorawan"
 	"github.com/ethereum/go-ethereum/common"
@@ -69,6 +71,77 @@ type GatewayDetails struct {
 	Altitude    *uint16 `json:"altitude,omitempty"`
 }
 
+// GatewayMetadata holds optional information about a gateway that is set by
+// the operator. Unlike the details it isn't registered in ThingsIX.
+type GatewayMetadata struct {
+	// Name is a human readable name for the gateway
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Latitude and Longitude of the installation location in degrees
+	Latitude  *float64 `json:"latitude,omitempty" yaml:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty" yaml:"longitude,omitempty"`
+	// Altitude of the antenna in meters
+	Altitude *float64 `json:"altitude,omitempty" yaml:"altitude,omitempty"`
+	// AntennaGain in dBi
+	AntennaGain *float64 `json:"antennaGain,omitempty" yaml:"antenna_gain,omitempty"`
+	// Contact is who to contact about the gateway, e.g. an email address
+	Contact string `json:"contact,omitempty" yaml:"contact,omitempty"`
+	// BandPlan is the regional band plan the gateway operates in, e.g.
+	// EU868 or AS923-2. It applies when no band is registered for the
+	// gateway.
+	BandPlan string `json:"bandPlan,omitempty" yaml:"band_plan,omitempty"`
+}
+
+// Validate returns an error if the metadata holds an invalid location.
+func (m *GatewayMetadata) Validate() error {
+	if m == nil {
+		return nil
+	}
+	if (m.Latitude == nil) != (m.Longitude == nil) {
+		return fmt.Errorf("latitude and longitude must be set together")
+	}
+	if m.Latitude != nil && (*m.Latitude < -90 || *m.Latitude > 90) {
+		return fmt.Errorf("invalid latitude %f", *m.Latitude)
+	}
+	if m.Longitude != nil && (*m.Longitude < -180 || *m.Longitude > 180) {
+		return fmt.Errorf("invalid longitude %f", *m.Longitude)
+	}
+	if m.BandPlan != "" {
+		var plan frequency_plan.BandName
+		if err := plan.UnmarshalText([]byte(m.BandPlan)); err != nil {
+			return fmt.Errorf("invalid band plan: %w", err)
+		}
+	}
+	return nil
+}
+
+// Equal returns an indication if m and o hold the same metadata.
+func (m *GatewayMetadata) Equal(o *GatewayMetadata) bool {
+	if m == nil || o == nil {
+		return m == o
+	}
+	eq := func(a, b *float64) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	}
+	return m.Name == o.Name && m.Contact == o.Contact && m.BandPlan == o.BandPlan &&
+		eq(m.Latitude, o.Latitude) && eq(m.Longitude, o.Longitude) &&
+		eq(m.Altitude, o.Altitude) && eq(m.AntennaGain, o.AntennaGain)
+}
+
+// clone returns a deep copy of m.
+func (m *GatewayMetadata) clone() *GatewayMetadata {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	for _, f := range []**float64{&c.Latitude, &c.Longitude, &c.Altitude, &c.AntennaGain} {
+		if *f != nil {
+			v := **f
+			*f = &v
+		}
+	}
+	return &c
+}
+
 // Gateway represents a ThingsIX gateway
 type Gateway struct {
 	// LocalID is the gateway ID as used in the communication between gateway
@@ -77,8 +150,13 @@ type Gateway struct {
 	// NetId is the gateway id as used in the communication between the
 	// forwarder and the ThingsIX network.
 	NetworkID lorawan.EUI64 `json:"networkId"`
-	// PrivateKey is the gateways private key
+	// PrivateKey is the gateways private key, nil when the key is held
+	// outside the forwarder.
 	PrivateKey *ecdsa.PrivateKey `json:"-"`
+	// KeyRef references the gateway key when it is held outside the
+	// forwarder, e.g. in a HSM. KeySigner signs with this key.
+	KeyRef    string    `json:"-"`
+	KeySigner KeySigner `json:"-"`
 	// PublicKey is the gateways public key from which the ThingsIX is derived.
 	PublicKey *ecdsa.PublicKey `json:"-"`
 	// PublicKeyBytes
@@ -97,6 +175,13 @@ type Gateway struct {
 	// Details set by the gateway owner. Can be empty when the details are not
 	// set or the details are not yet retrieved.
 	Details *GatewayDetails `json:"details,omitempty"`
+	// Disabled gateways stay in the store but data from and to them is
+	// dropped.
+	Disabled bool `json:"disabled,omitempty"`
+	// Tags are labels set by the operator to group gateways.
+	Tags []string `json:"tags,omitempty"`
+	// Metadata is optional information set by the operator.
+	Metadata *GatewayMetadata `json:"metadata,omitempty"`
 }
 
 // ID is the identifier as which the gateway is registered in the gateway
@@ -143,6 +228,19 @@ func (gw *Gateway) Address() common.Address {
 	return crypto.PubkeyToAddress(*gw.PublicKey)
 }
 
+// Signer returns a signer that signs with the gateway key using the given
+// signature scheme.
+func (gw *Gateway) Signer(scheme string) (signing.Signer, error) {
+	if gw.PrivateKey == nil && gw.KeySigner != nil {
+		// derived keys such as the ed25519 key require the private key
+		if scheme != signing.Secp256k1 {
+			return nil, fmt.Errorf("%w: %s with an external gateway key", signing.ErrUnsupportedScheme, scheme)
+		}
+		return signing.NewSecp256k1DigestSigner(gw.PublicKey, gw.KeySigner.SignDigest), nil
+	}
+	return signing.NewSigner(scheme, gw.PrivateKey)
+}
+
 type Collector struct {
 	Gateways []*Gateway
 }
@@ -0,0 +1,187 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Gateway identifiers are displayed in a canonical format everywhere, in logs,
+// API replies and CLI output:
+//
+//   - local and network ids (EUI64) as 16 lowercase hex characters without
+//     separators or prefix, e.g. 0016c001ff10a1b2
+//   - ThingsIX ids as 0x prefixed lowercase hex, e.g. 0x7c2b...e1f0
+//
+// Parsing is lenient and accepts ids with or without 0x prefix, in upper or
+// lower case and EUI64 values with colon, dash or space separators. Short
+// forms as shown by ShortEUI64 and ShortThingsIxID can be resolved against a
+// gateway store with Lookup.
+
+// IDFormat determines how EUI64 ids are formatted.
+type IDFormat string
+
+const (
+	// IDFormatCanonical formats EUI64 values as 16 lowercase hex characters
+	IDFormatCanonical IDFormat = "canonical"
+	// IDFormatColon formats EUI64 values as colon separated bytes
+	IDFormatColon IDFormat = "colon"
+	// IDFormatShort formats ids in their short form
+	IDFormatShort IDFormat = "short"
+)
+
+// shortIDLength is the number of hex characters kept in short forms.
+const shortIDLength = 8
+
+// ParseIDFormat parses the given format name.
+func ParseIDFormat(s string) (IDFormat, error) {
+	switch f := IDFormat(strings.ToLower(s)); f {
+	case IDFormatCanonical, IDFormatColon, IDFormatShort:
+		return f, nil
+	case "":
+		return IDFormatCanonical, nil
+	default:
+		return "", fmt.Errorf("unknown id format %q", s)
+	}
+}
+
+// normalizeHexID removes the 0x prefix, separators and surrounding
+// whitespace and lowercases the id.
+func normalizeHexID(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "0x")
+	return strings.NewReplacer(":", "", "-", "", " ", "").Replace(s)
+}
+
+// ParseEUI64 parses a local or network id in any of the supported formats.
+func ParseEUI64(s string) (lorawan.EUI64, error) {
+	var eui lorawan.EUI64
+	b, err := hex.DecodeString(normalizeHexID(s))
+	if err != nil || len(b) != len(eui) {
+		return eui, fmt.Errorf("%w: %q", ErrInvalidGatewayID, s)
+	}
+	copy(eui[:], b)
+	return eui, nil
+}
+
+// ParseThingsIxID parses a ThingsIX id with or without 0x prefix. The
+// compressed public key the id is derived from is accepted as well.
+func ParseThingsIxID(s string) (ThingsIxID, error) {
+	var id ThingsIxID
+	b, err := hex.DecodeString(normalizeHexID(s))
+	if err != nil {
+		return id, fmt.Errorf("%w: %q", ErrInvalidGatewayID, s)
+	}
+	if len(b) == len(id)+1 && (b[0] == 0x02 || b[0] == 0x03) {
+		b = b[1:]
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("%w: %q", ErrInvalidGatewayID, s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// FormatEUI64 formats the local or network id in the given format.
+func FormatEUI64(eui lorawan.EUI64, format IDFormat) string {
+	switch format {
+	case IDFormatColon:
+		parts := make([]string, len(eui))
+		for i, b := range eui {
+			parts[i] = hex.EncodeToString([]byte{b})
+		}
+		return strings.Join(parts, ":")
+	case IDFormatShort:
+		return ShortEUI64(eui)
+	default:
+		return eui.String()
+	}
+}
+
+// FormatThingsIxID formats the ThingsIX id in the given format, ThingsIX ids
+// have no colon format and are formatted canonical instead.
+func FormatThingsIxID(id ThingsIxID, format IDFormat) string {
+	if format == IDFormatShort {
+		return ShortThingsIxID(id)
+	}
+	return id.String()
+}
+
+// ShortEUI64 returns the last 8 hex characters of the id, this is the part
+// that differs between gateways of the same vendor.
+func ShortEUI64(eui lorawan.EUI64) string {
+	s := eui.String()
+	return s[len(s)-shortIDLength:]
+}
+
+// ShortThingsIxID returns the 0x prefixed first 8 hex characters of the id.
+func ShortThingsIxID(id ThingsIxID) string {
+	return id.String()[:2+shortIDLength]
+}
+
+// Lookup returns the gateway identified by id. The id can be a local id,
+// network id or ThingsIX id in any supported format, or a short form of one
+// of these. Short forms must match a single gateway, if multiple gateways
+// match ErrAmbiguousGatewayID is returned.
+func Lookup(store GatewayStore, id string) (*Gateway, error) {
+	normalized := normalizeHexID(id)
+	if len(normalized) == 0 {
+		return nil, ErrInvalidGatewayID
+	}
+	if _, err := hex.DecodeString(normalized + strings.Repeat("0", len(normalized)%2)); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidGatewayID, id)
+	}
+
+	if tid, err := ParseThingsIxID(id); err == nil {
+		return store.ByThingsIxID(tid)
+	}
+
+	if eui, err := ParseEUI64(id); err == nil {
+		if gw, err := store.ByLocalID(eui); err == nil {
+			return gw, nil
+		}
+		return store.ByNetworkID(eui)
+	}
+
+	// short form, match as suffix of EUI64 ids or prefix of ThingsIX ids
+	if len(normalized) < 4 {
+		return nil, fmt.Errorf("%w: %q is too short", ErrInvalidGatewayID, id)
+	}
+	var (
+		collector Collector
+		match     *Gateway
+	)
+	store.Range(&collector)
+	for _, gw := range collector.Gateways {
+		if strings.HasSuffix(gw.LocalID.String(), normalized) ||
+			strings.HasSuffix(gw.NetworkID.String(), normalized) ||
+			strings.HasPrefix(hex.EncodeToString(gw.ThingsIxID[:]), normalized) {
+			if match != nil && match != gw {
+				return nil, ErrAmbiguousGatewayID
+			}
+			match = gw
+		}
+	}
+	if match == nil {
+		return nil, ErrNotFound
+	}
+	return match, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestParseEUI64(t *testing.T) {
+	expected := lorawan.EUI64{0x00, 0x16, 0xc0, 0x01, 0xff, 0x10, 0xa1, 0xb2}
+	for _, input := range []string{
+		"0016c001ff10a1b2",
+		"0016C001FF10A1B2",
+		"0x0016c001ff10a1b2",
+		"00:16:c0:01:ff:10:a1:b2",
+		"00-16-C0-01-FF-10-A1-B2",
+		" 0016c001ff10a1b2\n",
+	} {
+		got, err := ParseEUI64(input)
+		if err != nil {
+			t.Errorf("parse %q: %v", input, err)
+		} else if got != expected {
+			t.Errorf("parse %q: got %s", input, got)
+		}
+	}
+
+	for _, input := range []string{"", "0016c001ff10a1", "0016c001ff10a1b2ff", "zz16c001ff10a1b2"} {
+		if _, err := ParseEUI64(input); err == nil {
+			t.Errorf("parse %q: expected error", input)
+		}
+	}
+}
+
+func TestFormatEUI64(t *testing.T) {
+	eui := lorawan.EUI64{0x00, 0x16, 0xc0, 0x01, 0xff, 0x10, 0xa1, 0xb2}
+	for format, expected := range map[IDFormat]string{
+		IDFormatCanonical: "0016c001ff10a1b2",
+		IDFormatColon:     "00:16:c0:01:ff:10:a1:b2",
+		IDFormatShort:     "ff10a1b2",
+	} {
+		if got := FormatEUI64(eui, format); got != expected {
+			t.Errorf("format %s: got %s, want %s", format, got, expected)
+		}
+	}
+}
+
+func TestParseThingsIxID(t *testing.T) {
+	const canonical = "0x7c2b4f1e0d3a5968778695a4b3c2d1e0f1e2d3c4b5a6978879695a4b3c2d1e0f"
+	for _, input := range []string{
+		canonical,
+		canonical[2:],
+		"0X7C2B4F1E0D3A5968778695A4B3C2D1E0F1E2D3C4B5A6978879695A4B3C2D1E0F",
+		"0x02" + canonical[2:], // compressed public key
+	} {
+		id, err := ParseThingsIxID(input)
+		if err != nil {
+			t.Errorf("parse %q: %v", input, err)
+		} else if id.String() != canonical {
+			t.Errorf("parse %q: got %s", input, id)
+		}
+	}
+
+	id, _ := ParseThingsIxID(canonical)
+	if got := FormatThingsIxID(id, IDFormatShort); got != "0x7c2b4f1e" {
+		t.Errorf("short form: got %s", got)
+	}
+	if _, err := ParseThingsIxID("0x04" + canonical[2:]); err == nil {
+		t.Error("expected error for uncompressed key prefix")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build cgo
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+// secp256k1OID is the DER encoded object identifier of the secp256k1 curve
+// (1.3.132.0.10) as it is stored in CKA_EC_PARAMS.
+var secp256k1OID = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x0a}
+
+func init() {
+	RegisterKeyOpener("pkcs11", openPKCS11Key)
+}
+
+var (
+	pkcs11ModulesMu sync.Mutex
+	// pkcs11Modules holds the loaded PKCS#11 libraries by path, a library
+	// must only be initialized once per process
+	pkcs11Modules = make(map[string]*pkcs11.Ctx)
+)
+
+func loadPKCS11Module(path string) (*pkcs11.Ctx, error) {
+	pkcs11ModulesMu.Lock()
+	defer pkcs11ModulesMu.Unlock()
+
+	if ctx, ok := pkcs11Modules[path]; ok {
+		return ctx, nil
+	}
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load pkcs11 module %s", path)
+	}
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("unable to initialize pkcs11 module %s: %w", path, err)
+	}
+	pkcs11Modules[path] = ctx
+	return ctx, nil
+}
+
+// pkcs11Signer signs with a secp256k1 key on a PKCS#11 token. The session
+// is shared by all signatures with the key, PKCS#11 sessions are not safe
+// for concurrent use.
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     *ecdsa.PublicKey
+}
+
+func openPKCS11Key(u *url.URL) (KeySigner, error) {
+	ref, err := parsePKCS11KeyRef(u)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := loadPKCS11Module(ref.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, err := findPKCS11Slot(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open pkcs11 session: %w", err)
+	}
+	if ref.PIN != "" {
+		if err := ctx.Login(session, pkcs11.CKU_USER, ref.PIN); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			_ = ctx.CloseSession(session)
+			return nil, fmt.Errorf("unable to login on pkcs11 token: %w", err)
+		}
+	}
+
+	signer, err := newPKCS11Signer(ctx, session, ref)
+	if err != nil {
+		_ = ctx.CloseSession(session)
+		return nil, err
+	}
+	return signer, nil
+}
+
+func findPKCS11Slot(ctx *pkcs11.Ctx, ref *pkcs11KeyRef) (uint, error) {
+	if ref.Token == "" {
+		return *ref.SlotID, nil
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list pkcs11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(info.Label) == ref.Token && (ref.SlotID == nil || *ref.SlotID == slot) {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("pkcs11 token %q not found", ref.Token)
+}
+
+func newPKCS11Signer(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, ref *pkcs11KeyRef) (*pkcs11Signer, error) {
+	key, err := findPKCS11Object(ctx, session, pkcs11.CKO_PRIVATE_KEY, ref)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := findPKCS11Object(ctx, session, pkcs11.CKO_PUBLIC_KEY, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, pubKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pkcs11 public key: %w", err)
+	}
+	var params, point []byte
+	for _, attr := range attrs {
+		switch attr.Type {
+		case pkcs11.CKA_EC_PARAMS:
+			params = attr.Value
+		case pkcs11.CKA_EC_POINT:
+			point = attr.Value
+		}
+	}
+	if !bytes.Equal(params, secp256k1OID) {
+		return nil, fmt.Errorf("pkcs11 key is not a secp256k1 key")
+	}
+	// CKA_EC_POINT is a DER encoded octet string, some tokens return the raw point
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+		raw = point
+	}
+	pub, err := crypto.UnmarshalPubkey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkcs11 public key: %w", err)
+	}
+
+	return &pkcs11Signer{
+		ctx:     ctx,
+		session: session,
+		key:     key,
+		pub:     pub,
+	}, nil
+}
+
+func findPKCS11Object(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, ref *pkcs11KeyRef) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+	}
+	if ref.Object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, ref.Object))
+	}
+	if len(ref.ID) != 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, ref.ID))
+	}
+
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("unable to search pkcs11 key: %w", err)
+	}
+	objects, _, err := ctx.FindObjects(session, 2)
+	_ = ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, fmt.Errorf("unable to search pkcs11 key: %w", err)
+	}
+	switch len(objects) {
+	case 0:
+		return 0, fmt.Errorf("pkcs11 key not found")
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, fmt.Errorf("pkcs11 key reference matches multiple keys")
+	}
+}
+
+func (s *pkcs11Signer) Public() *ecdsa.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) SignDigest(digest []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.key); err != nil {
+		return nil, fmt.Errorf("unable to sign with pkcs11 key: %w", err)
+	}
+	sig, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign with pkcs11 key: %w", err)
+	}
+	return RecoverableSignature(s.pub, digest, sig)
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !cgo
+
+package gateway
+
+import (
+	"fmt"
+	"net/url"
+)
+
+func init() {
+	RegisterKeyOpener("pkcs11", func(u *url.URL) (KeySigner, error) {
+		if _, err := parsePKCS11KeyRef(u); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("PKCS#11 support requires a forwarder that is built with cgo (CGO_ENABLED=1)")
+	})
+}
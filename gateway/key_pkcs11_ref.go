@@ -0,0 +1,106 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pkcs11KeyRef holds the attributes of a PKCS#11 URI (RFC 7512) that
+// identify a gateway key, e.g.:
+//
+//	pkcs11:token=thingsix;object=gw-0016c001ff10d3f6?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=/etc/thingsix-forwarder/hsm.pin
+type pkcs11KeyRef struct {
+	// Token is the label of the token that holds the key
+	Token string
+	// SlotID is the slot the token is in, used when Token is not set
+	SlotID *uint
+	// Object is the label of the key
+	Object string
+	// ID is the CKA_ID of the key
+	ID []byte
+	// ModulePath is the PKCS#11 library of the HSM or token
+	ModulePath string
+	// PIN is the user PIN, read from pin-value or the pin-source file
+	PIN string
+}
+
+func parsePKCS11KeyRef(u *url.URL) (*pkcs11KeyRef, error) {
+	var ref pkcs11KeyRef
+
+	path := u.Opaque
+	if path == "" {
+		path = u.Path
+	}
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pkcs11 attribute %q", attr)
+		}
+		value, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkcs11 attribute %q", attr)
+		}
+		switch name {
+		case "token":
+			ref.Token = value
+		case "object":
+			ref.Object = value
+		case "id":
+			ref.ID = []byte(value)
+		case "slot-id":
+			id, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pkcs11 slot-id %q", value)
+			}
+			slot := uint(id)
+			ref.SlotID = &slot
+		}
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkcs11 query attributes")
+	}
+	ref.ModulePath = query.Get("module-path")
+	ref.PIN = query.Get("pin-value")
+	if source := query.Get("pin-source"); source != "" && ref.PIN == "" {
+		pin, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pkcs11 pin: %w", err)
+		}
+		ref.PIN = strings.TrimSpace(string(pin))
+	}
+
+	if ref.ModulePath == "" {
+		return nil, fmt.Errorf("pkcs11 module-path missing")
+	}
+	if ref.Token == "" && ref.SlotID == nil {
+		return nil, fmt.Errorf("pkcs11 token or slot-id missing")
+	}
+	if ref.Object == "" && len(ref.ID) == 0 {
+		return nil, fmt.Errorf("pkcs11 object or id missing")
+	}
+	return &ref, nil
+}
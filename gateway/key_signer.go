@@ -0,0 +1,186 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// ErrUnsupportedKeyRef is returned when a key reference uses a scheme for
+	// which no key opener is registered.
+	ErrUnsupportedKeyRef = errs.New(errs.ErrNotSupported, "unsupported gateway key reference")
+)
+
+// KeySigner signs with a gateway key that is held outside the forwarder, for
+// example in a HSM, PKCS#11 token or cloud KMS. The private key never leaves
+// the device or service that holds it.
+type KeySigner interface {
+	// Public returns the public key of the gateway key.
+	Public() *ecdsa.PublicKey
+	// SignDigest returns the 65 byte [R || S || V] secp256k1 signature over
+	// the given 32 byte digest.
+	SignDigest(digest []byte) ([]byte, error)
+}
+
+// KeyOpener returns the signer for the key the given reference points to.
+type KeyOpener func(ref *url.URL) (KeySigner, error)
+
+// KeyRefStore is implemented by gateway stores that can store gateways with a
+// key that is held outside the forwarder. Only the key reference is stored.
+type KeyRefStore interface {
+	// AddKeyRef adds the gateway that signs with the given signer that was
+	// opened from ref. If the gateway already exists ErrAlreadyExists is
+	// returned.
+	AddKeyRef(ctx context.Context, localID lorawan.EUI64, ref string, signer KeySigner) (*Gateway, error)
+}
+
+var (
+	keyOpenersMu sync.RWMutex
+	keyOpeners   = make(map[string]KeyOpener)
+)
+
+// RegisterKeyOpener registers the opener for key references with the given
+// URI scheme, e.g. pkcs11.
+func RegisterKeyOpener(scheme string, open KeyOpener) {
+	keyOpenersMu.Lock()
+	defer keyOpenersMu.Unlock()
+	keyOpeners[scheme] = open
+}
+
+// OpenKeyRef returns the signer for the key the given reference points to.
+// References are URI's, the scheme determines the key opener that is used.
+func OpenKeyRef(ref string) (KeySigner, error) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme == "" {
+		return nil, fmt.Errorf("invalid gateway key reference")
+	}
+
+	keyOpenersMu.RLock()
+	open, ok := keyOpeners[u.Scheme]
+	keyOpenersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKeyRef, u.Scheme)
+	}
+
+	signer, err := open(u)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open gateway key %s: %w", redactKeyRef(u), err)
+	}
+	return signer, nil
+}
+
+// redactKeyRef returns the reference without query parameters that can hold
+// secrets such as the PIN.
+func redactKeyRef(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = ""
+	return redacted.String()
+}
+
+// NewGatewayWithKeySigner returns a gateway that signs with a key that is held
+// outside the forwarder.
+func NewGatewayWithKeySigner(localID lorawan.EUI64, ref string, signer KeySigner) (*Gateway, error) {
+	pub := signer.Public()
+	if pub == nil || pub.Curve != crypto.S256() {
+		return nil, fmt.Errorf("gateway key is not a secp256k1 key")
+	}
+	return &Gateway{
+		LocalID:        localID,
+		NetworkID:      GatewayNetworkIDFromPublicKey(pub),
+		KeyRef:         ref,
+		KeySigner:      signer,
+		PublicKey:      pub,
+		ThingsIxID:     utils.DeriveThingsIxID(pub),
+		PublicKeyBytes: utils.CalculatePublicKeyBytes(pub),
+	}, nil
+}
+
+// withRegistration returns a copy of gw with the given registry details.
+func (gw *Gateway) withRegistration(owner common.Address, version uint8) (*Gateway, error) {
+	if gw.PrivateKey != nil {
+		return NewOnboardedGateway(gw.LocalID, gw.PrivateKey, owner, version)
+	}
+	synced := *gw
+	synced.Owner, synced.Version, synced.Details = &owner, &version, nil
+	return &synced, nil
+}
+
+// signDigest returns the [R || S || V] secp256k1 signature over digest with
+// the gateway key.
+func (gw *Gateway) signDigest(digest []byte) ([]byte, error) {
+	if gw.PrivateKey != nil {
+		return crypto.Sign(digest, gw.PrivateKey)
+	}
+	if gw.KeySigner != nil {
+		return gw.KeySigner.SignDigest(digest)
+	}
+	return nil, fmt.Errorf("gateway %s has no key", gw.LocalID)
+}
+
+var secp256k1HalfN = new(big.Int).Rsh(crypto.S256().Params().N, 1)
+
+// RecoverableSignature converts the ECDSA signature that a HSM or KMS
+// returned for digest into the [R || S || V] format used by ThingsIX. The
+// signature is either 64 bytes (R || S) or ASN.1 DER encoded. S is normalized
+// to the lower half of the curve order and V is determined by recovering the
+// public key.
+func RecoverableSignature(pub *ecdsa.PublicKey, digest, sig []byte) ([]byte, error) {
+	var r, s *big.Int
+	if len(sig) == 64 {
+		r, s = new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	} else {
+		var der struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &der); err != nil || len(rest) != 0 {
+			return nil, fmt.Errorf("invalid signature encoding")
+		}
+		r, s = der.R, der.S
+	}
+	if s.Cmp(secp256k1HalfN) > 0 {
+		s = new(big.Int).Sub(crypto.S256().Params().N, s)
+	}
+	if r.BitLen() > 256 || s.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	var (
+		recoverable = make([]byte, crypto.SignatureLength)
+		expected    = crypto.FromECDSAPub(pub)
+	)
+	r.FillBytes(recoverable[:32])
+	s.FillBytes(recoverable[32:64])
+	for v := byte(0); v < 2; v++ {
+		recoverable[64] = v
+		if recovered, err := crypto.Ecrecover(digest, recoverable); err == nil && bytes.Equal(recovered, expected) {
+			return recoverable, nil
+		}
+	}
+	return nil, fmt.Errorf("signature doesn't match gateway key")
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// softKeySigner mimics a HSM, it returns signatures without recovery id and
+// with a high S value.
+type softKeySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s softKeySigner) Public() *ecdsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s softKeySigner) SignDigest(digest []byte) ([]byte, error) {
+	sig, err := crypto.Sign(digest, s.key)
+	if err != nil {
+		return nil, err
+	}
+	highS := new(big.Int).Sub(crypto.S256().Params().N, new(big.Int).SetBytes(sig[32:64]))
+	highS.FillBytes(sig[32:64])
+	return RecoverableSignature(&s.key.PublicKey, digest, sig[:64])
+}
+
+func TestYamlFileStoreKeyRef(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		path    = filepath.Join(t.TempDir(), "gateways.yaml")
+		localID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		ref     = "softkey:gateway-1"
+	)
+
+	key, err := utils.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterKeyOpener("softkey", func(u *url.URL) (KeySigner, error) {
+		return softKeySigner{key: key}, nil
+	})
+
+	store, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := OpenKeyRef(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddKeyRef(ctx, localID, ref, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("private_key")) || !bytes.Contains(raw, []byte(ref)) {
+		t.Errorf("expected only the key reference in the store, got:\n%s", raw)
+	}
+
+	loaded, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := loaded.ByLocalID(localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gw.PrivateKey != nil || gw.ThingsIxID != utils.DeriveThingsIxID(&key.PublicKey) {
+		t.Fatal("gateway not loaded from key reference")
+	}
+
+	secp, err := gw.Signer(signing.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("packet receipt")
+	sig, err := secp.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := signing.Verify(signing.Secp256k1, secp.PublicKey(), msg, sig); err != nil || !ok {
+		t.Errorf("signature with external key rejected: %v", err)
+	}
+	if _, err := gw.Signer(signing.Ed25519); err == nil {
+		t.Error("expected ed25519 to be unsupported for external keys")
+	}
+
+	onboard, err := SignPlainBatchOnboardMessage(big.NewInt(1), common.Address{1}, common.Address{2}, 1, gw)
+	if err != nil || len(onboard) != crypto.SignatureLength {
+		t.Errorf("unable to sign onboard message with external key: %v", err)
+	}
+}
+
+func TestParsePKCS11KeyRef(t *testing.T) {
+	u, err := url.Parse("pkcs11:token=thingsix%20hsm;object=gw-1;slot-id=2?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := parsePKCS11KeyRef(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Token != "thingsix hsm" || ref.Object != "gw-1" || ref.SlotID == nil || *ref.SlotID != 2 ||
+		ref.ModulePath != "/usr/lib/softhsm/libsofthsm2.so" || ref.PIN != "1234" {
+		t.Errorf("unexpected pkcs11 reference %+v", ref)
+	}
+
+	u, _ = url.Parse("pkcs11:token=thingsix?module-path=/lib.so")
+	if _, err := parsePKCS11KeyRef(u); err == nil {
+		t.Error("expected error for reference without object")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/console/prompt"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// DefaultKeystorePassphraseEnv is the environment variable the keystore
+// passphrase is read from if none is configured.
+const DefaultKeystorePassphraseEnv = "THINGSIX_GATEWAY_STORE_PASSPHRASE"
+
+var (
+	ErrKeystorePassphraseMissing = errs.New(errs.ErrInvalidArgument, "gateway keystore passphrase not configured")
+	ErrKeystoreLocked            = errs.New(errs.ErrFailedPrecondition, "gateway store contains encrypted keys but no keystore is configured")
+)
+
+// Keystore encrypts and decrypts gateway private keys with a passphrase.
+type Keystore struct {
+	passphrase string
+	scryptN    int
+	scryptP    int
+}
+
+// NewKeystore returns a keystore that uses the passphrase from the given
+// configuration, environment or terminal prompt, in that order.
+func NewKeystore(cfg *KeystoreConfig) (*Keystore, error) {
+	ks := &Keystore{
+		passphrase: cfg.Passphrase,
+		scryptN:    cfg.ScryptN,
+		scryptP:    cfg.ScryptP,
+	}
+	if ks.scryptN <= 0 {
+		ks.scryptN = keystore.LightScryptN
+	}
+	if ks.scryptP <= 0 {
+		ks.scryptP = keystore.LightScryptP
+	}
+
+	if cfg.PassphraseFile != "" {
+		raw, err := os.ReadFile(cfg.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gateway keystore passphrase: %w", err)
+		}
+		ks.passphrase = strings.TrimRight(string(raw), "\r\n")
+	}
+	if ks.passphrase == "" {
+		env := cfg.PassphraseEnv
+		if env == "" {
+			env = DefaultKeystorePassphraseEnv
+		}
+		ks.passphrase = os.Getenv(env)
+	}
+	if ks.passphrase == "" && cfg.Prompt {
+		passphrase, err := prompt.Stdin.PromptPassword("Gateway store passphrase: ")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gateway keystore passphrase: %w", err)
+		}
+		ks.passphrase = passphrase
+	}
+	if ks.passphrase == "" {
+		return nil, ErrKeystorePassphraseMissing
+	}
+	return ks, nil
+}
+
+// Encrypt returns the given private key encrypted with the keystore
+// passphrase.
+func (ks *Keystore) Encrypt(key *ecdsa.PrivateKey) (*keystore.CryptoJSON, error) {
+	encrypted, err := keystore.EncryptDataV3(crypto.FromECDSA(key), []byte(ks.passphrase), ks.scryptN, ks.scryptP)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt gateway key: %w", err)
+	}
+	return &encrypted, nil
+}
+
+// Decrypt returns the private key that was encrypted with Encrypt.
+func (ks *Keystore) Decrypt(encrypted *keystore.CryptoJSON) (*ecdsa.PrivateKey, error) {
+	keyBytes, err := keystore.DecryptDataV3(*encrypted, ks.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt gateway key: %w", err)
+	}
+	return crypto.ToECDSA(keyBytes)
+}
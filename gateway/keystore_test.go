@@ -0,0 +1,96 @@
+// Copyright 2022 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestEncryptYamlFileStore(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		path     = filepath.Join(t.TempDir(), "gateways.yaml")
+		registry = staticRegistry{}
+		localID  = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	)
+
+	key, err := utils.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewYamlFileStore(ctx, path, registry, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Add(ctx, localID, key); err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := NewKeystore(&KeystoreConfig{Passphrase: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := EncryptYamlFileStore(path, ks); err != nil || n != 1 {
+		t.Fatalf("expected 1 encrypted key, got %d: %v", n, err)
+	}
+	if n, err := EncryptYamlFileStore(path, ks); err != nil || n != 0 {
+		t.Fatalf("expected already encrypted store to be kept, got %d: %v", n, err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte(" private_key:")) {
+		t.Error("plain text key in encrypted store")
+	}
+
+	encrypted, err := NewYamlFileStore(ctx, path, registry, frequency_plan.EU868, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := encrypted.ByLocalID(localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(crypto.FromECDSA(gw.PrivateKey), crypto.FromECDSA(key)) {
+		t.Error("decrypted key differs")
+	}
+
+	locked := &yamlFileStore{path: path}
+	if _, err := locked.loadFromFile(true); !errors.Is(err, ErrKeystoreLocked) {
+		t.Errorf("expected locked store without keystore, got %v", err)
+	}
+
+	wrong, err := NewKeystore(&KeystoreConfig{Passphrase: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncryptYamlFileStore(path, wrong); err == nil {
+		t.Error("expected error for wrong passphrase")
+	}
+}
@@ -59,7 +59,7 @@ func SignPlainBatchOnboardMessage(chainID *big.Int, contract common.Address, own
 	}
 
 	h := crypto.Keccak256Hash(packed)
-	sign, err := crypto.Sign(h[:], gw.PrivateKey)
+	sign, err := gw.signDigest(h[:])
 	if err != nil {
 		return nil, err
 	}
@@ -20,9 +20,21 @@ import (
 	"context"
 	"time"
 
+	"github.com/ThingsIXFoundation/packet-handling/logging"
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// loggers for the gateway subsystems whose log level can be changed at
+// runtime
+var (
+	// onboardingLog logs gateway registry lookups
+	onboardingLog = logging.Module("onboarding")
+	// chainSyncLog logs synchronization with the on-chain gateway registry
+	chainSyncLog = logging.Module("chain_sync")
+	// keystoreLog logs the gateway stores that hold the gateway keys
+	keystoreLog = logging.Module("keystore")
+)
+
 // ThingsIXRegistry provides access to ThingsIX gateway registry.
 type ThingsIXRegistry interface {
 	// GatewayDetails retrieves gateway details from the ThingsIX registry.
@@ -33,6 +45,9 @@ type ThingsIXRegistry interface {
 
 // NewThingsIXGatewayRegistry builds a new ThingsIX gateway registry client.
 func NewThingsIXGatewayRegistry(cfg *RegistrySyncConfig) (ThingsIXRegistry, error) {
+	if cfg != nil && cfg.Local != nil {
+		return buildThingsIXRegistryLocal(cfg.Local)
+	}
 	if cfg != nil && cfg.OnChain != nil {
 		return buildThingsIXRegistryOnChainSyncer(cfg.OnChain)
 	}
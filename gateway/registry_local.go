@@ -0,0 +1,101 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+// GatewayLocalRegistry serves gateway registrations from local configuration.
+// It replaces the ThingsIX gateway registry in private deployments that don't
+// use on-chain components.
+type GatewayLocalRegistry struct {
+	owner    common.Address
+	version  uint8
+	details  *GatewayDetails
+	gateways map[ThingsIxID]RegistrySyncLocalGatewayConfig
+}
+
+func buildThingsIXRegistryLocal(cfg *RegistrySyncLocalConfig) (*GatewayLocalRegistry, error) {
+	registry := &GatewayLocalRegistry{
+		owner:    cfg.Owner,
+		version:  cfg.Version,
+		gateways: make(map[ThingsIxID]RegistrySyncLocalGatewayConfig),
+	}
+	if cfg.Details != (RegistrySyncLocalDetailsConfig{}) {
+		registry.details = cfg.Details.gatewayDetails()
+	}
+	for id, gw := range cfg.Gateways {
+		thingsIxID, err := ParseThingsIxID(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway in local registry: %w", err)
+		}
+		registry.gateways[thingsIxID] = gw
+	}
+
+	onboardingLog.WithFields(logrus.Fields{
+		"gateways":      len(registry.gateways),
+		"default_owner": registry.owner,
+	}).Info("use local gateway registry")
+
+	return registry, nil
+}
+
+// GatewayDetails returns the registration of the gateway from the local
+// configuration. Gateways that are not configured are registered to the
+// default owner, if there is no default owner ErrNotFound is returned.
+func (registry *GatewayLocalRegistry) GatewayDetails(ctx context.Context, gatewayID ThingsIxID, force bool) (common.Address, uint8, *GatewayDetails, error) {
+	if gw, ok := registry.gateways[gatewayID]; ok {
+		owner := gw.Owner
+		if owner == (common.Address{}) {
+			owner = registry.owner
+		}
+		if owner == (common.Address{}) {
+			return common.Address{}, 0, nil, ErrNotFound
+		}
+		details := registry.details
+		if gw.Details != (RegistrySyncLocalDetailsConfig{}) {
+			details = gw.Details.gatewayDetails()
+		}
+		return owner, gw.Version, details, nil
+	}
+	if registry.owner == (common.Address{}) {
+		return common.Address{}, 0, nil, ErrNotFound
+	}
+	return registry.owner, registry.version, registry.details, nil
+}
+
+func (cfg RegistrySyncLocalDetailsConfig) gatewayDetails() *GatewayDetails {
+	details := &GatewayDetails{}
+	if cfg.AntennaGain != "" {
+		details.AntennaGain = &cfg.AntennaGain
+	}
+	if cfg.Band != "" {
+		details.Band = &cfg.Band
+	}
+	if cfg.Location != "" {
+		details.Location = &cfg.Location
+	}
+	if cfg.Altitude != 0 {
+		details.Altitude = &cfg.Altitude
+	}
+	return details
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLocalRegistry(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		listed   = ThingsIxID{1}
+		unlisted = ThingsIxID{2}
+		owner    = common.HexToAddress("0x01")
+		other    = common.HexToAddress("0x02")
+	)
+
+	registry, err := buildThingsIXRegistryLocal(&RegistrySyncLocalConfig{
+		Gateways: map[string]RegistrySyncLocalGatewayConfig{
+			listed.String(): {
+				Owner:   other,
+				Version: 2,
+				Details: RegistrySyncLocalDetailsConfig{Band: "US915", Altitude: 10},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := registry.GatewayDetails(ctx, unlisted, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found for unlisted gateway without default owner, got %v", err)
+	}
+
+	gotOwner, version, details, err := registry.GatewayDetails(ctx, listed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotOwner != other || version != 2 || details == nil || *details.Band != "US915" || *details.Altitude != 10 || details.Location != nil {
+		t.Errorf("unexpected registration %s %d %+v", gotOwner, version, details)
+	}
+
+	registry.owner, registry.details = owner, &GatewayDetails{}
+	if gotOwner, _, _, err := registry.GatewayDetails(ctx, unlisted, false); err != nil || gotOwner != owner {
+		t.Errorf("expected default owner for unlisted gateway, got %s %v", gotOwner, err)
+	}
+
+	if _, err := buildThingsIXRegistryLocal(&RegistrySyncLocalConfig{
+		Gateways: map[string]RegistrySyncLocalGatewayConfig{"invalid": {}},
+	}); !errors.Is(err, ErrInvalidGatewayID) {
+		t.Errorf("expected invalid gateway id, got %v", err)
+	}
+}
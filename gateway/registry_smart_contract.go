@@ -47,7 +47,7 @@ func buildThingsIXRegistryOnChainSyncer(cfg *RegistrySyncOnChainConfig) (*Gatewa
 		return nil, fmt.Errorf("gateway ThingsIX registry syncer missing registry smart contract address")
 	}
 
-	logrus.WithFields(logrus.Fields{
+	chainSyncLog.WithFields(logrus.Fields{
 		"registry":      cfg.Address,
 		"confirmations": cfg.Confirmation,
 	}).Info("sync with ThingsIX gateway registry on-chain")
@@ -62,7 +62,7 @@ func buildThingsIXRegistryOnChainSyncer(cfg *RegistrySyncOnChainConfig) (*Gatewa
 func (sync *GatewayThingsIXSmartContract) GatewayDetails(ctx context.Context, gatewayID ThingsIxID, force bool) (common.Address, uint8, *GatewayDetails, error) {
 	client, err := ethclient.DialContext(ctx, sync.Endpoint)
 	if err != nil {
-		logrus.WithError(err).Warn("unable to connect to blockchain RPC node")
+		chainSyncLog.WithError(err).Warn("unable to connect to blockchain RPC node")
 		return common.Address{}, 0, nil, err
 	}
 	defer client.Close()
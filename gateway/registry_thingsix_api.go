@@ -41,7 +41,7 @@ type GatewayThingsIXAPI struct {
 }
 
 func buildThingsIXRegistryApiSyncer(cfg RegistrySyncAPIConfig) (*GatewayThingsIXAPI, error) {
-	logrus.WithFields(logrus.Fields{
+	onboardingLog.WithFields(logrus.Fields{
 		"endpoint": cfg.Endpoint,
 	}).Info("sync with ThingsIX gateway registry using API")
 
@@ -57,7 +57,7 @@ func (sync *GatewayThingsIXAPI) GatewayDetails(ctx context.Context, gatewayID Th
 		if v, ok := sync.cache.Load(gatewayID); ok {
 			cached := v.(*cachedData)
 			if cached.When.After(time.Now().Add(-10 * time.Minute)) {
-				logrus.WithField("gateway", gatewayID).
+				onboardingLog.WithField("gateway", gatewayID).
 					Debugf("ThingsIX API Gateway registry cache hit")
 				return cached.Owner, cached.Version, cached.Details, cached.Err
 			}
@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 
 	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/gatewayid"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/brocaar/lorawan"
 	"github.com/ethereum/go-ethereum/common"
@@ -118,6 +119,48 @@ func (u UniqueGatewayBands) ContainsFrequencyPlan(plan frequency_plan.Blockchain
 	return found
 }
 
+// GatewayManager is implemented by gateway stores that support changing and
+// removing gateways after they were added.
+type GatewayManager interface {
+	// Update calls fn with a copy of the gateway identified by localID and
+	// stores the result. Only changes to Disabled, Tags, Metadata and
+	// PrivateKey are stored. If fn replaces the private key the gateway gets
+	// a new identity that must be onboarded again. If not found ErrNotFound
+	// is returned.
+	Update(ctx context.Context, localID lorawan.EUI64, fn func(*Gateway) error) (*Gateway, error)
+
+	// Remove deletes the gateway identified by localID from the store. If
+	// not found ErrNotFound is returned.
+	Remove(ctx context.Context, localID lorawan.EUI64) error
+}
+
+// updateGateway returns a copy of gw with the changes fn made to Disabled,
+// Tags, Metadata and PrivateKey applied.
+func updateGateway(gw *Gateway, fn func(*Gateway) error) (*Gateway, error) {
+	updated := *gw
+	updated.Tags = append([]string(nil), gw.Tags...)
+	updated.Metadata = gw.Metadata.clone()
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	if err := updated.Metadata.Validate(); err != nil {
+		return nil, err
+	}
+
+	if updated.PrivateKey != nil && updated.PrivateKey != gw.PrivateKey {
+		rekeyed, err := NewGateway(gw.LocalID, updated.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		rekeyed.Disabled, rekeyed.Tags, rekeyed.Metadata = updated.Disabled, updated.Tags, updated.Metadata
+		return rekeyed, nil
+	}
+
+	result := *gw
+	result.Disabled, result.Tags, result.Metadata = updated.Disabled, updated.Tags, updated.Metadata
+	return &result, nil
+}
+
 // NewGatewayStore returns a gateway store that was configured in the given cfg.
 func NewGatewayStore(ctx context.Context, storeCfg *StoreConfig, registryCfg *RegistrySyncConfig) (GatewayStore, error) {
 	registery, err := NewThingsIXGatewayRegistry(registryCfg)
@@ -125,9 +168,19 @@ func NewGatewayStore(ctx context.Context, storeCfg *StoreConfig, registryCfg *Re
 		return nil, err
 	}
 
+	var ks *Keystore
+	if storeCfg.Keystore != nil {
+		if storeCfg.Type() == PostgresqlGatewayStore {
+			return nil, fmt.Errorf("gateway keystore is only supported by the file based gateway store")
+		}
+		if ks, err = NewKeystore(storeCfg.Keystore); err != nil {
+			return nil, err
+		}
+	}
+
 	switch storeCfg.Type() {
 	case YamlFileGatewayStore:
-		return NewYamlFileStore(ctx, *storeCfg.YamlStorePath, registery, storeCfg.DefaultGatewayFrequencyPlan)
+		return NewYamlFileStore(ctx, *storeCfg.YamlStorePath, registery, storeCfg.DefaultGatewayFrequencyPlan, ks)
 	case PostgresqlGatewayStore:
 		return NewPostgresStore(ctx, storeCfg.RefreshInterval, registery, storeCfg.DefaultGatewayFrequencyPlan)
 	case NoGatewayStoreType:
@@ -135,10 +188,10 @@ func NewGatewayStore(ctx context.Context, storeCfg *StoreConfig, registryCfg *Re
 		// in $HOME/gateway-store.yaml
 		home, err := os.UserHomeDir()
 		if err != nil {
-			logrus.Fatal("no gateway store configured")
+			keystoreLog.Fatal("no gateway store configured")
 		}
 		storePath := filepath.Join(home, "gateway-store.yaml")
-		return NewYamlFileStore(ctx, storePath, registery, storeCfg.DefaultGatewayFrequencyPlan)
+		return NewYamlFileStore(ctx, storePath, registery, storeCfg.DefaultGatewayFrequencyPlan, ks)
 	}
 
 	return nil, ErrInvalidConfig
@@ -146,12 +199,11 @@ func NewGatewayStore(ctx context.Context, storeCfg *StoreConfig, registryCfg *Re
 
 func GatewayNetworkIDFromPrivateKey(priv *ecdsa.PrivateKey) lorawan.EUI64 {
 	pub := priv.PublicKey
-	thingsIxID := utils.DeriveThingsIxID(&pub)
-	h := sha256.Sum256(thingsIxID[:])
-
-	gatewayID, _ := BytesToGatewayID(h[0:8])
+	return gatewayid.NetworkID(utils.DeriveThingsIxID(&pub))
+}
 
-	return gatewayID
+func GatewayNetworkIDFromPublicKey(pub *ecdsa.PublicKey) lorawan.EUI64 {
+	return gatewayid.NetworkID(utils.DeriveThingsIxID(pub))
 }
 
 func GatewayPublicKeyToID(pubKey []byte) (lorawan.EUI64, error) {
@@ -201,7 +253,7 @@ func NewOnboardedGateway(LocalID lorawan.EUI64, priv *ecdsa.PrivateKey, owner co
 
 func printGatewayStoreChanges(old map[lorawan.EUI64]*Gateway, new map[lorawan.EUI64]*Gateway) {
 	if len(old) == 0 {
-		logrus.WithField("count", len(new)).Info("loaded gateways from gateway store")
+		keystoreLog.WithField("count", len(new)).Info("loaded gateways from gateway store")
 		return // not interested to print more details, most cases initial start
 	}
 
@@ -211,7 +263,7 @@ func printGatewayStoreChanges(old map[lorawan.EUI64]*Gateway, new map[lorawan.EU
 	)
 	for k, gw := range old {
 		if _, found := new[k]; !found {
-			logrus.WithFields(logrus.Fields{
+			keystoreLog.WithFields(logrus.Fields{
 				"local_id":    gw.LocalID,
 				"network_id":  gw.NetworkID,
 				"thingsix_id": gw.ThingsIxID,
@@ -222,7 +274,7 @@ func printGatewayStoreChanges(old map[lorawan.EUI64]*Gateway, new map[lorawan.EU
 	}
 	for k, gw := range new {
 		if _, found := old[k]; !found {
-			logrus.WithFields(logrus.Fields{
+			keystoreLog.WithFields(logrus.Fields{
 				"local_id":    gw.LocalID,
 				"network_id":  gw.NetworkID,
 				"thingsix_id": gw.ThingsIxID,
@@ -232,7 +284,7 @@ func printGatewayStoreChanges(old map[lorawan.EUI64]*Gateway, new map[lorawan.EU
 		}
 	}
 	if added != 0 || removed != 0 {
-		logrus.WithFields(logrus.Fields{
+		keystoreLog.WithFields(logrus.Fields{
 			"added":   added,
 			"removed": removed,
 			"count":   len(new),
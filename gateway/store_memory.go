@@ -0,0 +1,320 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+)
+
+// MemoryStore is a gateway store that only keeps gateways in memory. It is
+// intended for tests and applications that embed the forwarder and manage
+// gateway persistency themselves. It is safe for concurrent use.
+type MemoryStore struct {
+	// guards byLocalId, byNetId and byThingsIxID
+	mu sync.RWMutex
+	// collection of gateways indexed by their local ID
+	byLocalId map[lorawan.EUI64]*Gateway
+	// collection of gateways indexed by their network ID
+	byNetId map[lorawan.EUI64]*Gateway
+	// collection of gateways indexed by their ThingsIX ID
+	byThingsIxID map[ThingsIxID]*Gateway
+	// thingsix gateway registry, nil if gateways are not synced
+	registry ThingsIXRegistry
+	// default frequency plan, or invalid if not configured
+	defaultFrequencyPlan frequency_plan.BandName
+
+	storeStatus
+}
+
+var (
+	_ GatewayStore   = (*MemoryStore)(nil)
+	_ GatewayManager = (*MemoryStore)(nil)
+	_ StatusReporter = (*MemoryStore)(nil)
+)
+
+// NewMemoryStore returns an in-memory store that contains the given gateways.
+// If registry is nil gateways are never synced with the ThingsIX gateway
+// registry.
+func NewMemoryStore(registry ThingsIXRegistry, defaultFreqPlan frequency_plan.BandName, gateways ...*Gateway) *MemoryStore {
+	store := &MemoryStore{
+		byLocalId:            make(map[lorawan.EUI64]*Gateway),
+		byNetId:              make(map[lorawan.EUI64]*Gateway),
+		byThingsIxID:         make(map[ThingsIxID]*Gateway),
+		registry:             registry,
+		defaultFrequencyPlan: defaultFreqPlan,
+	}
+	store.status.Loaded = true
+	store.status.Registry = registry != nil
+	for _, gw := range gateways {
+		store.put(gw)
+	}
+	return store
+}
+
+func (store *MemoryStore) put(gw *Gateway) {
+	store.byLocalId[gw.LocalID] = gw
+	store.byNetId[gw.NetworkID] = gw
+	store.byThingsIxID[gw.ThingsIxID] = gw
+}
+
+// Run periodically syncs the gateways with the registry, if configured,
+// until the given ctx expires.
+func (store *MemoryStore) Run(ctx context.Context) {
+	if store.registry == nil {
+		<-ctx.Done()
+		return
+	}
+	for {
+		select {
+		case <-time.NewTimer(30 * time.Minute).C:
+			store.syncAllGatewaysWithRegistry(ctx)
+		case <-ctx.Done():
+			keystoreLog.Info("stop gateway store")
+			return
+		}
+	}
+}
+
+func (store *MemoryStore) Count() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.byLocalId)
+}
+
+// Range calls r for each gateway. It iterates over a snapshot of the store,
+// r is therefore allowed to mutate the store.
+func (store *MemoryStore) Range(r GatewayRanger) {
+	store.mu.RLock()
+	gateways := make([]*Gateway, 0, len(store.byLocalId))
+	for _, gw := range store.byLocalId {
+		gateways = append(gateways, gw)
+	}
+	store.mu.RUnlock()
+
+	for _, gw := range gateways {
+		if !r.Do(gw) {
+			return
+		}
+	}
+}
+
+func (store *MemoryStore) ByLocalID(localID lorawan.EUI64) (*Gateway, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if gw, ok := store.byLocalId[localID]; ok {
+		return gw, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (store *MemoryStore) ByLocalIDString(id string) (*Gateway, error) {
+	eui, err := utils.Eui64FromString(id)
+	if err != nil {
+		return nil, ErrInvalidGatewayID
+	}
+	return store.ByLocalID(eui)
+}
+
+func (store *MemoryStore) ContainsByLocalID(localID lorawan.EUI64) bool {
+	gw, _ := store.ByLocalID(localID)
+	return gw != nil
+}
+
+func (store *MemoryStore) ByNetworkID(netID lorawan.EUI64) (*Gateway, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if gw, ok := store.byNetId[netID]; ok {
+		return gw, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (store *MemoryStore) ByNetworkIDString(id string) (*Gateway, error) {
+	eui, err := utils.Eui64FromString(id)
+	if err != nil {
+		return nil, ErrInvalidGatewayID
+	}
+	return store.ByNetworkID(eui)
+}
+
+func (store *MemoryStore) ContainsByNetID(netID lorawan.EUI64) bool {
+	gw, _ := store.ByNetworkID(netID)
+	return gw != nil
+}
+
+func (store *MemoryStore) ByThingsIxID(id ThingsIxID) (*Gateway, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if gw, ok := store.byThingsIxID[id]; ok {
+		return gw, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Add adds a gateway with the given local id and key. It returns
+// ErrAlreadyExists if the local id or key is already in use.
+func (store *MemoryStore) Add(ctx context.Context, localID lorawan.EUI64, key *ecdsa.PrivateKey) (*Gateway, error) {
+	gw, err := NewGateway(localID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.byLocalId[gw.LocalID]; ok {
+		return nil, ErrAlreadyExists
+	}
+	if _, ok := store.byNetId[gw.NetworkID]; ok {
+		return nil, ErrAlreadyExists
+	}
+
+	store.put(gw)
+	return gw, nil
+}
+
+// Delete removes the gateway identified by the given local id from the store.
+func (store *MemoryStore) Delete(localID lorawan.EUI64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	gw, ok := store.byLocalId[localID]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(store.byLocalId, gw.LocalID)
+	delete(store.byNetId, gw.NetworkID)
+	delete(store.byThingsIxID, gw.ThingsIxID)
+	return nil
+}
+
+func (store *MemoryStore) SyncGatewayByLocalID(ctx context.Context, localID lorawan.EUI64, force bool) (*Gateway, error) {
+	gw, err := store.ByLocalID(localID)
+	if err != nil || store.registry == nil {
+		return gw, err
+	}
+
+	owner, version, details, err := store.registry.GatewayDetails(ctx, gw.ThingsIxID, force)
+	if err != nil {
+		keystoreLog.WithError(err).Debug("unable to sync gateway with gateway registry")
+		return gw, nil
+	}
+
+	synced, err := NewOnboardedGateway(gw.LocalID, gw.PrivateKey, owner, version)
+	if err != nil {
+		return gw, nil
+	}
+	synced.Details = details
+	synced.Disabled, synced.Tags, synced.Metadata = gw.Disabled, gw.Tags, gw.Metadata
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// the gateway could have been removed or updated while syncing
+	current, ok := store.byLocalId[synced.LocalID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if current != gw {
+		return current, nil
+	}
+	store.put(synced)
+
+	return synced, nil
+}
+
+func (store *MemoryStore) syncAllGatewaysWithRegistry(ctx context.Context) {
+	var collector Collector
+	store.Range(&collector)
+
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	for _, gw := range collector.Gateways {
+		if _, err := store.SyncGatewayByLocalID(lctx, gw.LocalID, false); err != nil {
+			keystoreLog.WithError(err).
+				WithField("gw_local_id", gw.LocalID).
+				Warn("unable to sync gateway")
+		}
+	}
+	store.synced()
+}
+
+func (store *MemoryStore) UniqueGatewayBands() UniqueGatewayBands {
+	var (
+		collector Collector
+		result    = UniqueGatewayBands{
+			bands: make(map[frequency_plan.BandName]struct{}),
+			plans: make(map[frequency_plan.BlockchainFrequencyPlan]struct{}),
+		}
+	)
+
+	store.Range(&collector)
+
+	for _, gw := range collector.Gateways {
+		if gw.Details != nil && gw.Details.Band != nil {
+			result.addBand(frequency_plan.BandName(*gw.Details.Band))
+		} else if store.defaultFrequencyPlan != frequency_plan.Invalid {
+			result.addBand(store.defaultFrequencyPlan)
+		}
+	}
+	return result
+}
+
+func (store *MemoryStore) DefaultFrequencyPlan() frequency_plan.BandName {
+	return store.defaultFrequencyPlan
+}
+
+// Update changes the gateway identified by the given local id, see
+// GatewayManager.
+func (store *MemoryStore) Update(ctx context.Context, localID lorawan.EUI64, fn func(*Gateway) error) (*Gateway, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	gw, ok := store.byLocalId[localID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated, err := updateGateway(gw, fn)
+	if err != nil {
+		return nil, err
+	}
+	if updated.NetworkID != gw.NetworkID {
+		if _, ok := store.byNetId[updated.NetworkID]; ok {
+			return nil, ErrAlreadyExists
+		}
+	}
+
+	delete(store.byNetId, gw.NetworkID)
+	delete(store.byThingsIxID, gw.ThingsIxID)
+	store.put(updated)
+	return updated, nil
+}
+
+// Remove deletes the gateway identified by the given local id, see
+// GatewayManager.
+func (store *MemoryStore) Remove(ctx context.Context, localID lorawan.EUI64) error {
+	return store.Delete(localID)
+}
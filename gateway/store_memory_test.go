@@ -0,0 +1,131 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type staticRegistry struct {
+	owner common.Address
+}
+
+func (r staticRegistry) GatewayDetails(ctx context.Context, gatewayID ThingsIxID, force bool) (common.Address, uint8, *GatewayDetails, error) {
+	return r.owner, 1, &GatewayDetails{}, nil
+}
+
+func TestMemoryStore(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		store   = NewMemoryStore(nil, frequency_plan.EU868)
+		localID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	)
+
+	key, err := utils.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := store.Add(ctx, localID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(ctx, localID, key); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected already exists for duplicate local id, got %v", err)
+	}
+	if _, err := store.Add(ctx, lorawan.EUI64{8}, key); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected already exists for duplicate key, got %v", err)
+	}
+
+	if got, err := store.ByLocalIDString(localID.String()); err != nil || got != gw {
+		t.Errorf("by local id: %v", err)
+	}
+	if got, err := store.ByNetworkID(gw.NetworkID); err != nil || got != gw {
+		t.Errorf("by network id: %v", err)
+	}
+	if got, err := store.ByThingsIxID(gw.ThingsIxID); err != nil || got != gw {
+		t.Errorf("by thingsix id: %v", err)
+	}
+	if store.Count() != 1 || !store.UniqueGatewayBands().ContainsBand(frequency_plan.EU868) {
+		t.Error("unexpected store content")
+	}
+
+	if err := store.Delete(localID); err != nil {
+		t.Fatal(err)
+	}
+	if store.ContainsByLocalID(localID) || store.ContainsByNetID(gw.NetworkID) {
+		t.Error("gateway not deleted")
+	}
+}
+
+func TestMemoryStoreSync(t *testing.T) {
+	var (
+		owner = common.HexToAddress("0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf")
+		store = NewMemoryStore(staticRegistry{owner: owner}, frequency_plan.Invalid)
+	)
+	key, _ := utils.GeneratePrivateKey()
+	gw, err := store.Add(context.Background(), lorawan.EUI64{1}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := store.SyncGatewayByLocalID(context.Background(), gw.LocalID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced.Owner == nil || *synced.Owner != owner {
+		t.Errorf("gateway owner not synced")
+	}
+	if got, _ := store.ByNetworkID(gw.NetworkID); got != synced {
+		t.Error("synced gateway not stored")
+	}
+}
+
+func TestMemoryStoreConcurrent(t *testing.T) {
+	var (
+		store = NewMemoryStore(nil, frequency_plan.Invalid)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 32; j++ {
+				key, _ := utils.GeneratePrivateKey()
+				localID := lorawan.EUI64{byte(i), byte(j)}
+				if _, err := store.Add(context.Background(), localID, key); err != nil {
+					t.Error(err)
+				}
+				store.Range(GatewayRangerFunc(func(gw *Gateway) bool { return true }))
+				_ = store.ContainsByLocalID(localID)
+				if j%2 == 0 {
+					_ = store.Delete(localID)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if store.Count() != 8*16 {
+		t.Errorf("expected %d gateways, got %d", 8*16, store.Count())
+	}
+}
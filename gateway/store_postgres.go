@@ -20,7 +20,9 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -35,6 +37,11 @@ import (
 	"gorm.io/gorm"
 )
 
+var (
+	_ GatewayManager = (*pgStore)(nil)
+	_ StatusReporter = (*pgStore)(nil)
+)
+
 // pgStore is gateway store that uses a Postgres database as backend.
 type pgStore struct {
 	// refreshInterval indicates how often the store must be loaded from the
@@ -52,22 +59,23 @@ type pgStore struct {
 	registery ThingsIXRegistry
 	// default frequency plan, or invalid if not configured
 	defaultFrequencyPlan frequency_plan.BandName
+
+	storeStatus
 }
 
 // NewPostgresStore returns a gateway store that uses a postgresql backend.
 func NewPostgresStore(ctx context.Context, refreshInterval *time.Duration, registry ThingsIXRegistry, defaultFreqPlan frequency_plan.BandName) (*pgStore, error) {
-	// create gateway table if not already available
-	db := database.DBWithContext(ctx)
-	if err := db.AutoMigrate(&pgGateway{}, &RecordedUnknownGateway{}); err != nil {
+	// create or upgrade the gateway store schema
+	if err := migratePostgresStore(ctx); err != nil {
 		return nil, err
 	}
 
 	refresh := refreshInterval
 	if refresh == nil {
-		*refresh = time.Duration(30 * time.Minute)
+		refresh = utils.Ptr(30 * time.Minute)
 	}
 
-	log := logrus.WithFields(logrus.Fields{
+	log := keystoreLog.WithFields(logrus.Fields{
 		"table":   pgGateway{}.TableName(),
 		"refresh": refresh,
 	})
@@ -85,10 +93,13 @@ func NewPostgresStore(ctx context.Context, refreshInterval *time.Duration, regis
 		registery:            registry,
 		defaultFrequencyPlan: defaultFreqPlan,
 	}
+	store.status.Registry = registry != nil
 
 	// load initial set of gateways from backend
-	if err := store.loadFromPostgres(ctx); err != nil {
-		logrus.WithError(err).Error("unable to load gateways from database, retry later")
+	err := store.loadFromPostgres(ctx)
+	store.loaded(err)
+	if err != nil {
+		keystoreLog.WithError(err).Error("unable to load gateways from database, retry later")
 	}
 
 	return store, nil
@@ -98,10 +109,18 @@ func (store *pgStore) Run(ctx context.Context) {
 	for {
 		select {
 		case <-time.NewTimer(store.refreshInterval).C:
+			// retry loading when the previous attempt failed
+			if store.Status().LoadError != nil {
+				err := store.loadFromPostgres(ctx)
+				store.loaded(err)
+				if err != nil {
+					keystoreLog.WithError(err).Error("unable to load gateways from database, retry later")
+				}
+			}
 			// reload and sync with gateway registry
 			store.syncAll(ctx)
 		case <-ctx.Done():
-			logrus.Info("stop gateway store")
+			keystoreLog.Info("stop gateway store")
 			return
 		}
 	}
@@ -216,7 +235,7 @@ func (store *pgStore) Add(ctx context.Context, localID lorawan.EUI64, key *ecdsa
 	store.byNetId[gw.NetworkID] = gw
 	store.gwMapMu.Unlock()
 
-	logrus.WithFields(logrus.Fields{
+	keystoreLog.WithFields(logrus.Fields{
 		"localID":   gw.LocalID,
 		"networkID": gw.NetworkID,
 	}).Debug("loaded new gateway")
@@ -236,13 +255,14 @@ func (store *pgStore) syncGatewayByLocalID(ctx context.Context, localID lorawan.
 
 	owner, version, details, err := store.registery.GatewayDetails(ctx, gw.ThingsIxID, force)
 	if err != nil {
-		logrus.WithError(err).Debug("unable to retrieve gateway details from gateway registry")
+		keystoreLog.WithError(err).Debug("unable to retrieve gateway details from gateway registry")
 		return gw, nil
 	}
 
 	synced, err := NewOnboardedGateway(gw.LocalID, gw.PrivateKey, owner, version)
 	if err == nil {
 		synced.Details = details
+		synced.Disabled, synced.Tags, synced.Metadata = gw.Disabled, gw.Tags, gw.Metadata
 		var ( // update gateway in db
 			pggw = pgGateway{
 				LocalID:    synced.LocalID,
@@ -254,6 +274,9 @@ func (store *pgStore) syncGatewayByLocalID(ctx context.Context, localID lorawan.
 					Time:  time.Now(),
 					Valid: true,
 				},
+				Disabled: synced.Disabled,
+				Tags:     strings.Join(synced.Tags, ","),
+				Metadata: encodePgMetadata(synced.Metadata),
 			}
 			db = database.DBWithContext(ctx)
 		)
@@ -271,14 +294,100 @@ func (store *pgStore) syncGatewayByLocalID(ctx context.Context, localID lorawan.
 	}
 
 	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+	// the gateway could have been removed or updated while syncing
+	if current := store.byLocalId[synced.LocalID]; current != gw {
+		if current == nil {
+			return nil, ErrNotFound
+		}
+		return current, nil
+	}
 	store.byLocalId[synced.LocalID] = synced
 	store.byNetId[synced.NetworkID] = synced
 	store.byThingsIxID[synced.ThingsIxID] = synced
-	store.gwMapMu.Unlock()
 
 	return synced, nil
 }
 
+// Update changes the gateway identified by the given local id, see
+// GatewayManager.
+func (store *pgStore) Update(ctx context.Context, localID lorawan.EUI64, fn func(*Gateway) error) (*Gateway, error) {
+	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+
+	gw, ok := store.byLocalId[localID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated, err := updateGateway(gw, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]interface{}{
+		"disabled": updated.Disabled,
+		"tags":     strings.Join(updated.Tags, ","),
+		"metadata": encodePgMetadata(updated.Metadata),
+	}
+	if updated.NetworkID != gw.NetworkID {
+		// the gateway has a new identity that is not yet onboarded
+		columns["private_key"] = crypto.FromECDSA(updated.PrivateKey)
+		for _, column := range []string{"owner", "version", "antenna_gain", "band", "location", "altitude", "last_synced"} {
+			columns[column] = nil
+		}
+	}
+
+	db := database.DBWithContext(ctx)
+	if err := crdbgorm.ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+		result := tx.Model(&pgGateway{LocalID: localID}).Updates(columns)
+		if result.Error != nil {
+			if database.IsErrUniqueViolation(result.Error) {
+				return ErrAlreadyExists
+			}
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	delete(store.byNetId, gw.NetworkID)
+	delete(store.byThingsIxID, gw.ThingsIxID)
+	store.byLocalId[updated.LocalID] = updated
+	store.byNetId[updated.NetworkID] = updated
+	store.byThingsIxID[updated.ThingsIxID] = updated
+
+	return updated, nil
+}
+
+// Remove deletes the gateway identified by the given local id, see
+// GatewayManager.
+func (store *pgStore) Remove(ctx context.Context, localID lorawan.EUI64) error {
+	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+
+	gw, ok := store.byLocalId[localID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	db := database.DBWithContext(ctx)
+	if err := crdbgorm.ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+		return tx.Delete(&pgGateway{LocalID: localID}).Error
+	}); err != nil {
+		return err
+	}
+
+	delete(store.byLocalId, gw.LocalID)
+	delete(store.byNetId, gw.NetworkID)
+	delete(store.byThingsIxID, gw.ThingsIxID)
+
+	return nil
+}
+
 func (store *pgStore) UniqueGatewayBands() UniqueGatewayBands {
 	var (
 		collector Collector
@@ -311,6 +420,7 @@ func (store *pgStore) syncAll(ctx context.Context) {
 	for _, gw := range collector.Gateways {
 		_, _ = store.syncGatewayByLocalID(ctx, gw.LocalID, false)
 	}
+	store.synced()
 }
 
 func (store *pgStore) loadFromPostgres(ctx context.Context) error {
@@ -377,6 +487,13 @@ type pgGateway struct {
 	// LastSynced keeps track when the last time the data was retrieved from the
 	// ThingsIX gateway registry
 	LastSynced sql.NullTime
+	// Disabled gateways stay in the store but their data is dropped
+	Disabled bool `gorm:"not null;default:false"`
+	// Tags holds the comma separated tags set by the operator
+	Tags string `gorm:"not null;default:''"`
+	// Metadata holds the JSON encoded metadata set by the operator, empty
+	// if not set
+	Metadata string `gorm:"not null;default:''"`
 	// Set by gorm
 	CreatedAt time.Time
 }
@@ -396,6 +513,14 @@ func (gw pgGateway) asGateway() (*Gateway, error) {
 		details = gw.Details
 	}
 
+	var metadata *GatewayMetadata
+	if gw.Metadata != "" {
+		metadata = new(GatewayMetadata)
+		if err := json.Unmarshal([]byte(gw.Metadata), metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+
 	return &Gateway{
 		LocalID:    gw.LocalID,
 		NetworkID:  GatewayNetworkIDFromPrivateKey(key),
@@ -405,5 +530,25 @@ func (gw pgGateway) asGateway() (*Gateway, error) {
 		Owner:      gw.Owner,
 		Version:    gw.Version,
 		Details:    details,
+		Disabled:   gw.Disabled,
+		Tags:       splitTags(gw.Tags),
+		Metadata:   metadata,
 	}, nil
 }
+
+// encodePgMetadata returns the JSON encoded metadata, or an empty string if
+// not set.
+func encodePgMetadata(metadata *GatewayMetadata) string {
+	if metadata == nil {
+		return ""
+	}
+	encoded, _ := json.Marshal(metadata)
+	return string(encoded)
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
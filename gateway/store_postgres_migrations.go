@@ -0,0 +1,143 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/database"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// pgMigration changes the schema of the postgres gateway store. Migrations
+// are applied in order and must not change once released, add a new
+// migration instead.
+type pgMigration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// pgMigrations holds all gateway store schema migrations. Statements must be
+// idempotent because stores created before migrations were introduced
+// already have (part of) the schema.
+var pgMigrations = []pgMigration{
+	{
+		version:     1,
+		description: "create gateway store",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS gateway_store (
+				local_id bytea PRIMARY KEY,
+				private_key bytea NOT NULL,
+				owner bytea,
+				version smallint,
+				antenna_gain text,
+				band text,
+				location text,
+				altitude integer,
+				last_synced timestamptz,
+				created_at timestamptz
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_gateway_store_private_key ON gateway_store (private_key)`,
+			`CREATE TABLE IF NOT EXISTS recorded_unknown_gateways (
+				local_id bytea PRIMARY KEY,
+				first_seen bigint
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "disabled and tags columns",
+		statements: []string{
+			`ALTER TABLE gateway_store ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false`,
+			`ALTER TABLE gateway_store ADD COLUMN IF NOT EXISTS tags text NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     3,
+		description: "metadata column",
+		statements: []string{
+			`ALTER TABLE gateway_store ADD COLUMN IF NOT EXISTS metadata text NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// pgSchemaMigration records an applied migration.
+type pgSchemaMigration struct {
+	Version     int `gorm:"primaryKey;autoIncrement:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+func (pgSchemaMigration) TableName() string {
+	return "gateway_store_migrations"
+}
+
+// migratePostgresStore applies the gateway store schema migrations that are
+// not yet applied. Replicas that start at the same time can race, a
+// migration that was recorded by another replica is skipped.
+func migratePostgresStore(ctx context.Context) error {
+	db := database.DBWithContext(ctx)
+	if err := db.Exec(`CREATE TABLE IF NOT EXISTS gateway_store_migrations (
+		version integer PRIMARY KEY,
+		description text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`).Error; err != nil {
+		return fmt.Errorf("unable to create gateway store migrations table: %w", err)
+	}
+
+	var applied []pgSchemaMigration
+	if err := db.Find(&applied).Error; err != nil {
+		return fmt.Errorf("unable to load applied gateway store migrations: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+
+	for _, m := range pgMigrations {
+		if done[m.version] {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, stmt := range m.statements {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Create(&pgSchemaMigration{
+				Version:     m.version,
+				Description: m.description,
+				AppliedAt:   time.Now(),
+			}).Error
+		})
+		if database.IsErrUniqueViolation(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to apply gateway store migration %d (%s): %w", m.version, m.description, err)
+		}
+		keystoreLog.WithFields(logrus.Fields{
+			"version":     m.version,
+			"description": m.description,
+		}).Info("applied gateway store migration")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// StoreStatus describes if a gateway store loaded its gateways and when it
+// last synced them with the ThingsIX registry.
+type StoreStatus struct {
+	// Loaded is set when the store loaded its gateways at least once
+	Loaded bool
+	// LoadError is the error of the last attempt to load the gateways, the
+	// store keeps the gateways it loaded before
+	LoadError error
+	// Registry is set when the store syncs its gateways with a registry
+	Registry bool
+	// LastRegistrySync is when the store last finished syncing all gateways
+	// with the registry, zero if it never did
+	LastRegistrySync time.Time
+}
+
+// StatusReporter is implemented by gateway stores that report their status.
+type StatusReporter interface {
+	// Status returns the current status of the store.
+	Status() StoreStatus
+}
+
+// storeStatus keeps track of the status of a store, it is embedded in the
+// store implementations.
+type storeStatus struct {
+	mu     sync.Mutex
+	status StoreStatus
+}
+
+// Status returns the current status of the store.
+func (s *storeStatus) Status() StoreStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// loaded records the outcome of loading the gateways.
+func (s *storeStatus) loaded(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LoadError = err
+	if err == nil {
+		s.status.Loaded = true
+	}
+}
+
+// synced records that all gateways were synced with the registry.
+func (s *storeStatus) synced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastRegistrySync = time.Now()
+}
@@ -17,28 +17,48 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
+var (
+	_ GatewayManager = (*yamlFileStore)(nil)
+	_ StatusReporter = (*yamlFileStore)(nil)
+
+	// yamlErrorLineRe matches the line number in yaml decode errors
+	yamlErrorLineRe = regexp.MustCompile(`line (\d+):`)
+)
+
 // yamlFileStore is gateway store that uses a yaml file on disk for persistency.
 type yamlFileStore struct {
 	// path contains the full path to where the yaml gateway store is on disk
 	path string
+	// fileMu serializes access to the store file within this process, it
+	// is acquired before the file lock and gwMapMu
+	fileMu sync.Mutex
+	// fileHash is the hash of the store file as it was last read or written
+	// by this store, guarded by fileMu
+	fileHash [sha256.Size]byte
 	// guards byLocalId and byNetId
 	gwMapMu sync.RWMutex
 	// collection of gateways indexed by their local ID
@@ -51,17 +71,28 @@ type yamlFileStore struct {
 	registry ThingsIXRegistry
 	// default frequency plan, or invalid if not configured
 	defaultFrequencyPlan frequency_plan.BandName
+	// keystore encrypts gateway keys, nil if keys are stored in plain text
+	keystore *Keystore
+	// encryptedKeys caches encrypted gateway keys by ThingsIX id to prevent
+	// encrypting all keys each time the store file is rewritten, guarded by
+	// gwMapMu
+	encryptedKeys map[ThingsIxID]*keystore.CryptoJSON
+
+	storeStatus
 }
 
-func NewYamlFileStore(ctx context.Context, path string, registry ThingsIXRegistry, defaultFreqPlan frequency_plan.BandName) (*yamlFileStore, error) {
+func NewYamlFileStore(ctx context.Context, path string, registry ThingsIXRegistry, defaultFreqPlan frequency_plan.BandName, ks *Keystore) (*yamlFileStore, error) {
 	if path == "" {
 		return nil, fmt.Errorf("invalid gateway store file")
 	}
 
-	log := logrus.WithField("file", path)
+	log := keystoreLog.WithField("file", path)
 	if defaultFreqPlan != frequency_plan.Invalid {
 		log = log.WithField("gw_default_freq_plan", defaultFreqPlan)
 	}
+	if ks != nil {
+		log = log.WithField("encrypted", true)
+	}
 	log.Info("use file based gateway store")
 
 	store := &yamlFileStore{
@@ -71,11 +102,15 @@ func NewYamlFileStore(ctx context.Context, path string, registry ThingsIXRegistr
 		byThingsIxID:         make(map[ThingsIxID]*Gateway),
 		registry:             registry,
 		defaultFrequencyPlan: defaultFreqPlan,
+		keystore:             ks,
+		encryptedKeys:        make(map[ThingsIxID]*keystore.CryptoJSON),
 	}
+	store.status.Registry = registry != nil
 
-	if err := store.loadFromFile(); err != nil {
-		logrus.WithError(err).Fatal("unable to load gateways from disk")
+	if _, err := store.loadFromFile(true); err != nil {
+		keystoreLog.WithError(err).Fatal("unable to load gateways from disk")
 	}
+	store.loaded(nil)
 
 	// sync immediatly with registry
 	_ = store.syncAllGatewaysWithRegistry(ctx)
@@ -83,16 +118,24 @@ func NewYamlFileStore(ctx context.Context, path string, registry ThingsIXRegistr
 	return store, nil
 }
 
-// run a loop in the background that periodically refreshes the in-memory
-// gateway store with the gateway store file on disk and executes commando's
-// that mutate the store. This ensures that mutations are synchronized.
+// run a loop in the background that periodically syncs the in-memory gateway
+// store with the registry and reloads it when the gateway store file on disk
+// changed.
 func (store *yamlFileStore) Run(ctx context.Context) {
+	var (
+		syncTicker = time.NewTicker(30 * time.Minute)
+		changed    = utils.WatchFile(ctx, store.path, keystoreLog)
+	)
+	defer syncTicker.Stop()
+
 	for {
 		select {
-		case <-time.NewTimer(30 * time.Minute).C:
+		case <-syncTicker.C:
 			_ = store.syncAllGatewaysWithRegistry(ctx)
+		case <-changed:
+			store.reload(ctx)
 		case <-ctx.Done(): // forwarder issues to stop
-			logrus.Info("stop gateway store")
+			keystoreLog.Info("stop gateway store")
 			return
 		}
 	}
@@ -177,18 +220,27 @@ func (store *yamlFileStore) SyncGatewayByLocalID(ctx context.Context, localID lo
 
 	owner, version, details, err := store.registry.GatewayDetails(ctx, gw.ThingsIxID, force)
 	if err != nil {
-		logrus.WithError(err).Debug("unable to sync gateway with gateway registry")
+		keystoreLog.WithError(err).Debug("unable to sync gateway with gateway registry")
 		return gw, nil
 	}
 
-	synced, err := NewOnboardedGateway(gw.LocalID, gw.PrivateKey, owner, version)
+	synced, err := gw.withRegistration(owner, version)
 	if err == nil {
 		synced.Details = details
+		synced.Disabled, synced.Tags, synced.Metadata = gw.Disabled, gw.Tags, gw.Metadata
 	} else {
 		synced = gw
 	}
 
 	store.gwMapMu.Lock()
+	// the gateway could have been removed or updated while syncing
+	if current := store.byLocalId[synced.LocalID]; current != gw {
+		store.gwMapMu.Unlock()
+		if current == nil {
+			return nil, ErrNotFound
+		}
+		return current, nil
+	}
 	store.byLocalId[synced.LocalID] = synced
 	store.byNetId[synced.NetworkID] = synced
 	store.byThingsIxID[synced.ThingsIxID] = synced
@@ -203,39 +255,45 @@ func (store *yamlFileStore) Add(ctx context.Context, localID lorawan.EUI64, key
 	if err != nil {
 		return nil, err
 	}
+	return store.add(ctx, gw)
+}
 
-	// encode gateway entry
-	encoded, err := yaml.Marshal([]gatewayYAML{{
-		LocalID:    localID,
-		PrivateKey: hex.EncodeToString(crypto.FromECDSA(gw.PrivateKey)),
-	}})
+// AddKeyRef adds a gateway with a key that is held outside the forwarder, see
+// KeyRefStore.
+func (store *yamlFileStore) AddKeyRef(ctx context.Context, localID lorawan.EUI64, ref string, signer KeySigner) (*Gateway, error) {
+	gw, err := NewGatewayWithKeySigner(localID, ref, signer)
 	if err != nil {
-		return nil, fmt.Errorf("unable to encode gateway: %w", err)
-	}
-
-	store.gwMapMu.Lock()
-	defer store.gwMapMu.Unlock()
-
-	if _, ok := store.byLocalId[gw.LocalID]; ok {
-		return nil, ErrAlreadyExists
+		return nil, err
 	}
+	return store.add(ctx, gw)
+}
 
-	// append gateway to store
-	f, err := os.OpenFile(store.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+// add adds the gateway to the in-memory store and rewrites the store file.
+func (store *yamlFileStore) add(ctx context.Context, gw *Gateway) (*Gateway, error) {
+	unlock, err := store.lockFile()
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if _, err := f.Write(encoded); err != nil {
-		_ = f.Close()
+	added, err := store.refreshFromFile()
+	if err != nil {
 		return nil, err
 	}
+	defer store.syncGateways(ctx, added)
 
-	_ = f.Sync()
-	_ = f.Close()
+	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+
+	if _, ok := store.byLocalId[gw.LocalID]; ok {
+		return nil, ErrAlreadyExists
+	}
 
-	// add new gateway to memory cache
 	store.byLocalId[gw.LocalID] = gw
+	if err := store.writeFile(); err != nil {
+		delete(store.byLocalId, gw.LocalID)
+		return nil, err
+	}
 	store.byNetId[gw.NetworkID] = gw
 	store.byThingsIxID[gw.ThingsIxID] = gw
 
@@ -254,11 +312,12 @@ func (store *yamlFileStore) syncAllGatewaysWithRegistry(ctx context.Context) err
 	// fetch latest gateway details for gateway
 	for _, gw := range gateways {
 		if _, err := store.SyncGatewayByLocalID(lctx, gw.LocalID, false); err != nil {
-			logrus.WithError(err).
+			keystoreLog.WithError(err).
 				WithField("gw_local_id", gw.LocalID).
 				Warn("unable to sync gateway")
 		}
 	}
+	store.synced()
 
 	return nil
 }
@@ -288,45 +347,156 @@ func (store *yamlFileStore) DefaultFrequencyPlan() frequency_plan.BandName {
 	return store.defaultFrequencyPlan
 }
 
+// lockFile acquires fileMu and a lock on the store file that prevents other
+// processes, e.g. the new forwarder process during an upgrade, from writing
+// it concurrently. Temporary files left behind by interrupted writes are
+// removed. The returned func releases both locks.
+func (store *yamlFileStore) lockFile() (func(), error) {
+	store.fileMu.Lock()
+
+	// try to create the directory if it doesn't yet exist
+	if err := os.MkdirAll(filepath.Dir(store.path), os.ModePerm); err != nil {
+		store.fileMu.Unlock()
+		return nil, ErrStoreNotExists
+	}
+	unlock, err := lockPath(store.path + ".lock")
+	if err != nil {
+		store.fileMu.Unlock()
+		return nil, fmt.Errorf("unable to lock gateway store: %w", err)
+	}
+
+	if leftovers, err := filepath.Glob(store.path + ".tmp-*"); err == nil {
+		for _, leftover := range leftovers {
+			keystoreLog.WithField("file", leftover).Warn("remove temporary file of interrupted gateway store write")
+			_ = os.Remove(leftover)
+		}
+	}
+
+	return func() {
+		unlock()
+		store.fileMu.Unlock()
+	}, nil
+}
+
 // loadFromFile loads the gateway store from disk into this in-memory store.
-func (store *yamlFileStore) loadFromFile() error {
+// Gateways that didn't change are kept as is, the local ids of gateways that
+// were added or changed are returned. If recoverTail is set a store file of
+// which the last entry is truncated is recovered, this is only done at startup.
+func (store *yamlFileStore) loadFromFile(recoverTail bool) ([]lorawan.EUI64, error) {
+	unlock, err := store.lockFile()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	rawGateways, err := os.ReadFile(store.path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			// try to create the directory if it doesn't yet exist
-			dir := filepath.Dir(store.path)
-			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-				return ErrStoreNotExists
-			}
-
 			// try to create it, on success return empty store
 			f, err := os.OpenFile(store.path, os.O_CREATE, 0600)
 			if err != nil {
-				return ErrStoreNotExists
+				return nil, ErrStoreNotExists
 			}
 			_ = f.Close()
 			printGatewayStoreChanges(nil, nil)
-			return nil
+			store.fileHash = sha256.Sum256(nil)
+			return nil, nil
 		}
-		return err
+		return nil, err
+	}
+	return store.load(rawGateways, recoverTail)
+}
+
+// refreshFromFile loads the store file when it was changed by another
+// process since this store last read or wrote it. This prevents that writes
+// by this store overwrite these changes. The caller must hold the file lock
+// and not gwMapMu.
+func (store *yamlFileStore) refreshFromFile() ([]lorawan.EUI64, error) {
+	rawGateways, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil // written with the gateways in memory
+	} else if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(rawGateways) == store.fileHash {
+		return nil, nil
 	}
+	keystoreLog.WithField("file", store.path).Info("gateway store changed on disk, reload before write")
+	return store.load(rawGateways, false)
+}
 
+// load decodes the raw store file into this in-memory store. If the file can't
+// be decoded an error is returned and the loaded gateways are kept, unless
+// recoverTail is set and only the last entry is corrupt. The caller must hold
+// the file lock and not gwMapMu.
+func (store *yamlFileStore) load(rawGateways []byte, recoverTail bool) ([]lorawan.EUI64, error) {
 	var (
-		gws          []gatewayYAML
-		byLocalId    = make(map[lorawan.EUI64]*Gateway)
-		byNetId      = make(map[lorawan.EUI64]*Gateway)
-		byThingsIxID = make(map[ThingsIxID]*Gateway)
+		gws           []gatewayYAML
+		byLocalId     = make(map[lorawan.EUI64]*Gateway)
+		byNetId       = make(map[lorawan.EUI64]*Gateway)
+		byThingsIxID  = make(map[ThingsIxID]*Gateway)
+		encryptedKeys = make(map[ThingsIxID]*keystore.CryptoJSON)
+		added         []lorawan.EUI64
 	)
 
 	if err := yaml.Unmarshal(rawGateways, &gws); err != nil {
-		return fmt.Errorf("gateway store corrupt: %w", err)
+		if !recoverTail {
+			return nil, fmt.Errorf("gateway store corrupt: %w", err)
+		}
+		recovered, rerr := store.recover(rawGateways, err)
+		if rerr != nil {
+			return nil, rerr
+		}
+		rawGateways = recovered
+		if err := yaml.Unmarshal(rawGateways, &gws); err != nil {
+			return nil, fmt.Errorf("gateway store corrupt: %w", err)
+		}
+	}
+
+	// decrypting keys is slow by design, gateways that are not already in
+	// memory are converted without holding gwMapMu to not block lookups
+	store.gwMapMu.RLock()
+	reusable := make([]bool, len(gws))
+	for i, ygw := range gws {
+		reusable[i] = store.reuse(ygw) != nil
 	}
+	store.gwMapMu.RUnlock()
 
-	// convert yaml gateways to *Gateway
-	for _, ygw := range gws {
-		gw, err := ygw.asGateway()
+	converted := make([]*Gateway, len(gws))
+	for i, ygw := range gws {
+		if reusable[i] {
+			continue
+		}
+		gw, err := store.convert(ygw)
 		if err != nil {
-			return fmt.Errorf("unable to load gateway (localID=%s) from database", ygw.LocalID)
+			return nil, err
+		}
+		converted[i] = gw
+	}
+
+	// the maps are replaced while holding the lock, gateways are reused again
+	// to not lose mutations that happened while keys were decrypted
+	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+
+	var plaintext int
+	for i, ygw := range gws {
+		gw := store.reuse(ygw)
+		if gw == nil {
+			if gw = converted[i]; gw == nil {
+				// reused before keys were decrypted but changed since
+				var err error
+				if gw, err = store.convert(ygw); err != nil {
+					return nil, err
+				}
+			}
+			added = append(added, gw.LocalID)
+		}
+
+		if ygw.EncryptedPrivateKey != nil {
+			encryptedKeys[gw.ThingsIxID] = ygw.EncryptedPrivateKey
+		} else if ygw.KeyRef == "" {
+			plaintext++
 		}
 
 		byLocalId[gw.LocalID] = gw
@@ -336,15 +506,128 @@ func (store *yamlFileStore) loadFromFile() error {
 
 	oldByLocalId := store.byLocalId
 
-	store.gwMapMu.Lock()
 	store.byLocalId = byLocalId
 	store.byNetId = byNetId
 	store.byThingsIxID = byThingsIxID
-	store.gwMapMu.Unlock()
+	store.encryptedKeys = encryptedKeys
+	store.fileHash = sha256.Sum256(rawGateways)
 
 	printGatewayStoreChanges(oldByLocalId, byLocalId)
 
-	return nil
+	if store.keystore != nil && plaintext > 0 {
+		keystoreLog.WithFields(logrus.Fields{
+			"file":     store.path,
+			"gateways": plaintext,
+		}).Warn("gateway store contains unencrypted keys, stop the forwarder and run 'gateway encrypt-store' to encrypt them")
+	}
+
+	return added, nil
+}
+
+// convert returns the gateway for the gateway read from the store file, its
+// key is decrypted if it is encrypted.
+func (store *yamlFileStore) convert(ygw gatewayYAML) (*Gateway, error) {
+	gw, err := ygw.asGateway(store.keystore)
+	if errors.Is(err, ErrKeystoreLocked) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to load gateway (localID=%s) from database: %w", ygw.LocalID, err)
+	}
+	return gw, nil
+}
+
+// recover salvages the gateways from a store file that can't be decoded
+// because a write was interrupted halfway. Only the last entry is dropped and
+// only when the decode error is in that entry, errors earlier in the file are
+// most likely edits that the operator must fix. The corrupt file is kept next
+// to the store file and the store file is replaced by the recovered gateways.
+// The caller must hold the file lock.
+func (store *yamlFileStore) recover(rawGateways []byte, cause error) ([]byte, error) {
+	corrupt := fmt.Errorf("gateway store corrupt: %w", cause)
+
+	// entries start with "- " at the beginning of a line
+	start := bytes.LastIndex(rawGateways, []byte("\n- "))
+	if start < 0 {
+		return nil, corrupt
+	}
+	recovered := rawGateways[:start+1]
+	if line, ok := yamlErrorLine(cause); !ok || line <= bytes.Count(recovered, []byte("\n")) {
+		return nil, corrupt
+	}
+	var gws []gatewayYAML
+	if err := yaml.Unmarshal(recovered, &gws); err != nil || len(gws) == 0 {
+		return nil, corrupt
+	}
+
+	backup := fmt.Sprintf("%s.corrupt-%s", store.path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := writeFileAtomic(backup, rawGateways); err != nil {
+		return nil, fmt.Errorf("unable to backup corrupt gateway store: %w", err)
+	}
+	if err := writeFileAtomic(store.path, recovered); err != nil {
+		return nil, fmt.Errorf("unable to write recovered gateway store: %w", err)
+	}
+
+	keystoreLog.WithError(cause).WithFields(logrus.Fields{
+		"file":      store.path,
+		"backup":    backup,
+		"recovered": len(gws),
+		"dropped":   1,
+	}).Error("gateway store corrupt, dropped the truncated last entry")
+
+	return recovered, nil
+}
+
+// yamlErrorLine returns the first line number the yaml decode error refers to.
+func yamlErrorLine(err error) (int, bool) {
+	m := yamlErrorLineRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	line, err := strconv.Atoi(m[1])
+	return line, err == nil
+}
+
+// reuse returns the loaded gateway for the store entry if its key didn't
+// change. This keeps the details synced from the registry and prevents
+// decrypting keys again each time the store is reloaded. The caller must
+// hold the write lock.
+func (store *yamlFileStore) reuse(ygw gatewayYAML) *Gateway {
+	gw, ok := store.byLocalId[ygw.LocalID]
+	if !ok {
+		return nil
+	}
+
+	if ygw.KeyRef != "" || gw.KeyRef != "" {
+		if ygw.KeyRef != gw.KeyRef {
+			return nil
+		}
+	} else if ygw.EncryptedPrivateKey != nil {
+		cached, ok := store.encryptedKeys[gw.ThingsIxID]
+		if !ok || cached.CipherText != ygw.EncryptedPrivateKey.CipherText || cached.MAC != ygw.EncryptedPrivateKey.MAC {
+			return nil
+		}
+	} else if key, err := hex.DecodeString(ygw.PrivateKey); err != nil || !bytes.Equal(key, crypto.FromECDSA(gw.PrivateKey)) {
+		return nil
+	}
+
+	if gw.Disabled == ygw.Disabled && equalTags(gw.Tags, ygw.Tags) && gw.Metadata.Equal(ygw.Metadata) {
+		return gw
+	}
+	updated := *gw
+	updated.Disabled, updated.Tags, updated.Metadata = ygw.Disabled, ygw.Tags, ygw.Metadata
+	return &updated
+}
+
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // gatewayYAML is a helper type to serialize gateway store entires.
@@ -353,17 +636,81 @@ type gatewayYAML struct {
 	LocalID lorawan.EUI64 `yaml:"local_id"`
 	// PrivateKey is the gateways ECDSA hex encoded key that is registered in
 	// ThingsIX and the gateway can use to proof its identity.
-	PrivateKey string `yaml:"private_key"`
+	PrivateKey string `yaml:"private_key,omitempty"`
+	// EncryptedPrivateKey is the gateways private key encrypted by the
+	// keystore, it is used instead of PrivateKey when a keystore is
+	// configured.
+	EncryptedPrivateKey *keystore.CryptoJSON `yaml:"encrypted_private_key,omitempty"`
+	// KeyRef references the gateway key when it is held outside the
+	// forwarder, e.g. a PKCS#11 URI. It is used instead of PrivateKey.
+	KeyRef string `yaml:"key_ref,omitempty"`
+	// Disabled gateways stay in the store but their data is dropped
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Tags set by the operator
+	Tags []string `yaml:"tags,omitempty"`
+	// Metadata set by the operator
+	Metadata *GatewayMetadata `yaml:"metadata,omitempty"`
+}
+
+func newGatewayYAML(gw *Gateway) gatewayYAML {
+	if gw.KeyRef != "" {
+		return gatewayYAML{
+			LocalID:  gw.LocalID,
+			KeyRef:   gw.KeyRef,
+			Disabled: gw.Disabled,
+			Tags:     gw.Tags,
+			Metadata: gw.Metadata,
+		}
+	}
+	return gatewayYAML{
+		LocalID:    gw.LocalID,
+		PrivateKey: hex.EncodeToString(crypto.FromECDSA(gw.PrivateKey)),
+		Disabled:   gw.Disabled,
+		Tags:       gw.Tags,
+		Metadata:   gw.Metadata,
+	}
+}
+
+// encode returns the store entry for the given gateway, its private key is
+// encrypted if the store has a keystore. The caller must hold the write lock.
+func (store *yamlFileStore) encode(gw *Gateway) (gatewayYAML, error) {
+	entry := newGatewayYAML(gw)
+	if store.keystore == nil || gw.KeyRef != "" {
+		return entry, nil
+	}
+
+	encrypted, ok := store.encryptedKeys[gw.ThingsIxID]
+	if !ok {
+		var err error
+		if encrypted, err = store.keystore.Encrypt(gw.PrivateKey); err != nil {
+			return gatewayYAML{}, err
+		}
+		store.encryptedKeys[gw.ThingsIxID] = encrypted
+	}
+	entry.PrivateKey = ""
+	entry.EncryptedPrivateKey = encrypted
+	return entry, nil
 }
 
 // asGatway converts the gatewayYAML store entry to a gateway entry with all
-// gateway data derived from its local id and private key.
-func (gw gatewayYAML) asGateway() (*Gateway, error) {
-	keyBytes, err := hex.DecodeString(gw.PrivateKey)
-	if err != nil {
-		return nil, err
+// gateway data derived from its local id and private key. The keystore is
+// required for entries with an encrypted private key. For entries with a key
+// reference the key is opened instead.
+func (gw gatewayYAML) asGateway(ks *Keystore) (*Gateway, error) {
+	if gw.KeyRef != "" {
+		signer, err := OpenKeyRef(gw.KeyRef)
+		if err != nil {
+			return nil, err
+		}
+		ext, err := NewGatewayWithKeySigner(gw.LocalID, gw.KeyRef, signer)
+		if err != nil {
+			return nil, err
+		}
+		ext.Disabled, ext.Tags, ext.Metadata = gw.Disabled, gw.Tags, gw.Metadata
+		return ext, nil
 	}
-	key, err := crypto.ToECDSA(keyBytes)
+
+	key, err := gw.privateKey(ks)
 	if err != nil {
 		return nil, err
 	}
@@ -374,5 +721,211 @@ func (gw gatewayYAML) asGateway() (*Gateway, error) {
 		PrivateKey: key,
 		PublicKey:  &key.PublicKey,
 		ThingsIxID: utils.DeriveThingsIxID(&key.PublicKey),
+		Disabled:   gw.Disabled,
+		Tags:       gw.Tags,
+		Metadata:   gw.Metadata,
 	}, nil
 }
+
+func (gw gatewayYAML) privateKey(ks *Keystore) (*ecdsa.PrivateKey, error) {
+	if gw.EncryptedPrivateKey != nil {
+		if ks == nil {
+			return nil, ErrKeystoreLocked
+		}
+		return ks.Decrypt(gw.EncryptedPrivateKey)
+	}
+
+	keyBytes, err := hex.DecodeString(gw.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ToECDSA(keyBytes)
+}
+
+// Update changes the gateway identified by the given local id and rewrites
+// the store file, see GatewayManager.
+func (store *yamlFileStore) Update(ctx context.Context, localID lorawan.EUI64, fn func(*Gateway) error) (*Gateway, error) {
+	unlock, err := store.lockFile()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	added, err := store.refreshFromFile()
+	if err != nil {
+		return nil, err
+	}
+	defer store.syncGateways(ctx, added)
+
+	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+
+	gw, ok := store.byLocalId[localID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated, err := updateGateway(gw, fn)
+	if err != nil {
+		return nil, err
+	}
+	if updated.NetworkID != gw.NetworkID {
+		if _, ok := store.byNetId[updated.NetworkID]; ok {
+			return nil, ErrAlreadyExists
+		}
+	}
+
+	store.byLocalId[localID] = updated
+	if err := store.writeFile(); err != nil {
+		store.byLocalId[localID] = gw
+		return nil, err
+	}
+	delete(store.byNetId, gw.NetworkID)
+	delete(store.byThingsIxID, gw.ThingsIxID)
+	if updated.ThingsIxID != gw.ThingsIxID {
+		delete(store.encryptedKeys, gw.ThingsIxID)
+	}
+	store.byNetId[updated.NetworkID] = updated
+	store.byThingsIxID[updated.ThingsIxID] = updated
+
+	return updated, nil
+}
+
+// Remove deletes the gateway identified by the given local id and rewrites
+// the store file, see GatewayManager.
+func (store *yamlFileStore) Remove(ctx context.Context, localID lorawan.EUI64) error {
+	unlock, err := store.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	added, err := store.refreshFromFile()
+	if err != nil {
+		return err
+	}
+	defer store.syncGateways(ctx, added)
+
+	store.gwMapMu.Lock()
+	defer store.gwMapMu.Unlock()
+
+	gw, ok := store.byLocalId[localID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(store.byLocalId, localID)
+	if err := store.writeFile(); err != nil {
+		store.byLocalId[localID] = gw
+		return err
+	}
+	delete(store.byNetId, gw.NetworkID)
+	delete(store.byThingsIxID, gw.ThingsIxID)
+	delete(store.encryptedKeys, gw.ThingsIxID)
+
+	return nil
+}
+
+// writeFile replaces the store file with the gateways in memory, the caller
+// must hold the file lock and the write lock. The gateways are written to a temporary file that
+// replaces the store file when complete to prevent a corrupt store file when
+// writing fails halfway.
+func (store *yamlFileStore) writeFile() error {
+	entries := make([]gatewayYAML, 0, len(store.byLocalId))
+	for _, gw := range store.byLocalId {
+		entry, err := store.encode(gw)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].LocalID[:], entries[j].LocalID[:]) < 0
+	})
+
+	encoded, err := yaml.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("unable to encode gateways: %w", err)
+	}
+	if err := writeFileAtomic(store.path, encoded); err != nil {
+		return err
+	}
+	store.fileHash = sha256.Sum256(encoded)
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file that replaces the file at
+// path when complete.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// EncryptYamlFileStore encrypts the plain text private keys of the gateways
+// in the file based gateway store at path with the given keystore and
+// returns the number of keys it encrypted. Keys that are already encrypted
+// are kept as is. The store must not be in use by a running forwarder.
+func EncryptYamlFileStore(path string, ks *Keystore) (int, error) {
+	unlock, err := lockPath(path + ".lock")
+	if err != nil {
+		return 0, fmt.Errorf("unable to lock gateway store: %w", err)
+	}
+	defer unlock()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var gws []gatewayYAML
+	if err := yaml.Unmarshal(raw, &gws); err != nil {
+		return 0, fmt.Errorf("gateway store corrupt: %w", err)
+	}
+
+	var encrypted int
+	for i, gw := range gws {
+		if gw.KeyRef != "" {
+			continue // key is not in the store
+		}
+		key, err := gw.privateKey(ks)
+		if err != nil {
+			return 0, fmt.Errorf("unable to load gateway (localID=%s): %w", gw.LocalID, err)
+		}
+		if gw.EncryptedPrivateKey != nil {
+			continue
+		}
+		if gws[i].EncryptedPrivateKey, err = ks.Encrypt(key); err != nil {
+			return 0, err
+		}
+		gws[i].PrivateKey = ""
+		encrypted++
+	}
+
+	if encrypted == 0 {
+		return 0, nil
+	}
+
+	encoded, err := yaml.Marshal(gws)
+	if err != nil {
+		return 0, fmt.Errorf("unable to encode gateways: %w", err)
+	}
+	if err := writeFileAtomic(path, encoded); err != nil {
+		return 0, err
+	}
+	return encrypted, nil
+}
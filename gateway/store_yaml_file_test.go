@@ -0,0 +1,236 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+)
+
+func TestYamlFileStoreMetadata(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		path    = filepath.Join(t.TempDir(), "gateways.yaml")
+		localID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		lat     = 52.37
+		lon     = 4.89
+		gain    = 3.6
+	)
+
+	store, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := utils.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(ctx, localID, key); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &GatewayMetadata{Name: "rooftop", Latitude: &lat, Longitude: &lon, AntennaGain: &gain}
+	updated, err := store.Update(ctx, localID, func(gw *Gateway) error {
+		gw.Metadata = metadata
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Metadata.Equal(metadata) {
+		t.Errorf("unexpected metadata after update: %+v", updated.Metadata)
+	}
+
+	// metadata must survive reloading the store from disk
+	reopened, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := reopened.ByLocalID(localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gw.Metadata.Equal(metadata) {
+		t.Errorf("unexpected metadata after reload: %+v", gw.Metadata)
+	}
+
+	// a location requires both latitude and longitude
+	if _, err := store.Update(ctx, localID, func(gw *Gateway) error {
+		gw.Metadata = &GatewayMetadata{Latitude: &lat}
+		return nil
+	}); err == nil {
+		t.Error("expected update with only a latitude to fail")
+	}
+}
+
+func TestYamlFileStoreConcurrentWriters(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "gateways.yaml")
+		wg   sync.WaitGroup
+	)
+
+	// two stores on the same file act like two forwarder processes
+	var stores [2]*yamlFileStore
+	for i := range stores {
+		store, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = store
+	}
+
+	for i, store := range stores {
+		wg.Add(1)
+		go func(i int, store *yamlFileStore) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				key, err := utils.GeneratePrivateKey()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := store.Add(ctx, lorawan.EUI64{byte(i), byte(j)}, key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, store)
+	}
+	wg.Wait()
+
+	reopened, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Count(); got != 20 {
+		t.Errorf("expected 20 gateways in store, got %d", got)
+	}
+}
+
+func TestYamlFileStoreRecoverTruncated(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "gateways.yaml")
+	)
+
+	store, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= 3; i++ {
+		key, err := utils.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Add(ctx, lorawan.EUI64{i}, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate a write that was interrupted halfway the last entry
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := bytes.LastIndex(raw, []byte("\n- "))
+	truncated := raw[:last+len("\n- private_key: ab")]
+	if err := os.WriteFile(path, truncated, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recovered.Count(); got != 2 {
+		t.Errorf("expected 2 recovered gateways, got %d", got)
+	}
+	for _, localID := range []lorawan.EUI64{{1}, {2}} {
+		if !recovered.ContainsByLocalID(localID) {
+			t.Errorf("expected gateway %s to be recovered", localID)
+		}
+	}
+
+	backups, _ := filepath.Glob(path + ".corrupt-*")
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup of the corrupt store, got %d", len(backups))
+	}
+	if backup, _ := os.ReadFile(backups[0]); !bytes.Equal(backup, truncated) {
+		t.Error("backup doesn't contain the corrupt store")
+	}
+}
+
+func TestYamlFileStoreCorruptNotRecovered(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "gateways.yaml")
+	)
+
+	store, err := NewYamlFileStore(ctx, path, staticRegistry{}, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= 3; i++ {
+		key, err := utils.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Add(ctx, lorawan.EUI64{i}, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate an edit with a typo in the second entry
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := bytes.Index(raw, []byte("\n- ")) + 1
+	second += bytes.Index(raw[second:], []byte("\n")) + 1
+	corrupt := append(append(append([]byte{}, raw[:second]...), "  tags: [typo\n"...), raw[second:]...)
+	if err := os.WriteFile(path, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, load := range map[string]func() error{
+		"startup": func() error { _, err := store.loadFromFile(true); return err },
+		"reload":  func() error { _, err := store.loadFromFile(false); return err },
+		"refresh": func() error { _, err := store.refreshFromFile(); return err },
+	} {
+		if err := load(); err == nil {
+			t.Errorf("%s: expected corrupt store error", name)
+		}
+		if got := store.Count(); got != 3 {
+			t.Errorf("%s: expected 3 loaded gateways to be kept, got %d", name, got)
+		}
+		if onDisk, _ := os.ReadFile(path); !bytes.Equal(onDisk, corrupt) {
+			t.Errorf("%s: store file was modified", name)
+		}
+	}
+	if backups, _ := filepath.Glob(path + ".corrupt-*"); len(backups) != 0 {
+		t.Errorf("expected no backup of the corrupt store, got %d", len(backups))
+	}
+}
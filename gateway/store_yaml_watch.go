@@ -0,0 +1,55 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"os"
+
+	"github.com/brocaar/lorawan"
+	"github.com/sirupsen/logrus"
+)
+
+// reload loads the store file after it changed and syncs gateways that were
+// added with the registry. Gateways that didn't change are kept as is, if the
+// file can't be loaded the current gateways are kept.
+func (store *yamlFileStore) reload(ctx context.Context) {
+	log := keystoreLog.WithField("file", store.path)
+	if _, err := os.Stat(store.path); err != nil {
+		log.WithError(err).Warn("gateway store unavailable, keep loaded gateways")
+		return
+	}
+
+	added, err := store.loadFromFile(false)
+	store.loaded(err)
+	if err != nil {
+		log.WithError(err).Error("unable to reload gateway store, keep loaded gateways")
+		return
+	}
+	store.syncGateways(ctx, added)
+}
+
+// syncGateways syncs the gateways with the given local ids with the registry.
+func (store *yamlFileStore) syncGateways(ctx context.Context, localIDs []lorawan.EUI64) {
+	for _, localID := range localIDs {
+		if _, err := store.SyncGatewayByLocalID(ctx, localID, false); err != nil {
+			keystoreLog.WithError(err).
+				WithFields(logrus.Fields{"file": store.path, "gw_local_id": localID}).
+				Warn("unable to sync gateway")
+		}
+	}
+}
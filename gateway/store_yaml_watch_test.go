@@ -0,0 +1,87 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThingsIXFoundation/frequency-plan/go/frequency_plan"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+)
+
+func TestYamlFileStoreReload(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		path     = filepath.Join(t.TempDir(), "gateways.yaml")
+		registry = staticRegistry{}
+		first    = lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+		second   = lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+	)
+
+	store, err := NewYamlFileStore(ctx, path, registry, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := utils.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Add(ctx, first, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add a gateway to the file as an external tool would do
+	other, err := NewYamlFileStore(ctx, path, registry, frequency_plan.EU868, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = utils.GeneratePrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Add(ctx, second, key); err != nil {
+		t.Fatal(err)
+	}
+
+	store.reload(ctx)
+	if store.Count() != 2 {
+		t.Fatalf("expected 2 gateways after reload, got %d", store.Count())
+	}
+	if gw, err := store.ByLocalID(first); err != nil || gw != loaded {
+		t.Errorf("expected unchanged gateway to be kept, got %v", err)
+	}
+	if !store.ContainsByLocalID(second) {
+		t.Error("added gateway not loaded")
+	}
+
+	// an invalid or missing file must not drop loaded gateways
+	if err := os.WriteFile(path, []byte("{invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store.reload(ctx)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	store.reload(ctx)
+	if store.Count() != 2 {
+		t.Errorf("expected loaded gateways to be kept, got %d", store.Count())
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+)
+
+// ParseNetworkIDPrefix normalizes a hex network id prefix. Colons, dashes
+// and a 0x prefix are ignored and an odd number of hex digits is allowed.
+func ParseNetworkIDPrefix(prefix string) (string, error) {
+	prefix = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(prefix), "0x"))
+	prefix = strings.NewReplacer(":", "", "-", "").Replace(prefix)
+	if prefix == "" || len(prefix) > 2*len(lorawan.EUI64{}) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidNetworkIDPrefix, prefix)
+	}
+	for _, c := range prefix {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidNetworkIDPrefix, prefix)
+		}
+	}
+	return prefix, nil
+}
+
+// GenerateNewGatewayWithNetworkIDPrefix generates keys until the network id
+// derived from the key starts with the given hex prefix. Each additional hex
+// digit makes finding a key 16 times harder on average. It gives up after
+// maxAttempts keys and returns ErrNetworkIDPrefixNotFound. Keys are generated
+// on all CPUs. It returns the number of generated keys.
+func GenerateNewGatewayWithNetworkIDPrefix(ctx context.Context, localID lorawan.EUI64, prefix string, maxAttempts uint64) (*Gateway, uint64, error) {
+	prefix, err := ParseNetworkIDPrefix(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		attempts uint64
+		found    *ecdsa.PrivateKey
+		foundErr error
+		once     sync.Once
+		wg       sync.WaitGroup
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil && atomic.AddUint64(&attempts, 1) <= maxAttempts {
+				priv, err := utils.GeneratePrivateKey()
+				if err != nil {
+					once.Do(func() { foundErr = err })
+					cancel()
+					return
+				}
+				if strings.HasPrefix(GatewayNetworkIDFromPrivateKey(priv).String(), prefix) {
+					once.Do(func() { found = priv })
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if attempts > maxAttempts {
+		attempts = maxAttempts
+	}
+	if foundErr != nil {
+		return nil, attempts, foundErr
+	}
+	if found == nil {
+		if err := ctx.Err(); err != nil && attempts < maxAttempts {
+			return nil, attempts, err
+		}
+		return nil, attempts, fmt.Errorf("%w %q after %d attempts", ErrNetworkIDPrefixNotFound, prefix, attempts)
+	}
+
+	return &Gateway{
+		LocalID:    localID,
+		NetworkID:  GatewayNetworkIDFromPrivateKey(found),
+		PrivateKey: found,
+		PublicKey:  &found.PublicKey,
+		ThingsIxID: utils.DeriveThingsIxID(&found.PublicKey),
+	}, attempts, nil
+}
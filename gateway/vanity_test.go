@@ -0,0 +1,65 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestParseNetworkIDPrefix(t *testing.T) {
+	for input, expected := range map[string]string{
+		"AB":      "ab",
+		"0xab1":   "ab1",
+		"ab:cd-e": "abcde",
+	} {
+		if got, err := ParseNetworkIDPrefix(input); err != nil || got != expected {
+			t.Errorf("parse %q: got %q, %v", input, got, err)
+		}
+	}
+	for _, input := range []string{"", "0x", "xyz", "0123456789abcdef0"} {
+		if _, err := ParseNetworkIDPrefix(input); !errors.Is(err, ErrInvalidNetworkIDPrefix) {
+			t.Errorf("parse %q: expected invalid prefix error, got %v", input, err)
+		}
+	}
+}
+
+func TestGenerateNewGatewayWithNetworkIDPrefix(t *testing.T) {
+	localID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	gw, _, err := GenerateNewGatewayWithNetworkIDPrefix(context.Background(), localID, "a", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(gw.NetworkID.String(), "a") {
+		t.Errorf("network id %s doesn't start with prefix", gw.NetworkID)
+	}
+	if gw.NetworkID != GatewayNetworkIDFromPrivateKey(gw.PrivateKey) {
+		t.Error("network id doesn't match key")
+	}
+
+	_, attempts, err := GenerateNewGatewayWithNetworkIDPrefix(context.Background(), localID, "0123456789abcdef", 10)
+	if !errors.Is(err, ErrNetworkIDPrefixNotFound) {
+		t.Errorf("expected prefix not found error, got %v", err)
+	}
+	if attempts != 10 {
+		t.Errorf("expected 10 attempts, got %d", attempts)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gatewayid derives the identifiers of a ThingsIX gateway from its
+// key. It is the reference implementation used by the forwarder and is
+// intended for third party tools, such as onboarding apps and explorers,
+// that need to derive gateway ids identically. Test vectors are published
+// in testdata/vectors.json.
+//
+// A gateway key is a secp256k1 key. The ThingsIX id is the compressed public
+// key without its 0x02 prefix, only keys with an even public key (0x02
+// prefix) are valid ThingsIX gateway keys. The network id is the first 8
+// bytes of the SHA256 hash of the ThingsIX id and is used as gateway id in
+// the communication with routers. The address is the Ethereum address of the
+// public key.
+package gatewayid
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/brocaar/lorawan"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// ErrOddPublicKey is returned for keys with a public key that compresses
+	// with a 0x03 prefix, ThingsIX only supports keys with a 0x02 prefix.
+	ErrOddPublicKey = errs.New(errs.ErrInvalidArgument, "public key has odd y coordinate, not a valid ThingsIX gateway key")
+	// ErrInvalidKey is returned when the input is not a valid key.
+	ErrInvalidKey = errs.New(errs.ErrInvalidArgument, "invalid gateway key")
+)
+
+// IDs holds the identifiers derived from a gateway key.
+type IDs struct {
+	// ThingsIxID is the id the gateway is onboarded with in ThingsIX.
+	ThingsIxID [32]byte
+	// NetworkID is the gateway id as used by routers.
+	NetworkID lorawan.EUI64
+	// Address is the Ethereum address of the gateway key.
+	Address common.Address
+}
+
+// ThingsIxIDHex returns the ThingsIX id as 0x prefixed hex string.
+func (ids IDs) ThingsIxIDHex() string {
+	return fmt.Sprintf("0x%x", ids.ThingsIxID[:])
+}
+
+// NetworkID returns the network id for the given ThingsIX id.
+func NetworkID(thingsIxID [32]byte) lorawan.EUI64 {
+	var id lorawan.EUI64
+	h := sha256.Sum256(thingsIxID[:])
+	copy(id[:], h[:8])
+	return id
+}
+
+// FromPrivateKey derives the ids from a gateway private key.
+func FromPrivateKey(key *ecdsa.PrivateKey) (IDs, error) {
+	return FromPublicKey(&key.PublicKey)
+}
+
+// FromPublicKey derives the ids from a gateway public key.
+func FromPublicKey(pub *ecdsa.PublicKey) (IDs, error) {
+	compressed := crypto.CompressPubkey(pub)
+	if compressed[0] != 0x02 {
+		return IDs{}, ErrOddPublicKey
+	}
+	var ids IDs
+	copy(ids.ThingsIxID[:], compressed[1:])
+	ids.NetworkID = NetworkID(ids.ThingsIxID)
+	ids.Address = crypto.PubkeyToAddress(*pub)
+	return ids, nil
+}
+
+// FromThingsIxID derives the ids from a ThingsIX id.
+func FromThingsIxID(thingsIxID [32]byte) (IDs, error) {
+	pub, err := crypto.DecompressPubkey(append([]byte{0x02}, thingsIxID[:]...))
+	if err != nil {
+		return IDs{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return FromPublicKey(pub)
+}
+
+// Parse derives the ids from a hex encoded key, with or without 0x prefix.
+// It accepts:
+//   - 32 byte private key
+//   - 33 byte compressed public key
+//   - 65 byte uncompressed public key
+//
+// A 32 byte input is always interpreted as private key, use FromThingsIxID
+// to derive the ids from a ThingsIX id.
+func Parse(key string) (IDs, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(key), "0x"))
+	if err != nil {
+		return IDs{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	switch len(raw) {
+	case 32:
+		priv, err := crypto.ToECDSA(raw)
+		if err != nil {
+			return IDs{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		return FromPrivateKey(priv)
+	case 33:
+		pub, err := crypto.DecompressPubkey(raw)
+		if err != nil {
+			return IDs{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		return FromPublicKey(pub)
+	case 65:
+		pub, err := crypto.UnmarshalPubkey(raw)
+		if err != nil {
+			return IDs{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		return FromPublicKey(pub)
+	default:
+		return IDs{}, fmt.Errorf("%w: unexpected length %d", ErrInvalidKey, len(raw))
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gatewayid
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+type vector struct {
+	PrivateKey            string `json:"privateKey"`
+	PublicKey             string `json:"publicKey"`
+	UncompressedPublicKey string `json:"uncompressedPublicKey"`
+	ThingsIxID            string `json:"thingsIxId"`
+	NetworkID             string `json:"networkId"`
+	Address               string `json:"address"`
+}
+
+func loadVectors(t *testing.T) (valid, invalid []vector) {
+	raw, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors struct {
+		Valid   []vector `json:"valid"`
+		Invalid []vector `json:"invalid"`
+	}
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	return vectors.Valid, vectors.Invalid
+}
+
+func TestVectors(t *testing.T) {
+	valid, invalid := loadVectors(t)
+	if len(valid) == 0 || len(invalid) == 0 {
+		t.Fatal("no test vectors")
+	}
+
+	for _, v := range valid {
+		for _, key := range []string{v.PrivateKey, v.PublicKey, v.UncompressedPublicKey} {
+			ids, err := Parse(key)
+			if err != nil {
+				t.Errorf("parse %s: %v", key, err)
+				continue
+			}
+			if got := ids.ThingsIxIDHex(); got != v.ThingsIxID {
+				t.Errorf("%s: thingsix id %s, expected %s", key, got, v.ThingsIxID)
+			}
+			if got := ids.NetworkID.String(); got != v.NetworkID {
+				t.Errorf("%s: network id %s, expected %s", key, got, v.NetworkID)
+			}
+			if got := ids.Address.Hex(); got != v.Address {
+				t.Errorf("%s: address %s, expected %s", key, got, v.Address)
+			}
+		}
+
+		ids, _ := Parse(v.PrivateKey)
+		fromID, err := FromThingsIxID(ids.ThingsIxID)
+		if err != nil {
+			t.Errorf("from thingsix id %s: %v", v.ThingsIxID, err)
+		} else if fromID != ids {
+			t.Errorf("from thingsix id %s: got %+v, expected %+v", v.ThingsIxID, fromID, ids)
+		}
+	}
+
+	for _, v := range invalid {
+		for _, key := range []string{v.PrivateKey, v.PublicKey} {
+			if _, err := Parse(key); !errors.Is(err, ErrOddPublicKey) {
+				t.Errorf("parse %s: expected odd public key error, got %v", key, err)
+			}
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, key := range []string{"", "0x", "zz", "0x0102", "0x0000000000000000000000000000000000000000000000000000000000000000"} {
+		if _, err := Parse(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("parse %q: expected invalid key error, got %v", key, err)
+		}
+	}
+}
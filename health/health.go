@@ -0,0 +1,176 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package health implements liveness and readiness endpoints. A service
+// reports the state of its components as checks, critical checks indicate
+// the process is broken and must be restarted, other checks indicate the
+// process temporarily can't handle traffic.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// StatusPass indicates the check or all checks in a report passed
+	StatusPass = "pass"
+	// StatusFail indicates the check or at least one relevant check in a
+	// report failed
+	StatusFail = "fail"
+)
+
+// Check is the state of a single component.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Critical checks fail liveness, other checks only fail readiness
+	Critical bool   `json:"critical"`
+	Details  string `json:"details,omitempty"`
+}
+
+// Pass returns a passed check.
+func Pass(name, details string, args ...interface{}) Check {
+	return Check{Name: name, Status: StatusPass, Details: fmt.Sprintf(details, args...)}
+}
+
+// Fail returns a failed check.
+func Fail(name, details string, args ...interface{}) Check {
+	return Check{Name: name, Status: StatusFail, Details: fmt.Sprintf(details, args...)}
+}
+
+// Critical returns a copy of c that fails liveness when it fails.
+func Critical(c Check) Check {
+	c.Critical = true
+	return c
+}
+
+// Report is the outcome of evaluating the checks of a service.
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// Checker returns the current state of the components of a service.
+type Checker func() []Check
+
+// Evaluate returns the report for checks. For liveness only critical checks
+// are taken into account, for readiness all checks must pass.
+func Evaluate(checks []Check, readiness bool) Report {
+	report := Report{Status: StatusPass, Checks: checks}
+	for _, check := range checks {
+		if check.Status != StatusPass && (readiness || check.Critical) {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// LivenessHandler returns the handler for /healthz, it replies with 503
+// when a critical check fails.
+func LivenessHandler(checker Checker) http.HandlerFunc {
+	return handler(checker, false)
+}
+
+// ReadinessHandler returns the handler for /readyz, it replies with 503
+// when any check fails.
+func ReadinessHandler(checker Checker) http.HandlerFunc {
+	return handler(checker, true)
+}
+
+func handler(checker Checker, readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := Evaluate(checker(), readiness)
+		status := http.StatusOK
+		if report.Status != StatusPass {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+// RunWatchdog notifies systemd when the service started and keeps feeding
+// the systemd watchdog as long as no critical check fails, until the given
+// ctx expires. Readiness is not used, systemd would otherwise fail the start
+// of a service that waits for a dependency. It returns immediately when the
+// process is not started by systemd with a notify socket.
+func RunWatchdog(ctx context.Context, checker Checker) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	// systemd uses a leading @ for sockets in the abstract namespace
+	if socket[0] == '@' {
+		addr.Name = "\x00" + socket[1:]
+	}
+
+	// feed the watchdog twice per timeout, when systemd has no watchdog
+	// configured only the ready notification is sent
+	interval := 10 * time.Second
+	watchdog := false
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		interval, watchdog = time.Duration(usec)*time.Microsecond/2, true
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := false
+	for {
+		alive := Evaluate(checker(), false).Status == StatusPass
+		if !ready && alive {
+			if err := notify(addr, "READY=1"); err != nil {
+				logrus.WithError(err).Warn("unable to notify systemd")
+			}
+			ready = true
+		}
+		if watchdog && alive {
+			if err := notify(addr, "WATCHDOG=1"); err != nil {
+				logrus.WithError(err).Warn("unable to feed systemd watchdog")
+			}
+		}
+		if ready && !watchdog {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func notify(addr *net.UnixAddr, state string) error {
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
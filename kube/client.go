@@ -0,0 +1,196 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package kube implements a minimal client for the Kubernetes API that
+// supports the operations the forwarder needs, it avoids depending on the
+// full Kubernetes client libraries.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// ErrNotFound is returned when the requested object doesn't exist.
+var ErrNotFound = errs.New(errs.ErrNotFound, "not found")
+
+// ErrConflict is returned when an object was modified concurrently or
+// already exists.
+var ErrConflict = errs.New(errs.ErrAlreadyExists, "conflict")
+
+// Client is a Kubernetes API client.
+type Client struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewInClusterClient returns a client that uses the service account the pod
+// runs with, together with the namespace the pod runs in.
+func NewInClusterClient() (*Client, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", fmt.Errorf("not running in a Kubernetes cluster")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, "", fmt.Errorf("invalid cluster CA")
+	}
+
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read namespace: %w", err)
+	}
+
+	return &Client{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, strings.TrimSpace(string(namespace)), nil
+}
+
+// NewProxyClient returns a client for an API server that doesn't require
+// authentication, such as `kubectl proxy`.
+func NewProxyClient(host string) *Client {
+	return &Client{
+		host:   strings.TrimSuffix(host, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Do sends a request with the JSON encoded body to the API server and decodes
+// the reply in reply if not nil.
+func (k *Client) Do(ctx context.Context, method, path, contentType string, body, reply interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.host+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.tokenFile != "" {
+		// service account tokens are rotated, read it for each request
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err := fmt.Errorf("%s %s: %d - %s", method, path, resp.StatusCode, bytes.TrimSpace(msg))
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %v", ErrNotFound, err)
+		case http.StatusConflict:
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+		return err
+	}
+	if reply != nil {
+		return json.NewDecoder(resp.Body).Decode(reply)
+	}
+	return nil
+}
+
+// ObjectMeta holds the object metadata fields the forwarder uses.
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	Generation      int64  `json:"generation,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// ResourcePath returns the API path for resources of the given group,
+// version and plural name in the namespace.
+func ResourcePath(group, version, namespace, plural string) string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", group, version, namespace, plural)
+}
+
+// List retrieves all objects at the resource path and decodes them in items.
+func (k *Client) List(ctx context.Context, path string, items interface{}) error {
+	var reply struct {
+		Items json.RawMessage `json:"items"`
+	}
+	if err := k.Do(ctx, http.MethodGet, path, "", nil, &reply); err != nil {
+		return err
+	}
+	return json.Unmarshal(reply.Items, items)
+}
+
+// PatchStatus sets the status of the object with the given name.
+func (k *Client) PatchStatus(ctx context.Context, path, name string, status interface{}) error {
+	return k.Do(ctx, http.MethodPatch, path+"/"+name+"/status", "application/merge-patch+json",
+		map[string]interface{}{"status": status}, nil)
+}
+
+// SecretValue returns the value of the key in the secret.
+func (k *Client) SecretValue(ctx context.Context, namespace, name, key string) ([]byte, error) {
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, name)
+	if err := k.Do(ctx, http.MethodGet, path, "", nil, &secret); err != nil {
+		return nil, err
+	}
+	encoded, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %s", name, key)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
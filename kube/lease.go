@@ -0,0 +1,93 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// MicroTimeFormat is the format of timestamps in leases.
+const MicroTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Lease is a coordination.k8s.io/v1 Lease.
+type Lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       LeaseSpec  `json:"spec"`
+}
+
+// LeaseSpec holds the lease details.
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// Expired returns an indication if the lease was not renewed within its
+// duration.
+func (spec *LeaseSpec) Expired(now time.Time) bool {
+	if spec.HolderIdentity == "" || spec.RenewTime == "" {
+		return true
+	}
+	renewed, err := time.Parse(MicroTimeFormat, spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(spec.LeaseDurationSeconds) * time.Second))
+}
+
+func leasesPath(namespace string) string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", namespace)
+}
+
+// GetLease returns the lease, ErrNotFound if it doesn't exist.
+func (k *Client) GetLease(ctx context.Context, namespace, name string) (*Lease, error) {
+	var lease Lease
+	if err := k.Do(ctx, http.MethodGet, leasesPath(namespace)+"/"+name, "", nil, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// CreateLease creates the lease, ErrConflict if it already exists.
+func (k *Client) CreateLease(ctx context.Context, namespace string, lease *Lease) (*Lease, error) {
+	lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+	var created Lease
+	if err := k.Do(ctx, http.MethodPost, leasesPath(namespace), "application/json", lease, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateLease replaces the lease. The resource version of the lease must
+// match the stored version, ErrConflict is returned if it was modified in
+// the meantime.
+func (k *Client) UpdateLease(ctx context.Context, namespace string, lease *Lease) (*Lease, error) {
+	lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+	var updated Lease
+	path := leasesPath(namespace) + "/" + lease.Metadata.Name
+	if err := k.Do(ctx, http.MethodPut, path, "application/json", lease, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
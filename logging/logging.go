@@ -0,0 +1,223 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package logging provides loggers per subsystem whose level can be changed
+// at runtime. Module loggers write through the standard logrus logger, they
+// share its output, formatter and hooks. Modules without an explicit level
+// follow the level of the standard logger.
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/sirupsen/logrus"
+)
+
+// FieldModule is the field that holds the module name in log entries.
+const FieldModule = "module"
+
+// ErrUnknownModule is returned when a level is set for a module that does
+// not exist.
+var ErrUnknownModule = errs.New(errs.ErrNotFound, "unknown log module")
+
+// ModuleLevel is the current log level of a module.
+type ModuleLevel struct {
+	Module string `json:"module"`
+	Level  string `json:"level"`
+	// Override is set when the level is set for the module, otherwise the
+	// module follows the default level
+	Override bool `json:"override"`
+}
+
+type module struct {
+	logger   *logrus.Logger
+	override bool
+}
+
+var (
+	mu      sync.Mutex
+	modules = make(map[string]*module)
+)
+
+// standardWriter writes to the output of the standard logger.
+type standardWriter struct{}
+
+func (standardWriter) Write(p []byte) (int, error) {
+	return logrus.StandardLogger().Out.Write(p)
+}
+
+// formatter holds the formatter of the standard logger as set through
+// SetFormatter. Module loggers read it on each log call, the Formatter field
+// of the standard logger can't be read without racing with SetFormatter.
+var formatter atomic.Value
+
+// formatterValue wraps a formatter, all values stored in an atomic.Value must
+// be of the same type.
+type formatterValue struct {
+	logrus.Formatter
+}
+
+func init() {
+	formatter.Store(formatterValue{logrus.StandardLogger().Formatter})
+}
+
+// SetFormatter sets the formatter of the standard logger and the module
+// loggers. Use it instead of logrus.SetFormatter, module loggers don't
+// observe a formatter that is set directly on the standard logger.
+func SetFormatter(f logrus.Formatter) {
+	logrus.SetFormatter(f)
+	formatter.Store(formatterValue{f})
+}
+
+// moduleFormatter adds the module name to entries and formats them with the
+// formatter of the standard logger.
+type moduleFormatter struct {
+	name string
+}
+
+func (f moduleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	// the entry is a copy made for this log call, its data is not shared
+	entry.Data[FieldModule] = f.name
+	return formatter.Load().(formatterValue).Format(entry)
+}
+
+// Module returns the logger for the module with the given name, later calls
+// with the same name return the same logger.
+func Module(name string) *logrus.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if m, ok := modules[name]; ok {
+		return m.logger
+	}
+
+	std := logrus.StandardLogger()
+	logger := &logrus.Logger{
+		Out:          standardWriter{},
+		Formatter:    moduleFormatter{name: name},
+		Hooks:        std.Hooks,
+		Level:        std.GetLevel(),
+		ExitFunc:     std.ExitFunc,
+		ReportCaller: std.ReportCaller,
+	}
+	modules[name] = &module{logger: logger}
+	return logger
+}
+
+// SetDefaultLevel sets the level of the standard logger and all modules
+// that don't have their own level.
+func SetDefaultLevel(level logrus.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	logrus.SetLevel(level)
+	for _, m := range modules {
+		if !m.override {
+			m.logger.SetLevel(level)
+		}
+	}
+}
+
+// Configure sets the default level and the levels of the given modules, all
+// other modules follow the default level. Levels previously set at runtime
+// are discarded. An error is returned for modules that don't exist, the
+// levels of the other modules are applied.
+func Configure(defaultLevel logrus.Level, levels map[string]logrus.Level) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	logrus.SetLevel(defaultLevel)
+	for _, m := range modules {
+		m.override = false
+		m.logger.SetLevel(defaultLevel)
+	}
+
+	var unknown []string
+	for name, level := range levels {
+		m, ok := modules[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		m.override = true
+		m.logger.SetLevel(level)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%w: %s", ErrUnknownModule, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// SetLevel sets the level of the module with the given name, it no longer
+// follows the default level.
+func SetLevel(name string, level logrus.Level) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m, ok := modules[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownModule, name)
+	}
+	m.override = true
+	m.logger.SetLevel(level)
+	return nil
+}
+
+// ResetLevel lets the module with the given name follow the default level
+// again.
+func ResetLevel(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m, ok := modules[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownModule, name)
+	}
+	m.override = false
+	m.logger.SetLevel(logrus.GetLevel())
+	return nil
+}
+
+// Level returns the current level of the module with the given name.
+func Level(name string) (ModuleLevel, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m, ok := modules[name]
+	if !ok {
+		return ModuleLevel{}, fmt.Errorf("%w: %s", ErrUnknownModule, name)
+	}
+	return ModuleLevel{Module: name, Level: m.logger.GetLevel().String(), Override: m.override}, nil
+}
+
+// Levels returns the current level of all modules, ordered by name.
+func Levels() []ModuleLevel {
+	mu.Lock()
+	defer mu.Unlock()
+
+	levels := make([]ModuleLevel, 0, len(modules))
+	for name, m := range modules {
+		levels = append(levels, ModuleLevel{Module: name, Level: m.logger.GetLevel().String(), Override: m.override})
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Module < levels[j].Module })
+	return levels
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetFormatterWhileLogging(t *testing.T) {
+	var (
+		out    bytes.Buffer
+		outMu  sync.Mutex
+		std    = logrus.StandardLogger()
+		logger = Module("formatter_test")
+	)
+	prev := std.Out
+	std.SetOutput(writerFunc(func(p []byte) (int, error) {
+		outMu.Lock()
+		defer outMu.Unlock()
+		return out.Write(p)
+	}))
+	defer std.SetOutput(prev)
+	defer SetFormatter(&logrus.TextFormatter{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			logger.Info("reload")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		SetFormatter(&logrus.TextFormatter{})
+	}
+	wg.Wait()
+
+	SetFormatter(&logrus.JSONFormatter{})
+	outMu.Lock()
+	out.Reset()
+	outMu.Unlock()
+	logger.Info("json")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("module logger doesn't use the formatter set with SetFormatter: %v", err)
+	}
+	if entry[FieldModule] != "formatter_test" {
+		t.Errorf("expected module formatter_test, got %v", entry[FieldModule])
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
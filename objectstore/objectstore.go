@@ -0,0 +1,275 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package objectstore implements a minimal client for S3 compatible object
+// storage. Requests are signed with AWS signature version 4, which is also
+// accepted by Google Cloud Storage (interoperability mode with HMAC keys) and
+// most self-hosted object stores.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config describes the bucket objects are stored in.
+type Config struct {
+	// Provider is either "s3" (default) or "gcs", it determines the format
+	// of the lifecycle configuration.
+	Provider string `mapstructure:"provider"`
+	// Endpoint is the base URL of the object store, defaults to AWS S3 in
+	// the configured region or GCS for the gcs provider.
+	Endpoint string `mapstructure:"endpoint"`
+	// Region of the bucket, GCS uses "auto".
+	Region string `mapstructure:"region"`
+	Bucket string `mapstructure:"bucket"`
+
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+}
+
+// Client stores objects in a bucket.
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+}
+
+// New returns a client for the bucket in cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("object store bucket missing")
+	}
+	if cfg.Provider == "" {
+		cfg.Provider = "s3"
+	}
+	if cfg.Provider != "s3" && cfg.Provider != "gcs" {
+		return nil, fmt.Errorf("unsupported object store provider %q", cfg.Provider)
+	}
+	if cfg.Region == "" {
+		if cfg.Provider == "gcs" {
+			cfg.Region = "auto"
+		} else {
+			cfg.Region = "us-east-1"
+		}
+	}
+	if cfg.Endpoint == "" {
+		if cfg.Provider == "gcs" {
+			cfg.Endpoint = "https://storage.googleapis.com"
+		} else {
+			cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+		}
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store endpoint: %w", err)
+	}
+
+	return &Client{
+		cfg:      cfg,
+		endpoint: endpoint,
+		http:     &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Put stores data under the given key.
+func (c *Client) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	headers := map[string]string{"content-type": contentType}
+	return c.do(ctx, http.MethodPut, "/"+key, nil, headers, data)
+}
+
+// PutLifecycle configures the bucket to delete objects under prefix once they
+// are older than the given number of days. It replaces existing lifecycle
+// rules of the bucket.
+func (c *Client) PutLifecycle(ctx context.Context, prefix string, expirationDays int) error {
+	var body string
+	if c.cfg.Provider == "gcs" {
+		body = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><LifecycleConfiguration><Rule><Action><Delete/></Action><Condition><Age>%d</Age><MatchesPrefix>%s</MatchesPrefix></Condition></Rule></LifecycleConfiguration>`,
+			expirationDays, xmlEscape(prefix))
+	} else {
+		body = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Rule><ID>thingsix-expiration</ID><Filter><Prefix>%s</Prefix></Filter><Status>Enabled</Status><Expiration><Days>%d</Days></Expiration></Rule></LifecycleConfiguration>`,
+			xmlEscape(prefix), expirationDays)
+	}
+
+	sum := md5.Sum([]byte(body))
+	headers := map[string]string{
+		"content-type": "application/xml",
+		"content-md5":  base64.StdEncoding.EncodeToString(sum[:]),
+	}
+	return c.do(ctx, http.MethodPut, "", url.Values{"lifecycle": {""}}, headers, []byte(body))
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '&':
+			buf.WriteString("&amp;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// do executes a signed request for the given path in the bucket.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, headers map[string]string, body []byte) error {
+	u := *c.endpoint
+	u.Path = u.Path + "/" + c.cfg.Bucket + path
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("object store returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sign adds an AWS signature version 4 authorization header to req.
+func (c *Client) sign(req *http.Request, body []byte, now time.Time) {
+	var (
+		amzDate     = now.Format("20060102T150405Z")
+		date        = now.Format("20060102")
+		payloadHash = sha256Hex(body)
+		scope       = fmt.Sprintf("%s/%s/s3/aws4_request", date, c.cfg.Region)
+	)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes s as required by signature version 4, slashes are only
+// encoded when encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
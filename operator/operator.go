@@ -0,0 +1,324 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package operator implements a Kubernetes controller that reconciles
+// Gateway and Route custom resources into a forwarder through its admin API.
+// Gateways are added to the forwarders gateway store with the private key
+// from the referenced secret. Routes are set as managed default routers on
+// the forwarder, managed routes without a custom resource are removed.
+//
+// Gateways are never removed from the gateway store when their resource is
+// deleted, deleting a gateway key is not reversible and left to operators.
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/kube"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Group and Version of the ThingsIX custom resources
+	Group   = "thingsix.io"
+	Version = "v1alpha1"
+)
+
+// Resource states reported in the status of custom resources.
+const (
+	StateReady    = "Ready"
+	StateConflict = "Conflict"
+	StateError    = "Error"
+)
+
+// Config configures the controller.
+type Config struct {
+	// ForwarderAPI is the base URL of the forwarders admin API
+	ForwarderAPI string
+	// KubeAPI is the URL of an unauthenticated API server proxy, if empty the
+	// in-cluster service account is used
+	KubeAPI string
+	// Namespace to watch, defaults to the namespace the controller runs in
+	Namespace string
+	// Interval between reconciliations
+	Interval time.Duration
+}
+
+// GatewayResource is the Gateway custom resource.
+type GatewayResource struct {
+	Metadata kube.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		LocalID      string `json:"localId"`
+		KeySecretRef struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		} `json:"keySecretRef"`
+	} `json:"spec"`
+}
+
+// RouteResource is the Route custom resource.
+type RouteResource struct {
+	Metadata kube.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Endpoint string   `json:"endpoint"`
+		Regions  []string `json:"regions,omitempty"`
+	} `json:"spec"`
+}
+
+// Status is reported on reconciled resources.
+type Status struct {
+	State              string `json:"state"`
+	Message            string `json:"message,omitempty"`
+	NetworkID          string `json:"networkId,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration"`
+	LastReconciled     string `json:"lastReconciled"`
+}
+
+// Controller reconciles custom resources into the forwarder.
+type Controller struct {
+	kube      *kube.Client
+	namespace string
+	api       string
+	interval  time.Duration
+	client    *http.Client
+}
+
+// New returns a controller configured from cfg.
+func New(cfg Config) (*Controller, error) {
+	c := &Controller{
+		namespace: cfg.Namespace,
+		api:       strings.TrimSuffix(cfg.ForwarderAPI, "/"),
+		interval:  cfg.Interval,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.api == "" {
+		return nil, fmt.Errorf("missing forwarder API")
+	}
+	if c.interval <= 0 {
+		c.interval = 30 * time.Second
+	}
+
+	if cfg.KubeAPI != "" {
+		c.kube = kube.NewProxyClient(cfg.KubeAPI)
+	} else {
+		client, namespace, err := kube.NewInClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		c.kube = client
+		if c.namespace == "" {
+			c.namespace = namespace
+		}
+	}
+	if c.namespace == "" {
+		c.namespace = "default"
+	}
+	return c, nil
+}
+
+// Run reconciles periodically until ctx expires.
+func (c *Controller) Run(ctx context.Context) {
+	logrus.WithFields(logrus.Fields{
+		"namespace": c.namespace,
+		"forwarder": c.api,
+		"interval":  c.interval,
+	}).Info("start ThingsIX operator")
+
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			logrus.WithError(err).Warn("reconciliation failed")
+		}
+		select {
+		case <-time.After(c.interval):
+		case <-ctx.Done():
+			logrus.Info("ThingsIX operator stopped")
+			return
+		}
+	}
+}
+
+// Reconcile brings the forwarder in line with the custom resources once.
+func (c *Controller) Reconcile(ctx context.Context) error {
+	var gateways []GatewayResource
+	if err := c.kube.List(ctx, c.resourcePath("gateways"), &gateways); err != nil {
+		return fmt.Errorf("unable to list gateways: %w", err)
+	}
+	for i := range gateways {
+		c.reportStatus(ctx, "gateways", &gateways[i].Metadata, c.reconcileGateway(ctx, &gateways[i]))
+	}
+
+	var routes []RouteResource
+	if err := c.kube.List(ctx, c.resourcePath("routes"), &routes); err != nil {
+		return fmt.Errorf("unable to list routes: %w", err)
+	}
+	wanted := make(map[string]bool, len(routes))
+	for i := range routes {
+		wanted[routes[i].Metadata.Name] = true
+		c.reportStatus(ctx, "routes", &routes[i].Metadata, c.reconcileRoute(ctx, &routes[i]))
+	}
+
+	return c.pruneRoutes(ctx, wanted)
+}
+
+// errConflict indicates the forwarder state conflicts with the resource.
+var errConflict = errors.New("conflict")
+
+func (c *Controller) reconcileGateway(ctx context.Context, gw *GatewayResource) *Status {
+	if gw.Spec.LocalID == "" || gw.Spec.KeySecretRef.Name == "" || gw.Spec.KeySecretRef.Key == "" {
+		return &Status{State: StateError, Message: "localId and keySecretRef are required"}
+	}
+
+	key, err := c.kube.SecretValue(ctx, c.namespace, gw.Spec.KeySecretRef.Name, gw.Spec.KeySecretRef.Key)
+	if err != nil {
+		return &Status{State: StateError, Message: err.Error()}
+	}
+
+	var reply struct {
+		NetworkID string `json:"networkId"`
+	}
+	status, err := c.call(ctx, http.MethodPut, "/v1/gateways/"+strings.ToLower(gw.Spec.LocalID),
+		map[string]interface{}{"privateKey": strings.TrimSpace(string(key))}, &reply)
+	switch {
+	case errors.Is(err, errConflict):
+		return &Status{State: StateConflict, Message: err.Error()}
+	case err != nil:
+		return &Status{State: StateError, Message: err.Error()}
+	}
+
+	if status == http.StatusCreated {
+		logrus.WithFields(logrus.Fields{
+			"resource":      gw.Metadata.Name,
+			"gw_local_id":   gw.Spec.LocalID,
+			"gw_network_id": reply.NetworkID,
+		}).Info("gateway added to forwarder")
+	}
+	return &Status{State: StateReady, NetworkID: reply.NetworkID}
+}
+
+func (c *Controller) reconcileRoute(ctx context.Context, route *RouteResource) *Status {
+	if route.Spec.Endpoint == "" {
+		return &Status{State: StateError, Message: "endpoint is required"}
+	}
+
+	status, err := c.call(ctx, http.MethodPut, "/v1/routes/"+route.Metadata.Name, route.Spec, nil)
+	switch {
+	case errors.Is(err, errConflict):
+		return &Status{State: StateConflict, Message: err.Error()}
+	case err != nil:
+		return &Status{State: StateError, Message: err.Error()}
+	}
+
+	if status == http.StatusCreated {
+		logrus.WithFields(logrus.Fields{
+			"route":    route.Metadata.Name,
+			"endpoint": route.Spec.Endpoint,
+		}).Info("route set on forwarder")
+	}
+	return &Status{State: StateReady}
+}
+
+// pruneRoutes removes managed routes from the forwarder that have no
+// resource.
+func (c *Controller) pruneRoutes(ctx context.Context, wanted map[string]bool) error {
+	var routes []struct {
+		Name    string `json:"name"`
+		Managed bool   `json:"managed"`
+	}
+	if _, err := c.call(ctx, http.MethodGet, "/v1/routes", nil, &routes); err != nil {
+		return fmt.Errorf("unable to list forwarder routes: %w", err)
+	}
+	for _, route := range routes {
+		if !route.Managed || wanted[route.Name] {
+			continue
+		}
+		if _, err := c.call(ctx, http.MethodDelete, "/v1/routes/"+route.Name, nil, nil); err != nil {
+			return fmt.Errorf("unable to delete route %s: %w", route.Name, err)
+		}
+		logrus.WithField("route", route.Name).Info("route removed from forwarder")
+	}
+	return nil
+}
+
+func (c *Controller) reportStatus(ctx context.Context, plural string, meta *kube.ObjectMeta, status *Status) {
+	status.ObservedGeneration = meta.Generation
+	status.LastReconciled = time.Now().UTC().Format(time.RFC3339)
+
+	if status.State != StateReady {
+		logrus.WithFields(logrus.Fields{
+			"kind":  plural,
+			"name":  meta.Name,
+			"state": status.State,
+		}).Warn(status.Message)
+	}
+	if err := c.kube.PatchStatus(ctx, c.resourcePath(plural), meta.Name, status); err != nil {
+		logrus.WithError(err).WithField("name", meta.Name).Warn("unable to update resource status")
+	}
+}
+
+func (c *Controller) resourcePath(plural string) string {
+	return kube.ResourcePath(Group, Version, c.namespace, plural)
+}
+
+// call invokes the forwarder admin API and returns the HTTP status code. It
+// returns an error wrapping errConflict when the API replies with 409.
+func (c *Controller) call(ctx context.Context, method, path string, body, reply interface{}) (int, error) {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.api+path, payload)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode, fmt.Errorf("%w: %s", errConflict, bytes.TrimSpace(msg))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode, fmt.Errorf("unexpected reply from forwarder: %d - %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	if reply != nil {
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			return resp.StatusCode, fmt.Errorf("unable to decode forwarder reply: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,424 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package parquet implements a minimal writer for Apache Parquet files. It
+// supports flat schemas with required columns of primitive types, written with
+// plain encoding and optional gzip compression. This is enough to export
+// packet data for analytics tools that read Parquet without pulling in a full
+// Parquet implementation.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+)
+
+var magic = []byte("PAR1")
+
+// ErrClosed is returned when rows are written to a closed writer.
+var ErrClosed = errs.New(errs.ErrFailedPrecondition, "parquet writer closed")
+
+// Type is the type of a column.
+type Type int
+
+const (
+	Boolean Type = iota
+	Int32
+	Int64
+	Double
+	// String is stored as UTF-8 annotated byte array
+	String
+	Bytes
+	// Timestamp is stored as int64 milliseconds since the unix epoch
+	Timestamp
+)
+
+// parquet physical types
+const (
+	physicalBoolean   = 0
+	physicalInt32     = 1
+	physicalInt64     = 2
+	physicalDouble    = 5
+	physicalByteArray = 6
+)
+
+// parquet converted types
+const (
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+)
+
+// parquet encodings
+const (
+	encodingPlain = 0
+	encodingRLE   = 3
+)
+
+func (t Type) physical() int32 {
+	switch t {
+	case Boolean:
+		return physicalBoolean
+	case Int32:
+		return physicalInt32
+	case Int64, Timestamp:
+		return physicalInt64
+	case Double:
+		return physicalDouble
+	default:
+		return physicalByteArray
+	}
+}
+
+// Column describes a column in the schema.
+type Column struct {
+	Name string
+	Type Type
+}
+
+// Codec is the compression codec for column data.
+type Codec int32
+
+const (
+	Uncompressed Codec = 0
+	Gzip         Codec = 2
+)
+
+// ParseCodec returns the codec for the given name.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "gzip":
+		return Gzip, nil
+	case "none", "uncompressed":
+		return Uncompressed, nil
+	default:
+		return Uncompressed, fmt.Errorf("unsupported parquet compression %q", name)
+	}
+}
+
+type columnChunk struct {
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type rowGroup struct {
+	numRows   int64
+	totalSize int64
+	columns   []columnChunk
+}
+
+// Writer writes rows to a Parquet file. Rows are buffered in memory until
+// Flush is called, each flush writes a row group.
+type Writer struct {
+	w        io.Writer
+	schema   []Column
+	codec    Codec
+	metadata map[string]string
+
+	offset    int64
+	buffers   []bytes.Buffer
+	rows      int64
+	booleans  [][]bool
+	rowGroups []rowGroup
+	totalRows int64
+	closed    bool
+}
+
+// NewWriter returns a writer that writes a Parquet file with the given schema
+// to w.
+func NewWriter(w io.Writer, schema []Column, codec Codec) (*Writer, error) {
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("parquet schema has no columns")
+	}
+	pw := &Writer{
+		w:        w,
+		schema:   schema,
+		codec:    codec,
+		metadata: make(map[string]string),
+		buffers:  make([]bytes.Buffer, len(schema)),
+		booleans: make([][]bool, len(schema)),
+	}
+	if err := pw.write(magic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// SetMetadata sets a key/value pair that is stored in the file footer.
+func (w *Writer) SetMetadata(key, value string) {
+	w.metadata[key] = value
+}
+
+// Rows returns the number of rows buffered in the current row group.
+func (w *Writer) Rows() int64 {
+	return w.rows
+}
+
+// Write appends a row, values must be given in schema order and must match
+// the column type. Boolean columns take bool, Int32 int32, Int64 int64, Double
+// float64, String string, Bytes []byte and Timestamp time.Time.
+func (w *Writer) Write(values ...interface{}) error {
+	if w.closed {
+		return ErrClosed
+	}
+	if len(values) != len(w.schema) {
+		return fmt.Errorf("expected %d values, got %d", len(w.schema), len(values))
+	}
+
+	// validate all values before buffering to avoid partial rows
+	for i, col := range w.schema {
+		if !validValue(col.Type, values[i]) {
+			return fmt.Errorf("invalid value %T for column %s", values[i], col.Name)
+		}
+	}
+
+	var tmp [8]byte
+	for i, col := range w.schema {
+		buf := &w.buffers[i]
+		switch col.Type {
+		case Boolean:
+			w.booleans[i] = append(w.booleans[i], values[i].(bool))
+		case Int32:
+			binary.LittleEndian.PutUint32(tmp[:4], uint32(values[i].(int32)))
+			buf.Write(tmp[:4])
+		case Int64:
+			binary.LittleEndian.PutUint64(tmp[:], uint64(values[i].(int64)))
+			buf.Write(tmp[:])
+		case Timestamp:
+			binary.LittleEndian.PutUint64(tmp[:], uint64(values[i].(time.Time).UnixMilli()))
+			buf.Write(tmp[:])
+		case Double:
+			binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(values[i].(float64)))
+			buf.Write(tmp[:])
+		case String:
+			s := values[i].(string)
+			binary.LittleEndian.PutUint32(tmp[:4], uint32(len(s)))
+			buf.Write(tmp[:4])
+			buf.WriteString(s)
+		case Bytes:
+			b := values[i].([]byte)
+			binary.LittleEndian.PutUint32(tmp[:4], uint32(len(b)))
+			buf.Write(tmp[:4])
+			buf.Write(b)
+		}
+	}
+	w.rows++
+	return nil
+}
+
+func validValue(typ Type, v interface{}) bool {
+	switch v.(type) {
+	case bool:
+		return typ == Boolean
+	case int32:
+		return typ == Int32
+	case int64:
+		return typ == Int64
+	case float64:
+		return typ == Double
+	case string:
+		return typ == String
+	case []byte:
+		return typ == Bytes
+	case time.Time:
+		return typ == Timestamp
+	default:
+		return false
+	}
+}
+
+// Flush writes the buffered rows as a row group.
+func (w *Writer) Flush() error {
+	if w.closed {
+		return ErrClosed
+	}
+	if w.rows == 0 {
+		return nil
+	}
+
+	group := rowGroup{numRows: w.rows}
+	for i, col := range w.schema {
+		data := w.buffers[i].Bytes()
+		if col.Type == Boolean {
+			data = packBooleans(w.booleans[i])
+		}
+
+		chunk, err := w.writePage(data, w.rows)
+		if err != nil {
+			return err
+		}
+		group.columns = append(group.columns, chunk)
+		group.totalSize += chunk.compressedSize
+
+		w.buffers[i].Reset()
+		w.booleans[i] = w.booleans[i][:0]
+	}
+
+	w.rowGroups = append(w.rowGroups, group)
+	w.totalRows += w.rows
+	w.rows = 0
+	return nil
+}
+
+// packBooleans bit packs values, least significant bit first.
+func packBooleans(values []bool) []byte {
+	packed := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// writePage writes data as a single data page column chunk.
+func (w *Writer) writePage(data []byte, numValues int64) (columnChunk, error) {
+	compressed := data
+	if w.codec == Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return columnChunk{}, err
+		}
+		if err := gz.Close(); err != nil {
+			return columnChunk{}, err
+		}
+		compressed = buf.Bytes()
+	}
+
+	var header thriftWriter
+	header.structBegin()
+	header.fieldI32(1, 0) // DATA_PAGE
+	header.fieldI32(2, int32(len(data)))
+	header.fieldI32(3, int32(len(compressed)))
+	header.fieldStruct(5, func() {
+		header.fieldI32(1, int32(numValues))
+		header.fieldI32(2, encodingPlain)
+		header.fieldI32(3, encodingRLE)
+		header.fieldI32(4, encodingRLE)
+	})
+	header.structEnd()
+
+	chunk := columnChunk{
+		offset:           w.offset,
+		numValues:        numValues,
+		uncompressedSize: int64(len(header.bytes()) + len(data)),
+		compressedSize:   int64(len(header.bytes()) + len(compressed)),
+	}
+	if err := w.write(header.bytes()); err != nil {
+		return columnChunk{}, err
+	}
+	if err := w.write(compressed); err != nil {
+		return columnChunk{}, err
+	}
+	return chunk, nil
+}
+
+// Close flushes buffered rows and writes the file footer. It doesn't close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.closed = true
+
+	footer := w.fileMetadata()
+	if err := w.write(footer); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	if err := w.write(size[:]); err != nil {
+		return err
+	}
+	return w.write(magic)
+}
+
+func (w *Writer) fileMetadata() []byte {
+	var t thriftWriter
+	t.structBegin()
+	t.fieldI32(1, 1) // version
+	t.fieldList(2, thriftStruct, len(w.schema)+1, func(i int) {
+		if i == 0 {
+			t.fieldString(4, "schema")
+			t.fieldI32(5, int32(len(w.schema)))
+			return
+		}
+		col := w.schema[i-1]
+		t.fieldI32(1, col.Type.physical())
+		t.fieldI32(3, 0) // REQUIRED
+		t.fieldString(4, col.Name)
+		switch col.Type {
+		case String:
+			t.fieldI32(6, convertedUTF8)
+		case Timestamp:
+			t.fieldI32(6, convertedTimestampMillis)
+		}
+	})
+	t.fieldI64(3, w.totalRows)
+	t.fieldList(4, thriftStruct, len(w.rowGroups), func(i int) {
+		group := w.rowGroups[i]
+		t.fieldList(1, thriftStruct, len(group.columns), func(c int) {
+			chunk := group.columns[c]
+			col := w.schema[c]
+			t.fieldI64(2, chunk.offset)
+			t.fieldStruct(3, func() {
+				t.fieldI32(1, col.Type.physical())
+				t.fieldList(2, thriftI32, 1, func(int) { t.i32(encodingPlain) })
+				t.fieldList(3, thriftBinary, 1, func(int) { t.binary([]byte(col.Name)) })
+				t.fieldI32(4, int32(w.codec))
+				t.fieldI64(5, chunk.numValues)
+				t.fieldI64(6, chunk.uncompressedSize)
+				t.fieldI64(7, chunk.compressedSize)
+				t.fieldI64(9, chunk.offset)
+			})
+		})
+		t.fieldI64(2, group.totalSize)
+		t.fieldI64(3, group.numRows)
+	})
+	if len(w.metadata) > 0 {
+		keys := make([]string, 0, len(w.metadata))
+		for k := range w.metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		t.fieldList(5, thriftStruct, len(keys), func(i int) {
+			t.fieldString(1, keys[i])
+			t.fieldString(2, w.metadata[keys[i]])
+		})
+	}
+	t.fieldString(6, "thingsix packet-handling")
+	t.structEnd()
+	return t.bytes()
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
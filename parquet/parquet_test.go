@@ -0,0 +1,79 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	for _, codec := range []Codec{Uncompressed, Gzip} {
+		var (
+			buf    bytes.Buffer
+			schema = []Column{
+				{Name: "time", Type: Timestamp},
+				{Name: "gateway", Type: String},
+				{Name: "rssi", Type: Int32},
+				{Name: "frequency", Type: Int64},
+				{Name: "snr", Type: Double},
+				{Name: "crc_ok", Type: Boolean},
+				{Name: "payload", Type: Bytes},
+			}
+		)
+
+		w, err := NewWriter(&buf, schema, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetMetadata("schema_version", "1")
+
+		for i := 0; i < 10; i++ {
+			if err := w.Write(time.Now(), "0016c001ff10a235", int32(-100+i), int64(868100000), 7.5, i%2 == 0, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+			if i == 4 {
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := w.Write("wrong", "order", 1, 2, 3, 4, 5); err == nil {
+			t.Error("expected error for invalid row")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(time.Now(), "", int32(0), int64(0), 0.0, false, []byte{}); err != ErrClosed {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+
+		data := buf.Bytes()
+		if !bytes.HasPrefix(data, magic) || !bytes.HasSuffix(data, magic) {
+			t.Fatalf("missing magic bytes")
+		}
+		footerSize := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+		if footerSize <= 0 || footerSize > len(data)-12 {
+			t.Fatalf("invalid footer size %d", footerSize)
+		}
+		if len(w.rowGroups) != 2 || w.totalRows != 10 {
+			t.Errorf("expected 2 row groups with 10 rows, got %d with %d", len(w.rowGroups), w.totalRows)
+		}
+	}
+}
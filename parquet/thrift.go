@@ -0,0 +1,124 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package parquet
+
+import (
+	"encoding/binary"
+)
+
+// thrift compact protocol field types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structures with the thrift compact protocol that
+// parquet uses for page headers and file metadata.
+type thriftWriter struct {
+	buf []byte
+	// lastField holds the previous field id for each nested struct
+	lastField []int16
+}
+
+func (t *thriftWriter) bytes() []byte {
+	return t.buf
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	t.buf = append(t.buf, tmp[:n]...)
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) structBegin() {
+	t.lastField = append(t.lastField, 0)
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf = append(t.buf, 0) // stop field
+	t.lastField = t.lastField[:len(t.lastField)-1]
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &t.lastField[len(t.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) fieldString(id int16, v string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary([]byte(v))
+}
+
+func (t *thriftWriter) fieldStruct(id int16, write func()) {
+	t.fieldHeader(id, thriftStruct)
+	t.structBegin()
+	write()
+	t.structEnd()
+}
+
+// fieldList writes a list field with n elements of the given type, write is
+// called for each element.
+func (t *thriftWriter) fieldList(id int16, typ byte, n int, write func(i int)) {
+	t.fieldHeader(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|typ)
+	} else {
+		t.buf = append(t.buf, 0xf0|typ)
+		t.varint(uint64(n))
+	}
+	for i := 0; i < n; i++ {
+		if typ == thriftStruct {
+			t.structBegin()
+			write(i)
+			t.structEnd()
+		} else {
+			write(i)
+		}
+	}
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) binary(v []byte) {
+	t.varint(uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/objectstore"
+	"github.com/ThingsIXFoundation/packet-handling/parquet"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPendingArchives limits the number of archive files kept in memory when
+// uploads fail
+const maxPendingArchives = 48
+
+// archiveSchema is the schema of the uplink archive Parquet files
+var archiveSchema = []parquet.Column{
+	{Name: "received_at", Type: parquet.Timestamp},
+	{Name: "gw_network_id", Type: parquet.String},
+	{Name: "gw_owner", Type: parquet.String},
+	{Name: "uplink_id", Type: parquet.Int64},
+	{Name: "phy_payload", Type: parquet.Bytes},
+	{Name: "frequency", Type: parquet.Int64},
+	{Name: "modulation", Type: parquet.String},
+	{Name: "spreading_factor", Type: parquet.Int32},
+	{Name: "bandwidth", Type: parquet.Int32},
+	{Name: "code_rate", Type: parquet.String},
+	{Name: "rssi", Type: parquet.Int32},
+	{Name: "snr", Type: parquet.Double},
+	{Name: "channel", Type: parquet.Int32},
+	{Name: "rf_chain", Type: parquet.Int32},
+	{Name: "crc_status", Type: parquet.String},
+	{Name: "latitude", Type: parquet.Double},
+	{Name: "longitude", Type: parquet.Double},
+	{Name: "altitude", Type: parquet.Double},
+}
+
+type archivedUplink struct {
+	receivedAt time.Time
+	gatewayID  lorawan.EUI64
+	owner      common.Address
+	frame      *gw.UplinkFrame
+}
+
+type archiveFile struct {
+	key  string
+	data []byte
+}
+
+// Archiver stores verified uplinks with their gateway metadata in hourly
+// Parquet files in object storage. Uplinks are buffered in memory and written
+// when the hour ends or the maximum number of rows per file is reached.
+type Archiver struct {
+	client         *objectstore.Client
+	routerID       string
+	prefix         string
+	codec          parquet.Codec
+	maxRows        int
+	expirationDays int
+
+	mu      sync.Mutex
+	hour    time.Time
+	rows    []archivedUplink
+	pending []archiveFile
+}
+
+// NewArchiver returns an archiver configured from cfg.
+func NewArchiver(routerID string, cfg *ArchiveConfig) (*Archiver, error) {
+	client, err := objectstore.New(cfg.ObjectStore)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := parquet.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archiver{
+		client:         client,
+		routerID:       routerID,
+		prefix:         cfg.Prefix,
+		codec:          codec,
+		maxRows:        cfg.MaxRows,
+		expirationDays: cfg.ExpirationDays,
+		hour:           time.Now().UTC().Truncate(time.Hour),
+	}
+	if a.prefix != "" && !strings.HasSuffix(a.prefix, "/") {
+		a.prefix += "/"
+	}
+	if a.maxRows <= 0 {
+		a.maxRows = 500000
+	}
+	return a, nil
+}
+
+// Record adds the given uplink to the archive.
+func (a *Archiver) Record(gatewayID lorawan.EUI64, owner common.Address, frame *gw.UplinkFrame) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rows = append(a.rows, archivedUplink{
+		receivedAt: time.Now(),
+		gatewayID:  gatewayID,
+		owner:      owner,
+		frame:      frame,
+	})
+	if len(a.rows) >= a.maxRows {
+		a.seal()
+	}
+}
+
+// Run writes archive files at the end of each hour until the given context
+// expires. Buffered uplinks are written before it returns.
+func (a *Archiver) Run(ctx context.Context) {
+	if a.expirationDays > 0 {
+		if err := a.client.PutLifecycle(ctx, a.prefix, a.expirationDays); err != nil {
+			logrus.WithError(err).Error("unable to configure archive lifecycle")
+		} else {
+			logrus.WithField("expiration_days", a.expirationDays).Info("archive lifecycle configured")
+		}
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.mu.Lock()
+			if hour := time.Now().UTC().Truncate(time.Hour); !hour.Equal(a.hour) {
+				a.seal()
+				a.hour = hour
+			}
+			a.mu.Unlock()
+			a.upload(ctx)
+		case <-ctx.Done():
+			a.mu.Lock()
+			a.seal()
+			a.mu.Unlock()
+
+			uploadCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			a.upload(uploadCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+// seal encodes the buffered uplinks into a Parquet file that is queued for
+// upload. Caller must hold the lock.
+func (a *Archiver) seal() {
+	if len(a.rows) == 0 {
+		return
+	}
+
+	data, err := encodeArchive(a.rows, a.codec)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode uplink archive, drop uplinks")
+		a.rows = nil
+		return
+	}
+
+	key := fmt.Sprintf("%sdate=%s/hour=%s/uplinks-%s-%d.parquet", a.prefix,
+		a.hour.Format("2006-01-02"), a.hour.Format("15"), a.routerID, a.rows[0].receivedAt.UnixMilli())
+
+	if len(a.pending) >= maxPendingArchives {
+		logrus.WithField("key", a.pending[0].key).Warn("too many pending archive uploads, drop oldest")
+		a.pending = a.pending[1:]
+	}
+	a.pending = append(a.pending, archiveFile{key: key, data: data})
+	a.rows = nil
+}
+
+// upload stores pending archive files, files that fail are retried later.
+func (a *Archiver) upload(ctx context.Context) {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	var failed []archiveFile
+	for _, file := range pending {
+		log := logrus.WithFields(logrus.Fields{"key": file.key, "size": len(file.data)})
+		if err := a.client.Put(ctx, file.key, file.data, "application/vnd.apache.parquet"); err != nil {
+			log.WithError(err).Warn("unable to upload uplink archive, retry later")
+			archiveUploadsCounter.WithLabelValues("failed").Inc()
+			failed = append(failed, file)
+			continue
+		}
+		log.Info("uplink archive uploaded")
+		archiveUploadsCounter.WithLabelValues("success").Inc()
+	}
+
+	if len(failed) > 0 {
+		a.mu.Lock()
+		a.pending = append(failed, a.pending...)
+		if len(a.pending) > maxPendingArchives {
+			a.pending = a.pending[len(a.pending)-maxPendingArchives:]
+		}
+		a.mu.Unlock()
+	}
+}
+
+func encodeArchive(rows []archivedUplink, codec parquet.Codec) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := parquet.NewWriter(&buf, archiveSchema, codec)
+	if err != nil {
+		return nil, err
+	}
+	w.SetMetadata("schema_version", "1")
+
+	for _, row := range rows {
+		var (
+			rxInfo = row.frame.GetRxInfo()
+			txInfo = row.frame.GetTxInfo()
+			loc    = rxInfo.GetLocation()
+			mod    = "UNKNOWN"
+			sf     int32
+			bw     int32
+			cr     string
+		)
+		switch {
+		case txInfo.GetModulation().GetLora() != nil:
+			lora := txInfo.GetModulation().GetLora()
+			mod, sf, bw, cr = "LORA", int32(lora.GetSpreadingFactor()), int32(lora.GetBandwidth()), lora.GetCodeRate().String()
+		case txInfo.GetModulation().GetFsk() != nil:
+			mod = "FSK"
+		case txInfo.GetModulation().GetLrFhss() != nil:
+			mod = "LR_FHSS"
+		}
+
+		if err := w.Write(
+			row.receivedAt,
+			row.gatewayID.String(),
+			row.owner.Hex(),
+			int64(rxInfo.GetUplinkId()),
+			row.frame.GetPhyPayload(),
+			int64(txInfo.GetFrequency()),
+			mod,
+			sf,
+			bw,
+			cr,
+			rxInfo.GetRssi(),
+			float64(rxInfo.GetSnr()),
+			int32(rxInfo.GetChannel()),
+			int32(rxInfo.GetRfChain()),
+			rxInfo.GetCrcStatus().String(),
+			loc.GetLatitude(),
+			loc.GetLongitude(),
+			loc.GetAltitude(),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
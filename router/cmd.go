@@ -22,7 +22,10 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/ThingsIXFoundation/packet-handling/health"
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -56,6 +59,11 @@ func Run(cmd *cobra.Command, args []string) {
 		logrus.WithError(err).Fatal("unable to load config")
 	}
 
+	shutdownTracing, err := tracing.Setup(ctx, "thingsix-router", cfg.Tracing)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to setup tracing")
+	}
+
 	integration, err := buildIntegrations(cfg)
 	if err != nil {
 		logrus.WithError(err).Fatal("unable to instantiate integration")
@@ -84,16 +92,28 @@ func Run(cmd *cobra.Command, args []string) {
 	if cfg.PrometheusEnabled() {
 		wg.Add(1)
 		go func() {
-			publicPrometheusMetrics(ctx, cfg)
+			publicPrometheusMetrics(ctx, cfg, router.healthChecks)
 			wg.Done()
 		}()
 	}
 
+	// notify systemd when ready and feed its watchdog if configured
+	wg.Add(1)
+	go func() {
+		health.RunWatchdog(ctx, router.healthChecks)
+		wg.Done()
+	}()
+
 	// wait for shutdown signal
 	signal.Notify(sign, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	<-sign
 	logrus.Info("initiate shutdown...")
 	shutdown()
 	wg.Wait()
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		logrus.WithError(err).Warn("unable to flush traces")
+	}
+	cancel()
 	logrus.Info("bye")
 }
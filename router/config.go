@@ -22,6 +22,9 @@ import (
 	"os"
 	"time"
 
+	"github.com/ThingsIXFoundation/packet-handling/logging"
+	"github.com/ThingsIXFoundation/packet-handling/objectstore"
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
@@ -45,8 +48,19 @@ type RouterConfig struct {
 			Host string
 			Port uint16
 		}
+
+		// Optional TLS, if specified forwarders connect with TLS instead of
+		// plain text.
+		TLS *ForwarderTLSConfig `mapstructure:"tls"`
 	}
 
+	// Optional federation with peer routers, if specified data uplinks for
+	// NetIDs this router doesn't serve are relayed to the peer serving them.
+	Federation *FederationConfig `mapstructure:"federation"`
+
+	// Optional archive of verified uplinks in object storage.
+	Archive *ArchiveConfig `mapstructure:"archive"`
+
 	Integration struct {
 		Marshaler string `mapstructure:"marshaler"`
 
@@ -98,6 +112,54 @@ type RouterConfig struct {
 	} `mapstructure:"integration"`
 }
 
+type FederationConfig struct {
+	// Listen is the address the federation API listens on for peers
+	Listen string `mapstructure:"listen"`
+	// NetIDs this router serves, uplinks for these are never relayed
+	NetIDs []string `mapstructure:"net_ids"`
+	// Peers are the routers this router exchanges packets with
+	Peers []FederationPeerConfig `mapstructure:"peers"`
+}
+
+type FederationPeerConfig struct {
+	// Name identifies the peer in logs, metrics and accounting
+	Name string `mapstructure:"name"`
+	// Endpoint is the base URL of the peer federation API
+	Endpoint string `mapstructure:"endpoint"`
+	// Token is the shared secret that authenticates both directions
+	Token string `mapstructure:"token"`
+	// NetIDs served by the peer
+	NetIDs []string `mapstructure:"net_ids"`
+}
+
+type ForwarderTLSConfig struct {
+	// CertFile and KeyFile are the certificate and key of the router, the
+	// files are loaded again when they change
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCACert is a file with the CA certificates forwarder client
+	// certificates are verified against, if set forwarders must
+	// authenticate with a client certificate (mutual TLS)
+	ClientCACert string `mapstructure:"client_ca_cert"`
+	// SPIFFEIDs, if set, the forwarder client certificate must have one of
+	// these SPIFFE IDs as URI SAN, requires ClientCACert
+	SPIFFEIDs []string `mapstructure:"spiffe_ids"`
+}
+
+type ArchiveConfig struct {
+	// Prefix is prepended to the object keys of archive files
+	Prefix string `mapstructure:"prefix"`
+	// Compression of archive files, gzip (default) or none
+	Compression string `mapstructure:"compression"`
+	// MaxRows is the maximum number of uplinks per archive file
+	MaxRows int `mapstructure:"max_rows"`
+	// ExpirationDays configures the bucket to delete archive files after
+	// the given number of days, 0 leaves the bucket lifecycle untouched
+	ExpirationDays int `mapstructure:"expiration_days"`
+	// ObjectStore is the bucket archive files are stored in
+	ObjectStore objectstore.Config `mapstructure:"object_store"`
+}
+
 func (rc RouterConfig) ForwarderListenerAddress() string {
 	var (
 		host = "0.0.0.0"
@@ -128,6 +190,10 @@ type Config struct {
 			Path    string
 		}
 	}
+
+	// Optional tracing, if specified spans for uplinks are exported to an
+	// OpenTelemetry collector.
+	Tracing *tracing.Config `mapstructure:"tracing"`
 }
 
 func (cfg Config) PrometheusEnabled() bool {
@@ -179,8 +245,8 @@ func mustLoadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	logrus.SetLevel(cfg.Log.Level)
-	logrus.SetFormatter(&logrus.TextFormatter{
+	logging.SetDefaultLevel(cfg.Log.Level)
+	logging.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp:    true,
 		DisableTimestamp: !cfg.Log.Timestamp,
 	})
@@ -0,0 +1,121 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// downlinkAckTimeout is how long the pipeline waits for the ACK of a
+// downlink before it is considered lost, class B downlinks can be scheduled
+// up to two minutes ahead.
+const downlinkAckTimeout = 3 * time.Minute
+
+// statuses of relayed downlinks
+const (
+	downlinkRelayedForwarder  = "forwarder"
+	downlinkRelayedFederation = "federation"
+	downlinkGatewayOffline    = "gateway_offline"
+	downlinkInvalidGateway    = "invalid_gateway"
+)
+
+type downlinkKey struct {
+	gatewayNetworkID lorawan.EUI64
+	downlinkID       uint32
+}
+
+// downlinkPipeline follows downlinks from ChirpStack until the gateway
+// acknowledged them and reports each step through metrics. This shows where
+// downlinks get lost between ChirpStack, the router, forwarders and gateways.
+type downlinkPipeline struct {
+	mu sync.Mutex
+	// pending holds the time downlinks were relayed that are waiting for an
+	// ACK from the gateway
+	pending map[downlinkKey]time.Time
+}
+
+func newDownlinkPipeline() *downlinkPipeline {
+	return &downlinkPipeline{
+		pending: make(map[downlinkKey]time.Time),
+	}
+}
+
+// Received records a downlink received from ChirpStack.
+func (p *downlinkPipeline) Received(gatewayNetworkID lorawan.EUI64) {
+	chirpstackDownlinksReceivedCounter.WithLabelValues(gatewayNetworkID.String()).Inc()
+}
+
+// Relayed records how the downlink was relayed towards the gateway, if it was
+// relayed to a forwarder or federation peer it waits for an ACK.
+func (p *downlinkPipeline) Relayed(gatewayNetworkID lorawan.EUI64, downlinkID uint32, status string) {
+	chirpstackDownlinksRelayedCounter.WithLabelValues(gatewayNetworkID.String(), status).Inc()
+	if status != downlinkRelayedForwarder && status != downlinkRelayedFederation {
+		return
+	}
+
+	p.mu.Lock()
+	p.pending[downlinkKey{gatewayNetworkID, downlinkID}] = time.Now()
+	chirpstackDownlinksPendingGauge.Set(float64(len(p.pending)))
+	p.mu.Unlock()
+}
+
+// Acked records the ACK of a downlink, ACKs for downlinks that were not
+// received from ChirpStack are ignored.
+func (p *downlinkPipeline) Acked(gatewayNetworkID lorawan.EUI64, ack *gw.DownlinkTxAck) {
+	key := downlinkKey{gatewayNetworkID, ack.GetDownlinkId()}
+
+	p.mu.Lock()
+	relayed, ok := p.pending[key]
+	delete(p.pending, key)
+	chirpstackDownlinksPendingGauge.Set(float64(len(p.pending)))
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	status := gw.TxAckStatus_IGNORED
+	for i, item := range ack.GetItems() {
+		if i == 0 || item.GetStatus() != gw.TxAckStatus_IGNORED {
+			status = item.GetStatus()
+		}
+		if item.GetStatus() != gw.TxAckStatus_IGNORED {
+			break
+		}
+	}
+
+	chirpstackDownlinksAckedCounter.WithLabelValues(gatewayNetworkID.String(), status.String()).Inc()
+	chirpstackDownlinkAckDurationHistogram.Observe(time.Since(relayed).Seconds())
+}
+
+// cleanup records downlinks that didn't receive an ACK in time as lost.
+func (p *downlinkPipeline) cleanup() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, relayed := range p.pending {
+		if time.Since(relayed) > downlinkAckTimeout {
+			chirpstackDownlinksAckedCounter.WithLabelValues(key.gatewayNetworkID.String(), "TIMEOUT").Inc()
+			delete(p.pending, key)
+		}
+	}
+	chirpstackDownlinksPendingGauge.Set(float64(len(p.pending)))
+}
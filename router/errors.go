@@ -0,0 +1,31 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import "github.com/ThingsIXFoundation/packet-handling/errs"
+
+var (
+	// ErrInvalidForwarderTLS is returned when the TLS configuration of the
+	// forwarder listener is incomplete or can't be loaded.
+	ErrInvalidForwarderTLS = errs.New(errs.ErrInvalidArgument, "invalid forwarder TLS configuration")
+	// ErrInvalidFederationPeer is returned when a federation peer is
+	// configured without a name, endpoint, token or with an invalid NetID.
+	ErrInvalidFederationPeer = errs.New(errs.ErrInvalidArgument, "invalid federation peer")
+	// ErrUnknownJoinFilterGenerator is returned when no supported join filter
+	// generator is configured.
+	ErrUnknownJoinFilterGenerator = errs.New(errs.ErrInvalidArgument, "unknown JoinFilterGenerator")
+)
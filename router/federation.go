@@ -0,0 +1,501 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/integration"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// federatedGatewayTimeout is how long a gateway is remembered to be
+	// reachable through a peer after the last uplink relayed by that peer
+	federatedGatewayTimeout = 5 * time.Minute
+	// federationRequestTimeout is the timeout for calls to peer routers
+	federationRequestTimeout = 5 * time.Second
+	// maxFederationRequestSize limits the size of requests from peers
+	maxFederationRequestSize = 64 * 1024
+)
+
+// Federation lets a router exchange packets with peer routers. Data uplinks
+// for a NetID this router doesn't serve are relayed to the peer that serves it
+// instead of the integration layer. Downlinks and downlink ACKs for relayed
+// uplinks travel back the same way. All relayed traffic is accounted per peer.
+type Federation struct {
+	router *Router
+	listen string
+	netIDs []lorawan.NetID
+	peers  []*federationPeer
+	client *http.Client
+
+	mu sync.Mutex
+	// gateways holds the peer a gateway is reachable through for gateways
+	// that are not connected to this router but received relayed uplinks
+	gateways map[lorawan.EUI64]*federatedGateway
+	// downlinks holds the peer that sent a downlink for ACKs that must be
+	// returned to that peer
+	downlinks map[uint32]*federatedDownlink
+}
+
+type federationPeer struct {
+	name     string
+	endpoint string
+	token    string
+	netIDs   []lorawan.NetID
+
+	accountingMu sync.Mutex
+	accounting   FederationAccounting
+}
+
+type federatedGateway struct {
+	peer     *federationPeer
+	lastSeen time.Time
+}
+
+type federatedDownlink struct {
+	peer    *federationPeer
+	created time.Time
+}
+
+// FederationAccounting holds the number of frames and bytes exchanged with a
+// peer router.
+type FederationAccounting struct {
+	UplinksSent       uint64 `json:"uplinksSent"`
+	UplinksReceived   uint64 `json:"uplinksReceived"`
+	DownlinksSent     uint64 `json:"downlinksSent"`
+	DownlinksReceived uint64 `json:"downlinksReceived"`
+	AcksSent          uint64 `json:"acksSent"`
+	AcksReceived      uint64 `json:"acksReceived"`
+	BytesSent         uint64 `json:"bytesSent"`
+	BytesReceived     uint64 `json:"bytesReceived"`
+}
+
+// NewFederation creates the federation for r from the given configuration.
+func NewFederation(r *Router, cfg *FederationConfig) (*Federation, error) {
+	f := &Federation{
+		router:    r,
+		listen:    cfg.Listen,
+		client:    &http.Client{Timeout: federationRequestTimeout},
+		gateways:  make(map[lorawan.EUI64]*federatedGateway),
+		downlinks: make(map[uint32]*federatedDownlink),
+	}
+	if f.listen == "" {
+		f.listen = "0.0.0.0:3201"
+	}
+
+	netIDs, err := parseNetIDs(cfg.NetIDs)
+	if err != nil {
+		return nil, err
+	}
+	f.netIDs = netIDs
+
+	for _, p := range cfg.Peers {
+		if p.Name == "" || p.Endpoint == "" {
+			return nil, fmt.Errorf("%w: name and endpoint are required", ErrInvalidFederationPeer)
+		}
+		if p.Token == "" {
+			return nil, fmt.Errorf("%w: %s has no token", ErrInvalidFederationPeer, p.Name)
+		}
+		netIDs, err := parseNetIDs(p.NetIDs)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidFederationPeer, p.Name, err)
+		}
+		f.peers = append(f.peers, &federationPeer{
+			name:     p.Name,
+			endpoint: strings.TrimSuffix(p.Endpoint, "/"),
+			token:    p.Token,
+			netIDs:   netIDs,
+		})
+	}
+
+	return f, nil
+}
+
+func parseNetIDs(netIDs []string) ([]lorawan.NetID, error) {
+	parsed := make([]lorawan.NetID, 0, len(netIDs))
+	for _, s := range netIDs {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(s)); err != nil {
+			return nil, fmt.Errorf("invalid NetID %q: %w", s, err)
+		}
+		parsed = append(parsed, netID)
+	}
+	return parsed, nil
+}
+
+// Run serves the federation API until the given context expires.
+func (f *Federation) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/federation/uplink", f.peerHandler(f.receiveUplink))
+	mux.HandleFunc("/v1/federation/downlink", f.peerHandler(f.receiveDownlink))
+	mux.HandleFunc("/v1/federation/ack", f.peerHandler(f.receiveDownlinkTxAck))
+	mux.HandleFunc("/v1/federation/accounting", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(f.Accounting())
+	})
+
+	srv := http.Server{
+		Addr:    f.listen,
+		Handler: mux,
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.cleanup()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	logrus.WithField("addr", f.listen).Info("serve federation API")
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logrus.WithError(err).Error("federation API stopped unexpected")
+	}
+}
+
+// Accounting returns the traffic exchanged with each peer.
+func (f *Federation) Accounting() map[string]FederationAccounting {
+	accounting := make(map[string]FederationAccounting, len(f.peers))
+	for _, p := range f.peers {
+		p.accountingMu.Lock()
+		accounting[p.name] = p.accounting
+		p.accountingMu.Unlock()
+	}
+	return accounting
+}
+
+func (p *federationPeer) account(update func(a *FederationAccounting)) {
+	p.accountingMu.Lock()
+	update(&p.accounting)
+	p.accountingMu.Unlock()
+}
+
+// serves returns true if this router serves the given DevAddr.
+func (f *Federation) serves(addr lorawan.DevAddr) bool {
+	for _, netID := range f.netIDs {
+		if addr.IsNetID(netID) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerFor returns the peer that serves the given DevAddr, or nil if there is
+// none.
+func (f *Federation) peerFor(addr lorawan.DevAddr) *federationPeer {
+	for _, p := range f.peers {
+		for _, netID := range p.netIDs {
+			if addr.IsNetID(netID) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// RelayUplink relays the given uplink to the peer that serves the NetID of the
+// uplink DevAddr. It returns false if the uplink must be handled by this
+// router, either because it serves the NetID, the uplink is not a data uplink
+// or there is no peer that serves it.
+func (f *Federation) RelayUplink(frame *gw.UplinkFrame) bool {
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(frame.GetPhyPayload()); err != nil {
+		return false
+	}
+	if phy.MHDR.MType != lorawan.UnconfirmedDataUp && phy.MHDR.MType != lorawan.ConfirmedDataUp {
+		return false
+	}
+	mac, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok || f.serves(mac.FHDR.DevAddr) {
+		return false
+	}
+	peer := f.peerFor(mac.FHDR.DevAddr)
+	if peer == nil {
+		return false
+	}
+
+	go func() {
+		n, err := f.send(peer, "uplink", frame)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"peer":     peer.name,
+				"dev_addr": mac.FHDR.DevAddr,
+			}).Warn("unable to relay uplink to peer")
+			return
+		}
+		peer.account(func(a *FederationAccounting) {
+			a.UplinksSent++
+			a.BytesSent += uint64(n)
+		})
+		federationFramesCounter.WithLabelValues(peer.name, "sent", "uplink").Inc()
+		federationBytesCounter.WithLabelValues(peer.name, "sent").Add(float64(n))
+	}()
+
+	return true
+}
+
+// RelayDownlink sends the given downlink to the peer the addressed gateway is
+// reachable through. It returns false if the gateway is not reachable through
+// a peer.
+func (f *Federation) RelayDownlink(gatewayID lorawan.EUI64, frame *gw.DownlinkFrame) bool {
+	f.mu.Lock()
+	fgw, ok := f.gateways[gatewayID]
+	f.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	go func() {
+		n, err := f.send(fgw.peer, "downlink", frame)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"peer":          fgw.peer.name,
+				"gw_network_id": gatewayID,
+			}).Warn("unable to relay downlink to peer")
+			return
+		}
+		fgw.peer.account(func(a *FederationAccounting) {
+			a.DownlinksSent++
+			a.BytesSent += uint64(n)
+		})
+		federationFramesCounter.WithLabelValues(fgw.peer.name, "sent", "downlink").Inc()
+		federationBytesCounter.WithLabelValues(fgw.peer.name, "sent").Add(float64(n))
+	}()
+
+	return true
+}
+
+// RelayDownlinkTxAck returns the given ACK to the peer that sent the downlink.
+// It returns false if the downlink was not received from a peer.
+func (f *Federation) RelayDownlinkTxAck(ack *gw.DownlinkTxAck) bool {
+	f.mu.Lock()
+	dl, ok := f.downlinks[ack.GetDownlinkId()]
+	delete(f.downlinks, ack.GetDownlinkId())
+	f.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	go func() {
+		n, err := f.send(dl.peer, "ack", ack)
+		if err != nil {
+			logrus.WithError(err).WithField("peer", dl.peer.name).Warn("unable to relay downlink ACK to peer")
+			return
+		}
+		dl.peer.account(func(a *FederationAccounting) {
+			a.AcksSent++
+			a.BytesSent += uint64(n)
+		})
+		federationFramesCounter.WithLabelValues(dl.peer.name, "sent", "ack").Inc()
+		federationBytesCounter.WithLabelValues(dl.peer.name, "sent").Add(float64(n))
+	}()
+
+	return true
+}
+
+// send posts msg to the federation API of the given peer and returns the
+// number of bytes sent.
+func (f *Federation) send(peer *federationPeer, kind string, msg proto.Message) (int, error) {
+	body, err := protojson.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/federation/%s", peer.endpoint, kind), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+peer.token)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusAccepted {
+		return 0, fmt.Errorf("peer returned unexpected status %s", resp.Status)
+	}
+	return len(body), nil
+}
+
+// peerHandler authenticates the calling peer and passes the request body to
+// the given handler.
+func (f *Federation) peerHandler(handler func(peer *federationPeer, body []byte) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		peer := f.authenticate(r)
+		if peer == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxFederationRequestSize))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		peer.account(func(a *FederationAccounting) {
+			a.BytesReceived += uint64(len(body))
+		})
+		federationBytesCounter.WithLabelValues(peer.name, "received").Add(float64(len(body)))
+
+		status := handler(peer, body)
+		w.WriteHeader(status)
+	}
+}
+
+func (f *Federation) authenticate(r *http.Request) *federationPeer {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, p := range f.peers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1 {
+			return p
+		}
+	}
+	return nil
+}
+
+func (f *Federation) receiveUplink(peer *federationPeer, body []byte) int {
+	var frame gw.UplinkFrame
+	if err := protojson.Unmarshal(body, &frame); err != nil {
+		return http.StatusBadRequest
+	}
+	gatewayID, err := utils.Eui64FromString(frame.GetRxInfo().GetGatewayId())
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"peer":          peer.name,
+		"gw_network_id": gatewayID,
+		"uplink_id":     frame.GetRxInfo().GetUplinkId(),
+	})
+
+	if err := f.router.integration.PublishEvent(gatewayID, integration.EventUp, frame.GetRxInfo().GetUplinkId(), &frame); err != nil {
+		log.WithError(err).Error("forward relayed uplink to integration failed, drop uplink")
+		return http.StatusServiceUnavailable
+	}
+
+	f.mu.Lock()
+	f.gateways[gatewayID] = &federatedGateway{peer: peer, lastSeen: time.Now()}
+	f.mu.Unlock()
+
+	peer.account(func(a *FederationAccounting) { a.UplinksReceived++ })
+	federationFramesCounter.WithLabelValues(peer.name, "received", "uplink").Inc()
+	log.Info("forwarded relayed uplink to integration")
+
+	return http.StatusAccepted
+}
+
+func (f *Federation) receiveDownlink(peer *federationPeer, body []byte) int {
+	var frame gw.DownlinkFrame
+	if err := protojson.Unmarshal(body, &frame); err != nil {
+		return http.StatusBadRequest
+	}
+	gatewayID, err := utils.Eui64FromString(frame.GetGatewayId())
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	if !f.router.gatewayConnected(gatewayID) {
+		return http.StatusNotFound
+	}
+
+	f.mu.Lock()
+	f.downlinks[frame.GetDownlinkId()] = &federatedDownlink{peer: peer, created: time.Now()}
+	f.mu.Unlock()
+
+	peer.account(func(a *FederationAccounting) { a.DownlinksReceived++ })
+	federationFramesCounter.WithLabelValues(peer.name, "received", "downlink").Inc()
+
+	f.router.sendDownlinkFrame(frame.GetGatewayId(), downlinkFrameEvent(&frame))
+
+	return http.StatusAccepted
+}
+
+func (f *Federation) receiveDownlinkTxAck(peer *federationPeer, body []byte) int {
+	var ack gw.DownlinkTxAck
+	if err := protojson.Unmarshal(body, &ack); err != nil {
+		return http.StatusBadRequest
+	}
+	gatewayID, err := utils.Eui64FromString(ack.GetGatewayId())
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	f.router.downlinks.Acked(gatewayID, &ack)
+
+	if err := f.router.integration.PublishEvent(gatewayID, integration.EventAck, ack.GetDownlinkId(), &ack); err != nil {
+		logrus.WithError(err).WithField("peer", peer.name).Error("unable to send relayed downlink ACK to integration")
+		return http.StatusServiceUnavailable
+	}
+
+	peer.account(func(a *FederationAccounting) { a.AcksReceived++ })
+	federationFramesCounter.WithLabelValues(peer.name, "received", "ack").Inc()
+
+	return http.StatusAccepted
+}
+
+// cleanup forgets gateways that are no longer reachable through peers and
+// downlinks that never got an ACK.
+func (f *Federation) cleanup() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, fgw := range f.gateways {
+		if time.Since(fgw.lastSeen) > federatedGatewayTimeout {
+			delete(f.gateways, id)
+		}
+	}
+	for id, dl := range f.downlinks {
+		if time.Since(dl.created) > time.Minute {
+			delete(f.downlinks, id)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/health"
+)
+
+// routerHealth tracks the state of the router components that is reported
+// on the health endpoints.
+type routerHealth struct {
+	started  time.Time
+	routerID string
+	// listening is 1 while the forwarder listener accepts connections
+	listening int32
+	// forwarders is the number of connected forwarders
+	forwarders int32
+	// lastJoinFilterUpdate is the unix nano timestamp of the last successful
+	// join filter update, 0 if it never succeeded
+	lastJoinFilterUpdate int64
+}
+
+func (h *routerHealth) joinFilterUpdated() {
+	atomic.StoreInt64(&h.lastJoinFilterUpdate, time.Now().UnixNano())
+}
+
+// healthChecks returns the state of the router components. The forwarder
+// listener is critical, the router can't recover when it stopped accepting
+// forwarders. The join filter is considered stale when it wasn't updated
+// within 3 renew intervals.
+func (r *Router) healthChecks() []health.Check {
+	var checks []health.Check
+
+	if atomic.LoadInt32(&r.health.listening) == 1 {
+		checks = append(checks, health.Critical(health.Pass("listener", "accepting forwarders on %s", r.config.ForwarderListenerAddress())))
+	} else {
+		checks = append(checks, health.Critical(health.Fail("listener", "not accepting forwarders")))
+	}
+
+	r.gatewaysMu.RLock()
+	gateways := len(r.gateways)
+	r.gatewaysMu.RUnlock()
+	checks = append(checks,
+		health.Pass("forwarders", "%d forwarders connected", atomic.LoadInt32(&r.health.forwarders)),
+		health.Pass("gateways", "%d gateways online", gateways),
+		health.Pass("keystore", "router identity %s loaded", r.health.routerID))
+
+	var (
+		maxAge  = 3 * r.config.JoinFilterGenerator.RenewInterval
+		updated = atomic.LoadInt64(&r.health.lastJoinFilterUpdate)
+	)
+	switch {
+	case updated == 0 && time.Since(r.health.started) <= maxAge:
+		checks = append(checks, health.Fail("join_filter", "join filter not yet generated"))
+	case updated == 0:
+		checks = append(checks, health.Fail("join_filter", "join filter never generated"))
+	case time.Since(time.Unix(0, updated)) > maxAge:
+		checks = append(checks, health.Fail("join_filter", "join filter last updated %s ago, max %s",
+			time.Since(time.Unix(0, updated)).Round(time.Second), maxAge))
+	default:
+		checks = append(checks, health.Pass("join_filter", "join filter updated %s ago",
+			time.Since(time.Unix(0, updated)).Round(time.Second)))
+	}
+
+	return checks
+}
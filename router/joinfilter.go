@@ -43,7 +43,7 @@ func NewJoinFilterGenerator(config RouterConfig) (JoinFilterGenerator, error) {
 	if config.JoinFilterGenerator.ChirpStack.Target != "" {
 		return newChirpstackGenerator(config)
 	}
-	return nil, fmt.Errorf("unknown JoinFilterGenerator")
+	return nil, ErrUnknownJoinFilterGenerator
 }
 
 type chirpstackGenerator struct {
@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"sync"
 
+	"github.com/ThingsIXFoundation/packet-handling/health"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -49,13 +50,66 @@ var (
 		Name:      "uplinks",
 		Help:      "processed uplinks count",
 	}, []string{"gw_network_id", "status"})
+
+	archiveUploadsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "archive",
+		Name:      "uploads",
+		Help:      "uplink archive file uploads",
+	}, []string{"status"})
+
+	chirpstackDownlinksReceivedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chirpstack",
+		Name:      "downlinks_received",
+		Help:      "downlinks received from ChirpStack",
+	}, []string{"gw_network_id"})
+
+	chirpstackDownlinksRelayedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chirpstack",
+		Name:      "downlinks_relayed",
+		Help:      "downlinks received from ChirpStack by how they were relayed towards the gateway",
+	}, []string{"gw_network_id", "status"})
+
+	chirpstackDownlinksAckedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chirpstack",
+		Name:      "downlinks_acked",
+		Help:      "relayed downlinks received from ChirpStack by gateway ACK status, TIMEOUT if no ACK was received",
+	}, []string{"gw_network_id", "status"})
+
+	chirpstackDownlinksPendingGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chirpstack",
+		Name:      "downlinks_pending",
+		Help:      "relayed downlinks received from ChirpStack that wait for a gateway ACK",
+	})
+
+	chirpstackDownlinkAckDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "chirpstack",
+		Name:      "downlink_ack_seconds",
+		Help:      "time between relaying a downlink received from ChirpStack and its gateway ACK",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 120},
+	})
+
+	federationFramesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "federation",
+		Name:      "frames",
+		Help:      "frames exchanged with federation peers",
+	}, []string{"peer", "direction", "type"})
+
+	federationBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "federation",
+		Name:      "bytes",
+		Help:      "bytes exchanged with federation peers",
+	}, []string{"peer", "direction"})
 )
 
 func init() {
-	prometheus.MustRegister(connectedForwardersGauge, downlinksCounter, uplinksCounter)
+	prometheus.MustRegister(connectedForwardersGauge, downlinksCounter, uplinksCounter, federationFramesCounter, federationBytesCounter, archiveUploadsCounter,
+		chirpstackDownlinksReceivedCounter, chirpstackDownlinksRelayedCounter, chirpstackDownlinksAckedCounter,
+		chirpstackDownlinksPendingGauge, chirpstackDownlinkAckDurationHistogram)
 }
 
-func publicPrometheusMetrics(ctx context.Context, cfg *Config) {
+// publicPrometheusMetrics serves the Prometheus metrics endpoint and the
+// health endpoints of the given checker until the given ctx expires.
+func publicPrometheusMetrics(ctx context.Context, cfg *Config, checker health.Checker) {
 	var (
 		addr = cfg.MetricsPrometheusAddress()
 		path = cfg.MetricsPrometheusPath()
@@ -79,6 +133,8 @@ func publicPrometheusMetrics(ctx context.Context, cfg *Config) {
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/healthz", health.LivenessHandler(checker))
+	mux.HandleFunc("/readyz", health.ReadinessHandler(checker))
 
 	httpServerDone.Add(1)
 	go func() {
@@ -22,11 +22,14 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ThingsIXFoundation/packet-handling/external/chirpstack/gateway-bridge/integration"
 	"github.com/ThingsIXFoundation/packet-handling/gateway"
+	"github.com/ThingsIXFoundation/packet-handling/signing"
 	"github.com/ThingsIXFoundation/packet-handling/utils"
 	"github.com/ThingsIXFoundation/router-api/go/router"
 	"github.com/brocaar/lorawan"
@@ -34,11 +37,13 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
@@ -65,6 +70,18 @@ type Router struct {
 	// joinFilterGenerator generates the join filter that is required by gateways
 	// to be able to route joins (that don't have NetIds) to the right router
 	joinFilterGenerator JoinFilterGenerator
+
+	// federation exchanges packets with peer routers, nil if disabled
+	federation *Federation
+
+	// archiver stores verified uplinks in object storage, nil if disabled
+	archiver *Archiver
+
+	// downlinks follows downlinks from the integration until they are ACKed
+	downlinks *downlinkPipeline
+
+	// health tracks the state reported on the health endpoints
+	health routerHealth
 }
 
 var _ router.RouterV1Server = (*Router)(nil)
@@ -90,6 +107,20 @@ func NewRouter(cfg *Config, in integration.Integration) (*Router, error) {
 		gateways:            make(map[lorawan.EUI64]*forwarderManagedGateway),
 		config:              cfg.Router,
 		joinFilterGenerator: jfg,
+		downlinks:           newDownlinkPipeline(),
+		health:              routerHealth{started: time.Now(), routerID: identity.ID},
+	}
+
+	if cfg.Router.Federation != nil {
+		if r.federation, err = NewFederation(r, cfg.Router.Federation); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Router.Archive != nil {
+		if r.archiver, err = NewArchiver(identity.ID, cfg.Router.Archive); err != nil {
+			return nil, err
+		}
 	}
 
 	// callbacks called by the integration layer
@@ -127,6 +158,8 @@ func (r *Router) Run(ctx context.Context) error {
 		return fmt.Errorf("unable to bind to endpoint: %w", err)
 	}
 	defer lis.Close()
+	atomic.StoreInt32(&r.health.listening, 1)
+	defer atomic.StoreInt32(&r.health.listening, 0)
 
 	var (
 		kaep = keepalive.EnforcementPolicy{
@@ -141,10 +174,18 @@ func (r *Router) Run(ctx context.Context) error {
 			grpc.KeepaliveEnforcementPolicy(kaep),
 			grpc.KeepaliveParams(kasp),
 		}
-		grpcSrv        = grpc.NewServer(opts...)
 		grpcSrvStopped = make(chan struct{})
 	)
 
+	if r.config.Forwarder.TLS != nil {
+		creds, err := forwarderCredentials(r.config.Forwarder.TLS)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcSrv := grpc.NewServer(opts...)
+
 	router.RegisterRouterV1Server(grpcSrv, r)
 	grpc_health_v1.RegisterHealthServer(grpcSrv, health.NewServer())
 
@@ -161,6 +202,8 @@ func (r *Router) Run(ctx context.Context) error {
 		err := r.joinFilterGenerator.UpdateFilter(ctx)
 		if err != nil {
 			logrus.WithError(err).Error("error while updating JoinFilter")
+		} else {
+			r.health.joinFilterUpdated()
 		}
 
 		renewTicker := time.NewTicker(r.config.JoinFilterGenerator.RenewInterval)
@@ -171,6 +214,8 @@ func (r *Router) Run(ctx context.Context) error {
 				err := r.joinFilterGenerator.UpdateFilter(ctx)
 				if err != nil {
 					logrus.WithError(err).Error("error while updating JoinFilter")
+				} else {
+					r.health.joinFilterUpdated()
 				}
 				// No defer here because the function only returns once
 				cancel()
@@ -181,6 +226,14 @@ func (r *Router) Run(ctx context.Context) error {
 		}
 	}()
 
+	if r.federation != nil {
+		go r.federation.Run(ctx)
+	}
+
+	if r.archiver != nil {
+		go r.archiver.Run(ctx)
+	}
+
 	// Clean up timed-out gateways every minute
 	go func() {
 		cleanupTicker := time.NewTicker(time.Minute)
@@ -188,6 +241,7 @@ func (r *Router) Run(ctx context.Context) error {
 			select {
 			case <-cleanupTicker.C:
 				r.cleanupTimeOutGateways()
+				r.downlinks.cleanup()
 			case <-ctx.Done():
 				logrus.Info("stopping timed-out gateways clean-up loop")
 				return
@@ -235,8 +289,16 @@ func (r *Router) Events(forwarder router.RouterV1_EventsServer) error {
 	}
 	fwdlog.Info("forwarder connected")
 
+	if err := r.selectSigningScheme(fwdlog, forwarder); err != nil {
+		return err
+	}
+
 	connectedForwardersGauge.Add(1)
-	defer func() { connectedForwardersGauge.Add(-1) }()
+	atomic.AddInt32(&r.health.forwarders, 1)
+	defer func() {
+		connectedForwardersGauge.Add(-1)
+		atomic.AddInt32(&r.health.forwarders, -1)
+	}()
 
 	// turn forwarder into a readable event channel on which events from the
 	// forwarder can be read. It is closed when the connection closes. It is
@@ -278,7 +340,11 @@ func (r *Router) Events(forwarder router.RouterV1_EventsServer) error {
 			})
 
 			if uplink, ok := event.(*router.GatewayToRouterEvent_UplinkFrameEvent); ok {
-				r.handleUplink(log, gatewayNetworkID, uplink)
+				if err := verifyReceipt(pubKey, uplink.UplinkFrameEvent); err != nil {
+					log.WithError(err).Warn("drop uplink with invalid airtime receipt")
+					continue
+				}
+				r.handleUplink(log, gatewayNetworkID, gatewayOwner, uplink)
 				r.handleStatus(log, forwarderID, gatewayNetworkID, gatewayOwner, true, integrationEvents)
 			} else if downlinkAck, ok := event.(*router.GatewayToRouterEvent_DownlinkTXAckEvent); ok {
 				r.handleDownlinkTxAck(log, gatewayNetworkID, downlinkAck)
@@ -304,6 +370,42 @@ func (r *Router) Events(forwarder router.RouterV1_EventsServer) error {
 	}
 }
 
+// selectSigningScheme selects the first scheme the forwarder offers that is
+// supported and returns it in the stream header. Forwarders that don't offer
+// schemes sign airtime receipts with secp256k1.
+func (r *Router) selectSigningScheme(log *logrus.Entry, forwarder router.RouterV1_EventsServer) error {
+	md, _ := metadata.FromIncomingContext(forwarder.Context())
+	var offered []string
+	for _, entry := range md.Get(signing.OfferHeader) {
+		for _, scheme := range strings.Split(entry, ",") {
+			if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+				offered = append(offered, scheme)
+			}
+		}
+	}
+	if len(offered) == 0 {
+		return nil
+	}
+	scheme, err := signing.Negotiate(offered, signing.Schemes())
+	if err != nil {
+		log.WithError(err).Warn("no common signature scheme with forwarder")
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	log.WithField("scheme", scheme).Debug("selected signature scheme")
+	return forwarder.SendHeader(metadata.Pairs(signing.SelectHeader, scheme))
+}
+
+// verifyReceipt verifies the airtime receipt signature of the uplink, uplinks
+// from forwarders that don't sign receipts are accepted.
+func verifyReceipt(gatewayPublicKey []byte, event *router.UplinkFrameEvent) error {
+	var (
+		frame   = event.GetUplinkFrame()
+		receipt = event.GetAirtimeReceipt()
+	)
+	_, err := signing.VerifyReceipt(gatewayPublicKey, frame.GetRxInfo().GetMetadata(), frame.GetPhyPayload(), receipt.GetOwner(), receipt.GetAirtime())
+	return err
+}
+
 // forwarderEventerRWChan turns the given events readable into a readable go
 // channel with a reader and writer.
 func (r *Router) forwarderEventStream(id uuid.UUID, events router.RouterV1_EventsServer) <-chan *router.GatewayToRouterEvent {
@@ -341,7 +443,7 @@ func (r *Router) handleStatus(log *logrus.Entry, forwarderID uuid.UUID, gatewayI
 	}
 }
 
-func (r *Router) handleUplink(log *logrus.Entry, gatewayNetworkID lorawan.EUI64, event *router.GatewayToRouterEvent_UplinkFrameEvent) {
+func (r *Router) handleUplink(log *logrus.Entry, gatewayNetworkID lorawan.EUI64, gatewayOwner common.Address, event *router.GatewayToRouterEvent_UplinkFrameEvent) {
 	var (
 		frame                          = event.UplinkFrameEvent.GetUplinkFrame()
 		gatewayNetworkIDFromFrame, err = utils.Eui64FromString(frame.GetRxInfo().GetGatewayId())
@@ -360,6 +462,9 @@ func (r *Router) handleUplink(log *logrus.Entry, gatewayNetworkID lorawan.EUI64,
 		"payload_len": len(frame.GetPhyPayload()),
 	})
 
+	ctx, span := startUplinkSpan(frame, "router.uplink", trace.SpanKindConsumer)
+	defer span.End()
+
 	if err != nil {
 		log.WithError(err).Error("unable to decode gateway network id from uplink frame, drop uplink")
 		return
@@ -370,7 +475,19 @@ func (r *Router) handleUplink(log *logrus.Entry, gatewayNetworkID lorawan.EUI64,
 		return
 	}
 
-	if err := r.integration.PublishEvent(gatewayNetworkID, integration.EventUp, uplinkID, frame); err != nil {
+	if r.archiver != nil {
+		r.archiver.Record(gatewayNetworkID, gatewayOwner, frame)
+	}
+
+	if r.federation != nil && r.federation.RelayUplink(frame) {
+		log.Info("relayed uplink to federation peer")
+		return
+	}
+
+	_, publishSpan := startSpan(ctx, frame, "router.integration.publish", trace.SpanKindProducer)
+	err = r.integration.PublishEvent(gatewayNetworkID, integration.EventUp, uplinkID, frame)
+	endSpan(publishSpan, err)
+	if err != nil {
 		log.WithError(err).WithFields(logrus.Fields{
 			"event_type": integration.EventUp,
 		}).Error("forwarded uplink event to integrations failed, drop uplink")
@@ -404,6 +521,13 @@ func (r *Router) handleDownlinkTxAck(log *logrus.Entry, gatewayNetworkID lorawan
 		return
 	}
 
+	if r.federation != nil && r.federation.RelayDownlinkTxAck(ack) {
+		log.Info("relayed downlink ACK to federation peer")
+		return
+	}
+
+	r.downlinks.Acked(gatewayNetworkID, ack)
+
 	if err := integration.GetIntegration().PublishEvent(gatewayNetworkID, integration.EventAck, downlinkId, ack); err != nil {
 		log.WithError(err).WithField("event_type", integration.EventAck).Error("unable to send downlink ACK to integration")
 		downlinksCounter.WithLabelValues(gatewayNetworkID.String(), "failed").Inc()
@@ -515,7 +639,9 @@ func (r *Router) cleanupTimeOutGateways() {
 
 }
 
-func (r *Router) sendDownlinkFrame(addressedGatewayID string, event *router.RouterToGatewayEvent) {
+// sendDownlinkFrame sends the event to the forwarder the addressed gateway is
+// connected through, it returns false if the gateway is not connected.
+func (r *Router) sendDownlinkFrame(addressedGatewayID string, event *router.RouterToGatewayEvent) bool {
 	r.gatewaysMu.RLock()
 	defer r.gatewaysMu.RUnlock()
 
@@ -526,9 +652,11 @@ func (r *Router) sendDownlinkFrame(addressedGatewayID string, event *router.Rout
 			Error("invalid gateway id")
 	}
 
+	sent := false
 	for gatewayID, gateway := range r.gateways {
 		if gatewayID == gwId {
 			gateway.forwarder <- event
+			sent = true
 			logrus.WithFields(logrus.Fields{
 				"gw_network_id": gatewayID,
 				"event_type":    fmt.Sprintf("%T", event.GetEvent()),
@@ -536,15 +664,49 @@ func (r *Router) sendDownlinkFrame(addressedGatewayID string, event *router.Rout
 			}).Info("sent downlink to forwarder")
 		}
 	}
+	return sent
 }
 
-func (r *Router) DownlinkFrame(frame *gw.DownlinkFrame) {
-	event := &router.RouterToGatewayEvent{
+// gatewayConnected returns true if the gateway with the given id is connected
+// through a forwarder to this router.
+func (r *Router) gatewayConnected(gatewayID lorawan.EUI64) bool {
+	r.gatewaysMu.RLock()
+	defer r.gatewaysMu.RUnlock()
+
+	_, ok := r.gateways[gatewayID]
+	return ok
+}
+
+func downlinkFrameEvent(frame *gw.DownlinkFrame) *router.RouterToGatewayEvent {
+	return &router.RouterToGatewayEvent{
 		Event: &router.RouterToGatewayEvent_DownlinkFrameEvent{
 			DownlinkFrameEvent: &router.DownlinkFrameEvent{
 				DownlinkFrame: frame,
 			},
 		},
 	}
-	r.sendDownlinkFrame(frame.GatewayId, event)
+}
+
+func (r *Router) DownlinkFrame(frame *gw.DownlinkFrame) {
+	gatewayID, err := utils.Eui64FromString(frame.GetGatewayId())
+	r.downlinks.Received(gatewayID)
+	if err != nil {
+		r.downlinks.Relayed(gatewayID, frame.GetDownlinkId(), downlinkInvalidGateway)
+	}
+
+	if r.federation != nil && err == nil &&
+		!r.gatewayConnected(gatewayID) && r.federation.RelayDownlink(gatewayID, frame) {
+		r.downlinks.Relayed(gatewayID, frame.GetDownlinkId(), downlinkRelayedFederation)
+		return
+	}
+
+	sent := r.sendDownlinkFrame(frame.GatewayId, downlinkFrameEvent(frame))
+	if err != nil {
+		return
+	}
+	if sent {
+		r.downlinks.Relayed(gatewayID, frame.GetDownlinkId(), downlinkRelayedForwarder)
+	} else {
+		r.downlinks.Relayed(gatewayID, frame.GetDownlinkId(), downlinkGatewayOffline)
+	}
 }
@@ -0,0 +1,69 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"google.golang.org/grpc/credentials"
+)
+
+// forwarderCredentials returns the transport credentials for the forwarder
+// listener. With a client CA forwarders must present a certificate signed by
+// it, with SPIFFE IDs that certificate must also hold one of the IDs.
+func forwarderCredentials(cfg *ForwarderTLSConfig) (credentials.TransportCredentials, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("%w: cert_file and key_file are required", ErrInvalidForwarderTLS)
+	}
+	pair, err := utils.LoadTLSKeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to load listener certificate: %v", ErrInvalidForwarderTLS, err)
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return pair.Certificate()
+		},
+	}
+
+	if cfg.ClientCACert == "" {
+		if len(cfg.SPIFFEIDs) > 0 {
+			return nil, fmt.Errorf("%w: spiffe_ids requires client_ca_cert", ErrInvalidForwarderTLS)
+		}
+		return credentials.NewTLS(tlsCfg), nil
+	}
+
+	pool, err := utils.LoadCertPool(cfg.ClientCACert)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to load client CA certificate: %v", ErrInvalidForwarderTLS, err)
+	}
+	tlsCfg.ClientCAs = pool
+	tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(cfg.SPIFFEIDs) > 0 {
+		verify, err := utils.SPIFFEVerifier(cfg.SPIFFEIDs, pool, x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidForwarderTLS, err)
+		}
+		tlsCfg.VerifyConnection = verify
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package router
+
+import (
+	"context"
+
+	"github.com/ThingsIXFoundation/packet-handling/tracing"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// packetIDMetadataKey is the uplink metadata key in which the forwarder
+// stores the packet id.
+const packetIDMetadataKey = "thingsix_packet_id"
+
+var tracer = otel.Tracer("github.com/ThingsIXFoundation/packet-handling/router")
+
+// startUplinkSpan continues the trace the forwarder started for the uplink
+// and stores the context of the new span in the frame metadata, the next hop
+// continues the trace from there.
+func startUplinkSpan(frame *gw.UplinkFrame, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	ctx := tracing.ExtractMetadata(context.Background(), frame.GetRxInfo().GetMetadata())
+	return startSpan(ctx, frame, name, kind)
+}
+
+// startSpan starts a child span of ctx for the uplink frame and stores its
+// context in the frame metadata.
+func startSpan(ctx context.Context, frame *gw.UplinkFrame, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("thingsix.packet_id", frame.GetRxInfo().GetMetadata()[packetIDMetadataKey]),
+			attribute.String("thingsix.gw_network_id", frame.GetRxInfo().GetGatewayId()),
+		))
+	tracing.InjectMetadata(ctx, frame.GetRxInfo().GetMetadata())
+	return ctx, span
+}
+
+// endSpan ends the span and marks it as failed when err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,315 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package selfupdate replaces the running forwarder binary with a release
+// binary. Releases publish a checksums file with the SHA256 of each release
+// archive and an Ed25519 signature over that file. An archive is only
+// installed when the signature verifies against the release public key and
+// the archive matches its checksum.
+package selfupdate
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+)
+
+const (
+	// DefaultReleaseURL is where release artifacts are downloaded from,
+	// {version} is replaced with the release version.
+	DefaultReleaseURL = "https://github.com/ThingsIXFoundation/packet-handling/releases/download/{version}/"
+	// DefaultLatestURL returns the latest release in the GitHub API format.
+	DefaultLatestURL = "https://api.github.com/repos/ThingsIXFoundation/packet-handling/releases/latest"
+
+	// ChecksumsFile is the name of the release file with archive checksums
+	ChecksumsFile = "checksums.txt"
+	// SignatureFile is the name of the release file with the hex encoded
+	// Ed25519 signature over the checksums file
+	SignatureFile = ChecksumsFile + ".sig"
+
+	// maxDownloadSize limits the size of downloaded release files
+	maxDownloadSize = 256 << 20
+)
+
+var (
+	// ErrNoPublicKey is returned when no release public key is available to
+	// verify releases with.
+	ErrNoPublicKey = errs.New(errs.ErrFailedPrecondition, "no release public key")
+	// ErrInvalidSignature is returned when the checksums signature doesn't
+	// verify against the release public key.
+	ErrInvalidSignature = errs.New(errs.ErrInvalidArgument, "invalid release signature")
+	// ErrChecksumMismatch is returned when a downloaded archive doesn't match
+	// the signed checksum.
+	ErrChecksumMismatch = errs.New(errs.ErrInvalidArgument, "release archive checksum mismatch")
+)
+
+// Updater downloads and verifies release binaries.
+type Updater struct {
+	// ReleaseURL is the base URL of release artifacts, {version} is replaced
+	// with the release version
+	ReleaseURL string
+	// LatestURL returns the latest release as a JSON object with the release
+	// version in tag_name
+	LatestURL string
+	// PublicKey verifies the signature over the release checksums
+	PublicKey ed25519.PublicKey
+	// Client is used for all downloads
+	Client *http.Client
+}
+
+// New returns an updater that downloads releases from the ThingsIX GitHub
+// repository and verifies them with the given hex encoded public key.
+func New(publicKey string) (*Updater, error) {
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Updater{
+		ReleaseURL: DefaultReleaseURL,
+		LatestURL:  DefaultLatestURL,
+		PublicKey:  key,
+		Client:     &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// ParsePublicKey decodes a hex encoded Ed25519 public key.
+func ParsePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	if publicKey == "" {
+		return nil, ErrNoPublicKey
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(publicKey, "0x"))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid release public key")
+	}
+	return key, nil
+}
+
+// AssetName returns the name of the release archive for the platform the
+// given binary was built for.
+func AssetName(version string, build utils.BuildInfo) string {
+	return fmt.Sprintf("thingsix-forwarder-%s-%s%s-%s.tar.gz", build.OS, build.Arch, build.Mips, version)
+}
+
+// Latest returns the version of the latest release.
+func (u *Updater) Latest(ctx context.Context) (string, error) {
+	raw, err := u.get(ctx, u.LatestURL)
+	if err != nil {
+		return "", err
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.Unmarshal(raw, &release); err != nil {
+		return "", fmt.Errorf("unable to decode latest release: %w", err)
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("latest release has no version")
+	}
+	return release.TagName, nil
+}
+
+// Download returns the forwarder binary of the given release version for the
+// platform of build, after it verified the release signature and checksum.
+func (u *Updater) Download(ctx context.Context, version string, build utils.BuildInfo) ([]byte, error) {
+	base := strings.ReplaceAll(u.ReleaseURL, "{version}", version)
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	checksums, err := u.get(ctx, base+ChecksumsFile)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := u.get(ctx, base+SignatureFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(u.PublicKey, checksums, signature); err != nil {
+		return nil, err
+	}
+
+	asset := AssetName(version, build)
+	expected, err := lookupChecksum(checksums, asset)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := u.get(ctx, base+asset)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(archive); !bytes.Equal(sum[:], expected) {
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, asset)
+	}
+
+	binary := "forwarder"
+	if build.OS == "windows" {
+		binary += ".exe"
+	}
+	return extract(archive, binary)
+}
+
+func (u *Updater) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("ThingsIX forwarder :: %s", utils.Version()))
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", url, err)
+	}
+	if len(raw) > maxDownloadSize {
+		return nil, fmt.Errorf("unable to download %s: too large", url)
+	}
+	return raw, nil
+}
+
+// Verify checks the hex encoded signature over the checksums file.
+func Verify(publicKey ed25519.PublicKey, checksums, signature []byte) error {
+	sig, err := hex.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || !ed25519.Verify(publicKey, checksums, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Checksums returns a checksums file in the sha256sum format for the given
+// files and the hex encoded signature over it.
+func Checksums(key ed25519.PrivateKey, files []string) ([]byte, []byte, error) {
+	var checksums bytes.Buffer
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		sum := sha256.Sum256(raw)
+		fmt.Fprintf(&checksums, "%x  %s\n", sum, filepath.Base(file))
+	}
+	signature := hex.EncodeToString(ed25519.Sign(key, checksums.Bytes()))
+	return checksums.Bytes(), []byte(signature + "\n"), nil
+}
+
+// lookupChecksum returns the checksum of the given file from a checksums
+// file in the sha256sum format.
+func lookupChecksum(checksums []byte, file string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != file {
+			continue
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid checksum for %s", file)
+		}
+		return sum, nil
+	}
+	return nil, fmt.Errorf("release has no %s", file)
+}
+
+// extract returns the content of the named file from a gzipped tar archive.
+func extract(archive []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("invalid release archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("release archive has no %s", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid release archive: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == name {
+			return io.ReadAll(io.LimitReader(tr, maxDownloadSize))
+		}
+	}
+}
+
+// Replace installs binary over the executable at path. The new binary is
+// written next to it and renamed over it, the running process keeps using
+// the old binary until it is restarted.
+func Replace(executable string, binary []byte) error {
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(executable), "."+filepath.Base(executable)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(binary); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// windows doesn't allow to replace a running executable but does allow
+	// to rename it
+	old := executable + ".old"
+	_ = os.Remove(old)
+	if err := os.Rename(executable, old); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), executable); err != nil {
+		_ = os.Rename(old, executable)
+		return err
+	}
+	_ = os.Remove(old)
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+)
+
+func TestDownload(t *testing.T) {
+	var (
+		build  = utils.BuildInfo{OS: "linux", Arch: "mipsle", Mips: "softfloat"}
+		binary = []byte("new forwarder binary")
+		dir    = t.TempDir()
+		asset  = filepath.Join(dir, AssetName("v1.2.3", build))
+	)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	_ = tw.WriteHeader(&tar.Header{Name: "forwarder", Mode: 0755, Size: int64(len(binary)), Typeflag: tar.TypeReg})
+	_, _ = tw.Write(binary)
+	_ = tw.Close()
+	_ = gz.Close()
+	if err := os.WriteFile(asset, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checksums, signature, err := Checksums(priv, []string{asset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"/v1.2.3/" + ChecksumsFile:        checksums,
+		"/v1.2.3/" + SignatureFile:        signature,
+		"/v1.2.3/" + filepath.Base(asset): archive.Bytes(),
+		"/latest":                         []byte(`{"tag_name": "v1.2.3"}`),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if content, ok := files[r.URL.Path]; ok {
+			_, _ = w.Write(content)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	updater, err := New(hex.EncodeToString(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater.ReleaseURL = srv.URL + "/{version}"
+	updater.LatestURL = srv.URL + "/latest"
+
+	ctx := context.Background()
+	if version, err := updater.Latest(ctx); err != nil || version != "v1.2.3" {
+		t.Fatalf("unexpected latest version %q: %v", version, err)
+	}
+	got, err := updater.Download(ctx, "v1.2.3", build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, binary) {
+		t.Errorf("unexpected binary %q", got)
+	}
+
+	// tampered archive
+	files["/v1.2.3/"+filepath.Base(asset)] = append(archive.Bytes(), 0)
+	if _, err := updater.Download(ctx, "v1.2.3", build); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+
+	// release signed by another key
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	updater.PublicKey = otherPub
+	if _, err := updater.Download(ctx, "v1.2.3", build); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected invalid signature, got %v", err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	executable := filepath.Join(t.TempDir(), "forwarder")
+	if err := os.WriteFile(executable, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Replace(executable, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(executable)
+	if err != nil || string(got) != "new" {
+		t.Fatalf("unexpected executable %q: %v", got, err)
+	}
+	if info, err := os.Stat(executable); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected executable mode: %v", err)
+	}
+}
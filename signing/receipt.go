@@ -0,0 +1,111 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+)
+
+const (
+	// OfferHeader is the stream header in which a forwarder lists the
+	// schemes it offers in order of preference.
+	OfferHeader = "thingsix-signing-schemes"
+	// SelectHeader is the stream header in which a router returns the
+	// scheme it selected from the offer.
+	SelectHeader = "thingsix-signing-scheme"
+)
+
+const (
+	// ReceiptSchemeMetadata is the uplink metadata key with the scheme of
+	// the airtime receipt signature.
+	ReceiptSchemeMetadata = "thingsix_receipt_scheme"
+	// ReceiptPublicKeyMetadata is the uplink metadata key with the hex
+	// encoded public key that verifies the airtime receipt signature.
+	ReceiptPublicKeyMetadata = "thingsix_receipt_public_key"
+	// ReceiptSignatureMetadata is the uplink metadata key with the hex
+	// encoded airtime receipt signature.
+	ReceiptSignatureMetadata = "thingsix_receipt_signature"
+)
+
+// receiptDomain separates airtime receipt signatures from other messages
+// signed with the gateway key.
+const receiptDomain = "thingsix-airtime-receipt-v1"
+
+// ErrInvalidReceiptSignature is returned when an airtime receipt signature
+// doesn't verify.
+var ErrInvalidReceiptSignature = errs.New(errs.ErrInvalidArgument, "invalid airtime receipt signature")
+
+// ReceiptMessage returns the message a gateway signs to confirm it received
+// the frame with phyPayload and charges airtime to the router for it.
+func ReceiptMessage(phyPayload, owner []byte, airtime uint32) []byte {
+	msg := make([]byte, 0, len(receiptDomain)+len(owner)+4+len(phyPayload))
+	msg = append(msg, receiptDomain...)
+	msg = append(msg, owner...)
+	msg = binary.BigEndian.AppendUint32(msg, airtime)
+	return append(msg, phyPayload...)
+}
+
+// SignReceipt signs the airtime receipt with signer and sets the signature,
+// its scheme and public key in metadata.
+func SignReceipt(signer Signer, metadata map[string]string, phyPayload, owner []byte, airtime uint32) error {
+	sig, err := signer.Sign(ReceiptMessage(phyPayload, owner, airtime))
+	if err != nil {
+		return err
+	}
+	metadata[ReceiptSchemeMetadata] = signer.Scheme()
+	metadata[ReceiptPublicKeyMetadata] = hex.EncodeToString(signer.PublicKey())
+	metadata[ReceiptSignatureMetadata] = hex.EncodeToString(sig)
+	return nil
+}
+
+// VerifyReceipt verifies the airtime receipt signature in metadata. It
+// returns false without error when the receipt isn't signed, forwarders that
+// predate receipt signatures don't sign. Secp256k1 signatures must be made
+// with the gateway key. Ed25519 keys are derived from the gateway key and
+// can't be related to it by the router, they are verified with the key in
+// metadata.
+func VerifyReceipt(gatewayPublicKey []byte, metadata map[string]string, phyPayload, owner []byte, airtime uint32) (bool, error) {
+	scheme, ok := metadata[ReceiptSchemeMetadata]
+	if !ok {
+		return false, nil
+	}
+	publicKey, err := hex.DecodeString(metadata[ReceiptPublicKeyMetadata])
+	if err != nil {
+		return true, fmt.Errorf("%w: invalid public key", ErrInvalidReceiptSignature)
+	}
+	sig, err := hex.DecodeString(metadata[ReceiptSignatureMetadata])
+	if err != nil {
+		return true, fmt.Errorf("%w: invalid signature encoding", ErrInvalidReceiptSignature)
+	}
+	if scheme == Secp256k1 && !bytes.Equal(publicKey, gatewayPublicKey) {
+		return true, fmt.Errorf("%w: not signed with the gateway key", ErrInvalidReceiptSignature)
+	}
+
+	valid, err := Verify(scheme, publicKey, ReceiptMessage(phyPayload, owner, airtime), sig)
+	if err != nil {
+		return true, err
+	}
+	if !valid {
+		return true, ErrInvalidReceiptSignature
+	}
+	return true, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package signing abstracts the signature schemes gateways use to sign
+// packets and receipts. Schemes are identified by name and negotiated with
+// routers so new schemes can be introduced without breaking routers that
+// only support the original secp256k1 signatures.
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// Secp256k1 signs the SHA256 digest of the message with the gateway key
+	// and produces a 65 byte [R || S || V] signature. It is the original
+	// ThingsIX scheme and supported by all routers.
+	Secp256k1 = "secp256k1"
+	// Ed25519 signs the message with an Ed25519 key that is derived from the
+	// gateway key and produces a 64 byte signature.
+	Ed25519 = "ed25519"
+)
+
+var (
+	// ErrUnsupportedScheme is returned when a scheme is not known.
+	ErrUnsupportedScheme = errs.New(errs.ErrNotSupported, "unsupported signature scheme")
+	// ErrNoCommonScheme is returned when negotiation doesn't result in a
+	// scheme both parties support.
+	ErrNoCommonScheme = errs.New(errs.ErrNotSupported, "no common signature scheme")
+)
+
+// ed25519SeedDomain separates the Ed25519 seed derivation from other uses of
+// the gateway key.
+const ed25519SeedDomain = "thingsix-ed25519-v1"
+
+// Signer signs messages on behalf of a gateway.
+type Signer interface {
+	// Scheme returns the name of the signature scheme.
+	Scheme() string
+	// PublicKey returns the encoded public key that verifies signatures.
+	PublicKey() []byte
+	// Sign returns the signature over msg.
+	Sign(msg []byte) ([]byte, error)
+}
+
+// Schemes returns all supported schemes in order of preference.
+func Schemes() []string {
+	return []string{Ed25519, Secp256k1}
+}
+
+// NewSigner returns a signer for the given scheme that uses the gateway key.
+func NewSigner(scheme string, key *ecdsa.PrivateKey) (Signer, error) {
+	switch scheme {
+	case Secp256k1:
+		return secp256k1Signer{key: key}, nil
+	case Ed25519:
+		return newEd25519Signer(key), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
+	}
+}
+
+// Verify returns an indication if sig is a valid signature over msg for the
+// given scheme and public key.
+func Verify(scheme string, publicKey, msg, sig []byte) (bool, error) {
+	switch scheme {
+	case Secp256k1:
+		if len(sig) != crypto.SignatureLength {
+			return false, nil
+		}
+		h := sha256.Sum256(msg)
+		return crypto.VerifySignature(publicKey, h[:], sig[:64]), nil
+	case Ed25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return false, nil
+		}
+		return ed25519.Verify(publicKey, msg, sig), nil
+	default:
+		return false, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
+	}
+}
+
+// Negotiate returns the first scheme in preferred that is also in offered.
+// If offered is empty the peer predates negotiation and secp256k1 is used.
+func Negotiate(preferred, offered []string) (string, error) {
+	if len(offered) == 0 {
+		return Secp256k1, nil
+	}
+	for _, p := range preferred {
+		for _, o := range offered {
+			if strings.EqualFold(p, strings.TrimSpace(o)) {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: offered %s", ErrNoCommonScheme, strings.Join(offered, ","))
+}
+
+// ParseSchemes parses a comma separated list of scheme names and returns an
+// error if any of them is not supported.
+func ParseSchemes(list []string) ([]string, error) {
+	var schemes []string
+	for _, entry := range list {
+		for _, name := range strings.Split(entry, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if name != Secp256k1 && name != Ed25519 {
+				return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, name)
+			}
+			schemes = append(schemes, name)
+		}
+	}
+	return schemes, nil
+}
+
+type secp256k1Signer struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s secp256k1Signer) Scheme() string { return Secp256k1 }
+
+func (s secp256k1Signer) PublicKey() []byte {
+	return crypto.CompressPubkey(&s.key.PublicKey)
+}
+
+func (s secp256k1Signer) Sign(msg []byte) ([]byte, error) {
+	h := sha256.Sum256(msg)
+	return crypto.Sign(h[:], s.key)
+}
+
+// NewSecp256k1DigestSigner returns a secp256k1 signer for a key that is held
+// outside the process, such as in a HSM. The SHA256 digest of the message is
+// passed to sign, which must return a 65 byte [R || S || V] signature.
+func NewSecp256k1DigestSigner(pub *ecdsa.PublicKey, sign func(digest []byte) ([]byte, error)) Signer {
+	return secp256k1DigestSigner{pub: pub, sign: sign}
+}
+
+type secp256k1DigestSigner struct {
+	pub  *ecdsa.PublicKey
+	sign func(digest []byte) ([]byte, error)
+}
+
+func (s secp256k1DigestSigner) Scheme() string { return Secp256k1 }
+
+func (s secp256k1DigestSigner) PublicKey() []byte {
+	return crypto.CompressPubkey(s.pub)
+}
+
+func (s secp256k1DigestSigner) Sign(msg []byte) ([]byte, error) {
+	h := sha256.Sum256(msg)
+	return s.sign(h[:])
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+// newEd25519Signer derives the Ed25519 key deterministically from the
+// gateway key, gateways therefore don't need to store an additional key.
+func newEd25519Signer(key *ecdsa.PrivateKey) ed25519Signer {
+	seed := sha256.Sum256(append([]byte(ed25519SeedDomain), crypto.FromECDSA(key)...))
+	return ed25519Signer{key: ed25519.NewKeyFromSeed(seed[:])}
+}
+
+func (s ed25519Signer) Scheme() string { return Ed25519 }
+
+func (s ed25519Signer) PublicKey() []byte {
+	return []byte(s.key.Public().(ed25519.PublicKey))
+}
+
+func (s ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, msg), nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSignVerify(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("packet receipt")
+
+	for _, scheme := range Schemes() {
+		signer, err := NewSigner(scheme, key)
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		sig, err := signer.Sign(msg)
+		if err != nil {
+			t.Fatalf("%s: sign: %v", scheme, err)
+		}
+		if ok, err := Verify(scheme, signer.PublicKey(), msg, sig); err != nil || !ok {
+			t.Errorf("%s: valid signature rejected: %v", scheme, err)
+		}
+		if ok, _ := Verify(scheme, signer.PublicKey(), []byte("other"), sig); ok {
+			t.Errorf("%s: signature over other message accepted", scheme)
+		}
+	}
+}
+
+func TestEd25519KeyDeterministic(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := NewSigner(Ed25519, key)
+	b, _ := NewSigner(Ed25519, key)
+	if string(a.PublicKey()) != string(b.PublicKey()) {
+		t.Error("ed25519 key derivation not deterministic")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		offered  []string
+		expected string
+		err      error
+	}{
+		{nil, Secp256k1, nil},
+		{[]string{"secp256k1"}, Secp256k1, nil},
+		{[]string{"secp256k1", "ED25519"}, Ed25519, nil},
+		{[]string{"rsa"}, "", ErrNoCommonScheme},
+	}
+	for _, tt := range tests {
+		got, err := Negotiate(Schemes(), tt.offered)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("negotiate %v: unexpected error %v", tt.offered, err)
+		}
+		if got != tt.expected {
+			t.Errorf("negotiate %v: got %q, expected %q", tt.offered, got, tt.expected)
+		}
+	}
+}
+
+func TestVerifyReceipt(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		gatewayPublicKey = crypto.CompressPubkey(&key.PublicKey)
+		phy              = []byte{0x40, 0xda, 0x1b, 0x01, 0x26, 0x00, 0x01, 0x00}
+		owner            = []byte("gateway owner address")
+	)
+
+	if signed, err := VerifyReceipt(gatewayPublicKey, map[string]string{}, phy, owner, 41); signed || err != nil {
+		t.Errorf("unsigned receipt: signed=%v, err=%v", signed, err)
+	}
+
+	for _, scheme := range Schemes() {
+		signer, _ := NewSigner(scheme, key)
+		md := make(map[string]string)
+		if err := SignReceipt(signer, md, phy, owner, 41); err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if signed, err := VerifyReceipt(gatewayPublicKey, md, phy, owner, 41); !signed || err != nil {
+			t.Errorf("%s: valid receipt rejected: %v", scheme, err)
+		}
+		if _, err := VerifyReceipt(gatewayPublicKey, md, phy, owner, 42); !errors.Is(err, ErrInvalidReceiptSignature) {
+			t.Errorf("%s: receipt with other airtime accepted: %v", scheme, err)
+		}
+	}
+
+	// secp256k1 receipts must be signed with the gateway key
+	signer, _ := NewSigner(Secp256k1, other)
+	md := make(map[string]string)
+	if err := SignReceipt(signer, md, phy, owner, 41); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyReceipt(gatewayPublicKey, md, phy, owner, 41); !errors.Is(err, ErrInvalidReceiptSignature) {
+		t.Errorf("receipt signed with other key accepted: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing sets up OpenTelemetry tracing for the forwarder and router.
+// The trace context of a packet is carried in the uplink frame metadata, this
+// metadata travels with the frame from the forwarder through the router to
+// ChirpStack. That allows the spans of all components to be joined into a
+// single trace per packet.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ThingsIXFoundation/packet-handling/utils"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// Config describes the OTLP collector spans are exported to.
+type Config struct {
+	// Endpoint is the OTLP gRPC collector address (default: localhost:4317)
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure disables TLS for the connection to the collector
+	Insecure bool `mapstructure:"insecure"`
+	// Headers are sent with each export request, e.g. for authentication
+	Headers map[string]string `mapstructure:"headers"`
+	// SampleRatio is the fraction of packets that start a new trace
+	// (default: 1). Packets that already carry a trace context follow the
+	// sampling decision of their parent.
+	SampleRatio *float64 `mapstructure:"sample_ratio"`
+}
+
+// propagator reads and writes the W3C trace context.
+var propagator = propagation.TraceContext{}
+
+// Setup installs the global tracer provider that exports spans for the
+// given service according to cfg. The returned func flushes pending spans
+// and must be called on shutdown. If cfg is nil tracing is disabled and all
+// spans are discarded.
+func Setup(ctx context.Context, service string, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	if cfg == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var (
+		endpoint = "localhost:4317"
+		ratio    = 1.0
+		opts     []otlptracegrpc.Option
+	)
+	if cfg.Endpoint != "" {
+		endpoint = cfg.Endpoint
+	}
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("invalid tracing sample ratio %g, must be between 0 and 1", ratio)
+	}
+
+	opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+
+	version, _ := utils.Info()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(service),
+			semconv.ServiceVersion(version))))
+	otel.SetTracerProvider(provider)
+
+	logrus.WithFields(logrus.Fields{
+		"endpoint":     endpoint,
+		"sample_ratio": ratio,
+	}).Info("export traces")
+
+	return provider.Shutdown, nil
+}
+
+// metadataCarrier exposes frame metadata as trace context carrier.
+type metadataCarrier map[string]string
+
+func (m metadataCarrier) Get(key string) string {
+	return m[key]
+}
+
+func (m metadataCarrier) Set(key string, value string) {
+	m[key] = value
+}
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// InjectMetadata writes the trace context of ctx into the given frame
+// metadata. Nothing is written when ctx holds no sampled span.
+func InjectMetadata(ctx context.Context, metadata map[string]string) {
+	if metadata == nil {
+		return
+	}
+	propagator.Inject(ctx, metadataCarrier(metadata))
+}
+
+// ExtractMetadata returns a copy of ctx with the trace context read from the
+// given frame metadata.
+func ExtractMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return propagator.Extract(ctx, metadataCarrier(metadata))
+}
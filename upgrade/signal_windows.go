@@ -0,0 +1,30 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build windows
+
+package upgrade
+
+import "os"
+
+// supported indicates if sockets can be passed to a child process.
+const supported = false
+
+// Signals returns the signals that trigger an upgrade, on windows there are
+// none since sockets can't be passed to a child process.
+func Signals() []os.Signal {
+	return nil
+}
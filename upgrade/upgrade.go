@@ -0,0 +1,343 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upgrade implements zero-downtime binary upgrades. The running
+// process re-executes its binary and passes the listener sockets it owns to
+// the new process. The new process reuses these sockets instead of binding
+// new ones and signals the old process when it is ready, after which the old
+// process can shut down. Gateways keep sending to the same socket and don't
+// notice that the process behind it was replaced.
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThingsIXFoundation/packet-handling/errs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envInheritedFDs holds the list of sockets passed from the parent, in
+	// the form <network>:<address>=<fd>,...
+	envInheritedFDs = "THINGSIX_UPGRADE_FDS"
+	// envReadyFD holds the file descriptor the child writes to when it is
+	// ready to take over.
+	envReadyFD = "THINGSIX_UPGRADE_READY_FD"
+)
+
+var (
+	// ErrUpgradeInProgress is returned when an upgrade is requested while a
+	// previous upgrade has not yet finished.
+	ErrUpgradeInProgress = errs.New(errs.ErrAlreadyExists, "upgrade already in progress")
+	// ErrUpgradeNotSupported is returned on platforms that cannot pass
+	// sockets to a child process.
+	ErrUpgradeNotSupported = errs.New(errs.ErrNotSupported, "upgrade not supported on this platform")
+)
+
+// Upgrader keeps track of the listener sockets in use by this process so they
+// can be handed over to a new process.
+type Upgrader struct {
+	mu sync.Mutex
+	// inherited holds sockets received from the parent process that are not
+	// yet claimed by a listener in this process
+	inherited map[string]*os.File
+	// active holds duplicates of all sockets in use by this process, these
+	// are passed to the child on upgrade
+	active map[string]*os.File
+	// ready is the pipe to signal the parent that this process has started,
+	// nil if this process was not started through an upgrade
+	ready *os.File
+	// upgrading is set when an upgrade is in progress
+	upgrading bool
+	// readyTimeout is how long to wait for the child to become ready
+	readyTimeout time.Duration
+}
+
+var (
+	defaultOnce     sync.Once
+	defaultUpgrader *Upgrader
+)
+
+// Default returns the process wide upgrader that is initialized from the
+// environment this process was started with.
+func Default() *Upgrader {
+	defaultOnce.Do(func() {
+		u, err := New()
+		if err != nil {
+			logrus.WithError(err).Warn("unable to load sockets from parent process, bind new sockets")
+			u = &Upgrader{
+				inherited:    make(map[string]*os.File),
+				active:       make(map[string]*os.File),
+				readyTimeout: time.Minute,
+			}
+		}
+		defaultUpgrader = u
+	})
+	return defaultUpgrader
+}
+
+// New returns an upgrader that loads the sockets passed by a parent process
+// from the environment.
+func New() (*Upgrader, error) {
+	u := &Upgrader{
+		inherited:    make(map[string]*os.File),
+		active:       make(map[string]*os.File),
+		readyTimeout: time.Minute,
+	}
+
+	if fds := os.Getenv(envInheritedFDs); fds != "" {
+		for _, entry := range strings.Split(fds, ",") {
+			sep := strings.LastIndex(entry, "=")
+			if sep < 0 {
+				return nil, fmt.Errorf("invalid inherited socket %q", entry)
+			}
+			fd, err := strconv.Atoi(entry[sep+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid inherited socket %q", entry)
+			}
+			u.inherited[entry[:sep]] = os.NewFile(uintptr(fd), entry[:sep])
+		}
+	}
+
+	if readyFD := os.Getenv(envReadyFD); readyFD != "" {
+		fd, err := strconv.Atoi(readyFD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ready fd %q", readyFD)
+		}
+		u.ready = os.NewFile(uintptr(fd), "ready")
+	}
+
+	// don't leak upgrade state to processes started by this process
+	_ = os.Unsetenv(envInheritedFDs)
+	_ = os.Unsetenv(envReadyFD)
+
+	return u, nil
+}
+
+// HasParent returns an indication if this process was started by an upgrade.
+func (u *Upgrader) HasParent() bool {
+	return u.ready != nil
+}
+
+// ListenUDP returns an UDP socket bound to the given addr. If the parent
+// process passed a socket for this address it is reused.
+func (u *Upgrader) ListenUDP(addr string) (*net.UDPConn, error) {
+	key := "udp:" + addr
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		conn, err := net.FilePacketConn(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to reuse inherited socket %s: %w", key, err)
+		}
+		udpConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			_ = conn.Close()
+			return nil, fmt.Errorf("inherited socket %s is not an UDP socket", key)
+		}
+		logrus.WithField("addr", addr).Info("reuse UDP socket from parent process")
+		return udpConn, u.track(key, udpConn)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, u.track(key, conn)
+}
+
+// Listen returns a stream listener bound to the given addr. If the parent
+// process passed a listener for this address it is reused.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	key := network + ":" + addr
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to reuse inherited listener %s: %w", key, err)
+		}
+		logrus.WithField("addr", addr).Info("reuse listener from parent process")
+		return ln, u.track(key, ln)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return ln, u.track(key, ln)
+}
+
+// track keeps a duplicate of the socket so it can be passed to a child even
+// after the original socket is closed in this process.
+func (u *Upgrader) track(key string, sock interface{}) error {
+	filer, ok := sock.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil
+	}
+	f, err := filer.File()
+	if err != nil {
+		// not fatal, this socket can't be passed to a new process
+		logrus.WithError(err).WithField("socket", key).Warn("socket can't be handed over on upgrade")
+		return nil
+	}
+	if old, ok := u.active[key]; ok {
+		_ = old.Close()
+	}
+	u.active[key] = f
+	return nil
+}
+
+// Ready must be called when this process is fully started. If it was started
+// through an upgrade it signals the parent process that it can stop. Sockets
+// passed by the parent that were not claimed are closed.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, f := range u.inherited {
+		logrus.WithField("socket", key).Info("close unused socket from parent process")
+		_ = f.Close()
+		delete(u.inherited, key)
+	}
+
+	if u.ready == nil {
+		return nil
+	}
+	defer func() {
+		_ = u.ready.Close()
+		u.ready = nil
+	}()
+
+	if _, err := u.ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("unable to signal parent process: %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts a new instance of the running binary with the same arguments
+// and passes all active sockets to it. It returns after the new process has
+// signalled it is ready, the caller is expected to shutdown afterwards. If the
+// new process fails to start or doesn't become ready in time an error is
+// returned and the caller must continue as normal.
+func (u *Upgrader) Upgrade() error {
+	if !supported {
+		return ErrUpgradeNotSupported
+	}
+
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.upgrading = true
+
+	var (
+		files   []*os.File
+		entries []string
+	)
+	for key, f := range u.active {
+		// fd 0, 1 and 2 are stdin, stdout and stderr, extra files start at 3
+		entries = append(entries, fmt.Sprintf("%s=%d", key, 3+len(files)))
+		files = append(files, f)
+	}
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to determine executable: %w", err)
+	}
+
+	readR, readW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("unable to create ready pipe: %w", err)
+	}
+	defer readR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readW)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", envInheritedFDs, strings.Join(entries, ",")),
+		fmt.Sprintf("%s=%d", envReadyFD, 3+len(files)))
+
+	logrus.WithFields(logrus.Fields{
+		"executable": executable,
+		"sockets":    len(files),
+	}).Info("start upgraded process")
+
+	if err := cmd.Start(); err != nil {
+		_ = readW.Close()
+		return fmt.Errorf("unable to start new process: %w", err)
+	}
+	// only the child must hold the write end, this ensures the read below
+	// returns when the child exits before it signalled readiness
+	_ = readW.Close()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readR.Read(buf); err != nil {
+			ready <- fmt.Errorf("new process exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return err
+		}
+		logrus.WithField("pid", cmd.Process.Pid).Info("upgraded process ready")
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("new process exited: %v", err)
+	case <-time.After(u.readyTimeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process not ready within %s", u.readyTimeout)
+	}
+}
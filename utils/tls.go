@@ -0,0 +1,141 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSKeyPair is a certificate and key loaded from files. The files are
+// loaded again when they changed, e.g. for short lived SPIFFE certificates
+// that are rotated by a workload agent.
+type TLSKeyPair struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// LoadTLSKeyPair loads the certificate and key from the given files.
+func LoadTLSKeyPair(certFile, keyFile string) (*TLSKeyPair, error) {
+	pair := &TLSKeyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := pair.Certificate(); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// Certificate returns the certificate, it is loaded again when one of the
+// files changed. When the changed files can't be loaded, e.g. because only
+// the certificate is written yet, the previous certificate is returned.
+func (p *TLSKeyPair) Certificate() (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	modified, err := lastModified(p.certFile, p.keyFile)
+	if err != nil && p.cert == nil {
+		return nil, err
+	}
+	if err != nil || !modified.After(p.modified) {
+		return p.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		if p.cert == nil {
+			return nil, err
+		}
+		return p.cert, nil
+	}
+	p.cert, p.modified = &cert, modified
+	return p.cert, nil
+}
+
+func lastModified(files ...string) (time.Time, error) {
+	var last time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// LoadCertPool returns a pool with the PEM encoded certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no CA certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// SPIFFEVerifier returns a function for tls.Config.VerifyConnection that
+// accepts peers with a certificate chain up to roots and one of the given
+// SPIFFE IDs as URI SAN. SPIFFE certificates identify a workload instead of a
+// host, the host name of the peer is therefore not verified. Nil roots uses
+// the system roots. Usage is the extended key usage the peer certificate must
+// allow.
+func SPIFFEVerifier(ids []string, roots *x509.CertPool, usage x509.ExtKeyUsage) (func(tls.ConnectionState) error, error) {
+	accepted := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		u, err := url.Parse(id)
+		if err != nil || u.Scheme != "spiffe" || u.Host == "" {
+			return nil, fmt.Errorf("invalid SPIFFE ID %q", id)
+		}
+		accepted[u.String()] = struct{}{}
+	}
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("peer didn't present a certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		}); err != nil {
+			return err
+		}
+		for _, uri := range leaf.URIs {
+			if _, ok := accepted[uri.String()]; ok && uri.Scheme == "spiffe" {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer certificate has none of the accepted SPIFFE IDs")
+	}, nil
+}
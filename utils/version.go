@@ -16,11 +16,19 @@
 
 package utils
 
-import "fmt"
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
 
 var version = "develop"
 var commit = "unknown"
 
+// releasePublicKey is the hex encoded Ed25519 key that signs the checksums of
+// release artifacts, it is set at build time.
+var releasePublicKey = ""
+
 func Version() string {
 	return fmt.Sprintf("%s (commit: %s)", version, commit)
 }
@@ -28,3 +36,55 @@ func Version() string {
 func Info() (string, string) {
 	return version, commit
 }
+
+// ReleasePublicKey returns the hex encoded Ed25519 key that release checksums
+// are signed with, or an empty string if the binary was built without it.
+func ReleasePublicKey() string {
+	return releasePublicKey
+}
+
+// BuildInfo describes how the running binary was built.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	// Arm and Mips hold the GOARM and GOMIPS variant, if applicable
+	Arm  string `json:"arm,omitempty"`
+	Mips string `json:"mips,omitempty"`
+	// CommitTime and Modified are taken from the VCS information that the go
+	// toolchain embeds
+	CommitTime string `json:"commitTime,omitempty"`
+	Modified   bool   `json:"modified"`
+}
+
+// Build returns the build information of the running binary.
+func Build() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "GOARM":
+				info.Arm = setting.Value
+			case "GOMIPS":
+				info.Mips = setting.Value
+			case "vcs.revision":
+				if info.Commit == "unknown" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				info.CommitTime = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
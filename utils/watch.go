@@ -0,0 +1,134 @@
+// Copyright 2023 Stichting ThingsIX Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// fileSettleDelay is how long changes to a watched file must settle
+	// before it is reported, editors and tools often write a file in steps
+	fileSettleDelay = time.Second
+	// filePollInterval is how often a file is checked for changes when the
+	// file system can't be watched
+	filePollInterval = 10 * time.Second
+)
+
+// WatchFile returns a channel that receives a value each time the file at
+// path changed. The directory of the file is watched because the file is
+// often replaced instead of written in place. If the file system can't be
+// watched the file is polled for changes. Problems are logged to log.
+func WatchFile(ctx context.Context, path string, log logrus.FieldLogger) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default: // change already pending
+		}
+	}
+
+	log = log.WithField("file", path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			_ = watcher.Close()
+		}
+	}
+	if err != nil {
+		log.WithError(err).Warn("unable to watch file, poll for changes")
+		go pollFile(ctx, path, notify)
+		return changed
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var (
+			path    = filepath.Clean(path)
+			settle  = time.NewTimer(fileSettleDelay)
+			settled = false
+		)
+		settle.Stop()
+
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != path || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				if !settled && !settle.Stop() {
+					select {
+					case <-settle.C:
+					default:
+					}
+				}
+				settled = false
+				settle.Reset(fileSettleDelay)
+			case <-settle.C:
+				settled = true
+				notify()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("error while watching file")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changed
+}
+
+// pollFile calls notify when the modification time or size of the file at
+// path changed.
+func pollFile(ctx context.Context, path string, notify func()) {
+	var (
+		ticker = time.NewTicker(filePollInterval)
+		last   os.FileInfo
+	)
+	defer ticker.Stop()
+
+	last, _ = os.Stat(path)
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+				notify()
+			}
+			last = info
+		case <-ctx.Done():
+			return
+		}
+	}
+}